@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+
+	"github.com/pivaldi/tmd/internal/addrbook"
+	"github.com/pivaldi/tmd/internal/keyid"
+)
+
+// With --addressbook, the peers nodes announce are kept in a file sealed
+// under a key derived from the seed: keys, last addresses, trust (with
+// --pins) and a note of the user's (/note). On start, the peers of the
+// book that no node announced yet are put in the peer table, so they can
+// be dialed at their last addresses, or queued for, without a node. The
+// book is a cache, not a trust anchor: keys read back from it are checked
+// against the pins like those of a node. /book lists it, /forget drops a
+// peer.
+
+func (p *connPool) setAddressBook(b *addrbook.Book) {
+	p.book = b
+}
+
+// loadAddressBook puts the peers of b missing from pt in it.
+func loadAddressBook(pt *PeerTable, b *addrbook.Book) []error {
+	var errs []error
+	for _, e := range b.Entries() {
+		if _, ok := pt.Get(PeerID(e.Nickname)); ok {
+			continue
+		}
+		info, err := peerInfoFromBook(e)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.Nickname, err))
+			continue
+		}
+		pt.Add(info)
+	}
+	return errs
+}
+
+// peerInfoFromBook converts an address book entry to a PeerInfo.
+func peerInfoFromBook(e addrbook.Entry) (PeerInfo, error) {
+	id, err := peer.Decode(e.PeerID)
+	if err != nil {
+		return PeerInfo{}, err
+	}
+	kid, err := keyid.Resolve(e.KeyID, e.HPKEPub)
+	if err != nil {
+		return PeerInfo{}, err
+	}
+	addrs := make([]multiaddr.Multiaddr, 0, len(e.Addrs))
+	for _, s := range e.Addrs {
+		a, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return PeerInfo{}, err
+		}
+		addrs = append(addrs, a)
+	}
+	return PeerInfo{
+		Nickname: PeerID(e.Nickname),
+		PeerID:   id,
+		Addrs:    addrs,
+		HPKEPub:  e.HPKEPub,
+		KeyID:    kid,
+	}, nil
+}
+
+// rememberPeer writes what a node announced of a peer to the address
+// book, if --addressbook is set.
+func (p *connPool) rememberPeer(info PeerInfo) {
+	if p.book == nil {
+		return
+	}
+	addrs := make([]string, len(info.Addrs))
+	for i, a := range info.Addrs {
+		addrs[i] = a.String()
+	}
+	err := p.book.Put(addrbook.Entry{
+		Nickname: string(info.Nickname),
+		PeerID:   info.PeerID.String(),
+		HPKEPub:  info.HPKEPub,
+		KeyID:    info.KeyID,
+		Addrs:    addrs,
+		Trust:    p.peerTrust(info),
+		Seen:     time.Now().UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		p.console.Errorf("address book: %v", err)
+	}
+}
+
+// rememberTrust records a new trust state of peer in the address book.
+func (p *connPool) rememberTrust(peer PeerID, trust string) {
+	if p.book == nil || trust == "" {
+		return
+	}
+	if err := p.book.SetTrust(string(peer), trust); err != nil {
+		p.console.Errorf("address book: %v", err)
+	}
+}
+
+// runBook handles "/book [peer]": the peers of the address book, or one
+// of them with its addresses.
+func runBook(c Console, pool *connPool, args string) {
+	if pool.book == nil {
+		c.Printf("[book] no address book (see --addressbook)")
+		return
+	}
+	if args != "" {
+		e, ok := pool.book.Get(args)
+		if !ok {
+			c.Errorf("%s is not in the address book", args)
+			return
+		}
+		c.Printf("[book] %s%s", e.Nickname, bookMark(e))
+		c.Printf("  peerID: %s", e.PeerID)
+		c.Printf("  keyID:  %s", keyid.KeyID(e.KeyID))
+		for _, a := range e.Addrs {
+			c.Printf("  addr:   %s", a)
+		}
+		if e.Suite != "" {
+			c.Printf("  suite:  %s", e.Suite)
+		}
+		if e.Note != "" {
+			c.Printf("  note:   %s", e.Note)
+		}
+		return
+	}
+	list := pool.book.Entries()
+	if len(list) == 0 {
+		c.Printf("[book] empty")
+		return
+	}
+	for _, e := range list {
+		line := fmt.Sprintf("- %s%s keyID=%s", e.Nickname, bookMark(e), keyid.KeyID(e.KeyID))
+		if e.Note != "" {
+			line += ": " + e.Note
+		}
+		c.Printf("%s", line)
+	}
+}
+
+// bookMark shows the trust of an entry and when it was last announced.
+func bookMark(e addrbook.Entry) string {
+	var mark string
+	if e.Trust != "" {
+		mark = " [" + e.Trust + "]"
+	}
+	if !e.Seen.IsZero() {
+		mark += ", seen " + seenAgo(e.Seen)
+	}
+	return mark
+}
+
+// runNote handles "/note <peer> [text]": it sets the note on a peer of
+// the address book, or clears it.
+func runNote(c Console, pool *connPool, args string) {
+	name, text, _ := strings.Cut(args, " ")
+	if name == "" {
+		c.Errorf("usage: /note <peer> [text]")
+		return
+	}
+	if pool.book == nil {
+		c.Errorf("no address book (see --addressbook)")
+		return
+	}
+	text = strings.TrimSpace(text)
+	if err := pool.book.SetNote(name, text); err != nil {
+		c.Errorf("note: %v", err)
+		return
+	}
+	if text == "" {
+		c.Printf("[book] note on %s cleared", name)
+		return
+	}
+	c.Printf("[book] note on %s: %s", name, text)
+}
+
+// runForget handles "/forget <peer>": it drops a peer from the address
+// book.
+func runForget(c Console, pool *connPool, args string) {
+	if args == "" || strings.Contains(args, " ") {
+		c.Errorf("usage: /forget <peer>")
+		return
+	}
+	if pool.book == nil {
+		c.Errorf("no address book (see --addressbook)")
+		return
+	}
+	ok, err := pool.book.Remove(args)
+	switch {
+	case err != nil:
+		c.Errorf("forget: %v", err)
+	case !ok:
+		c.Errorf("%s is not in the address book", args)
+	default:
+		c.Printf("[book] %s forgotten", args)
+	}
+}
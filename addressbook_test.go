@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/multiformats/go-multiaddr"
+
+	"github.com/pivaldi/tmd/internal/addrbook"
+	"github.com/pivaldi/tmd/internal/conformance"
+	"github.com/pivaldi/tmd/internal/identity"
+	"github.com/pivaldi/tmd/internal/pins"
+)
+
+// TestAddressBook checks that a peer a node announced is back in the peer
+// table after a restart, with its keys, addresses, trust and note.
+func TestAddressBook(t *testing.T) {
+	bob, err := identity.DeriveKeysWith(conformance.Hex(bobSeed), seedDerivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "book")
+	seed := conformance.Hex(aliceSeed)
+	book, err := addrbook.Open(path, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := pins.OpenStore(filepath.Join(dir, "pins.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newHeadlessConsole()
+	pool := newTestPool("alice")
+	pool.setConsole(c)
+	pool.setPinStore(store)
+	pool.setAddressBook(book)
+
+	addr := multiaddr.StringCast("/ip4/192.0.2.1/tcp/4001")
+	info := PeerInfo{Nickname: "bob", PeerID: bob.PeerID, Addrs: []multiaddr.Multiaddr{addr}, HPKEPub: bob.HPKEPubBytes, KeyID: bob.KeyID}
+	if err := pool.observePeer(info); err != nil {
+		t.Fatal(err)
+	}
+	pool.rememberPeer(info)
+	if _, err := pool.verifyPeer("bob"); err != nil {
+		t.Fatal(err)
+	}
+	runNote(c, pool, "bob met at the conference")
+
+	// Restart: bob is reachable without a node.
+	book, err = addrbook.Open(path, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt := NewPeerTable()
+	pt.Add(PeerInfo{Nickname: "carol"})
+	if errs := loadAddressBook(pt, book); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	got, ok := pt.Get("bob")
+	if !ok {
+		t.Fatal("bob not loaded from the address book")
+	}
+	if got.PeerID != bob.PeerID || !bytes.Equal(got.HPKEPub, bob.HPKEPubBytes) || !got.KeyID.Matches(bob.KeyID) || len(got.Addrs) != 1 || !got.Addrs[0].Equal(addr) {
+		t.Fatalf("bob = %+v", got)
+	}
+	e, _ := book.Get("bob")
+	if e.Trust != peerVerified || e.Note != "met at the conference" {
+		t.Fatalf("entry = %+v, want verified with the note", e)
+	}
+	if _, ok := book.Get("carol"); ok {
+		t.Fatal("a peer never announced is in the book")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// preferredDialTimeout bounds the first dial attempt, restricted to the
+// addresses the node hints at, before falling back to every address.
+const preferredDialTimeout = 2 * time.Second
+
+// setRegion makes dials prefer addresses the node places in region.
+func (p *connPool) setRegion(region string) {
+	p.region = region
+}
+
+// preferredAddrs picks the addresses of to worth dialing first: those the
+// node places in region, or else the one with the lowest node-measured
+// latency. It returns nil when the hints single nothing out.
+func preferredAddrs(to PeerInfo, region string) []multiaddr.Multiaddr {
+	if len(to.Hints) != len(to.Addrs) {
+		return nil
+	}
+	var local []multiaddr.Multiaddr
+	if region != "" {
+		for i, h := range to.Hints {
+			if h.Region == region {
+				local = append(local, to.Addrs[i])
+			}
+		}
+	}
+	if len(local) > 0 && len(local) < len(to.Addrs) {
+		return local
+	}
+
+	best := -1
+	for i, h := range to.Hints {
+		if h.Latency > 0 && (best < 0 || h.Latency < to.Hints[best].Latency) {
+			best = i
+		}
+	}
+	if best < 0 || len(to.Addrs) == 1 {
+		return nil
+	}
+	return []multiaddr.Multiaddr{to.Addrs[best]}
+}
+
+// dialPreferred connects to the preferred addresses of to, if any, so that
+// the stream opened afterwards reuses that connection instead of racing
+// every advertised address. Failure is not an error: the caller then dials
+// all addresses.
+func (p *connPool) dialPreferred(ctx context.Context, to PeerInfo) {
+	pref := preferredAddrs(to, p.region)
+	if len(pref) == 0 || p.host.Network().Connectedness(to.PeerID) == network.Connected {
+		return
+	}
+	// The swarm dials every address in the peerstore, so hide the others
+	// for this attempt.
+	p.host.Peerstore().ClearAddrs(to.PeerID)
+	ctx, cancel := context.WithTimeout(ctx, preferredDialTimeout)
+	defer cancel()
+	_ = p.host.Connect(ctx, peer.AddrInfo{ID: to.PeerID, Addrs: pref})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multiaddr"
+	"github.com/pivaldi/tmd/internal/node"
+)
+
+func TestPreferredAddrs(t *testing.T) {
+	eu := multiaddr.StringCast("/ip4/10.1.0.5/tcp/9000")
+	us := multiaddr.StringCast("/ip4/10.2.0.5/tcp/9000")
+	pub := multiaddr.StringCast("/ip4/192.0.2.1/tcp/9000")
+	to := PeerInfo{
+		Addrs: []multiaddr.Multiaddr{eu, us, pub},
+		Hints: []node.AddrHint{
+			{Region: "eu-west"},
+			{Region: "us-east", Latency: 80 * time.Millisecond},
+			{Latency: 20 * time.Millisecond},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		to     PeerInfo
+		region string
+		want   []multiaddr.Multiaddr
+	}{
+		{"region match", to, "eu-west", []multiaddr.Multiaddr{eu}},
+		{"unknown region falls back to latency", to, "ap-south", []multiaddr.Multiaddr{pub}},
+		{"no region", to, "", []multiaddr.Multiaddr{pub}},
+		{"no hints", PeerInfo{Addrs: to.Addrs}, "eu-west", nil},
+		{"single address", PeerInfo{Addrs: to.Addrs[2:], Hints: to.Hints[2:]}, "", nil},
+		{"mismatched hints", PeerInfo{Addrs: to.Addrs, Hints: to.Hints[:1]}, "eu-west", nil},
+	}
+	for _, tt := range tests {
+		got := preferredAddrs(tt.to, tt.region)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if !got[i].Equal(tt.want[i]) {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pivaldi/tmd/internal/attest"
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+// loadExternalKey reads the OpenPGP or SSH public key named by exactly one
+// of the two flags.
+func loadExternalKey(sshPath, pgpPath string) (attest.ExternalKey, error) {
+	switch {
+	case sshPath != "" && pgpPath != "":
+		return nil, fmt.Errorf("use only one of --ssh and --pgp")
+	case sshPath != "":
+		data, err := os.ReadFile(sshPath)
+		if err != nil {
+			return nil, err
+		}
+		return attest.ParseSSHKey(data)
+	case pgpPath != "":
+		data, err := os.ReadFile(pgpPath)
+		if err != nil {
+			return nil, err
+		}
+		return attest.ParsePGPKey(data)
+	default:
+		return nil, fmt.Errorf("--ssh or --pgp is required")
+	}
+}
+
+// runAttest writes an attestation binding the tmd identity to an existing
+// OpenPGP or SSH key; the user then signs it with that key.
+func runAttest(args []string) error {
+	fs := flag.NewFlagSet("attest", flag.ExitOnError)
+	var seedSel seedFlags
+	addSeedFlags(fs, &seedSel, "path to seed file, or keyring:<name> for an OS keyring entry (required, or --identity)")
+	nick := fs.String("nick", "", "nickname to attest (required)")
+	sshPath := fs.String("ssh", "", "SSH Ed25519 public key, e.g. ~/.ssh/id_ed25519.pub")
+	pgpPath := fs.String("pgp", "", "armored OpenPGP public key")
+	outPath := fs.String("out", "", "output path (default: <nick>.tmd-attest)")
+	fs.Parse(args)
+
+	if !seedSel.set() || *nick == "" {
+		return fmt.Errorf("--seed (or --identity) and --nick are required")
+	}
+	seedPath, err := seedSel.path(false)
+	if err != nil {
+		return err
+	}
+	ext, err := loadExternalKey(*sshPath, *pgpPath)
+	if err != nil {
+		return err
+	}
+	f, err := identity.LoadSeedFile(seedPath)
+	if err != nil {
+		return err
+	}
+	keys, err := f.DeriveKeys()
+	if err != nil {
+		return fmt.Errorf("derive keys: %w", err)
+	}
+
+	if *outPath == "" {
+		*outPath = *nick + ".tmd-attest"
+	}
+	data := attest.Create(attest.Statement{
+		Nickname: *nick,
+		PeerID:   keys.PeerID,
+		HPKEPub:  keys.HPKEPubBytes,
+		KeyID:    keys.KeyID,
+		External: ext.Fingerprint(),
+	}, keys.Ed25519Priv)
+	if err := os.WriteFile(*outPath, data, 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Attestation written to %s\n", *outPath)
+	fmt.Println("Sign it with the attested key and distribute both files:")
+	if *sshPath != "" {
+		fmt.Printf("  ssh-keygen -Y sign -n %s -f <private key> %s\n", attest.Namespace, *outPath)
+	} else {
+		fmt.Printf("  gpg --armor --detach-sign %s\n", *outPath)
+	}
+	return nil
+}
+
+// runTrust verifies a signed attestation against a known OpenPGP or SSH
+// key and records the tmd identity in the trust store.
+func runTrust(args []string) error {
+	fs := flag.NewFlagSet("trust", flag.ExitOnError)
+	sshPath := fs.String("ssh", "", "the peer's SSH Ed25519 public key")
+	pgpPath := fs.String("pgp", "", "the peer's armored OpenPGP public key")
+	attPath := fs.String("attestation", "", "attestation file from 'tmd attest' (required)")
+	sigPath := fs.String("sig", "", "detached signature (default: attestation + .sig or .asc)")
+	storePath := fs.String("store", "trusted.json", "trust store to update")
+	fs.Parse(args)
+
+	if *attPath == "" {
+		return fmt.Errorf("--attestation is required")
+	}
+	ext, err := loadExternalKey(*sshPath, *pgpPath)
+	if err != nil {
+		return err
+	}
+	if *sigPath == "" {
+		*sigPath = *attPath + ".sig"
+		if *pgpPath != "" {
+			*sigPath = *attPath + ".asc"
+		}
+	}
+	att, err := os.ReadFile(*attPath)
+	if err != nil {
+		return err
+	}
+	sig, err := os.ReadFile(*sigPath)
+	if err != nil {
+		return err
+	}
+
+	st, err := attest.Verify(att, sig, ext)
+	if err != nil {
+		return err
+	}
+	store, err := attest.OpenStore(*storePath)
+	if err != nil {
+		return err
+	}
+	if err := store.Add(st); err != nil {
+		return err
+	}
+
+	fmt.Printf("Trusted %s (peerID=%s, keyID=%x) via %s\n", st.Nickname, st.PeerID, st.KeyID, st.External)
+	return nil
+}
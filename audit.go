@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pivaldi/tmd/internal/audit"
+)
+
+// With --audit, security events (keys other than pinned, attested or on a
+// contact card, Hellos that fail verification, revoked keys in use, nodes
+// refusing us) are recorded in a tamper-evident log, chained under a key
+// derived from the seed; /audit shows it.
+
+// auditShown is how many events /audit shows by default.
+const auditShown = 20
+
+func (p *connPool) setAuditLog(l *audit.Log) {
+	p.audit = l
+}
+
+// auditf records an event of kind about peer ("" for none), if --audit is
+// set.
+func (p *connPool) auditf(kind string, peer PeerID, format string, args ...any) {
+	if p.audit == nil {
+		return
+	}
+	if err := p.audit.Record(kind, string(peer), fmt.Sprintf(format, args...)); err != nil {
+		p.console.Errorf("%v", err)
+	}
+}
+
+// runAudit handles "/audit [count]": it checks the audit log and shows its
+// last events.
+func runAudit(c Console, pool *connPool, args string) {
+	if pool.audit == nil {
+		c.Printf("[audit] no audit log (see --audit)")
+		return
+	}
+	n := auditShown
+	if args = strings.TrimSpace(args); args != "" {
+		v, err := strconv.Atoi(args)
+		if err != nil || v < 1 {
+			c.Errorf("usage: /audit [count]")
+			return
+		}
+		n = v
+	}
+	events, err := pool.audit.Verify()
+	if len(events) == 0 && err == nil {
+		c.Printf("[audit] no events")
+		return
+	}
+	for _, e := range events[max(0, len(events)-n):] {
+		peer := e.Peer
+		if peer == "" {
+			peer = "-"
+		}
+		c.Printf("[audit] %d %s %s %s: %s", e.Seq, e.Time.Local().Format("2006-01-02 15:04:05"), e.Kind, peer, e.Detail)
+	}
+	var tamper *audit.TamperError
+	switch {
+	case err == nil:
+		c.Printf("[audit] chain intact through event %d", len(events))
+	case errors.As(err, &tamper):
+		c.Errorf("[audit] WARNING: the log was altered at event %d (%s): events from there on cannot be trusted", tamper.Seq, tamper.Reason)
+	case errors.Is(err, audit.ErrWrongKey):
+		c.Errorf("[audit] WARNING: the log does not verify with this seed: it was written by another identity, or altered")
+	default:
+		c.Errorf("[audit] %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+
+	"github.com/pivaldi/tmd/internal/node"
+)
+
+// An autoRule answers direct messages with a fixed reply instead of
+// ackReply. Empty fields match anything; all set ones must match. The
+// first matching rule wins.
+type autoRule struct {
+	From     string `json:"from"`     // sender nickname
+	Match    string `json:"match"`    // regular expression searched in the text
+	Presence string `json:"presence"` // our presence, as set with /status
+	Reply    string `json:"reply"`
+
+	re *regexp.Regexp
+}
+
+// autoReplyConfig is the --autoreply file.
+type autoReplyConfig struct {
+	Rules []autoRule `json:"rules"`
+}
+
+// autoReplies holds the rules in use.
+type autoReplies struct {
+	mu    sync.Mutex
+	rules []autoRule
+}
+
+// loadAutoReplies reads and checks the rules in a JSON file, e.g.
+//
+//	{"rules": [
+//	  {"presence": "away", "reply": "Away until Monday."},
+//	  {"match": "(?i)\\burgent\\b", "reply": "Call me instead."}
+//	]}
+func loadAutoReplies(path string) ([]autoRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read autoreply rules: %w", err)
+	}
+	var cfg autoReplyConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse autoreply rules: %w", err)
+	}
+	for i := range cfg.Rules {
+		if err := cfg.Rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("autoreply rule %d: %w", i+1, err)
+		}
+	}
+	return cfg.Rules, nil
+}
+
+func (r *autoRule) compile() error {
+	switch {
+	case r.Reply == "":
+		return errors.New("reply is required")
+	case r.Reply == ackReply:
+		return fmt.Errorf("reply %q is the default one", ackReply)
+	case !node.ValidPresence(r.Presence):
+		return fmt.Errorf("unknown presence %q", r.Presence)
+	}
+	if r.Match != "" {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return err
+		}
+		r.re = re
+	}
+	return nil
+}
+
+func (r *autoRule) matches(from PeerID, text, presence string) bool {
+	return (r.From == "" || PeerID(r.From) == from) &&
+		(r.Presence == "" || r.Presence == presence) &&
+		(r.re == nil || r.re.MatchString(text))
+}
+
+// setAutoReplies replaces the rules in use.
+func (p *connPool) setAutoReplies(rules []autoRule) {
+	p.replies.mu.Lock()
+	defer p.replies.mu.Unlock()
+	p.replies.rules = rules
+}
+
+// autoReply returns the reply of the first rule matching a direct
+// message, if any.
+func (p *connPool) autoReply(from PeerID, text string) (string, bool) {
+	presence := p.Presence()
+	p.replies.mu.Lock()
+	defer p.replies.mu.Unlock()
+	for i := range p.replies.rules {
+		if r := &p.replies.rules[i]; r.matches(from, text, presence) {
+			return r.Reply, true
+		}
+	}
+	return "", false
+}
+
+// runAutoReply handles "/autoreply" (list the rules) and "/autoreply off".
+func runAutoReply(c Console, pool *connPool, args string) {
+	if args == "off" {
+		pool.setAutoReplies(nil)
+		c.Printf("[autoreply] off")
+		return
+	}
+	if args != "" {
+		c.Errorf("usage: /autoreply [off]")
+		return
+	}
+	pool.replies.mu.Lock()
+	rules := pool.replies.rules
+	pool.replies.mu.Unlock()
+	if len(rules) == 0 {
+		c.Printf("[autoreply] no rules; messages are answered %q", ackReply)
+		return
+	}
+	for i, r := range rules {
+		c.Printf("[autoreply] %d  from=%s match=%s presence=%s: %s", i+1, orAny(r.From), orAny(r.Match), orAny(r.Presence), r.Reply)
+	}
+}
+
+func orAny(s string) string {
+	if s == "" {
+		return "*"
+	}
+	return s
+}
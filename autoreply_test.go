@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAutoReplyRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	rules := `{"rules": [
+		{"from": "bob", "match": "(?i)lunch", "reply": "Not today, bob."},
+		{"match": "(?i)\\burgent\\b", "reply": "Call me instead."},
+		{"presence": "away", "reply": "Away until Monday."}
+	]}`
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadAutoReplies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newTestPool("alice")
+	pool.setAutoReplies(loaded)
+
+	for _, tc := range []struct {
+		from PeerID
+		text string
+		want string
+	}{
+		{"bob", "Lunch?", "Not today, bob."},
+		{"carol", "lunch?", ""},
+		{"carol", "URGENT: the build", "Call me instead."},
+		{"carol", "urgently", ""},
+	} {
+		got, ok := pool.autoReply(tc.from, tc.text)
+		if got != tc.want || ok != (tc.want != "") {
+			t.Errorf("autoReply(%s, %q) = %q, %v; want %q", tc.from, tc.text, got, ok, tc.want)
+		}
+	}
+
+	pool.subs.status = "away"
+	if got, _ := pool.autoReply("carol", "hi"); got != "Away until Monday." {
+		t.Errorf("away: autoReply = %q", got)
+	}
+}
+
+func TestAutoReplyRulesInvalid(t *testing.T) {
+	for rules, want := range map[string]string{
+		`{"rules": [{"match": "x"}]}`:                     "reply is required",
+		`{"rules": [{"match": "(", "reply": "x"}]}`:       "missing closing )",
+		`{"rules": [{"presence": "gone", "reply": "x"}]}`: "unknown presence",
+		`{"rules": [{"reply": "` + ackReply + `"}]}`:      "is the default one",
+		`{"rules": {}}`: "parse autoreply rules",
+	} {
+		path := filepath.Join(t.TempDir(), "rules.json")
+		if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadAutoReplies(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: err = %v, want %q", rules, err, want)
+		}
+	}
+}
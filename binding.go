@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// A HELLO is bound to its connection: its signature also covers the peer
+// IDs of both ends, the stream protocol and the session's suite, so a
+// HELLO signed for a connection with one peer cannot be passed on over
+// another. A listener offering suites offers featureBinding (see
+// features.go); the dialer then binds its HELLO and sets featureBinding in
+// it. HELLOs from dialers predating bindings do not set it and are
+// refused, unless --legacy-hellos accepts them unbound.
+const bindingContext = "tmd hello binding v1"
+
+// channelBinding returns the bytes a bound HELLO also signs, after the
+// CHALLENGE payload: "tmd hello binding v1" || 0 || dialer peer ID || 0 ||
+// listener peer ID || 0 || protocol || 0 || u16(KEM) || u16(KDF) ||
+// u16(AEAD) of the session's suite.
+func channelBinding(dialer, listener peer.ID, proto protocol.ID, suite hpke.Suite) []byte {
+	var b bytes.Buffer
+	b.WriteString(bindingContext)
+	b.WriteByte(0)
+	b.WriteString(string(dialer))
+	b.WriteByte(0)
+	b.WriteString(string(listener))
+	b.WriteByte(0)
+	b.WriteString(string(proto))
+	b.WriteByte(0)
+	kem, kdf, aead := suite.Params()
+	_ = binary.Write(&b, binary.BigEndian, [3]uint16{uint16(kem), uint16(kdf), uint16(aead)})
+	return b.Bytes()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"slices"
+	"testing"
+
+	"github.com/cloudflare/circl/hpke"
+
+	"github.com/pivaldi/tmd/internal/conformance"
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+// TestChannelBinding checks that a bound HELLO verifies only for the
+// connection, protocol and suite it was signed for, and that the binding
+// cannot be dropped on the way.
+func TestChannelBinding(t *testing.T) {
+	alice, err := identity.DeriveKeysWith(conformance.Hex(aliceSeed), seedDerivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := identity.DeriveKeysWith(conformance.Hex(bobSeed), seedDerivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chal := make([]byte, 32)
+	_, _ = rand.Read(chal)
+	payload := encodeChallenge(chal, defaultMaxFrame, supportedSuites, featureBinding)
+
+	suite := supportedSuites[0]
+	h := Hello{SenderID: "alice", SenderKeyID: alice.KeyID, SenderEdPub: alice.Ed25519Pub, SenderHPKEPub: alice.HPKEPubBytes,
+		MaxFrame: defaultMaxFrame, Suites: encodeSuites(supportedSuites), Features: featureBinding}
+	bound := func(b []byte) []byte { return append(slices.Clip(payload), b...) }
+	h.Signature = ed25519.Sign(alice.Ed25519Priv, helloSignInput(bound(channelBinding(alice.PeerID, bob.PeerID, ProtocolID, suite)), h))
+	dec, err := decodeHello(encodeHello(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySignedHello(nil, bound(channelBinding(alice.PeerID, bob.PeerID, ProtocolID, suite)), dec); err != nil {
+		t.Fatalf("bound HELLO rejected on its own connection: %v", err)
+	}
+
+	// Passed on over another connection, or under another protocol or suite.
+	for name, b := range map[string][]byte{
+		"listener": channelBinding(alice.PeerID, alice.PeerID, ProtocolID, suite),
+		"dialer":   channelBinding(bob.PeerID, bob.PeerID, ProtocolID, suite),
+		"protocol": channelBinding(alice.PeerID, bob.PeerID, ProtocolID+"-other", suite),
+		"suite":    channelBinding(alice.PeerID, bob.PeerID, ProtocolID, supportedSuites[2]),
+		"none":     nil,
+	} {
+		if err := verifySignedHello(nil, bound(b), dec); err == nil {
+			t.Fatalf("bound HELLO verified with another %s", name)
+		}
+	}
+
+	// The binding dropped from the HELLO, to have it verified unbound.
+	stripped := dec
+	stripped.Features = 0
+	if err := verifySignedHello(nil, payload, stripped); err == nil {
+		t.Fatal("a HELLO stripped of its binding verified")
+	}
+
+	// A listener that offered the binding does not fall back to verifying
+	// unbound: not for a HELLO without it, nor for one it cannot bind.
+	p := newTestPool("bob")
+	if _, err := p.helloTranscript(nil, chal, payload, stripped); err == nil {
+		t.Fatal("an unbound HELLO was verified after offering the binding")
+	}
+	none := dec
+	none.Suites = encodeSuites([]hpke.Suite{hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA384, hpke.AEAD_AES256GCM)})
+	if _, err := p.helloTranscript(nil, chal, payload, none); err == nil {
+		t.Fatal("a HELLO that could not be bound was verified")
+	}
+	p.setLegacyHellos(true)
+	if signed, err := p.helloTranscript(nil, chal, payload, stripped); err != nil || !bytes.Equal(signed, payload) {
+		t.Fatalf("legacy unbound HELLO transcript = %x, %v", signed, err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// errBlocked is returned for messages to and sessions with blocked peers.
+var errBlocked = errors.New("peer is blocked")
+
+// blockList holds the Ed25519 identity keys of blocked peers. Keys, not
+// nicknames, are blocked: a blocked peer cannot come back under another
+// nickname, and a peer taking over a blocked nickname with other keys is
+// not blocked.
+type blockList struct {
+	mu   sync.Mutex
+	keys map[string]PeerID // Ed25519 public key -> nickname it was blocked as
+}
+
+// identityKey returns the Ed25519 key of a peer: the one its libp2p peer
+// ID embeds, which tmd derives from the same seed as the key signing its
+// Hello.
+func identityKey(info PeerInfo) (ed25519.PublicKey, error) {
+	pub, err := info.PeerID.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("%s: no key in peer ID: %w", info.Nickname, err)
+	}
+	raw, err := pub.Raw()
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s: peer ID does not hold an Ed25519 key", info.Nickname)
+	}
+	return raw, nil
+}
+
+// Block blocks the identity key of a peer and closes our session with it.
+func (p *connPool) Block(info PeerInfo) error {
+	key, err := identityKey(info)
+	if err != nil {
+		return err
+	}
+	p.blocks.mu.Lock()
+	if p.blocks.keys == nil {
+		p.blocks.keys = make(map[string]PeerID)
+	}
+	p.blocks.keys[string(key)] = info.Nickname
+	p.blocks.mu.Unlock()
+
+	p.RemoveSession(info.Nickname)
+	return nil
+}
+
+// Unblock unblocks the keys blocked as nick, and reports whether there
+// were any.
+func (p *connPool) Unblock(nick PeerID) bool {
+	p.blocks.mu.Lock()
+	defer p.blocks.mu.Unlock()
+	found := false
+	for key, n := range p.blocks.keys {
+		if n == nick {
+			delete(p.blocks.keys, key)
+			found = true
+		}
+	}
+	return found
+}
+
+// blockedKey reports whether an Ed25519 identity key is blocked.
+func (p *connPool) blockedKey(key []byte) bool {
+	p.blocks.mu.Lock()
+	defer p.blocks.mu.Unlock()
+	_, ok := p.blocks.keys[string(key)]
+	return ok
+}
+
+// checkBlocked fails with errBlocked if to's identity key is blocked.
+// Peers whose key cannot be told are not blocked.
+func (p *connPool) checkBlocked(to PeerInfo) error {
+	key, err := identityKey(to)
+	if err == nil && p.blockedKey(key) {
+		return fmt.Errorf("%s: %w", to.Nickname, errBlocked)
+	}
+	return nil
+}
+
+// blockedNicks lists the nicknames blocked keys were blocked as.
+func (p *connPool) blockedNicks() []string {
+	p.blocks.mu.Lock()
+	defer p.blocks.mu.Unlock()
+	var list []string
+	for key, n := range p.blocks.keys {
+		list = append(list, fmt.Sprintf("%s (key %x)", n, key[:8]))
+	}
+	sort.Strings(list)
+	return list
+}
+
+// runBlockCommand handles "/block <peer>", "/unblock <peer>" and
+// "/blocked".
+func runBlockCommand(c Console, pool *connPool, cmd, args string) {
+	if cmd == "/blocked" {
+		list := pool.blockedNicks()
+		if len(list) == 0 {
+			c.Printf("[block] nobody is blocked")
+			return
+		}
+		for _, s := range list {
+			c.Printf("[block] %s", s)
+		}
+		return
+	}
+	if args == "" {
+		c.Errorf("usage: %s <peer>", cmd)
+		return
+	}
+	nick := PeerID(args)
+	if cmd == "/unblock" {
+		if !pool.Unblock(nick) {
+			c.Errorf("%s is not blocked", nick)
+			return
+		}
+		c.Printf("[block] unblocked %s", nick)
+		return
+	}
+	info, ok := pool.peerTable.Get(nick)
+	if !ok {
+		c.Errorf("unknown peer: %s", nick)
+		return
+	}
+	if err := pool.Block(info); err != nil {
+		c.Errorf("block: %v", err)
+		return
+	}
+	c.Printf("[block] blocked %s; its messages are refused and it is not dialed", nick)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Broadcasts that fail for a peer are retried, in order, with exponential
+// backoff: broadcastRetryMin, doubled up to broadcastRetryMax, for as long
+// as the peer is in the peer table. A peer that left gets them when it
+// joins again. Broadcasts still undelivered after broadcastRetryTTL are
+// dropped.
+const (
+	broadcastRetryMin = time.Second
+	broadcastRetryMax = 30 * time.Second
+	broadcastRetryTTL = time.Hour
+	// maxRetriedBroadcasts bounds the broadcasts kept per peer; the
+	// oldest go first.
+	maxRetriedBroadcasts = 100
+)
+
+// broadcastRetries holds the broadcasts each peer missed.
+type broadcastRetries struct {
+	mu      sync.Mutex
+	pending map[PeerID][]missedBroadcast
+	backoff map[PeerID]time.Duration
+	timers  map[PeerID]*time.Timer
+	running map[PeerID]bool
+}
+
+type missedBroadcast struct {
+	msg    string
+	queued time.Time
+}
+
+// retryBroadcast queues a broadcast a peer failed to receive.
+func (p *connPool) retryBroadcast(to PeerID, msg string) {
+	p.retries.mu.Lock()
+	if p.retries.pending == nil {
+		p.retries.pending = make(map[PeerID][]missedBroadcast)
+		p.retries.backoff = make(map[PeerID]time.Duration)
+		p.retries.timers = make(map[PeerID]*time.Timer)
+		p.retries.running = make(map[PeerID]bool)
+	}
+	list := append(p.retries.pending[to], missedBroadcast{msg: msg, queued: time.Now()})
+	if len(list) > maxRetriedBroadcasts {
+		list = list[len(list)-maxRetriedBroadcasts:]
+	}
+	p.retries.pending[to] = list
+	p.scheduleRetryLocked(to)
+	p.retries.mu.Unlock()
+
+	p.showRetries()
+}
+
+// scheduleRetryLocked arms the backoff timer of a peer, unless a retry is
+// already due or running.
+func (p *connPool) scheduleRetryLocked(to PeerID) {
+	if p.retries.timers[to] != nil || p.retries.running[to] {
+		return
+	}
+	delay := p.retries.backoff[to]
+	if delay == 0 {
+		delay = broadcastRetryMin
+	}
+	p.retries.backoff[to] = min(2*delay, broadcastRetryMax)
+	p.retries.timers[to] = time.AfterFunc(delay, func() { p.flushBroadcasts(to) })
+}
+
+// resumeBroadcasts retries at once the broadcasts a peer that just joined
+// missed.
+func (p *connPool) resumeBroadcasts(to PeerID) {
+	p.retries.mu.Lock()
+	if len(p.retries.pending[to]) == 0 {
+		p.retries.mu.Unlock()
+		return
+	}
+	if t := p.retries.timers[to]; t != nil {
+		t.Stop()
+		delete(p.retries.timers, to)
+	}
+	delete(p.retries.backoff, to)
+	p.retries.mu.Unlock()
+
+	go p.flushBroadcasts(to)
+}
+
+// flushBroadcasts sends a peer the broadcasts it missed, oldest first,
+// until one fails again.
+func (p *connPool) flushBroadcasts(to PeerID) {
+	p.retries.mu.Lock()
+	delete(p.retries.timers, to)
+	if p.retries.running[to] {
+		p.retries.mu.Unlock()
+		return
+	}
+	p.retries.running[to] = true
+	p.retries.mu.Unlock()
+	defer p.showRetries()
+
+	for {
+		p.retries.mu.Lock()
+		list := p.retries.pending[to]
+		for len(list) > 0 && time.Since(list[0].queued) > broadcastRetryTTL {
+			p.console.Errorf("broadcast to %s dropped after %s: %s", to, broadcastRetryTTL, list[0].msg)
+			list = list[1:]
+		}
+		p.retries.pending[to] = list
+		if len(list) == 0 {
+			delete(p.retries.pending, to)
+			delete(p.retries.backoff, to)
+			delete(p.retries.running, to)
+			p.retries.mu.Unlock()
+			return
+		}
+		p.retries.mu.Unlock()
+
+		info, online := p.peerTable.Get(to)
+		var err error
+		if online {
+			_, err = p.SendRequest(info, broadcastPrefix+list[0].msg)
+		}
+
+		p.retries.mu.Lock()
+		if !online || err != nil {
+			// Offline peers wait for their next join.
+			delete(p.retries.running, to)
+			if online {
+				p.scheduleRetryLocked(to)
+			}
+			p.retries.mu.Unlock()
+			return
+		}
+		p.retries.pending[to] = p.retries.pending[to][1:]
+		p.retries.mu.Unlock()
+		p.console.Printf("[broadcast] %s received it after a retry: %s", to, list[0].msg)
+	}
+}
+
+// showRetries keeps the number of broadcasts awaiting a retry in the
+// status area.
+func (p *connPool) showRetries() {
+	p.retries.mu.Lock()
+	n := 0
+	for _, list := range p.retries.pending {
+		n += len(list)
+	}
+	p.retries.mu.Unlock()
+	if n == 0 {
+		p.setStatus("broadcast retries", "")
+		return
+	}
+	p.setStatus("broadcast retries", fmt.Sprintf("%d broadcasts to retry", n))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBroadcastRetriedOnJoin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("needs loopback networking")
+	}
+	n := newSimNetwork(t)
+	n.tokens["alice"] = "token-alice"
+	n.tokens["bob"] = "token-bob"
+	n.startNode("n1")
+	n.startPeer("alice", []string{"n1"})
+	n.startPeer("bob", []string{"n1"})
+	alice := n.peer("alice")
+	if !alice.console.WaitFor("peer joined: bob", defaultExpectTimeout) {
+		t.Fatal("alice never saw bob")
+	}
+	stale, _ := alice.pool.peerTable.Get("bob")
+
+	// bob goes away without alice noticing: the broadcast fails for him.
+	n.stopPeer("bob")
+	if !alice.console.WaitFor("peer left: bob", defaultExpectTimeout) {
+		t.Fatal("alice never saw bob leave")
+	}
+	alice.pool.peerTable.Add(stale)
+	results := alice.pool.Broadcast("missed me?")
+	if len(results) != 1 || results[0].Peer != "bob" || results[0].Err == nil {
+		t.Fatalf("results = %+v", results)
+	}
+	if !slices.Contains(alice.console.Status(), "1 broadcasts to retry") {
+		t.Fatalf("status = %q", alice.console.Status())
+	}
+
+	n.startPeer("bob", []string{"n1"})
+	if !n.peer("bob").console.WaitFor("[broadcast from alice] missed me?", defaultExpectTimeout) {
+		t.Fatalf("bob never got the broadcast: %q", n.peer("bob").console.History())
+	}
+	if !alice.console.WaitFor("[broadcast] bob received it after a retry: missed me?", defaultExpectTimeout) {
+		t.Fatalf("alice history: %q", alice.console.History())
+	}
+}
+
+func TestBroadcastRelayed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("needs loopback networking")
+	}
+	n := newSimNetwork(t)
+	n.tokens["alice"] = "token-alice"
+	n.tokens["bob"] = "token-bob"
+	n.startNode("n1")
+	n.startPeer("alice", []string{"n1"})
+	n.startPeer("bob", []string{"n1"})
+	alice := n.peer("alice")
+	if !alice.console.WaitFor("peer joined: bob", defaultExpectTimeout) {
+		t.Fatal("alice never saw bob")
+	}
+
+	alice.pool.setRelayBroadcasts(true)
+	results := alice.pool.Broadcast("via the node")
+	if len(results) != 1 || results[0].Peer != "bob" || !results[0].Relayed || results[0].Err != nil {
+		t.Fatalf("results = %+v", results)
+	}
+	if !n.peer("bob").console.WaitFor("[broadcast from alice] via the node", defaultExpectTimeout) {
+		t.Fatalf("bob never got the broadcast: %q", n.peer("bob").console.History())
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/bundle"
+	"github.com/pivaldi/tmd/internal/identity"
+	"github.com/pivaldi/tmd/internal/pins"
+)
+
+// bundlePassphraseEnv holds the passphrase of `tmd identity`, for scripts;
+// without it, the passphrase is read from stdin.
+const bundlePassphraseEnv = "TMD_BUNDLE_PASSPHRASE"
+
+// runIdentity handles `tmd identity list`, `export`, `import` and `rotate`.
+func runIdentity(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: tmd identity list|export|import|rotate [flags]")
+	}
+	switch args[0] {
+	case "list":
+		return runIdentityList(args[1:])
+	case "export":
+		return runIdentityExport(args[1:], os.Stdin)
+	case "import":
+		return runIdentityImport(args[1:], os.Stdin)
+	case "rotate":
+		return runIdentityRotate(args[1:])
+	default:
+		return fmt.Errorf("unknown identity command %q (want list, export, import or rotate)", args[0])
+	}
+}
+
+// runIdentityExport writes the identity of a seed, with its profile and
+// pins, to a bundle encrypted under a passphrase.
+func runIdentityExport(args []string, stdin io.Reader) error {
+	fs := flag.NewFlagSet("identity export", flag.ExitOnError)
+	var seedSel seedFlags
+	addSeedFlags(fs, &seedSel, "path to seed file, or keyring:<name> for an OS keyring entry (required, or --identity)")
+	outPath := fs.String("out", "", "bundle file to write (required)")
+	nick := fs.String("nick", "", "nickname of the identity (defaults to the one the seed file notes)")
+	pinsPath := fs.String("pins", "", "pins file (--pins) whose pins and verifications to include")
+	name := fs.String("name", "", "display name of the profile")
+	avatar := fs.String("avatar", "", "avatar image of the profile (only its SHA-256 is kept)")
+	note := fs.String("note", "", "note of the profile")
+	fs.Parse(args)
+
+	if !seedSel.set() || *outPath == "" {
+		return fmt.Errorf("--seed (or --identity) and --out are required")
+	}
+	seedPath, err := seedSel.path(false)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(*outPath); err == nil {
+		return fmt.Errorf("bundle already exists: %s", *outPath)
+	}
+	f, err := identity.LoadSeedFile(seedPath)
+	if err != nil {
+		return err
+	}
+	if *nick == "" {
+		*nick = f.Nickname
+	}
+	b := &bundle.Bundle{
+		Seed:       f.Seed,
+		Derivation: f.Derivation,
+		HPKEGen:    f.HPKEGen,
+		Nickname:   *nick,
+		Profile:    bundle.Profile{DisplayName: *name, Note: *note},
+		Created:    time.Now().UTC(),
+	}
+	if *avatar != "" {
+		if b.Profile.AvatarHash, err = avatarHash(*avatar); err != nil {
+			return fmt.Errorf("avatar: %w", err)
+		}
+	}
+	pr := Profile{DisplayName: b.Profile.DisplayName, AvatarHash: b.Profile.AvatarHash, Note: b.Profile.Note}
+	if err := pr.validate(); err != nil {
+		return err
+	}
+	if *pinsPath != "" {
+		store, err := pins.OpenStore(*pinsPath)
+		if err != nil {
+			return err
+		}
+		b.Pins = store.All()
+	}
+
+	passphrase, err := readPassphrase(stdin, bundlePassphraseEnv, "Bundle passphrase: ", true)
+	if err != nil {
+		return err
+	}
+	data, err := bundle.Seal(b, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*outPath, data, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Identity written to %s (%d pins)\n", *outPath, len(b.Pins))
+	fmt.Printf("Anyone with the file and the passphrase is you: move it, import it, then delete it.\n")
+	return nil
+}
+
+// runIdentityImport restores the identity of a bundle: its seed, and its
+// pins merged into a pins file.
+func runIdentityImport(args []string, stdin io.Reader) error {
+	fs := flag.NewFlagSet("identity import", flag.ExitOnError)
+	inPath := fs.String("in", "", "bundle file written by 'tmd identity export' (required)")
+	var seedSel seedFlags
+	addSeedFlags(fs, &seedSel, "seed file, or keyring:<name>, to write (required, or --identity)")
+	pinsPath := fs.String("pins", "", "pins file to merge the bundle's pins into")
+	fs.Parse(args)
+
+	if *inPath == "" || !seedSel.set() {
+		return fmt.Errorf("--in and --seed (or --identity) are required")
+	}
+	seedPath, err := seedSel.path(true)
+	if err != nil {
+		return err
+	}
+	if exists, err := identity.SeedExists(seedPath); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("seed already exists: %s", seedPath)
+	}
+	data, err := os.ReadFile(*inPath)
+	if err != nil {
+		return err
+	}
+	passphrase, err := readPassphrase(stdin, bundlePassphraseEnv, "Bundle passphrase: ", false)
+	if err != nil {
+		return err
+	}
+	b, err := bundle.Open(data, passphrase)
+	if err != nil {
+		return err
+	}
+	f := &identity.SeedFile{Seed: b.Seed, Derivation: b.Derivation, Nickname: b.Nickname, HPKEGen: b.HPKEGen}
+	keys, err := f.DeriveKeys()
+	if err != nil {
+		return fmt.Errorf("derive keys: %w", err)
+	}
+	if err := identity.SaveSeedFile(seedPath, f); err != nil {
+		return fmt.Errorf("save seed: %w", err)
+	}
+	fmt.Printf("Seed written to %s\n", seedPath)
+	fmt.Printf("PeerID: %s\n", keys.PeerID)
+	fmt.Printf("HPKE KeyID: %x\n", keys.KeyID)
+
+	switch {
+	case len(b.Pins) > 0 && *pinsPath == "":
+		fmt.Printf("The bundle holds %d pins: import again with --pins to keep them.\n", len(b.Pins))
+	case len(b.Pins) > 0:
+		store, err := pins.OpenStore(*pinsPath)
+		if err != nil {
+			return err
+		}
+		conflicts, err := store.Merge(b.Pins)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d pins merged into %s\n", len(b.Pins)-len(conflicts), *pinsPath)
+		for _, p := range conflicts {
+			fmt.Printf("warning: %s is pinned to other keys in %s; kept those (see /repin)\n", p.Nickname, *pinsPath)
+		}
+	}
+
+	cmd := []string{"tmd", "--seed", seedPath}
+	if seedSel.identity != "" {
+		cmd = []string{"tmd", "--identity", seedSel.identity}
+		if seedSel.keystore != "" {
+			cmd = append(cmd, "--keystore", seedSel.keystore)
+		}
+	}
+	if b.Nickname != "" {
+		cmd = append(cmd, "--nick", b.Nickname)
+	}
+	if b.Profile.DisplayName != "" {
+		cmd = append(cmd, "--name", fmt.Sprintf("%q", b.Profile.DisplayName))
+	}
+	if b.Profile.Note != "" {
+		cmd = append(cmd, "--note", fmt.Sprintf("%q", b.Profile.Note))
+	}
+	if *pinsPath != "" {
+		cmd = append(cmd, "--pins", *pinsPath)
+	}
+	fmt.Printf("Run with: %s\n", strings.Join(cmd, " "))
+	if len(b.Profile.AvatarHash) > 0 {
+		fmt.Printf("and --avatar with the image whose SHA-256 is %x\n", b.Profile.AvatarHash)
+	}
+	return nil
+}
+
+// readPassphrase returns a passphrase from the environment variable env,
+// or from stdin after prompt, twice when confirm is set.
+func readPassphrase(stdin io.Reader, env, prompt string, confirm bool) ([]byte, error) {
+	if p := os.Getenv(env); p != "" {
+		return []byte(p), nil
+	}
+	r := bufio.NewReader(stdin)
+	read := func(prompt string) ([]byte, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		line, err := r.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("read passphrase: %w", err)
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+	p, err := read(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	if confirm {
+		again, err := read("Again: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(p, again) {
+			return nil, fmt.Errorf("passphrases differ")
+		}
+	}
+	return p, nil
+}
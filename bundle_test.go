@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pivaldi/tmd/internal/identity"
+	"github.com/pivaldi/tmd/internal/pins"
+)
+
+func TestIdentityExportImport(t *testing.T) {
+	dir := t.TempDir()
+	seedPath, bundlePath := filepath.Join(dir, "alice.key"), filepath.Join(dir, "alice.bundle")
+	seed, err := identity.GenerateSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := identity.SaveSeedWith(seedPath, seed, identity.DerivationDirect); err != nil {
+		t.Fatal(err)
+	}
+	oldPins := filepath.Join(dir, "pins.json")
+	store, err := pins.OpenStore(oldPins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Observe("bob", []byte("ed-bob"), []byte("hpke-bob")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Verify("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The passphrase twice on stdin; mistyped, nothing is written.
+	if err := runIdentityExport([]string{"--seed", seedPath, "--out", bundlePath, "--nick", "alice", "--name", "Alice", "--pins", oldPins},
+		strings.NewReader("secret\nsecert\n")); err == nil {
+		t.Fatal("export went ahead with differing passphrases")
+	}
+	if err := runIdentityExport([]string{"--seed", seedPath, "--out", bundlePath, "--nick", "alice", "--name", "Alice", "--pins", oldPins},
+		strings.NewReader("secret\nsecret\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	newSeed, newPins := filepath.Join(dir, "moved.key"), filepath.Join(dir, "moved-pins.json")
+	if err := runIdentityImport([]string{"--in", bundlePath, "--seed", newSeed, "--pins", newPins}, strings.NewReader("wrong\n")); err == nil {
+		t.Fatal("imported with a wrong passphrase")
+	}
+	t.Setenv(bundlePassphraseEnv, "secret")
+	if err := runIdentityImport([]string{"--in", bundlePath, "--seed", newSeed, "--pins", newPins}, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := identity.LoadSeedFile(newSeed)
+	if err != nil || !bytes.Equal(got.Seed, seed) || got.Derivation != identity.DerivationDirect || got.Nickname != "alice" {
+		t.Fatalf("imported seed: %+v, %v; want the same seed and derivation, noting alice", got, err)
+	}
+	moved, err := pins.OpenStore(newPins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, p := moved.Check("bob", []byte("ed-bob"), []byte("hpke-bob")); status != pins.Match || p.Verified.IsZero() {
+		t.Fatalf("imported pin: %v %+v; want bob pinned and verified", status, p)
+	}
+	if err := runIdentityImport([]string{"--in", bundlePath, "--seed", newSeed}, nil); err == nil {
+		t.Fatal("import overwrote an existing seed")
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/circl/kem"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// A channel is a duplex, ordered stream of sealed frames between two
+// peers, beyond request/response. The dialer opens it on its session
+// stream with an HPKE encapsulation to the listener's key (CHAN_OPEN); the
+// HPKE exporter secret of that context, bound to both nicknames, keys one
+// AEAD per direction. Both sides then send CHAN_DATA frames on that one
+// libp2p stream, numbered from 0 in each direction: a frame out of order
+// or that does not open closes the channel, and so does CHAN_CLOSE or the
+// loss of the stream.
+const (
+	chanInfoContext   = "tmd channel v1"
+	chanExportContext = "tmd channel v1 exporter"
+	chanSecretSize    = 32
+)
+
+// chanKey names a channel: the peer, the ID its opener chose, and whether
+// we opened it.
+type chanKey struct {
+	peer PeerID
+	id   uint64
+	ours bool
+}
+
+// channel is one open channel.
+type channel struct {
+	key   chanKey
+	via   any // the session or responder it is carried on
+	write func(typ byte, payload []byte) error
+
+	mu      sync.Mutex
+	send    cipher.AEAD
+	sendSeq uint64
+	recv    cipher.AEAD
+	recvSeq uint64
+
+	// Replacing the sending key (see rekey.go); set by addChannel.
+	limits  rekeyLimits
+	sent    rekeyCount // under the current sending key
+	rekey   func(seq uint64) (ChanRekey, cipher.AEAD, error)
+	rekeyed int // times the sending key was replaced
+}
+
+// channelState holds the open channels.
+type channelState struct {
+	mu   sync.Mutex
+	priv kem.PrivateKey // ours, to open CHAN_OPEN; set by SetupStreamHandler
+	next uint64
+	open map[chanKey]*channel
+}
+
+// chanInfo is the HPKE info of a channel from initiator to responder.
+func chanInfo(initiator, responder PeerID) []byte {
+	return []byte(chanInfoContext + "\x00" + string(initiator) + "\x00" + string(responder))
+}
+
+// chanKeys derives n channel keys from an HPKE exporter secret.
+func chanKeys(secret []byte, info string, n int) ([]cipher.AEAD, error) {
+	keys := hkdf.New(sha256.New, secret, nil, []byte(info))
+	aeads := make([]cipher.AEAD, n)
+	for i := range aeads {
+		k := make([]byte, chacha20poly1305.KeySize)
+		if _, err := io.ReadFull(keys, k); err != nil {
+			return nil, err
+		}
+		aead, err := chacha20poly1305.New(k)
+		if err != nil {
+			return nil, err
+		}
+		aeads[i] = aead
+	}
+	return aeads, nil
+}
+
+func newChannel(key chanKey, secret []byte, via any, write func(byte, []byte) error) (*channel, error) {
+	aeads, err := chanKeys(secret, chanInfoContext, 2)
+	if err != nil {
+		return nil, err
+	}
+	// The first key seals what the opener sends, the second the replies.
+	c := &channel{key: key, via: via, write: write, send: aeads[0], recv: aeads[1]}
+	if !key.ours {
+		c.send, c.recv = c.recv, c.send
+	}
+	return c, nil
+}
+
+func chanNonce(seq uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func chanAD(id uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(chanInfoContext+"\x00"), id)
+}
+
+// Send seals data as the channel's next frame and writes it, after a
+// CHAN_REKEY if the sending key is due for replacement.
+func (c *channel) Send(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rekey != nil && c.limits.due(c.sent, len(data)) {
+		k, aead, err := c.rekey(c.sendSeq)
+		if err != nil {
+			return fmt.Errorf("rekey: %w", err)
+		}
+		if err := c.write(msgChanRekey, encodeChanRekey(k)); err != nil {
+			return err
+		}
+		c.send, c.sent = aead, rekeyCount{}
+		c.rekeyed++
+	}
+	ct := c.send.Seal(nil, chanNonce(c.sendSeq), data, chanAD(c.key.id))
+	d := ChanData{ChannelID: c.key.id, Seq: c.sendSeq, Ciphertext: ct}
+	c.sendSeq++
+	c.sent.add(len(data))
+	return c.write(msgChanData, encodeChanData(d))
+}
+
+// rekeyRecv replaces the receiving key from frame number seq on, which
+// must be the next.
+func (c *channel) rekeyRecv(seq uint64, aead cipher.AEAD) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq != c.recvSeq {
+		return fmt.Errorf("rekey at frame %d (expected %d)", seq, c.recvSeq)
+	}
+	c.recv = aead
+	return nil
+}
+
+// open checks that d is the next frame and opens it.
+func (c *channel) open(d ChanData) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d.Seq != c.recvSeq {
+		return nil, fmt.Errorf("frame %d out of order (expected %d)", d.Seq, c.recvSeq)
+	}
+	plain, err := c.recv.Open(nil, chanNonce(d.Seq), d.Ciphertext, chanAD(c.key.id))
+	if err != nil {
+		return nil, fmt.Errorf("frame %d does not open", d.Seq)
+	}
+	c.recvSeq++
+	return plain, nil
+}
+
+// OpenChannel opens a channel to a peer on our session with it.
+func (p *connPool) OpenChannel(to PeerInfo) (*channel, error) {
+	if err := p.checkBlocked(to); err != nil {
+		return nil, err
+	}
+	if err := p.checkRevoked(to); err != nil {
+		return nil, err
+	}
+	pub, err := p.kemScheme.UnmarshalBinaryPublicKey(to.HPKEPub)
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad HPKE key: %w", to.Nickname, err)
+	}
+	sender, err := p.suite.NewSender(pub, chanInfo(p.nickname, to.Nickname))
+	if err != nil {
+		return nil, err
+	}
+	enc, sealer, err := sender.Setup(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ps, err := p.NewSession(to)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", to.Nickname, err)
+	}
+
+	p.chans.mu.Lock()
+	p.chans.next++
+	key := chanKey{peer: to.Nickname, id: p.chans.next, ours: true}
+	p.chans.mu.Unlock()
+	c, err := newChannel(key, sealer.Export([]byte(chanExportContext), chanSecretSize), ps, ps.send)
+	if err != nil {
+		return nil, err
+	}
+	p.addChannel(c)
+	if err := ps.send(msgChanOpen, encodeChanOpen(ChanOpen{ChannelID: key.id, RecipientKeyID: to.KeyID, EncapKey: enc})); err != nil {
+		p.dropChannel(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+// CloseChannel closes a channel at both ends.
+func (p *connPool) CloseChannel(c *channel) error {
+	p.dropChannel(c)
+	return c.write(msgChanClose, encodeChanClose(ChanClose{ChannelID: c.key.id}))
+}
+
+func (p *connPool) addChannel(c *channel) {
+	c.limits = p.rekey
+	c.rekey = func(seq uint64) (ChanRekey, cipher.AEAD, error) { return p.rekeyChannel(c.key, seq) }
+	p.chans.mu.Lock()
+	defer p.chans.mu.Unlock()
+	if p.chans.open == nil {
+		p.chans.open = make(map[chanKey]*channel)
+	}
+	p.chans.open[c.key] = c
+}
+
+func (p *connPool) dropChannel(c *channel) {
+	p.chans.mu.Lock()
+	defer p.chans.mu.Unlock()
+	if p.chans.open[c.key] == c {
+		delete(p.chans.open, c.key)
+	}
+}
+
+// dropChannelsVia forgets the channels carried on a stream that ended.
+func (p *connPool) dropChannelsVia(via any) {
+	p.chans.mu.Lock()
+	defer p.chans.mu.Unlock()
+	for key, c := range p.chans.open {
+		if c.via == via {
+			delete(p.chans.open, key)
+		}
+	}
+}
+
+// channelWith returns an open channel with a peer, preferring one we
+// opened.
+func (p *connPool) channelWith(peer PeerID) (*channel, bool) {
+	p.chans.mu.Lock()
+	defer p.chans.mu.Unlock()
+	var found *channel
+	for key, c := range p.chans.open {
+		if key.peer == peer && (found == nil || key.ours) {
+			found = c
+		}
+	}
+	return found, found != nil
+}
+
+// channelFrame handles a CHAN_* frame from a peer. ours is set for frames
+// read on our own session, which only carries channels we opened; write
+// answers on the stream the frame came on.
+func (p *connPool) channelFrame(from PeerID, ours bool, typ byte, payload []byte, via any, write func(byte, []byte) error) error {
+	switch typ {
+	case msgChanOpen:
+		if ours {
+			return fmt.Errorf("CHAN_OPEN from %s on our session", from)
+		}
+		o, err := decodeChanOpen(payload)
+		if err != nil {
+			return fmt.Errorf("decode channel open: %w", err)
+		}
+		if string(o.RecipientKeyID) != string(p.keyID) {
+			return fmt.Errorf("channel for keyID=%x (expected %x)", o.RecipientKeyID, p.keyID)
+		}
+		p.chans.mu.Lock()
+		priv := p.chans.priv
+		p.chans.mu.Unlock()
+		receiver, err := p.suite.NewReceiver(priv, chanInfo(from, p.nickname))
+		if err != nil {
+			return err
+		}
+		opener, err := receiver.Setup(o.EncapKey)
+		if err != nil {
+			return fmt.Errorf("channel from %s: %w", from, err)
+		}
+		c, err := newChannel(chanKey{peer: from, id: o.ChannelID}, opener.Export([]byte(chanExportContext), chanSecretSize), via, write)
+		if err != nil {
+			return err
+		}
+		p.addChannel(c)
+		p.console.AddHistory(fmt.Sprintf("[chan] %s opened a channel", from))
+
+	case msgChanData:
+		d, err := decodeChanData(payload)
+		if err != nil {
+			return fmt.Errorf("decode channel data: %w", err)
+		}
+		p.chans.mu.Lock()
+		c := p.chans.open[chanKey{peer: from, id: d.ChannelID, ours: ours}]
+		p.chans.mu.Unlock()
+		if c == nil {
+			return nil // closed already
+		}
+		plain, err := c.open(d)
+		if err != nil {
+			_ = p.CloseChannel(c)
+			p.console.Errorf("channel with %s: %v; closed", from, err)
+			return nil
+		}
+		p.sawPeer(from, false)
+		p.console.AddHistory(fmt.Sprintf("[chan %s] %s: %s", from, from, plain))
+
+	case msgChanRekey:
+		k, err := decodeChanRekey(payload)
+		if err != nil {
+			return fmt.Errorf("decode channel rekey: %w", err)
+		}
+		p.chans.mu.Lock()
+		c := p.chans.open[chanKey{peer: from, id: k.ChannelID, ours: ours}]
+		p.chans.mu.Unlock()
+		if c == nil {
+			return nil // closed already
+		}
+		if err := p.acceptChanRekey(from, c, k); err != nil {
+			_ = p.CloseChannel(c)
+			p.console.Errorf("channel with %s: %v; closed", from, err)
+		}
+
+	case msgChanClose:
+		cl, err := decodeChanClose(payload)
+		if err != nil {
+			return fmt.Errorf("decode channel close: %w", err)
+		}
+		p.chans.mu.Lock()
+		c := p.chans.open[chanKey{peer: from, id: cl.ChannelID, ours: ours}]
+		p.chans.mu.Unlock()
+		if c != nil {
+			p.dropChannel(c)
+			p.console.AddHistory(fmt.Sprintf("[chan] %s closed the channel", from))
+		}
+	}
+	return nil
+}
+
+// runChannelCommand handles "/chan <peer> [text]" and "/unchan <peer>".
+// /chan opens a channel with the peer unless one is open, then sends text
+// on it.
+func runChannelCommand(c Console, pool *connPool, cmd, args string) {
+	nick, text, _ := strings.Cut(args, " ")
+	if nick == "" {
+		c.Errorf("usage: /chan <peer> [text] or /unchan <peer>")
+		return
+	}
+	ch, open := pool.channelWith(PeerID(nick))
+	if cmd == "/unchan" {
+		if !open {
+			c.Errorf("no channel with %s", nick)
+			return
+		}
+		if err := pool.CloseChannel(ch); err != nil {
+			c.Errorf("close channel: %v", err)
+		}
+		c.Printf("[chan] closed the channel with %s", nick)
+		return
+	}
+	if !open {
+		to, ok := pool.peerTable.Get(PeerID(nick))
+		if !ok {
+			c.Errorf("unknown peer: %s", nick)
+			return
+		}
+		var err error
+		if ch, err = pool.OpenChannel(to); err != nil {
+			c.Errorf("open channel: %v", err)
+			return
+		}
+		c.Printf("[chan] opened a channel with %s", nick)
+	}
+	if text = strings.TrimSpace(text); text == "" {
+		return
+	}
+	if err := ch.Send([]byte(text)); err != nil {
+		pool.dropChannel(ch)
+		c.Errorf("channel with %s lost: %v", nick, err)
+		return
+	}
+	c.Printf("[chan %s] %s: %s", nick, pool.nickname, text)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChannelFramesInOrder(t *testing.T) {
+	secret := bytes.Repeat([]byte{7}, chanSecretSize)
+	var sent [][]byte
+	record := func(typ byte, payload []byte) error {
+		sent = append(sent, payload)
+		return nil
+	}
+	opener, err := newChannel(chanKey{peer: "bob", id: 1, ours: true}, secret, nil, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := newChannel(chanKey{peer: "alice", id: 1}, secret, nil, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{"one", "two"} {
+		if err := opener.Send([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, _ := decodeChanData(sent[0])
+	second, _ := decodeChanData(sent[1])
+	if _, err := peer.open(second); err == nil {
+		t.Fatal("frame 1 opened before frame 0")
+	}
+	if got, err := peer.open(first); err != nil || string(got) != "one" {
+		t.Fatalf("frame 0 = %q, %v", got, err)
+	}
+	if _, err := peer.open(first); err == nil {
+		t.Fatal("replayed frame opened")
+	}
+	if got, err := peer.open(second); err != nil || string(got) != "two" {
+		t.Fatalf("frame 1 = %q, %v", got, err)
+	}
+
+	// Each direction has its own key: a frame cannot be reflected.
+	if _, err := opener.open(first); err == nil {
+		t.Fatal("reflected frame opened")
+	}
+	if err := peer.Send([]byte("back")); err != nil {
+		t.Fatal(err)
+	}
+	back, _ := decodeChanData(sent[2])
+	if got, err := opener.open(back); err != nil || string(got) != "back" {
+		t.Fatalf("reply = %q, %v", got, err)
+	}
+}
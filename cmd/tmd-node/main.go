@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -13,8 +14,17 @@ import (
 )
 
 func main() {
+	// Handle status subcommand (query a running node)
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		if err := runStatus(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "status error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	configPath := flag.String("config", "node.json", "path to config file")
-	seedPath := flag.String("seed", "", "path to seed file (optional, generates new if not provided)")
+	seedPath := flag.String("seed", "", "path to seed file, or keyring:<name> for an OS keyring entry (optional, generates new if not provided)")
 	flag.Parse()
 
 	// Load config
@@ -26,8 +36,9 @@ func main() {
 
 	// Load or generate seed
 	var seed []byte
+	derivation := identity.DerivationHKDF
 	if *seedPath != "" {
-		seed, err = identity.LoadSeed(*seedPath)
+		seed, derivation, err = identity.LoadSeed(*seedPath)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "load seed: %v\n", err)
 			os.Exit(1)
@@ -38,7 +49,7 @@ func main() {
 	}
 
 	// Derive keys
-	keys, err := identity.DeriveKeys(seed)
+	keys, err := identity.DeriveKeysWith(seed, derivation)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "derive keys: %v\n", err)
 		os.Exit(1)
@@ -60,12 +71,35 @@ func main() {
 	// Create server
 	srv := node.NewServer(h, cfg)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cfg.Cluster != nil {
+		logf := func(format string, args ...any) { fmt.Fprintf(os.Stderr, format+"\n", args...) }
+		backend, lease, closeBackend, err := cfg.Cluster.Open(ctx, h, logf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cluster: %v\n", err)
+			os.Exit(1)
+		}
+		defer closeBackend()
+		if err := srv.EnableCluster(ctx, backend, lease, logf); err != nil {
+			fmt.Fprintf(os.Stderr, "cluster: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Cluster: %s backend, lease %s\n", cfg.Cluster.Backend, lease)
+		if f := cfg.Cluster.Federation; f != nil && cfg.Cluster.Backend == "federation" {
+			fmt.Printf("Federation: gossiping with %d node(s) on %s\n", len(f.Peers), node.FederationProtocolID)
+		}
+	}
+
 	fmt.Printf("Node started\n")
 	fmt.Printf("PeerID: %s\n", srv.ID())
 	for _, addr := range srv.Addrs() {
 		fmt.Printf("Address: %s/p2p/%s\n", addr, srv.ID())
 	}
-	fmt.Printf("Allowed peers: %v\n", getKeys(cfg.Peers))
+	fmt.Printf("Allowed peers: %v\n", cfg.Nicknames())
+	if len(cfg.Admins) > 0 {
+		fmt.Printf("Status: served to %d admin(s) on %s\n", len(cfg.Admins), node.StatusProtocolID)
+	}
 
 	// Wait for interrupt
 	sigCh := make(chan os.Signal, 1)
@@ -74,11 +108,3 @@ func main() {
 
 	fmt.Println("\nShutting down...")
 }
-
-func getKeys(m map[string]string) []string {
-	keys := make([]string, 0, len(m))
-	for k := range m {
-		keys = append(keys, k)
-	}
-	return keys
-}
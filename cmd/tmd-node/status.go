@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/pivaldi/tmd/internal/identity"
+	"github.com/pivaldi/tmd/internal/node"
+)
+
+// runStatus implements `tmd-node status`: it queries a running node over
+// the status protocol and prints the report.
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	addr := fs.String("addr", "", "node multiaddr including /p2p/<id> (required)")
+	seedPath := fs.String("seed", "", "seed whose peer ID is listed in the node's admins (required)")
+	asJSON := fs.Bool("json", false, "print the raw status as JSON")
+	timeout := fs.Duration("timeout", 10*time.Second, "give up after this long")
+	fs.Parse(args)
+
+	if *addr == "" || *seedPath == "" {
+		return fmt.Errorf("usage: tmd-node status --addr <multiaddr> --seed <admin.key> [--json]")
+	}
+
+	seed, derivation, err := identity.LoadSeed(*seedPath)
+	if err != nil {
+		return fmt.Errorf("load seed: %w", err)
+	}
+	keys, err := identity.DeriveKeysWith(seed, derivation)
+	if err != nil {
+		return fmt.Errorf("derive keys: %w", err)
+	}
+	// A client-only host: the query needs no listener.
+	h, err := libp2p.New(libp2p.Identity(keys.Libp2pPriv), libp2p.NoListenAddrs)
+	if err != nil {
+		return fmt.Errorf("create host: %w", err)
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	st, err := node.QueryStatus(ctx, h, *addr)
+	if err != nil {
+		return fmt.Errorf("%w (querying as %s)", err, h.ID())
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	}
+	printStatus(st, time.Now())
+	return nil
+}
+
+func printStatus(st *node.Status, now time.Time) {
+	fmt.Printf("PeerID:  %s\n", st.PeerID)
+	for _, a := range st.Addrs {
+		fmt.Printf("Address: %s\n", a)
+	}
+	fmt.Printf("Uptime:  %s (since %s)\n", st.Uptime, st.Started.Format(time.RFC3339))
+
+	cfg := st.Config
+	var features []string
+	if cfg.Cluster != "" {
+		features = append(features, fmt.Sprintf("cluster=%s (%d peers cluster-wide)", cfg.Cluster, cfg.ClusterPeers))
+	}
+	if cfg.ACL {
+		features = append(features, "acl")
+	}
+	if cfg.AddrHints {
+		features = append(features, "addr_hints")
+	}
+	if len(features) == 0 {
+		features = append(features, "standalone")
+	}
+	fmt.Printf("Config:  %d allowed peers, %s\n", cfg.AllowedPeers, strings.Join(features, ", "))
+
+	fmt.Printf("Online:  %d\n", len(st.Peers))
+	if st.Mail > 0 {
+		fmt.Printf("Mail:    %d held for offline peers\n", st.Mail)
+	}
+	if len(st.Peers) == 0 {
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NICKNAME\tPEER ID\tONLINE FOR\tLAST ACTIVE")
+	for _, p := range st.Peers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s ago\n", p.Nickname, p.PeerID,
+			now.Sub(p.Since).Round(time.Second), now.Sub(p.LastActive).Round(time.Second))
+	}
+	w.Flush()
+}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/openpcc/twoway"
+	"github.com/pivaldi/tmd/internal/conformance"
+	"github.com/pivaldi/tmd/internal/identity"
+	"github.com/pivaldi/tmd/internal/node"
+)
+
+var update = flag.Bool("update", false, "regenerate golden conformance vectors")
+
+const vectorsDir = "internal/conformance/vectors"
+
+// seedDerivation is how the vectors' seeds give their keys: they predate
+// identity.DerivationHKDF, and the keys are part of the vectors.
+const seedDerivation = identity.DerivationDirect
+
+var (
+	aliceSeed = "0000000000000000000000000000000000000000000000000000000000000a11"
+	bobSeed   = "0000000000000000000000000000000000000000000000000000000000000b0b"
+	challenge = "c0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5d6d7d8d9dadbdcdddedf"
+)
+
+// signedHelloFor builds the Hello a peer with the given seed sends in
+// answer to chal, advertising maxFrame (0 for a pre-negotiation Hello) and
+// listing suites, if any (chal is then the whole CHALLENGE payload).
+func signedHelloFor(t *testing.T, nickname, seedHex string, chal []byte, maxFrame uint32, suites ...hpke.Suite) Hello {
+	t.Helper()
+	keys, err := identity.DeriveKeysWith(conformance.Hex(seedHex), seedDerivation)
+	if err != nil {
+		t.Fatalf("derive keys: %v", err)
+	}
+	h := Hello{
+		SenderID:      PeerID(nickname),
+		SenderKeyID:   keys.KeyID,
+		SenderEdPub:   keys.Ed25519Pub,
+		SenderHPKEPub: keys.HPKEPubBytes,
+		MaxFrame:      maxFrame,
+	}
+	if len(suites) > 0 {
+		h.Suites = encodeSuites(suites)
+	}
+	h.Signature = ed25519.Sign(keys.Ed25519Priv, helloSignInput(chal, h))
+	return h
+}
+
+func wireVectors(t *testing.T) []conformance.Vector {
+	in := map[string]string{
+		"nickname":  "alice",
+		"seed":      aliceSeed,
+		"challenge": challenge,
+	}
+	hello := signedHelloFor(t, in["nickname"], in["seed"], conformance.Hex(in["challenge"]), 0)
+
+	reqIn := map[string]string{
+		"request_id":       "0000000000000007",
+		"recipient_key_id": "4211223344556677",
+		"encap_key":        "aabbccdd",
+		"media_type":       "text/plain; purpose=req",
+		"ciphertext":       "00112233445566778899",
+	}
+	req := Request{
+		RequestID:      binary.BigEndian.Uint64(conformance.Hex(reqIn["request_id"])),
+		RecipientKeyID: conformance.Hex(reqIn["recipient_key_id"]),
+		EncapKey:       conformance.Hex(reqIn["encap_key"]),
+		MediaType:      []byte(reqIn["media_type"]),
+		Ciphertext:     conformance.Hex(reqIn["ciphertext"]),
+	}
+
+	respIn := map[string]string{
+		"request_id": "0000000000000007",
+		"media_type": "text/plain; purpose=resp",
+		"ciphertext": "ffeeddccbbaa",
+	}
+	resp := Response{
+		RequestID:  binary.BigEndian.Uint64(conformance.Hex(respIn["request_id"])),
+		MediaType:  []byte(respIn["media_type"]),
+		Ciphertext: conformance.Hex(respIn["ciphertext"]),
+	}
+
+	notifyIn := map[string]string{
+		"recipient_key_id": "4211223344556677",
+		"encap_key":        "aabbccdd",
+		"media_type":       "text/plain; purpose=notify",
+		"ciphertext":       "00112233445566778899",
+	}
+	notify := Notify{
+		RecipientKeyID: conformance.Hex(notifyIn["recipient_key_id"]),
+		EncapKey:       conformance.Hex(notifyIn["encap_key"]),
+		MediaType:      []byte(notifyIn["media_type"]),
+		Ciphertext:     conformance.Hex(notifyIn["ciphertext"]),
+	}
+
+	roomIn := map[string]string{
+		"room":       "#dev",
+		"gen":        "00000002",
+		"nonce":      "000102030405060708090a0b0c0d0e0f1011121314151617",
+		"ciphertext": "00112233445566778899",
+	}
+	roomMsg := RoomMessage{
+		Room:       roomIn["room"],
+		Gen:        binary.BigEndian.Uint32(conformance.Hex(roomIn["gen"])),
+		Nonce:      conformance.Hex(roomIn["nonce"]),
+		Ciphertext: conformance.Hex(roomIn["ciphertext"]),
+	}
+
+	fileIn := map[string]string{
+		"transfer_id":      "000102030405060708090a0b0c0d0e0f",
+		"chunks":           "00000002",
+		"index":            "00000001",
+		"recipient_key_id": "4211223344556677",
+		"encap_key":        "aabbccdd",
+		"ciphertext":       "00112233445566778899",
+	}
+	fileSealed := func(mediaType string) Notify {
+		return Notify{
+			RecipientKeyID: conformance.Hex(fileIn["recipient_key_id"]),
+			EncapKey:       conformance.Hex(fileIn["encap_key"]),
+			MediaType:      []byte(mediaType),
+			Ciphertext:     conformance.Hex(fileIn["ciphertext"]),
+		}
+	}
+	fileOffer := FileOffer{
+		TransferID: conformance.Hex(fileIn["transfer_id"]),
+		Chunks:     binary.BigEndian.Uint32(conformance.Hex(fileIn["chunks"])),
+		Sealed:     fileSealed(fileOfferMediaType),
+	}
+	fileChunk := FileChunk{
+		TransferID: conformance.Hex(fileIn["transfer_id"]),
+		Index:      binary.BigEndian.Uint32(conformance.Hex(fileIn["index"])),
+		Sealed:     fileSealed(fileChunkMediaType),
+	}
+
+	resumeIn := map[string]string{"transfer_id": "000102030405060708090a0b0c0d0e0f", "missing": "0000000100000003"}
+	resume := FileResume{
+		TransferID: conformance.Hex(resumeIn["transfer_id"]),
+		Missing:    [][2]uint32{{1, 3}},
+	}
+
+	streamIn := map[string]string{
+		"request_id":       "0000000000000009",
+		"recipient_key_id": "4211223344556677",
+		"encap_key":        "aabbccdd",
+		"media_type":       "application/octet-stream",
+		"data":             "00112233445566778899",
+		"error":            "out of space",
+		"frames":           "00000020",
+	}
+	streamID := binary.BigEndian.Uint64(conformance.Hex(streamIn["request_id"]))
+	streamOpen := StreamOpen{
+		RequestID:      streamID,
+		RecipientKeyID: conformance.Hex(streamIn["recipient_key_id"]),
+		EncapKey:       conformance.Hex(streamIn["encap_key"]),
+		MediaType:      []byte(streamIn["media_type"]),
+	}
+
+	reqIDIn := map[string]string{"message_id": "0f0e0d0c0b0a09080706050403020100"}
+	for k, v := range reqIn {
+		reqIDIn[k] = v
+	}
+	reqWithID := req
+	reqWithID.MessageID = conformance.Hex(reqIDIn["message_id"])
+
+	reqPrioIn := map[string]string{"priority": "01"}
+	for k, v := range reqIDIn {
+		reqPrioIn[k] = v
+	}
+	reqWithPrio := reqWithID
+	reqWithPrio.Priority = conformance.Hex(reqPrioIn["priority"])[0]
+
+	reqTimeoutIn := map[string]string{"timeout_ms": "00015f90"}
+	for k, v := range reqPrioIn {
+		reqTimeoutIn[k] = v
+	}
+	reqWithTimeout := reqWithPrio
+	reqWithTimeout.Timeout = time.Duration(binary.BigEndian.Uint32(conformance.Hex(reqTimeoutIn["timeout_ms"]))) * time.Millisecond
+
+	receiptIn := map[string]string{"request_id": "0000000000000007", "kind": "02"}
+	receipt := Receipt{
+		RequestID: binary.BigEndian.Uint64(conformance.Hex(receiptIn["request_id"])),
+		Kind:      conformance.Hex(receiptIn["kind"])[0],
+	}
+
+	typingIn := map[string]string{
+		"recipient_key_id": notifyIn["recipient_key_id"],
+		"encap_key":        notifyIn["encap_key"],
+		"media_type":       typingMediaType,
+		"ciphertext":       notifyIn["ciphertext"],
+	}
+	typing := notify
+	typing.MediaType = []byte(typingIn["media_type"])
+
+	goodbyeIn := map[string]string{"nickname": "alice"}
+
+	limitsIn := map[string]string{"nickname": "alice", "seed": aliceSeed, "challenge": challenge, "max_frame": "1048576"}
+	limitsHello := signedHelloFor(t, limitsIn["nickname"], limitsIn["seed"], conformance.Hex(limitsIn["challenge"]), defaultMaxFrame)
+
+	// The listener offers supportedSuites; the Hello lists the same and
+	// signs the whole CHALLENGE payload.
+	suitesIn := map[string]string{"nickname": "alice", "seed": aliceSeed, "challenge": challenge, "max_frame": "1048576",
+		"suites": hex.EncodeToString(encodeSuites(supportedSuites))}
+	suitesChallenge := encodeChallenge(conformance.Hex(challenge), defaultMaxFrame, supportedSuites, 0)
+	suitesHello := signedHelloFor(t, suitesIn["nickname"], suitesIn["seed"], suitesChallenge, defaultMaxFrame, supportedSuites...)
+
+	profileIn := map[string]string{"nickname": "alice", "seed": aliceSeed, "challenge": challenge, "display_name": "Alice", "note": "hi"}
+	profileHello := signedHelloFor(t, profileIn["nickname"], profileIn["seed"], conformance.Hex(profileIn["challenge"]), 0)
+	profileKeys, err := identity.DeriveKeysWith(conformance.Hex(aliceSeed), seedDerivation)
+	if err != nil {
+		t.Fatalf("derive keys: %v", err)
+	}
+	profileHello.Profile, err = signProfile(Profile{DisplayName: profileIn["display_name"], Note: profileIn["note"]}, "alice", profileKeys.Ed25519Priv)
+	if err != nil {
+		t.Fatalf("sign profile: %v", err)
+	}
+
+	// The Hello also carries the HPKE key signed on its own (see keysig.go).
+	keySigIn := map[string]string{"nickname": "alice", "seed": aliceSeed, "challenge": challenge}
+	keySigHello := signedHelloFor(t, keySigIn["nickname"], keySigIn["seed"], conformance.Hex(keySigIn["challenge"]), 0)
+	keySigHello.KeySig = ed25519.Sign(profileKeys.Ed25519Priv, node.KeySignInput("alice", keySigHello.SenderKeyID, keySigHello.SenderHPKEPub))
+
+	// The listener offers binding too (see binding.go): the Hello sets the
+	// feature and signs the connection as well.
+	bobKeys, err := identity.DeriveKeysWith(conformance.Hex(bobSeed), seedDerivation)
+	if err != nil {
+		t.Fatalf("derive keys: %v", err)
+	}
+	boundIn := map[string]string{"nickname": "alice", "seed": aliceSeed, "challenge": challenge, "max_frame": "1048576",
+		"suites": suitesIn["suites"], "dialer_peer_id": profileKeys.PeerID.String(), "listener_peer_id": bobKeys.PeerID.String(),
+		"protocol": ProtocolID, "suite": hex.EncodeToString(encodeSuites(supportedSuites[:1])),
+		"features": hex.EncodeToString(binary.BigEndian.AppendUint32(nil, featureBinding))}
+	boundChallenge := encodeChallenge(conformance.Hex(challenge), defaultMaxFrame, supportedSuites, featureBinding)
+	boundHello := signedHelloFor(t, boundIn["nickname"], boundIn["seed"], nil, defaultMaxFrame)
+	boundHello.Suites = encodeSuites(supportedSuites)
+	boundHello.Features = featureBinding
+	boundHello.Signature = ed25519.Sign(profileKeys.Ed25519Priv, helloSignInput(append(slices.Clip(boundChallenge),
+		channelBinding(profileKeys.PeerID, bobKeys.PeerID, ProtocolID, supportedSuites[0])...), boundHello))
+
+	chanIn := map[string]string{
+		"channel_id":       "0000000000000003",
+		"recipient_key_id": notifyIn["recipient_key_id"],
+		"encap_key":        notifyIn["encap_key"],
+		"seq":              "0000000000000001",
+		"ciphertext":       notifyIn["ciphertext"],
+	}
+	chanID := binary.BigEndian.Uint64(conformance.Hex(chanIn["channel_id"]))
+	chanOpen := ChanOpen{ChannelID: chanID, RecipientKeyID: conformance.Hex(chanIn["recipient_key_id"]), EncapKey: conformance.Hex(chanIn["encap_key"])}
+	chanData := ChanData{ChannelID: chanID, Seq: binary.BigEndian.Uint64(conformance.Hex(chanIn["seq"])), Ciphertext: conformance.Hex(chanIn["ciphertext"])}
+
+	// Last fragment of a GOODBYE from "a": type || blob("a").
+	fragIn := map[string]string{"more": "00", "chunk": "05" + "00000001" + "61"}
+
+	return []conformance.Vector{
+		{Name: "challenge", Type: msgChallenge, Inputs: map[string]string{"challenge": challenge},
+			Frame: conformance.Frame(msgChallenge, conformance.Hex(challenge))},
+		{Name: "hello", Type: msgHello, Inputs: in, Frame: conformance.Frame(msgHello, encodeHello(hello))},
+		{Name: "request", Type: msgRequest, Inputs: reqIn, Frame: conformance.Frame(msgRequest, encodeRequest(req))},
+		{Name: "response", Type: msgResponse, Inputs: respIn, Frame: conformance.Frame(msgResponse, encodeResponse(resp))},
+		{Name: "goodbye", Type: msgGoodbye, Inputs: goodbyeIn,
+			Frame: conformance.Frame(msgGoodbye, encodeGoodbye(Goodbye{SenderID: PeerID(goodbyeIn["nickname"])}))},
+		{Name: "challenge_max_frame", Type: msgChallenge, Inputs: map[string]string{"challenge": challenge, "max_frame": "1048576"},
+			Frame: conformance.Frame(msgChallenge, encodeChallenge(conformance.Hex(challenge), defaultMaxFrame, nil, 0))},
+		{Name: "hello_max_frame", Type: msgHello, Inputs: limitsIn, Frame: conformance.Frame(msgHello, encodeHello(limitsHello))},
+		{Name: "fragment_last", Type: msgFragment, Inputs: fragIn,
+			Frame: conformance.Frame(msgFragment, conformance.Hex(fragIn["more"]+fragIn["chunk"]))},
+		{Name: "notify", Type: msgNotify, Inputs: notifyIn, Frame: conformance.Frame(msgNotify, encodeNotify(notify))},
+		{Name: "room", Type: msgRoom, Inputs: roomIn, Frame: conformance.Frame(msgRoom, encodeRoomMessage(roomMsg))},
+		{Name: "file_offer", Type: msgFileOffer, Inputs: fileIn, Frame: conformance.Frame(msgFileOffer, encodeFileOffer(fileOffer))},
+		{Name: "file_chunk", Type: msgFileChunk, Inputs: fileIn, Frame: conformance.Frame(msgFileChunk, encodeFileChunk(fileChunk))},
+		{Name: "file_resume", Type: msgFileResume, Inputs: resumeIn, Frame: conformance.Frame(msgFileResume, encodeFileResume(resume))},
+		{Name: "stream_open", Type: msgStreamOpen, Inputs: streamIn, Frame: conformance.Frame(msgStreamOpen, encodeStreamOpen(streamOpen))},
+		{Name: "stream_data", Type: msgStreamData, Inputs: streamIn,
+			Frame: conformance.Frame(msgStreamData, encodeStreamData(StreamData{RequestID: streamID, Data: conformance.Hex(streamIn["data"])}))},
+		{Name: "stream_end", Type: msgStreamEnd, Inputs: streamIn,
+			Frame: conformance.Frame(msgStreamEnd, encodeStreamEnd(StreamEnd{RequestID: streamID, Error: streamIn["error"]}))},
+		{Name: "stream_credit", Type: msgStreamCred, Inputs: streamIn,
+			Frame: conformance.Frame(msgStreamCred, encodeStreamCredit(StreamCredit{RequestID: streamID, Frames: binary.BigEndian.Uint32(conformance.Hex(streamIn["frames"]))}))},
+		{Name: "receipt", Type: msgReceipt, Inputs: receiptIn, Frame: conformance.Frame(msgReceipt, encodeReceipt(receipt))},
+		{Name: "request_message_id", Type: msgRequest, Inputs: reqIDIn, Frame: conformance.Frame(msgRequest, encodeRequest(reqWithID))},
+		{Name: "typing", Type: msgTyping, Inputs: typingIn, Frame: conformance.Frame(msgTyping, encodeNotify(typing))},
+		{Name: "request_priority", Type: msgRequest, Inputs: reqPrioIn, Frame: conformance.Frame(msgRequest, encodeRequest(reqWithPrio))},
+		{Name: "request_timeout", Type: msgRequest, Inputs: reqTimeoutIn, Frame: conformance.Frame(msgRequest, encodeRequest(reqWithTimeout))},
+		{Name: "hello_profile", Type: msgHello, Inputs: profileIn, Frame: conformance.Frame(msgHello, encodeHello(profileHello))},
+		{Name: "chan_open", Type: msgChanOpen, Inputs: chanIn, Frame: conformance.Frame(msgChanOpen, encodeChanOpen(chanOpen))},
+		{Name: "chan_data", Type: msgChanData, Inputs: chanIn, Frame: conformance.Frame(msgChanData, encodeChanData(chanData))},
+		{Name: "chan_close", Type: msgChanClose, Inputs: chanIn,
+			Frame: conformance.Frame(msgChanClose, encodeChanClose(ChanClose{ChannelID: chanID}))},
+		{Name: "challenge_suites", Type: msgChallenge, Inputs: suitesIn, Frame: conformance.Frame(msgChallenge, suitesChallenge)},
+		{Name: "hello_suites", Type: msgHello, Inputs: suitesIn, Frame: conformance.Frame(msgHello, encodeHello(suitesHello))},
+		{Name: "hello_key_sig", Type: msgHello, Inputs: keySigIn, Frame: conformance.Frame(msgHello, encodeHello(keySigHello))},
+		{Name: "challenge_bound", Type: msgChallenge, Inputs: boundIn, Frame: conformance.Frame(msgChallenge, boundChallenge)},
+		{Name: "hello_bound", Type: msgHello, Inputs: boundIn, Frame: conformance.Frame(msgHello, encodeHello(boundHello))},
+	}
+}
+
+// handshakeTranscript replays a full alice -> bob exchange with
+// deterministic randomness: CHALLENGE, HELLO, one sealed REQUEST and its
+// sealed RESPONSE.
+func handshakeTranscript(t *testing.T) conformance.Transcript {
+	in := map[string]string{
+		"dialer":         "alice",
+		"dialer_seed":    aliceSeed,
+		"listener_seed":  bobSeed,
+		"challenge":      challenge,
+		"request":        "hello bob",
+		"response":       "message received",
+		"rand_dialer":    "tmd-conformance-dialer",
+		"rand_listener":  "tmd-conformance-listener",
+		"hpke_suite_ids": "0020/0001/0001",
+		"max_frame":      "1048576",
+	}
+
+	chal := conformance.Hex(in["challenge"])
+	hello := signedHelloFor(t, in["dialer"], in["dialer_seed"], chal, defaultMaxFrame)
+
+	bob, err := identity.DeriveKeysWith(conformance.Hex(in["listener_seed"]), seedDerivation)
+	if err != nil {
+		t.Fatalf("derive keys: %v", err)
+	}
+	suite := hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+
+	sender := twoway.NewMultiRequestSender(suite, conformance.NewDeterministicReader(in["rand_dialer"]))
+	reqMediaType := []byte("text/plain; purpose=req")
+	sealer, err := sender.NewRequestSealer(strings.NewReader(in["request"]), reqMediaType)
+	if err != nil {
+		t.Fatalf("NewRequestSealer: %v", err)
+	}
+	reqCT, err := io.ReadAll(sealer)
+	if err != nil {
+		t.Fatalf("seal request: %v", err)
+	}
+	encap, openResp, err := sealer.EncapsulateKey(bob.KeyID[0], bob.HPKEPub)
+	if err != nil {
+		t.Fatalf("EncapsulateKey: %v", err)
+	}
+	req := Request{RequestID: 1, RecipientKeyID: bob.KeyID, EncapKey: encap, MediaType: reqMediaType, Ciphertext: reqCT}
+
+	receiver, err := twoway.NewMultiRequestReceiver(suite, bob.KeyID[0], bob.HPKEPriv, conformance.NewDeterministicReader(in["rand_listener"]))
+	if err != nil {
+		t.Fatalf("NewMultiRequestReceiver: %v", err)
+	}
+	opener, err := receiver.NewRequestOpener(req.EncapKey, bytes.NewReader(req.Ciphertext), req.MediaType)
+	if err != nil {
+		t.Fatalf("NewRequestOpener: %v", err)
+	}
+	plain, err := io.ReadAll(opener)
+	if err != nil || string(plain) != in["request"] {
+		t.Fatalf("open request: %q, %v", plain, err)
+	}
+	respMediaType := []byte("text/plain; purpose=resp")
+	respSealer, err := opener.NewResponseSealer(strings.NewReader(in["response"]), respMediaType)
+	if err != nil {
+		t.Fatalf("NewResponseSealer: %v", err)
+	}
+	respCT, err := io.ReadAll(respSealer)
+	if err != nil {
+		t.Fatalf("seal response: %v", err)
+	}
+	respOpener, err := openResp(bytes.NewReader(respCT), respMediaType)
+	if err != nil {
+		t.Fatalf("open response: %v", err)
+	}
+	if got, _ := io.ReadAll(respOpener); string(got) != in["response"] {
+		t.Fatalf("response plaintext mismatch: %q", got)
+	}
+	resp := Response{RequestID: 1, MediaType: respMediaType, Ciphertext: respCT}
+
+	return conformance.Transcript{
+		Name:   "alice_to_bob",
+		Inputs: in,
+		Steps: []conformance.Step{
+			{From: "listener", Type: msgChallenge, Frame: conformance.Frame(msgChallenge, encodeChallenge(chal, defaultMaxFrame, nil, 0))},
+			{From: "dialer", Type: msgHello, Frame: conformance.Frame(msgHello, encodeHello(hello))},
+			{From: "dialer", Type: msgRequest, Frame: conformance.Frame(msgRequest, encodeRequest(req))},
+			{From: "listener", Type: msgResponse, Frame: conformance.Frame(msgResponse, encodeResponse(resp))},
+		},
+	}
+}
+
+// helloChallenge returns the bytes a golden Hello signs besides its own
+// fields: the challenge, or the whole CHALLENGE payload when the Hello
+// lists suites, with the features offered, followed by the channel binding
+// when it sets featureBinding.
+func helloChallenge(t *testing.T, v conformance.Vector, h Hello) []byte {
+	t.Helper()
+	chal := conformance.Hex(v.Inputs["challenge"])
+	if len(h.Suites) > 0 {
+		offered, err := decodeSuites(conformance.Hex(v.Inputs["suites"]))
+		if err != nil {
+			t.Fatalf("decodeSuites: %v", err)
+		}
+		var features uint32
+		if f := conformance.Hex(v.Inputs["features"]); len(f) == 4 {
+			features = binary.BigEndian.Uint32(f)
+		}
+		chal = encodeChallenge(chal, defaultMaxFrame, offered, features)
+	}
+	if h.Features&featureBinding != 0 {
+		dialer, err1 := peer.Decode(v.Inputs["dialer_peer_id"])
+		listener, err2 := peer.Decode(v.Inputs["listener_peer_id"])
+		picked, err3 := decodeSuites(conformance.Hex(v.Inputs["suite"]))
+		if err := errors.Join(err1, err2, err3); err != nil || len(picked) != 1 {
+			t.Fatalf("%s: binding inputs: %v", v.Name, err)
+		}
+		chal = append(chal, channelBinding(dialer, listener, protocol.ID(v.Inputs["protocol"]), picked[0])...)
+	}
+	return chal
+}
+
+// goldenHello decodes the Hello of a vector.
+func goldenHello(t *testing.T, v conformance.Vector) Hello {
+	t.Helper()
+	_, payload, err := readMsg(bytes.NewReader(conformance.Hex(v.Frame)))
+	if err != nil {
+		t.Fatalf("%s: readMsg: %v", v.Name, err)
+	}
+	h, err := decodeHello(payload)
+	if err != nil {
+		t.Fatalf("%s: decodeHello: %v", v.Name, err)
+	}
+	return h
+}
+
+// helloSignatures lists the signatures of the Hello vectors with the
+// bytes they cover.
+func helloSignatures(t *testing.T, vectors []conformance.Vector) []conformance.Signature {
+	var sigs []conformance.Signature
+	for _, v := range vectors {
+		if v.Type != msgHello {
+			continue
+		}
+		h := goldenHello(t, v)
+		pub := hex.EncodeToString(h.SenderEdPub)
+		sigs = append(sigs, conformance.Signature{
+			Vector:    v.Name,
+			Field:     "signature",
+			Input:     hex.EncodeToString(helloSignInput(helloChallenge(t, v, h), h)),
+			PublicKey: pub,
+			Signature: hex.EncodeToString(h.Signature),
+		})
+		if len(h.KeySig) > 0 {
+			sigs = append(sigs, conformance.Signature{
+				Vector:    v.Name,
+				Field:     "key_sig",
+				Input:     hex.EncodeToString(node.KeySignInput(string(h.SenderID), h.SenderKeyID, h.SenderHPKEPub)),
+				PublicKey: pub,
+				Signature: hex.EncodeToString(h.KeySig),
+			})
+		}
+	}
+	return sigs
+}
+
+// wireRejects lists messages the strict decoders refuse (see
+// wire-format.go).
+func wireRejects(t *testing.T) []conformance.Reject {
+	req := encodeRequest(Request{
+		RequestID:      7,
+		RecipientKeyID: conformance.Hex("4211223344556677"),
+		EncapKey:       conformance.Hex("aabbccdd"),
+		MediaType:      []byte("text/plain; purpose=req"),
+		Ciphertext:     conformance.Hex("00112233445566778899"),
+	})
+	hello := encodeHello(signedHelloFor(t, "alice", aliceSeed, conformance.Hex(challenge), 0))
+	var overrun bytes.Buffer
+	writeRequestID(&overrun, 9)
+	overrun.Write([]byte{0xff, 0xff, 0xff, 0xf0})
+	return []conformance.Reject{
+		{Name: "request_trailing_byte", Type: msgRequest, Reason: "bytes after the last field",
+			Frame: conformance.Frame(msgRequest, append(slices.Clip(req), 0))},
+		{Name: "request_truncated", Type: msgRequest, Reason: "blob past the end of the message",
+			Frame: conformance.Frame(msgRequest, req[:len(req)-1])},
+		{Name: "stream_data_overrun", Type: msgStreamData, Reason: "blob length past the end of the message",
+			Frame: conformance.Frame(msgStreamData, overrun.Bytes())},
+		{Name: "hello_trailing_blob", Type: msgHello, Reason: "blob after the last known trailer",
+			Frame: conformance.Frame(msgHello, appendBlobs(hello, []byte{0, 0, 0, 0}, nil, nil, nil, nil, nil, nil))},
+		{Name: "goodbye_long_sender", Type: msgGoodbye, Reason: "sender ID over 256 bytes",
+			Frame: conformance.Frame(msgGoodbye, encodeGoodbye(Goodbye{SenderID: PeerID(strings.Repeat("a", maxNameField+1))}))},
+		{Name: "request_key_id_length", Type: msgRequest, Reason: "recipient key ID neither 8 bytes nor 1",
+			Frame: conformance.Frame(msgRequest, encodeRequest(Request{RequestID: 7, RecipientKeyID: make([]byte, 4)}))},
+	}
+}
+
+// appendBlobs appends blobs to an encoded message.
+func appendBlobs(p []byte, blobs ...[]byte) []byte {
+	b := bytes.NewBuffer(slices.Clip(p))
+	for _, blob := range blobs {
+		_ = writeBlob(b, blob)
+	}
+	return b.Bytes()
+}
+
+// decodeWire decodes a frame payload of any message type with a decoder.
+func decodeWire(typ byte, p []byte) error {
+	var err error
+	switch typ {
+	case msgHello:
+		_, err = decodeHello(p)
+	case msgRequest:
+		_, err = decodeRequest(p)
+	case msgResponse:
+		_, err = decodeResponse(p)
+	case msgGoodbye:
+		_, err = decodeGoodbye(p)
+	case msgNotify, msgTyping:
+		_, err = decodeNotify(p)
+	case msgRoom:
+		_, err = decodeRoomMessage(p)
+	case msgFileOffer:
+		_, err = decodeFileOffer(p)
+	case msgFileChunk:
+		_, err = decodeFileChunk(p)
+	case msgFileResume:
+		_, err = decodeFileResume(p)
+	case msgStreamOpen:
+		_, err = decodeStreamOpen(p)
+	case msgStreamData:
+		_, err = decodeStreamData(p)
+	case msgStreamEnd:
+		_, err = decodeStreamEnd(p)
+	case msgStreamCred:
+		_, err = decodeStreamCredit(p)
+	case msgReceipt:
+		_, err = decodeReceipt(p)
+	case msgChanOpen:
+		_, err = decodeChanOpen(p)
+	case msgChanData:
+		_, err = decodeChanData(p)
+	case msgChanClose:
+		_, err = decodeChanClose(p)
+	}
+	return err
+}
+
+func TestConformanceWire(t *testing.T) {
+	vectors := wireVectors(t)
+	transcript := handshakeTranscript(t)
+	signatures := helloSignatures(t, vectors)
+	rejects := wireRejects(t)
+
+	if *update {
+		suite := &conformance.Suite{
+			Description: "peer messaging protocol (" + ProtocolID + ")",
+			Vectors:     vectors,
+			Transcripts: []conformance.Transcript{transcript},
+			Signatures:  signatures,
+			Rejects:     rejects,
+		}
+		if err := conformance.Save(vectorsDir, "wire", suite); err != nil {
+			t.Fatalf("save vectors: %v", err)
+		}
+		t.Skip("vectors regenerated; rerun without -update to verify")
+	}
+
+	suite, err := conformance.Load("wire")
+	if err != nil {
+		t.Fatalf("load vectors: %v", err)
+	}
+	if len(suite.Vectors) != len(vectors) {
+		t.Fatalf("expected %d vectors, got %d", len(vectors), len(suite.Vectors))
+	}
+	for i, v := range suite.Vectors {
+		if v.Name != vectors[i].Name || v.Frame != vectors[i].Frame {
+			t.Fatalf("%s: encoding mismatch\n got  %s\n want %s", v.Name, vectors[i].Frame, v.Frame)
+		}
+		typ, payload, err := readMsg(bytes.NewReader(conformance.Hex(v.Frame)))
+		if err != nil || typ != v.Type {
+			t.Fatalf("%s: readMsg: typ=%d err=%v", v.Name, typ, err)
+		}
+		if err := decodeWire(typ, payload); err != nil {
+			t.Fatalf("%s: decode: %v", v.Name, err)
+		}
+	}
+	if !slices.Equal(suite.Signatures, signatures) {
+		t.Fatalf("signature vectors mismatch\n got  %+v\n want %+v", signatures, suite.Signatures)
+	}
+	if !slices.Equal(suite.Rejects, rejects) {
+		t.Fatalf("reject vectors mismatch\n got  %+v\n want %+v", rejects, suite.Rejects)
+	}
+	for _, v := range suite.Rejects {
+		typ, payload, err := readMsg(bytes.NewReader(conformance.Hex(v.Frame)))
+		if err != nil || typ != v.Type {
+			t.Fatalf("%s: readMsg: typ=%d err=%v", v.Name, typ, err)
+		}
+		if err := decodeWire(typ, payload); err == nil {
+			t.Fatalf("%s: decoded a message with %s", v.Name, v.Reason)
+		}
+	}
+
+	if len(suite.Transcripts) != 1 {
+		t.Fatalf("expected 1 transcript, got %d", len(suite.Transcripts))
+	}
+	golden := suite.Transcripts[0]
+	for i, step := range golden.Steps {
+		if step.Frame != transcript.Steps[i].Frame {
+			t.Fatalf("transcript step %d (%s): mismatch\n got  %s\n want %s", i, step.From, transcript.Steps[i].Frame, step.Frame)
+		}
+	}
+}
+
+// TestConformanceHelloVerifies checks that the golden Hello is accepted by
+// the current verifier, so signature input changes are caught as well.
+func TestConformanceHelloVerifies(t *testing.T) {
+	suite, err := conformance.Load("wire")
+	if err != nil {
+		t.Fatalf("load vectors: %v", err)
+	}
+	for _, v := range suite.Vectors {
+		if v.Type != msgHello {
+			continue
+		}
+		h := goldenHello(t, v)
+		if err := verifySignedHello(nil, helloChallenge(t, v, h), h); err != nil {
+			t.Fatalf("golden hello rejected: %v", err)
+		}
+		if err := checkHelloKeySig(h); err != nil {
+			t.Fatalf("golden hello key signature rejected: %v", err)
+		}
+		if len(h.Profile) > 0 {
+			if _, err := openProfile(h.Profile, h.SenderID, verifyEd(h.SenderEdPub)); err != nil {
+				t.Fatalf("golden hello profile rejected: %v", err)
+			}
+		}
+	}
+}
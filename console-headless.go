@@ -0,0 +1,569 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Console is the user-facing side of a peer: where history lines, direct
+// messages and errors are shown, and where input lines come from. The tcell
+// TUI (tuiConsole) is the interactive implementation; headlessConsole
+// records everything in memory for tests and scripted runs.
+type Console interface {
+	// AddHistory appends a line to the general history.
+	AddHistory(text string)
+	// AddDirectMessage queues an unreplied direct message and logs it.
+	AddDirectMessage(from PeerID, message string)
+	// ClearQueue drops queued messages from a peer and returns how many.
+	ClearQueue(peerID PeerID) int
+	// Printf appends a formatted line to the history.
+	Printf(format string, args ...any)
+	// Errorf appends a formatted error line to the history.
+	Errorf(format string, args ...any)
+	// ReadLine blocks for the next input line; ok is false once closed.
+	ReadLine() (line string, ok bool)
+	// Close releases the console; pending ReadLine calls return.
+	Close()
+}
+
+// statusConsole is implemented by consoles with a status area, where
+// long-running operations such as file transfers report progress.
+type statusConsole interface {
+	// SetStatus shows text under key, replacing what was shown there;
+	// empty text removes the entry.
+	SetStatus(key, text string)
+}
+
+// printUsage writes the startup banner and command list to c.
+func printUsage(c Console, nickname PeerID, keyID []byte, selfEdPub ed25519.PublicKey, selfHPKEPubBytes []byte, peerID string) {
+	c.AddHistory(fmt.Sprintf("[%s] up with peerID=%s (keyID=%x)", nickname, peerID, keyID))
+	c.AddHistory(fmt.Sprintf("[%s] pinned Ed25519 pub: %x", nickname, selfEdPub))
+	c.AddHistory(fmt.Sprintf("[%s] pinned HPKE pub:    %x", nickname, selfHPKEPubBytes))
+	c.AddHistory("")
+	c.AddHistory("Commands:")
+	c.AddHistory("  @peer message   send a request")
+	c.AddHistory("  /reply peer[#n] msg answer the oldest (or nth) message from peer, quoting it")
+	c.AddHistory("  /notify peer msg send a one-way note to peer")
+	c.AddHistory("  /forward peer[#n] @to pass the last (or nth last) message from peer on")
+	c.AddHistory("  /react peer[#n] 👍  react to the last (or nth last) message from peer")
+	c.AddHistory("  /edit peer[#n] msg change your last (or nth last) message to peer (/delete peer[#n])")
+	c.AddHistory("  /join #room     join a room (/leave, /rooms); #room msg sends to it")
+	c.AddHistory("  /send-file peer path send a file (/files, /save n [path], /discard n, /resume n)")
+	c.AddHistory("  /outbox         list messages queued for offline peers (/unqueue n)")
+	c.AddHistory("  /schedule @peer 2026-01-01T10:00 msg  send later (/scheduled, /unschedule n)")
+	c.AddHistory("  /search words   find words in history and show the latest (again: older)")
+	c.AddHistory("  /export @peer file.md  write a conversation to markdown (or .json)")
+	c.AddHistory("  /sync           pull history and outbox from your --devices now")
+	c.AddHistory("  /fingerprint peer  words to compare with peer out of band")
+	c.AddHistory("  /myqr [file.png] show your contact card as a QR code to scan and pin")
+	c.AddHistory("  /audit [n]      check the --audit log and show its last n events")
+	c.AddHistory("  /verify peer    mark peer's pinned keys as checked (--pins)")
+	c.AddHistory("  /vouch peer [to] send the keys you verified for peer to to, or to all")
+	c.AddHistory("  /repin peer     accept peer's new keys (--pins)")
+	c.AddHistory("  /requests       list messages of untrusted peers (/accept peer, /decline peer)")
+	c.AddHistory("  /revoke reason  revoke our keys for good, through the nodes")
+	c.AddHistory("  /peers          list online peers")
+	c.AddHistory("  /book [peer]    list the --addressbook (/note peer text, /forget peer)")
+	c.AddHistory("  /suite [peer [name]] list HPKE suites, require one with peer (--addressbook)")
+	c.AddHistory("  /status away    tell peers you are away (available, busy)")
+	c.AddHistory("  /whois peer     show the profile peer signed")
+	c.AddHistory("  /chan peer [msg] open a duplex channel and send on it (/unchan peer)")
+	c.AddHistory("  /call peer method [params]  call a method the peer serves, e.g. getTime")
+	c.AddHistory("  /autoreply      list the --autoreply rules (/autoreply off)")
+	c.AddHistory("  /block peer     refuse peer by key (/unblock, /blocked)")
+	c.AddHistory("  /mentions       list broadcasts that mentioned @you")
+	c.AddHistory("  /follow [peer]  only show presence of followed peers (/unfollow)")
+	c.AddHistory("  /hide peer      hide a peer's presence (/unhide)")
+	c.AddHistory("  /mute peer      keep peer out of the queue, quietly (/unmute, /muted)")
+	c.AddHistory("  /quit           exit")
+	c.AddHistory("  Tab             select in the direct queue (Enter reply, d dismiss, o open)")
+	c.AddHistory("")
+}
+
+// nopConsole discards all output and never yields input. It is the
+// connPool default until a real console is attached.
+type nopConsole struct{}
+
+func (nopConsole) AddHistory(string)               {}
+func (nopConsole) AddDirectMessage(PeerID, string) {}
+func (nopConsole) ClearQueue(PeerID) int           { return 0 }
+func (nopConsole) Printf(string, ...any)           {}
+func (nopConsole) Errorf(string, ...any)           {}
+func (nopConsole) ReadLine() (string, bool)        { return "", false }
+func (nopConsole) Close()                          {}
+
+// receiptConsole is implemented by consoles that show the delivery state
+// of sent direct messages next to them.
+type receiptConsole interface {
+	// AddSent appends a sent message to the history, marked sent, and
+	// returns an ID for SetReceipt.
+	AddSent(text string) uint64
+	// SetReceipt marks the message added under id "delivered" or "read".
+	SetReceipt(id uint64, state string)
+}
+
+// readConsole is implemented by consoles that tell when the user has seen
+// the direct messages from a peer, for read receipts.
+type readConsole interface {
+	// OnRead registers fn, called (on its own goroutine) with the peer
+	// whose messages were seen.
+	OnRead(fn func(from PeerID))
+}
+
+// typingConsole is implemented by consoles that tell when the user is
+// composing a message to a peer, for typing signals.
+type typingConsole interface {
+	// OnTyping registers fn, called (on its own goroutine) with the peer
+	// addressed by the line being typed, on every keystroke.
+	OnTyping(fn func(to PeerID))
+}
+
+// headlessConsole is an in-memory Console. Input is fed with Feed and all
+// output is recorded so tests can assert on it.
+type headlessConsole struct {
+	mu       sync.Mutex
+	changed  *sync.Cond
+	history  []string
+	times    []time.Time    // when each history line was added
+	synced   map[int]PeerID // history lines synced from another device
+	queue    map[PeerID][]string
+	status   map[string]string
+	sent     []sentLine // AddSent lines, by ID-1
+	presence map[PeerID]string
+	trust    map[PeerID]string // see SetPeerTrust
+	requests map[PeerID][]string
+	onRead   func(PeerID)
+	typing   func(PeerID)
+	index    historyIndex
+	search   searchState
+
+	inputCh   chan string
+	quitCh    chan struct{}
+	closeOnce sync.Once
+}
+
+func newHeadlessConsole() *headlessConsole {
+	c := &headlessConsole{
+		queue:    make(map[PeerID][]string),
+		status:   make(map[string]string),
+		presence: make(map[PeerID]string),
+		trust:    make(map[PeerID]string),
+		requests: make(map[PeerID][]string),
+		inputCh:  make(chan string, 64),
+		quitCh:   make(chan struct{}),
+	}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *headlessConsole) AddHistory(text string) {
+	c.mu.Lock()
+	c.history = append(c.history, strings.TrimRight(text, "\n"))
+	c.times = append(c.times, time.Now())
+	c.index.add(len(c.history)-1, c.history[len(c.history)-1])
+	c.changed.Broadcast()
+	c.mu.Unlock()
+}
+
+func (c *headlessConsole) AddDirectMessage(from PeerID, message string) {
+	c.mu.Lock()
+	c.queue[from] = append(c.queue[from], message)
+	c.mu.Unlock()
+
+	c.AddHistory(fmt.Sprintf("[from %s] %s", from, message))
+}
+
+// AddMention records a highlighted line as "[mention] text".
+func (c *headlessConsole) AddMention(text string) {
+	c.AddHistory("[mention] " + text)
+}
+
+// SetPeerPresence records the presence of peer (see PeerPresence).
+func (c *headlessConsole) SetPeerPresence(peer PeerID, presence string) {
+	c.mu.Lock()
+	c.presence[peer] = presence
+	c.changed.Broadcast()
+	c.mu.Unlock()
+}
+
+// SetPeerTrust records the key state of peer (see PeerTrust).
+func (c *headlessConsole) SetPeerTrust(peer PeerID, trust string) {
+	c.mu.Lock()
+	c.trust[peer] = trust
+	c.changed.Broadcast()
+	c.mu.Unlock()
+}
+
+// PeerTrust returns the key state last set for peer.
+func (c *headlessConsole) PeerTrust(peer PeerID) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.trust[peer]
+}
+
+// SetRequests records the message requests of peer (see Requests).
+func (c *headlessConsole) SetRequests(peer PeerID, messages []string) {
+	c.mu.Lock()
+	if len(messages) == 0 {
+		delete(c.requests, peer)
+	} else {
+		c.requests[peer] = append([]string(nil), messages...)
+	}
+	c.changed.Broadcast()
+	c.mu.Unlock()
+}
+
+// Requests returns a copy of the message requests last set for peer.
+func (c *headlessConsole) Requests(peer PeerID) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.requests[peer]...)
+}
+
+// PeerPresence returns the presence last set for peer.
+func (c *headlessConsole) PeerPresence(peer PeerID) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.presence[peer]
+}
+
+// sentLine is a history line added by AddSent.
+type sentLine struct {
+	index     int // in history
+	text      string
+	state     string
+	reactions string
+}
+
+// AddReaction appends reaction to the latest matching history line.
+func (c *headlessConsole) AddReaction(match func(line string) bool, reaction string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.history) - 1; i >= 0; i-- {
+		s := c.sentAtLocked(i)
+		if s == nil && match(c.history[i]) {
+			c.history[i] += "  " + reaction
+		} else if s != nil && match(s.text) {
+			s.reactions += "  " + reaction
+			c.history[i] = s.line()
+		} else {
+			continue
+		}
+		c.changed.Broadcast()
+		return true
+	}
+	return false
+}
+
+// sentAtLocked returns the sent line at index i of the history, if any.
+func (c *headlessConsole) sentAtLocked(i int) *sentLine {
+	for j := range c.sent {
+		if c.sent[j].index == i {
+			return &c.sent[j]
+		}
+	}
+	return nil
+}
+
+func (l *sentLine) line() string {
+	return l.text + " (" + l.state + ")" + l.reactions
+}
+
+// EditMessage changes the latest queued message old from a peer and its
+// history line.
+func (c *headlessConsole) EditMessage(from PeerID, old, text string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	queue := c.queue[from]
+	for i := len(queue) - 1; i >= 0; i-- {
+		if queue[i] == old {
+			if text == "" {
+				c.queue[from] = append(queue[:i:i], queue[i+1:]...)
+			} else {
+				queue[i] = text
+			}
+			break
+		}
+	}
+	for i := len(c.history) - 1; i >= 0; i-- {
+		if isMessageLine(c.history[i], from, old) {
+			c.history[i] = editedLine(from, text)
+			c.index.add(i, c.history[i])
+			c.changed.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+// Search searches the recorded history (see Searched).
+func (c *headlessConsole) Search(query string) (matches, shown int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.search.next(&c.index, query, func(pos int) string { return c.history[pos] })
+}
+
+// Conversation returns the recorded lines of the conversation with peer.
+func (c *headlessConsole) Conversation(peer PeerID) []conversationLine {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []conversationLine
+	for i, line := range c.history {
+		l := conversationLine{Time: c.times[i], Text: line}
+		if s := c.sentAtLocked(i); s != nil {
+			l.Text, l.State = s.text+s.reactions, s.state
+		}
+		if inConversation(l.Text, peer) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// LocalLines returns the message lines recorded on this device after t.
+func (c *headlessConsole) LocalLines(after time.Time) []conversationLine {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []conversationLine
+	for i, line := range c.history {
+		if _, ok := c.synced[i]; ok || !c.times[i].After(after) {
+			continue
+		}
+		l := conversationLine{Time: c.times[i], Text: line}
+		if s := c.sentAtLocked(i); s != nil {
+			l.Text, l.State = s.text, s.state
+		}
+		if syncedLine(l.Text) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// SyncedUntil returns the time of the latest line synced from device.
+func (c *headlessConsole) SyncedUntil(device PeerID) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var t time.Time
+	for i, d := range c.synced {
+		if d == device && c.times[i].After(t) {
+			t = c.times[i]
+		}
+	}
+	return t
+}
+
+// AddSynced records lines synced from another device with their time.
+func (c *headlessConsole) AddSynced(device PeerID, lines []conversationLine) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.synced == nil {
+		c.synced = make(map[int]PeerID)
+	}
+	for _, l := range lines {
+		c.synced[len(c.history)] = device
+		c.history = append(c.history, l.Text)
+		c.times = append(c.times, l.Time)
+		c.index.add(len(c.history)-1, l.Text)
+	}
+	c.changed.Broadcast()
+}
+
+// Searched returns the history line the last search shows, if any.
+func (c *headlessConsole) Searched() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pos, ok := c.search.current()
+	if !ok {
+		return "", false
+	}
+	return c.history[pos], true
+}
+
+// ClearQueue counts as reading the peer's messages.
+func (c *headlessConsole) ClearQueue(peerID PeerID) int {
+	c.mu.Lock()
+	count := len(c.queue[peerID])
+	delete(c.queue, peerID)
+	onRead := c.onRead
+	c.mu.Unlock()
+
+	if count > 0 && onRead != nil {
+		go onRead(peerID)
+	}
+	return count
+}
+
+func (c *headlessConsole) AddSent(text string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = append(c.sent, sentLine{index: len(c.history), text: text, state: "sent"})
+	c.history = append(c.history, text+" (sent)")
+	c.times = append(c.times, time.Now())
+	c.index.add(len(c.history)-1, text)
+	c.changed.Broadcast()
+	return uint64(len(c.sent))
+}
+
+func (c *headlessConsole) SetReceipt(id uint64, state string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id == 0 || id > uint64(len(c.sent)) {
+		return
+	}
+	l := &c.sent[id-1]
+	l.state = state
+	c.history[l.index] = l.line()
+	c.changed.Broadcast()
+}
+
+func (c *headlessConsole) OnRead(fn func(from PeerID)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onRead = fn
+}
+
+func (c *headlessConsole) Printf(format string, args ...any) {
+	c.AddHistory(fmt.Sprintf(format, args...))
+}
+
+func (c *headlessConsole) Errorf(format string, args ...any) {
+	c.AddHistory(fmt.Sprintf("[error] "+format, args...))
+}
+
+func (c *headlessConsole) SetStatus(key, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if text == "" {
+		delete(c.status, key)
+	} else {
+		c.status[key] = text
+	}
+}
+
+func (c *headlessConsole) ReadLine() (string, bool) {
+	select {
+	case line := <-c.inputCh:
+		return line, true
+	case <-c.quitCh:
+		return "", false
+	}
+}
+
+func (c *headlessConsole) Close() {
+	c.closeOnce.Do(func() { close(c.quitCh) })
+}
+
+func (c *headlessConsole) OnTyping(fn func(to PeerID)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.typing = fn
+}
+
+// Compose reports a partly typed line, as the TUI does on keystrokes.
+func (c *headlessConsole) Compose(partial string) {
+	c.mu.Lock()
+	fn := c.typing
+	c.mu.Unlock()
+	if to, ok := composingTo(partial); ok && fn != nil {
+		go fn(to)
+	}
+}
+
+// Feed queues an input line as if the user had typed it.
+func (c *headlessConsole) Feed(line string) {
+	c.inputCh <- line
+}
+
+// History returns a copy of every recorded history line.
+func (c *headlessConsole) History() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.history...)
+}
+
+// Queue returns a copy of the queued direct messages from a peer.
+func (c *headlessConsole) Queue(from PeerID) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.queue[from]...)
+}
+
+// Status returns the status area entries, ordered by key.
+func (c *headlessConsole) Status() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return statusLines(c.status)
+}
+
+// WaitFor blocks until a history line contains substr or the timeout
+// elapses, and reports whether it was found.
+func (c *headlessConsole) WaitFor(substr string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		c.mu.Lock()
+		c.changed.Broadcast()
+		c.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		for _, line := range c.history {
+			if strings.Contains(line, substr) {
+				return true
+			}
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		c.changed.Wait()
+	}
+}
+
+// logConsole writes history lines to w (stderr in `tmd rpc` mode) and
+// never yields input: the process is driven by another channel.
+type logConsole struct {
+	mu        sync.Mutex
+	w         io.Writer
+	quitCh    chan struct{}
+	closeOnce sync.Once
+}
+
+func newLogConsole(w io.Writer) *logConsole {
+	return &logConsole{w: w, quitCh: make(chan struct{})}
+}
+
+func (c *logConsole) AddHistory(text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintln(c.w, strings.TrimRight(text, "\n"))
+}
+
+func (c *logConsole) AddDirectMessage(from PeerID, message string) {
+	c.AddHistory(fmt.Sprintf("[from %s] %s", from, message))
+}
+
+func (c *logConsole) ClearQueue(PeerID) int { return 0 }
+
+func (c *logConsole) Printf(format string, args ...any) {
+	c.AddHistory(fmt.Sprintf(format, args...))
+}
+
+func (c *logConsole) Errorf(format string, args ...any) {
+	c.AddHistory(fmt.Sprintf("[error] "+format, args...))
+}
+
+func (c *logConsole) ReadLine() (string, bool) {
+	<-c.quitCh
+	return "", false
+}
+
+func (c *logConsole) Close() {
+	c.closeOnce.Do(func() { close(c.quitCh) })
+}
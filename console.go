@@ -2,36 +2,60 @@
 package main
 
 import (
-	"crypto/ed25519"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gdamore/tcell/v2"
+	"github.com/pivaldi/tmd/internal/history"
 )
 
 type queuedMessage struct {
+	id        uint64 // identifies the message for selection and replies
 	from      PeerID
 	message   string
 	timestamp time.Time
 }
 
+// paneFocus is the pane receiving key events.
+type paneFocus int
+
+const (
+	focusInput paneFocus = iota
+	focusQueue
+)
+
 type historyMessage struct {
 	text      string
 	timestamp time.Time
+	sentID    uint64 // set by AddSent
+	state     string // sent, delivered or read, shown after text
+	reactions string // shown after state (see AddReaction)
+	mention   bool   // highlighted (see AddMention)
+	device    PeerID // the device of ours it was synced from (see AddSynced)
 }
 
-type console struct {
+type tuiConsole struct {
 	screen tcell.Screen
-	self   PeerInfo
-	pool   *connPool
 
 	// Message storage
 	queueMu   sync.Mutex
 	queue     map[PeerID][]queuedMessage // Unreplied messages per peer
+	nextID    uint64
+	focus     paneFocus           // Tab toggles between input and queue
+	selected  int                 // index in queueOrder() of the selected message
+	replyTo   *queuedMessage      // queued message answered by the line being typed
+	presence  map[PeerID]string   // peers not available (see SetPeerPresence)
+	requests  map[PeerID][]string // messages of untrusted peers (see SetRequests)
 	historyMu sync.Mutex
 	history   []historyMessage // All messages
+	tabs      []PeerID         // open conversation tabs
+	activeTab int              // 0 is General, i is tabs[i-1]
+	sentCount uint64           // IDs of AddSent lines
+	index     historyIndex     // words of history, for /search
+	search    searchState      // last /search, until Esc
 
 	// Input state
 	inputMu     sync.Mutex
@@ -41,16 +65,39 @@ type console struct {
 	// Render lock (tcell is not thread-safe)
 	renderMu sync.Mutex
 
+	// Status area entries (progress of file transfers), by key
+	statusMu sync.Mutex
+	status   map[string]string
+
+	// Peers' key states, shown as badges (see SetPeerTrust)
+	trustMu sync.Mutex
+	trust   map[PeerID]string
+
+	// Called when the user sees a peer's messages (see OnRead) and when
+	// typing to a peer (see OnTyping)
+	hooksMu  sync.Mutex
+	onRead   func(PeerID)
+	onTyping func(PeerID)
+
+	// Optional persistence of history and queue (see setStore)
+	storeMu sync.Mutex
+	store   *history.Store
+
 	// Channels
 	inputCh chan string
 	quitCh  chan struct{}
 }
 
-func newConsole(me PeerInfo, pool *connPool) (*console, error) {
+func newTUIConsole() (*tuiConsole, error) {
 	screen, err := tcell.NewScreen()
 	if err != nil {
 		return nil, err
 	}
+	return newTUIConsoleOn(screen)
+}
+
+// newTUIConsoleOn runs the console on screen (a simulation screen in tests).
+func newTUIConsoleOn(screen tcell.Screen) (*tuiConsole, error) {
 	if err := screen.Init(); err != nil {
 		return nil, err
 	}
@@ -59,14 +106,16 @@ func newConsole(me PeerInfo, pool *connPool) (*console, error) {
 	screen.EnableMouse()
 	screen.Clear()
 
-	c := &console{
-		screen:  screen,
-		self:    me,
-		pool:    pool,
-		queue:   make(map[PeerID][]queuedMessage),
-		history: make([]historyMessage, 0),
-		inputCh: make(chan string, 10),
-		quitCh:  make(chan struct{}),
+	c := &tuiConsole{
+		screen:   screen,
+		queue:    make(map[PeerID][]queuedMessage),
+		presence: make(map[PeerID]string),
+		requests: make(map[PeerID][]string),
+		history:  make([]historyMessage, 0),
+		status:   make(map[string]string),
+		trust:    make(map[PeerID]string),
+		inputCh:  make(chan string, 10),
+		quitCh:   make(chan struct{}),
 	}
 
 	// Start event handler
@@ -78,12 +127,75 @@ func newConsole(me PeerInfo, pool *connPool) (*console, error) {
 	return c, nil
 }
 
-func (c *console) Close() {
+func (c *tuiConsole) Close() {
 	close(c.quitCh)
 	c.screen.Fini()
+
+	c.storeMu.Lock()
+	defer c.storeMu.Unlock()
+	if c.store != nil {
+		_ = c.store.Close()
+		c.store = nil
+	}
+}
+
+// setStore restores the history and direct queue saved in s, then saves
+// every change to them there. The console closes s when it is closed.
+func (c *tuiConsole) setStore(s *history.Store) error {
+	lines, err := s.Lines()
+	if err != nil {
+		return err
+	}
+	queue, err := s.Queue()
+	if err != nil {
+		return err
+	}
+
+	c.historyMu.Lock()
+	restored := make([]historyMessage, 0, len(lines)+len(c.history))
+	for _, l := range lines {
+		restored = append(restored, historyMessage{text: l.Text, timestamp: l.Time, device: PeerID(l.Device)})
+	}
+	c.history = append(restored, c.history...)
+	c.index.reset()
+	for i, m := range c.history {
+		c.index.add(i, m.text)
+	}
+	c.search = searchState{}
+	c.historyMu.Unlock()
+
+	c.queueMu.Lock()
+	for _, q := range queue {
+		from := PeerID(q.From)
+		c.queue[from] = append(c.queue[from], queuedMessage{id: q.ID, from: from, message: q.Message, timestamp: q.Time})
+		c.nextID = max(c.nextID, q.ID)
+	}
+	c.queueMu.Unlock()
+
+	c.storeMu.Lock()
+	c.store = s
+	c.storeMu.Unlock()
+	c.render()
+	return nil
+}
+
+// persist applies a change to the store, if any. After a failure the
+// console stops saving and says so.
+func (c *tuiConsole) persist(change func(*history.Store) error) {
+	c.storeMu.Lock()
+	defer c.storeMu.Unlock()
+	if c.store == nil {
+		return
+	}
+	if err := change(c.store); err != nil {
+		_ = c.store.Close()
+		c.store = nil
+		// Callers may hold historyMu or queueMu.
+		go c.Errorf("history: %v (no longer saved)", err)
+	}
 }
 
-func (c *console) handleEvents() {
+func (c *tuiConsole) handleEvents() {
 	for {
 		select {
 		case <-c.quitCh:
@@ -105,7 +217,26 @@ func (c *console) handleEvents() {
 	}
 }
 
-func (c *console) handleKeyEvent(ev *tcell.EventKey) {
+func (c *tuiConsole) handleKeyEvent(ev *tcell.EventKey) {
+	c.queueMu.Lock()
+	if ev.Key() == tcell.KeyTab {
+		if c.focus == focusInput && len(c.queueOrderLocked()) > 0 {
+			c.focus = focusQueue
+		} else {
+			c.focus = focusInput
+		}
+		c.queueMu.Unlock()
+		c.render()
+		return
+	}
+	queueFocused := c.focus == focusQueue
+	c.queueMu.Unlock()
+	if queueFocused {
+		c.handleQueueKey(ev)
+		c.render()
+		return
+	}
+
 	c.inputMu.Lock()
 
 	switch ev.Key() {
@@ -115,10 +246,30 @@ func (c *console) handleKeyEvent(ev *tcell.EventKey) {
 			c.inputBuffer = ""
 			c.cursorPos = 0
 			c.inputMu.Unlock()
+			c.queueMu.Lock()
+			if c.replyTo != nil && !strings.HasPrefix(line, c.replyCommandLocked(*c.replyTo)) {
+				c.replyTo = nil // retargeted: no longer a reply
+			}
+			c.queueMu.Unlock()
 			c.inputCh <- line
 			c.render()
 			return
 		}
+	case tcell.KeyEscape:
+		c.inputMu.Unlock()
+		if c.leaveSearch() {
+			c.render()
+			return
+		}
+		c.queueMu.Lock()
+		replying := c.replyTo != nil
+		c.replyTo = nil
+		c.queueMu.Unlock()
+		if !replying {
+			c.closeTab()
+		}
+		c.render()
+		return
 	case tcell.KeyBackspace, tcell.KeyBackspace2:
 		if c.cursorPos > 0 {
 			c.inputBuffer = c.inputBuffer[:c.cursorPos-1] + c.inputBuffer[c.cursorPos:]
@@ -140,6 +291,9 @@ func (c *console) handleKeyEvent(ev *tcell.EventKey) {
 		r := ev.Rune()
 		c.inputBuffer = c.inputBuffer[:c.cursorPos] + string(r) + c.inputBuffer[c.cursorPos:]
 		c.cursorPos++
+		if to, ok := composingTo(c.inputBuffer); ok {
+			c.notifyTyping(to)
+		}
 	default:
 		// Check if it's a printable rune
 		if ev.Key() == tcell.KeyRune {
@@ -153,7 +307,195 @@ func (c *console) handleKeyEvent(ev *tcell.EventKey) {
 	c.render()
 }
 
-func (c *console) render() {
+// handleQueueKey handles a key while the Direct Queue pane has focus:
+// arrows move the selection, Enter starts a reply to the selected message,
+// 'd' dismisses it and 'o' opens its sender's conversation tab.
+func (c *tuiConsole) handleQueueKey(ev *tcell.EventKey) {
+	if ev.Key() == tcell.KeyCtrlC {
+		c.inputCh <- "/quit"
+		return
+	}
+
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+
+	order := c.queueOrderLocked()
+	if len(order) == 0 {
+		c.focus = focusInput
+		return
+	}
+	c.selected = min(max(c.selected, 0), len(order)-1)
+	msg := order[c.selected]
+
+	switch ev.Key() {
+	case tcell.KeyUp:
+		c.selected = max(c.selected-1, 0)
+	case tcell.KeyDown:
+		c.selected = min(c.selected+1, len(order)-1)
+	case tcell.KeyLeft:
+		c.switchTab(-1)
+	case tcell.KeyRight:
+		c.switchTab(1)
+	case tcell.KeyEscape:
+		c.focus = focusInput
+	case tcell.KeyEnter:
+		c.replyTo = &msg
+		c.focus = focusInput
+		c.inputMu.Lock()
+		c.inputBuffer = c.replyCommandLocked(msg)
+		c.cursorPos = len(c.inputBuffer)
+		c.inputMu.Unlock()
+	case tcell.KeyRune:
+		switch ev.Rune() {
+		case 'd':
+			c.removeQueuedLocked(msg)
+			c.notifyRead(msg.from)
+			if c.selected >= len(order)-1 {
+				c.selected = max(len(order)-2, 0)
+			}
+			if len(order) == 1 {
+				c.focus = focusInput
+			}
+		case 'o':
+			c.openTab(msg.from)
+		}
+	}
+}
+
+// replyCommandLocked starts the /reply line answering msg. Messages after
+// a peer's first are numbered, so that the reply quotes the right one.
+func (c *tuiConsole) replyCommandLocked(msg queuedMessage) string {
+	for i, m := range c.queue[msg.from] {
+		if m.id == msg.id && i > 0 {
+			return fmt.Sprintf("/reply %s#%d ", msg.from, i+1)
+		}
+	}
+	return "/reply " + string(msg.from) + " "
+}
+
+// queueOrderLocked lists queued messages in display order: peers sorted
+// by name, then by arrival.
+func (c *tuiConsole) queueOrderLocked() []queuedMessage {
+	peers := make([]PeerID, 0, len(c.queue))
+	for peerID, messages := range c.queue {
+		if len(messages) > 0 {
+			peers = append(peers, peerID)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+
+	var order []queuedMessage
+	for _, peerID := range peers {
+		order = append(order, c.queue[peerID]...)
+	}
+	return order
+}
+
+// removeQueuedLocked drops msg from the queue and reports whether it was
+// still queued.
+func (c *tuiConsole) removeQueuedLocked(msg queuedMessage) bool {
+	if c.replyTo != nil && c.replyTo.id == msg.id {
+		c.replyTo = nil
+	}
+	messages := c.queue[msg.from]
+	found := false
+	for i, m := range messages {
+		if m.id == msg.id {
+			messages = append(messages[:i:i], messages[i+1:]...)
+			found = true
+			c.persist(func(s *history.Store) error { return s.DeleteQueued(msg.id) })
+			break
+		}
+	}
+	if len(messages) == 0 {
+		delete(c.queue, msg.from)
+	} else {
+		c.queue[msg.from] = messages
+	}
+	return found
+}
+
+// openTab shows the conversation with peer in the history pane.
+func (c *tuiConsole) openTab(peer PeerID) {
+	c.notifyRead(peer)
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	for i, t := range c.tabs {
+		if t == peer {
+			c.activeTab = i + 1
+			return
+		}
+	}
+	c.tabs = append(c.tabs, peer)
+	c.activeTab = len(c.tabs)
+}
+
+// closeTab closes the active conversation tab, if any.
+func (c *tuiConsole) closeTab() {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	if c.activeTab == 0 {
+		return
+	}
+	c.tabs = append(c.tabs[:c.activeTab-1], c.tabs[c.activeTab:]...)
+	c.activeTab = min(c.activeTab, len(c.tabs))
+}
+
+func (c *tuiConsole) switchTab(delta int) {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	n := len(c.tabs) + 1
+	c.activeTab = ((c.activeTab+delta)%n + n) % n
+	if c.activeTab > 0 {
+		c.notifyRead(c.tabs[c.activeTab-1])
+	}
+}
+
+// OnRead registers fn to be told when the user sees the messages from a
+// peer: opening its tab, dismissing one of them or answering them.
+func (c *tuiConsole) OnRead(fn func(from PeerID)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onRead = fn
+}
+
+// OnTyping registers fn to be told the peer addressed by the line being
+// typed ("@peer ..." or "/reply peer ...") on every keystroke.
+func (c *tuiConsole) OnTyping(fn func(to PeerID)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.onTyping = fn
+}
+
+func (c *tuiConsole) notifyTyping(to PeerID) {
+	c.hooksMu.Lock()
+	fn := c.onTyping
+	c.hooksMu.Unlock()
+	if fn != nil {
+		go fn(to)
+	}
+}
+
+// notifyRead calls the OnRead function without holding up the caller,
+// which may hold the console's locks.
+func (c *tuiConsole) notifyRead(peer PeerID) {
+	c.hooksMu.Lock()
+	fn := c.onRead
+	c.hooksMu.Unlock()
+	if fn != nil {
+		go fn(peer)
+	}
+}
+
+// inConversation reports whether a history line belongs to the
+// conversation with peer: messages from it and messages sent to it.
+func inConversation(text string, peer PeerID) bool {
+	return strings.HasPrefix(text, "[from "+string(peer)+"] ") ||
+		strings.HasPrefix(text, "[broadcast from "+string(peer)+"] ") ||
+		(strings.HasPrefix(text, "[") && strings.Contains(text, " to "+string(peer)+"] "))
+}
+
+func (c *tuiConsole) render() {
 	c.renderMu.Lock()
 	defer c.renderMu.Unlock()
 
@@ -177,8 +519,24 @@ func (c *console) render() {
 	}
 	c.screen.SetContent(leftWidth, height-inputHeight-1, '┼', nil, tcell.StyleDefault)
 
-	// Render left pane (queue)
-	c.renderQueue(0, 0, leftWidth, height-inputHeight-1)
+	// Reply context on the separator above the input, or else the status
+	// area
+	c.queueMu.Lock()
+	if c.replyTo != nil {
+		ctx := fmt.Sprintf(" replying to %s: %s (Esc cancels) ", c.replyTo.from, c.replyTo.message)
+		c.drawText(leftWidth+2, height-inputHeight-1, rightWidth-2, ctx, tcell.StyleDefault.Dim(true))
+	} else if status := c.statusText(); status != "" {
+		c.drawText(leftWidth+2, height-inputHeight-1, rightWidth-2, " "+status+" ", tcell.StyleDefault.Dim(true))
+	}
+	c.queueMu.Unlock()
+
+	// Render left pane (queue), with the message requests under it
+	leftHeight := height - inputHeight - 1
+	if reqHeight := c.requestsHeight(leftHeight); reqHeight > 0 {
+		leftHeight -= reqHeight
+		c.renderRequests(0, leftHeight, leftWidth, reqHeight)
+	}
+	c.renderQueue(0, 0, leftWidth, leftHeight)
 
 	// Render right-top pane (history)
 	c.renderHistory(leftWidth+1, 0, rightWidth, rightTopHeight)
@@ -189,78 +547,200 @@ func (c *console) render() {
 	c.screen.Show()
 }
 
-func (c *console) renderQueue(x, y, width, height int) {
+func (c *tuiConsole) renderQueue(x, y, width, height int) {
 	c.queueMu.Lock()
 	defer c.queueMu.Unlock()
 
 	// Title
-	c.drawText(x, y, width, "Direct Queue", tcell.StyleDefault.Bold(true))
+	title := "Direct Queue"
+	if c.focus == focusQueue {
+		title = "Direct Queue (Enter reply, d dismiss, o open)"
+	}
+	c.drawText(x, y, width, title, tcell.StyleDefault.Bold(true))
 	currentY := y + 1
 
-	if len(c.queue) == 0 {
+	order := c.queueOrderLocked()
+	if len(order) == 0 {
 		c.drawText(x, currentY, width, "(no unreplied messages)", tcell.StyleDefault.Dim(true))
 		return
 	}
 
-	// Render queued messages by peer
-	for peerID, messages := range c.queue {
-		if len(messages) == 0 {
-			continue
+	// Lay out peer headers and messages, then scroll so that the
+	// selection stays visible.
+	type row struct {
+		indent int
+		text   string
+		style  tcell.Style
+	}
+	var rows []row
+	selectedRow := 0
+	for i, msg := range order {
+		if i == 0 || order[i-1].from != msg.from {
+			if i > 0 {
+				rows = append(rows, row{}) // Blank line between peers
+			}
+			header := fmt.Sprintf("%s%s%s (%d):", msg.from, c.trustMark(msg.from), presenceMark(c.presence[msg.from]), len(c.queue[msg.from]))
+			rows = append(rows, row{text: header, style: tcell.StyleDefault.Bold(true)})
 		}
 
+		text := msg.message
+		if len(text) > 50 {
+			text = text[:47] + "..."
+		}
+		style := tcell.StyleDefault
+		if c.focus == focusQueue && i == c.selected {
+			style = style.Reverse(true)
+			selectedRow = len(rows)
+		}
+		rows = append(rows, row{indent: 2, text: text, style: style})
+	}
+
+	visible := height - 1
+	start := 0
+	if selectedRow >= visible {
+		start = selectedRow - visible + 1
+	}
+	for _, r := range rows[start:] {
 		if currentY >= y+height {
 			break
 		}
+		c.drawText(x+r.indent, currentY, width-r.indent, r.text, r.style)
+		currentY++
+	}
+}
+
+// requestsHeight is the height of the requests pane, at most a third of
+// the left pane's; 0 without requests.
+func (c *tuiConsole) requestsHeight(height int) int {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	if len(c.requests) == 0 {
+		return 0
+	}
+	rows := 2 // separator and title
+	for _, msgs := range c.requests {
+		rows += 1 + len(msgs)
+	}
+	return min(rows, height/3)
+}
+
+func (c *tuiConsole) renderRequests(x, y, width, height int) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+
+	for i := x; i < x+width; i++ {
+		c.screen.SetContent(i, y, '─', nil, tcell.StyleDefault)
+	}
+	c.drawText(x, y+1, width, "Requests (/accept peer, /decline peer)", tcell.StyleDefault.Bold(true))
+	peers := make([]PeerID, 0, len(c.requests))
+	for peer := range c.requests {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
 
-		// Peer header with count
-		header := fmt.Sprintf("%s (%d):", peerID, len(messages))
+	currentY := y + 2
+	for _, peer := range peers {
+		if currentY >= y+height {
+			return
+		}
+		header := fmt.Sprintf("%s%s (%d):", peer, c.trustMark(peer), len(c.requests[peer]))
 		c.drawText(x, currentY, width, header, tcell.StyleDefault.Bold(true))
 		currentY++
-
-		// Show messages (truncated)
-		for _, msg := range messages {
+		for _, msg := range c.requests[peer] {
 			if currentY >= y+height {
-				break
+				return
 			}
-
-			text := msg.message
-			if len(text) > 50 {
-				text = text[:47] + "..."
+			if len(msg) > 50 {
+				msg = msg[:47] + "..."
 			}
-			c.drawText(x+2, currentY, width-2, text, tcell.StyleDefault)
+			c.drawText(x+2, currentY, width-2, msg, tcell.StyleDefault.Dim(true))
 			currentY++
 		}
-
-		currentY++ // Blank line between peers
 	}
 }
 
-func (c *console) renderHistory(x, y, width, height int) {
+func (c *tuiConsole) renderHistory(x, y, width, height int) {
 	c.historyMu.Lock()
 	defer c.historyMu.Unlock()
 
-	// Title
-	c.drawText(x, y, width, "General Messages", tcell.StyleDefault.Bold(true))
+	// Title, or the tab bar once a conversation is open
+	if len(c.tabs) == 0 {
+		c.drawText(x, y, width, "General Messages", tcell.StyleDefault.Bold(true))
+	} else {
+		tabX := x
+		for i, name := range append([]string{"General"}, peerNames(c.tabs)...) {
+			style := tcell.StyleDefault.Dim(true)
+			if i == c.activeTab {
+				style = tcell.StyleDefault.Bold(true).Reverse(true)
+			}
+			label := " " + name + " "
+			c.drawText(tabX, y, x+width-tabX, label, style)
+			tabX += len(label) + 1
+		}
+	}
 
-	if len(c.history) == 0 {
+	lines := c.history
+	if c.activeTab > 0 {
+		peer := c.tabs[c.activeTab-1]
+		lines = nil
+		for _, m := range c.history {
+			if inConversation(m.text, peer) {
+				lines = append(lines, m)
+			}
+		}
+	}
+
+	if len(lines) == 0 {
 		c.drawText(x, y+1, width, "(no messages yet)", tcell.StyleDefault.Dim(true))
 		return
 	}
 
-	// Calculate visible messages (show most recent)
+	// Calculate visible messages (show most recent, or center the
+	// search match shown)
 	startIdx := 0
-	if len(c.history) > height-1 {
-		startIdx = len(c.history) - (height - 1)
+	if len(lines) > height-1 {
+		startIdx = len(lines) - (height - 1)
+	}
+	hit, searching := c.search.current()
+	if searching && c.activeTab == 0 {
+		startIdx = max(0, min(startIdx, hit-(height-1)/2))
+	} else {
+		searching = false
 	}
 
 	currentY := y + 1
-	for i := startIdx; i < len(c.history) && currentY < y+height; i++ {
-		c.drawText(x, currentY, width, c.history[i].text, tcell.StyleDefault)
+	for i := startIdx; i < len(lines) && currentY < y+height; i++ {
+		style := tcell.StyleDefault
+		if lines[i].mention {
+			style = style.Bold(true).Reverse(true)
+		}
+		if searching && i == hit {
+			style = style.Underline(true).Reverse(true)
+		}
+		c.drawText(x, currentY, width, withTrustBadge(lines[i].text, c.peerTrust), style)
+		suffix := lines[i].reactions
+		if lines[i].state != "" {
+			suffix = " (" + lines[i].state + ")" + suffix
+		}
+		if lines[i].device != "" {
+			suffix += "  [on " + string(lines[i].device) + "]"
+		}
+		if suffix != "" {
+			c.drawText(x+len(lines[i].text), currentY, width-len(lines[i].text), suffix, tcell.StyleDefault.Dim(true))
+		}
 		currentY++
 	}
 }
 
-func (c *console) renderInput(x, y, width int) {
+func peerNames(peers []PeerID) []string {
+	names := make([]string, len(peers))
+	for i, p := range peers {
+		names[i] = string(p)
+	}
+	return names
+}
+
+func (c *tuiConsole) renderInput(x, y, width int) {
 	c.inputMu.Lock()
 	defer c.inputMu.Unlock()
 
@@ -296,7 +776,7 @@ func (c *console) renderInput(x, y, width int) {
 	c.screen.ShowCursor(cursorX, y)
 }
 
-func (c *console) drawText(x, y, maxWidth int, text string, style tcell.Style) {
+func (c *tuiConsole) drawText(x, y, maxWidth int, text string, style tcell.Style) {
 	for i, r := range text {
 		if i >= maxWidth {
 			break
@@ -305,168 +785,362 @@ func (c *console) drawText(x, y, maxWidth int, text string, style tcell.Style) {
 	}
 }
 
-func (c *console) Usage(nickname PeerID, keyID []byte, selfEdPub ed25519.PublicKey, selfHPKEPubBytes []byte, peerID string) {
-	c.AddHistory(fmt.Sprintf("[%s] up with peerID=%s (keyID=%x)", nickname, peerID, keyID))
-	c.AddHistory(fmt.Sprintf("[%s] pinned Ed25519 pub: %x", nickname, selfEdPub))
-	c.AddHistory(fmt.Sprintf("[%s] pinned HPKE pub:    %x", nickname, selfHPKEPubBytes))
-	c.AddHistory("")
-	c.AddHistory("Commands:")
-	c.AddHistory("  @peer message   send a request")
-	c.AddHistory("  /peers          list online peers")
-	c.AddHistory("  /quit           exit")
-	c.AddHistory("")
-}
-
 // AddDirectMessage adds a message to both queue and history
-func (c *console) AddDirectMessage(from PeerID, message string) {
+func (c *tuiConsole) AddDirectMessage(from PeerID, message string) {
 	c.queueMu.Lock()
-	c.queue[from] = append(c.queue[from], queuedMessage{
+	c.nextID++
+	msg := queuedMessage{
+		id:        c.nextID,
 		from:      from,
 		message:   message,
 		timestamp: time.Now(),
+	}
+	c.queue[from] = append(c.queue[from], msg)
+	c.persist(func(s *history.Store) error {
+		return s.PutQueued(history.Queued{ID: msg.id, From: string(from), Message: message, Time: msg.timestamp})
 	})
 	c.queueMu.Unlock()
 
 	c.AddHistory(fmt.Sprintf("[from %s] %s", from, message))
 }
 
-// ClearQueue clears all queued messages from a specific peer
-func (c *console) ClearQueue(peerID PeerID) int {
+// EditMessage changes the latest queued message old from a peer and its
+// history line, in the store too.
+func (c *tuiConsole) EditMessage(from PeerID, old, text string) bool {
+	c.queueMu.Lock()
+	messages := c.queue[from]
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].message != old {
+			continue
+		}
+		if text == "" {
+			c.removeQueuedLocked(messages[i])
+			break
+		}
+		messages[i].message = text
+		q := history.Queued{ID: messages[i].id, From: string(from), Message: text, Time: messages[i].timestamp}
+		c.persist(func(s *history.Store) error { return s.PutQueued(q) })
+		break
+	}
+	c.queueMu.Unlock()
+
+	match := func(line string) bool { return isMessageLine(line, from, old) }
+	line := editedLine(from, text)
+	found := false
+	c.historyMu.Lock()
+	for i := len(c.history) - 1; i >= 0; i-- {
+		if match(c.history[i].text) {
+			c.history[i].text = line
+			c.index.add(i, line)
+			found = true
+			break
+		}
+	}
+	if found {
+		c.persist(func(s *history.Store) error {
+			_, err := s.ReplaceLine(match, line)
+			return err
+		})
+	}
+	c.historyMu.Unlock()
+
+	c.render()
+	return found
+}
+
+// ClearQueue clears all queued messages from a specific peer, or only the
+// message being replied to when the reply was started from the queue pane.
+func (c *tuiConsole) ClearQueue(peerID PeerID) int {
 	c.queueMu.Lock()
 	defer c.queueMu.Unlock()
 
-	count := len(c.queue[peerID])
+	if c.replyTo != nil && c.replyTo.from == peerID {
+		if c.removeQueuedLocked(*c.replyTo) {
+			c.notifyRead(peerID)
+			return 1
+		}
+		return 0
+	}
+
+	messages := c.queue[peerID]
 	delete(c.queue, peerID)
-	return count
+	if len(messages) > 0 {
+		c.notifyRead(peerID)
+		ids := make([]uint64, len(messages))
+		for i, m := range messages {
+			ids[i] = m.id
+		}
+		c.persist(func(s *history.Store) error { return s.DeleteQueued(ids...) })
+	}
+	return len(messages)
 }
 
 // AddHistory adds a message to the general history pane
-func (c *console) AddHistory(text string) {
-	if c == nil {
-		return
-	}
-
+func (c *tuiConsole) AddHistory(text string) {
 	c.historyMu.Lock()
 	// Strip trailing newlines
 	text = strings.TrimRight(text, "\n")
-	c.history = append(c.history, historyMessage{
+	msg := historyMessage{
 		text:      text,
 		timestamp: time.Now(),
-	})
+	}
+	c.history = append(c.history, msg)
+	c.index.add(len(c.history)-1, text)
+	c.persist(func(s *history.Store) error { return s.AppendLine(history.Line{Text: text, Time: msg.timestamp}) })
 	c.historyMu.Unlock()
 
 	c.render()
 }
 
-// Printf adds a formatted message to history
-func (c *console) Printf(format string, args ...any) {
-	if c == nil {
-		return
-	}
+// AddMention adds a highlighted line to the history and rings the
+// terminal bell.
+func (c *tuiConsole) AddMention(text string) {
+	c.historyMu.Lock()
+	msg := historyMessage{text: text, timestamp: time.Now(), mention: true}
+	c.history = append(c.history, msg)
+	c.index.add(len(c.history)-1, text)
+	c.persist(func(s *history.Store) error { return s.AppendLine(history.Line{Text: text, Time: msg.timestamp}) })
+	c.historyMu.Unlock()
 
-	c.AddHistory(fmt.Sprintf(format, args...))
+	c.screen.Beep()
+	c.render()
 }
 
-// Errorf adds a formatted error message to history
-func (c *console) Errorf(format string, args ...any) {
-	if c == nil {
-		return
+// AddSent adds a sent direct message to the history, marked sent until
+// SetReceipt says otherwise.
+func (c *tuiConsole) AddSent(text string) uint64 {
+	c.historyMu.Lock()
+	c.sentCount++
+	msg := historyMessage{text: text, timestamp: time.Now(), sentID: c.sentCount, state: "sent"}
+	c.history = append(c.history, msg)
+	c.index.add(len(c.history)-1, text)
+	c.persist(func(s *history.Store) error { return s.AppendLine(history.Line{Text: text, Time: msg.timestamp}) })
+	c.historyMu.Unlock()
+
+	c.render()
+	return msg.sentID
+}
+
+// SetReceipt updates the state shown after a line added by AddSent.
+func (c *tuiConsole) SetReceipt(id uint64, state string) {
+	c.historyMu.Lock()
+	for i := len(c.history) - 1; i >= 0; i-- {
+		if c.history[i].sentID == id {
+			c.history[i].state = state
+			break
+		}
 	}
+	c.historyMu.Unlock()
 
-	c.AddHistory(fmt.Sprintf("[error] "+format, args...))
+	c.render()
 }
 
-// ReadLine reads a line of input (blocking)
-func (c *console) ReadLine() (string, bool) {
-	if c == nil {
-		return "", false
+// AddReaction shows reaction after the latest matching history line.
+func (c *tuiConsole) AddReaction(match func(line string) bool, reaction string) bool {
+	c.historyMu.Lock()
+	found := false
+	for i := len(c.history) - 1; i >= 0; i-- {
+		if match(c.history[i].text) {
+			c.history[i].reactions += "  " + reaction
+			found = true
+			break
+		}
 	}
+	c.historyMu.Unlock()
 
-	select {
-	case line := <-c.inputCh:
-		return line, true
-	case <-c.quitCh:
-		return "", false
+	if found {
+		c.render()
 	}
+	return found
 }
 
-// REPL runs the main input loop
-func (c *console) REPL(pool *connPool) {
-	for {
-		line, ok := c.ReadLine()
-		if !ok {
-			return
-		}
+// Search finds history lines with the words of query and scrolls the
+// General pane to the latest, or to the next older one when query is
+// empty, until Esc.
+func (c *tuiConsole) Search(query string) (matches, shown int) {
+	c.historyMu.Lock()
+	matches, shown = c.search.next(&c.index, query, func(pos int) string { return c.history[pos].text })
+	if matches > 0 {
+		c.activeTab = 0
+	}
+	c.historyMu.Unlock()
 
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
+	c.render()
+	return matches, shown
+}
 
-		switch line {
-		case "/quit", "/exit":
-			return
-		case "/peers":
-			c.listPeers()
-			continue
+// Conversation returns the history lines of the conversation with peer.
+func (c *tuiConsole) Conversation(peer PeerID) []conversationLine {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	var out []conversationLine
+	for _, m := range c.history {
+		if inConversation(m.text, peer) {
+			out = append(out, conversationLine{Time: m.timestamp, Text: m.text + m.reactions, State: m.state})
 		}
+	}
+	return out
+}
 
-		// Direct message if line starts with @peer
-		if strings.HasPrefix(line, "@") {
-			toTag, msg, ok := splitFirstWord(line)
-			if !ok {
-				c.Errorf("usage: @peer <message>")
-				continue
-			}
-
-			toTag = strings.TrimPrefix(toTag, "@")
-			to, found := pool.peerTable.Get(PeerID(toTag))
-			if !found {
-				c.Errorf("unknown peer: %s", toTag)
-				continue
-			}
-			c.sendTo(to, msg)
-			continue
+// LocalLines returns the message lines added on this device after t.
+func (c *tuiConsole) LocalLines(after time.Time) []conversationLine {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	var out []conversationLine
+	for _, m := range c.history {
+		if m.device == "" && m.timestamp.After(after) && syncedLine(m.text) {
+			out = append(out, conversationLine{Time: m.timestamp, Text: m.text, State: m.state})
 		}
+	}
+	return out
+}
 
-		// Otherwise: broadcast to everyone else.
-		count := len(pool.peerTable.All())
-		if err := pool.Broadcast(line); err != nil {
-			c.Errorf("broadcast failed: %v", err)
-		} else {
-			c.Printf("[broadcast] %s sent to %d peers: %s", c.self.Nickname, count, line)
+// SyncedUntil returns the time of the latest line synced from device.
+func (c *tuiConsole) SyncedUntil(device PeerID) time.Time {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	var t time.Time
+	for _, m := range c.history {
+		if m.device == device && m.timestamp.After(t) {
+			t = m.timestamp
 		}
 	}
+	return t
 }
 
-func (c *console) listPeers() {
-	peers := c.pool.peerTable.All()
-	if len(peers) == 0 {
-		c.Printf("No online peers")
+// AddSynced appends lines synced from another device, marked with it, and
+// stores them as such.
+func (c *tuiConsole) AddSynced(device PeerID, lines []conversationLine) {
+	if len(lines) == 0 {
 		return
 	}
-	for _, p := range peers {
-		c.Printf("- %s (peerID=%s) keyID=%d", p.Nickname, p.PeerID.ShortString(), p.KeyID)
+	c.historyMu.Lock()
+	for _, l := range lines {
+		c.history = append(c.history, historyMessage{text: l.Text, timestamp: l.Time, state: l.State, device: device})
+		c.index.add(len(c.history)-1, l.Text)
+		c.persist(func(s *history.Store) error {
+			return s.AppendLine(history.Line{Text: l.Text, Time: l.Time, Device: string(device)})
+		})
 	}
+	c.historyMu.Unlock()
+
+	c.render()
 }
 
-func (c *console) sendTo(to PeerInfo, msg string) {
-	if c == nil {
-		return
+// leaveSearch returns the history pane to the latest lines and reports
+// whether a search was shown.
+func (c *tuiConsole) leaveSearch() bool {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	_, searching := c.search.current()
+	c.search = searchState{}
+	return searching
+}
+
+// SetPeerTrust shows the key state of peer as a badge after its name, in
+// history labels and the queue pane.
+func (c *tuiConsole) SetPeerTrust(peer PeerID, trust string) {
+	c.trustMu.Lock()
+	if trust == "" {
+		delete(c.trust, peer)
+	} else {
+		c.trust[peer] = trust
 	}
+	c.trustMu.Unlock()
 
-	if to.Nickname == c.self.Nickname {
-		c.Errorf("can't send to self")
-		return
+	c.render()
+}
+
+func (c *tuiConsole) peerTrust(peer PeerID) string {
+	c.trustMu.Lock()
+	defer c.trustMu.Unlock()
+	return c.trust[peer]
+}
+
+// trustMark is the badge after peer in the queue pane.
+func (c *tuiConsole) trustMark(peer PeerID) string {
+	if badge := trustBadge(c.peerTrust(peer)); badge != "" {
+		return " " + badge
 	}
+	return ""
+}
 
-	// Clear queue for this peer
-	_ = c.ClearQueue(to.Nickname)
-	_, err := c.pool.SendRequest(to, msg)
-	if err != nil {
-		c.Errorf("send failed: %v", err)
-		return
+// SetPeerPresence shows presence next to peer in the queue pane.
+func (c *tuiConsole) SetPeerPresence(peer PeerID, presence string) {
+	c.queueMu.Lock()
+	if presenceMark(presence) == "" {
+		delete(c.presence, peer)
+	} else {
+		c.presence[peer] = presence
+	}
+	c.queueMu.Unlock()
+
+	c.render()
+}
+
+// SetRequests shows the message requests of peer in the requests pane;
+// none removes the peer.
+func (c *tuiConsole) SetRequests(peer PeerID, messages []string) {
+	c.queueMu.Lock()
+	if len(messages) == 0 {
+		delete(c.requests, peer)
+	} else {
+		c.requests[peer] = append([]string(nil), messages...)
+	}
+	c.queueMu.Unlock()
+
+	c.render()
+}
+
+// SetStatus shows text in the status area under key; empty text removes it.
+func (c *tuiConsole) SetStatus(key, text string) {
+	c.statusMu.Lock()
+	if text == "" {
+		delete(c.status, key)
+	} else {
+		c.status[key] = text
 	}
+	c.statusMu.Unlock()
+
+	c.render()
+}
+
+func (c *tuiConsole) statusText() string {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	return strings.Join(statusLines(c.status), " | ")
+}
 
-	c.Printf("[%s to %s] %s", c.self.Nickname, to.Nickname, msg)
+// statusLines returns status entries ordered by key.
+func statusLines(status map[string]string) []string {
+	keys := make([]string, 0, len(status))
+	for k := range status {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		lines[i] = status[k]
+	}
+	return lines
+}
+
+// Printf adds a formatted message to history
+func (c *tuiConsole) Printf(format string, args ...any) {
+	c.AddHistory(fmt.Sprintf(format, args...))
+}
+
+// Errorf adds a formatted error message to history
+func (c *tuiConsole) Errorf(format string, args ...any) {
+	c.AddHistory(fmt.Sprintf("[error] "+format, args...))
+}
+
+// ReadLine reads a line of input (blocking)
+func (c *tuiConsole) ReadLine() (string, bool) {
+	select {
+	case line := <-c.inputCh:
+		return line, true
+	case <-c.quitCh:
+		return "", false
+	}
 }
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/pivaldi/tmd/internal/history"
+)
+
+func newSimConsole(t *testing.T) (*tuiConsole, tcell.SimulationScreen) {
+	t.Helper()
+	screen := tcell.NewSimulationScreen("UTF-8")
+	c, err := newTUIConsoleOn(screen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	screen.SetSize(100, 20)
+	t.Cleanup(c.Close)
+	return c, screen
+}
+
+func screenText(screen tcell.SimulationScreen) string {
+	cells, width, _ := screen.GetContents()
+	var b strings.Builder
+	for i, cell := range cells {
+		if len(cell.Runes) > 0 {
+			b.WriteRune(cell.Runes[0])
+		} else {
+			b.WriteByte(' ')
+		}
+		if (i+1)%width == 0 {
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+func press(c *tuiConsole, key tcell.Key, r rune) {
+	c.handleKeyEvent(tcell.NewEventKey(key, r, tcell.ModNone))
+}
+
+func queued(c *tuiConsole) []string {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	var out []string
+	for _, m := range c.queueOrderLocked() {
+		out = append(out, string(m.from)+":"+m.message)
+	}
+	return out
+}
+
+func TestQueuePaneActions(t *testing.T) {
+	c, screen := newSimConsole(t)
+	c.AddDirectMessage("bob", "b1")
+	c.AddDirectMessage("carol", "c1")
+	c.AddDirectMessage("bob", "b2")
+
+	// Tab focuses the queue; Down then 'd' dismisses bob's second message.
+	press(c, tcell.KeyTab, 0)
+	press(c, tcell.KeyDown, 0)
+	press(c, tcell.KeyRune, 'd')
+	if got := strings.Join(queued(c), ","); got != "bob:b1,carol:c1" {
+		t.Fatalf("queue after dismiss = %s", got)
+	}
+
+	// Enter on b1 starts a reply; sending it clears only that message.
+	press(c, tcell.KeyUp, 0)
+	press(c, tcell.KeyEnter, 0)
+	if c.inputBuffer != "/reply bob " {
+		t.Fatalf("input = %q, want reply prefix", c.inputBuffer)
+	}
+	c.AddDirectMessage("bob", "b3")
+	if !strings.Contains(screenText(screen), "replying to bob: b1") {
+		t.Fatalf("reply context not shown:\n%s", screenText(screen))
+	}
+	press(c, tcell.KeyRune, 'k')
+	press(c, tcell.KeyEnter, 0)
+	if line, _ := c.ReadLine(); line != "/reply bob k" {
+		t.Fatalf("submitted %q", line)
+	}
+	if n := c.ClearQueue("bob"); n != 1 {
+		t.Fatalf("ClearQueue after reply removed %d messages, want 1", n)
+	}
+	if got := strings.Join(queued(c), ","); got != "bob:b3,carol:c1" {
+		t.Fatalf("queue after reply = %s", got)
+	}
+
+	// Without a reply in progress ClearQueue drops the whole peer queue.
+	if n := c.ClearQueue("bob"); n != 1 {
+		t.Fatalf("ClearQueue = %d", n)
+	}
+
+	// 'o' opens carol's conversation tab, which filters the history.
+	c.AddHistory("[alice to carol] hi carol")
+	c.AddHistory("[alice to dave] hi dave")
+	press(c, tcell.KeyTab, 0)
+	press(c, tcell.KeyRune, 'o')
+	text := screenText(screen)
+	if !strings.Contains(text, " carol ") || !strings.Contains(text, "hi carol") || strings.Contains(text, "hi dave") {
+		t.Fatalf("conversation tab not shown:\n%s", text)
+	}
+
+	// Esc returns to the input, a second Esc closes the tab.
+	press(c, tcell.KeyEscape, 0)
+	press(c, tcell.KeyEscape, 0)
+	if text := screenText(screen); !strings.Contains(text, "General Messages") || !strings.Contains(text, "hi dave") {
+		t.Fatalf("tab not closed:\n%s", text)
+	}
+}
+
+func TestReplyRetargetedIsNotAReply(t *testing.T) {
+	c, _ := newSimConsole(t)
+	c.AddDirectMessage("bob", "b1")
+	c.AddDirectMessage("bob", "b2")
+
+	press(c, tcell.KeyTab, 0)
+	press(c, tcell.KeyEnter, 0)
+	c.inputMu.Lock()
+	c.inputBuffer, c.cursorPos = "@carol hi", len("@carol hi")
+	c.inputMu.Unlock()
+	press(c, tcell.KeyEnter, 0)
+	c.ReadLine()
+
+	if n := c.ClearQueue("bob"); n != 2 {
+		t.Fatalf("ClearQueue = %d, want the whole queue", n)
+	}
+}
+
+func TestConsoleHistoryStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	seed := make([]byte, 32)
+
+	open := func() *tuiConsole {
+		store, err := history.Open(path, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := newTUIConsoleOn(tcell.NewSimulationScreen("UTF-8"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.setStore(store); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := open()
+	c.AddHistory("hello")
+	c.AddDirectMessage("bob", "b1")
+	c.AddDirectMessage("carol", "c1")
+	c.AddDirectMessage("bob", "b2")
+	c.ClearQueue("carol")
+	press(c, tcell.KeyTab, 0)
+	press(c, tcell.KeyRune, 'd') // dismisses b1
+	c.Close()
+
+	c = open()
+	defer c.Close()
+	if got := queued(c); len(got) != 1 || got[0] != "bob:b2" {
+		t.Fatalf("restored queue = %v", got)
+	}
+	var texts []string
+	for _, m := range c.history {
+		texts = append(texts, m.text)
+	}
+	if len(texts) != 4 || texts[0] != "hello" || texts[3] != "[from bob] b2" {
+		t.Fatalf("restored history = %q", texts)
+	}
+	if n, _ := c.Search("hello"); n != 1 {
+		t.Fatalf("restored history search found %d lines", n)
+	}
+
+	// New messages get IDs after the restored ones.
+	c.AddDirectMessage("bob", "b3")
+	if got := queued(c); len(got) != 2 || got[1] != "bob:b3" {
+		t.Fatalf("queue = %v", got)
+	}
+}
+
+func TestConsoleStatusArea(t *testing.T) {
+	c, screen := newSimConsole(t)
+	c.SetStatus("file b", "b.bin to bob 40%")
+	c.SetStatus("file a", "a.bin from carol 7%")
+	if text := screenText(screen); !strings.Contains(text, "a.bin from carol 7% | b.bin to bob 40%") {
+		t.Fatalf("status not shown:\n%s", text)
+	}
+	c.SetStatus("file a", "")
+	c.SetStatus("file b", "")
+	if text := screenText(screen); strings.Contains(text, "bob 40%") {
+		t.Fatalf("status not cleared:\n%s", text)
+	}
+}
+
+func TestConsoleReceipts(t *testing.T) {
+	c, screen := newSimConsole(t)
+	read := make(chan PeerID, 1)
+	c.OnRead(func(from PeerID) { read <- from })
+
+	id := c.AddSent("[alice to bob] hi")
+	if text := screenText(screen); !strings.Contains(text, "[alice to bob] hi (sent)") {
+		t.Fatalf("sent state not shown:\n%s", text)
+	}
+	c.SetReceipt(id, "read")
+	if text := screenText(screen); !strings.Contains(text, "[alice to bob] hi (read)") {
+		t.Fatalf("read state not shown:\n%s", text)
+	}
+
+	c.AddDirectMessage("carol", "hello")
+	c.ClearQueue("carol")
+	if from := <-read; from != "carol" {
+		t.Fatalf("read %s, want carol", from)
+	}
+}
+
+func TestComposingTo(t *testing.T) {
+	for line, want := range map[string]PeerID{
+		"@bob hi":          "bob",
+		"/reply carol ok":  "carol",
+		"@bob ":            "",
+		"@bob":             "",
+		"hello everyone":   "",
+		"/notify bob soon": "",
+	} {
+		got, ok := composingTo(line)
+		if got != want || ok != (want != "") {
+			t.Errorf("composingTo(%q) = %q, %v", line, got, ok)
+		}
+	}
+}
+
+func TestConsoleSearch(t *testing.T) {
+	c, screen := newSimConsole(t)
+	c.AddHistory("[from bob] lunch at noon?")
+	for i := range 30 {
+		c.AddHistory(fmt.Sprintf("filler %d", i))
+	}
+	c.AddSent("[alice to bob] Lunching with carol")
+	c.AddHistory("[from carol] see you")
+	if strings.Contains(screenText(screen), "lunch at noon") {
+		t.Fatal("old line shown before searching")
+	}
+
+	if n, shown := c.Search("LUNCH"); n != 2 || shown != 1 {
+		t.Fatalf("Search = %d, %d; want 2, 1", n, shown)
+	}
+	if n, shown := c.Search(""); n != 2 || shown != 2 {
+		t.Fatalf("next = %d, %d; want 2, 2", n, shown)
+	}
+	if text := screenText(screen); !strings.Contains(text, "lunch at noon") {
+		t.Fatalf("older match not shown:\n%s", text)
+	}
+	if n, _ := c.Search("lunch noon carol"); n != 0 {
+		t.Fatalf("matched %d lines without every word", n)
+	}
+
+	press(c, tcell.KeyEscape, 0)
+	if text := screenText(screen); strings.Contains(text, "lunch at noon") || !strings.Contains(text, "see you") {
+		t.Fatalf("Esc did not return to the latest lines:\n%s", text)
+	}
+}
+
+func TestConsoleSyncedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	open := func() *tuiConsole {
+		store, err := history.Open(path, make([]byte, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := newTUIConsoleOn(tcell.NewSimulationScreen("UTF-8"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.setStore(store); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := open()
+	c.AddHistory("[node] peer joined: bob")
+	c.AddHistory("[from bob] hi")
+	at := time.Now().Add(-time.Minute).Round(0)
+	c.AddSynced("phone", []conversationLine{{Time: at, Text: "[phone to bob] from my phone", State: "read"}})
+	c.Close()
+
+	c = open()
+	defer c.Close()
+	if got := c.SyncedUntil("phone"); !got.Equal(at) {
+		t.Fatalf("SyncedUntil = %v, want %v", got, at)
+	}
+	local := c.LocalLines(time.Time{})
+	if len(local) != 1 || local[0].Text != "[from bob] hi" {
+		t.Fatalf("LocalLines = %+v", local)
+	}
+}
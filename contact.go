@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/pivaldi/tmd/internal/contact"
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+// runContact handles `tmd contact qr` and `tmd contact scan`.
+func runContact(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: tmd contact qr|scan [flags]")
+	}
+	switch args[0] {
+	case "qr":
+		return runContactQR(args[1:])
+	case "scan":
+		return runContactScan(args[1:])
+	default:
+		return fmt.Errorf("unknown contact command %q (want qr or scan)", args[0])
+	}
+}
+
+// runContactQR prints the local contact card as a terminal QR code and as
+// text for pasting.
+func runContactQR(args []string) error {
+	fs := flag.NewFlagSet("contact qr", flag.ExitOnError)
+	var seedSel seedFlags
+	addSeedFlags(fs, &seedSel, "path to seed file, or keyring:<name> for an OS keyring entry (required, or --identity)")
+	nick := fs.String("nick", "", "your nickname (required)")
+	addrs := fs.String("addrs", "", "comma-separated multiaddrs where you can be reached (optional)")
+	pngPath := fs.String("png", "", "also write the QR code to this PNG file")
+	fs.Parse(args)
+
+	if !seedSel.set() || *nick == "" {
+		return fmt.Errorf("--seed (or --identity) and --nick are required")
+	}
+	seedPath, err := seedSel.path(false)
+	if err != nil {
+		return err
+	}
+	f, err := identity.LoadSeedFile(seedPath)
+	if err != nil {
+		return err
+	}
+	keys, err := f.DeriveKeys()
+	if err != nil {
+		return fmt.Errorf("derive keys: %w", err)
+	}
+
+	var addrList []string
+	for _, a := range strings.Split(*addrs, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrList = append(addrList, a)
+		}
+	}
+	card, err := selfCard(*nick, keys.PeerID, keys.HPKEPubBytes, addrList, keys.Ed25519Priv)
+	if err != nil {
+		return err
+	}
+
+	text := card.Encode()
+	if err := contact.Render(os.Stdout, text); err != nil {
+		return err
+	}
+	printCard(card)
+	fmt.Printf("\n%s\n", text)
+
+	if *pngPath != "" {
+		data, err := contact.PNG(text)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*pngPath, data, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("QR code written to %s\n", *pngPath)
+	}
+	return nil
+}
+
+// runContactScan imports a contact card from a QR image, the command line
+// or stdin (as pasted from a phone's QR scanner).
+func runContactScan(args []string) error {
+	fs := flag.NewFlagSet("contact scan", flag.ExitOnError)
+	imagePath := fs.String("image", "", "photo or screenshot of a contact QR code (PNG or JPEG)")
+	bookPath := fs.String("contacts", "contacts.json", "contacts file to update")
+	fs.Parse(args)
+
+	var (
+		card *contact.Card
+		err  error
+	)
+	switch {
+	case *imagePath != "":
+		data, rerr := os.ReadFile(*imagePath)
+		if rerr != nil {
+			return rerr
+		}
+		img, _, derr := image.Decode(bytes.NewReader(data))
+		if derr != nil {
+			return fmt.Errorf("decode image: %w", derr)
+		}
+		card, err = contact.ScanImage(img)
+	case fs.NArg() > 0:
+		card, err = contact.Decode(fs.Arg(0))
+	default:
+		fmt.Fprint(os.Stderr, "Paste contact card: ")
+		line, rerr := bufio.NewReader(os.Stdin).ReadString('\n')
+		if rerr != nil && line == "" {
+			return fmt.Errorf("read contact card: %w", rerr)
+		}
+		card, err = contact.Decode(line)
+	}
+	if err != nil {
+		return err
+	}
+
+	book, err := contact.OpenBook(*bookPath)
+	if err != nil {
+		return err
+	}
+	if prev, ok := book.Get(card.Nickname); ok && prev.PeerID != card.PeerID {
+		fmt.Printf("warning: replacing a different identity for %s (was %s)\n", card.Nickname, prev.PeerID)
+	}
+	if err := book.Add(card); err != nil {
+		return err
+	}
+	printCard(card)
+	fmt.Printf("Added to %s\n", *bookPath)
+	return nil
+}
+
+// runMyQR handles "/myqr [file.png]": our contact card as a QR code, for
+// a peer to scan with 'tmd contact scan' and pin.
+func runMyQR(c Console, pool *connPool, args string) {
+	card, err := selfCard(string(pool.nickname), pool.host.ID(), pool.selfHPKEPubBytes, nil, pool.selfSigner)
+	if err != nil {
+		c.Errorf("myqr: %v", err)
+		return
+	}
+	text := card.Encode()
+	rows, err := contact.Lines(text)
+	if err != nil {
+		c.Errorf("myqr: %v", err)
+		return
+	}
+	for _, row := range rows {
+		c.AddHistory(row)
+	}
+	for _, line := range cardLines(card) {
+		c.Printf("[myqr] %s", line)
+	}
+	c.Printf("[myqr] %s", text)
+	if path := strings.TrimSpace(args); path != "" {
+		data, err := contact.PNG(text)
+		if err == nil {
+			err = os.WriteFile(path, data, 0644)
+		}
+		if err != nil {
+			c.Errorf("myqr: %v", err)
+			return
+		}
+		c.Printf("[myqr] QR code written to %s", path)
+	}
+}
+
+// selfCard returns our own contact card, signed with the identity key
+// behind peerID.
+func selfCard(nick string, peerID peer.ID, hpkePub []byte, addrs []string, signer crypto.Signer) (*contact.Card, error) {
+	card := &contact.Card{
+		Nickname: nick,
+		PeerID:   peerID.String(),
+		HPKEPub:  hpkePub,
+		Addrs:    addrs,
+	}
+	if err := card.SignWith(signer); err != nil {
+		return nil, err
+	}
+	if err := card.Verify(); err != nil {
+		return nil, err
+	}
+	return card, nil
+}
+
+func printCard(c *contact.Card) {
+	for _, line := range cardLines(c) {
+		fmt.Println(line)
+	}
+}
+
+// cardLines describes a card: the public identity it carries, for
+// comparing with what a peer scanned.
+func cardLines(c *contact.Card) []string {
+	lines := []string{
+		"Nickname:   " + c.Nickname,
+		"PeerID:     " + c.PeerID,
+	}
+	if edPub, err := c.EdPub(); err == nil {
+		lines = append(lines, fmt.Sprintf("Ed25519:    %x", edPub))
+	}
+	lines = append(lines,
+		fmt.Sprintf("HPKE pub:   %x", c.HPKEPub),
+		fmt.Sprintf("HPKE KeyID: %s", c.KeyID()))
+	for _, a := range c.Addrs {
+		lines = append(lines, "Address:    "+a)
+	}
+	return lines
+}
+
+// addContactPeer makes an imported contact reachable by adding it to the
+// peer table.
+func addContactPeer(pt *PeerTable, c *contact.Card) error {
+	id, err := peer.Decode(c.PeerID)
+	if err != nil {
+		return err
+	}
+	addrs, err := c.Multiaddrs()
+	if err != nil {
+		return err
+	}
+	pt.Add(PeerInfo{
+		Nickname: PeerID(c.Nickname),
+		PeerID:   id,
+		Addrs:    addrs,
+		HPKEPub:  c.HPKEPub,
+		KeyID:    c.KeyID(),
+	})
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Requests carry a timeout: how long their sender waits for the response,
+// counted from when the request is sent so that clocks need not agree. The
+// sender gives up after it (DoRequest), resends on a repaired session
+// included; a receiver that holds an interactive request for /reply past
+// it drops it and answers with expiredRespMediaType instead.
+const (
+	// requestTimeout is the timeout of the requests this peer sends. It
+	// outlasts replyWindow, so that an unanswered interactive request is
+	// still acknowledged.
+	requestTimeout = replyWindow + 30*time.Second
+	// maxRequestTimeout is the largest timeout the wire format carries.
+	maxRequestTimeout = time.Duration(1<<32-1) * time.Millisecond
+
+	expiredRespMediaType = "text/plain; purpose=resp; error=expired"
+	expiredReply         = "deadline exceeded"
+)
+
+// errRequestExpired is returned for requests not answered before their
+// deadline.
+var errRequestExpired = errors.New("request expired")
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRequestDeadline(t *testing.T) {
+	if testing.Short() {
+		t.Skip("needs loopback networking")
+	}
+	n := newSimNetwork(t)
+	n.tokens["alice"] = "token-alice"
+	n.tokens["bob"] = "token-bob"
+	n.startNode("n1")
+	n.startPeer("alice", []string{"n1"})
+	n.startPeer("bob", []string{"n1"})
+	alice, bob := n.peer("alice"), n.peer("bob")
+	if !alice.console.WaitFor("peer joined: bob", defaultExpectTimeout) {
+		t.Fatal("alice never saw bob")
+	}
+	to, _ := alice.pool.peerTable.Get("bob")
+	session, err := alice.pool.NewSession(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _, err := alice.pool.sealWith(session.suite, nil, to, "quick?", interactiveReqMediaType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.MessageID, _ = newMessageID()
+	req.Timeout = 200 * time.Millisecond
+
+	// Neither side waits for /reply past the deadline: whichever gives up
+	// first, alice learns that the request expired.
+	start := time.Now()
+	resp, err := session.DoRequest(req, func() {}, nil)
+	if !errors.Is(err, errRequestExpired) && string(resp.MediaType) != expiredRespMediaType {
+		t.Fatalf("DoRequest = %+v, %v", resp, err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("DoRequest took %s", d)
+	}
+
+	if !bob.console.WaitFor("[from alice] quick?", defaultExpectTimeout) {
+		t.Fatal("bob never got the message")
+	}
+	deadline := time.Now().Add(defaultExpectTimeout)
+	for {
+		bob.pool.held.mu.Lock()
+		held := len(bob.pool.held.pending["alice"])
+		bob.pool.held.mu.Unlock()
+		if held == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bob still holds the expired request")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/history"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Devices of one identity run with keys derived from its seed
+// (identity.DeviceSeed, --device) under nicknames of their own, listed
+// with --devices. They replicate their history and outbox to each other
+// over the peer protocol: a device pulls from another with a request of
+// syncMediaType, answered by a Handler route. Both the pull and its answer
+// are sealed, inside the usual HPKE request, with a key every device
+// derives from the identity seed, so only our own devices can ask or
+// answer. The answer holds the message lines added on that device since
+// the latest one we have from it, and its outbox as it stands.
+const (
+	syncMediaType = "application/x-tmd-sync"
+	syncKeyInfo   = "tmd device sync v1"
+	// syncBatch bounds the lines of one answer; the puller asks again
+	// for the rest.
+	syncBatch = 500
+	// deviceSyncInterval is how often online devices are pulled from.
+	deviceSyncInterval = 30 * time.Second
+)
+
+// syncConsole is implemented by consoles whose history can be replicated
+// between devices.
+type syncConsole interface {
+	// LocalLines returns the message lines (see syncedLine) added on
+	// this device after t, oldest first.
+	LocalLines(after time.Time) []conversationLine
+	// SyncedUntil returns the time of the latest line synced from device.
+	SyncedUntil(device PeerID) time.Time
+	// AddSynced appends lines synced from another device of ours.
+	AddSynced(device PeerID, lines []conversationLine)
+}
+
+// syncedLine reports whether a history line is replicated: messages
+// received, broadcast or sent ("[from bob] ...", "[alice to bob] ..."),
+// not notices.
+func syncedLine(text string) bool {
+	label, _, ok := strings.Cut(strings.TrimPrefix(text, "["), "] ")
+	if !ok || !strings.HasPrefix(text, "[") {
+		return false
+	}
+	return strings.HasPrefix(label, "from ") || strings.HasPrefix(label, "broadcast from ") || strings.Contains(label, " to ")
+}
+
+// syncPull asks a device for its lines after Since.
+type syncPull struct {
+	Since time.Time `json:"since"`
+}
+
+// syncPush answers a syncPull.
+type syncPush struct {
+	Lines  []conversationLine `json:"lines"`
+	More   bool               `json:"more,omitempty"` // lines left after these
+	Outbox []history.Outgoing `json:"outbox"`
+}
+
+// deviceSync holds our other devices and what they last told us.
+type deviceSync struct {
+	mu      sync.Mutex
+	key     []byte // nil: not syncing
+	devices []PeerID
+	outbox  map[PeerID][]history.Outgoing // each device's, as last pulled
+	pulling map[PeerID]bool
+}
+
+// setDevices syncs with the given devices of the identity whose seed is
+// given.
+func (p *connPool) setDevices(seed []byte, devices []PeerID) error {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, seed, nil, []byte(syncKeyInfo)), key); err != nil {
+		return fmt.Errorf("derive sync key: %w", err)
+	}
+	p.devices.mu.Lock()
+	p.devices.key = key
+	p.devices.devices = slices.DeleteFunc(slices.Clone(devices), func(d PeerID) bool { return d == p.nickname })
+	p.devices.mu.Unlock()
+
+	p.onRequest(syncMediaType, HandlerFunc(p.serveSync))
+	return nil
+}
+
+// isDevice reports whether a peer is one of our other devices.
+func (p *connPool) isDevice(peer PeerID) bool {
+	p.devices.mu.Lock()
+	defer p.devices.mu.Unlock()
+	return slices.Contains(p.devices.devices, peer)
+}
+
+// syncAD binds a sealed pull or answer to who sends it to whom.
+func syncAD(from, to PeerID) []byte {
+	return []byte(syncKeyInfo + "\x00" + string(from) + "\x00" + string(to))
+}
+
+// sealSync seals v from one device to another.
+func (p *connPool) sealSync(from, to PeerID, v any) ([]byte, error) {
+	p.devices.mu.Lock()
+	key := p.devices.key
+	p.devices.mu.Unlock()
+	if key == nil {
+		return nil, errors.New("device sync is off (see --devices)")
+	}
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, syncAD(from, to)), nil
+}
+
+// openSync opens what sealSync sealed into v.
+func (p *connPool) openSync(from, to PeerID, sealed []byte, v any) error {
+	p.devices.mu.Lock()
+	key := p.devices.key
+	p.devices.mu.Unlock()
+	if key == nil {
+		return errors.New("device sync is off (see --devices)")
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return errors.New("sync message too short")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], syncAD(from, to))
+	if err != nil {
+		return fmt.Errorf("%s is not one of our devices", from)
+	}
+	return json.Unmarshal(plain, v)
+}
+
+// serveSync answers a pull from another device.
+func (p *connPool) serveSync(_ context.Context, from PeerInfo, _ string, plaintext []byte) (string, []byte, error) {
+	var pull syncPull
+	if err := p.openSync(from.Nickname, p.nickname, plaintext, &pull); err != nil {
+		return "", nil, err
+	}
+	sc, ok := p.console.(syncConsole)
+	if !ok {
+		return "", nil, errors.New("no history to sync")
+	}
+	push := syncPush{Lines: sc.LocalLines(pull.Since), Outbox: p.Outbox()}
+	if len(push.Lines) > syncBatch {
+		push.Lines, push.More = push.Lines[:syncBatch], true
+	}
+	sealed, err := p.sealSync(p.nickname, from.Nickname, push)
+	if err != nil {
+		return "", nil, err
+	}
+	return syncMediaType, sealed, nil
+}
+
+// SyncDevice pulls the lines and outbox of another device of ours and
+// returns how many lines it got.
+func (p *connPool) SyncDevice(to PeerInfo) (int, error) {
+	sc, ok := p.console.(syncConsole)
+	if !ok {
+		return 0, errors.New("this console keeps no history to sync")
+	}
+	got := 0
+	for {
+		sealed, err := p.sealSync(p.nickname, to.Nickname, syncPull{Since: sc.SyncedUntil(to.Nickname)})
+		if err != nil {
+			return got, err
+		}
+		r, err := p.sendRequest(to, string(sealed), syncMediaType, nil, nil, nil)
+		if err != nil {
+			return got, err
+		}
+		var push syncPush
+		if err := p.openSync(to.Nickname, p.nickname, []byte(r.Text), &push); err != nil {
+			return got, err
+		}
+		sc.AddSynced(to.Nickname, push.Lines)
+		got += len(push.Lines)
+
+		p.devices.mu.Lock()
+		if p.devices.outbox == nil {
+			p.devices.outbox = make(map[PeerID][]history.Outgoing)
+		}
+		p.devices.outbox[to.Nickname] = push.Outbox
+		p.devices.mu.Unlock()
+		if !push.More || len(push.Lines) == 0 {
+			return got, nil
+		}
+	}
+}
+
+// syncDevice pulls from a device in the background, once at a time,
+// reporting failures.
+func (p *connPool) syncDevice(nickname PeerID) {
+	if !p.isDevice(nickname) {
+		return
+	}
+	to, ok := p.peerTable.Get(nickname)
+	if !ok {
+		return
+	}
+	p.devices.mu.Lock()
+	if p.devices.pulling[nickname] {
+		p.devices.mu.Unlock()
+		return
+	}
+	if p.devices.pulling == nil {
+		p.devices.pulling = make(map[PeerID]bool)
+	}
+	p.devices.pulling[nickname] = true
+	p.devices.mu.Unlock()
+
+	go func() {
+		defer func() {
+			p.devices.mu.Lock()
+			delete(p.devices.pulling, nickname)
+			p.devices.mu.Unlock()
+		}()
+		if _, err := p.SyncDevice(to); err != nil {
+			p.console.Errorf("sync with %s: %v", nickname, err)
+		}
+	}()
+}
+
+// startDeviceSync pulls from every online device every interval, until
+// the returned function is called.
+func (p *connPool) startDeviceSync(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				p.devices.mu.Lock()
+				devices := slices.Clone(p.devices.devices)
+				p.devices.mu.Unlock()
+				for _, d := range devices {
+					p.syncDevice(d)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// deviceOutboxes returns the outbox of each other device, as last pulled.
+func (p *connPool) deviceOutboxes() map[PeerID][]history.Outgoing {
+	p.devices.mu.Lock()
+	defer p.devices.mu.Unlock()
+	out := make(map[PeerID][]history.Outgoing, len(p.devices.outbox))
+	for d, list := range p.devices.outbox {
+		out[d] = slices.Clone(list)
+	}
+	return out
+}
+
+// runSync handles "/sync": pull from every online device now.
+func runSync(c Console, pool *connPool) {
+	pool.devices.mu.Lock()
+	devices := slices.Clone(pool.devices.devices)
+	pool.devices.mu.Unlock()
+	if len(devices) == 0 {
+		c.Errorf("no devices to sync with (see --devices)")
+		return
+	}
+	for _, d := range devices {
+		to, ok := pool.peerTable.Get(d)
+		if !ok {
+			c.Printf("[sync] %s is offline", d)
+			continue
+		}
+		go func() {
+			n, err := pool.SyncDevice(to)
+			if err != nil {
+				c.Errorf("sync with %s: %v", d, err)
+				return
+			}
+			c.Printf("[sync] %d lines from %s", n, d)
+		}()
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+
+	"github.com/pivaldi/tmd/internal/rendezvous"
+)
+
+// With --dht, peers find each other on the libp2p Kademlia DHT instead of
+// through a tmd-node: each advertises itself under the rendezvous key its
+// group shares and serves a record sealed with its peer key, which the
+// others fetch and check (see internal/rendezvous). Peers so found go
+// through the same handler as the ones a node announces. Rooms, mailboxes
+// and relayed broadcasts need a node; with --dht alone they are not
+// available.
+//
+// With --rendezvous, peers register the same way at a libp2p rendezvous
+// point (/rendezvous/1.0.0) instead, or as well, under the
+// --rendezvous-key namespace; records are still fetched from, and checked
+// against, each peer found.
+
+// startDHT joins the DHT through bootstrap (comma-separated multiaddrs,
+// or empty for the public bootstrap peers) and finds the peers sharing
+// key until the returned func is called.
+func startDHT(h host.Host, key, bootstrap string, handler *peerHandler, pool *connPool) (func(), error) {
+	var peers []string
+	for _, a := range strings.Split(bootstrap, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			peers = append(peers, a)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	disc, err := newDHTDiscovery(ctx, h, peers)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := runRendezvous(ctx, "[dht]", h, disc, key, handler, pool); err != nil {
+		cancel()
+		return nil, err
+	}
+	return cancel, nil
+}
+
+// newDHTDiscovery joins the Kademlia DHT through the bootstrap peers, the
+// public ones if none are given, until ctx is done. At least one
+// bootstrap peer must answer. opts come after our own DHT options.
+func newDHTDiscovery(ctx context.Context, h host.Host, bootstrap []string, opts ...dht.Option) (discovery.Discovery, error) {
+	peers := dht.GetDefaultBootstrapPeerAddrInfos()
+	if len(bootstrap) > 0 {
+		peers = peers[:0]
+		for _, a := range bootstrap {
+			info, err := peer.AddrInfoFromString(a)
+			if err != nil {
+				return nil, fmt.Errorf("DHT bootstrap peer %q: %w", a, err)
+			}
+			peers = append(peers, *info)
+		}
+	}
+	opts = append([]dht.Option{dht.Mode(dht.ModeAutoServer), dht.BootstrapPeers(peers...)}, opts...)
+	kad, err := dht.New(ctx, h, opts...)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = kad.Close()
+	}()
+
+	cctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		connected int
+	)
+	for _, p := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if h.Connect(cctx, p) == nil {
+				mu.Lock()
+				connected++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if connected == 0 {
+		return nil, fmt.Errorf("none of the %d DHT bootstrap peers answered", len(peers))
+	}
+	if err := kad.Bootstrap(ctx); err != nil {
+		return nil, err
+	}
+	return drouting.NewRoutingDiscovery(kad), nil
+}
+
+// startPoint registers with the libp2p rendezvous point at addr and finds
+// the peers registered there under key until the returned func is called.
+func startPoint(h host.Host, addr, key string, handler *peerHandler, pool *connPool) (func(), error) {
+	point, err := rendezvous.NewPoint(h, addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := runRendezvous(ctx, "[rendezvous]", h, point, key, handler, pool); err != nil {
+		cancel()
+		return nil, err
+	}
+	return func() {
+		cancel()
+		unregister, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		_ = point.Unregister(unregister, rendezvous.Namespace(key))
+	}, nil
+}
+
+// runRendezvous publishes our record on disc under key and reports the
+// peers found there to handler until ctx is done, logging under tag.
+func runRendezvous(ctx context.Context, tag string, h host.Host, disc discovery.Discovery, key string, handler *peerHandler, pool *connPool) error {
+	logf := func(format string, args ...any) { handler.console.AddHistory(tag + " " + fmt.Sprintf(format, args...)) }
+	svc, err := rendezvous.New(h, disc, rendezvous.Config{Key: key, Logf: logf}, handler)
+	if err != nil {
+		return err
+	}
+	if err := svc.Publish(rendezvous.Record{
+		Nickname: string(pool.nickname),
+		HPKEPub:  pool.selfHPKEPubBytes,
+		KeyID:    pool.keyID,
+		KeySig:   pool.keySig,
+		Profile:  pool.ownProfile(),
+	}); err != nil {
+		return err
+	}
+	pool.subs.mu.Lock()
+	others := pool.subs.advertise
+	pool.subs.mu.Unlock()
+	if others != nil {
+		pool.setPresenceAdvertiser(presenceAdvertisers{others, svc})
+	} else {
+		pool.setPresenceAdvertiser(svc)
+	}
+	go svc.Run(ctx)
+	return nil
+}
+
+// presenceAdvertisers tells our presence to the nodes, on the DHT and
+// at the rendezvous point.
+type presenceAdvertisers []presenceAdvertiser
+
+func (as presenceAdvertisers) SetPresence(presence string) error {
+	var errs []error
+	for _, a := range as {
+		errs = append(errs, a.SetPresence(presence))
+	}
+	return errors.Join(errs...)
+}
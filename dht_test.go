@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// TestDHTDiscovery checks that two peers joining the DHT through one
+// bootstrap peer find each other under a namespace, and that joining
+// fails when no bootstrap peer answers.
+func TestDHTDiscovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A loopback network has no public addresses, so every DHT peer is
+	// made a server; left to ModeAutoServer they would all stay clients.
+	server := dht.Mode(dht.ModeServer)
+	boot, _, _ := newSimHost(t, simIdentity{})
+	defer boot.Close()
+	bootDHT, err := dht.New(ctx, boot, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bootDHT.Close()
+
+	alice, _, _ := newSimHost(t, simIdentity{})
+	defer alice.Close()
+	bob, _, _ := newSimHost(t, simIdentity{})
+	defer bob.Close()
+	aliceDisc, err := newDHTDiscovery(ctx, alice, []string{loopbackAddr(boot)}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobDisc, err := newDHTDiscovery(ctx, bob, []string{loopbackAddr(boot)}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const ns = "tmd-dht-test"
+	if _, err := aliceDisc.Advertise(ctx, ns); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(defaultExpectTimeout)
+	for {
+		found, err := bobDisc.FindPeers(ctx, ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []peer.ID
+		for p := range found {
+			ids = append(ids, p.ID)
+		}
+		if len(ids) == 1 && ids[0] == alice.ID() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bob found %v, want alice %s", ids, alice.ID())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// The bootstrap peer is gone: nobody answers.
+	addr := loopbackAddr(boot)
+	_ = bootDHT.Close()
+	_ = boot.Close()
+	carol, _, _ := newSimHost(t, simIdentity{})
+	defer carol.Close()
+	if _, err := newDHTDiscovery(ctx, carol, []string{addr}, server); err == nil || !strings.Contains(err.Error(), "answered") {
+		t.Fatalf("join without bootstrap peers: %v", err)
+	}
+	if _, err := newDHTDiscovery(ctx, carol, []string{"not an address"}); err == nil {
+		t.Fatal("a bad bootstrap address was accepted")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import "time"
+
+// The first request to a new peer may ride in the HELLO, so that it costs
+// one round trip rather than waiting behind the handshake. The listener
+// says it takes such requests by offering featureEarly (see features.go);
+// listeners predating early requests do not offer it and get the HELLO
+// and the request in frames of their own, as before. A dialer dialing for a
+// request then holds its signed HELLO back until the request is sealed,
+// and writes both in one HELLO frame; any other frame written first sends
+// the HELLO on its own. The HELLO signature does not cover the request:
+// it travels as the requests after it on the same stream do, and is
+// opened, answered and signed like them. The dialer has no ratchet yet
+// (see ratchets.go), so an early request is sealed to the HPKE key only,
+// without forward secrecy: a dialer offering a ratchet sends one only
+// with setEarlyRequests (--early). It sends its HELLO alone instead, and
+// its requests wait up to ratchetWait for the RATCHET frame, which a
+// listener taking early requests postdates and always sends, so that the
+// first request is ratcheted too.
+
+// ratchetWait bounds how long requests on a new session wait for the
+// RATCHET frame before going out sealed to the HPKE key only.
+const ratchetWait = 2 * time.Second
+
+// setEarlyRequests lets the first request of a session ride in the
+// HELLO even when we offer a ratchet, giving up its forward secrecy for a
+// round trip; it is set before the pool is used.
+func (p *connPool) setEarlyRequests(on bool) {
+	p.earlyRequests = on
+}
+
+// awaitRatchet waits until requests on ps may be sealed, for its RATCHET
+// frame or ratchetWait at most, but not past deadline.
+func (ps *peerSession) awaitRatchet(deadline time.Time) {
+	if ps.ratcheted == nil {
+		return
+	}
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case <-ps.ratcheted:
+	case <-t.C:
+	}
+}
+
+// ratchetReady lets the requests waiting in awaitRatchet go.
+func (ps *peerSession) ratchetReady() {
+	if ps.ratcheted != nil {
+		ps.ratchetOnce.Do(func() { close(ps.ratcheted) })
+	}
+}
+
+// writeHello writes the HELLO ps holds for its first request, if any, on
+// its own. It runs within ps.writes.
+func (ps *peerSession) writeHello() error {
+	if ps.hello == nil {
+		return nil
+	}
+	h := ps.hello
+	ps.hello = nil
+	return writeMsg(ps.stream, msgHello, encodeHello(*h))
+}
+
+// writeRequest writes req, in the HELLO ps holds if it fits the limits of
+// the peer. It runs within ps.writes.
+func (ps *peerSession) writeRequest(req Request) error {
+	if h := ps.hello; h != nil {
+		withReq := *h
+		withReq.Request = encodeRequest(req)
+		if payload := encodeHello(withReq); len(payload) < int(min(ps.sendLimit, defaultMaxFrame)) {
+			ps.hello = nil
+			return writeMsg(ps.stream, msgHello, payload)
+		}
+		if err := ps.writeHello(); err != nil {
+			return err
+		}
+	}
+	return writeMsgLimit(ps.stream, msgRequest, encodeRequest(req), ps.sendLimit, ps.fragments)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// bufStream is a session stream writing to a buffer.
+type bufStream struct {
+	network.Stream
+	buf bytes.Buffer
+}
+
+func (s *bufStream) Write(b []byte) (int, error) { return s.buf.Write(b) }
+
+// TestEarlyRequest checks that the first request rides in the held HELLO
+// when it fits, and that the HELLO goes first on its own otherwise.
+func TestEarlyRequest(t *testing.T) {
+	hello := Hello{SenderID: "alice", SenderKeyID: make([]byte, KeyIDSize), SenderEdPub: make([]byte, 32), SenderHPKEPub: make([]byte, 32), Signature: make([]byte, 64)}
+	req := Request{RequestID: 1, RecipientKeyID: make([]byte, KeyIDSize), EncapKey: []byte("encap"), MediaType: []byte(reqMediaType), Ciphertext: []byte("sealed")}
+
+	// The first request rides in the HELLO, the next goes on its own.
+	s := &bufStream{}
+	h := hello
+	ps := &peerSession{stream: s, sendLimit: defaultMaxFrame, hello: &h}
+	if err := ps.writeRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	req.RequestID = 2
+	if err := ps.writeRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	typ, p, err := readMsg(&s.buf)
+	if err != nil || typ != msgHello {
+		t.Fatalf("first frame: type %d, %v; want HELLO", typ, err)
+	}
+	got, err := decodeHello(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(helloSignInput(nil, got), helloSignInput(nil, hello)) {
+		t.Fatal("the early request changed what the HELLO signs")
+	}
+	if early, err := decodeRequest(got.Request); err != nil || early.RequestID != 1 || !bytes.Equal(early.Ciphertext, req.Ciphertext) {
+		t.Fatalf("early request = %+v, %v", early, err)
+	}
+	if typ, p, err := readMsg(&s.buf); err != nil || typ != msgRequest {
+		t.Fatalf("second frame: type %d, %v; want REQUEST", typ, err)
+	} else if next, _ := decodeRequest(p); next.RequestID != 2 {
+		t.Fatalf("second request ID = %d, want 2", next.RequestID)
+	}
+
+	// Too large to ride along: the HELLO goes first, bare.
+	s = &bufStream{}
+	h = hello
+	ps = &peerSession{stream: s, sendLimit: minMaxFrame, fragments: true, hello: &h}
+	req.Ciphertext = make([]byte, 2*minMaxFrame)
+	if err := ps.writeRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if typ, p, err := readMsg(&s.buf); err != nil || typ != msgHello {
+		t.Fatalf("first frame: type %d, %v; want HELLO", typ, err)
+	} else if got, _ := decodeHello(p); len(got.Request) != 0 {
+		t.Fatal("an oversized request rode in the HELLO")
+	}
+	if typ, _, err := readMessage(&s.buf, minMaxFrame); err != nil || typ != msgRequest {
+		t.Fatalf("then type %d, %v; want REQUEST", typ, err)
+	}
+
+	// Any other frame sends the HELLO first.
+	s = &bufStream{}
+	h = hello
+	ps = &peerSession{stream: s, sendLimit: defaultMaxFrame, hello: &h}
+	if err := ps.send(msgTyping, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []byte{msgHello, msgTyping} {
+		if typ, _, err := readMsg(&s.buf); err != nil || typ != want {
+			t.Fatalf("type %d, %v; want %d", typ, err, want)
+		}
+	}
+}
+
+// TestEarlyRequestNeedsOptIn checks that a dialer offering a ratchet sends
+// its HELLO alone and has the first request wait for the ratchet, unless
+// --early lets the request ride in the HELLO.
+func TestEarlyRequestNeedsOptIn(t *testing.T) {
+	n := newSimNetwork(t)
+	n.tokens["alice"] = "token-alice"
+	n.tokens["bob"] = "token-bob"
+	n.startNode("n1")
+	n.startPeer("alice", []string{"n1"})
+	n.startPeer("bob", []string{"n1"})
+	alice := n.peer("alice")
+	if !alice.console.WaitFor("peer joined: bob", defaultExpectTimeout) {
+		t.Fatalf("no join; alice: %q", alice.console.History())
+	}
+	bob, _ := alice.pool.peerTable.Get("bob")
+
+	ps, err := alice.pool.requestSession(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.hello != nil || ps.ratcheted == nil {
+		t.Fatal("the first request would ride in the HELLO without its ratchet")
+	}
+	ps.awaitRatchet(time.Now().Add(defaultExpectTimeout))
+	if ps.ratchet.Load() == nil {
+		t.Fatal("no ratchet once awaitRatchet returned")
+	}
+	if _, err := alice.pool.SendRequest(bob, "after the ratchet"); err != nil {
+		t.Fatal(err)
+	}
+	alice.pool.RemoveSession("bob")
+
+	alice.pool.setEarlyRequests(true)
+	if ps, err = alice.pool.requestSession(bob); err != nil {
+		t.Fatal(err)
+	}
+	if ps.hello == nil || ps.ratcheted != nil {
+		t.Fatal("--early did not hold the HELLO for the first request")
+	}
+	if _, err := alice.pool.SendRequest(bob, "in the HELLO"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAwaitRatchet checks that requests wait for the ratchet until it is
+// ready or the deadline passes.
+func TestAwaitRatchet(t *testing.T) {
+	(&peerSession{}).awaitRatchet(time.Now().Add(time.Hour)) // nothing to wait for
+
+	ps := &peerSession{ratcheted: make(chan struct{})}
+	start := time.Now()
+	ps.awaitRatchet(start.Add(50 * time.Millisecond))
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("returned after %v, before the deadline", waited)
+	}
+	time.AfterFunc(10*time.Millisecond, ps.ratchetReady)
+	ps.awaitRatchet(time.Now().Add(time.Hour))
+	ps.ratchetReady() // twice is fine
+	ps.awaitRatchet(time.Now().Add(time.Hour))
+}
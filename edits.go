@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A direct message can be edited or deleted after it was sent. The sender
+// remembers the last maxEditable messages to each peer and sends a sealed
+// notify naming the message ID: editMediaType carries the new text,
+// deleteMediaType nothing more. The receiver remembers as many messages
+// from each peer, and only changes those: edits to messages it never
+// showed, or no longer remembers, are dropped.
+const (
+	editMediaType   = "application/x-tmd-edit"
+	deleteMediaType = "application/x-tmd-delete"
+	// maxEditable bounds the messages remembered per peer, each way.
+	maxEditable = 100
+)
+
+// editConsole is implemented by consoles that can change a direct message
+// already shown.
+type editConsole interface {
+	// EditMessage replaces the queued message old from a peer, and its
+	// history line, with text; empty text deletes it. It reports whether
+	// the message was found.
+	EditMessage(from PeerID, old, text string) bool
+}
+
+// editableMessages are the direct messages sent to, and received from,
+// each peer lately, oldest first.
+type editableMessages struct {
+	mu       sync.Mutex
+	sent     map[PeerID][]editable
+	received map[PeerID][]editable
+}
+
+type editable struct {
+	id   []byte
+	text string
+}
+
+// remember records a message in list, dropping the oldest beyond
+// maxEditable.
+func remember(m map[PeerID][]editable, peer PeerID, id []byte, text string) map[PeerID][]editable {
+	if m == nil {
+		m = make(map[PeerID][]editable)
+	}
+	list := append(m[peer], editable{id: id, text: text})
+	if len(list) > maxEditable {
+		list = list[len(list)-maxEditable:]
+	}
+	m[peer] = list
+	return m
+}
+
+// rememberSent records a direct message sent to a peer.
+func (p *connPool) rememberSent(to PeerID, id []byte, text string) {
+	p.edits.mu.Lock()
+	defer p.edits.mu.Unlock()
+	p.edits.sent = remember(p.edits.sent, to, id, text)
+}
+
+// rememberReceived records a direct message shown from a peer.
+func (p *connPool) rememberReceived(from PeerID, id []byte, text string) {
+	p.edits.mu.Lock()
+	defer p.edits.mu.Unlock()
+	p.edits.received = remember(p.edits.received, from, id, text)
+}
+
+// EditSent replaces the nth latest message sent to a peer (1 is the
+// latest) with text, or deletes it if text is empty, and tells the peer.
+// It returns the text replaced.
+func (p *connPool) EditSent(to PeerInfo, n int, text string) (string, error) {
+	p.edits.mu.Lock()
+	list := p.edits.sent[to.Nickname]
+	if n < 1 || n > len(list) {
+		p.edits.mu.Unlock()
+		return "", fmt.Errorf("no message #%d sent to %s (%d remembered)", n, to.Nickname, len(list))
+	}
+	m := &list[len(list)-n]
+	old, id := m.text, m.id
+	p.edits.mu.Unlock()
+
+	mediaType := editMediaType
+	if text == "" {
+		mediaType = deleteMediaType
+	}
+	if err := p.sendNotify(to, string(encodeEdit(id, text)), mediaType); err != nil {
+		return "", err
+	}
+
+	p.edits.mu.Lock()
+	defer p.edits.mu.Unlock()
+	list = p.edits.sent[to.Nickname]
+	for i := range list {
+		if bytes.Equal(list[i].id, id) {
+			if text == "" {
+				p.edits.sent[to.Nickname] = append(list[:i:i], list[i+1:]...)
+			} else {
+				list[i].text = text
+			}
+			break
+		}
+	}
+	return old, nil
+}
+
+// applyEdit changes a message received from a peer as its sender asked.
+func (p *connPool) applyEdit(from PeerID, plain []byte, mediaType string) error {
+	id, text, err := decodeEdit(plain)
+	if err != nil {
+		return fmt.Errorf("decode edit: %w", err)
+	}
+	if mediaType == deleteMediaType {
+		text = ""
+	} else if text == "" {
+		return errors.New("edit without text")
+	}
+
+	p.edits.mu.Lock()
+	list := p.edits.received[from]
+	var old string
+	found := false
+	for i := range list {
+		if bytes.Equal(list[i].id, id) {
+			old, found = list[i].text, true
+			if text == "" {
+				p.edits.received[from] = append(list[:i:i], list[i+1:]...)
+			} else {
+				list[i].text = text
+			}
+			break
+		}
+	}
+	p.edits.mu.Unlock()
+	if !found {
+		return nil
+	}
+
+	if ec, ok := p.console.(editConsole); ok && ec.EditMessage(from, old, text) {
+		return nil
+	}
+	if text == "" {
+		p.console.AddHistory(fmt.Sprintf("[%s deleted] %s", from, old))
+	} else {
+		p.console.AddHistory(fmt.Sprintf("[%s edited] %s", from, text))
+	}
+	return nil
+}
+
+// encodeEdit lays out a message ID and a text, for edits and reactions.
+func encodeEdit(id []byte, text string) []byte {
+	var b bytes.Buffer
+	_ = writeBlob(&b, id)
+	_ = writeBlob(&b, []byte(text))
+	return b.Bytes()
+}
+
+func decodeEdit(p []byte) ([]byte, string, error) {
+	r := bytes.NewReader(p)
+	id, err := readBlob(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(id) != messageIDSize {
+		return nil, "", errors.New("bad message ID")
+	}
+	text, err := readBlob(r)
+	if err != nil {
+		return nil, "", err
+	}
+	return id, string(text), nil
+}
+
+// editedLine is the history line of a direct message after an edit, or
+// a deletion if text is empty.
+func editedLine(from PeerID, text string) string {
+	if text == "" {
+		return fmt.Sprintf("[from %s] (deleted)", from)
+	}
+	return fmt.Sprintf("[from %s] %s (edited)", from, text)
+}
+
+// isMessageLine reports whether a history line shows the direct message
+// text from a peer, edited or not.
+func isMessageLine(line string, from PeerID, text string) bool {
+	return line == fmt.Sprintf("[from %s] %s", from, text) || line == editedLine(from, text)
+}
+
+// runEditCommand handles "/edit <peer>[#n] <text>" and "/delete
+// <peer>[#n]", where n counts back from the latest message to peer.
+func runEditCommand(c Console, pool *connPool, cmd, args string) {
+	usage := "usage: /edit <peer>[#n] <text>"
+	target, text, ok := splitFirstWord(args)
+	if cmd == "/delete" {
+		usage = "usage: /delete <peer>[#n]"
+		target, text = strings.TrimSpace(args), ""
+		ok = target != "" && !strings.Contains(target, " ")
+	}
+	if !ok {
+		c.Errorf("%s", usage)
+		return
+	}
+	peer, num, numbered := strings.Cut(target, "#")
+	n := 1
+	if numbered {
+		var err error
+		if n, err = strconv.Atoi(num); err != nil || n < 1 {
+			c.Errorf("%s", usage)
+			return
+		}
+	}
+	to, found := pool.peerTable.Get(PeerID(peer))
+	if !found {
+		c.Errorf("unknown peer: %s", peer)
+		return
+	}
+
+	old, err := pool.EditSent(to, n, text)
+	if err != nil {
+		c.Errorf("%s: %v", strings.TrimPrefix(cmd, "/"), err)
+		return
+	}
+	if text == "" {
+		c.Printf("[%s to %s] (deleted) %s", pool.nickname, peer, old)
+		return
+	}
+	c.Printf("[%s to %s] %s (edited)", pool.nickname, peer, text)
+}
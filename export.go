@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/attest"
+)
+
+// exportConsole is implemented by consoles that can hand over the
+// history lines of a conversation, for /export.
+type exportConsole interface {
+	// Conversation returns the history lines exchanged with peer (see
+	// inConversation), oldest first.
+	Conversation(peer PeerID) []conversationLine
+}
+
+// conversationLine is a history line of a conversation.
+type conversationLine struct {
+	Time  time.Time `json:"time"`
+	Text  string    `json:"text"`            // as shown, without the state
+	State string    `json:"state,omitempty"` // sent, delivered or read for lines added by AddSent
+}
+
+// exportedConversation is the JSON layout of /export; the markdown one
+// shows the same.
+type exportedConversation struct {
+	Peer     PeerID            `json:"peer"`
+	With     PeerID            `json:"with"`
+	KeyID    string            `json:"key_id,omitempty"`
+	PeerID   string            `json:"peer_id,omitempty"`
+	Identity string            `json:"identity"`
+	Exported time.Time         `json:"exported"`
+	Messages []exportedMessage `json:"messages"`
+}
+
+type exportedMessage struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"` // "in" or "out"
+	Kind      string    `json:"kind"`      // the line's label, e.g. "from bob"
+	Text      string    `json:"text"`
+	State     string    `json:"state,omitempty"`
+}
+
+// exportMessage splits a conversation line with peer into its label and
+// text; lines we sent carry " to peer" in their label.
+func exportMessage(peer PeerID, l conversationLine) exportedMessage {
+	m := exportedMessage{Time: l.Time, Direction: "in", Text: l.Text, State: l.State}
+	if label, text, ok := strings.Cut(strings.TrimPrefix(l.Text, "["), "] "); ok && strings.HasPrefix(l.Text, "[") {
+		m.Kind, m.Text = label, text
+		if strings.HasSuffix(label, " to "+string(peer)) {
+			m.Direction = "out"
+		}
+	}
+	return m
+}
+
+// identityState says whether a peer's keys match the --trusted store; only
+// online peers can be checked.
+func identityState(pool *connPool, peer PeerID) (info PeerInfo, state string) {
+	info, online := pool.peerTable.Get(peer)
+	if !online {
+		return PeerInfo{Nickname: peer}, "not checked (offline)"
+	}
+	switch status, e := pool.trustStatus(info); status {
+	case attest.Verified:
+		return info, "verified: " + e.External
+	case attest.Mismatch:
+		return info, "KEY MISMATCH"
+	}
+	return info, "not verified"
+}
+
+// exportConversation builds the export of the conversation with peer.
+func exportConversation(c exportConsole, pool *connPool, peer PeerID) exportedConversation {
+	info, identity := identityState(pool, peer)
+	out := exportedConversation{
+		Peer:     peer,
+		With:     pool.nickname,
+		Identity: identity,
+		Exported: time.Now().UTC(),
+		Messages: []exportedMessage{},
+	}
+	if info.PeerID != "" {
+		out.KeyID = fmt.Sprintf("%x", info.KeyID)
+		out.PeerID = info.PeerID.String()
+	}
+	for _, l := range c.Conversation(peer) {
+		out.Messages = append(out.Messages, exportMessage(peer, l))
+	}
+	return out
+}
+
+// markdown lays out an export for reading.
+func (e exportedConversation) markdown() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Conversation between %s and %s\n\n", e.With, e.Peer)
+	if e.PeerID != "" {
+		fmt.Fprintf(&b, "- Peer: %s (keyID=%s, peerID=%s)\n", e.Peer, e.KeyID, e.PeerID)
+	} else {
+		fmt.Fprintf(&b, "- Peer: %s\n", e.Peer)
+	}
+	fmt.Fprintf(&b, "- Identity: %s\n", e.Identity)
+	fmt.Fprintf(&b, "- Exported: %s\n\n", e.Exported.Format(time.RFC3339))
+	if len(e.Messages) == 0 {
+		b.WriteString("_No messages._\n")
+	}
+	for _, m := range e.Messages {
+		arrow := "←"
+		if m.Direction == "out" {
+			arrow = "→"
+		}
+		fmt.Fprintf(&b, "- `%s` %s **%s** %s", m.Time.Local().Format(time.DateTime), arrow, m.Kind, m.Text)
+		if m.State != "" {
+			fmt.Fprintf(&b, " _(%s)_", m.State)
+		}
+		b.WriteString("\n")
+	}
+	return []byte(b.String())
+}
+
+// writeExport writes e to path, as JSON for a .json file and markdown
+// otherwise. The file is only readable by us.
+func writeExport(e exportedConversation, path string) error {
+	var data []byte
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		var err error
+		if data, err = json.MarshalIndent(e, "", "  "); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	case ".md", ".markdown":
+		data = e.markdown()
+	default:
+		return fmt.Errorf("%s: want a .md or .json file", path)
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// runExport handles "/export @peer <file.md|file.json>".
+func runExport(c Console, pool *connPool, args string) {
+	peer, path, _ := strings.Cut(args, " ")
+	path = strings.TrimSpace(path)
+	if !strings.HasPrefix(peer, "@") || path == "" {
+		c.Errorf("usage: /export @peer <file.md|file.json>")
+		return
+	}
+	ec, ok := c.(exportConsole)
+	if !ok {
+		c.Errorf("export: this console keeps no history")
+		return
+	}
+	e := exportConversation(ec, pool, PeerID(strings.TrimPrefix(peer, "@")))
+	if err := writeExport(e, path); err != nil {
+		c.Errorf("export: %v", err)
+		return
+	}
+	c.Printf("[export] %d messages with %s written to %s", len(e.Messages), e.Peer, path)
+}
@@ -0,0 +1,36 @@
+package main
+
+import "encoding/binary"
+
+// Features are the handshake extensions a peer supports, as bits of a u32.
+// The listener offers its features at the end of its CHALLENGE, after the
+// suites, as u16(0xFFFF) || u32(features): the field takes the place of a
+// suite whose KEM is not assigned, which dialers predating features skip
+// as unknown. A dialer sets in the Features of its HELLO those it takes
+// up. Both fields are signed with the HELLO, so neither can be changed or
+// dropped on the way; HELLOs without features carry no such field.
+const (
+	featureBinding     uint32 = 1 << iota // the HELLO is bound to the connection (binding.go)
+	featureEarly                          // the first request may ride in the HELLO (early.go)
+	featureMutual                         // the listener answers with a RESPONDER_HELLO (mutual.go)
+	featureSessionKeys                    // requests after the first may skip the KEM (sessionkeys.go)
+)
+
+// featuresTag opens the features field of a CHALLENGE.
+const featuresTag = 0xffff
+
+// appendFeatures appends the features field to a CHALLENGE payload.
+func appendFeatures(b []byte, features uint32) []byte {
+	b = binary.BigEndian.AppendUint16(b, featuresTag)
+	return binary.BigEndian.AppendUint32(b, features)
+}
+
+// cutFeatures splits the features field off the end of the suite list of
+// a CHALLENGE, if it has one.
+func cutFeatures(suites []byte) (rest []byte, features uint32) {
+	n := len(suites) - suiteSize
+	if n < 0 || len(suites)%suiteSize != 0 || binary.BigEndian.Uint16(suites[n:]) != featuresTag {
+		return suites, 0
+	}
+	return suites[:n], binary.BigEndian.Uint32(suites[n+2:])
+}
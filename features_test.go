@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+// TestFeatures checks that decodeChallenge returns the features offered,
+// that dialers predating them skip the field as an unknown suite, and
+// that the features of a HELLO are signed.
+func TestFeatures(t *testing.T) {
+	chal := make([]byte, 32)
+	_, _ = rand.Read(chal)
+	const offered = featureBinding | featureEarly | featureMutual
+	payload := encodeChallenge(chal, defaultMaxFrame, supportedSuites, offered)
+	_, _, suites, features, err := decodeChallenge(payload)
+	if err != nil || len(suites) != len(supportedSuites) || features != offered {
+		t.Fatalf("decodeChallenge = %v, %x, %v", suites, features, err)
+	}
+	if suites, err := decodeSuites(payload[36:]); err != nil || len(suites) != len(supportedSuites) {
+		t.Fatalf("decodeSuites did not skip the features: %v, %v", suites, err)
+	}
+	if _, _, _, features, err := decodeChallenge(encodeChallenge(chal, defaultMaxFrame, supportedSuites, 0)); err != nil || features != 0 {
+		t.Fatalf("features without a field = %x, %v", features, err)
+	}
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	h := Hello{SenderID: "alice", SenderKeyID: make([]byte, KeyIDSize), SenderEdPub: pub, SenderHPKEPub: make([]byte, 32),
+		Suites: encodeSuites(supportedSuites), Features: featureBinding}
+	h.Signature = ed25519.Sign(priv, helloSignInput(payload, h))
+	dec, err := decodeHello(encodeHello(h))
+	if err != nil || dec.Features != featureBinding || len(dec.Request) != 0 {
+		t.Fatalf("decodeHello = %+v, %v", dec, err)
+	}
+	if err := verifySignedHello(nil, payload, dec); err != nil {
+		t.Fatal(err)
+	}
+	dec.Features |= featureEarly
+	if err := verifySignedHello(nil, payload, dec); err == nil {
+		t.Fatal("a HELLO with changed features verified")
+	}
+}
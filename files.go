@@ -0,0 +1,840 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openpcc/twoway"
+)
+
+// File transfers: the sender sends a FILE_OFFER with the name, size and
+// SHA-256 of the file and of each chunk, then the file in FILE_CHUNK
+// frames, each sealed to the receiver's HPKE key on its own so that
+// neither side holds the whole file in memory. The receiver writes chunks
+// to a partial file as they arrive, checks the digest once all are in, and
+// asks the user to /save or /discard the result.
+//
+// Both sides keep a manifest of each transfer in the transfer directory.
+// When a transfer stops short (the sender lost its session, or either side
+// restarted) the receiver sends a FILE_RESUME listing the chunks it still
+// lacks, once the sender is back online or on /resume; the chunks already
+// on disk are found again by their hashes. An empty FILE_RESUME tells the
+// sender that the file arrived, and it forgets the transfer.
+
+const (
+	fileOfferMediaType = "application/x-tmd-file-offer"
+	fileChunkMediaType = "application/x-tmd-file-chunk"
+
+	fileIDSize    = 16
+	fileChunkSize = 256 << 10 // fits the default frame limit once sealed
+	maxFileSize   = 4 << 30
+)
+
+// fileManifest describes a transfer. It is written when the transfer
+// starts and removed once it is over.
+type fileManifest struct {
+	ID          string   `json:"id"`   // hex transfer ID
+	Peer        PeerID   `json:"peer"` // the sender, or the receiver of an outgoing file
+	Name        string   `json:"name"`
+	Size        uint64   `json:"size"`
+	ChunkSize   uint32   `json:"chunk_size"`
+	Digest      []byte   `json:"digest"`
+	ChunkHashes [][]byte `json:"chunk_hashes"`
+
+	// Outgoing transfers only: the file being sent, which must not change
+	// until it is delivered.
+	Path    string    `json:"path,omitempty"`
+	ModTime time.Time `json:"mod_time,omitzero"`
+}
+
+func (m *fileManifest) chunks() uint32 {
+	return uint32(len(m.ChunkHashes))
+}
+
+// chunkLen is the length of chunk i; the last one may be short.
+func (m *fileManifest) chunkLen(i uint32) int {
+	offset := uint64(i) * uint64(m.ChunkSize)
+	return int(min(uint64(m.ChunkSize), m.Size-offset))
+}
+
+// incomingFile is a file being received, or received and awaiting /save.
+type incomingFile struct {
+	fileManifest
+	num      int // shown in prompts
+	data     *os.File
+	got      []bool
+	received uint32
+	complete bool
+	percent  int // last progress shown
+}
+
+// outgoingFile is a file sent and not yet reported delivered.
+type outgoingFile struct {
+	fileManifest
+	percent int
+}
+
+// fileTransfers holds the transfers in progress.
+type fileTransfers struct {
+	mu       sync.Mutex
+	dir      string // manifests and partial files
+	next     int
+	incoming map[string]*incomingFile // by sender and transfer ID
+	outgoing map[string]*outgoingFile // by transfer ID
+}
+
+// setTransferDir keeps transfers in dir and picks up those an earlier run
+// left there. Without it they are kept under the system temp directory.
+func (p *connPool) setTransferDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	p.files.mu.Lock()
+	p.files.dir = dir
+	p.files.mu.Unlock()
+
+	outs, _ := filepath.Glob(filepath.Join(dir, "out-*.json"))
+	for _, path := range outs {
+		var m fileManifest
+		if err := readManifest(path, &m); err != nil {
+			p.console.Errorf("[file] %s: %v", path, err)
+			continue
+		}
+		p.files.mu.Lock()
+		p.addOutgoingLocked(&outgoingFile{fileManifest: m})
+		p.files.mu.Unlock()
+		p.console.AddHistory(fmt.Sprintf("[file to %s] %s awaiting delivery", m.Peer, m.Name))
+	}
+
+	ins, _ := filepath.Glob(filepath.Join(dir, "in-*.json"))
+	for _, path := range ins {
+		var m fileManifest
+		if err := readManifest(path, &m); err != nil {
+			p.console.Errorf("[file] %s: %v", path, err)
+			continue
+		}
+		if err := p.restoreIncoming(m); err != nil {
+			p.console.Errorf("[file from %s] %s: %v", m.Peer, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// restoreIncoming reopens the partial file of an incoming transfer and
+// checks which chunks it already holds.
+func (p *connPool) restoreIncoming(m fileManifest) error {
+	data, err := os.OpenFile(p.transferPath("in", m.ID, ".part"), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	in := &incomingFile{fileManifest: m, data: data, got: make([]bool, m.chunks())}
+	for i := range m.chunks() {
+		buf := make([]byte, m.chunkLen(i))
+		if _, err := data.ReadAt(buf, int64(i)*int64(m.ChunkSize)); err != nil {
+			continue
+		}
+		if sum := sha256.Sum256(buf); bytes.Equal(sum[:], m.ChunkHashes[i]) {
+			in.got[i] = true
+			in.received++
+		}
+	}
+
+	p.files.mu.Lock()
+	p.addIncomingLocked(in)
+	p.files.mu.Unlock()
+
+	if in.received == m.chunks() {
+		p.finishFile(in)
+		return nil
+	}
+	p.console.AddHistory(fmt.Sprintf("[file from %s] %s: %d/%d chunks, resuming as %d when %s is online",
+		m.Peer, m.Name, in.received, m.chunks(), in.num, m.Peer))
+	return nil
+}
+
+// SendFile sends the file at path to a peer, chunk by chunk.
+func (p *connPool) SendFile(to PeerInfo, path string) error {
+	o, err := p.offerFile(to, path)
+	if err != nil {
+		return err
+	}
+	return p.sendChunks(to, o, [][2]uint32{{0, o.chunks()}})
+}
+
+// offerFile hashes the file at path, records the transfer and sends the
+// offer.
+func (p *connPool) offerFile(to PeerInfo, path string) (*outgoingFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !st.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	if st.Size() > maxFileSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", path, int64(maxFileSize))
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, fileIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	m := fileManifest{
+		ID:        hex.EncodeToString(id),
+		Peer:      to.Nickname,
+		Name:      filepath.Base(path),
+		Size:      uint64(st.Size()),
+		ChunkSize: fileChunkSize,
+		Path:      abs,
+		ModTime:   st.ModTime(),
+	}
+	whole := sha256.New()
+	buf := make([]byte, fileChunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			m.ChunkHashes = append(m.ChunkHashes, sum[:])
+			whole.Write(buf[:n])
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	m.Digest = whole.Sum(nil)
+
+	o := &outgoingFile{fileManifest: m}
+	if err := writeManifest(p.transferPath("out", m.ID, ".json"), &m); err != nil {
+		return nil, err
+	}
+	p.files.mu.Lock()
+	p.addOutgoingLocked(o)
+	p.files.mu.Unlock()
+
+	sealed, err := p.sealNotify(to, string(encodeFileOfferInfo(id, &m)), fileOfferMediaType)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.sendOneWay(to, msgFileOffer, encodeFileOffer(FileOffer{TransferID: id, Chunks: m.chunks(), Sealed: sealed})); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// sendChunks sends the chunks of o in the given index ranges.
+func (p *connPool) sendChunks(to PeerInfo, o *outgoingFile, ranges [][2]uint32) error {
+	if len(ranges) == 0 || ranges[0][0] == ranges[0][1] {
+		return nil
+	}
+	f, err := os.Open(o.Path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	if st, err := f.Stat(); err != nil || uint64(st.Size()) != o.Size || !st.ModTime().Equal(o.ModTime) {
+		return fmt.Errorf("%s changed since it was offered", o.Path)
+	}
+
+	id, _ := hex.DecodeString(o.ID)
+	var missing uint32
+	for _, r := range ranges {
+		missing += r[1] - r[0]
+	}
+	done := o.chunks() - missing
+	key := "file " + o.ID
+	defer p.setStatus(key, "")
+	buf := make([]byte, o.ChunkSize)
+	for _, r := range ranges {
+		for i := r[0]; i < r[1]; i++ {
+			chunk := buf[:o.chunkLen(i)]
+			if _, err := f.ReadAt(chunk, int64(i)*int64(o.ChunkSize)); err != nil {
+				return err
+			}
+			sealed, err := p.sealNotify(to, string(fileChunkPlain(id, i, chunk)), fileChunkMediaType)
+			if err != nil {
+				return err
+			}
+			if err := p.sendOneWay(to, msgFileChunk, encodeFileChunk(FileChunk{TransferID: id, Index: i, Sealed: sealed})); err != nil {
+				return fmt.Errorf("chunk %d of %d: %w", i+1, o.chunks(), err)
+			}
+			done++
+			p.files.mu.Lock()
+			pct, changed := progress(&o.percent, done, o.chunks())
+			p.files.mu.Unlock()
+			if changed {
+				p.setStatus(key, fmt.Sprintf("%s to %s %d%%", o.Name, o.Peer, pct))
+			}
+		}
+	}
+	return nil
+}
+
+// handleFileFrame opens a FILE_OFFER or FILE_CHUNK from a peer, or acts on
+// a FILE_RESUME. Like notifies, files are not passed to onReceive
+// subscribers.
+func (p *connPool) handleFileFrame(from PeerID, typ byte, payload []byte, receiver *twoway.MultiRequestReceiver) error {
+	switch typ {
+	case msgFileOffer:
+		o, err := decodeFileOffer(payload)
+		if err != nil {
+			return fmt.Errorf("decode file offer: %w", err)
+		}
+		if baseMediaType(o.Sealed.MediaType) != fileOfferMediaType {
+			return fmt.Errorf("file offer from %s: media type %q", from, o.Sealed.MediaType)
+		}
+		plain, err := p.openNotify(o.Sealed, receiver)
+		if err != nil {
+			return err
+		}
+		return p.acceptFileOffer(from, o, plain)
+	case msgFileResume:
+		r, err := decodeFileResume(payload)
+		if err != nil {
+			return fmt.Errorf("decode file resume: %w", err)
+		}
+		p.acceptFileResume(from, r)
+		return nil
+	}
+
+	c, err := decodeFileChunk(payload)
+	if err != nil {
+		return fmt.Errorf("decode file chunk: %w", err)
+	}
+	if baseMediaType(c.Sealed.MediaType) != fileChunkMediaType {
+		return fmt.Errorf("file chunk from %s: media type %q", from, c.Sealed.MediaType)
+	}
+	plain, err := p.openNotify(c.Sealed, receiver)
+	if err != nil {
+		return err
+	}
+	return p.acceptFileChunk(from, c, plain)
+}
+
+func (p *connPool) acceptFileOffer(from PeerID, o FileOffer, plain []byte) error {
+	id, m, err := decodeFileOfferInfo(plain)
+	if err != nil || !bytes.Equal(id, o.TransferID) {
+		return fmt.Errorf("file offer from %s: bad content", from)
+	}
+	m.Peer = from
+	if m.Size > maxFileSize || m.ChunkSize == 0 || m.chunks() != o.Chunks ||
+		uint64(o.Chunks) != (m.Size+uint64(m.ChunkSize)-1)/uint64(m.ChunkSize) {
+		p.console.Errorf("[file from %s] %s: refused, %d bytes", from, m.Name, m.Size)
+		return nil
+	}
+
+	p.files.mu.Lock()
+	_, dup := p.files.incoming[fileKey(from, id)]
+	p.files.mu.Unlock()
+	if dup {
+		return nil
+	}
+	data, err := os.OpenFile(p.transferPath("in", m.ID, ".part"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err == nil {
+		err = writeManifest(p.transferPath("in", m.ID, ".json"), &m)
+	}
+	if err != nil {
+		p.console.Errorf("[file from %s] %s: %v", from, m.Name, err)
+		return nil
+	}
+
+	in := &incomingFile{fileManifest: m, data: data, got: make([]bool, o.Chunks)}
+	p.files.mu.Lock()
+	p.addIncomingLocked(in)
+	p.files.mu.Unlock()
+
+	p.console.AddHistory(fmt.Sprintf("[file from %s] %s (%d bytes), receiving as %d", from, in.Name, in.Size, in.num))
+	if o.Chunks == 0 {
+		p.finishFile(in)
+	}
+	return nil
+}
+
+func (p *connPool) acceptFileChunk(from PeerID, c FileChunk, plain []byte) error {
+	id, index, data, err := decodeFileChunkPlain(plain)
+	if err != nil || !bytes.Equal(id, c.TransferID) || index != c.Index {
+		return fmt.Errorf("file chunk from %s: bad content", from)
+	}
+
+	p.files.mu.Lock()
+	in, ok := p.files.incoming[fileKey(from, id)]
+	if !ok || in.complete || index >= in.chunks() || in.got[index] {
+		p.files.mu.Unlock()
+		return nil // discarded, or a resent duplicate
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], in.ChunkHashes[index]) {
+		p.files.mu.Unlock()
+		return fmt.Errorf("file chunk %d from %s does not match the offer", index, from)
+	}
+	if _, err := in.data.WriteAt(data, int64(index)*int64(in.ChunkSize)); err != nil {
+		p.files.mu.Unlock()
+		p.console.Errorf("[file from %s] %s: %v", from, in.Name, err)
+		return nil
+	}
+	in.got[index] = true
+	in.received++
+	done := in.received == in.chunks()
+	pct, changed := progress(&in.percent, in.received, in.chunks())
+	p.files.mu.Unlock()
+
+	if done {
+		p.finishFile(in)
+	} else if changed {
+		p.setStatus("file "+in.ID, fmt.Sprintf("%s from %s %d%%", in.Name, in.Peer, pct))
+	}
+	return nil
+}
+
+// acceptFileResume resends what a receiver lacks, or forgets a transfer
+// it reports complete.
+func (p *connPool) acceptFileResume(from PeerID, r FileResume) {
+	p.files.mu.Lock()
+	o, ok := p.files.outgoing[hex.EncodeToString(r.TransferID)]
+	if !ok || o.Peer != from {
+		p.files.mu.Unlock()
+		return
+	}
+	if len(r.Missing) == 0 {
+		delete(p.files.outgoing, o.ID)
+		p.files.mu.Unlock()
+		_ = os.Remove(p.transferPath("out", o.ID, ".json"))
+		p.console.AddHistory(fmt.Sprintf("[file to %s] %s delivered", o.Peer, o.Name))
+		return
+	}
+	p.files.mu.Unlock()
+
+	for _, m := range r.Missing {
+		if m[1] > o.chunks() {
+			p.console.Errorf("[file to %s] %s: resume past the last chunk", from, o.Name)
+			return
+		}
+	}
+	to, ok := p.peerTable.Get(from)
+	if !ok {
+		return
+	}
+	p.console.AddHistory(fmt.Sprintf("[file to %s] resuming %s", from, o.Name))
+	go func() {
+		if err := p.sendChunks(to, o, r.Missing); err != nil {
+			p.console.Errorf("send %s to %s: %v", o.Name, from, err)
+			return
+		}
+		p.console.AddHistory(fmt.Sprintf("[file to %s] sent %s", from, o.Name))
+	}()
+}
+
+// finishFile checks the digest of a fully received file, tells the sender
+// it arrived and prompts for it.
+func (p *connPool) finishFile(in *incomingFile) {
+	p.setStatus("file "+in.ID, "")
+	h := sha256.New()
+	_, err := io.Copy(h, io.NewSectionReader(in.data, 0, int64(in.Size)))
+	if err == nil && !bytes.Equal(h.Sum(nil), in.Digest) {
+		err = errors.New("digest mismatch")
+	}
+	if err != nil {
+		p.console.Errorf("[file from %s] %s: %v", in.Peer, in.Name, err)
+		p.dropFile(in.num)
+		return
+	}
+
+	p.files.mu.Lock()
+	in.complete = true
+	p.files.mu.Unlock()
+	go func() { _ = p.sendFileResume(in, nil) }()
+	p.console.AddHistory(fmt.Sprintf("[file from %s] %s received: /save %d [path] or /discard %d", in.Peer, in.Name, in.num, in.num))
+}
+
+// ResumeFile asks the sender of an incoming file for the chunks missing.
+func (p *connPool) ResumeFile(num int) error {
+	p.files.mu.Lock()
+	in := p.fileByNum(num)
+	p.files.mu.Unlock()
+	if in == nil {
+		return fmt.Errorf("no file %d", num)
+	}
+	if in.complete {
+		return fmt.Errorf("file %d is already received", num)
+	}
+	return p.sendFileResume(in, missingChunks(in))
+}
+
+// resumeFilesFrom resumes the transfers from a peer that came online, and
+// confirms again those received meanwhile in case it missed it.
+func (p *connPool) resumeFilesFrom(nick PeerID) {
+	p.files.mu.Lock()
+	var ins []*incomingFile
+	for _, in := range p.files.incoming {
+		if in.Peer == nick {
+			ins = append(ins, in)
+		}
+	}
+	p.files.mu.Unlock()
+
+	for _, in := range ins {
+		go func() {
+			var missing [][2]uint32
+			if !in.complete {
+				missing = missingChunks(in)
+			}
+			_ = p.sendFileResume(in, missing)
+		}()
+	}
+}
+
+func (p *connPool) sendFileResume(in *incomingFile, missing [][2]uint32) error {
+	to, ok := p.peerTable.Get(in.Peer)
+	if !ok {
+		return fmt.Errorf("%s is offline", in.Peer)
+	}
+	id, _ := hex.DecodeString(in.ID)
+	return p.sendOneWay(to, msgFileResume, encodeFileResume(FileResume{TransferID: id, Missing: missing}))
+}
+
+// SaveFile writes a received file to path, which must not exist; an empty
+// path saves it under its own name in the current directory.
+func (p *connPool) SaveFile(num int, path string) (string, error) {
+	p.files.mu.Lock()
+	in := p.fileByNum(num)
+	p.files.mu.Unlock()
+	if in == nil {
+		return "", fmt.Errorf("no file %d", num)
+	}
+	if !in.complete {
+		return "", fmt.Errorf("file %d is still being received", num)
+	}
+	if path == "" {
+		path = in.Name
+	}
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(in.data, 0, int64(in.Size)))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return "", err
+	}
+	p.dropFile(num)
+	return path, nil
+}
+
+// DiscardFile drops a received or incoming file.
+func (p *connPool) DiscardFile(num int) error {
+	if !p.dropFile(num) {
+		return fmt.Errorf("no file %d", num)
+	}
+	return nil
+}
+
+// Files lists the incoming and received files, then those sent and not
+// yet delivered.
+func (p *connPool) Files() []string {
+	p.files.mu.Lock()
+	defer p.files.mu.Unlock()
+	var ins []*incomingFile
+	for _, in := range p.files.incoming {
+		ins = append(ins, in)
+	}
+	slices.SortFunc(ins, func(a, b *incomingFile) int { return a.num - b.num })
+
+	var lines []string
+	for _, in := range ins {
+		state := "received"
+		if !in.complete {
+			state = fmt.Sprintf("%d/%d chunks", in.received, in.chunks())
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s from %s, %d bytes, %s", in.num, in.Name, in.Peer, in.Size, state))
+	}
+	for _, o := range p.files.outgoing {
+		lines = append(lines, fmt.Sprintf("-  %s to %s, %d bytes, not yet delivered", o.Name, o.Peer, o.Size))
+	}
+	return lines
+}
+
+func (p *connPool) dropFile(num int) bool {
+	p.files.mu.Lock()
+	defer p.files.mu.Unlock()
+	for k, in := range p.files.incoming {
+		if in.num == num {
+			delete(p.files.incoming, k)
+			_ = in.data.Close()
+			_ = os.Remove(p.transferPathLocked("in", in.ID, ".part"))
+			_ = os.Remove(p.transferPathLocked("in", in.ID, ".json"))
+			p.setStatus("file "+in.ID, "")
+			return true
+		}
+	}
+	return false
+}
+
+func (p *connPool) fileByNum(num int) *incomingFile {
+	for _, in := range p.files.incoming {
+		if in.num == num {
+			return in
+		}
+	}
+	return nil
+}
+
+func (p *connPool) addIncomingLocked(in *incomingFile) {
+	if p.files.incoming == nil {
+		p.files.incoming = make(map[string]*incomingFile)
+	}
+	p.files.next++
+	in.num = p.files.next
+	id, _ := hex.DecodeString(in.ID)
+	p.files.incoming[fileKey(in.Peer, id)] = in
+}
+
+func (p *connPool) addOutgoingLocked(o *outgoingFile) {
+	if p.files.outgoing == nil {
+		p.files.outgoing = make(map[string]*outgoingFile)
+	}
+	p.files.outgoing[o.ID] = o
+}
+
+// transferPath names a manifest or partial file in the transfer directory.
+func (p *connPool) transferPath(dir, id, ext string) string {
+	p.files.mu.Lock()
+	defer p.files.mu.Unlock()
+	return p.transferPathLocked(dir, id, ext)
+}
+
+func (p *connPool) transferPathLocked(dir, id, ext string) string {
+	if p.files.dir == "" {
+		p.files.dir = filepath.Join(os.TempDir(), "tmd-"+string(p.nickname))
+		_ = os.MkdirAll(p.files.dir, 0o700)
+	}
+	return filepath.Join(p.files.dir, dir+"-"+id+ext)
+}
+
+// setStatus shows progress in the console's status area, if it has one.
+func (p *connPool) setStatus(key, text string) {
+	if c, ok := p.console.(statusConsole); ok {
+		c.SetStatus(key, text)
+	}
+}
+
+// progress updates *last to the percentage done/total and reports whether
+// it changed.
+func progress(last *int, done, total uint32) (int, bool) {
+	pct := int(uint64(done) * 100 / uint64(max(total, 1)))
+	if pct == *last {
+		return pct, false
+	}
+	*last = pct
+	return pct, true
+}
+
+// missingChunks lists the chunks of in not yet received, as index ranges.
+func missingChunks(in *incomingFile) [][2]uint32 {
+	var ranges [][2]uint32
+	for i, got := range in.got {
+		switch {
+		case got:
+		case len(ranges) > 0 && ranges[len(ranges)-1][1] == uint32(i):
+			ranges[len(ranges)-1][1]++
+		default:
+			ranges = append(ranges, [2]uint32{uint32(i), uint32(i) + 1})
+		}
+	}
+	return ranges
+}
+
+func fileKey(from PeerID, id []byte) string {
+	return string(from) + "\x00" + string(id)
+}
+
+func readManifest(path string, m *fileManifest) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return err
+	}
+	if len(m.ID) != 2*fileIDSize || m.ChunkSize == 0 {
+		return errors.New("bad manifest")
+	}
+	return nil
+}
+
+func writeManifest(path string, m *fileManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// Offer content: blob(transfer ID) || blob(name) || blob(u64 size) ||
+// blob(u32 chunk size) || blob(sha256) || blob(sha256 of each chunk)
+func encodeFileOfferInfo(id []byte, m *fileManifest) []byte {
+	var b bytes.Buffer
+	_ = writeBlob(&b, id)
+	_ = writeBlob(&b, []byte(m.Name))
+	_ = writeBlob(&b, binary.BigEndian.AppendUint64(nil, m.Size))
+	_ = writeBlob(&b, binary.BigEndian.AppendUint32(nil, m.ChunkSize))
+	_ = writeBlob(&b, m.Digest)
+	_ = writeBlob(&b, bytes.Join(m.ChunkHashes, nil))
+	return b.Bytes()
+}
+
+func decodeFileOfferInfo(p []byte) ([]byte, fileManifest, error) {
+	r := bytes.NewReader(p)
+	var fields [6][]byte
+	for i := range fields {
+		f, err := readBlob(r)
+		if err != nil {
+			return nil, fileManifest{}, err
+		}
+		fields[i] = f
+	}
+	if len(fields[0]) != fileIDSize || len(fields[2]) != 8 || len(fields[3]) != 4 ||
+		len(fields[4]) != sha256.Size || len(fields[5])%sha256.Size != 0 {
+		return nil, fileManifest{}, errors.New("bad file offer")
+	}
+	m := fileManifest{
+		ID:        hex.EncodeToString(fields[0]),
+		Name:      safeFileName(string(fields[1])),
+		Size:      binary.BigEndian.Uint64(fields[2]),
+		ChunkSize: binary.BigEndian.Uint32(fields[3]),
+		Digest:    fields[4],
+	}
+	for h := range slices.Chunk(fields[5], sha256.Size) {
+		m.ChunkHashes = append(m.ChunkHashes, h)
+	}
+	return fields[0], m, nil
+}
+
+// Chunk content: blob(transfer ID) || blob(u32 index) || data
+func fileChunkPlain(id []byte, index uint32, data []byte) []byte {
+	var b bytes.Buffer
+	_ = writeBlob(&b, id)
+	_ = writeBlob(&b, binary.BigEndian.AppendUint32(nil, index))
+	b.Write(data)
+	return b.Bytes()
+}
+
+func decodeFileChunkPlain(p []byte) ([]byte, uint32, []byte, error) {
+	r := bytes.NewReader(p)
+	id, err := readBlob(r)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	index, err := readBlob(r)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if len(index) != 4 {
+		return nil, 0, nil, errors.New("bad chunk index")
+	}
+	return id, binary.BigEndian.Uint32(index), p[len(p)-r.Len():], nil
+}
+
+// safeFileName keeps the last element of a sender-chosen name, so that
+// saving it cannot escape the current directory.
+func safeFileName(name string) string {
+	name = filepath.Base(filepath.Clean("/" + strings.ReplaceAll(name, "\\", "/")))
+	if name == "/" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// runFileCommand handles /send-file, /files, /save, /discard and /resume.
+func runFileCommand(c Console, pool *connPool, cmd, args string) {
+	switch cmd {
+	case "/send-file":
+		nick, path, ok := splitFirstWord(args)
+		if !ok {
+			c.Errorf("usage: /send-file <peer> <path>")
+			return
+		}
+		to, found := pool.peerTable.Get(PeerID(nick))
+		if !found {
+			c.Errorf("unknown peer: %s", nick)
+			return
+		}
+		name := filepath.Base(path)
+		c.Printf("[file to %s] sending %s", nick, name)
+		go func() {
+			if err := pool.SendFile(to, path); err != nil {
+				c.Errorf("send %s to %s: %v", name, nick, err)
+				return
+			}
+			c.Printf("[file to %s] sent %s", nick, name)
+		}()
+	case "/files":
+		files := pool.Files()
+		if len(files) == 0 {
+			c.Printf("No file transfers")
+			return
+		}
+		for _, line := range files {
+			c.Printf("%s", line)
+		}
+	case "/save", "/discard", "/resume":
+		numArg, path, _ := strings.Cut(strings.TrimSpace(args), " ")
+		num, err := strconv.Atoi(numArg)
+		if err != nil {
+			if cmd == "/save" {
+				c.Errorf("usage: /save <n> [path]")
+			} else {
+				c.Errorf("usage: %s <n>", cmd)
+			}
+			return
+		}
+		switch cmd {
+		case "/discard":
+			if err := pool.DiscardFile(num); err != nil {
+				c.Errorf("%v", err)
+				return
+			}
+			c.Printf("[file] discarded %d", num)
+		case "/resume":
+			if err := pool.ResumeFile(num); err != nil {
+				c.Errorf("resume %d: %v", num, err)
+				return
+			}
+			c.Printf("[file] asked to resume %d", num)
+		default:
+			saved, err := pool.SaveFile(num, strings.TrimSpace(path))
+			if err != nil {
+				c.Errorf("save %d: %v", num, err)
+				return
+			}
+			c.Printf("[file] saved %d as %s", num, saved)
+		}
+	}
+}
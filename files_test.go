@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRestoreIncomingFile(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("x"), 2*fileChunkSize+10)
+	m := fileManifest{ID: "000102030405060708090a0b0c0d0e0f", Peer: "alice", Name: "x.bin", Size: uint64(len(data)), ChunkSize: fileChunkSize}
+	for c := range slices.Chunk(data, fileChunkSize) {
+		sum := sha256.Sum256(c)
+		m.ChunkHashes = append(m.ChunkHashes, sum[:])
+	}
+	whole := sha256.Sum256(data)
+	m.Digest = whole[:]
+	if err := writeManifest(filepath.Join(dir, "in-"+m.ID+".json"), &m); err != nil {
+		t.Fatal(err)
+	}
+	// The middle chunk never arrived.
+	part := slices.Clone(data)
+	clear(part[fileChunkSize : 2*fileChunkSize])
+	if err := os.WriteFile(filepath.Join(dir, "in-"+m.ID+".part"), part, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newHeadlessConsole()
+	pool := newTestPool("bob")
+	pool.setConsole(c)
+	if err := pool.setTransferDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !c.WaitFor("[file from alice] x.bin: 2/3 chunks, resuming as 1 when alice is online", 0) {
+		t.Fatalf("history: %q", c.History())
+	}
+	in := pool.fileByNum(1)
+	if got := missingChunks(in); !slices.Equal(got, [][2]uint32{{1, 2}}) {
+		t.Fatalf("missingChunks = %v", got)
+	}
+}
+
+func TestMissingChunks(t *testing.T) {
+	in := &incomingFile{got: []bool{false, false, true, false, true, true, false}}
+	want := [][2]uint32{{0, 2}, {3, 4}, {6, 7}}
+	if got := missingChunks(in); !slices.Equal(got, want) {
+		t.Fatalf("missingChunks = %v, want %v", got, want)
+	}
+}
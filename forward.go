@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A forwarded message is a request of its own media type whose text
+// starts with a "forwarded from <peer>" line naming the original sender.
+// Peers that predate forwarding show that text as is. The attribution is
+// the forwarder's word: the original sender's keys are not involved.
+const (
+	forwardMediaType = "text/plain; purpose=req; forwarded=1"
+	forwardHeader    = "forwarded from "
+)
+
+func forwardEnvelope(from PeerID, text string) string {
+	return forwardHeader + string(from) + "\n" + text
+}
+
+// parseForward returns the original sender and text of a forwarded
+// message.
+func parseForward(plain string) (PeerID, string, bool) {
+	line, text, ok := strings.Cut(plain, "\n")
+	from, found := strings.CutPrefix(line, forwardHeader)
+	if !ok || !found || from == "" || strings.ContainsRune(from, ' ') {
+		return "", "", false
+	}
+	return PeerID(from), text, true
+}
+
+// forwardedLine is how a forwarded message is shown to its receiver.
+func forwardedLine(from PeerID, text string) string {
+	return fmt.Sprintf("(forwarded from %s) %s", from, text)
+}
+
+// Forward sends the nth latest message received from a peer (1 is the
+// latest) to another peer, and returns it.
+func (p *connPool) Forward(from PeerID, n int, to PeerInfo) (string, error) {
+	p.edits.mu.Lock()
+	list := p.edits.received[from]
+	if n < 1 || n > len(list) {
+		p.edits.mu.Unlock()
+		return "", fmt.Errorf("no message #%d from %s (%d remembered)", n, from, len(list))
+	}
+	text := list[len(list)-n].text
+	p.edits.mu.Unlock()
+
+	if _, err := p.sendRequest(to, forwardEnvelope(from, text), forwardMediaType, nil, nil, nil); err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+// runForward handles "/forward <peer>[#n] @<to>", where n counts back
+// from the latest message received from peer.
+func runForward(c Console, pool *connPool, args string) {
+	const usage = "usage: /forward <peer>[#n] @<peer>"
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		c.Errorf(usage)
+		return
+	}
+	from, num, numbered := strings.Cut(fields[0], "#")
+	n := 1
+	if numbered {
+		var err error
+		if n, err = strconv.Atoi(num); err != nil || n < 1 {
+			c.Errorf(usage)
+			return
+		}
+	}
+	toTag := strings.TrimPrefix(fields[1], "@")
+	to, found := pool.peerTable.Get(PeerID(toTag))
+	if !found {
+		c.Errorf("unknown peer: %s", toTag)
+		return
+	}
+
+	text, err := pool.Forward(PeerID(from), n, to)
+	if err != nil {
+		c.Errorf("forward: %v", err)
+		return
+	}
+	c.Printf("[%s to %s] %s", pool.nickname, to.Nickname, forwardedLine(PeerID(from), text))
+}
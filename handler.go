@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Handler answers the requests peers send: bots are built on tmd by
+// registering one with setHandler. The stream handler shows each request
+// as before, then passes it to Handle once opened, with the sender's
+// timeout as ctx's deadline, and seals the response back to the peer.
+// Resent copies of a request get the first copy's response without
+// reaching the Handler again.
+//
+// from is the sender as authenticated by its session's Hello, so bots
+// may trust its nickname and keys.
+//
+// Handle runs on the sender's stream: later requests from the same peer
+// wait for it. An empty respMediaType stands for respMediaType. Returning ErrHold leaves an interactive request for /reply;
+// any other error is sent to the peer as a failedRespMediaType response.
+type Handler interface {
+	Handle(ctx context.Context, from PeerInfo, mediaType string, plaintext []byte) (respMediaType string, resp []byte, err error)
+}
+
+// HandlerFunc adapts a function to Handler.
+type HandlerFunc func(ctx context.Context, from PeerInfo, mediaType string, plaintext []byte) (string, []byte, error)
+
+func (f HandlerFunc) Handle(ctx context.Context, from PeerInfo, mediaType string, plaintext []byte) (string, []byte, error) {
+	return f(ctx, from, mediaType, plaintext)
+}
+
+// ErrHold is returned by a Handler to leave an interactive request for
+// /reply, or for the ackReply sent when replyWindow elapses. For other
+// requests it is a failure like any error.
+var ErrHold = errors.New("hold for /reply")
+
+// failedRespMediaType is the media type of responses to requests the
+// Handler failed on; the response is the error text.
+const failedRespMediaType = "text/plain; purpose=resp; error=handler"
+
+// handlerState holds the Handler set with setHandler; nil means
+// defaultHandler.
+type handlerState struct {
+	mu sync.RWMutex
+	h  Handler
+}
+
+// setHandler answers requests with h instead of the default responses
+// (autoreply rules, /reply, ackReply); nil restores those.
+func (p *connPool) setHandler(h Handler) {
+	p.handler.mu.Lock()
+	defer p.handler.mu.Unlock()
+	p.handler.h = h
+}
+
+func (p *connPool) requestHandler() Handler {
+	p.handler.mu.RLock()
+	defer p.handler.mu.RUnlock()
+	if p.handler.h != nil {
+		return p.handler.h
+	}
+	return HandlerFunc(p.defaultHandler)
+}
+
+// defaultHandler is tmd's own Handler: broadcasts are acknowledged, and
+// direct messages get the reply of the first matching autoreply rule,
+// unless their peer is untrusted (see requests.go); interactive ones are
+// otherwise held for /reply, the rest acknowledged.
+func (p *connPool) defaultHandler(_ context.Context, from PeerInfo, mediaType string, plaintext []byte) (string, []byte, error) {
+	text := string(plaintext)
+	if strings.HasPrefix(text, broadcastPrefix) && mediaType != forwardMediaType {
+		return respMediaType, []byte(ackReply), nil
+	}
+	if mediaType == forwardMediaType {
+		if orig, fwd, ok := parseForward(text); ok {
+			text = forwardedLine(orig, fwd)
+		}
+	}
+	if auto, ok := p.autoReply(from.Nickname, text); ok && !p.untrusted(from.Nickname) {
+		p.console.AddHistory(fmt.Sprintf("[autoreply to %s] %s", from.Nickname, auto))
+		return respMediaType, []byte(auto), nil
+	}
+	if mediaType == interactiveReqMediaType {
+		return "", nil, ErrHold
+	}
+	return respMediaType, []byte(ackReply), nil
+}
+
+// errNotAccepted answers the method calls of peers whose messages are
+// still requests (see requests.go).
+var errNotAccepted = errors.New("not accepted yet: your messages are message requests")
+
+// handleRequest passes an opened request to the Handler. The requests of
+// an untrusted peer (see requests.go) get defaultHandler's answer
+// instead: a Handler set with setHandler does not see them.
+func (p *connPool) handleRequest(hello Hello, remote peer.ID, req Request, plain []byte) (cachedResponse, error) {
+	h := p.requestHandler()
+	if p.untrusted(hello.SenderID) {
+		h = HandlerFunc(p.defaultHandler)
+	}
+	return p.handleRequestWith(h, hello, remote, req, plain)
+}
+
+// handleRouted passes an opened request to the method h routed by its
+// media type, unless its peer is untrusted.
+func (p *connPool) handleRouted(h Handler, hello Hello, remote peer.ID, req Request, plain []byte) (cachedResponse, error) {
+	if p.untrusted(hello.SenderID) {
+		return cachedResponse{}, errNotAccepted
+	}
+	return p.handleRequestWith(h, hello, remote, req, plain)
+}
+
+// handleRequestWith passes an opened request, received on a session with
+// remote, to h. The Handler's from is the peer the session authenticated:
+// its Hello is signed with the key of remote (see checkHelloPeer), and the
+// peer table's entry for its nickname is used only when it holds remote.
+func (p *connPool) handleRequestWith(h Handler, hello Hello, remote peer.ID, req Request, plain []byte) (cachedResponse, error) {
+	from, ok := p.peerTable.Get(hello.SenderID)
+	if !ok || from.PeerID != remote {
+		from = PeerInfo{Nickname: hello.SenderID, PeerID: remote, HPKEPub: hello.SenderHPKEPub, KeyID: hello.SenderKeyID}
+	}
+	ctx := context.Background()
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+		defer cancel()
+	}
+	mediaType, resp, err := h.Handle(ctx, from, string(req.MediaType), plain)
+	if err != nil {
+		return cachedResponse{}, err
+	}
+	if mediaType == "" {
+		mediaType = respMediaType
+	}
+	return cachedResponse{mediaType: mediaType, text: string(resp)}, nil
+}
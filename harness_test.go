@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/pivaldi/tmd/internal/hwkey"
+	"github.com/pivaldi/tmd/internal/identity"
+	"github.com/pivaldi/tmd/internal/node"
+	"github.com/pivaldi/tmd/internal/p2p"
+)
+
+// simNetwork is an in-process deployment: discovery nodes and peers running
+// on real libp2p hosts bound to loopback, each peer driven through a
+// headlessConsole exactly like a user would drive the TUI.
+type simNetwork struct {
+	t      *testing.T
+	tokens map[string]string // nickname -> token, shared by all nodes
+	nodes  map[string]*simNode
+	peers  map[string]*simPeer
+	setups map[string][]peerSetup // run before each start of a peer
+	idents map[string]simIdentity // kept across restarts
+}
+
+// simIdentity is what a restarted peer keeps: its keys and listen port.
+type simIdentity struct {
+	seed   []byte
+	port   int
+	signer *hwkey.Signer // hardware-held signing key (--signer), or nil
+}
+
+// peerSetup configures the pool of a peer before its stream handler and
+// node client start, as its flags would.
+type peerSetup func(n *simNetwork, p *connPool) error
+
+type simNode struct {
+	host host.Host
+	srv  *node.Server
+	addr string // full /p2p/ multiaddr for clients
+}
+
+type simPeer struct {
+	nickname string
+	host     host.Host
+	pool     *connPool
+	console  *headlessConsole
+	client   *node.Client
+	done     chan struct{}
+}
+
+func newSimNetwork(t *testing.T) *simNetwork {
+	n := &simNetwork{
+		t:      t,
+		tokens: make(map[string]string),
+		nodes:  make(map[string]*simNode),
+		peers:  make(map[string]*simPeer),
+		setups: make(map[string][]peerSetup),
+		idents: make(map[string]simIdentity),
+	}
+	t.Cleanup(n.shutdown)
+	return n
+}
+
+// newSimHost creates a host for id, or for a new identity on a free port
+// if id is zero.
+func newSimHost(t *testing.T, id simIdentity) (host.Host, *identity.DerivedKeys, simIdentity) {
+	t.Helper()
+	seed := id.seed
+	if seed == nil {
+		var err error
+		if seed, err = identity.GenerateSeed(); err != nil {
+			t.Fatalf("generate seed: %v", err)
+		}
+	}
+	keys, err := identity.DeriveKeys(seed)
+	if err != nil {
+		t.Fatalf("derive keys: %v", err)
+	}
+	if id.signer != nil {
+		if keys.Libp2pPriv, err = p2p.SignerKey(id.signer); err != nil {
+			t.Fatalf("signer key: %v", err)
+		}
+		keys.Ed25519Pub = id.signer.Public().(ed25519.PublicKey)
+	}
+	h, err := p2p.NewHost(keys.Libp2pPriv, id.port)
+	if err != nil {
+		t.Fatalf("create host: %v", err)
+	}
+	keys.PeerID = h.ID()
+	port, _ := strconv.Atoi(strings.Split(loopbackAddr(h), "/")[4])
+	return h, keys, simIdentity{seed: seed, port: port, signer: id.signer}
+}
+
+// loopbackAddr returns the host's 127.0.0.1 address in /p2p/ form.
+func loopbackAddr(h host.Host) string {
+	for _, a := range h.Addrs() {
+		if strings.HasPrefix(a.String(), "/ip4/127.0.0.1/") {
+			return fmt.Sprintf("%s/p2p/%s", a, h.ID())
+		}
+	}
+	return fmt.Sprintf("%s/p2p/%s", h.Addrs()[0], h.ID())
+}
+
+func (n *simNetwork) startNode(name string) {
+	h, _, _ := newSimHost(n.t, simIdentity{})
+	srv := node.NewServer(h, &node.Config{Peers: n.tokens})
+	n.nodes[name] = &simNode{host: h, srv: srv, addr: loopbackAddr(h)}
+}
+
+func (n *simNetwork) startPeer(nickname string, nodeNames []string) {
+	t := n.t
+	// A restarted peer keeps its identity.
+	h, keys, id := newSimHost(t, n.idents[nickname])
+	n.idents[nickname] = id
+
+	suite := hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	kemScheme := hpke.KEM_X25519_HKDF_SHA256.Scheme()
+	peerTable := NewPeerTable()
+	var signer crypto.Signer = keys.Ed25519Priv
+	if id.signer != nil {
+		signer = id.signer
+	}
+	pool := newConnPool(h, peerTable, suite, kemScheme, PeerID(nickname), keys.KeyID, signer, keys.HPKEPubBytes)
+
+	c := newHeadlessConsole()
+	pool.setConsole(c)
+	for _, setup := range n.setups[nickname] {
+		if err := setup(n, pool); err != nil {
+			t.Fatalf("%s: setup: %v", nickname, err)
+		}
+	}
+	if err := pool.setProfile(Profile{DisplayName: strings.ToUpper(nickname[:1]) + nickname[1:], Note: "simulated peer"}); err != nil {
+		t.Fatalf("%s: profile: %v", nickname, err)
+	}
+	if err := pool.signOwnKey(); err != nil {
+		t.Fatalf("%s: %v", nickname, err)
+	}
+	if err := pool.setTransferDir(t.TempDir()); err != nil {
+		t.Fatalf("%s: transfer dir: %v", nickname, err)
+	}
+	if err := pool.SetupStreamHandler(keys.HPKEPriv); err != nil {
+		t.Fatalf("%s: setup handler: %v", nickname, err)
+	}
+
+	p := &simPeer{nickname: nickname, host: h, pool: pool, console: c, done: make(chan struct{})}
+
+	if len(nodeNames) > 0 {
+		addrs := make([]string, 0, len(nodeNames))
+		for _, name := range nodeNames {
+			sn, ok := n.nodes[name]
+			if !ok {
+				t.Fatalf("%s: unknown node %q", nickname, name)
+			}
+			addrs = append(addrs, sn.addr)
+		}
+		handler := &peerHandler{
+			peerTable: peerTable,
+			console:   c,
+			pool:      pool,
+		}
+		nick, _ := node.SplitDevice(nickname)
+		client := node.NewClient(h, nickname, n.tokens[nick], keys.HPKEPubBytes, keys.KeyID, handler)
+		pool.setPresenceApplier(func(f node.PresenceFilter) { handler.applyPresenceFilter(client, f) })
+		pool.setRoomDirectory(client)
+		pool.setMailbox(client)
+		pool.setPresenceAdvertiser(client)
+		pool.setRevocationPublisher(client)
+		if err := client.SetProfile(pool.ownProfile()); err != nil {
+			t.Fatalf("%s: profile: %v", nickname, err)
+		}
+		if err := client.SetKeySig(pool.keySig); err != nil {
+			t.Fatalf("%s: key signature: %v", nickname, err)
+		}
+		p.client = client
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := p.client.ConnectAll(ctx, addrs); err != nil {
+			t.Fatalf("%s: connect nodes: %v", nickname, err)
+		}
+	}
+
+	self := PeerInfo{Nickname: PeerID(nickname), PeerID: keys.PeerID, Addrs: h.Addrs(), HPKEPub: keys.HPKEPubBytes, KeyID: keys.KeyID}
+	go func() {
+		REPL(c, self, pool)
+		close(p.done)
+	}()
+
+	n.peers[nickname] = p
+}
+
+func (n *simNetwork) peer(nickname string) *simPeer {
+	p, ok := n.peers[nickname]
+	if !ok {
+		n.t.Fatalf("unknown peer %q", nickname)
+	}
+	return p
+}
+
+// stopPeer shuts a peer down the way main does on /quit.
+func (n *simNetwork) stopPeer(nickname string) {
+	p := n.peer(nickname)
+	p.console.Close()
+	<-p.done
+	p.pool.AnnounceDisconnexion()
+	if p.client != nil {
+		p.client.Close()
+	}
+	_ = p.host.Close()
+	delete(n.peers, nickname)
+}
+
+func (n *simNetwork) shutdown() {
+	for nickname := range n.peers {
+		n.stopPeer(nickname)
+	}
+	for _, sn := range n.nodes {
+		_ = sn.host.Close()
+	}
+}
@@ -3,24 +3,34 @@ package main
 import (
 	"bytes"
 	"crypto/ed25519"
+	"encoding/binary"
 	"fmt"
 
 	"github.com/cloudflare/circl/kem"
+	libp2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 // Signed HELLO verification
 type Hello struct {
 	SenderID      PeerID
-	SenderKeyID   []byte // 8-byte key fingerprint
+	SenderKeyID   []byte // 8-byte key fingerprint, 1 byte from peers predating them
 	SenderEdPub   []byte // 32 bytes
 	SenderHPKEPub []byte // 32 bytes for X25519 KEM public key
 	Signature     []byte // 64 bytes
+	MaxFrame      uint32 // largest accepted frame; 0 if not advertised
+	Profile       []byte // signed on its own (see profile.go); may be empty
+	RatchetPub    []byte // the dialer's key for the stream's ratchet (see ratchets.go); may be empty
+	Suites        []byte // the dialer's HPKE suites, encoded (see suites.go); may be empty
+	KeySig        []byte // SenderHPKEPub signed on its own (see keysig.go); may be empty
+	Request       []byte // the dialer's first request, encoded (see early.go); may be empty
+	Features      uint32 // the listener's features the dialer takes up (see features.go)
 }
 
 // verifySignedHello verifies the signature on a Hello message.
 // In the new architecture, keys are received from the discovery node.
-// This function verifies the signature matches the Ed25519 public key in the Hello.
-// If peerTable is provided, it also verifies against known peer info.
+// This function verifies the signature matches the Ed25519 public key in the Hello;
+// checkHelloPeer then checks that key against the peer.
 func verifySignedHello(kemScheme kem.Scheme, challenge []byte, h Hello) error {
 	// Basic validation
 	if len(h.SenderEdPub) != ed25519.PublicKeySize {
@@ -38,33 +48,43 @@ func verifySignedHello(kemScheme kem.Scheme, challenge []byte, h Hello) error {
 	return nil
 }
 
-// verifySignedHelloWithTable verifies the signature and cross-checks with the peer table.
-func verifySignedHelloWithTable(kemScheme kem.Scheme, challenge []byte, h Hello, peerTable *PeerTable) error {
-	// First do basic signature verification
-	if err := verifySignedHello(kemScheme, challenge, h); err != nil {
-		return err
+// checkHelloPeer checks that a verified Hello comes from the peer it
+// names: its Ed25519 key must be the one of remote, the peer ID on the
+// other end of the stream, and a peer the table knows must connect with
+// the peer ID and keys it was announced with. A Hello whose HPKE key is
+// signed (see keysig.go) may bring a new one: the peer rotated it.
+func checkHelloPeer(h Hello, remote peer.ID, peerTable *PeerTable) error {
+	pub, err := libp2pcrypto.UnmarshalEd25519PublicKey(h.SenderEdPub)
+	if err != nil {
+		return fmt.Errorf("bad Ed25519 key for %s: %w", h.SenderID, err)
 	}
-
-	// If we have a peer table, verify against known peer info
-	if peerTable != nil {
-		peer, ok := peerTable.Get(h.SenderID)
-		if ok {
-			// Verify key ID matches
-			if !bytes.Equal(h.SenderKeyID, peer.KeyID) {
-				return fmt.Errorf("keyID mismatch for %s: got %x want %x", h.SenderID, h.SenderKeyID, peer.KeyID)
-			}
-			// Verify HPKE public key matches
-			if !bytes.Equal(h.SenderHPKEPub, peer.HPKEPub) {
-				return fmt.Errorf("HPKE pubkey mismatch for %s", h.SenderID)
-			}
-		}
+	if !remote.MatchesPublicKey(pub) {
+		return fmt.Errorf("%s signed its Hello with a key other than the one of its peer ID %s", h.SenderID, remote.ShortString())
+	}
+	known, ok := peerTable.Get(h.SenderID)
+	if !ok || known.PeerID == "" {
+		return nil
+	}
+	if known.PeerID != remote {
+		return fmt.Errorf("%s connected from %s, but is known as %s", h.SenderID, remote.ShortString(), known.PeerID.ShortString())
+	}
+	if len(h.KeySig) > 0 {
+		return nil
+	}
+	if !known.KeyID.Matches(h.SenderKeyID) {
+		return fmt.Errorf("keyID mismatch for %s: got %x want %x", h.SenderID, h.SenderKeyID, known.KeyID)
+	}
+	if !bytes.Equal(h.SenderHPKEPub, known.HPKEPub) {
+		return fmt.Errorf("HPKE pubkey mismatch for %s", h.SenderID)
 	}
-
 	return nil
 }
 
+// helloSignInput returns the bytes a Hello's signature covers. When the
+// Hello lists suites, challenge is the whole CHALLENGE payload, so the
+// suites the listener offered are signed as well.
 func helloSignInput(challenge []byte, h Hello) []byte {
-	// signed bytes = challenge || senderID || 0 || keyID (8 bytes) || edPub || hpkePub
+	// signed bytes = challenge || senderID || 0 || keyID (8 bytes) || edPub || hpkePub [|| u32(maxFrame)] [|| suites] [|| u32(features)]
 	var b bytes.Buffer
 	b.Write(challenge)
 	b.Write([]byte(h.SenderID))
@@ -72,5 +92,14 @@ func helloSignInput(challenge []byte, h Hello) []byte {
 	b.Write(h.SenderKeyID) // 8-byte key fingerprint
 	b.Write(h.SenderEdPub)
 	b.Write(h.SenderHPKEPub)
+	if h.MaxFrame != 0 {
+		_ = binary.Write(&b, binary.BigEndian, h.MaxFrame)
+	}
+	if len(h.Suites) > 0 {
+		b.Write(h.Suites)
+	}
+	if h.Features != 0 {
+		_ = binary.Write(&b, binary.BigEndian, h.Features)
+	}
 	return b.Bytes()
 }
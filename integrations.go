@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tmdv1 "github.com/pivaldi/tmd/api/tmd/v1"
+	"github.com/pivaldi/tmd/internal/gateway"
+	"github.com/pivaldi/tmd/internal/grpcapi"
+	"github.com/pivaldi/tmd/internal/irc"
+	"github.com/pivaldi/tmd/internal/mailnotify"
+	"github.com/pivaldi/tmd/internal/matrix"
+	"github.com/pivaldi/tmd/internal/xmpp"
+)
+
+// poolSender adapts connPool to the Sender interfaces of the gateway and
+// bridge packages: it resolves the nickname in
+// the peer table, delivers over the peer protocol and logs the exchange to
+// the console so gateway traffic is visible like typed messages.
+type poolSender struct {
+	pool    *connPool
+	console Console
+	via     string // label shown in history, e.g. "gateway"
+}
+
+func (s poolSender) Send(to, message string) (string, error) {
+	peer, ok := s.pool.peerTable.Get(PeerID(to))
+	if !ok {
+		return "", fmt.Errorf("%w: %s", gateway.ErrUnknownPeer, to)
+	}
+	if peer.Nickname == s.pool.nickname {
+		return "", fmt.Errorf("can't send to self")
+	}
+
+	reply, err := s.pool.SendRequest(peer, message)
+	if err != nil {
+		s.console.Errorf("[%s] send to %s failed: %v", s.via, to, err)
+		return "", err
+	}
+
+	s.console.Printf("[%s: %s to %s] %s", s.via, s.pool.nickname, to, message)
+	return reply, nil
+}
+
+func (s poolSender) Broadcast(message string) error {
+	if err := broadcastErr(s.pool.Broadcast(message)); err != nil {
+		s.console.Errorf("[%s] broadcast failed: %v", s.via, err)
+		return err
+	}
+	s.console.Printf("[%s: broadcast] %s", s.via, message)
+	return nil
+}
+
+func (s poolSender) Peers() []string {
+	var nicks []string
+	for _, p := range s.pool.peerTable.All() {
+		if p.Nickname != s.pool.nickname {
+			nicks = append(nicks, string(p.Nickname))
+		}
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// startIRCServer serves the local IRC interface and relays every received
+// tmd message to connected IRC clients.
+func startIRCServer(addr string, pool *connPool, c Console) (func(), error) {
+	srv, err := irc.Listen(addr, string(pool.nickname), os.Getenv("TMD_IRC_PASSWORD"), poolSender{pool: pool, console: c, via: "irc"}, c.Printf)
+	if err != nil {
+		return nil, err
+	}
+	pool.onReceive(func(m receivedMessage) {
+		srv.Relay(m.Kind, string(m.From), m.Text)
+	})
+	c.AddHistory(fmt.Sprintf("[irc] accepting IRC clients on %s (channel %s)", srv.Addr(), irc.Channel))
+	return func() { _ = srv.Close() }, nil
+}
+
+// startGRPCAPI serves the tmd.v1 gRPC API and feeds it received messages,
+// delivery receipts and presence changes.
+func startGRPCAPI(addr string, pool *connPool, c Console) (func(), error) {
+	events := grpcapi.NewEvents(grpcapi.DefaultRetention)
+	srv, err := grpcapi.Listen(addr, os.Getenv("TMD_GRPC_TOKEN"), events)
+	if err != nil {
+		return nil, err
+	}
+	pool.onReceive(func(m receivedMessage) {
+		events.PublishMessage(m.Kind == "broadcast", string(m.From), m.Text)
+	})
+	pool.onDelivered(func(m deliveredMessage) {
+		events.PublishReceipt(string(m.To), "", tmdv1.Receipt_STATUS_DELIVERED)
+	})
+	pool.onPresence(func(ev presenceEvent) {
+		events.PublishPresence(string(ev.Nickname), ev.Online)
+	})
+	c.AddHistory(fmt.Sprintf("[grpc] serving tmd.v1.Events on %s", srv.Addr()))
+	return srv.Close, nil
+}
+
+// startMatrixBridge serves the application-service API and relays every
+// received tmd message into the bridged room. The returned func stops it.
+func startMatrixBridge(configPath string, pool *connPool, c Console) (func(), error) {
+	cfg, err := matrix.LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	bridge := matrix.New(*cfg, poolSender{pool: pool, console: c, via: "matrix"}, c.Printf)
+	srv := &http.Server{Addr: cfg.Listen, Handler: bridge.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			c.Errorf("[matrix] appservice listener: %v", err)
+		}
+	}()
+
+	pool.onReceive(func(m receivedMessage) {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			text := m.Text
+			if m.Kind == "broadcast" {
+				text = "[broadcast] " + text
+			}
+			if err := bridge.Relay(ctx, string(m.From), text); err != nil {
+				c.Errorf("[matrix] relay from %s failed: %v", m.From, err)
+			}
+		}()
+	})
+
+	c.AddHistory(fmt.Sprintf("[matrix] bridging %s via %s (appservice on %s)", cfg.Room, cfg.Homeserver, cfg.Listen))
+	return func() { _ = srv.Close() }, nil
+}
+
+// startXMPPGateway connects the XMPP component, relays received tmd
+// messages to the configured XMPP users and reconnects with backoff when
+// the server drops the stream. The returned func stops it.
+func startXMPPGateway(configPath string, pool *connPool, c Console) (func(), error) {
+	cfg, err := xmpp.LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var (
+		mu   sync.Mutex
+		comp *xmpp.Component
+	)
+
+	go func() {
+		backoff := time.Second
+		for ctx.Err() == nil {
+			dialCtx, dialCancel := context.WithTimeout(ctx, 10*time.Second)
+			cc, err := xmpp.Dial(dialCtx, *cfg, poolSender{pool: pool, console: c, via: "xmpp"}, c.Printf)
+			dialCancel()
+			if err != nil {
+				c.Errorf("[xmpp] %v (retrying in %s)", err, backoff)
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
+				}
+				backoff = min(backoff*2, time.Minute)
+				continue
+			}
+
+			backoff = time.Second
+			mu.Lock()
+			comp = cc
+			mu.Unlock()
+			c.AddHistory(fmt.Sprintf("[xmpp] component %s connected to %s", cfg.Domain, cfg.Server))
+
+			if err := cc.Serve(); err != nil && ctx.Err() == nil {
+				c.Errorf("[xmpp] stream error: %v", err)
+			}
+			mu.Lock()
+			comp = nil
+			mu.Unlock()
+		}
+	}()
+
+	pool.onReceive(func(m receivedMessage) {
+		mu.Lock()
+		cc := comp
+		mu.Unlock()
+		if cc == nil {
+			return
+		}
+		text := m.Text
+		if m.Kind == "broadcast" {
+			text = "[broadcast] " + text
+		}
+		if err := cc.Relay(string(m.From), text); err != nil {
+			c.Errorf("[xmpp] relay from %s failed: %v", m.From, err)
+		}
+	})
+
+	return func() {
+		cancel()
+		mu.Lock()
+		defer mu.Unlock()
+		if comp != nil {
+			_ = comp.Close()
+		}
+	}, nil
+}
+
+// startEmailNotifier mails a summary of direct messages received while the
+// user is idle. It returns a Console that records input activity; the REPL
+// must read through it for idle detection to work.
+func startEmailNotifier(configPath, nickname string, pool *connPool, c Console) (Console, func(), error) {
+	cfg, err := mailnotify.LoadConfig(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	n := mailnotify.New(*cfg, nickname, func(err error) {
+		c.Errorf("[email] notification failed: %v", err)
+	})
+	pool.onReceive(func(m receivedMessage) {
+		if m.Kind == "direct" {
+			n.DirectMessage(string(m.From), m.Text)
+		}
+	})
+	c.AddHistory(fmt.Sprintf("[email] notifying %s after %s idle", strings.Join(cfg.To, ", "), time.Duration(cfg.IdleAfter)))
+	return activityConsole{Console: c, touch: n.Touch}, n.Flush, nil
+}
+
+// activityConsole calls touch whenever the user enters a line.
+type activityConsole struct {
+	Console
+	touch func()
+}
+
+func (a activityConsole) ReadLine() (string, bool) {
+	line, ok := a.Console.ReadLine()
+	if ok {
+		a.touch()
+	}
+	return line, ok
+}
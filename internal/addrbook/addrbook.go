@@ -0,0 +1,207 @@
+// Package addrbook keeps the peers a client has seen, with their keys,
+// their last addresses, the user's notes and how far their keys are
+// trusted, so that they can be reached again after a restart without a
+// discovery node. The file is one JSON list sealed with
+// XChaCha20-Poly1305 under a key derived from the peer's seed, so it is
+// useless without the seed; only its size is visible.
+package addrbook
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const context = "tmd address book v1"
+
+// ErrWrongKey means the file was written with another seed, or altered.
+var ErrWrongKey = errors.New("addrbook: file was written with another seed, or altered")
+
+// Entry is one peer of the book.
+type Entry struct {
+	Nickname string    `json:"nick"`
+	PeerID   string    `json:"peer_id"`
+	HPKEPub  []byte    `json:"hpke_pub"`
+	KeyID    []byte    `json:"key_id"`
+	Addrs    []string  `json:"addrs,omitempty"`
+	Note     string    `json:"note,omitempty"`
+	Trust    string    `json:"trust,omitempty"` // e.g. verified or tofu, as last seen with --pins
+	Seen     time.Time `json:"seen,omitzero"`   // when a node last announced the peer
+	Suite    string    `json:"suite,omitempty"` // HPKE suite required with the peer, by name
+}
+
+// Book is an open address book file; it is safe for concurrent use.
+type Book struct {
+	path string
+	aead cipher.AEAD
+
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+// Open loads the book at path, sealed with a key derived from seed; a
+// missing file yields an empty book. It fails with ErrWrongKey if the
+// file was written with another seed.
+func Open(path string, seed []byte) (*Book, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, seed, nil, []byte(context)), key); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	b := &Book{path: path, aead: aead, entries: make(map[string]Entry)}
+	sealed, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read address book: %w", err)
+	}
+	n := aead.NonceSize()
+	if len(sealed) < n {
+		return nil, ErrWrongKey
+	}
+	data, err := aead.Open(nil, sealed[:n], sealed[n:], []byte(context))
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	var list []Entry
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse address book: %w", err)
+	}
+	for _, e := range list {
+		b.entries[e.Nickname] = e
+	}
+	return b, nil
+}
+
+// Get returns the entry for nickname.
+func (b *Book) Get(nickname string) (Entry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[nickname]
+	return e, ok
+}
+
+// Entries returns all entries sorted by nickname.
+func (b *Book) Entries() []Entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.listLocked()
+}
+
+// Put stores what is known of a peer now, replacing its keys, addresses
+// and time seen. The note and suite are kept, and so is the trust when e
+// has none. The file is only written when the entry changed.
+func (b *Book) Put(e Entry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old, ok := b.entries[e.Nickname]
+	if ok {
+		e.Note, e.Suite = old.Note, old.Suite
+		if e.Trust == "" {
+			e.Trust = old.Trust
+		}
+		if same(old, e) {
+			return nil
+		}
+	}
+	b.entries[e.Nickname] = e
+	return b.saveLocked()
+}
+
+// SetNote replaces the note on a peer's entry; empty removes it.
+func (b *Book) SetNote(nickname, note string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[nickname]
+	if !ok {
+		return fmt.Errorf("%s is not in the address book", nickname)
+	}
+	e.Note = note
+	b.entries[nickname] = e
+	return b.saveLocked()
+}
+
+// SetSuite sets the HPKE suite required with a peer; empty removes it.
+func (b *Book) SetSuite(nickname, suite string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[nickname]
+	if !ok {
+		return fmt.Errorf("%s is not in the address book", nickname)
+	}
+	e.Suite = suite
+	b.entries[nickname] = e
+	return b.saveLocked()
+}
+
+// SetTrust records the trust in a peer's keys. Peers not in the book are
+// ignored.
+func (b *Book) SetTrust(nickname, trust string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[nickname]
+	if !ok || e.Trust == trust {
+		return nil
+	}
+	e.Trust = trust
+	b.entries[nickname] = e
+	return b.saveLocked()
+}
+
+// Remove forgets a peer. It reports whether it was in the book.
+func (b *Book) Remove(nickname string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.entries[nickname]; !ok {
+		return false, nil
+	}
+	delete(b.entries, nickname)
+	return true, b.saveLocked()
+}
+
+func (b *Book) listLocked() []Entry {
+	list := make([]Entry, 0, len(b.entries))
+	for _, e := range b.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Nickname < list[j].Nickname })
+	return list
+}
+
+func (b *Book) saveLocked() error {
+	data, err := json.Marshal(b.listLocked())
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // crypto/rand does not fail
+	}
+	if err := os.WriteFile(b.path, b.aead.Seal(nonce, nonce, data, []byte(context)), 0600); err != nil {
+		return fmt.Errorf("write address book: %w", err)
+	}
+	return nil
+}
+
+// same reports whether two entries hold the same.
+func same(a, b Entry) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
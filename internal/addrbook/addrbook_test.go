@@ -0,0 +1,86 @@
+package addrbook
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBookRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "book")
+	seed := bytes.Repeat([]byte{1}, 32)
+	seen := time.Now().UTC().Truncate(time.Second)
+
+	b, err := Open(path, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := Entry{Nickname: "bob", PeerID: "12D3KooWbob", HPKEPub: []byte("hpke"), KeyID: []byte("keyid"), Addrs: []string{"/ip4/192.0.2.1/tcp/4001"}, Trust: "tofu", Seen: seen}
+	if err := b.Put(bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(Entry{Nickname: "carol", PeerID: "12D3KooWcarol"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetNote("bob", "met at the conference"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetNote("dave", "x"); err == nil {
+		t.Fatal("SetNote accepted a peer not in the book")
+	}
+	if err := b.SetSuite("bob", "x25519-sha512-aes256gcm"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later announcement keeps the note and suite, and the trust when it
+	// has none.
+	moved := bob
+	moved.Addrs, moved.Trust = []string{"/ip4/198.51.100.7/tcp/4001"}, ""
+	if err := b.Put(moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetTrust("bob", "verified"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := b.Remove("carol"); err != nil || !ok {
+		t.Fatalf("Remove(carol) = %v, %v", ok, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("conference")) || bytes.Contains(data, []byte("bob")) {
+		t.Fatal("address book is not encrypted")
+	}
+
+	b, err = Open(path, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := b.Entries()
+	if len(list) != 1 {
+		t.Fatalf("entries = %+v, want bob only", list)
+	}
+	got := list[0]
+	if got.Note != "met at the conference" || got.Suite != "x25519-sha512-aes256gcm" || got.Trust != "verified" || len(got.Addrs) != 1 || got.Addrs[0] != moved.Addrs[0] || !got.Seen.Equal(seen) || !bytes.Equal(got.HPKEPub, bob.HPKEPub) {
+		t.Fatalf("bob = %+v", got)
+	}
+}
+
+func TestBookWrongSeed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "book")
+	b, err := Open(path, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(Entry{Nickname: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, bytes.Repeat([]byte{2}, 32)); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("open with another seed: %v, want ErrWrongKey", err)
+	}
+}
@@ -0,0 +1,139 @@
+// Package attest binds a peer's tmd identity to an OpenPGP or SSH Ed25519
+// key the peer already has, so trust can be bootstrapped from keys an
+// organization already distributes.
+//
+// The binding is cross-signed:
+//
+//  1. the peer creates an attestation naming its tmd identity (nickname,
+//     libp2p peer ID, HPKE key) and the fingerprint of its external key,
+//     signed with the tmd Ed25519 key (tmd attest);
+//  2. the peer signs the attestation file with the external key, using
+//     ssh-keygen -Y sign -n tmd-attest or gpg --detach-sign --armor;
+//  3. whoever holds the external public key verifies both signatures and
+//     records the identity in a Store (tmd trust).
+package attest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Namespace is the SSHSIG namespace attestations must be signed under.
+const Namespace = "tmd-attest"
+
+const header = "tmd-attestation-v1"
+
+// ExternalKey is an imported OpenPGP or SSH public key.
+type ExternalKey interface {
+	// Fingerprint identifies the key, e.g. "ssh SHA256:..." or
+	// "openpgp 0123...".
+	Fingerprint() string
+	// VerifyDetached checks a detached signature over message.
+	VerifyDetached(message, signature []byte) error
+}
+
+// Statement is a tmd identity claimed by an attestation.
+type Statement struct {
+	Nickname string
+	PeerID   peer.ID
+	HPKEPub  []byte
+	KeyID    []byte
+	External string // fingerprint of the external key
+}
+
+func (s *Statement) body() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s\n", header)
+	fmt.Fprintf(&b, "nick: %s\n", s.Nickname)
+	fmt.Fprintf(&b, "peerid: %s\n", s.PeerID)
+	fmt.Fprintf(&b, "hpke: %x\n", s.HPKEPub)
+	fmt.Fprintf(&b, "keyid: %x\n", s.KeyID)
+	fmt.Fprintf(&b, "external: %s\n", s.External)
+	return b.Bytes()
+}
+
+// Create builds the attestation file for s, signed with the tmd identity
+// key edPriv.
+func Create(s Statement, edPriv ed25519.PrivateKey) []byte {
+	body := s.body()
+	sig := ed25519.Sign(edPriv, body)
+	return append(body, fmt.Sprintf("tmd-signature: %x\n", sig)...)
+}
+
+// Verify checks an attestation against the external key that signed it:
+// the detached external signature over the whole file, the tmd signature
+// over the body (against the key embedded in the peer ID), and that the
+// attestation names ext as the external key.
+func Verify(attestation, signature []byte, ext ExternalKey) (*Statement, error) {
+	if err := ext.VerifyDetached(attestation, signature); err != nil {
+		return nil, fmt.Errorf("external signature: %w", err)
+	}
+
+	s, tmdSig, err := parse(attestation)
+	if err != nil {
+		return nil, err
+	}
+	if s.External != ext.Fingerprint() {
+		return nil, fmt.Errorf("attestation names key %q, signed by %q", s.External, ext.Fingerprint())
+	}
+
+	pub, err := s.PeerID.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("peer ID: %w", err)
+	}
+	raw, err := pub.Raw()
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("peer ID does not embed an Ed25519 key")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(raw), s.body(), tmdSig) {
+		return nil, errors.New("tmd signature does not verify")
+	}
+	return s, nil
+}
+
+func parse(data []byte) (*Statement, []byte, error) {
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) != 7 || lines[0] != header {
+		return nil, nil, errors.New("not a tmd attestation")
+	}
+
+	fields := make(map[string]string, 6)
+	for _, l := range lines[1:] {
+		k, v, ok := strings.Cut(l, ": ")
+		if !ok {
+			return nil, nil, fmt.Errorf("malformed attestation line %q", l)
+		}
+		fields[k] = v
+	}
+
+	var (
+		s   Statement
+		err error
+	)
+	s.Nickname = fields["nick"]
+	s.External = fields["external"]
+	if s.PeerID, err = peer.Decode(fields["peerid"]); err != nil {
+		return nil, nil, fmt.Errorf("attestation peerid: %w", err)
+	}
+	if s.HPKEPub, err = hex.DecodeString(fields["hpke"]); err != nil {
+		return nil, nil, fmt.Errorf("attestation hpke: %w", err)
+	}
+	if s.KeyID, err = hex.DecodeString(fields["keyid"]); err != nil {
+		return nil, nil, fmt.Errorf("attestation keyid: %w", err)
+	}
+	sig, err := hex.DecodeString(fields["tmd-signature"])
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, nil, errors.New("attestation tmd-signature malformed")
+	}
+	// Re-serializing must reproduce the signed bytes exactly.
+	if !bytes.Equal(s.body(), []byte(strings.Join(lines[:6], "\n")+"\n")) {
+		return nil, nil, errors.New("attestation is not in canonical form")
+	}
+	return &s, sig, nil
+}
@@ -0,0 +1,194 @@
+package attest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/pivaldi/tmd/internal/identity"
+	"golang.org/x/crypto/ssh"
+)
+
+func testIdentity(t *testing.T) *identity.DerivedKeys {
+	t.Helper()
+	seed := bytes.Repeat([]byte{0x42}, identity.SeedSize)
+	keys, err := identity.DeriveKeys(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func statementFor(keys *identity.DerivedKeys, ext ExternalKey) Statement {
+	return Statement{
+		Nickname: "bob",
+		PeerID:   keys.PeerID,
+		HPKEPub:  keys.HPKEPubBytes,
+		KeyID:    keys.KeyID,
+		External: ext.Fingerprint(),
+	}
+}
+
+// sshSign produces what ssh-keygen -Y sign -n <namespace> would.
+func sshSign(t *testing.T, signer ssh.Signer, namespace string, message []byte) []byte {
+	t.Helper()
+	h := sha512.Sum512(message)
+	signed := append([]byte(sshsigMagic), ssh.Marshal(sshsigSigned{
+		Namespace: namespace, HashAlgorithm: "sha512", Hash: h[:],
+	})...)
+	sig, err := signer.Sign(rand.Reader, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := append([]byte(sshsigMagic), ssh.Marshal(sshsig{
+		Version:       1,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     namespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(sig),
+	})...)
+	return pem.EncodeToMemory(&pem.Block{Type: "SSH SIGNATURE", Bytes: blob})
+}
+
+func newSSHKey(t *testing.T) (ssh.Signer, ExternalKey) {
+	t.Helper()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ext, err := ParseSSHKey(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, ext
+}
+
+func TestSSHAttestation(t *testing.T) {
+	keys := testIdentity(t)
+	signer, ext := newSSHKey(t)
+
+	att := Create(statementFor(keys, ext), keys.Ed25519Priv)
+	sig := sshSign(t, signer, Namespace, att)
+
+	st, err := Verify(att, sig, ext)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if st.Nickname != "bob" || st.PeerID != keys.PeerID || !bytes.Equal(st.HPKEPub, keys.HPKEPubBytes) {
+		t.Fatalf("statement = %+v", st)
+	}
+
+	if _, err := Verify(att, sshSign(t, signer, "git", att), ext); err == nil {
+		t.Fatal("signature under another namespace accepted")
+	}
+
+	other, otherExt := newSSHKey(t)
+	if _, err := Verify(att, sshSign(t, other, Namespace, att), otherExt); err == nil {
+		t.Fatal("attestation naming another key accepted")
+	}
+
+	tampered := bytes.Replace(att, []byte("nick: bob"), []byte("nick: eve"), 1)
+	if _, err := Verify(tampered, sshSign(t, signer, Namespace, tampered), ext); err == nil {
+		t.Fatal("tampered attestation accepted")
+	}
+}
+
+func TestSSHKeygenInterop(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not installed")
+	}
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "id_ed25519")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", keyPath).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %v\n%s", err, out)
+	}
+	pub, _ := os.ReadFile(keyPath + ".pub")
+	ext, err := ParseSSHKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := testIdentity(t)
+	attPath := filepath.Join(dir, "bob.tmd-attest")
+	os.WriteFile(attPath, Create(statementFor(keys, ext), keys.Ed25519Priv), 0600)
+	if out, err := exec.Command("ssh-keygen", "-Y", "sign", "-n", Namespace, "-f", keyPath, attPath).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen -Y sign: %v\n%s", err, out)
+	}
+	att, _ := os.ReadFile(attPath)
+	sig, _ := os.ReadFile(attPath + ".sig")
+	if _, err := Verify(att, sig, ext); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+}
+
+func TestOpenPGPAttestation(t *testing.T) {
+	cfg := &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+	entity, err := openpgp.NewEntity("Bob", "", "bob@example.org", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pub bytes.Buffer
+	w, _ := armor.Encode(&pub, openpgp.PublicKeyType, nil)
+	entity.Serialize(w)
+	w.Close()
+
+	ext, err := ParsePGPKey(pub.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ext.Fingerprint(), "openpgp ") {
+		t.Fatalf("fingerprint = %q", ext.Fingerprint())
+	}
+
+	keys := testIdentity(t)
+	att := Create(statementFor(keys, ext), keys.Ed25519Priv)
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, entity, bytes.NewReader(att), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(att, sig.Bytes(), ext); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if _, err := Verify(append(att, '\n'), sig.Bytes(), ext); err == nil {
+		t.Fatal("signature over different bytes accepted")
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trusted.json")
+	s, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testIdentity(t)
+	_, ext := newSSHKey(t)
+	st := statementFor(keys, ext)
+	if err := s.Add(&st); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, e := s.Check("bob", keys.PeerID, keys.HPKEPubBytes); status != Verified || e.External != ext.Fingerprint() {
+		t.Fatalf("Check = %v %+v", status, e)
+	}
+	if status, _ := s.Check("bob", keys.PeerID, []byte("other")); status != Mismatch {
+		t.Fatalf("changed key: status %v", status)
+	}
+	if status, _ := s.Check("carol", keys.PeerID, keys.HPKEPubBytes); status != Unknown {
+		t.Fatalf("unknown nick: status %v", status)
+	}
+}
@@ -0,0 +1,133 @@
+package attest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+type sshKey struct {
+	pub ssh.PublicKey
+}
+
+// ParseSSHKey parses an Ed25519 public key in authorized_keys format, as
+// found in ~/.ssh/id_ed25519.pub.
+func ParseSSHKey(data []byte) (ExternalKey, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse ssh key: %w", err)
+	}
+	if pub.Type() != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("ssh key type %s not supported, need ssh-ed25519", pub.Type())
+	}
+	return sshKey{pub: pub}, nil
+}
+
+func (k sshKey) Fingerprint() string {
+	return "ssh " + ssh.FingerprintSHA256(k.pub)
+}
+
+// sshsig is the SSHSIG blob produced by ssh-keygen -Y sign (see
+// PROTOCOL.sshsig in OpenSSH), after the "SSHSIG" magic.
+type sshsig struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+type sshsigSigned struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+const sshsigMagic = "SSHSIG"
+
+func (k sshKey) VerifyDetached(message, signature []byte) error {
+	block, _ := pem.Decode(signature)
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return errors.New("not an armored SSH signature")
+	}
+	blob, ok := bytes.CutPrefix(block.Bytes, []byte(sshsigMagic))
+	if !ok {
+		return errors.New("missing SSHSIG magic")
+	}
+
+	var sig sshsig
+	if err := ssh.Unmarshal(blob, &sig); err != nil {
+		return fmt.Errorf("parse SSHSIG: %w", err)
+	}
+	if sig.Version != 1 {
+		return fmt.Errorf("unsupported SSHSIG version %d", sig.Version)
+	}
+	if sig.Namespace != Namespace {
+		return fmt.Errorf("signature namespace %q, want %q", sig.Namespace, Namespace)
+	}
+	if !bytes.Equal(sig.PublicKey, k.pub.Marshal()) {
+		return errors.New("signed by a different ssh key")
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha512":
+		h = sha512.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return fmt.Errorf("unsupported SSHSIG hash %q", sig.HashAlgorithm)
+	}
+	h.Write(message)
+
+	var inner ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &inner); err != nil {
+		return fmt.Errorf("parse SSHSIG signature: %w", err)
+	}
+	signed := append([]byte(sshsigMagic), ssh.Marshal(sshsigSigned{
+		Namespace:     sig.Namespace,
+		HashAlgorithm: sig.HashAlgorithm,
+		Hash:          h.Sum(nil),
+	})...)
+	return k.pub.Verify(signed, &inner)
+}
+
+type pgpKey struct {
+	ring openpgp.EntityList
+}
+
+// ParsePGPKey parses an armored OpenPGP public key holding exactly one
+// primary key.
+func ParsePGPKey(data []byte) (ExternalKey, error) {
+	ring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("parse openpgp key: %w", err)
+	}
+	if len(ring) != 1 {
+		return nil, fmt.Errorf("openpgp key file holds %d keys, want 1", len(ring))
+	}
+	return pgpKey{ring: ring}, nil
+}
+
+func (k pgpKey) Fingerprint() string {
+	return fmt.Sprintf("openpgp %X", k.ring[0].PrimaryKey.Fingerprint)
+}
+
+func (k pgpKey) VerifyDetached(message, signature []byte) error {
+	verify := openpgp.CheckDetachedSignature
+	if strings.HasPrefix(strings.TrimSpace(string(signature)), "-----BEGIN PGP SIGNATURE-----") {
+		verify = openpgp.CheckArmoredDetachedSignature
+	}
+	_, err := verify(k.ring, bytes.NewReader(message), bytes.NewReader(signature), nil)
+	return err
+}
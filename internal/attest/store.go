@@ -0,0 +1,113 @@
+package attest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Entry is a verified identity recorded in the Store.
+type Entry struct {
+	Nickname string    `json:"nick"`
+	PeerID   string    `json:"peer_id"`
+	HPKEPub  []byte    `json:"hpke_pub"`
+	External string    `json:"external"`
+	Imported time.Time `json:"imported"`
+}
+
+// Status is the result of checking a peer against the Store.
+type Status int
+
+const (
+	Unknown  Status = iota // nickname not in the store
+	Verified               // keys match a verified attestation
+	Mismatch               // nickname known, but with different keys
+)
+
+// Store is a JSON file of verified identities, keyed by nickname.
+type Store struct {
+	path string
+
+	mu      sync.RWMutex
+	entries map[string]Entry
+}
+
+// OpenStore loads the store at path; a missing file yields an empty store.
+func OpenStore(path string) (*Store, error) {
+	s := &Store{path: path, entries: make(map[string]Entry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read trust store: %w", err)
+	}
+	var list []Entry
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse trust store: %w", err)
+	}
+	for _, e := range list {
+		s.entries[e.Nickname] = e
+	}
+	return s, nil
+}
+
+// Add records a verified statement and saves the store, replacing any
+// previous entry for the nickname.
+func (s *Store) Add(st *Statement) error {
+	s.mu.Lock()
+	s.entries[st.Nickname] = Entry{
+		Nickname: st.Nickname,
+		PeerID:   st.PeerID.String(),
+		HPKEPub:  st.HPKEPub,
+		External: st.External,
+		Imported: time.Now().UTC(),
+	}
+	s.mu.Unlock()
+	return s.save()
+}
+
+// Check compares a peer announced under nickname with the store. A nil
+// Store knows no one.
+func (s *Store) Check(nickname string, id peer.ID, hpkePub []byte) (Status, Entry) {
+	if s == nil {
+		return Unknown, Entry{}
+	}
+	s.mu.RLock()
+	e, ok := s.entries[nickname]
+	s.mu.RUnlock()
+	switch {
+	case !ok:
+		return Unknown, Entry{}
+	case e.PeerID == id.String() && bytes.Equal(e.HPKEPub, hpkePub):
+		return Verified, e
+	default:
+		return Mismatch, e
+	}
+}
+
+func (s *Store) save() error {
+	s.mu.RLock()
+	list := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		list = append(list, e)
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Nickname < list[j].Nickname })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("write trust store: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Package audit keeps a tamper-evident log of security events: key
+// mismatches, Hellos that fail verification, revoked keys in use, nodes
+// refusing registration. The log is a file of JSON lines, one event each,
+// appended to and never rewritten. Every event carries an HMAC-SHA256,
+// under a key derived from the peer's seed, of the previous event's MAC
+// and its own fields, so editing, inserting, reordering or deleting an
+// event breaks the chain from there on, and only the seed can mend it.
+// Cutting events off the end leaves a valid, shorter chain: the file
+// should live where that is noticed, or be copied off the machine.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Kinds of events.
+const (
+	KeyMismatch = "key-mismatch" // keys other than pinned, attested or on a contact card
+	HelloFailed = "hello-failed" // a Hello that did not verify
+	RevokedKey  = "revoked-key"  // a peer using, or announced with, a revoked key
+	NodeAuth    = "node-auth"    // a node refused our registration, or asked for a bad proof
+	ForgedSig   = "forged-sig"   // a signed message whose signature did not verify
+	UnsignedKey = "unsigned-key" // an HPKE key its peer did not sign, or unsigned after it was signed
+	KeyRotated  = "key-rotated"  // a pinned peer moved to an HPKE key its identity key signed
+	Downgrade   = "downgrade"    // a Hello leaving out the suites we offered
+)
+
+// Event is one recorded event.
+type Event struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Peer   string    `json:"peer,omitempty"`
+	Detail string    `json:"detail"`
+	MAC    string    `json:"mac"` // hex; chains to the previous event
+}
+
+// ErrWrongKey means the first event does not verify: the log was written
+// with another seed, or its first event was altered.
+var ErrWrongKey = errors.New("audit: log was written with another seed, or altered")
+
+// TamperError reports the first event that breaks the chain.
+type TamperError struct {
+	Seq    uint64 // position in the log, from 1, of the first event that does not verify
+	Reason string
+}
+
+func (e *TamperError) Error() string {
+	return fmt.Sprintf("audit: log altered at event %d: %s", e.Seq, e.Reason)
+}
+
+// Log is an open audit log; it is safe for concurrent use.
+type Log struct {
+	mu   sync.Mutex
+	f    *os.File
+	key  []byte
+	seq  uint64 // of the last event
+	last []byte // MAC of the last event
+}
+
+// Open opens the log at path, creating it, with a key derived from seed.
+// A log whose chain is broken still opens, so that events go on being
+// recorded; Verify reports the break.
+func Open(path string, seed []byte) (*Log, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, seed, nil, []byte("tmd audit v1")), key); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	l := &Log{f: f, key: key}
+	events, err := readEvents(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Chain on from the last event as written: if it was forged, the
+	// chain is broken there already, and stays so.
+	if n := len(events); n > 0 {
+		l.seq = events[n-1].Seq
+		if l.last, err = hex.DecodeString(events[n-1].MAC); err != nil {
+			l.last = nil
+		}
+	}
+	return l, nil
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// Record appends an event of kind about peer ("" for none).
+func (l *Log) Record(kind, peer, detail string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := Event{Seq: l.seq + 1, Time: time.Now().UTC(), Kind: kind, Peer: peer, Detail: detail}
+	mac := l.mac(l.last, &e)
+	e.MAC = hex.EncodeToString(mac)
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	l.seq, l.last = e.Seq, mac
+	return nil
+}
+
+// Verify reads the log back and checks its chain. It returns the events
+// in order, and the events are those read even when the chain breaks;
+// the error is then a *TamperError, or ErrWrongKey.
+func (l *Log) Verify() ([]Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events, err := readEvents(l.f)
+	if err != nil {
+		return nil, err
+	}
+	var prev []byte
+	for i := range events {
+		e := &events[i]
+		got, err := hex.DecodeString(e.MAC)
+		if err != nil || !hmac.Equal(got, l.mac(prev, e)) {
+			if i == 0 {
+				return events, ErrWrongKey
+			}
+			return events, &TamperError{Seq: uint64(i) + 1, Reason: "the MAC does not match"}
+		}
+		if e.Seq != uint64(i)+1 {
+			return events, &TamperError{Seq: uint64(i) + 1, Reason: fmt.Sprintf("numbered %d", e.Seq)}
+		}
+		prev = got
+	}
+	return events, nil
+}
+
+// mac returns the MAC of e, chained to prev.
+func (l *Log) mac(prev []byte, e *Event) []byte {
+	h := hmac.New(sha256.New, l.key)
+	h.Write(prev)
+	for _, field := range [][]byte{
+		binary.BigEndian.AppendUint64(nil, e.Seq),
+		binary.BigEndian.AppendUint64(nil, uint64(e.Time.UnixNano())),
+		[]byte(e.Kind),
+		[]byte(e.Peer),
+		[]byte(e.Detail),
+	} {
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(field))))
+		h.Write(field)
+	}
+	return h.Sum(nil)
+}
+
+// readEvents reads every event of f. A line that is not an event is
+// kept as an empty one, which fails verification where it stands.
+func readEvents(f *os.File) ([]Event, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+	var events []Event
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(line, &e); err != nil {
+			e = Event{Detail: "unreadable: " + string(line)}
+		}
+		events = append(events, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+	return events, nil
+}
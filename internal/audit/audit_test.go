@@ -0,0 +1,99 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func record(t *testing.T, l *Log, kinds ...string) {
+	t.Helper()
+	for _, k := range kinds {
+		if err := l.Record(k, "12D3KooWpeer", "detail of "+k); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecordVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	seed := bytes.Repeat([]byte{1}, 32)
+	l, err := Open(path, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, l, KeyMismatch, HelloFailed)
+	l.Close()
+
+	// Reopened, the log chains on.
+	if l, err = Open(path, seed); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	record(t, l, RevokedKey)
+	events, err := l.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[2].Seq != 3 || events[2].Kind != RevokedKey || events[0].Peer != "12D3KooWpeer" {
+		t.Fatalf("Verify = %+v", events)
+	}
+
+	other, err := Open(path, bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := other.Verify(); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("Verify with another seed: %v, want ErrWrongKey", err)
+	}
+}
+
+func TestTamper(t *testing.T) {
+	seed := bytes.Repeat([]byte{1}, 32)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	l, err := Open(path, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, l, KeyMismatch, HelloFailed, NodeAuth)
+	l.Close()
+	data, _ := os.ReadFile(path)
+	lines := bytes.SplitAfter(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+
+	for _, tc := range []struct {
+		name  string
+		lines [][]byte
+		at    uint64
+	}{
+		{"edited", [][]byte{lines[0], bytes.Replace(lines[1], []byte("hello-failed"), []byte("key-mismatch"), 1), lines[2]}, 2},
+		{"deleted", [][]byte{lines[0], lines[2]}, 2},
+		{"reordered", [][]byte{lines[0], lines[2], lines[1]}, 2},
+		{"garbage", [][]byte{lines[0], lines[1], []byte("nothing to see\n"), lines[2]}, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := filepath.Join(dir, tc.name+".log")
+			if err := os.WriteFile(p, bytes.Join(tc.lines, nil), 0600); err != nil {
+				t.Fatal(err)
+			}
+			l, err := Open(p, seed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			_, err = l.Verify()
+			var te *TamperError
+			if !errors.As(err, &te) || te.Seq != tc.at {
+				t.Fatalf("Verify = %v, want a break at event %d", err, tc.at)
+			}
+			// Events recorded after the break do not mend it.
+			record(t, l, ForgedSig)
+			if _, err := l.Verify(); !errors.As(err, &te) {
+				t.Fatalf("Verify after recording = %v", err)
+			}
+		})
+	}
+}
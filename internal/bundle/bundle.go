@@ -0,0 +1,137 @@
+// Package bundle seals an identity for moving it to another machine: its
+// seed, nickname, profile and pinned peer keys (with when each was
+// verified), encrypted under a passphrase.
+//
+// A bundle is
+//
+//	"TMDBUNDLE1" || u32(time) || u32(memory KiB) || u8(threads) ||
+//	salt (16) || nonce (24) || XChaCha20-Poly1305(JSON)
+//
+// where the key is Argon2id of the passphrase and salt with the given
+// parameters, and everything before the ciphertext is its additional
+// data. Each bundle names its own parameters, so they can be raised
+// without breaking older bundles.
+package bundle
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/identity"
+	"github.com/pivaldi/tmd/internal/pins"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const magic = "TMDBUNDLE1"
+
+// Argon2id parameters of new bundles.
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+)
+
+// Bounds on the parameters a bundle may ask for, so opening one cannot
+// take unbounded time or memory.
+const (
+	maxArgonTime   = 16
+	maxArgonMemory = 1024 * 1024 // KiB
+)
+
+const (
+	saltSize   = 16
+	headerSize = len(magic) + 4 + 4 + 1 + saltSize + chacha20poly1305.NonceSizeX
+)
+
+// ErrPassphrase is returned by Open for a wrong passphrase, or a bundle
+// altered since it was sealed.
+var ErrPassphrase = errors.New("wrong passphrase, or damaged bundle")
+
+// Profile is the profile the identity showed peers.
+type Profile struct {
+	DisplayName string `json:"name,omitempty"`
+	AvatarHash  []byte `json:"avatar,omitempty"` // SHA-256 of the avatar image
+	Note        string `json:"note,omitempty"`
+}
+
+// Bundle is an identity as moved between machines.
+type Bundle struct {
+	Seed       []byte              `json:"seed"`
+	Derivation identity.Derivation `json:"derivation"`
+	HPKEGen    int                 `json:"hpke_gen,omitempty"` // see identity.DeriveKeysGen
+	Nickname   string              `json:"nick,omitempty"`
+	Profile    Profile             `json:"profile,omitzero"`
+	Pins       []pins.Pin          `json:"pins,omitempty"`
+	Created    time.Time           `json:"created"`
+}
+
+// Seal encrypts b under passphrase.
+func Seal(b *Bundle, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	plain, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, headerSize)
+	header = append(header, magic...)
+	header = binary.BigEndian.AppendUint32(header, argonTime)
+	header = binary.BigEndian.AppendUint32(header, argonMemory)
+	header = append(header, argonThreads)
+	random := make([]byte, saltSize+chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(random); err != nil {
+		return nil, fmt.Errorf("bundle salt: %w", err)
+	}
+	header = append(header, random...)
+
+	aead, err := newAEAD(header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, header[headerSize-chacha20poly1305.NonceSizeX:], plain, header), nil
+}
+
+// Open decrypts a bundle sealed under passphrase.
+func Open(data, passphrase []byte) (*Bundle, error) {
+	if len(data) < headerSize || !bytes.HasPrefix(data, []byte(magic)) {
+		return nil, errors.New("not a tmd identity bundle")
+	}
+	header := data[:headerSize]
+	aead, err := newAEAD(header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, header[headerSize-chacha20poly1305.NonceSizeX:], data[headerSize:], header)
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	var b Bundle
+	if err := json.Unmarshal(plain, &b); err != nil {
+		return nil, fmt.Errorf("parse bundle: %w", err)
+	}
+	if len(b.Seed) != identity.SeedSize {
+		return nil, fmt.Errorf("bundle seed of %d bytes", len(b.Seed))
+	}
+	return &b, nil
+}
+
+// newAEAD derives the key of the bundle with header from passphrase.
+func newAEAD(header, passphrase []byte) (cipher.AEAD, error) {
+	params := header[len(magic):]
+	t := binary.BigEndian.Uint32(params)
+	memory := binary.BigEndian.Uint32(params[4:])
+	threads := params[8]
+	salt := params[9 : 9+saltSize]
+	if t == 0 || t > maxArgonTime || memory < 8*uint32(threads) || memory > maxArgonMemory || threads == 0 {
+		return nil, fmt.Errorf("bundle asks for unsupported Argon2id parameters t=%d m=%d p=%d", t, memory, threads)
+	}
+	return chacha20poly1305.NewX(argon2.IDKey(passphrase, salt, t, memory, threads, chacha20poly1305.KeySize))
+}
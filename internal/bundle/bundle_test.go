@@ -0,0 +1,65 @@
+package bundle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/identity"
+	"github.com/pivaldi/tmd/internal/pins"
+)
+
+func TestSealOpen(t *testing.T) {
+	seed, err := identity.GenerateSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	b := &Bundle{
+		Seed:       seed,
+		Derivation: identity.DerivationHKDF,
+		Nickname:   "alice",
+		Profile:    Profile{DisplayName: "Alice", Note: "hi"},
+		Pins:       []pins.Pin{{Nickname: "bob", EdPub: []byte("ed"), HPKEPub: []byte("hpke"), Pinned: verified, Verified: verified}},
+		Created:    verified,
+	}
+	data, err := Seal(b, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, seed) || bytes.Contains(data, []byte("alice")) {
+		t.Fatal("the bundle shows its contents")
+	}
+
+	got, err := Open(data, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Seed, seed) || got.Derivation != identity.DerivationHKDF || got.Nickname != "alice" ||
+		got.Profile.DisplayName != "Alice" || len(got.Pins) != 1 || !got.Pins[0].Verified.Equal(verified) {
+		t.Fatalf("Open = %+v", got)
+	}
+
+	if _, err := Open(data, []byte("wrong horse")); !errors.Is(err, ErrPassphrase) {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+	// The parameters are authenticated too: weakening them breaks the bundle.
+	weak := bytes.Clone(data)
+	binary.BigEndian.PutUint32(weak[len(magic):], 1)
+	if _, err := Open(weak, []byte("correct horse")); !errors.Is(err, ErrPassphrase) {
+		t.Fatalf("changed parameters: %v", err)
+	}
+	huge := bytes.Clone(data)
+	binary.BigEndian.PutUint32(huge[len(magic)+4:], maxArgonMemory+1)
+	if _, err := Open(huge, []byte("correct horse")); err == nil || errors.Is(err, ErrPassphrase) {
+		t.Fatalf("unbounded parameters: %v", err)
+	}
+	if _, err := Open(data[:headerSize-1], []byte("correct horse")); err == nil {
+		t.Fatal("a truncated bundle opened")
+	}
+	if _, err := Seal(b, nil); err == nil {
+		t.Fatal("sealed under an empty passphrase")
+	}
+}
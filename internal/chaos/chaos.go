@@ -0,0 +1,210 @@
+// Package chaos injects network faults into libp2p streams.
+//
+// It is a test/debug facility: wrapping the peer streams with an Injector
+// adds latency, reorders frames, truncates writes and randomly resets
+// streams, so that retry, timeout and resumption logic can be exercised
+// under realistic failure conditions. Faults are applied on the write side
+// only; since every frame is emitted with a single Write call, each fault
+// affects exactly one protocol frame.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// ErrInjectedReset is returned by Write when the injector reset the stream.
+var ErrInjectedReset = errors.New("chaos: injected stream reset")
+
+// reorderFlushDelay bounds how long a held-back frame waits for a successor
+// before it is delivered anyway.
+const reorderFlushDelay = 200 * time.Millisecond
+
+// Config describes which faults to inject. Probabilities are per frame and
+// must lie in [0, 1].
+type Config struct {
+	Latency  time.Duration // fixed delay added before every write
+	Jitter   time.Duration // random extra delay in [0, Jitter)
+	Reorder  float64       // probability a frame is held back behind the next one
+	Truncate float64       // probability a frame is cut in half and the stream reset
+	Reset    float64       // probability the stream is reset instead of writing
+	Seed     int64         // PRNG seed, 0 = time based
+}
+
+// Enabled reports whether the config injects any fault at all.
+func (c Config) Enabled() bool {
+	return c.Latency > 0 || c.Jitter > 0 || c.Reorder > 0 || c.Truncate > 0 || c.Reset > 0
+}
+
+// ParseConfig parses a comma-separated spec such as
+// "latency=50ms,jitter=20ms,reorder=0.05,truncate=0.01,reset=0.01,seed=42".
+// An empty spec returns a disabled config.
+func ParseConfig(spec string) (Config, error) {
+	var c Config
+	if strings.TrimSpace(spec) == "" {
+		return c, nil
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return Config{}, fmt.Errorf("chaos: expected key=value, got %q", part)
+		}
+
+		var err error
+		switch key {
+		case "latency":
+			c.Latency, err = time.ParseDuration(val)
+		case "jitter":
+			c.Jitter, err = time.ParseDuration(val)
+		case "reorder":
+			c.Reorder, err = parseProbability(val)
+		case "truncate":
+			c.Truncate, err = parseProbability(val)
+		case "reset":
+			c.Reset, err = parseProbability(val)
+		case "seed":
+			c.Seed, err = strconv.ParseInt(val, 10, 64)
+		default:
+			return Config{}, fmt.Errorf("chaos: unknown option %q", key)
+		}
+		if err != nil {
+			return Config{}, fmt.Errorf("chaos: %s: %w", key, err)
+		}
+	}
+
+	return c, nil
+}
+
+func parseProbability(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("probability out of range: %v", p)
+	}
+	return p, nil
+}
+
+// Injector wraps streams according to a Config. A nil Injector wraps
+// nothing, so callers can use it unconditionally.
+type Injector struct {
+	cfg Config
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// New creates an injector, or returns nil if cfg injects no fault.
+func New(cfg Config) *Injector {
+	if !cfg.Enabled() {
+		return nil
+	}
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Injector{cfg: cfg, rng: rand.New(rand.NewSource(seed))}
+}
+
+// Wrap returns s with fault injection applied to its writes.
+func (in *Injector) Wrap(s network.Stream) network.Stream {
+	if in == nil {
+		return s
+	}
+	return &stream{Stream: s, in: in}
+}
+
+func (in *Injector) roll(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.rng.Float64() < p
+}
+
+func (in *Injector) delay() time.Duration {
+	d := in.cfg.Latency
+	if in.cfg.Jitter > 0 {
+		in.mu.Lock()
+		d += time.Duration(in.rng.Int63n(int64(in.cfg.Jitter)))
+		in.mu.Unlock()
+	}
+	return d
+}
+
+type stream struct {
+	network.Stream
+	in *Injector
+
+	mu    sync.Mutex
+	held  []byte
+	timer *time.Timer
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	if d := s.in.delay(); d > 0 {
+		time.Sleep(d)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.in.roll(s.in.cfg.Reset):
+		_ = s.Stream.Reset()
+		return 0, ErrInjectedReset
+
+	case s.in.roll(s.in.cfg.Truncate):
+		n, _ := s.Stream.Write(p[:len(p)/2])
+		_ = s.Stream.Reset()
+		return n, ErrInjectedReset
+
+	case s.held == nil && s.in.roll(s.in.cfg.Reorder):
+		s.held = append([]byte(nil), p...)
+		s.timer = time.AfterFunc(reorderFlushDelay, s.flushHeld)
+		return len(p), nil
+	}
+
+	n, err := s.Stream.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if s.held != nil {
+		if err := s.writeHeldLocked(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *stream) flushHeld() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.writeHeldLocked()
+}
+
+func (s *stream) writeHeldLocked() error {
+	if s.held == nil {
+		return nil
+	}
+	s.timer.Stop()
+	held := s.held
+	s.held = nil
+	_, err := s.Stream.Write(held)
+	return err
+}
+
+func (s *stream) Close() error {
+	s.flushHeld()
+	return s.Stream.Close()
+}
@@ -0,0 +1,106 @@
+package chaos
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// fakeStream records writes; only the methods used by the wrapper are
+// implemented.
+type fakeStream struct {
+	network.Stream
+	writes [][]byte
+	resets int
+}
+
+func (f *fakeStream) Write(p []byte) (int, error) {
+	f.writes = append(f.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (f *fakeStream) Reset() error { f.resets++; return nil }
+func (f *fakeStream) Close() error { return nil }
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig("latency=50ms, jitter=10ms,reorder=0.5,truncate=0.1,reset=0.2,seed=7")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := Config{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond, Reorder: 0.5, Truncate: 0.1, Reset: 0.2, Seed: 7}
+	if c != want {
+		t.Fatalf("got %+v, want %+v", c, want)
+	}
+
+	for _, bad := range []string{"latency", "reset=2", "bogus=1", "jitter=abc"} {
+		if _, err := ParseConfig(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+
+	if c, _ := ParseConfig(""); c.Enabled() || New(c) != nil {
+		t.Fatal("empty spec should be disabled")
+	}
+}
+
+func TestNilInjectorPassesThrough(t *testing.T) {
+	f := &fakeStream{}
+	var in *Injector
+	if in.Wrap(f) != network.Stream(f) {
+		t.Fatal("nil injector should return the stream unchanged")
+	}
+}
+
+func TestReset(t *testing.T) {
+	f := &fakeStream{}
+	s := New(Config{Reset: 1, Seed: 1}).Wrap(f)
+
+	if _, err := s.Write([]byte("frame")); !errors.Is(err, ErrInjectedReset) {
+		t.Fatalf("expected injected reset, got %v", err)
+	}
+	if f.resets != 1 || len(f.writes) != 0 {
+		t.Fatalf("resets=%d writes=%d", f.resets, len(f.writes))
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	f := &fakeStream{}
+	s := New(Config{Truncate: 1, Seed: 1}).Wrap(f)
+
+	if _, err := s.Write([]byte("12345678")); !errors.Is(err, ErrInjectedReset) {
+		t.Fatalf("expected injected reset, got %v", err)
+	}
+	if len(f.writes) != 1 || string(f.writes[0]) != "1234" || f.resets != 1 {
+		t.Fatalf("writes=%q resets=%d", f.writes, f.resets)
+	}
+}
+
+func TestReorder(t *testing.T) {
+	f := &fakeStream{}
+	s := New(Config{Reorder: 1, Seed: 1}).Wrap(f)
+
+	_, _ = s.Write([]byte("first"))
+	if len(f.writes) != 0 {
+		t.Fatal("first frame should be held back")
+	}
+	_, _ = s.Write([]byte("second"))
+	// With reorder=1 the second frame cannot be held as well: it goes out
+	// first, followed by the held one.
+	if len(f.writes) != 2 || !bytes.Equal(f.writes[0], []byte("second")) || !bytes.Equal(f.writes[1], []byte("first")) {
+		t.Fatalf("unexpected order: %q", f.writes)
+	}
+}
+
+func TestReorderFlushesOnClose(t *testing.T) {
+	f := &fakeStream{}
+	s := New(Config{Reorder: 1, Seed: 1}).Wrap(f)
+
+	_, _ = s.Write([]byte("only"))
+	_ = s.Close()
+	if len(f.writes) != 1 {
+		t.Fatalf("held frame not flushed on close: %q", f.writes)
+	}
+}
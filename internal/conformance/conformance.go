@@ -0,0 +1,159 @@
+// Package conformance publishes golden byte vectors for the tmd wire formats.
+//
+// The vectors live in vectors/*.json and are embedded into the package so
+// that refactors of the encoders (and alternative implementations) can check
+// byte-level compatibility against a fixed reference. Each file holds a list
+// of vectors; the inputs are described as strings (hex for binary fields) and
+// the expected output is the full framed message, also hex-encoded.
+package conformance
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+//go:embed vectors/*.json
+var files embed.FS
+
+// Vector is a single golden encoding.
+type Vector struct {
+	Name   string            `json:"name"`
+	Type   byte              `json:"type"`
+	Inputs map[string]string `json:"inputs"`
+	Frame  string            `json:"frame"` // hex of u32(len) || type || payload
+}
+
+// Step is one framed message of a handshake transcript.
+type Step struct {
+	From  string `json:"from"` // "dialer" or "listener"
+	Type  byte   `json:"type"`
+	Frame string `json:"frame"`
+}
+
+// Transcript is a complete dialer/listener exchange with the inputs needed to
+// replay it deterministically.
+type Transcript struct {
+	Name   string            `json:"name"`
+	Inputs map[string]string `json:"inputs"`
+	Steps  []Step            `json:"steps"`
+}
+
+// Signature is a signature carried by a vector, with the exact bytes it
+// covers, so an implementation can check that it builds the same input
+// from the vector's fields.
+type Signature struct {
+	Vector    string `json:"vector"`     // name of the vector carrying it
+	Field     string `json:"field"`      // "signature" or "key_sig"
+	Input     string `json:"input"`      // hex of the signed bytes
+	PublicKey string `json:"public_key"` // hex Ed25519 key
+	Signature string `json:"signature"`
+}
+
+// Reject is a framed message that decoders must refuse.
+type Reject struct {
+	Name   string `json:"name"`
+	Type   byte   `json:"type"`
+	Reason string `json:"reason"`
+	Frame  string `json:"frame"`
+}
+
+// Suite groups all vectors stored in one file.
+type Suite struct {
+	Description string       `json:"description"`
+	Vectors     []Vector     `json:"vectors,omitempty"`
+	Transcripts []Transcript `json:"transcripts,omitempty"`
+	Signatures  []Signature  `json:"signatures,omitempty"`
+	Rejects     []Reject     `json:"rejects,omitempty"`
+}
+
+// Names returns the embedded suite names (file names without extension).
+func Names() []string {
+	entries, _ := files.ReadDir("vectors")
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		names = append(names, name[:len(name)-len(filepath.Ext(name))])
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Load returns the embedded suite with the given name.
+func Load(name string) (*Suite, error) {
+	data, err := files.ReadFile("vectors/" + name + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("load suite %s: %w", name, err)
+	}
+	var s Suite
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parse suite %s: %w", name, err)
+	}
+	return &s, nil
+}
+
+// Save writes a suite as indented JSON. It is used by the tests' -update
+// flag to regenerate the golden files; path is the vectors directory.
+func Save(dir, name string, s *Suite) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name+".json"), append(data, '\n'), 0644)
+}
+
+// Hex decodes a hex input and panics on malformed vectors.
+func Hex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(fmt.Sprintf("conformance: bad hex %q: %v", s, err))
+	}
+	return b
+}
+
+// Frame builds the hex string of a framed message, matching the
+// u32(len(type+payload)) || type || payload framing used by every protocol.
+func Frame(typ byte, payload []byte) string {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(1+len(payload)))
+	b := append(hdr[:], typ)
+	return hex.EncodeToString(append(b, payload...))
+}
+
+// DeterministicReader is an io.Reader producing a reproducible byte stream
+// (SHA-256 in counter mode over a label). It replaces crypto/rand when
+// generating vectors whose encoding involves randomness, such as HPKE
+// encapsulation; it must never be used outside of tests.
+type DeterministicReader struct {
+	label   []byte
+	counter uint64
+	buf     []byte
+}
+
+// NewDeterministicReader returns a reader seeded by label.
+func NewDeterministicReader(label string) *DeterministicReader {
+	return &DeterministicReader{label: []byte(label)}
+}
+
+func (r *DeterministicReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			var ctr [8]byte
+			binary.BigEndian.PutUint64(ctr[:], r.counter)
+			r.counter++
+			sum := sha256.Sum256(append(append([]byte{}, r.label...), ctr[:]...))
+			r.buf = sum[:]
+		}
+		c := copy(p[n:], r.buf)
+		r.buf = r.buf[c:]
+		n += c
+	}
+	return n, nil
+}
@@ -0,0 +1,85 @@
+package contact
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Book is a JSON file of imported contact cards, keyed by nickname.
+type Book struct {
+	path string
+
+	mu    sync.RWMutex
+	cards map[string]*Card
+}
+
+// OpenBook loads the book at path; a missing file yields an empty book.
+// Cards are verified again on load.
+func OpenBook(path string) (*Book, error) {
+	b := &Book{path: path, cards: make(map[string]*Card)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read contacts: %w", err)
+	}
+	var list []*Card
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse contacts: %w", err)
+	}
+	for _, c := range list {
+		if err := c.Verify(); err != nil {
+			return nil, fmt.Errorf("contact %s: %w", c.Nickname, err)
+		}
+		b.cards[c.Nickname] = c
+	}
+	return b, nil
+}
+
+// Add stores a card, replacing any previous card for the nickname, and
+// saves the book.
+func (b *Book) Add(c *Card) error {
+	b.mu.Lock()
+	b.cards[c.Nickname] = c
+	b.mu.Unlock()
+	return b.save()
+}
+
+// Get returns the card for nickname. A nil Book has no cards.
+func (b *Book) Get(nickname string) (*Card, bool) {
+	if b == nil {
+		return nil, false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	c, ok := b.cards[nickname]
+	return c, ok
+}
+
+// Cards returns all cards sorted by nickname.
+func (b *Book) Cards() []*Card {
+	b.mu.RLock()
+	list := make([]*Card, 0, len(b.cards))
+	for _, c := range b.cards {
+		list = append(list, c)
+	}
+	b.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Nickname < list[j].Nickname })
+	return list
+}
+
+func (b *Book) save() error {
+	data, err := json.MarshalIndent(b.Cards(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(b.path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("write contacts: %w", err)
+	}
+	return nil
+}
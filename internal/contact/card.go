@@ -0,0 +1,141 @@
+// Package contact implements signed contact cards for in-person key
+// exchange. A card carries everything needed to reach a peer without a
+// discovery node (nickname, libp2p peer ID, multiaddrs, HPKE key) and is
+// signed with the peer's Ed25519 identity key, which the peer ID embeds,
+// so a scanned card cannot be altered in transit.
+//
+// Cards travel as text ("TMD1:" + base64url) inside a QR code; Render
+// draws the code in a terminal and ScanImage reads it back from a photo
+// or screenshot.
+package contact
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/pivaldi/tmd/internal/keyid"
+)
+
+// Prefix starts every encoded card.
+const Prefix = "TMD1:"
+
+const signContext = "tmd-contact-v1"
+
+// Card is a peer's contact information.
+type Card struct {
+	Nickname string   `json:"n"`
+	PeerID   string   `json:"p"`
+	Addrs    []string `json:"a,omitempty"`
+	HPKEPub  []byte   `json:"h"`
+	Sig      []byte   `json:"s,omitempty"`
+}
+
+// KeyID returns the 8-byte fingerprint of the card's HPKE key.
+func (c *Card) KeyID() keyid.KeyID {
+	return keyid.Of(c.HPKEPub)
+}
+
+// Multiaddrs parses the card's addresses.
+func (c *Card) Multiaddrs() ([]multiaddr.Multiaddr, error) {
+	out := make([]multiaddr.Multiaddr, 0, len(c.Addrs))
+	for _, a := range c.Addrs {
+		m, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("contact address %q: %w", a, err)
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+func (c *Card) signInput() []byte {
+	unsigned := *c
+	unsigned.Sig = nil
+	data, _ := json.Marshal(unsigned) // fields are plain data; cannot fail
+	return append([]byte(signContext), data...)
+}
+
+// Sign sets c.Sig using the identity key behind c.PeerID.
+func (c *Card) Sign(edPriv ed25519.PrivateKey) {
+	c.Sig = ed25519.Sign(edPriv, c.signInput())
+}
+
+// SignWith is Sign for an identity key held elsewhere, such as a
+// hardware one.
+func (c *Card) SignWith(s crypto.Signer) error {
+	sig, err := s.Sign(nil, c.signInput(), crypto.Hash(0))
+	if err != nil {
+		return fmt.Errorf("sign contact card: %w", err)
+	}
+	c.Sig = sig
+	return nil
+}
+
+// EdPub returns the Ed25519 identity key embedded in c.PeerID.
+func (c *Card) EdPub() (ed25519.PublicKey, error) {
+	id, err := peer.Decode(c.PeerID)
+	if err != nil {
+		return nil, fmt.Errorf("contact peer ID: %w", err)
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("contact peer ID: %w", err)
+	}
+	raw, err := pub.Raw()
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("contact peer ID does not embed an Ed25519 key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// Verify checks the signature against the key embedded in the peer ID.
+func (c *Card) Verify() error {
+	edPub, err := c.EdPub()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(edPub, c.signInput(), c.Sig) {
+		return errors.New("contact card signature does not verify")
+	}
+	if _, err := c.Multiaddrs(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode returns the text form of a signed card.
+func (c *Card) Encode() string {
+	data, _ := json.Marshal(c)
+	return Prefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode parses and verifies a card produced by Encode. Surrounding
+// whitespace, as left by copy/paste, is ignored.
+func Decode(s string) (*Card, error) {
+	payload, ok := strings.CutPrefix(strings.TrimSpace(s), Prefix)
+	if !ok {
+		return nil, errors.New("not a tmd contact card")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("decode contact card: %w", err)
+	}
+	var c Card
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("decode contact card: %w", err)
+	}
+	if c.Nickname == "" || len(c.HPKEPub) != 32 {
+		return nil, errors.New("contact card is missing its nickname or HPKE key")
+	}
+	if err := c.Verify(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
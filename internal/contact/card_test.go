@@ -0,0 +1,152 @@
+package contact
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+func testCard(t *testing.T) *Card {
+	t.Helper()
+	keys, err := identity.DeriveKeys(bytes.Repeat([]byte{7}, identity.SeedSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Card{
+		Nickname: "bob",
+		PeerID:   keys.PeerID.String(),
+		Addrs:    []string{"/ip4/192.0.2.7/tcp/4001", "/ip4/192.0.2.7/udp/4001/quic-v1"},
+		HPKEPub:  keys.HPKEPubBytes,
+	}
+	c.Sign(keys.Ed25519Priv)
+	if !bytes.Equal(c.KeyID(), keys.KeyID) {
+		t.Fatalf("KeyID = %x, want %x", c.KeyID(), keys.KeyID)
+	}
+	return c
+}
+
+func TestEncodeDecode(t *testing.T) {
+	c := testCard(t)
+	got, err := Decode("  " + c.Encode() + "\n")
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got.Nickname != "bob" || got.PeerID != c.PeerID || len(got.Addrs) != 2 {
+		t.Fatalf("decoded %+v", got)
+	}
+
+	tampered := *c
+	tampered.Addrs = []string{"/ip4/203.0.113.66/tcp/4001"}
+	if _, err := Decode(tampered.Encode()); err == nil {
+		t.Fatal("tampered card accepted")
+	}
+	if _, err := Decode("hello"); err == nil {
+		t.Fatal("garbage accepted")
+	}
+}
+
+func TestQRRoundTrip(t *testing.T) {
+	c := testCard(t)
+	data, err := PNG(c.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ScanImage(img)
+	if err != nil {
+		t.Fatalf("ScanImage: %v", err)
+	}
+	if got.Encode() != c.Encode() {
+		t.Fatal("scanned card differs")
+	}
+
+	var out strings.Builder
+	if err := Render(&out, c.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "█") {
+		t.Fatal("render produced no modules")
+	}
+}
+
+func TestLinesScan(t *testing.T) {
+	c := testCard(t)
+	rows, err := Lines(c.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Paint the rows as a dark screen would, light where drawn, and
+	// scan that.
+	const scale = 4
+	width := len([]rune(rows[0]))
+	img := image.NewGray(image.Rect(0, 0, width*scale, len(rows)*2*scale))
+	for y, row := range rows {
+		for x, r := range []rune(row) {
+			top, bottom := r == '█' || r == '▀', r == '█' || r == '▄'
+			for dy := 0; dy < 2*scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					lit := (dy < scale && top) || (dy >= scale && bottom)
+					if lit {
+						img.SetGray(x*scale+dx, y*2*scale+dy, color.Gray{Y: 0xff})
+					}
+				}
+			}
+		}
+	}
+	got, err := ScanImage(img)
+	if err != nil {
+		t.Fatalf("ScanImage of Lines: %v", err)
+	}
+	if got.Encode() != c.Encode() {
+		t.Fatal("scanned card differs")
+	}
+}
+
+func TestSignWith(t *testing.T) {
+	keys, err := identity.DeriveKeys(bytes.Repeat([]byte{7}, identity.SeedSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Card{Nickname: "bob", PeerID: keys.PeerID.String(), HPKEPub: keys.HPKEPubBytes}
+	if err := c.SignWith(keys.Ed25519Priv); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	edPub, err := c.EdPub()
+	if err != nil || !bytes.Equal(edPub, keys.Ed25519Pub) {
+		t.Fatalf("EdPub = %x, %v; want %x", edPub, err, keys.Ed25519Pub)
+	}
+}
+
+func TestBook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "contacts.json")
+	b, err := OpenBook(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(testCard(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = OpenBook(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := b.Get("bob"); !ok || c.Nickname != "bob" {
+		t.Fatalf("Get(bob) = %v, %v", c, ok)
+	}
+	if len(b.Cards()) != 1 {
+		t.Fatalf("Cards() = %d", len(b.Cards()))
+	}
+}
@@ -0,0 +1,102 @@
+package contact
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"strings"
+
+	"github.com/makiuchi-d/gozxing"
+	gozxingqr "github.com/makiuchi-d/gozxing/qrcode"
+	"rsc.io/qr"
+)
+
+// quietZone is the blank border, in modules, that scanners need.
+const quietZone = 2
+
+// Render draws text as a QR code using half-block characters, two modules
+// per terminal row. The code is drawn dark-on-light so it scans on both
+// dark and light terminal themes.
+func Render(w io.Writer, text string) error {
+	rows, err := halfBlocks(text, true)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, row := range rows {
+		b.WriteString("\x1b[47;30m") // light background, dark foreground
+		b.WriteString(row)
+		b.WriteString("\x1b[0m\n")
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// Lines is Render for screens that take no escape codes, such as the
+// TUI: one string per row, with the light modules drawn, so the code has
+// the right colors on a dark background.
+func Lines(text string) ([]string, error) {
+	return halfBlocks(text, false)
+}
+
+// halfBlocks draws the QR code of text two modules per row, as blocks
+// where modules are dark, or where they are light without dark.
+func halfBlocks(text string, dark bool) ([]string, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return nil, fmt.Errorf("encode qr: %w", err)
+	}
+
+	drawn := func(x, y int) bool {
+		x, y = x-quietZone, y-quietZone
+		black := x >= 0 && y >= 0 && x < code.Size && y < code.Size && code.Black(x, y)
+		return black == dark
+	}
+	size := code.Size + 2*quietZone
+
+	var rows []string
+	for y := 0; y < size; y += 2 {
+		var b strings.Builder
+		for x := 0; x < size; x++ {
+			// The row past the bottom edge stays blank either way.
+			top, bottom := drawn(x, y), y+1 < size && drawn(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteRune('█')
+			case top:
+				b.WriteRune('▀')
+			case bottom:
+				b.WriteRune('▄')
+			default:
+				b.WriteRune(' ')
+			}
+		}
+		rows = append(rows, b.String())
+	}
+	return rows, nil
+}
+
+// PNG returns text as a QR code PNG image.
+func PNG(text string) ([]byte, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return nil, fmt.Errorf("encode qr: %w", err)
+	}
+	code.Scale = 8
+	return code.PNG(), nil
+}
+
+// ScanImage decodes the QR code in img and parses it as a contact card.
+func ScanImage(img image.Image) (*Card, error) {
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return nil, fmt.Errorf("scan qr: %w", err)
+	}
+	res, err := gozxingqr.NewQRCodeReader().Decode(bmp, map[gozxing.DecodeHintType]any{
+		gozxing.DecodeHintType_TRY_HARDER: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan qr: %w", err)
+	}
+	return Decode(res.GetText())
+}
@@ -0,0 +1,179 @@
+// Package eventlog is a bounded in-memory journal of events with resumable
+// cursors. Consumers follow the log from a cursor: retained events after
+// it are replayed, then new events are streamed as they are appended, so
+// a consumer that reconnects with its last cursor misses nothing as long as
+// the events are still retained.
+//
+// Cursors are "<epoch>-<seq>"; the epoch changes every time a Log is
+// created, so cursors from a previous process are reported as expired
+// instead of silently skipping events.
+package eventlog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrCursorExpired means events after the cursor are no longer
+	// retained, or the cursor belongs to another process.
+	ErrCursorExpired = errors.New("eventlog: cursor expired")
+	// ErrInvalidCursor means the cursor could not be parsed or points past
+	// the end of the log.
+	ErrInvalidCursor = errors.New("eventlog: invalid cursor")
+	// ErrLagged means the follower did not keep up with live events and
+	// was dropped; it should follow again from its last cursor.
+	ErrLagged = errors.New("eventlog: follower lagged")
+)
+
+// followerBuffer is how many live events may queue for a slow follower
+// before it is dropped with ErrLagged.
+const followerBuffer = 256
+
+// Entry is one appended event.
+type Entry[T any] struct {
+	Seq    uint64
+	Cursor string
+	Time   time.Time
+	Value  T
+}
+
+// Log is a bounded journal of T values; it is safe for concurrent use.
+type Log[T any] struct {
+	epoch    string
+	capacity int
+
+	mu        sync.Mutex
+	entries   []Entry[T] // oldest first, at most capacity
+	next      uint64     // seq of the next appended entry
+	followers map[chan Entry[T]]struct{}
+}
+
+// New returns a log retaining the last capacity events.
+func New[T any](capacity int) *Log[T] {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return &Log[T]{
+		epoch:     hex.EncodeToString(b[:]),
+		capacity:  max(capacity, 1),
+		next:      1,
+		followers: make(map[chan Entry[T]]struct{}),
+	}
+}
+
+// Append adds an event. build receives the entry's cursor and time, so
+// values that embed their own cursor can be built before they are shared.
+func (l *Log[T]) Append(build func(cursor string, at time.Time) T) Entry[T] {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := Entry[T]{Seq: l.next, Cursor: l.cursor(l.next), Time: time.Now()}
+	e.Value = build(e.Cursor, e.Time)
+	l.next++
+
+	l.entries = append(l.entries, e)
+	if len(l.entries) > l.capacity {
+		l.entries = append(l.entries[:0:0], l.entries[len(l.entries)-l.capacity:]...)
+	}
+
+	for ch := range l.followers {
+		select {
+		case ch <- e:
+		default:
+			close(ch)
+			delete(l.followers, ch)
+		}
+	}
+	return e
+}
+
+func (l *Log[T]) cursor(seq uint64) string {
+	return l.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// Follow calls fn for every event after cursor, first the retained
+// backlog, then live events, until ctx is done, fn fails or the follower
+// lags. An empty cursor starts at the next event, or at the oldest
+// retained one if fromOldest is set.
+func (l *Log[T]) Follow(ctx context.Context, cursor string, fromOldest bool, fn func(Entry[T]) error) error {
+	l.mu.Lock()
+	after, err := l.resolve(cursor, fromOldest)
+	if err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	var backlog []Entry[T]
+	for _, e := range l.entries {
+		if e.Seq > after {
+			backlog = append(backlog, e)
+		}
+	}
+	ch := make(chan Entry[T], followerBuffer)
+	l.followers[ch] = struct{}{}
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		if _, ok := l.followers[ch]; ok {
+			delete(l.followers, ch)
+			close(ch)
+		}
+		l.mu.Unlock()
+	}()
+
+	for _, e := range backlog {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-ch:
+			if !ok {
+				return ErrLagged
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// resolve returns the seq after which to start; l.mu must be held.
+func (l *Log[T]) resolve(cursor string, fromOldest bool) (uint64, error) {
+	oldest := l.next
+	if len(l.entries) > 0 {
+		oldest = l.entries[0].Seq
+	}
+	if cursor == "" {
+		if fromOldest {
+			return oldest - 1, nil
+		}
+		return l.next - 1, nil
+	}
+
+	epoch, seqStr, ok := strings.Cut(cursor, "-")
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidCursor, cursor)
+	}
+	if epoch != l.epoch {
+		return 0, fmt.Errorf("%w: from another session", ErrCursorExpired)
+	}
+	if seq >= l.next {
+		return 0, fmt.Errorf("%w: %q is in the future", ErrInvalidCursor, cursor)
+	}
+	if seq+1 < oldest {
+		return 0, fmt.Errorf("%w: events after %q were dropped", ErrCursorExpired, cursor)
+	}
+	return seq, nil
+}
@@ -0,0 +1,131 @@
+package eventlog
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func appendN(l *Log[int], from, to int) {
+	for i := from; i <= to; i++ {
+		l.Append(func(string, time.Time) int { return i })
+	}
+}
+
+// collect follows until n values were seen.
+func collect(t *testing.T, l *Log[int], cursor string, fromOldest bool, n int) ([]int, string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var (
+		got  []int
+		last string
+		stop = errors.New("stop")
+	)
+	err := l.Follow(ctx, cursor, fromOldest, func(e Entry[int]) error {
+		got = append(got, e.Value)
+		last = e.Cursor
+		if len(got) == n {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("Follow: %v (got %v)", err, got)
+	}
+	return got, last
+}
+
+func TestResume(t *testing.T) {
+	l := New[int](10)
+	appendN(l, 1, 3)
+
+	got, cursor := collect(t, l, "", true, 3)
+	if len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Fatalf("backlog = %v", got)
+	}
+
+	appendN(l, 4, 5)
+	got, _ = collect(t, l, cursor, false, 2)
+	if got[0] != 4 || got[1] != 5 {
+		t.Fatalf("resumed = %v", got)
+	}
+}
+
+func TestLive(t *testing.T) {
+	l := New[int](10)
+	appendN(l, 1, 2)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		appendN(l, 3, 3)
+	}()
+	got, _ := collect(t, l, "", false, 1)
+	if got[0] != 3 {
+		t.Fatalf("live = %v, want only new events", got)
+	}
+}
+
+func TestCursorErrors(t *testing.T) {
+	l := New[int](2)
+	appendN(l, 1, 5) // retains 4, 5
+
+	ctx := context.Background()
+	nop := func(Entry[int]) error { return nil }
+	if err := l.Follow(ctx, l.cursor(1), false, nop); !errors.Is(err, ErrCursorExpired) {
+		t.Fatalf("dropped events: %v", err)
+	}
+	if err := l.Follow(ctx, "deadbeef-3", false, nop); !errors.Is(err, ErrCursorExpired) {
+		t.Fatalf("other epoch: %v", err)
+	}
+	if err := l.Follow(ctx, l.cursor(9), false, nop); !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("future cursor: %v", err)
+	}
+	if err := l.Follow(ctx, "junk", false, nop); !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("junk cursor: %v", err)
+	}
+
+	// The cursor right before the oldest retained event is still valid.
+	if got, _ := collect(t, l, l.cursor(3), false, 2); got[0] != 4 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func followers(l *Log[int]) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.followers)
+}
+
+func TestLaggedFollower(t *testing.T) {
+	l := New[int](1000)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		first := true
+		done <- l.Follow(context.Background(), "", false, func(Entry[int]) error {
+			if first {
+				first = false
+				close(started)
+				<-release // does not keep up
+			}
+			return nil
+		})
+	}()
+	for followers(l) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	appendN(l, 1, 1)
+	<-started
+	appendN(l, 2, followerBuffer+2)
+	if n := followers(l); n != 0 {
+		t.Fatalf("slow follower not dropped (%d followers)", n)
+	}
+
+	close(release)
+	if err := <-done; !errors.Is(err, ErrLagged) {
+		t.Fatalf("Follow = %v, want ErrLagged", err)
+	}
+}
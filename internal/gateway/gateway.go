@@ -0,0 +1,150 @@
+// Package gateway exposes a local HTTP endpoint through which external
+// systems hand messages to tmd for sealed delivery to a peer.
+//
+//	POST /v1/messages
+//	Authorization: Bearer <token>
+//	{"to": "bob", "message": "deploy finished"}
+//
+// The request is answered once the peer has responded; the body carries the
+// peer's (decrypted) reply: {"reply": "message received"}.
+package gateway
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// MaxMessageSize bounds the accepted request body.
+const MaxMessageSize = 1 << 20
+
+// ErrUnknownPeer is returned by a Sender when the target is not known.
+var ErrUnknownPeer = errors.New("unknown peer")
+
+// Sender seals and delivers a message to a peer and returns its reply.
+type Sender interface {
+	Send(to, message string) (reply string, err error)
+}
+
+// SendRequest is the JSON body of POST /v1/messages.
+type SendRequest struct {
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+// SendResponse is returned on successful delivery.
+type SendResponse struct {
+	Reply string `json:"reply"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handler returns the gateway HTTP handler. Every request must present
+// token as a bearer credential.
+func Handler(token string, sender Sender) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		var req SendRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxMessageSize))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid body: " + err.Error()})
+			return
+		}
+		if req.To == "" || req.Message == "" {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "to and message are required"})
+			return
+		}
+
+		reply, err := sender.Send(req.To, req.Message)
+		switch {
+		case errors.Is(err, ErrUnknownPeer):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusBadGateway, errorResponse{Error: err.Error()})
+		default:
+			writeJSON(w, http.StatusOK, SendResponse{Reply: reply})
+		}
+	})
+
+	return requireToken(token, mux)
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// Server is a running gateway listener.
+type Server struct {
+	srv *http.Server
+	ln  net.Listener
+}
+
+// Listen starts the gateway on addr. Only loopback addresses are accepted:
+// the endpoint hands out the local identity's signing power and must not
+// be exposed to the network.
+func Listen(addr, token string, sender Sender) (*Server, error) {
+	if len(token) < 16 {
+		return nil, errors.New("gateway: token must be at least 16 characters")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("gateway: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("gateway: refusing non-loopback address %s", addr)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("gateway: %w", err)
+	}
+	s := &Server{
+		srv: &http.Server{
+			Handler:           Handler(token, sender),
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		ln: ln,
+	}
+	go func() { _ = s.srv.Serve(ln) }()
+	return s, nil
+}
+
+// Addr returns the listening address, e.g. "127.0.0.1:8080".
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close shuts the listener down, letting in-flight requests finish.
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
+
+// URL returns the base URL of the gateway.
+func (s *Server) URL() string {
+	return "http://" + s.Addr()
+}
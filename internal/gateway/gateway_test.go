@@ -0,0 +1,102 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeSender struct {
+	sent []SendRequest
+	err  error
+}
+
+func (f *fakeSender) Send(to, message string) (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	f.sent = append(f.sent, SendRequest{To: to, Message: message})
+	return "message received", nil
+}
+
+const testToken = "0123456789abcdef"
+
+func post(t *testing.T, h http.Handler, auth, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandlerDelivers(t *testing.T) {
+	s := &fakeSender{}
+	rec := post(t, Handler(testToken, s), "Bearer "+testToken, `{"to":"bob","message":"hi"}`)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp SendResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Reply != "message received" {
+		t.Fatalf("unexpected response %q (%v)", rec.Body, err)
+	}
+	if len(s.sent) != 1 || s.sent[0].To != "bob" || s.sent[0].Message != "hi" {
+		t.Fatalf("unexpected sends: %+v", s.sent)
+	}
+}
+
+func TestHandlerRejects(t *testing.T) {
+	cases := []struct {
+		name   string
+		auth   string
+		body   string
+		err    error
+		status int
+	}{
+		{"no auth", "", `{"to":"bob","message":"hi"}`, nil, http.StatusUnauthorized},
+		{"bad token", "Bearer nope", `{"to":"bob","message":"hi"}`, nil, http.StatusUnauthorized},
+		{"bad json", "Bearer " + testToken, `{`, nil, http.StatusBadRequest},
+		{"unknown field", "Bearer " + testToken, `{"to":"bob","message":"hi","x":1}`, nil, http.StatusBadRequest},
+		{"missing to", "Bearer " + testToken, `{"message":"hi"}`, nil, http.StatusBadRequest},
+		{"unknown peer", "Bearer " + testToken, `{"to":"zed","message":"hi"}`, ErrUnknownPeer, http.StatusNotFound},
+		{"send failure", "Bearer " + testToken, `{"to":"bob","message":"hi"}`, errors.New("dial failed"), http.StatusBadGateway},
+	}
+	for _, tc := range cases {
+		rec := post(t, Handler(testToken, &fakeSender{err: tc.err}), tc.auth, tc.body)
+		if rec.Code != tc.status {
+			t.Fatalf("%s: got status %d, want %d", tc.name, rec.Code, tc.status)
+		}
+	}
+}
+
+func TestListenRequiresLoopback(t *testing.T) {
+	if _, err := Listen("0.0.0.0:0", testToken, &fakeSender{}); err == nil {
+		t.Fatal("expected non-loopback address to be refused")
+	}
+	if _, err := Listen("127.0.0.1:0", "short", &fakeSender{}); err == nil {
+		t.Fatal("expected short token to be refused")
+	}
+
+	s, err := Listen("127.0.0.1:0", testToken, &fakeSender{})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer s.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, s.URL()+"/v1/messages", strings.NewReader(`{"to":"bob","message":"hi"}`))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+}
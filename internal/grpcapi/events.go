@@ -0,0 +1,159 @@
+// Package grpcapi serves the tmd.v1 gRPC API (api/tmd/v1) of a running
+// client: a server-streaming Subscribe feed of received messages, receipts
+// and presence changes, resumable by cursor.
+package grpcapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	tmdv1 "github.com/pivaldi/tmd/api/tmd/v1"
+	"github.com/pivaldi/tmd/internal/eventlog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultRetention is how many events Subscribe can replay.
+const DefaultRetention = 4096
+
+// Events is the event journal behind Subscribe. Publish methods are
+// called by the client as things happen.
+type Events struct {
+	tmdv1.UnimplementedEventsServer
+
+	log *eventlog.Log[*tmdv1.Event]
+}
+
+// NewEvents returns a journal retaining the last retention events.
+func NewEvents(retention int) *Events {
+	return &Events{log: eventlog.New[*tmdv1.Event](retention)}
+}
+
+func (e *Events) publish(fill func(ev *tmdv1.Event)) {
+	e.log.Append(func(cursor string, at time.Time) *tmdv1.Event {
+		ev := &tmdv1.Event{Cursor: cursor, Time: timestamppb.New(at)}
+		fill(ev)
+		return ev
+	})
+}
+
+// PublishMessage records a received message.
+func (e *Events) PublishMessage(broadcast bool, from, text string) {
+	kind := tmdv1.Message_KIND_DIRECT
+	if broadcast {
+		kind = tmdv1.Message_KIND_BROADCAST
+	}
+	e.publish(func(ev *tmdv1.Event) {
+		ev.Payload = &tmdv1.Event_Message{Message: &tmdv1.Message{Kind: kind, From: from, Text: text}}
+	})
+}
+
+// PublishReceipt records a delivery receipt for a sent message.
+func (e *Events) PublishReceipt(peer, messageID string, st tmdv1.Receipt_Status) {
+	e.publish(func(ev *tmdv1.Event) {
+		ev.Payload = &tmdv1.Event_Receipt{Receipt: &tmdv1.Receipt{Peer: peer, MessageId: messageID, Status: st}}
+	})
+}
+
+// PublishPresence records a peer going online or offline.
+func (e *Events) PublishPresence(nick string, online bool) {
+	e.publish(func(ev *tmdv1.Event) {
+		ev.Payload = &tmdv1.Event_Presence{Presence: &tmdv1.Presence{Nick: nick, Online: online}}
+	})
+}
+
+// Subscribe implements tmdv1.EventsServer.
+func (e *Events) Subscribe(req *tmdv1.SubscribeRequest, stream grpc.ServerStreamingServer[tmdv1.Event]) error {
+	err := e.log.Follow(stream.Context(), req.GetCursor(), req.GetFromOldest(), func(entry eventlog.Entry[*tmdv1.Event]) error {
+		return stream.Send(entry.Value)
+	})
+	switch {
+	case errors.Is(err, eventlog.ErrCursorExpired):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.Is(err, eventlog.ErrInvalidCursor):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, eventlog.ErrLagged):
+		return status.Error(codes.ResourceExhausted, "consumer too slow; resubscribe with the last cursor")
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	return err
+}
+
+// Server is a running gRPC listener.
+type Server struct {
+	grpc *grpc.Server
+	ln   net.Listener
+}
+
+// Listen serves the API on addr. Like the HTTP gateway it only accepts
+// loopback addresses, and calls must carry "authorization: Bearer <token>".
+func Listen(addr, token string, events *Events) (*Server, error) {
+	if len(token) < 16 {
+		return nil, errors.New("grpc api: token must be at least 16 characters")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("grpc api: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("grpc api: refusing non-loopback address %s", addr)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("grpc api: %w", err)
+	}
+
+	auth := bearerAuth(token)
+	s := &Server{
+		grpc: grpc.NewServer(
+			grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, h grpc.UnaryHandler) (any, error) {
+				if err := auth(ctx); err != nil {
+					return nil, err
+				}
+				return h(ctx, req)
+			}),
+			grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, h grpc.StreamHandler) error {
+				if err := auth(ss.Context()); err != nil {
+					return err
+				}
+				return h(srv, ss)
+			}),
+		),
+		ln: ln,
+	}
+	tmdv1.RegisterEventsServer(s.grpc, events)
+	go func() { _ = s.grpc.Serve(ln) }()
+	return s, nil
+}
+
+func bearerAuth(token string) func(context.Context) error {
+	want := []byte("Bearer " + token)
+	return func(ctx context.Context) error {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, v := range md.Get("authorization") {
+			if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(v)), want) == 1 {
+				return nil
+			}
+		}
+		return status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+	}
+}
+
+// Addr returns the listening address.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server, ending open subscriptions.
+func (s *Server) Close() {
+	s.grpc.Stop()
+}
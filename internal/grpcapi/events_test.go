@@ -0,0 +1,109 @@
+package grpcapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tmdv1 "github.com/pivaldi/tmd/api/tmd/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testToken = "0123456789abcdef0123"
+
+func dial(t *testing.T, s *Server) tmdv1.EventsClient {
+	t.Helper()
+	conn, err := grpc.NewClient(s.Addr(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return tmdv1.NewEventsClient(conn)
+}
+
+func authed(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+testToken)
+}
+
+func TestSubscribeResume(t *testing.T) {
+	events := NewEvents(16)
+	s, err := Listen("127.0.0.1:0", testToken, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	client := dial(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events.PublishMessage(false, "bob", "hello")
+	events.PublishPresence("carol", true)
+
+	stream, err := client.Subscribe(authed(ctx), &tmdv1.SubscribeRequest{FromOldest: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := first.GetMessage(); m.GetFrom() != "bob" || m.GetKind() != tmdv1.Message_KIND_DIRECT {
+		t.Fatalf("first event = %v", first)
+	}
+
+	// Disconnect after the first event, then resume from its cursor.
+	subCtx, subCancel := context.WithCancel(authed(ctx))
+	stream, err = client.Subscribe(subCtx, &tmdv1.SubscribeRequest{Cursor: first.GetCursor()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events.PublishReceipt("bob", "m1", tmdv1.Receipt_STATUS_DELIVERED)
+
+	second, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := second.GetPresence(); p.GetNick() != "carol" || !p.GetOnline() {
+		t.Fatalf("resumed event = %v", second)
+	}
+	third, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := third.GetReceipt(); r.GetMessageId() != "m1" {
+		t.Fatalf("live event = %v", third)
+	}
+	subCancel()
+
+	stream, _ = client.Subscribe(authed(ctx), &tmdv1.SubscribeRequest{Cursor: "00000000-1"})
+	if _, err := stream.Recv(); status.Code(err) != codes.OutOfRange {
+		t.Fatalf("foreign cursor: %v", err)
+	}
+}
+
+func TestSubscribeRequiresToken(t *testing.T) {
+	s, err := Listen("127.0.0.1:0", testToken, NewEvents(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := dial(t, s).Subscribe(ctx, &tmdv1.SubscribeRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("got %v, want Unauthenticated", err)
+	}
+
+	if _, err := Listen("0.0.0.0:0", testToken, NewEvents(1)); err == nil {
+		t.Fatal("non-loopback address accepted")
+	}
+}
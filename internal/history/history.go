@@ -0,0 +1,384 @@
+// Package history persists a peer's console history, direct-message
+// queue, outbox and when other peers were last seen in a bbolt file.
+// Every record is sealed with XChaCha20-Poly1305 under a key derived from
+// the peer's seed, so the file is useless without the seed; only record
+// counts and sizes are visible.
+package history
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// MaxLines is how many history lines are kept; older ones are dropped as
+// new ones are appended.
+const MaxLines = 10000
+
+// ErrWrongKey means the file was written with another seed.
+var ErrWrongKey = errors.New("history: file was written with another seed")
+
+var (
+	bucketMeta   = []byte("meta")
+	bucketLines  = []byte("lines")
+	bucketQueue  = []byte("queue")
+	bucketOutbox = []byte("outbox")
+	bucketSeen   = []byte("seen")
+	bucketSched  = []byte("scheduled")
+
+	keyCheck   = []byte("check")
+	checkValue = []byte("tmd history")
+)
+
+// Line is one history line.
+type Line struct {
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+	// Device is the device of ours the line was synced from; empty for
+	// lines of this one.
+	Device string `json:"device,omitempty"`
+}
+
+// Queued is one unreplied direct message.
+type Queued struct {
+	ID      uint64    `json:"id"`
+	From    string    `json:"from"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Outgoing is one direct message waiting in the outbox for its peer to
+// come online.
+type Outgoing struct {
+	ID      uint64    `json:"id"`
+	To      string    `json:"to"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	// MessageID is kept for the peer to recognise copies of the message.
+	MessageID []byte `json:"message_id,omitempty"`
+}
+
+// Scheduled is one direct message to send at a later time.
+type Scheduled struct {
+	ID      uint64    `json:"id"`
+	To      string    `json:"to"`
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// Seen is when a peer was last online or active.
+type Seen struct {
+	Peer string    `json:"peer"`
+	Time time.Time `json:"time"`
+}
+
+// Store is an open history file; it is safe for concurrent use.
+type Store struct {
+	db       *bolt.DB
+	aead     cipher.AEAD
+	maxLines uint64
+}
+
+// Open opens or creates the history file at path, sealed with a key
+// derived from seed. It fails with ErrWrongKey if the file was created
+// with another seed, and after a second if another process holds it.
+func Open(path string, seed []byte) (*Store, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, seed, nil, []byte("tmd history v1")), key); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open history: %w", err)
+	}
+	s := &Store{db: db, aead: aead, maxLines: MaxLines}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketLines, bucketQueue, bucketOutbox, bucketSeen, bucketSched} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+		check := meta.Get(keyCheck)
+		if check == nil {
+			return meta.Put(keyCheck, s.seal(bucketMeta, keyCheck, checkValue))
+		}
+		if _, err := s.open(bucketMeta, keyCheck, check); err != nil {
+			return ErrWrongKey
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the file.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Lines returns the stored history, oldest first.
+func (s *Store) Lines() ([]Line, error) {
+	var lines []Line
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLines).ForEach(func(k, v []byte) error {
+			var l Line
+			if err := s.decode(bucketLines, k, v, &l); err != nil {
+				return err
+			}
+			lines = append(lines, l)
+			return nil
+		})
+	})
+	return lines, err
+}
+
+// AppendLine stores a history line, dropping the oldest beyond MaxLines.
+func (s *Store) AppendLine(l Line) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketLines)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := s.put(b, bucketLines, seq, l); err != nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && seq-binary.BigEndian.Uint64(k) >= s.maxLines; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ReplaceLine replaces the text of the latest stored line for which match
+// is true. It reports whether there was one.
+func (s *Store) ReplaceLine(match func(text string) bool, text string) (bool, error) {
+	found := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketLines)
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var l Line
+			if err := s.decode(bucketLines, k, v, &l); err != nil {
+				return err
+			}
+			if !match(l.Text) {
+				continue
+			}
+			found = true
+			l.Text = text
+			return s.put(b, bucketLines, binary.BigEndian.Uint64(k), l)
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Queue returns the stored direct queue in arrival order.
+func (s *Store) Queue() ([]Queued, error) {
+	var queue []Queued
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketQueue).ForEach(func(k, v []byte) error {
+			var q Queued
+			if err := s.decode(bucketQueue, k, v, &q); err != nil {
+				return err
+			}
+			queue = append(queue, q)
+			return nil
+		})
+	})
+	return queue, err
+}
+
+// PutQueued stores a queued message under its ID.
+func (s *Store) PutQueued(q Queued) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.put(tx.Bucket(bucketQueue), bucketQueue, q.ID, q)
+	})
+}
+
+// DeleteQueued removes queued messages, typically once replied to or
+// dismissed. Unknown IDs are ignored.
+func (s *Store) DeleteQueued(ids ...uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketQueue)
+		for _, id := range ids {
+			if err := b.Delete(seqKey(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Outbox returns the stored outbox in ID order.
+func (s *Store) Outbox() ([]Outgoing, error) {
+	var out []Outgoing
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketOutbox).ForEach(func(k, v []byte) error {
+			var o Outgoing
+			if err := s.decode(bucketOutbox, k, v, &o); err != nil {
+				return err
+			}
+			out = append(out, o)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// PutOutgoing stores an outbox message under its ID.
+func (s *Store) PutOutgoing(o Outgoing) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.put(tx.Bucket(bucketOutbox), bucketOutbox, o.ID, o)
+	})
+}
+
+// DeleteOutgoing removes outbox messages, once sent or dropped. Unknown
+// IDs are ignored.
+func (s *Store) DeleteOutgoing(ids ...uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketOutbox)
+		for _, id := range ids {
+			if err := b.Delete(seqKey(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Schedule returns the stored scheduled messages in ID order.
+func (s *Store) Schedule() ([]Scheduled, error) {
+	var out []Scheduled
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSched).ForEach(func(k, v []byte) error {
+			var sc Scheduled
+			if err := s.decode(bucketSched, k, v, &sc); err != nil {
+				return err
+			}
+			out = append(out, sc)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// PutScheduled stores a scheduled message under its ID.
+func (s *Store) PutScheduled(sc Scheduled) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.put(tx.Bucket(bucketSched), bucketSched, sc.ID, sc)
+	})
+}
+
+// DeleteScheduled removes scheduled messages, once due or cancelled.
+// Unknown IDs are ignored.
+func (s *Store) DeleteScheduled(ids ...uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketSched)
+		for _, id := range ids {
+			if err := b.Delete(seqKey(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LastSeen returns when each peer was last seen, in nickname order.
+func (s *Store) LastSeen() ([]Seen, error) {
+	var out []Seen
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSeen).ForEach(func(k, v []byte) error {
+			var seen Seen
+			if err := s.decode(bucketSeen, k, v, &seen); err != nil {
+				return err
+			}
+			out = append(out, seen)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// PutSeen stores when a peer was last seen, replacing the previous time.
+func (s *Store) PutSeen(seen Seen) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.putKey(tx.Bucket(bucketSeen), bucketSeen, []byte(seen.Peer), seen)
+	})
+}
+
+func (s *Store) put(b *bolt.Bucket, bucket []byte, seq uint64, v any) error {
+	return s.putKey(b, bucket, seqKey(seq), v)
+}
+
+func (s *Store) putKey(b *bolt.Bucket, bucket, k []byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(k, s.seal(bucket, k, data))
+}
+
+func (s *Store) decode(bucket, k, v []byte, dst any) error {
+	data, err := s.open(bucket, k, v)
+	if err != nil {
+		return fmt.Errorf("history: %s record %x: %w", bucket, k, err)
+	}
+	return json.Unmarshal(data, dst)
+}
+
+// seal encrypts a record, binding it to its bucket and key so records
+// cannot be moved around in the file.
+func (s *Store) seal(bucket, k, plain []byte) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // crypto/rand does not fail
+	}
+	return s.aead.Seal(nonce, nonce, plain, recordAD(bucket, k))
+}
+
+func (s *Store) open(bucket, k, sealed []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("record too short")
+	}
+	return s.aead.Open(nil, sealed[:n], sealed[n:], recordAD(bucket, k))
+}
+
+func recordAD(bucket, k []byte) []byte {
+	return append(append(append([]byte{}, bucket...), 0), k...)
+}
+
+// seqKey encodes a sequence number so that bbolt's byte order is
+// numeric order.
+func seqKey(seq uint64) []byte {
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], seq)
+	return k[:]
+}
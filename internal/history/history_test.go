@@ -0,0 +1,196 @@
+package history
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTemp(t *testing.T, path string, seed []byte) *Store {
+	t.Helper()
+	s, err := Open(path, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	seed := bytes.Repeat([]byte{1}, 32)
+	now := time.Now().Round(0)
+
+	s := openTemp(t, path, seed)
+	for _, text := range []string{"one", "two", "secret words"} {
+		if err := s.AppendLine(Line{Text: text, Time: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := uint64(1); id <= 3; id++ {
+		if err := s.PutQueued(Queued{ID: id, From: "bob", Message: "m", Time: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteQueued(2, 9); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("secret words")) {
+		t.Fatal("plaintext found in the file")
+	}
+
+	s = openTemp(t, path, seed)
+	defer s.Close()
+	lines, err := s.Lines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 || lines[0].Text != "one" || lines[2].Text != "secret words" || !lines[0].Time.Equal(now) {
+		t.Fatalf("Lines = %+v", lines)
+	}
+	queue, err := s.Queue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 2 || queue[0].ID != 1 || queue[1].ID != 3 || queue[1].From != "bob" {
+		t.Fatalf("Queue = %+v", queue)
+	}
+}
+
+func TestStoreWrongSeed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	s := openTemp(t, path, bytes.Repeat([]byte{1}, 32))
+	s.Close()
+
+	if _, err := Open(path, bytes.Repeat([]byte{2}, 32)); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("Open with another seed: %v", err)
+	}
+}
+
+func TestStoreTrimsLines(t *testing.T) {
+	s := openTemp(t, filepath.Join(t.TempDir(), "history.db"), make([]byte, 32))
+	defer s.Close()
+	s.maxLines = 3
+
+	for _, text := range []string{"a", "b", "c", "d", "e"} {
+		if err := s.AppendLine(Line{Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines, err := s.Lines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 || lines[0].Text != "c" || lines[2].Text != "e" {
+		t.Fatalf("Lines = %+v", lines)
+	}
+}
+
+func TestStoreReplaceLine(t *testing.T) {
+	s := openTemp(t, filepath.Join(t.TempDir(), "history.db"), bytes.Repeat([]byte{1}, 32))
+	defer s.Close()
+	for _, text := range []string{"[from bob] hi", "other", "[from bob] hi"} {
+		if err := s.AppendLine(Line{Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	is := func(want string) func(string) bool { return func(text string) bool { return text == want } }
+	if ok, err := s.ReplaceLine(is("[from bob] hi"), "[from bob] hello (edited)"); !ok || err != nil {
+		t.Fatalf("ReplaceLine = %v, %v", ok, err)
+	}
+	if ok, err := s.ReplaceLine(is("missing"), "x"); ok || err != nil {
+		t.Fatalf("ReplaceLine(missing) = %v, %v", ok, err)
+	}
+	lines, err := s.Lines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 || lines[0].Text != "[from bob] hi" || lines[2].Text != "[from bob] hello (edited)" {
+		t.Fatalf("Lines = %+v", lines)
+	}
+}
+
+func TestStoreOutbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	seed := make([]byte, 32)
+	s := openTemp(t, path, seed)
+	for id := uint64(1); id <= 3; id++ {
+		if err := s.PutOutgoing(Outgoing{ID: id, To: "bob", Message: "later"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteOutgoing(1); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openTemp(t, path, seed)
+	defer s.Close()
+	out, err := s.Outbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || out[0].ID != 2 || out[1].To != "bob" || out[1].Message != "later" {
+		t.Fatalf("Outbox = %+v", out)
+	}
+}
+
+func TestStoreSchedule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	seed := make([]byte, 32)
+	at := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	s := openTemp(t, path, seed)
+	for id := uint64(1); id <= 2; id++ {
+		if err := s.PutScheduled(Scheduled{ID: id, To: "bob", Message: "happy new year", At: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteScheduled(1, 7); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openTemp(t, path, seed)
+	defer s.Close()
+	sched, err := s.Schedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sched) != 1 || sched[0].ID != 2 || sched[0].To != "bob" || !sched[0].At.Equal(at) {
+		t.Fatalf("Schedule = %+v", sched)
+	}
+}
+
+func TestStoreLastSeen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	seed := make([]byte, 32)
+	then := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := openTemp(t, path, seed)
+	for _, seen := range []Seen{{Peer: "carol", Time: then}, {Peer: "bob", Time: then}, {Peer: "bob", Time: then.Add(time.Hour)}} {
+		if err := s.PutSeen(seen); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	s = openTemp(t, path, seed)
+	defer s.Close()
+	seen, err := s.LastSeen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || seen[0].Peer != "bob" || !seen[0].Time.Equal(then.Add(time.Hour)) || seen[1].Peer != "carol" {
+		t.Fatalf("LastSeen = %+v", seen)
+	}
+}
@@ -0,0 +1,137 @@
+// Package hwkey signs with an Ed25519 key held in hardware (a PIV smart
+// card, a security key or a TPM) rather than one derived from the seed
+// file. It talks to the device through an SSH agent that exposes the key,
+// such as ssh-agent with a PKCS#11 provider (ssh-add -s) or a
+// device-specific agent: the agent answers Ed25519 sign requests with a
+// plain Ed25519 signature, which peers verify like any other.
+//
+// Keys the agent signs in another way are refused: ECDSA and RSA keys,
+// and FIDO2 sk-ssh-ed25519 keys, whose signatures also cover the
+// authenticator's flags and counter.
+package hwkey
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// AgentPrefix starts a signer spec naming a key of the SSH agent.
+const AgentPrefix = "ssh-agent"
+
+// Signer is a crypto.Signer for an Ed25519 key held by an SSH agent. Its
+// signatures are plain Ed25519 ones.
+type Signer struct {
+	mu    sync.Mutex // agent connections serve one request at a time
+	agent agent.Agent
+	key   ssh.PublicKey
+	pub   ed25519.PublicKey
+}
+
+// Open returns the signer a spec names: "ssh-agent" for the only Ed25519
+// key of the agent at $SSH_AUTH_SOCK, or "ssh-agent:SHA256:..." for the
+// key with that fingerprint (as ssh-add -l prints it). The connection
+// stays open for the life of the process.
+func Open(spec string) (*Signer, error) {
+	rest, ok := strings.CutPrefix(spec, AgentPrefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, ":")) {
+		return nil, fmt.Errorf("unknown signer %q (want %s or %s:<fingerprint>)", spec, AgentPrefix, AgentPrefix)
+	}
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set: no agent to sign with")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("connect to agent: %w", err)
+	}
+	s, err := FromAgent(agent.NewClient(conn), strings.TrimPrefix(rest, ":"))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// FromAgent returns the signer for the Ed25519 key of ag with the given
+// fingerprint, or for its only Ed25519 key if fingerprint is empty.
+func FromAgent(ag agent.Agent, fingerprint string) (*Signer, error) {
+	keys, err := ag.List()
+	if err != nil {
+		return nil, fmt.Errorf("list agent keys: %w", err)
+	}
+	var found []*agent.Key
+	for _, k := range keys {
+		if fingerprint != "" && ssh.FingerprintSHA256(k) != fingerprint {
+			continue
+		}
+		if k.Type() != ssh.KeyAlgoED25519 {
+			if fingerprint != "" {
+				return nil, fmt.Errorf("agent key %s is %s, not Ed25519", fingerprint, k.Type())
+			}
+			continue
+		}
+		found = append(found, k)
+	}
+	switch {
+	case len(found) == 0 && fingerprint != "":
+		return nil, fmt.Errorf("agent holds no key %s", fingerprint)
+	case len(found) == 0:
+		return nil, errors.New("agent holds no Ed25519 key")
+	case len(found) > 1:
+		return nil, fmt.Errorf("agent holds %d Ed25519 keys: name one by fingerprint (%s:SHA256:...)", len(found), AgentPrefix)
+	}
+
+	key, err := ssh.ParsePublicKey(found[0].Marshal())
+	if err != nil {
+		return nil, fmt.Errorf("parse agent key: %w", err)
+	}
+	cpk, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, errors.New("agent key has no public key")
+	}
+	pub, ok := cpk.CryptoPublicKey().(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("agent key is not Ed25519")
+	}
+	return &Signer{agent: ag, key: key, pub: pub}, nil
+}
+
+// Public returns the ed25519.PublicKey of the signer.
+func (s *Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Fingerprint returns the key's SHA256 fingerprint, as ssh-add -l prints
+// it.
+func (s *Signer) Fingerprint() string {
+	return ssh.FingerprintSHA256(s.key)
+}
+
+// Sign signs message as ed25519.PrivateKey.Sign does with crypto.Hash(0):
+// the message itself, not a digest. The device may ask for a PIN or a
+// touch meanwhile.
+func (s *Signer) Sign(_ io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, errors.New("ed25519 signs messages, not digests")
+	}
+	s.mu.Lock()
+	sig, err := s.agent.Sign(s.key, message)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("agent sign: %w", err)
+	}
+	if sig.Format != ssh.KeyAlgoED25519 || !ed25519.Verify(s.pub, message, sig.Blob) {
+		return nil, fmt.Errorf("agent returned a bad %s signature", sig.Format)
+	}
+	return sig.Blob, nil
+}
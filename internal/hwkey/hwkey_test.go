@@ -0,0 +1,92 @@
+package hwkey
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func addKey(t *testing.T, ag agent.Agent, key any) ssh.PublicKey {
+	t.Helper()
+	if err := ag.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.PublicKey()
+}
+
+func TestFromAgent(t *testing.T) {
+	ag := agent.NewKeyring()
+	if _, err := FromAgent(ag, ""); err == nil {
+		t.Fatal("empty agent: no error")
+	}
+
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecPub := addKey(t, ag, ec)
+	if _, err := FromAgent(ag, ""); err == nil {
+		t.Fatal("agent without Ed25519 key: no error")
+	}
+	if _, err := FromAgent(ag, ssh.FingerprintSHA256(ecPub)); err == nil || !strings.Contains(err.Error(), "not Ed25519") {
+		t.Fatalf("ECDSA key by fingerprint: %v", err)
+	}
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	edPub := addKey(t, ag, priv)
+	s, err := FromAgent(ag, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(s.Public()) || s.Fingerprint() != ssh.FingerprintSHA256(edPub) {
+		t.Fatalf("signer key %x (%s), want %x", s.Public(), s.Fingerprint(), pub)
+	}
+
+	msg := []byte("hello")
+	sig, err := s.Sign(nil, msg, crypto.Hash(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(pub, msg, sig) {
+		t.Fatal("signature does not verify as plain Ed25519")
+	}
+	if _, err := s.Sign(nil, msg, crypto.SHA256); err == nil {
+		t.Fatal("signed a digest")
+	}
+
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub := addKey(t, ag, other)
+	if _, err := FromAgent(ag, ""); err == nil {
+		t.Fatal("two Ed25519 keys and no fingerprint: no error")
+	}
+	s, err = FromAgent(ag, ssh.FingerprintSHA256(otherPub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !other.Public().(ed25519.PublicKey).Equal(s.Public()) {
+		t.Fatal("fingerprint picked the wrong key")
+	}
+	if _, err := FromAgent(ag, "SHA256:nope"); err == nil {
+		t.Fatal("unknown fingerprint: no error")
+	}
+}
+
+func TestOpenSpec(t *testing.T) {
+	for _, spec := range []string{"", "pkcs11", "ssh-agentx"} {
+		if _, err := Open(spec); err == nil || !strings.Contains(err.Error(), "unknown signer") {
+			t.Errorf("Open(%q) = %v, want unknown signer", spec, err)
+		}
+	}
+	t.Setenv("SSH_AUTH_SOCK", "")
+	if _, err := Open(AgentPrefix); err == nil {
+		t.Fatal("no agent socket: no error")
+	}
+}
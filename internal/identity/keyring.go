@@ -0,0 +1,53 @@
+package identity
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+)
+
+// A seed can live in the OS keyring (Secret Service on Linux, the
+// Keychain on macOS, the Credential Manager with DPAPI on Windows) rather
+// than in a file: a seed path of "keyring:name" names the entry "name" of
+// the tmd service. The entry holds the same bytes as a seed file, base64
+// encoded since keyrings store strings.
+
+// KeyringPrefix starts a seed path naming an OS keyring entry.
+const KeyringPrefix = "keyring:"
+
+// keyringService is the service the entries are filed under.
+const keyringService = "tmd"
+
+// keyringName returns the entry a seed path names, if it is a keyring one.
+func keyringName(path string) (string, bool) {
+	name, ok := strings.CutPrefix(path, KeyringPrefix)
+	return name, ok
+}
+
+func saveKeyringSeed(name string, data []byte) error {
+	if name == "" {
+		return errors.New("empty keyring entry name")
+	}
+	if err := keyring.Set(keyringService, name, base64.StdEncoding.EncodeToString(data)); err != nil {
+		return fmt.Errorf("keyring: %w", err)
+	}
+	return nil
+}
+
+func loadKeyringSeed(name string) ([]byte, error) {
+	if name == "" {
+		return nil, errors.New("empty keyring entry name")
+	}
+	enc, err := keyring.Get(keyringService, name)
+	if err != nil {
+		return nil, fmt.Errorf("keyring entry %q: %w", name, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, fmt.Errorf("keyring entry %q: %w", name, err)
+	}
+	return data, nil
+}
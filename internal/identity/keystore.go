@@ -0,0 +1,81 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A keystore is a directory holding several identities, one seed file
+// each, named <name>.key. An identity is then picked by name rather than
+// by the path of its seed file.
+
+// keystoreExt ends the seed files of a keystore.
+const keystoreExt = ".key"
+
+// identityName is what an identity name may be: it becomes a file name.
+var identityName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Keystore is a directory of seed files.
+type Keystore struct {
+	Dir string
+}
+
+// DefaultKeystoreDir is the keystore used when none is given: tmd/identities
+// in the user's configuration directory.
+func DefaultKeystoreDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("keystore: %w", err)
+	}
+	return filepath.Join(dir, "tmd", "identities"), nil
+}
+
+// Path returns the seed file of the identity name, which need not exist.
+func (k Keystore) Path(name string) (string, error) {
+	if !identityName.MatchString(name) {
+		return "", fmt.Errorf("invalid identity name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	return filepath.Join(k.Dir, name+keystoreExt), nil
+}
+
+// Init creates the keystore directory, readable by its owner only.
+func (k Keystore) Init() error {
+	return os.MkdirAll(k.Dir, 0700)
+}
+
+// KeystoreEntry is an identity of a keystore. Err is set, and File nil,
+// when its seed file cannot be read.
+type KeystoreEntry struct {
+	Name string
+	File *SeedFile
+	Err  error
+}
+
+// List returns the identities of the keystore, sorted by name. A keystore
+// that does not exist yet is empty.
+func (k Keystore) List() ([]KeystoreEntry, error) {
+	dirents, err := os.ReadDir(k.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("keystore: %w", err)
+	}
+	var entries []KeystoreEntry
+	for _, d := range dirents {
+		name, ok := strings.CutSuffix(d.Name(), keystoreExt)
+		if !ok || !d.Type().IsRegular() || !identityName.MatchString(name) {
+			continue
+		}
+		e := KeystoreEntry{Name: name}
+		e.File, e.Err = LoadSeedFile(filepath.Join(k.Dir, d.Name()))
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
@@ -0,0 +1,50 @@
+package identity
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeystore(t *testing.T) {
+	ks := Keystore{Dir: filepath.Join(t.TempDir(), "identities")}
+	if entries, err := ks.List(); err != nil || len(entries) != 0 {
+		t.Fatalf("List of a missing keystore = %v, %v", entries, err)
+	}
+	for _, name := range []string{"", "../alice", "a/b", ".hidden", "alice bob"} {
+		if _, err := ks.Path(name); err == nil {
+			t.Fatalf("Path(%q) accepted", name)
+		}
+	}
+	if err := ks.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	seed, _ := GenerateSeed()
+	for _, name := range []string{"work", "alice"} {
+		path, err := ks.Path(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := SaveSeedFile(path, &SeedFile{Seed: seed, Derivation: DerivationHKDF, Nickname: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Other files are not identities; a broken seed file is listed as such.
+	_ = os.WriteFile(filepath.Join(ks.Dir, "notes.txt"), []byte("hi"), 0600)
+	_ = os.WriteFile(filepath.Join(ks.Dir, "broken.key"), []byte("short"), 0600)
+
+	entries, err := ks.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Name != "alice" || entries[1].Name != "broken" || entries[2].Name != "work" {
+		t.Fatalf("List = %+v; want alice, broken, work", entries)
+	}
+	if entries[0].Err != nil || entries[0].File.Nickname != "alice" {
+		t.Fatalf("alice: %+v", entries[0])
+	}
+	if entries[1].Err == nil || entries[1].File != nil {
+		t.Fatalf("broken: %+v; want an error", entries[1])
+	}
+}
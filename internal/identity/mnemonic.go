@@ -0,0 +1,90 @@
+package identity
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"fmt"
+	"strings"
+)
+
+// A seed can be written down as a BIP39 mnemonic: its 256 bits followed by
+// the first 8 bits of their SHA-256, split into 24 words of 11 bits taken
+// from the English wordlist. The words encode the seed itself; BIP39's
+// PBKDF2 step, which turns words into a wallet seed, is not used.
+
+// MnemonicWords is the number of words of a seed's mnemonic.
+const MnemonicWords = 24
+
+//go:embed bip39_english.txt
+var englishWords string
+
+var (
+	wordList  = strings.Fields(englishWords)
+	wordIndex = func() map[string]int {
+		m := make(map[string]int, len(wordList))
+		for i, w := range wordList {
+			m[w] = i
+		}
+		return m
+	}()
+)
+
+// Mnemonic returns the 24 words of a seed, space-separated.
+func Mnemonic(seed []byte) (string, error) {
+	if len(seed) != SeedSize {
+		return "", fmt.Errorf("invalid seed size: %d", len(seed))
+	}
+	sum := sha256.Sum256(seed)
+	return strings.Join(Words(append(append([]byte{}, seed...), sum[0]), MnemonicWords), " "), nil
+}
+
+// Words returns n words of the BIP39 English wordlist spelling the first
+// 11n bits of data, which must hold that many.
+func Words(data []byte, n int) []string {
+	words := make([]string, n)
+	for i := range words {
+		words[i] = wordList[readBits(data, i*11, 11)]
+	}
+	return words
+}
+
+// SeedFromMnemonic returns the seed whose mnemonic is given. Words may be
+// separated by any white space and in any case; a mistyped word or a wrong
+// checksum is an error.
+func SeedFromMnemonic(mnemonic string) ([]byte, error) {
+	words := strings.Fields(strings.ToLower(mnemonic))
+	if len(words) != MnemonicWords {
+		return nil, fmt.Errorf("want %d words, got %d", MnemonicWords, len(words))
+	}
+	bits := make([]byte, SeedSize+1)
+	for i, w := range words {
+		n, ok := wordIndex[w]
+		if !ok {
+			return nil, fmt.Errorf("word %d (%q) is not in the BIP39 English wordlist", i+1, w)
+		}
+		writeBits(bits, i*11, 11, n)
+	}
+	seed := bits[:SeedSize]
+	if sum := sha256.Sum256(seed); sum[0] != bits[SeedSize] {
+		return nil, fmt.Errorf("bad mnemonic checksum (check the words and their order)")
+	}
+	return seed, nil
+}
+
+// readBits returns n bits of b from bit offset off, most significant first.
+func readBits(b []byte, off, n int) int {
+	v := 0
+	for i := off; i < off+n; i++ {
+		v = v<<1 | int(b[i/8]>>(7-i%8)&1)
+	}
+	return v
+}
+
+// writeBits stores the n low bits of v in b from bit offset off.
+func writeBits(b []byte, off, n, v int) {
+	for i := 0; i < n; i++ {
+		if v>>(n-1-i)&1 == 1 {
+			b[(off+i)/8] |= 1 << (7 - (off+i)%8)
+		}
+	}
+}
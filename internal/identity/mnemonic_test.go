@@ -0,0 +1,64 @@
+package identity
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Vectors from the BIP39 reference test set (256-bit entropy).
+var mnemonicVectors = []struct {
+	fill  byte
+	words string
+}{
+	{0x00, strings.Repeat("abandon ", 23) + "art"},
+	{0x7f, strings.Repeat("legal winner thank year wave sausage worth useful ", 2) + "legal winner thank year wave sausage worth title"},
+	{0x80, strings.Repeat("letter advice cage absurd amount doctor acoustic avoid ", 2) + "letter advice cage absurd amount doctor acoustic bless"},
+	{0xff, strings.Repeat("zoo ", 23) + "vote"},
+}
+
+func TestMnemonicVectors(t *testing.T) {
+	for _, v := range mnemonicVectors {
+		seed := bytes.Repeat([]byte{v.fill}, SeedSize)
+		got, err := Mnemonic(seed)
+		if err != nil {
+			t.Fatalf("Mnemonic(%02x...) failed: %v", v.fill, err)
+		}
+		if got != v.words {
+			t.Fatalf("Mnemonic(%02x...) = %q, want %q", v.fill, got, v.words)
+		}
+		back, err := SeedFromMnemonic(v.words)
+		if err != nil || !bytes.Equal(back, seed) {
+			t.Fatalf("SeedFromMnemonic(%q) = %x, %v", v.words, back, err)
+		}
+	}
+}
+
+func TestMnemonicRoundTrip(t *testing.T) {
+	seed, _ := GenerateSeed()
+	words, err := Mnemonic(seed)
+	if err != nil {
+		t.Fatalf("Mnemonic failed: %v", err)
+	}
+	back, err := SeedFromMnemonic("  " + strings.ToUpper(strings.ReplaceAll(words, " ", "\n")) + "\n")
+	if err != nil || !bytes.Equal(back, seed) {
+		t.Fatalf("round trip = %x, %v", back, err)
+	}
+}
+
+func TestSeedFromMnemonicErrors(t *testing.T) {
+	good := strings.Repeat("abandon ", 23) + "art"
+	for name, words := range map[string]string{
+		"too few words": strings.Repeat("abandon ", 23),
+		"unknown word":  strings.Repeat("abandon ", 23) + "artt",
+		"bad checksum":  strings.Repeat("abandon ", 23) + "zoo",
+		"swapped words": "art " + strings.Repeat("abandon ", 23),
+	} {
+		if _, err := SeedFromMnemonic(words); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	if _, err := SeedFromMnemonic(good); err != nil {
+		t.Fatalf("valid mnemonic rejected: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package identity
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// A seed can also be derived from a passphrase, so that the same
+// passphrase and nickname always give the same identity: for test fleets
+// rebuilt from a script, or as a last resort for recovery. The seed is
+// Argon2id of the passphrase, salted with the nickname so that one guess
+// does not test every identity at once. Anyone guessing the passphrase
+// is the identity, and the public keys let them check guesses offline, so
+// the parameters are heavier than those of a bundle and the passphrase
+// must be long.
+
+// MinPassphrase is the fewest characters SeedFromPassphrase accepts.
+const MinPassphrase = 16
+
+// Argon2id parameters of SeedFromPassphrase. Changing them changes every
+// identity made with it.
+const (
+	passphraseTime    = 4
+	passphraseMemory  = 256 * 1024 // KiB
+	passphraseThreads = 4
+)
+
+// passphraseSalt starts the salt, before the nickname.
+const passphraseSalt = "tmd passphrase seed v1\x00"
+
+// SeedFromPassphrase derives the seed of nickname from passphrase.
+func SeedFromPassphrase(passphrase []byte, nickname string) ([]byte, error) {
+	if n := utf8.RuneCount(passphrase); n < MinPassphrase {
+		return nil, fmt.Errorf("passphrase of %d characters: use at least %d", n, MinPassphrase)
+	}
+	if nickname == "" {
+		return nil, fmt.Errorf("a seed from a passphrase needs the nickname it is for")
+	}
+	salt := append([]byte(passphraseSalt), nickname...)
+	return argon2.IDKey(passphrase, salt, passphraseTime, passphraseMemory, passphraseThreads, SeedSize), nil
+}
@@ -0,0 +1,17 @@
+package identity
+
+import "github.com/pivaldi/tmd/internal/secmem"
+
+// Wipe zeroes the Ed25519 private key, which the libp2p key shares, on
+// shutdown. The keys are unusable afterwards.
+//
+// Only the seed is kept in locked memory (see main). The private keys
+// derived from it are Go heap values and never locked: crypto/ed25519
+// caches the expanded key under a weak pointer to the private key's
+// memory, which must be the Go heap's, and circl keeps the HPKE key in
+// unexported slices that the client's receivers, channels and ratchet
+// hold until the process ends. Of these only the Ed25519 key can be
+// wiped.
+func (k *DerivedKeys) Wipe() {
+	secmem.Wipe(k.Ed25519Priv)
+}
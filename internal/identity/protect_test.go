@@ -0,0 +1,22 @@
+package identity
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestWipe(t *testing.T) {
+	seed, _ := GenerateSeed()
+	keys, err := DeriveKeys(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.Wipe()
+	if !bytes.Equal(keys.Ed25519Priv, make([]byte, ed25519.PrivateKeySize)) {
+		t.Fatal("Wipe left the Ed25519 key")
+	}
+	if raw, _ := keys.Libp2pPriv.Raw(); !bytes.Equal(raw, make([]byte, ed25519.PrivateKeySize)) {
+		t.Fatal("Wipe left the libp2p key")
+	}
+}
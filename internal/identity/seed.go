@@ -4,17 +4,35 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/cloudflare/circl/hpke"
 	"github.com/cloudflare/circl/kem"
 	libp2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/pivaldi/tmd/internal/keyid"
+	"github.com/pivaldi/tmd/internal/secmem"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/hkdf"
 )
 
 const SeedSize = 32
 
+// Derivation says how the keys of a seed are derived from it.
+type Derivation byte
+
+const (
+	// DerivationDirect feeds the seed itself to Ed25519 and HPKE, as
+	// seed files of bare 32 bytes were used.
+	DerivationDirect Derivation = 1
+	// DerivationHKDF derives a sub-seed per key from the seed with
+	// HKDF-SHA256 under its own label, so no two keys share input.
+	DerivationHKDF Derivation = 2
+)
+
 // GenerateSeed creates a new 32-byte random seed.
 func GenerateSeed() ([]byte, error) {
 	seed := make([]byte, SeedSize)
@@ -24,28 +42,42 @@ func GenerateSeed() ([]byte, error) {
 	return seed, nil
 }
 
-// SaveSeed writes a seed to file with 0600 permissions.
-func SaveSeed(path string, seed []byte) error {
-	if len(seed) != SeedSize {
-		return fmt.Errorf("invalid seed size: %d", len(seed))
+// SeedExists reports whether a seed is already stored at path, a file or
+// a "keyring:name" entry.
+func SeedExists(path string) (bool, error) {
+	if name, ok := keyringName(path); ok {
+		_, err := loadKeyringSeed(name)
+		if errors.Is(err, keyring.ErrNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
 	}
-	return os.WriteFile(path, seed, 0600)
+	return err == nil, err
 }
 
-// LoadSeed reads a seed from file.
-func LoadSeed(path string) ([]byte, error) {
-	seed, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("load seed: %w", err)
-	}
+// DeviceSeed derives the seed of one device of an identity from the
+// identity's seed: each device gets its own keys and peer ID, while
+// whoever holds the identity seed can derive them all.
+func DeviceSeed(seed []byte, device string) ([]byte, error) {
 	if len(seed) != SeedSize {
 		return nil, fmt.Errorf("invalid seed size: %d", len(seed))
 	}
-	return seed, nil
+	if device == "" {
+		return nil, fmt.Errorf("empty device name")
+	}
+	out := make([]byte, SeedSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, seed, nil, []byte("tmd device v1\x00"+device)), out); err != nil {
+		return nil, fmt.Errorf("derive device seed: %w", err)
+	}
+	return out, nil
 }
 
 // KeyIDSize is the size of the key fingerprint in bytes.
-const KeyIDSize = 8
+const KeyIDSize = keyid.Size
 
 // DerivedKeys holds all keys derived from a seed.
 type DerivedKeys struct {
@@ -54,34 +86,82 @@ type DerivedKeys struct {
 	HPKEPub      kem.PublicKey
 	HPKEPriv     kem.PrivateKey
 	HPKEPubBytes []byte
-	KeyID        []byte // 8-byte fingerprint of HPKE public key
+	KeyID        keyid.KeyID // 8-byte fingerprint of HPKE public key
 	Libp2pPriv   libp2pcrypto.PrivKey
 	Libp2pPub    libp2pcrypto.PubKey
 	PeerID       peer.ID
 }
 
-// DeriveKeys derives all cryptographic keys from a seed.
+// subKeyInfo labels the sub-seed of each key under DerivationHKDF.
+const subKeyInfo = "tmd key v2\x00"
+
+// subSeed derives the sub-seed labelled label from seed.
+func subSeed(seed []byte, label string) ([]byte, error) {
+	out := make([]byte, SeedSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, seed, nil, []byte(subKeyInfo+label)), out); err != nil {
+		return nil, fmt.Errorf("derive %s sub-seed: %w", label, err)
+	}
+	return out, nil
+}
+
+// DeriveKeys derives all cryptographic keys from a new seed
+// (DerivationHKDF).
 func DeriveKeys(seed []byte) (*DerivedKeys, error) {
+	return DeriveKeysWith(seed, DerivationHKDF)
+}
+
+// DeriveKeysWith derives all cryptographic keys from a seed the way d
+// says. The libp2p key is the Ed25519 one under either: peers find the
+// key signing a Hello in the peer ID.
+func DeriveKeysWith(seed []byte, d Derivation) (*DerivedKeys, error) {
+	return DeriveKeysGen(seed, d, 0)
+}
+
+// DeriveKeysGen is DeriveKeysWith with the HPKE key of generation gen.
+// Rotating the HPKE key moves to the next generation, derived under the
+// label "hpke/<gen>"; the Ed25519 key, and so the peer ID, stays. Only
+// DerivationHKDF has generations after 0.
+func DeriveKeysGen(seed []byte, d Derivation, gen int) (*DerivedKeys, error) {
+	if gen < 0 || gen > 0 && d != DerivationHKDF {
+		return nil, fmt.Errorf("HPKE key generation %d needs the HKDF key derivation", gen)
+	}
 	if len(seed) != SeedSize {
 		return nil, fmt.Errorf("invalid seed size: %d", len(seed))
 	}
+	edSeed, hpkeSeed := seed, seed
+	switch d {
+	case DerivationDirect:
+	case DerivationHKDF:
+		var err error
+		if edSeed, err = subSeed(seed, "ed25519"); err != nil {
+			return nil, err
+		}
+		defer secmem.Wipe(edSeed)
+		label := "hpke"
+		if gen > 0 {
+			label = fmt.Sprintf("hpke/%d", gen)
+		}
+		if hpkeSeed, err = subSeed(seed, label); err != nil {
+			return nil, err
+		}
+		defer secmem.Wipe(hpkeSeed)
+	default:
+		return nil, fmt.Errorf("unknown key derivation %d", d)
+	}
 
 	// Ed25519 for Hello signing
-	ed25519Priv := ed25519.NewKeyFromSeed(seed)
+	ed25519Priv := ed25519.NewKeyFromSeed(edSeed)
 	ed25519Pub := ed25519Priv.Public().(ed25519.PublicKey)
 
 	// HPKE X25519 for message encryption
 	kemScheme := hpke.KEM_X25519_HKDF_SHA256.Scheme()
-	hpkePub, hpkePriv := kemScheme.DeriveKeyPair(seed)
+	hpkePub, hpkePriv := kemScheme.DeriveKeyPair(hpkeSeed)
 	hpkePubBytes, err := hpkePub.MarshalBinary()
 	if err != nil {
 		return nil, fmt.Errorf("marshal HPKE pub: %w", err)
 	}
 
-	// KeyID from first 8 bytes of HPKE public key hash
-	hash := sha256.Sum256(hpkePubBytes)
-	keyID := make([]byte, KeyIDSize)
-	copy(keyID, hash[:KeyIDSize])
+	keyID := keyid.Of(hpkePubBytes)
 
 	// libp2p Ed25519 for transport (convert from std lib key)
 	libp2pPriv, libp2pPub, err := libp2pcrypto.KeyPairFromStdKey(&ed25519Priv)
@@ -1,10 +1,13 @@
 package identity
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/zalando/go-keyring"
 )
 
 func TestGenerateSeed(t *testing.T) {
@@ -42,13 +45,36 @@ func TestLoadSeed(t *testing.T) {
 	original, _ := GenerateSeed()
 	_ = SaveSeed(path, original)
 
-	loaded, err := LoadSeed(path)
+	loaded, derivation, err := LoadSeed(path)
 	if err != nil {
 		t.Fatalf("LoadSeed failed: %v", err)
 	}
 	if string(loaded) != string(original) {
 		t.Fatal("loaded seed doesn't match original")
 	}
+	if derivation != DerivationHKDF {
+		t.Fatalf("new seed file has derivation %d", derivation)
+	}
+}
+
+func TestLoadOldSeed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.key")
+	original, _ := GenerateSeed()
+	if err := os.WriteFile(path, original, 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, derivation, err := LoadSeed(path)
+	if err != nil {
+		t.Fatalf("LoadSeed failed: %v", err)
+	}
+	if string(loaded) != string(original) || derivation != DerivationDirect {
+		t.Fatalf("bare seed file loaded with derivation %d", derivation)
+	}
+
+	_ = os.WriteFile(path, append([]byte(seedMagic), append([]byte{9}, original...)...), 0600)
+	if _, _, err := LoadSeed(path); err == nil {
+		t.Fatal("unknown derivation accepted")
+	}
 }
 
 func TestDeriveKeys(t *testing.T) {
@@ -88,3 +114,96 @@ func TestDeriveKeysDeterministic(t *testing.T) {
 		t.Fatal("same seed should produce same PeerID")
 	}
 }
+
+func TestDeriveKeysSubSeeds(t *testing.T) {
+	seed, _ := GenerateSeed()
+	direct, _ := DeriveKeysWith(seed, DerivationDirect)
+	keys, err := DeriveKeys(seed)
+	if err != nil {
+		t.Fatalf("DeriveKeys failed: %v", err)
+	}
+	if keys.PeerID == direct.PeerID || string(keys.HPKEPubBytes) == string(direct.HPKEPubBytes) {
+		t.Fatal("sub-seed keys match the direct ones")
+	}
+	// Each key has its own input, none of them the seed.
+	if string(keys.Ed25519Priv.Seed()) == string(seed) {
+		t.Fatal("Ed25519 key made from the seed itself")
+	}
+	hpkeSeed, _ := subSeed(seed, "hpke")
+	if string(keys.Ed25519Priv.Seed()) == string(hpkeSeed) {
+		t.Fatal("Ed25519 and HPKE share a sub-seed")
+	}
+	if _, err := DeriveKeysWith(seed, 0); err == nil {
+		t.Fatal("unknown derivation accepted")
+	}
+}
+
+func TestDeriveKeysGen(t *testing.T) {
+	seed, _ := GenerateSeed()
+	keys, _ := DeriveKeys(seed)
+	if gen0, err := DeriveKeysGen(seed, DerivationHKDF, 0); err != nil || string(gen0.HPKEPubBytes) != string(keys.HPKEPubBytes) {
+		t.Fatalf("generation 0 is not the HPKE key DeriveKeys gives: %v", err)
+	}
+	gen1, err := DeriveKeysGen(seed, DerivationHKDF, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen2, _ := DeriveKeysGen(seed, DerivationHKDF, 2)
+	if string(gen1.HPKEPubBytes) == string(keys.HPKEPubBytes) || string(gen2.HPKEPubBytes) == string(gen1.HPKEPubBytes) || string(gen1.KeyID) == string(keys.KeyID) {
+		t.Fatal("a rotated HPKE key matches an earlier one")
+	}
+	if gen1.PeerID != keys.PeerID {
+		t.Fatal("rotating the HPKE key changed the peer ID")
+	}
+	if _, err := DeriveKeysGen(seed, DerivationDirect, 1); err == nil {
+		t.Fatal("rotated a key of the direct derivation")
+	}
+}
+
+func TestDeviceSeed(t *testing.T) {
+	seed, _ := GenerateSeed()
+	laptop, err := DeviceSeed(seed, "laptop")
+	if err != nil {
+		t.Fatalf("DeviceSeed failed: %v", err)
+	}
+	again, _ := DeviceSeed(seed, "laptop")
+	phone, _ := DeviceSeed(seed, "phone")
+	if string(laptop) != string(again) {
+		t.Fatal("device seed is not deterministic")
+	}
+	if string(laptop) == string(phone) || string(laptop) == string(seed) {
+		t.Fatal("device seeds are not distinct")
+	}
+	if _, err := DeviceSeed(seed, ""); err == nil {
+		t.Fatal("empty device name accepted")
+	}
+}
+
+func TestKeyringSeed(t *testing.T) {
+	keyring.MockInit()
+	const path = KeyringPrefix + "alice"
+
+	if exists, err := SeedExists(path); err != nil || exists {
+		t.Fatalf("SeedExists before saving = %v, %v", exists, err)
+	}
+	if _, _, err := LoadSeed(path); err == nil {
+		t.Fatal("loaded a missing keyring entry")
+	}
+	seed, _ := GenerateSeed()
+	if err := SaveSeed(path, seed); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := SeedExists(path); err != nil || !exists {
+		t.Fatalf("SeedExists after saving = %v, %v", exists, err)
+	}
+	loaded, derivation, err := LoadSeed(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded, seed) || derivation != DerivationHKDF {
+		t.Fatalf("loaded %x (derivation %d), want %x", loaded, derivation, seed)
+	}
+	if err := SaveSeed(KeyringPrefix, seed); err == nil {
+		t.Fatal("saved under an empty entry name")
+	}
+}
@@ -0,0 +1,204 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// seedMagic starts seed files that say more than the bare seed. A seed
+// file is one of, by version:
+//
+//	1: the bare 32-byte seed, keys derived with DerivationDirect
+//	2: "TMDSEED" || Derivation (1 or 2) || seed
+//	3: "TMDSEED" || u8(3) || u32(len(meta)) || meta (JSON) || seed
+//
+// Versions start at 3 so that the byte after the magic tells them from
+// version 2. The metadata names the KDF deriving keys from the seed and
+// its parameters, and says when the seed was made and for which nickname.
+// Once the HPKE key has been rotated, it also records the key's
+// generation and when it was rotated. A version or KDF this tmd does not
+// know is refused rather than read as something else; unknown metadata
+// fields are ignored.
+const seedMagic = "TMDSEED"
+
+// SeedFileVersion is the version of the seed files SaveSeed writes.
+const SeedFileVersion = 3
+
+// maxSeedMeta bounds the metadata of a seed file.
+const maxSeedMeta = 4096
+
+// SeedFile is a seed and what its file says about it.
+type SeedFile struct {
+	Version    int // 1 to SeedFileVersion
+	Seed       []byte
+	Derivation Derivation
+	Created    time.Time // zero before version 3
+	Nickname   string    // a hint only: the client's --nick when none is given
+	HPKEGen    int       // generation of the HPKE key, 0 until rotated (see DeriveKeysGen)
+	Rotated    time.Time // when the HPKE key was last rotated; zero if never
+	Expires    time.Time // when the keys should be rotated by; zero if never
+}
+
+// KeysSince returns when the HPKE key of f was made: when it was last
+// rotated, or else when the seed was. It is zero if f does not say.
+func (f *SeedFile) KeysSince() time.Time {
+	if !f.Rotated.IsZero() {
+		return f.Rotated
+	}
+	return f.Created
+}
+
+// DeriveKeys derives the keys of f, with the HPKE key of its generation.
+func (f *SeedFile) DeriveKeys() (*DerivedKeys, error) {
+	return DeriveKeysGen(f.Seed, f.Derivation, f.HPKEGen)
+}
+
+// seedMeta is the metadata of a version 3 seed file.
+type seedMeta struct {
+	KDF      seedKDF   `json:"kdf"`
+	Created  time.Time `json:"created,omitzero"`
+	Nickname string    `json:"nick,omitempty"`
+	HPKEGen  int       `json:"hpke_gen,omitempty"`
+	Rotated  time.Time `json:"rotated,omitzero"`
+	Expires  time.Time `json:"expires,omitzero"`
+}
+
+// seedKDF names how keys are derived from the seed. Neither KDF so far
+// takes parameters; those of later ones go next to the name.
+type seedKDF struct {
+	Name string `json:"name"`
+}
+
+// kdfNames are the names of the derivations in seed file metadata.
+var kdfNames = map[Derivation]string{
+	DerivationDirect: "direct",
+	DerivationHKDF:   "hkdf-sha256",
+}
+
+// SaveSeed writes a seed to file with 0600 permissions, or to the OS
+// keyring for a "keyring:name" path, marked for DerivationHKDF.
+func SaveSeed(path string, seed []byte) error {
+	return SaveSeedWith(path, seed, DerivationHKDF)
+}
+
+// SaveSeedWith is SaveSeed for a seed whose keys are derived with d, such
+// as one restored from a bundle.
+func SaveSeedWith(path string, seed []byte, d Derivation) error {
+	return SaveSeedFile(path, &SeedFile{Seed: seed, Derivation: d})
+}
+
+// SaveSeedFile writes f as SaveSeed does, in the current version; a zero
+// Created is now.
+func SaveSeedFile(path string, f *SeedFile) error {
+	data, err := encodeSeedFile(f)
+	if err != nil {
+		return err
+	}
+	if name, ok := keyringName(path); ok {
+		return saveKeyringSeed(name, data)
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// LoadSeed reads a seed from file, or from the OS keyring for a
+// "keyring:name" path, and how its keys are derived.
+func LoadSeed(path string) ([]byte, Derivation, error) {
+	f, err := LoadSeedFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return f.Seed, f.Derivation, nil
+}
+
+// LoadSeedFile reads a seed file, of any version, as LoadSeed does.
+func LoadSeedFile(path string) (*SeedFile, error) {
+	var data []byte
+	var err error
+	if name, ok := keyringName(path); ok {
+		data, err = loadKeyringSeed(name)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load seed: %w", err)
+	}
+	return decodeSeedFile(data)
+}
+
+func encodeSeedFile(f *SeedFile) ([]byte, error) {
+	if len(f.Seed) != SeedSize {
+		return nil, fmt.Errorf("invalid seed size: %d", len(f.Seed))
+	}
+	name, ok := kdfNames[f.Derivation]
+	if !ok {
+		return nil, fmt.Errorf("unknown key derivation %d", f.Derivation)
+	}
+	created := f.Created
+	if created.IsZero() {
+		created = time.Now().UTC().Truncate(time.Second)
+	}
+	if f.HPKEGen < 0 || f.HPKEGen > 0 && f.Derivation != DerivationHKDF {
+		return nil, fmt.Errorf("HPKE key generation %d with key derivation %d", f.HPKEGen, f.Derivation)
+	}
+	meta, err := json.Marshal(seedMeta{KDF: seedKDF{Name: name}, Created: created, Nickname: f.Nickname,
+		HPKEGen: f.HPKEGen, Rotated: f.Rotated, Expires: f.Expires})
+	if err != nil {
+		return nil, err
+	}
+	if len(meta) > maxSeedMeta {
+		return nil, fmt.Errorf("seed file metadata of %d bytes", len(meta))
+	}
+	data := append([]byte(seedMagic), SeedFileVersion)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(meta)))
+	data = append(data, meta...)
+	return append(data, f.Seed...), nil
+}
+
+func decodeSeedFile(data []byte) (*SeedFile, error) {
+	if len(data) == SeedSize {
+		return &SeedFile{Version: 1, Seed: data, Derivation: DerivationDirect}, nil
+	}
+	rest, ok := bytes.CutPrefix(data, []byte(seedMagic))
+	if !ok || len(rest) == 0 {
+		return nil, fmt.Errorf("invalid seed file: %d bytes", len(data))
+	}
+	switch v := rest[0]; {
+	case v == byte(DerivationDirect) || v == byte(DerivationHKDF):
+		if len(rest) != 1+SeedSize {
+			return nil, fmt.Errorf("invalid seed file: %d bytes", len(data))
+		}
+		return &SeedFile{Version: 2, Seed: rest[1:], Derivation: Derivation(v)}, nil
+	case v != SeedFileVersion:
+		return nil, fmt.Errorf("unknown seed file version or key derivation %d: written by a newer tmd?", v)
+	}
+
+	rest = rest[1:]
+	if len(rest) < 4 {
+		return nil, fmt.Errorf("invalid seed file: %d bytes", len(data))
+	}
+	n := binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+	if n > maxSeedMeta || uint32(len(rest)) != n+SeedSize {
+		return nil, fmt.Errorf("invalid seed file: %d bytes of metadata in %d bytes", n, len(data))
+	}
+	var meta seedMeta
+	if err := json.Unmarshal(rest[:n], &meta); err != nil {
+		return nil, fmt.Errorf("seed file metadata: %w", err)
+	}
+	if meta.HPKEGen < 0 {
+		return nil, fmt.Errorf("seed file metadata: HPKE key generation %d", meta.HPKEGen)
+	}
+	f := &SeedFile{Version: SeedFileVersion, Seed: rest[n:], Created: meta.Created, Nickname: meta.Nickname,
+		HPKEGen: meta.HPKEGen, Rotated: meta.Rotated, Expires: meta.Expires}
+	for d, name := range kdfNames {
+		if name == meta.KDF.Name {
+			f.Derivation = d
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key derivation %q in seed file: written by a newer tmd?", meta.KDF.Name)
+}
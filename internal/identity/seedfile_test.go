@@ -0,0 +1,88 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSeedFileVersions(t *testing.T) {
+	dir := t.TempDir()
+	seed, _ := GenerateSeed()
+	created := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	path := filepath.Join(dir, "v3.key")
+	if err := SaveSeedFile(path, &SeedFile{Seed: seed, Derivation: DerivationHKDF, Created: created, Nickname: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := LoadSeedFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != SeedFileVersion || !bytes.Equal(f.Seed, seed) || f.Derivation != DerivationHKDF || !f.Created.Equal(created) || f.Nickname != "alice" {
+		t.Fatalf("LoadSeedFile = %+v", f)
+	}
+	// A rotated key keeps its generation, when it was rotated and when it
+	// expires.
+	f.HPKEGen, f.Rotated, f.Expires = 2, created.Add(time.Hour), created.Add(365*24*time.Hour)
+	if err := SaveSeedFile(path, f); err != nil {
+		t.Fatal(err)
+	}
+	if g, err := LoadSeedFile(path); err != nil || g.HPKEGen != 2 || !g.Rotated.Equal(f.Rotated) || !g.Expires.Equal(f.Expires) || !g.Created.Equal(created) || !g.KeysSince().Equal(f.Rotated) {
+		t.Fatalf("rotated: %+v, %v", g, err)
+	}
+	if err := SaveSeedFile(path, &SeedFile{Seed: seed, Derivation: DerivationDirect, HPKEGen: 1}); err == nil {
+		t.Fatal("saved a rotated key of the direct derivation")
+	}
+	now := filepath.Join(dir, "now.key")
+	if err := SaveSeed(now, seed); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := LoadSeedFile(now); err != nil || f.Created.IsZero() || f.Nickname != "" {
+		t.Fatalf("SaveSeed wrote %+v, %v; want a creation time and no nickname", f, err)
+	}
+
+	// Files of the earlier versions still load.
+	old := filepath.Join(dir, "v2.key")
+	_ = os.WriteFile(old, append([]byte(seedMagic+"\x02"), seed...), 0600)
+	if f, err := LoadSeedFile(old); err != nil || f.Version != 2 || f.Derivation != DerivationHKDF || !bytes.Equal(f.Seed, seed) {
+		t.Fatalf("version 2: %+v, %v", f, err)
+	}
+	_ = os.WriteFile(old, seed, 0600)
+	if f, err := LoadSeedFile(old); err != nil || f.Version != 1 || f.Derivation != DerivationDirect {
+		t.Fatalf("version 1: %+v, %v", f, err)
+	}
+}
+
+func TestSeedFileRefusesUnknown(t *testing.T) {
+	seed, _ := GenerateSeed()
+	file := func(version byte, meta string) []byte {
+		b := append([]byte(seedMagic), version)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(meta)))
+		return append(append(b, meta...), seed...)
+	}
+
+	// Fields a later version adds are ignored.
+	f, err := decodeSeedFile(file(SeedFileVersion, `{"kdf":{"name":"hkdf-sha256"},"color":"blue"}`))
+	if err != nil || f.Derivation != DerivationHKDF {
+		t.Fatalf("unknown field: %+v, %v", f, err)
+	}
+	for name, data := range map[string][]byte{
+		"newer version": file(SeedFileVersion+1, `{"kdf":{"name":"hkdf-sha256"}}`),
+		"unknown KDF":   file(SeedFileVersion, `{"kdf":{"name":"argon2id-v9"}}`),
+		"no KDF":        file(SeedFileVersion, `{}`),
+		"bad metadata":  file(SeedFileVersion, `{"kdf":`),
+		"truncated":     file(SeedFileVersion, `{"kdf":{"name":"hkdf-sha256"}}`)[:60],
+		"magic only":    []byte(seedMagic),
+	} {
+		if _, err := decodeSeedFile(data); err == nil {
+			t.Fatalf("%s: accepted", name)
+		}
+	}
+	if _, err := encodeSeedFile(&SeedFile{Seed: seed, Derivation: 9}); err == nil {
+		t.Fatal("encoded an unknown derivation")
+	}
+}
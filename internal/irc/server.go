@@ -0,0 +1,379 @@
+// Package irc exposes tmd through a minimal local IRC server so any IRC
+// client can be used as the frontend.
+//
+// Peers appear as IRC nicks and the broadcast audience as the #tmd channel:
+//
+//	/msg bob hi          -> sealed direct message to bob
+//	message in #tmd      -> broadcast to all online peers
+//
+// Messages tmd receives are delivered as PRIVMSG from the sender's nick
+// (direct) or in #tmd (broadcast). The connected client is renamed to the
+// local tmd nickname on registration. Only the subset of RFC 2812 needed by
+// common clients is implemented.
+package irc
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channel is the IRC channel mapped to tmd broadcasts.
+const Channel = "#tmd"
+
+const serverName = "tmd.local"
+
+// Sender delivers messages over tmd. Peers lists the nicknames currently
+// online, excluding the local one.
+type Sender interface {
+	Send(to, message string) (reply string, err error)
+	Broadcast(message string) error
+	Peers() []string
+}
+
+// Server is a running IRC listener.
+type Server struct {
+	ln       net.Listener
+	self     string
+	password string
+	sender   Sender
+	logf     func(format string, args ...any)
+
+	mu      sync.Mutex
+	clients map[*client]struct{}
+	wg      sync.WaitGroup
+}
+
+// Listen starts the IRC server on addr. As with the HTTP gateway only
+// loopback addresses are accepted, and clients must send PASS password.
+func Listen(addr, self, password string, sender Sender, logf func(string, ...any)) (*Server, error) {
+	if password == "" {
+		return nil, errors.New("irc: password is required")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("irc: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("irc: refusing non-loopback address %s", addr)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("irc: %w", err)
+	}
+	if logf == nil {
+		logf = func(string, ...any) {}
+	}
+
+	s := &Server{
+		ln:       ln,
+		self:     self,
+		password: password,
+		sender:   sender,
+		logf:     logf,
+		clients:  make(map[*client]struct{}),
+	}
+	s.wg.Add(1)
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Addr returns the listening address.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the listener and disconnects all clients.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	for c := range s.clients {
+		_ = c.conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// Relay delivers a received tmd message to every registered client. kind
+// is "direct" or "broadcast".
+func (s *Server) Relay(kind, from, text string) {
+	target := s.self
+	if kind == "broadcast" {
+		target = Channel
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		if c.registered {
+			for _, line := range strings.Split(text, "\n") {
+				c.send(prefix(from), "PRIVMSG", target, line)
+			}
+		}
+	}
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.logf("[irc] client connected from %s", conn.RemoteAddr())
+		c := &client{srv: s, conn: conn, w: bufio.NewWriter(conn)}
+		s.mu.Lock()
+		s.clients[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+			s.mu.Lock()
+			delete(s.clients, c)
+			s.mu.Unlock()
+			_ = conn.Close()
+		}()
+	}
+}
+
+func prefix(nick string) string {
+	return nick + "!" + nick + "@" + serverName
+}
+
+type client struct {
+	srv  *Server
+	conn net.Conn
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	// Registration state, owned by serve except registered, which Relay
+	// reads under srv.mu.
+	passOK     bool
+	nick       string
+	user       bool
+	registered bool
+}
+
+// send writes one IRC line; the last param is always sent as trailing.
+func (c *client) send(from, command string, params ...string) {
+	var b strings.Builder
+	if from != "" {
+		b.WriteString(":" + from + " ")
+	}
+	b.WriteString(command)
+	for i, p := range params {
+		if i == len(params)-1 {
+			b.WriteString(" :" + p)
+		} else {
+			b.WriteString(" " + p)
+		}
+	}
+	b.WriteString("\r\n")
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, _ = c.w.WriteString(b.String())
+	_ = c.w.Flush()
+}
+
+func (c *client) numeric(code string, params ...string) {
+	nick := c.nick
+	if nick == "" {
+		nick = "*"
+	}
+	c.send(serverName, code, append([]string{nick}, params...)...)
+}
+
+func (c *client) serve() {
+	sc := bufio.NewScanner(c.conn)
+	sc.Buffer(make([]byte, 0, 512), 8192)
+	for sc.Scan() {
+		cmd, params := parseLine(strings.TrimRight(sc.Text(), "\r"))
+		if cmd == "" {
+			continue
+		}
+		if !c.handle(cmd, params) {
+			return
+		}
+	}
+}
+
+// handle processes one command and reports whether the connection stays open.
+func (c *client) handle(cmd string, params []string) bool {
+	switch cmd {
+	case "CAP":
+		if len(params) > 0 && params[0] == "LS" {
+			c.send(serverName, "CAP", "*", "LS", "")
+		}
+		return true
+	case "PASS":
+		if len(params) > 0 && subtle.ConstantTimeCompare([]byte(params[0]), []byte(c.srv.password)) == 1 {
+			c.passOK = true
+		}
+		return true
+	case "NICK":
+		if len(params) == 0 {
+			c.numeric("431", "No nickname given")
+			return true
+		}
+		if c.registered {
+			// The nick is pinned to the tmd identity.
+			c.numeric("432", params[0], "Nickname is fixed to the tmd identity")
+			return true
+		}
+		c.nick = params[0]
+	case "USER":
+		c.user = true
+	case "PING":
+		c.send(serverName, "PONG", serverName, strings.Join(params, " "))
+		return true
+	case "QUIT":
+		c.send("", "ERROR", "Closing link")
+		return false
+	}
+
+	if !c.registered {
+		if c.nick == "" || !c.user {
+			if cmd != "NICK" && cmd != "USER" {
+				c.numeric("451", "You have not registered")
+			}
+			return true
+		}
+		if !c.passOK {
+			c.numeric("464", "Password incorrect")
+			c.send("", "ERROR", "Closing link (bad password)")
+			return false
+		}
+		c.register()
+		return true
+	}
+
+	switch cmd {
+	case "NICK", "USER":
+	case "JOIN":
+		if len(params) == 0 {
+			c.numeric("461", "JOIN", "Not enough parameters")
+			break
+		}
+		for _, ch := range strings.Split(params[0], ",") {
+			if ch == Channel {
+				c.join()
+			} else {
+				c.numeric("403", ch, "No such channel; tmd only has "+Channel)
+			}
+		}
+	case "PART":
+		// Leaving #tmd only hides broadcasts in the client; nothing to do.
+	case "NAMES":
+		c.names()
+	case "WHO":
+		c.who()
+	case "MODE":
+		if len(params) > 0 && params[0] == Channel {
+			c.numeric("324", Channel, "+nt")
+		}
+	case "TOPIC":
+		c.numeric("332", Channel, "tmd broadcast channel")
+	case "PRIVMSG", "NOTICE":
+		if len(params) < 2 {
+			c.numeric("412", "No text to send")
+			break
+		}
+		c.privmsg(cmd, params[0], params[1])
+	default:
+		c.numeric("421", cmd, "Unknown command")
+	}
+	return true
+}
+
+func (c *client) register() {
+	if c.nick != c.srv.self {
+		c.send(prefix(c.nick), "NICK", c.srv.self)
+		c.nick = c.srv.self
+	}
+	c.srv.mu.Lock()
+	c.registered = true
+	c.srv.mu.Unlock()
+
+	c.numeric("001", "Welcome to tmd, "+c.nick)
+	c.numeric("002", "Your host is "+serverName)
+	c.numeric("003", "Messages are end-to-end encrypted by tmd")
+	c.numeric("004", serverName, "tmd", "o", "nt")
+	c.numeric("422", "MOTD File is missing")
+	c.join()
+}
+
+func (c *client) join() {
+	c.send(prefix(c.nick), "JOIN", Channel)
+	c.numeric("332", Channel, "tmd broadcast channel")
+	c.names()
+}
+
+func (c *client) names() {
+	names := append([]string{c.nick}, c.srv.sender.Peers()...)
+	c.numeric("353", "=", Channel, strings.Join(names, " "))
+	c.numeric("366", Channel, "End of /NAMES list")
+}
+
+func (c *client) who() {
+	for _, p := range append([]string{c.nick}, c.srv.sender.Peers()...) {
+		c.numeric("352", Channel, p, serverName, serverName, p, "H", "0 "+p)
+	}
+	c.numeric("315", Channel, "End of /WHO list")
+}
+
+func (c *client) privmsg(cmd, target, text string) {
+	if target == Channel {
+		if err := c.srv.sender.Broadcast(text); err != nil {
+			c.send(serverName, "NOTICE", c.nick, "broadcast failed: "+err.Error())
+		}
+		return
+	}
+
+	if !slices.Contains(c.srv.sender.Peers(), target) {
+		c.numeric("401", target, "No such nick")
+		return
+	}
+	reply, err := c.srv.sender.Send(target, text)
+	switch {
+	case err != nil:
+		c.send(serverName, "NOTICE", c.nick, fmt.Sprintf("send to %s failed: %v", target, err))
+	case cmd == "PRIVMSG" && reply != "":
+		c.send(prefix(target), "NOTICE", c.nick, reply)
+	}
+}
+
+// parseLine splits an IRC line into its upper-cased command and params,
+// dropping any prefix.
+func parseLine(line string) (string, []string) {
+	if strings.HasPrefix(line, ":") {
+		_, rest, ok := strings.Cut(line, " ")
+		if !ok {
+			return "", nil
+		}
+		line = rest
+	}
+	var trailing *string
+	if head, t, ok := strings.Cut(line, " :"); ok {
+		line, trailing = head, &t
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	params := fields[1:]
+	if trailing != nil {
+		params = append(params, *trailing)
+	}
+	return strings.ToUpper(fields[0]), params
+}
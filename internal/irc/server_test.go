@@ -0,0 +1,143 @@
+package irc
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSender struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (f *fakeSender) Send(to, message string) (string, error) {
+	f.mu.Lock()
+	f.sent = append(f.sent, to+": "+message)
+	f.mu.Unlock()
+	return "message received", nil
+}
+
+func (f *fakeSender) Broadcast(message string) error {
+	f.mu.Lock()
+	f.sent = append(f.sent, "*: "+message)
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakeSender) Peers() []string { return []string{"bob"} }
+
+func (f *fakeSender) Sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.sent...)
+}
+
+type ircClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, s *Server) *ircClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &ircClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *ircClient) write(line string) {
+	fmt.Fprintf(c.conn, "%s\r\n", line)
+}
+
+// expect reads lines until one contains substr.
+func (c *ircClient) expect(substr string) string {
+	c.t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("waiting for %q: %v", substr, err)
+		}
+		if strings.Contains(line, substr) {
+			return line
+		}
+	}
+}
+
+func startServer(t *testing.T) (*Server, *fakeSender) {
+	t.Helper()
+	f := &fakeSender{}
+	s, err := Listen("127.0.0.1:0", "alice", "hunter2", f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, f
+}
+
+func TestRegisterAndMessage(t *testing.T) {
+	s, f := startServer(t)
+	c := dial(t, s)
+
+	c.write("CAP LS 302")
+	c.write("PASS hunter2")
+	c.write("NICK someone")
+	c.write("USER u 0 * :Real Name")
+	c.expect(":someone!someone@tmd.local NICK :alice")
+	c.expect(" 001 alice ")
+	c.expect("JOIN :#tmd")
+	c.expect(" 353 alice = #tmd :alice bob")
+
+	c.write("PRIVMSG bob :hello there")
+	c.expect(":bob!bob@tmd.local NOTICE alice :message received")
+
+	c.write("PRIVMSG #tmd :hi all")
+	c.write("PRIVMSG carol :hi")
+	c.expect(" 401 alice carol ")
+
+	if got := f.Sent(); len(got) != 2 || got[0] != "bob: hello there" || got[1] != "*: hi all" {
+		t.Fatalf("sent = %q", got)
+	}
+
+	s.Relay("direct", "bob", "psst")
+	c.expect(":bob!bob@tmd.local PRIVMSG alice :psst")
+	s.Relay("broadcast", "bob", "hello everyone")
+	c.expect(":bob!bob@tmd.local PRIVMSG #tmd :hello everyone")
+
+	c.write("PING :abc")
+	c.expect("PONG tmd.local :abc")
+}
+
+func TestBadPassword(t *testing.T) {
+	s, _ := startServer(t)
+	c := dial(t, s)
+	c.write("PASS wrong")
+	c.write("NICK alice")
+	c.write("USER u 0 * :x")
+	c.expect(" 464 ")
+	c.expect("ERROR")
+}
+
+func TestListenRejectsNonLoopback(t *testing.T) {
+	if _, err := Listen("0.0.0.0:0", "alice", "pw", &fakeSender{}, nil); err == nil {
+		t.Fatal("expected non-loopback address to be rejected")
+	}
+	if _, err := Listen("127.0.0.1:0", "alice", "", &fakeSender{}, nil); err == nil {
+		t.Fatal("expected empty password to be rejected")
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	cmd, params := parseLine(":nick!u@h privmsg #tmd :hello :world")
+	if cmd != "PRIVMSG" || len(params) != 2 || params[0] != "#tmd" || params[1] != "hello :world" {
+		t.Fatalf("got %q %q", cmd, params)
+	}
+}
@@ -0,0 +1,202 @@
+// Package jsonrpc is a small JSON-RPC 2.0 server for newline-delimited
+// streams such as stdin/stdout: every request, response and notification
+// is one JSON value on its own line.
+package jsonrpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Standard JSON-RPC 2.0 error codes.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+// MaxLine bounds the size of one incoming message.
+const MaxLine = 1 << 20
+
+// Error is a JSON-RPC error object. Handlers may return one to control the
+// code; any other error is reported as CodeInternalError.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
+// InvalidParams returns a CodeInvalidParams error.
+func InvalidParams(format string, args ...any) *Error {
+	return &Error{Code: CodeInvalidParams, Message: fmt.Sprintf(format, args...)}
+}
+
+// Handler serves one method. params is nil when the request has none.
+type Handler func(params json.RawMessage) (result any, err error)
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  any             `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type notification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+}
+
+// Server dispatches requests to registered handlers. Requests are served
+// concurrently, so responses may be written out of order.
+type Server struct {
+	methods map[string]Handler
+
+	wmu sync.Mutex
+	w   io.Writer
+}
+
+// NewServer returns a server writing responses and notifications to w.
+func NewServer(w io.Writer) *Server {
+	return &Server{methods: make(map[string]Handler), w: w}
+}
+
+// Register adds a method. It must be called before Serve.
+func (s *Server) Register(method string, h Handler) {
+	s.methods[method] = h
+}
+
+// Notify sends a server-to-client notification.
+func (s *Server) Notify(method string, params any) error {
+	return s.write(notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// Serve reads requests from r until EOF and waits for in-flight handlers.
+func (s *Server) Serve(r io.Reader) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), MaxLine)
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		line = bytes.Clone(line)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if out := s.handleMessage(line); out != nil {
+				_ = s.write(out)
+			}
+		}()
+	}
+	return sc.Err()
+}
+
+// handleMessage handles a single request or a batch and returns what to
+// write back, or nil when only notifications were received.
+func (s *Server) handleMessage(data []byte) any {
+	if data[0] != '[' {
+		var req request
+		if err := json.Unmarshal(data, &req); err != nil {
+			return errorResponse(nil, &Error{Code: CodeParseError, Message: err.Error()})
+		}
+		if resp := s.call(req); resp != nil {
+			return resp
+		}
+		return nil
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return errorResponse(nil, &Error{Code: CodeParseError, Message: err.Error()})
+	}
+	if len(batch) == 0 {
+		return errorResponse(nil, &Error{Code: CodeInvalidRequest, Message: "empty batch"})
+	}
+	var out []*response
+	for _, raw := range batch {
+		var req request
+		if err := json.Unmarshal(raw, &req); err != nil {
+			out = append(out, errorResponse(nil, &Error{Code: CodeInvalidRequest, Message: err.Error()}))
+			continue
+		}
+		if resp := s.call(req); resp != nil {
+			out = append(out, resp)
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// call runs one request; notifications (no id) get no response.
+func (s *Server) call(req request) *response {
+	isNotification := len(req.ID) == 0
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return errorResponse(req.ID, &Error{Code: CodeInvalidRequest, Message: "invalid request"})
+	}
+	h, ok := s.methods[req.Method]
+	if !ok {
+		if isNotification {
+			return nil
+		}
+		return errorResponse(req.ID, &Error{Code: CodeMethodNotFound, Message: "method not found: " + req.Method})
+	}
+
+	result, err := h(req.Params)
+	if isNotification {
+		return nil
+	}
+	if err != nil {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &Error{Code: CodeInternalError, Message: err.Error()}
+		}
+		return errorResponse(req.ID, rpcErr)
+	}
+	if result == nil {
+		result = struct{}{}
+	}
+	return &response{JSONRPC: "2.0", Result: result, ID: req.ID}
+}
+
+func errorResponse(id json.RawMessage, err *Error) *response {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &response{JSONRPC: "2.0", Error: err, ID: id}
+}
+
+func (s *Server) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
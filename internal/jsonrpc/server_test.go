@@ -0,0 +1,92 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newTestServer(out *bytes.Buffer) *Server {
+	s := NewServer(out)
+	s.Register("echo", func(params json.RawMessage) (any, error) {
+		var p struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, InvalidParams("%v", err)
+		}
+		return p, nil
+	})
+	s.Register("fail", func(json.RawMessage) (any, error) {
+		return nil, errors.New("boom")
+	})
+	return s
+}
+
+func serve(t *testing.T, input string) []string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := newTestServer(&out).Serve(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	sort.Strings(lines)
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	return lines
+}
+
+func TestServe(t *testing.T) {
+	got := serve(t, strings.Join([]string{
+		`{"jsonrpc":"2.0","id":1,"method":"echo","params":{"text":"hi"}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"nope"}`,
+		`{"jsonrpc":"2.0","id":"x","method":"fail"}`,
+		`{"jsonrpc":"2.0","method":"echo","params":{"text":"notification"}}`,
+		`{not json`,
+		`{"jsonrpc":"2.0","id":3,"method":"echo","params":[1]}`,
+	}, "\n"))
+
+	want := []string{
+		`{"jsonrpc":"2.0","error":{"code":-32601,"message":"method not found: nope"},"id":2}`,
+		`{"jsonrpc":"2.0","error":{"code":-32603,"message":"boom"},"id":"x"}`,
+		`{"jsonrpc":"2.0","result":{"text":"hi"},"id":1}`,
+	}
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			found = found || g == w
+		}
+		if !found {
+			t.Errorf("missing %s in\n%s", w, strings.Join(got, "\n"))
+		}
+	}
+	if len(got) != 5 {
+		t.Fatalf("expected 5 responses (notification unanswered), got %d:\n%s", len(got), strings.Join(got, "\n"))
+	}
+	joined := strings.Join(got, "\n")
+	if !strings.Contains(joined, `"code":-32700`) || !strings.Contains(joined, `"code":-32602`) {
+		t.Fatalf("missing parse/params errors:\n%s", joined)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	got := serve(t, `[{"jsonrpc":"2.0","id":1,"method":"echo","params":{"text":"a"}},{"jsonrpc":"2.0","method":"echo","params":{"text":"b"}}]`)
+	if len(got) != 1 || got[0] != `[{"jsonrpc":"2.0","result":{"text":"a"},"id":1}]` {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	var out bytes.Buffer
+	s := NewServer(&out)
+	if err := s.Notify("message", map[string]string{"from": "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != `{"jsonrpc":"2.0","method":"message","params":{"from":"bob"}}`+"\n" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,74 @@
+// Package keyid defines the fingerprint naming an HPKE public key, shared
+// by the identity, node and peer wire formats.
+package keyid
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Size is the size of a KeyID in bytes.
+const Size = 8
+
+// LegacySize is the size of the key IDs of peers predating 8-byte KeyIDs:
+// the single byte twoway carries in its HPKE framing.
+const LegacySize = 1
+
+// KeyID is the first Size bytes of the SHA-256 of an HPKE public key. It
+// stays a byte slice so that it goes on the wire and into JSON as before.
+type KeyID []byte
+
+// Of returns the KeyID of an HPKE public key.
+func Of(hpkePub []byte) KeyID {
+	sum := sha256.Sum256(hpkePub)
+	return KeyID(sum[:Size])
+}
+
+// Valid reports whether b is a full KeyID.
+func Valid(b []byte) bool {
+	return len(b) == Size
+}
+
+// ValidOrLegacy reports whether b is a full KeyID or the key ID of a peer
+// predating them.
+func ValidOrLegacy(b []byte) bool {
+	return len(b) == Size || len(b) == LegacySize
+}
+
+// Resolve returns the KeyID a peer sent along with hpkePub: a full one as
+// is, a legacy one widened from hpkePub once its byte is checked.
+func Resolve(b, hpkePub []byte) (KeyID, error) {
+	switch len(b) {
+	case Size:
+		return KeyID(b), nil
+	case LegacySize:
+		k := Of(hpkePub)
+		if k[0] != b[0] {
+			return nil, fmt.Errorf("legacy keyID %x is not that of the HPKE key", b)
+		}
+		return k, nil
+	default:
+		return nil, fmt.Errorf("bad keyID length: %d", len(b))
+	}
+}
+
+// Matches reports whether b names k: k itself or, from peers predating
+// full KeyIDs, its legacy byte.
+func (k KeyID) Matches(b []byte) bool {
+	if len(b) == LegacySize {
+		return len(k) > 0 && k[0] == b[0]
+	}
+	return bytes.Equal(k, b)
+}
+
+// Short returns the byte twoway carries in its HPKE framing to name the
+// recipient's key.
+func (k KeyID) Short() byte {
+	return k[0]
+}
+
+func (k KeyID) String() string {
+	return hex.EncodeToString(k)
+}
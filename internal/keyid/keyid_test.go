@@ -0,0 +1,54 @@
+package keyid
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestOf(t *testing.T) {
+	pub := []byte("an HPKE public key")
+	sum := sha256.Sum256(pub)
+	k := Of(pub)
+	if len(k) != Size || !bytes.Equal(k, sum[:Size]) {
+		t.Fatalf("Of = %x, want %x", k, sum[:Size])
+	}
+	if k.Short() != sum[0] || k.String() != hex.EncodeToString(sum[:Size]) {
+		t.Fatalf("Short = %x, String = %q", k.Short(), k.String())
+	}
+}
+
+func TestResolve(t *testing.T) {
+	pub := []byte("an HPKE public key")
+	k := Of(pub)
+
+	if got, err := Resolve(k, pub); err != nil || !bytes.Equal(got, k) {
+		t.Fatalf("Resolve(full) = %x, %v", got, err)
+	}
+	if got, err := Resolve([]byte{k[0]}, pub); err != nil || !bytes.Equal(got, k) {
+		t.Fatalf("Resolve(legacy) = %x, %v; want it widened", got, err)
+	}
+	if _, err := Resolve([]byte{k[0] + 1}, pub); err == nil {
+		t.Fatal("a legacy keyID of another key was widened")
+	}
+	for _, n := range []int{0, 2, Size - 1, Size + 1} {
+		if _, err := Resolve(make([]byte, n), pub); err == nil {
+			t.Fatalf("a keyID of %d bytes was accepted", n)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	k := Of([]byte("an HPKE public key"))
+	if !k.Matches(k) || !k.Matches([]byte{k[0]}) {
+		t.Fatal("k does not match itself or its legacy byte")
+	}
+	other := Of([]byte("another key"))
+	if k.Matches(other) || k.Matches([]byte{k[0] + 1}) || k.Matches(nil) || k.Matches(k[:2]) {
+		t.Fatal("k matches another keyID")
+	}
+	if !Valid(k) || Valid(k[:1]) || !ValidOrLegacy(k[:1]) || ValidOrLegacy(k[:2]) {
+		t.Fatal("Valid/ValidOrLegacy disagree with the sizes")
+	}
+}
@@ -0,0 +1,211 @@
+// Package mailnotify emails a summary of direct messages that arrive while
+// the user is away from the terminal.
+//
+// The user is considered idle once no input has been typed for
+// Config.IdleAfter. Messages received while idle are collected for
+// Config.BatchWindow and then sent as a single email, so a burst of
+// messages produces one notification. Whether message text is included is
+// a privacy choice (Config.IncludeContent); by default only the sender and
+// time are mailed.
+package mailnotify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults applied to zero Config fields.
+const (
+	DefaultIdleAfter   = 15 * time.Minute
+	DefaultBatchWindow = time.Minute
+)
+
+// Config describes the SMTP relay and the notification policy.
+type Config struct {
+	SMTP           string   `json:"smtp"` // host:port of the submission server
+	Username       string   `json:"username"`
+	From           string   `json:"from"`
+	To             []string `json:"to"`
+	IdleAfter      Duration `json:"idle_after"`
+	BatchWindow    Duration `json:"batch_window"`
+	IncludeContent bool     `json:"include_content"`
+
+	// Password is not read from the file; see LoadConfig.
+	Password string `json:"-"`
+}
+
+// Duration is a time.Duration that unmarshals from strings like "10m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// LoadConfig reads a JSON config; the SMTP password comes from the
+// TMD_SMTP_PASSWORD environment variable so it stays out of files.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read email config: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse email config: %w", err)
+	}
+	if cfg.SMTP == "" || cfg.From == "" || len(cfg.To) == 0 {
+		return nil, errors.New("email config: smtp, from and to are required")
+	}
+	cfg.Password = os.Getenv("TMD_SMTP_PASSWORD")
+	return &cfg, nil
+}
+
+// SendFunc matches smtp.SendMail; tests substitute it.
+type SendFunc func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+
+type pending struct {
+	from string
+	text string
+	at   time.Time
+}
+
+// Notifier tracks user activity and mails batched summaries.
+type Notifier struct {
+	cfg      Config
+	send     SendFunc
+	identity string // local nickname, used in the subject
+	onError  func(error)
+
+	mu       sync.Mutex
+	lastSeen time.Time
+	batch    []pending
+	timer    *time.Timer
+	now      func() time.Time
+}
+
+// New creates a notifier for the local identity nickname. onError receives
+// delivery failures and may be nil.
+func New(cfg Config, nickname string, onError func(error)) *Notifier {
+	if cfg.IdleAfter <= 0 {
+		cfg.IdleAfter = Duration(DefaultIdleAfter)
+	}
+	if cfg.BatchWindow <= 0 {
+		cfg.BatchWindow = Duration(DefaultBatchWindow)
+	}
+	if onError == nil {
+		onError = func(error) {}
+	}
+	return &Notifier{
+		cfg:      cfg,
+		send:     smtp.SendMail,
+		identity: nickname,
+		onError:  onError,
+		lastSeen: time.Now(),
+		now:      time.Now,
+	}
+}
+
+// Touch records user activity.
+func (n *Notifier) Touch() {
+	n.mu.Lock()
+	n.lastSeen = n.now()
+	n.mu.Unlock()
+}
+
+// Idle reports whether the user has been inactive beyond the threshold.
+func (n *Notifier) Idle() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.now().Sub(n.lastSeen) >= time.Duration(n.cfg.IdleAfter)
+}
+
+// DirectMessage records a received direct message; if the user is idle it
+// is added to the pending batch, which is mailed after the batch window.
+func (n *Notifier) DirectMessage(from, text string) {
+	if !n.Idle() {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.batch = append(n.batch, pending{from: from, text: text, at: n.now()})
+	if n.timer == nil {
+		n.timer = time.AfterFunc(time.Duration(n.cfg.BatchWindow), n.Flush)
+	}
+}
+
+// Flush mails the pending batch immediately, if any.
+func (n *Notifier) Flush() {
+	n.mu.Lock()
+	batch := n.batch
+	n.batch = nil
+	if n.timer != nil {
+		n.timer.Stop()
+		n.timer = nil
+	}
+	n.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+	if err := n.deliver(batch); err != nil {
+		n.onError(err)
+	}
+}
+
+func (n *Notifier) deliver(batch []pending) error {
+	var auth smtp.Auth
+	if n.cfg.Username != "" {
+		host, _, err := net.SplitHostPort(n.cfg.SMTP)
+		if err != nil {
+			return fmt.Errorf("email: %w", err)
+		}
+		auth = smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, host)
+	}
+	return n.send(n.cfg.SMTP, auth, n.cfg.From, n.cfg.To, n.compose(batch))
+}
+
+func (n *Notifier) compose(batch []pending) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", n.cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(n.cfg.To, ", "))
+	fmt.Fprintf(&b, "Subject: [tmd] %d new direct message(s) for %s\r\n", len(batch), n.identity)
+	fmt.Fprintf(&b, "Date: %s\r\n", n.now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	fmt.Fprintf(&b, "You received %d direct message(s) while away:\r\n\r\n", len(batch))
+	for _, p := range batch {
+		fmt.Fprintf(&b, "- %s from %s", p.at.Format("2006-01-02 15:04:05"), sanitize(p.from))
+		if n.cfg.IncludeContent {
+			fmt.Fprintf(&b, ": %s", sanitize(p.text))
+		}
+		b.WriteString("\r\n")
+	}
+	if !n.cfg.IncludeContent {
+		b.WriteString("\r\nMessage contents are not included; open tmd to read them.\r\n")
+	}
+	return b.Bytes()
+}
+
+// sanitize keeps peer-controlled text on one line so it cannot inject
+// headers or break the body layout.
+func sanitize(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
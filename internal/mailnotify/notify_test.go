@@ -0,0 +1,102 @@
+package mailnotify
+
+import (
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type captured struct {
+	mu   sync.Mutex
+	msgs []string
+	to   [][]string
+}
+
+func (c *captured) send(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, string(msg))
+	c.to = append(c.to, to)
+	return nil
+}
+
+func newTestNotifier(include bool) (*Notifier, *captured, *time.Time) {
+	c := &captured{}
+	now := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	n := New(Config{
+		SMTP:           "localhost:25",
+		From:           "tmd@example.org",
+		To:             []string{"me@example.org"},
+		IdleAfter:      Duration(10 * time.Minute),
+		BatchWindow:    Duration(time.Hour), // flushed manually in tests
+		IncludeContent: include,
+	}, "alice", nil)
+	n.send = c.send
+	n.now = func() time.Time { return now }
+	n.Touch()
+	return n, c, &now
+}
+
+func TestNoMailWhileActive(t *testing.T) {
+	n, c, _ := newTestNotifier(true)
+	n.DirectMessage("bob", "hi")
+	n.Flush()
+	if len(c.msgs) != 0 {
+		t.Fatalf("mailed while active: %q", c.msgs)
+	}
+}
+
+func TestBatchWhileIdle(t *testing.T) {
+	n, c, now := newTestNotifier(false)
+	*now = now.Add(11 * time.Minute)
+
+	n.DirectMessage("bob", "secret plan")
+	n.DirectMessage("carol", "hello\r\nBcc: evil@example.org")
+	n.Flush()
+
+	if len(c.msgs) != 1 {
+		t.Fatalf("expected one summary mail, got %d", len(c.msgs))
+	}
+	msg := c.msgs[0]
+	if !strings.Contains(msg, "Subject: [tmd] 2 new direct message(s) for alice") {
+		t.Fatalf("bad subject: %s", msg)
+	}
+	if !strings.Contains(msg, "from bob") || !strings.Contains(msg, "from carol") {
+		t.Fatalf("senders missing: %s", msg)
+	}
+	if strings.Contains(msg, "secret plan") {
+		t.Fatalf("content leaked with include_content=false: %s", msg)
+	}
+}
+
+func TestIncludeContentSanitized(t *testing.T) {
+	n, c, now := newTestNotifier(true)
+	*now = now.Add(time.Hour)
+
+	n.DirectMessage("carol", "hello\r\nBcc: evil@example.org")
+	n.Flush()
+
+	if len(c.msgs) != 1 {
+		t.Fatalf("expected one mail, got %d", len(c.msgs))
+	}
+	if !strings.Contains(c.msgs[0], "from carol: hello  Bcc: evil@example.org") {
+		t.Fatalf("content not included on one line: %s", c.msgs[0])
+	}
+	if strings.Contains(c.msgs[0], "\r\nBcc:") {
+		t.Fatal("header injection")
+	}
+}
+
+func TestTouchResetsIdle(t *testing.T) {
+	n, _, now := newTestNotifier(false)
+	*now = now.Add(time.Hour)
+	if !n.Idle() {
+		t.Fatal("expected idle")
+	}
+	n.Touch()
+	if n.Idle() {
+		t.Fatal("expected active after Touch")
+	}
+}
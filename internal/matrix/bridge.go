@@ -0,0 +1,307 @@
+// Package matrix bridges tmd peers to a Matrix room using the
+// application-service API.
+//
+// Each tmd peer is represented in Matrix by a virtual ("puppet") user,
+// @<prefix><nickname>:<server>, owned by the application service. Messages
+// received by the local tmd client are posted to the bridged room as the
+// sender's puppet; messages written by Matrix users in that room are
+// relayed to tmd: "@bob text" goes to bob as a direct message, anything
+// else is broadcast to every online peer.
+//
+// The homeserver must be configured with a registration file whose
+// as_token/hs_token match Config and whose user namespace covers the
+// puppet prefix.
+package matrix
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config describes the homeserver and the bridged room.
+type Config struct {
+	Homeserver string `json:"homeserver"`  // e.g. https://matrix.example.org
+	ServerName string `json:"server_name"` // e.g. example.org
+	ASToken    string `json:"as_token"`    // token the bridge presents to the homeserver
+	HSToken    string `json:"hs_token"`    // token the homeserver presents to the bridge
+	Listen     string `json:"listen"`      // address for the AS API, e.g. 127.0.0.1:9009
+	Room       string `json:"room"`        // bridged room ID, e.g. !abc:example.org
+	UserPrefix string `json:"user_prefix"` // puppet localpart prefix, default "tmd_"
+}
+
+// LoadConfig reads a JSON bridge config.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read matrix config: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse matrix config: %w", err)
+	}
+	if cfg.UserPrefix == "" {
+		cfg.UserPrefix = "tmd_"
+	}
+	if cfg.Homeserver == "" || cfg.ServerName == "" || cfg.ASToken == "" || cfg.HSToken == "" || cfg.Room == "" {
+		return nil, fmt.Errorf("matrix config: homeserver, server_name, as_token, hs_token and room are required")
+	}
+	return &cfg, nil
+}
+
+// Sender delivers Matrix-originated messages into tmd.
+type Sender interface {
+	Send(to, message string) (reply string, err error)
+	Broadcast(message string) error
+}
+
+// Bridge relays messages between one Matrix room and tmd.
+type Bridge struct {
+	cfg    Config
+	sender Sender
+	client *http.Client
+	logf   func(format string, args ...any)
+
+	txnCounter atomic.Uint64
+
+	mu      sync.Mutex
+	seenTxn map[string]bool // homeserver transaction IDs already processed
+	joined  map[string]bool // puppet user IDs registered and joined
+}
+
+// New creates a bridge. logf receives diagnostic lines and may be nil.
+func New(cfg Config, sender Sender, logf func(format string, args ...any)) *Bridge {
+	if cfg.UserPrefix == "" {
+		cfg.UserPrefix = "tmd_"
+	}
+	if logf == nil {
+		logf = func(string, ...any) {}
+	}
+	return &Bridge{
+		cfg:     cfg,
+		sender:  sender,
+		client:  &http.Client{Timeout: 15 * time.Second},
+		logf:    logf,
+		seenTxn: make(map[string]bool),
+		joined:  make(map[string]bool),
+	}
+}
+
+// PuppetID returns the Matrix user ID representing a tmd nickname.
+func (b *Bridge) PuppetID(nickname string) string {
+	return "@" + b.cfg.UserPrefix + strings.ToLower(nickname) + ":" + b.cfg.ServerName
+}
+
+func (b *Bridge) isPuppet(userID string) bool {
+	return strings.HasPrefix(userID, "@"+b.cfg.UserPrefix) && strings.HasSuffix(userID, ":"+b.cfg.ServerName)
+}
+
+// -------------------- Homeserver -> bridge --------------------
+
+type transaction struct {
+	Events []event `json:"events"`
+}
+
+type event struct {
+	Type    string          `json:"type"`
+	RoomID  string          `json:"room_id"`
+	Sender  string          `json:"sender"`
+	Content json.RawMessage `json:"content"`
+}
+
+type messageContent struct {
+	MsgType string `json:"msgtype"`
+	Body    string `json:"body"`
+}
+
+// Handler serves the application-service API the homeserver pushes to.
+func (b *Bridge) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /_matrix/app/v1/transactions/{txnId}", b.handleTransaction)
+	// Puppets are created on demand, so user and alias queries only need
+	// to acknowledge users in our namespace.
+	mux.HandleFunc("GET /_matrix/app/v1/users/{userId}", func(w http.ResponseWriter, r *http.Request) {
+		if b.isPuppet(r.PathValue("userId")) {
+			writeJSON(w, http.StatusOK, struct{}{})
+			return
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"errcode": "M_NOT_FOUND"})
+	})
+	mux.HandleFunc("GET /_matrix/app/v1/rooms/{alias}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"errcode": "M_NOT_FOUND"})
+	})
+	return b.requireHSToken(mux)
+}
+
+func (b *Bridge) requireHSToken(next http.Handler) http.Handler {
+	want := []byte("Bearer " + b.cfg.HSToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeJSON(w, http.StatusForbidden, map[string]string{"errcode": "M_FORBIDDEN"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (b *Bridge) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	txnID := r.PathValue("txnId")
+
+	var txn transaction
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<20)).Decode(&txn); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"errcode": "M_NOT_JSON"})
+		return
+	}
+
+	// Homeservers retry transactions until acknowledged; process each once.
+	b.mu.Lock()
+	seen := b.seenTxn[txnID]
+	b.seenTxn[txnID] = true
+	b.mu.Unlock()
+
+	if !seen {
+		for _, ev := range txn.Events {
+			b.handleEvent(ev)
+		}
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (b *Bridge) handleEvent(ev event) {
+	if ev.Type != "m.room.message" || ev.RoomID != b.cfg.Room || b.isPuppet(ev.Sender) {
+		return
+	}
+	var content messageContent
+	if err := json.Unmarshal(ev.Content, &content); err != nil || content.Body == "" {
+		return
+	}
+
+	text := fmt.Sprintf("<%s> %s", ev.Sender, content.Body)
+	if strings.HasPrefix(content.Body, "@") {
+		to, msg, ok := strings.Cut(strings.TrimPrefix(content.Body, "@"), " ")
+		if ok && strings.TrimSpace(msg) != "" {
+			// Deliver in the background: the transaction must be
+			// acknowledged quickly and the peer may be slow to answer.
+			go func() {
+				if _, err := b.sender.Send(to, fmt.Sprintf("<%s> %s", ev.Sender, strings.TrimSpace(msg))); err != nil {
+					b.logf("[matrix] relay to %s failed: %v", to, err)
+					b.notice(fmt.Sprintf("could not deliver to %s: %v", to, err))
+				}
+			}()
+			return
+		}
+	}
+
+	go func() {
+		if err := b.sender.Broadcast(text); err != nil {
+			b.logf("[matrix] broadcast failed: %v", err)
+		}
+	}()
+}
+
+// -------------------- tmd -> Matrix --------------------
+
+// Relay posts a message received from a tmd peer into the bridged room as
+// that peer's puppet user.
+func (b *Bridge) Relay(ctx context.Context, from, text string) error {
+	userID := b.PuppetID(from)
+	if err := b.ensurePuppet(ctx, from, userID); err != nil {
+		return err
+	}
+	return b.sendMessage(ctx, userID, text)
+}
+
+// notice posts a bridge status message as the application service bot.
+func (b *Bridge) notice(text string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	_ = b.sendMessage(ctx, "", text)
+}
+
+func (b *Bridge) ensurePuppet(ctx context.Context, nickname, userID string) error {
+	b.mu.Lock()
+	ok := b.joined[userID]
+	b.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	// Register the puppet; M_USER_IN_USE means it already exists.
+	reg := map[string]string{"type": "m.login.application_service", "username": b.cfg.UserPrefix + strings.ToLower(nickname)}
+	status, body, err := b.call(ctx, http.MethodPost, "/_matrix/client/v3/register", "", reg)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && !bytes.Contains(body, []byte("M_USER_IN_USE")) {
+		return fmt.Errorf("register %s: %d %s", userID, status, body)
+	}
+
+	status, body, err = b.call(ctx, http.MethodPost, "/_matrix/client/v3/rooms/"+url.PathEscape(b.cfg.Room)+"/join", userID, struct{}{})
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("join %s as %s: %d %s", b.cfg.Room, userID, status, body)
+	}
+
+	b.mu.Lock()
+	b.joined[userID] = true
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *Bridge) sendMessage(ctx context.Context, userID, text string) error {
+	txn := fmt.Sprintf("tmd%d.%d", time.Now().UnixNano(), b.txnCounter.Add(1))
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(b.cfg.Room) + "/send/m.room.message/" + txn
+	status, body, err := b.call(ctx, http.MethodPut, path, userID, messageContent{MsgType: "m.text", Body: text})
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("send to %s: %d %s", b.cfg.Room, status, body)
+	}
+	return nil
+}
+
+// call performs a client-server API request as the application service,
+// optionally masquerading as userID.
+func (b *Bridge) call(ctx context.Context, method, path, userID string, payload any) (int, []byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	u := strings.TrimSuffix(b.cfg.Homeserver, "/") + path
+	if userID != "" {
+		u += "?user_id=" + url.QueryEscape(userID)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.cfg.ASToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, body, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,159 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSender struct {
+	mu         sync.Mutex
+	direct     []string
+	broadcasts []string
+	done       chan struct{}
+}
+
+func newFakeSender() *fakeSender { return &fakeSender{done: make(chan struct{}, 10)} }
+
+func (f *fakeSender) Send(to, message string) (string, error) {
+	f.mu.Lock()
+	f.direct = append(f.direct, to+": "+message)
+	f.mu.Unlock()
+	f.done <- struct{}{}
+	return "message received", nil
+}
+
+func (f *fakeSender) Broadcast(message string) error {
+	f.mu.Lock()
+	f.broadcasts = append(f.broadcasts, message)
+	f.mu.Unlock()
+	f.done <- struct{}{}
+	return nil
+}
+
+func testConfig(hs string) Config {
+	return Config{
+		Homeserver: hs,
+		ServerName: "example.org",
+		ASToken:    "as-secret",
+		HSToken:    "hs-secret",
+		Room:       "!room:example.org",
+		UserPrefix: "tmd_",
+	}
+}
+
+func putTxn(t *testing.T, h http.Handler, txnID, token string, events ...event) int {
+	t.Helper()
+	body, _ := json.Marshal(transaction{Events: events})
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/"+txnID, strings.NewReader(string(body)))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func textEvent(sender, body string) event {
+	content, _ := json.Marshal(messageContent{MsgType: "m.text", Body: body})
+	return event{Type: "m.room.message", RoomID: "!room:example.org", Sender: sender, Content: content}
+}
+
+func wait(t *testing.T, f *fakeSender) {
+	t.Helper()
+	select {
+	case <-f.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("sender not called")
+	}
+}
+
+func TestTransactionRelaysToTmd(t *testing.T) {
+	f := newFakeSender()
+	b := New(testConfig("http://unused"), f, nil)
+	h := b.Handler()
+
+	if code := putTxn(t, h, "1", "wrong"); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for bad hs_token, got %d", code)
+	}
+
+	code := putTxn(t, h, "2", "hs-secret",
+		textEvent("@dave:example.org", "@bob are you there?"),
+	)
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	wait(t, f)
+
+	// Retried transaction and puppet echo must be ignored.
+	putTxn(t, h, "2", "hs-secret", textEvent("@dave:example.org", "@bob are you there?"))
+	putTxn(t, h, "3", "hs-secret", textEvent("@tmd_alice:example.org", "echo"))
+
+	putTxn(t, h, "4", "hs-secret", textEvent("@dave:example.org", "hello everyone"))
+	wait(t, f)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.direct) != 1 || f.direct[0] != "bob: <@dave:example.org> are you there?" {
+		t.Fatalf("unexpected direct sends: %q", f.direct)
+	}
+	if len(f.broadcasts) != 1 || f.broadcasts[0] != "<@dave:example.org> hello everyone" {
+		t.Fatalf("unexpected broadcasts: %q", f.broadcasts)
+	}
+}
+
+func TestRelayPostsAsPuppet(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	var sent messageContent
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer as-secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.Path+" "+r.URL.Query().Get("user_id"))
+		mu.Unlock()
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/register"):
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"errcode":"M_USER_IN_USE"}`)
+		case strings.Contains(r.URL.Path, "/send/"):
+			_ = json.NewDecoder(r.Body).Decode(&sent)
+			io.WriteString(w, `{"event_id":"$1"}`)
+		default:
+			io.WriteString(w, `{}`)
+		}
+	}))
+	defer hs.Close()
+
+	b := New(testConfig(hs.URL), newFakeSender(), nil)
+	if err := b.Relay(context.Background(), "Alice", "hi from tmd"); err != nil {
+		t.Fatalf("Relay: %v", err)
+	}
+	if err := b.Relay(context.Background(), "Alice", "again"); err != nil {
+		t.Fatalf("Relay: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// register + join happen once, then one send per message.
+	if len(calls) != 4 {
+		t.Fatalf("unexpected calls: %q", calls)
+	}
+	if !strings.HasSuffix(calls[1], "/join @tmd_alice:example.org") {
+		t.Fatalf("join not masqueraded: %q", calls[1])
+	}
+	if !strings.Contains(calls[2], "/send/m.room.message/") || !strings.HasSuffix(calls[2], "@tmd_alice:example.org") {
+		t.Fatalf("send not masqueraded: %q", calls[2])
+	}
+	if sent.Body != "again" || sent.MsgType != "m.text" {
+		t.Fatalf("unexpected content: %+v", sent)
+	}
+}
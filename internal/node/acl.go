@@ -0,0 +1,81 @@
+package node
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ACL restricts which peers a node reveals to each other. Peers in a
+// common group always see each other; Allow rules open visibility across
+// groups. A node with an ACL only announces to a peer the peers it may
+// see, so several isolated teams can share one node. Messaging needs the
+// keys and addresses learnt through discovery, so hiding a peer also keeps
+// others from reaching it unless they obtained its contact card out of
+// band.
+type ACL struct {
+	Groups map[string][]string `json:"groups"` // group -> nicknames
+	Allow  []ACLRule           `json:"allow"`
+}
+
+// ACLRule lets From see To. Both are a nickname, "@group" or "*".
+// Rules are one-way: add the reverse rule for mutual visibility.
+type ACLRule struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (a *ACL) validate() error {
+	for _, r := range a.Allow {
+		for _, sel := range []string{r.From, r.To} {
+			if sel == "" {
+				return fmt.Errorf("acl rule %s -> %s: empty selector", r.From, r.To)
+			}
+			if g, ok := strings.CutPrefix(sel, "@"); ok {
+				if _, ok := a.Groups[g]; !ok {
+					return fmt.Errorf("acl rule %s -> %s: unknown group %q", r.From, r.To, g)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// CanSee reports whether viewer may discover target. A nil ACL allows
+// everything. Devices (see DeviceName) are seen as their nickname.
+func (a *ACL) CanSee(viewer, target string) bool {
+	viewer, _ = SplitDevice(viewer)
+	target, _ = SplitDevice(target)
+	if a == nil || viewer == target {
+		return true
+	}
+	for _, members := range a.Groups {
+		if contains(members, viewer) && contains(members, target) {
+			return true
+		}
+	}
+	for _, r := range a.Allow {
+		if a.matches(r.From, viewer) && a.matches(r.To, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ACL) matches(selector, nickname string) bool {
+	if selector == "*" {
+		return true
+	}
+	if g, ok := strings.CutPrefix(selector, "@"); ok {
+		return contains(a.Groups[g], nickname)
+	}
+	return selector == nickname
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
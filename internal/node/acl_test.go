@@ -0,0 +1,97 @@
+package node
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestACLCanSee(t *testing.T) {
+	acl := &ACL{
+		Groups: map[string][]string{
+			"red":  {"alice", "bob"},
+			"blue": {"carol"},
+			"ops":  {"oscar"},
+		},
+		Allow: []ACLRule{
+			{From: "@ops", To: "*"},
+			{From: "carol", To: "bob"},
+		},
+	}
+	tests := []struct {
+		viewer, target string
+		want           bool
+	}{
+		{"alice", "bob", true},      // same group
+		{"alice", "carol", false},   // isolated teams
+		{"carol", "bob", true},      // one-way rule
+		{"bob", "carol", false},     // ...not the reverse
+		{"oscar", "carol", true},    // group wildcard
+		{"alice", "oscar", false},   // ops is not visible back
+		{"mallory", "alice", false}, // not in any group
+		{"alice", "alice", true},
+	}
+	for _, tt := range tests {
+		if got := acl.CanSee(tt.viewer, tt.target); got != tt.want {
+			t.Errorf("CanSee(%s, %s) = %v, want %v", tt.viewer, tt.target, got, tt.want)
+		}
+	}
+
+	var none *ACL
+	if !none.CanSee("alice", "carol") {
+		t.Error("nil ACL must allow everything")
+	}
+}
+
+func TestLoadConfigRejectsUnknownGroup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.json")
+	cfg := `{"peers": {"alice": "t"}, "acl": {"groups": {"red": ["alice"]}, "allow": [{"from": "@blue", "to": "*"}]}}`
+	if err := os.WriteFile(path, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("LoadConfig accepted a rule on an unknown group")
+	}
+}
+
+func TestServerFiltersByACL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &Config{
+		Peers: map[string]string{"alice": "ta", "bob": "tb", "carol": "tc"},
+		ACL:   &ACL{Groups: map[string][]string{"red": {"alice", "bob"}, "blue": {"carol"}}},
+	}
+	srv := NewServer(newTestHost(t), cfg)
+
+	connect := func(nick, token string) (*Client, recordingHandler) {
+		events := make(recordingHandler, 16)
+		c := NewClient(newTestHost(t), nick, token, []byte(nick+"-hpke"), make([]byte, 8), events)
+		if err := c.Connect(ctx, nodeAddr(srv)); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		return c, events
+	}
+
+	_, aliceEvents := connect("alice", "ta")
+	carol, carolEvents := connect("carol", "tc")
+	bob, _ := connect("bob", "tb")
+
+	aliceEvents.expect(t, peerEvent{true, "bob"}, 2*time.Second)
+	if peers := bob.GetAllPeers(); len(peers) != 1 || peers[0].Nickname != "alice" {
+		t.Fatalf("bob's peer list = %+v, want only alice", peers)
+	}
+	if peers := carol.GetAllPeers(); len(peers) != 0 {
+		t.Fatalf("carol's peer list = %+v, want empty", peers)
+	}
+	select {
+	case ev := <-carolEvents:
+		t.Fatalf("carol got %+v from another team", ev)
+	case ev := <-aliceEvents:
+		t.Fatalf("alice got unexpected %+v", ev)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
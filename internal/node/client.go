@@ -3,13 +3,16 @@ package node
 import (
 	"context"
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
+	"github.com/pivaldi/tmd/internal/keyid"
 )
 
 // Client connects to one or more discovery nodes.
@@ -18,11 +21,17 @@ type Client struct {
 	nickname string
 	token    string
 	hpkePub  []byte
-	keyID    []byte // 8-byte key fingerprint
+	keyID    keyid.KeyID
 
 	mu      sync.RWMutex
-	nodes   map[peer.ID]*nodeConn    // node PeerID -> connection
-	peers   map[string]*TrackedPeer  // nickname -> peer info
+	nodes   map[peer.ID]*nodeConn           // node PeerID -> connection
+	peers   map[string]*TrackedPeer         // nickname -> peer info
+	filter  PresenceFilter                  // presence subscription
+	status  string                          // our presence, sent on registration
+	profile []byte                          // our signed profile, sent on registration
+	keySig  []byte                          // our HPKE key signed (see KeySignInput), sent on registration
+	revokes [][]byte                        // our revocation statements, sent on registration
+	rooms   map[string]map[peer.ID][]string // joined room -> node -> members
 	handler PeerHandler
 }
 
@@ -40,6 +49,42 @@ type PeerHandler interface {
 	OnNodeDisconnected(nodeID peer.ID)
 }
 
+// PeerUpdateHandler is optionally implemented by a PeerHandler to hear
+// about peers whose addresses changed while they stayed online.
+type PeerUpdateHandler interface {
+	OnPeerUpdated(info PeerInfo, nodeID peer.ID)
+}
+
+// RoomHandler is optionally implemented by a PeerHandler to hear about the
+// membership of joined rooms. members merges what every connected node
+// reports and includes this client.
+type RoomHandler interface {
+	OnRoomMembers(room string, members []string)
+}
+
+// RevocationHandler is optionally implemented by a PeerHandler to receive
+// the revocation statements peers published (see Client.Revoke), ours
+// included. Every node pushes the ones it keeps, on registration and as
+// they are published, so the same statement may arrive more than once.
+type RevocationHandler interface {
+	OnRevocation(from string, statement []byte, nodeID peer.ID)
+}
+
+// AuthFailureHandler is optionally implemented by a PeerHandler to hear
+// when a node refuses to register this client, or sends a registration
+// challenge it cannot answer.
+type AuthFailureHandler interface {
+	OnAuthFailure(nodeID peer.ID, reason string)
+}
+
+// MailHandler is optionally implemented by a PeerHandler to receive the
+// payloads other peers deposited for this client (see Client.Deposit).
+// Every node holding a copy pushes it, so the same payload may arrive more
+// than once.
+type MailHandler interface {
+	OnMail(from string, data []byte, nodeID peer.ID)
+}
+
 type nodeConn struct {
 	nodeID peer.ID
 	stream network.Stream
@@ -47,7 +92,7 @@ type nodeConn struct {
 }
 
 // NewClient creates a new node client.
-func NewClient(h host.Host, nickname, token string, hpkePub []byte, keyID []byte, handler PeerHandler) *Client {
+func NewClient(h host.Host, nickname, token string, hpkePub []byte, keyID keyid.KeyID, handler PeerHandler) *Client {
 	return &Client{
 		host:     h,
 		nickname: nickname,
@@ -56,6 +101,7 @@ func NewClient(h host.Host, nickname, token string, hpkePub []byte, keyID []byte
 		keyID:    keyID,
 		nodes:    make(map[peer.ID]*nodeConn),
 		peers:    make(map[string]*TrackedPeer),
+		rooms:    make(map[string]map[peer.ID][]string),
 		handler:  handler,
 	}
 }
@@ -86,12 +132,22 @@ func (c *Client) Connect(ctx context.Context, nodeAddr string) error {
 	}
 
 	// Send Register
+	keySig, err := c.ownKeySig()
+	if err != nil {
+		stream.Close()
+		return err
+	}
+	c.mu.RLock()
 	reg := &Register{
 		Nickname: c.nickname,
 		Token:    c.token,
 		HPKEPub:  c.hpkePub,
 		KeyID:    c.keyID,
+		Presence: c.status,
+		Profile:  c.profile,
+		KeySig:   keySig,
 	}
+	c.mu.RUnlock()
 	if err := WriteMsg(stream, MsgRegister, EncodeRegister(reg)); err != nil {
 		stream.Close()
 		return fmt.Errorf("send register: %w", err)
@@ -103,10 +159,22 @@ func (c *Client) Connect(ctx context.Context, nodeAddr string) error {
 		stream.Close()
 		return fmt.Errorf("read response: %w", err)
 	}
+	if typ == MsgRegisterChallenge {
+		if err := c.proveRegistration(stream, addrInfo.ID, payload); err != nil {
+			stream.Close()
+			c.authFailed(addrInfo.ID, "registration challenge: "+err.Error())
+			return fmt.Errorf("registration challenge: %w", err)
+		}
+		if typ, payload, err = ReadMsg(stream); err != nil {
+			stream.Close()
+			return fmt.Errorf("read response: %w", err)
+		}
+	}
 
 	if typ == MsgRegisterFail {
 		fail, _ := DecodeRegisterFail(payload)
 		stream.Close()
+		c.authFailed(addrInfo.ID, "registration refused: "+fail.Reason)
 		return fmt.Errorf("registration failed: %s", fail.Reason)
 	}
 
@@ -142,6 +210,15 @@ func (c *Client) Connect(ctx context.Context, nodeAddr string) error {
 
 	c.mu.Lock()
 	c.nodes[addrInfo.ID] = nc
+	if !c.filter.isZero() {
+		WriteMsg(stream, MsgSubscribe, EncodeSubscribe(&c.filter))
+	}
+	for room := range c.rooms {
+		WriteMsg(stream, MsgJoinRoom, EncodeRoomJoin(&RoomJoin{Room: room}))
+	}
+	for _, st := range c.revokes {
+		WriteMsg(stream, MsgRevoke, EncodeRevoke(&Revoke{Statement: st}))
+	}
 	c.mu.Unlock()
 
 	// Add peers from list
@@ -163,12 +240,18 @@ func (c *Client) Connect(ctx context.Context, nodeAddr string) error {
 func (c *Client) addPeer(info PeerInfo, nodeID peer.ID) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.addPeerLocked(info, nodeID)
+}
 
+func (c *Client) addPeerLocked(info PeerInfo, nodeID peer.ID) {
 	existing, ok := c.peers[info.Nickname]
 	if ok {
 		existing.SeenBy[nodeID] = true
 		// Update addresses if newer
 		existing.Addrs = info.Addrs
+		existing.Hints = info.Hints
+		existing.Presence = info.Presence
+		existing.Profile = info.Profile
 	} else {
 		c.peers[info.Nickname] = &TrackedPeer{
 			PeerInfo: info,
@@ -176,11 +259,33 @@ func (c *Client) addPeer(info PeerInfo, nodeID peer.ID) {
 		}
 	}
 
-	if c.handler != nil {
+	if c.handler != nil && c.filter.Allows(info.Nickname) {
 		c.handler.OnPeerJoined(info, nodeID)
 	}
 }
 
+// updatePeer applies new addresses of a tracked peer. An update for a peer
+// we never heard of is treated as a join.
+func (c *Client) updatePeer(info PeerInfo, nodeID peer.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	existing, ok := c.peers[info.Nickname]
+	if !ok || existing.PeerID != info.PeerID {
+		c.addPeerLocked(info, nodeID)
+		return
+	}
+	existing.SeenBy[nodeID] = true
+	existing.Addrs = info.Addrs
+	existing.Hints = info.Hints
+	existing.Presence = info.Presence
+	existing.Profile = info.Profile
+
+	if h, ok := c.handler.(PeerUpdateHandler); ok && c.filter.Allows(info.Nickname) {
+		h.OnPeerUpdated(info, nodeID)
+	}
+}
+
 func (c *Client) removePeerFromNode(nickname string, nodeID peer.ID) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -197,7 +302,7 @@ func (c *Client) removePeerFromNode(nickname string, nodeID peer.ID) {
 		delete(c.peers, nickname)
 	}
 
-	if c.handler != nil {
+	if c.handler != nil && c.filter.Allows(nickname) {
 		c.handler.OnPeerLeft(nickname, nodeID)
 	}
 }
@@ -207,6 +312,11 @@ func (c *Client) readLoop(ctx context.Context, nc *nodeConn) {
 		nc.stream.Close()
 		c.mu.Lock()
 		delete(c.nodes, nc.nodeID)
+		for room, byNode := range c.rooms {
+			if _, ok := byNode[nc.nodeID]; ok {
+				c.setRoomMembersLocked(room, nc.nodeID, nil)
+			}
+		}
 		c.mu.Unlock()
 
 		if c.handler != nil {
@@ -238,6 +348,27 @@ func (c *Client) readLoop(ctx context.Context, nc *nodeConn) {
 				Addrs:    joined.Addrs,
 				HPKEPub:  joined.HPKEPub,
 				KeyID:    joined.KeyID,
+				Hints:    joined.Hints,
+				Presence: joined.Presence,
+				Profile:  joined.Profile,
+				KeySig:   joined.KeySig,
+			}, nc.nodeID)
+
+		case MsgPeerUpdated:
+			updated, err := DecodePeerJoined(payload)
+			if err != nil {
+				continue
+			}
+			c.updatePeer(PeerInfo{
+				Nickname: updated.Nickname,
+				PeerID:   updated.PeerID,
+				Addrs:    updated.Addrs,
+				HPKEPub:  updated.HPKEPub,
+				KeyID:    updated.KeyID,
+				Hints:    updated.Hints,
+				Presence: updated.Presence,
+				Profile:  updated.Profile,
+				KeySig:   updated.KeySig,
 			}, nc.nodeID)
 
 		case MsgPeerLeft:
@@ -246,34 +377,280 @@ func (c *Client) readLoop(ctx context.Context, nc *nodeConn) {
 				continue
 			}
 			c.removePeerFromNode(left.Nickname, nc.nodeID)
+
+		case MsgRoomMembers:
+			m, err := DecodeRoomMembers(payload)
+			if err != nil {
+				continue
+			}
+			c.mu.Lock()
+			if _, joined := c.rooms[m.Room]; joined {
+				c.setRoomMembersLocked(m.Room, nc.nodeID, m.Members)
+			}
+			c.mu.Unlock()
+
+		case MsgMail:
+			m, err := DecodeMail(payload)
+			if err != nil {
+				continue
+			}
+			if h, ok := c.handler.(MailHandler); ok {
+				h.OnMail(m.From, m.Data, nc.nodeID)
+			}
+
+		case MsgRevocation:
+			r, err := DecodeRevocation(payload)
+			if err != nil {
+				continue
+			}
+			if h, ok := c.handler.(RevocationHandler); ok {
+				h.OnRevocation(r.From, r.Statement, nc.nodeID)
+			}
 		}
 	}
 }
 
-// GetPeer returns info for a peer by nickname.
+// GetPeer returns info for a peer by nickname, unless the presence filter
+// hides it.
 func (c *Client) GetPeer(nickname string) (PeerInfo, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
 	tracked, ok := c.peers[nickname]
-	if !ok {
+	if !ok || !c.filter.Allows(nickname) {
 		return PeerInfo{}, false
 	}
 	return tracked.PeerInfo, true
 }
 
-// GetAllPeers returns all known peers.
+// GetAllPeers returns all known peers that pass the presence filter.
 func (c *Client) GetAllPeers() []PeerInfo {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
 	peers := make([]PeerInfo, 0, len(c.peers))
 	for _, p := range c.peers {
-		peers = append(peers, p.PeerInfo)
+		if c.filter.Allows(p.Nickname) {
+			peers = append(peers, p.PeerInfo)
+		}
 	}
 	return peers
 }
 
+// SetPresenceFilter restricts the peers reported to the handler and by
+// GetPeer/GetAllPeers, and asks every connected node to stop pushing the
+// others. The handler is not called for peers the change hides or reveals:
+// callers resync from GetAllPeers. Peers revealed later by a node that
+// filtered them arrive through OnPeerJoined.
+func (c *Client) SetPresenceFilter(f PresenceFilter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.filter = f
+	encoded := EncodeSubscribe(&f)
+	for _, nc := range c.nodes {
+		WriteMsg(nc.stream, MsgSubscribe, encoded)
+	}
+}
+
+// UpdateAddrs advertises a new address set to every connected node.
+func (c *Client) UpdateAddrs(addrs []multiaddr.Multiaddr) {
+	if len(addrs) == 0 {
+		return
+	}
+	encoded := EncodeUpdateAddrs(&UpdateAddrs{Addrs: addrs})
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, nc := range c.nodes {
+		WriteMsg(nc.stream, MsgUpdateAddrs, encoded)
+	}
+}
+
+// SetProfile sets the signed profile sent when registering with nodes
+// connected from now on.
+func (c *Client) SetProfile(profile []byte) error {
+	if len(profile) > MaxProfileSize {
+		return fmt.Errorf("profile too large: %d bytes, max %d", len(profile), MaxProfileSize)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.profile = profile
+	return nil
+}
+
+// SetKeySig sets the signature over our HPKE key (see KeySignInput) sent
+// when registering with nodes connected from now on.
+func (c *Client) SetKeySig(sig []byte) error {
+	if len(sig) > MaxKeySigSize {
+		return fmt.Errorf("key signature too large: %d bytes, max %d", len(sig), MaxKeySigSize)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keySig = sig
+	return nil
+}
+
+// SetPresence advertises our presence to every connected node, and to
+// nodes connected later. Nodes that predate presence ignore it.
+func (c *Client) SetPresence(presence string) error {
+	if !ValidPresence(presence) {
+		return fmt.Errorf("bad presence %q: want %s, %s or %s", presence, PresenceAvailable, PresenceAway, PresenceBusy)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = presence
+	encoded := EncodeSetPresence(&SetPresence{Presence: presence})
+	for _, nc := range c.nodes {
+		WriteMsg(nc.stream, MsgSetPresence, encoded)
+	}
+	return nil
+}
+
+// WatchAddrs calls UpdateAddrs whenever the host's listen addresses change,
+// until ctx is done.
+func (c *Client) WatchAddrs(ctx context.Context) error {
+	sub, err := c.host.EventBus().Subscribe(new(event.EvtLocalAddressesUpdated))
+	if err != nil {
+		return fmt.Errorf("subscribe to address changes: %w", err)
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+				if ev := e.(event.EvtLocalAddressesUpdated); ev.Diffs {
+					c.UpdateAddrs(c.host.Addrs())
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// JoinRoom joins room on every connected node, and on nodes connected
+// later. Memberships arrive through RoomHandler.
+func (c *Client) JoinRoom(room string) error {
+	if !ValidRoom(room) {
+		return fmt.Errorf("bad room name %q: want # followed by up to %d characters, no spaces", room, maxRoomName-1)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.rooms[room]; ok {
+		return nil
+	}
+	if len(c.nodes) == 0 {
+		return fmt.Errorf("not connected to any node")
+	}
+	c.rooms[room] = make(map[peer.ID][]string)
+	encoded := EncodeRoomJoin(&RoomJoin{Room: room})
+	for _, nc := range c.nodes {
+		WriteMsg(nc.stream, MsgJoinRoom, encoded)
+	}
+	return nil
+}
+
+// Deposit leaves data for an offline peer with every connected node; the
+// nodes push it when the peer registers with them. Nodes do not confirm
+// deposits, and those that predate mailboxes drop them.
+func (c *Client) Deposit(to string, data []byte) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.nodes) == 0 {
+		return fmt.Errorf("not connected to any node")
+	}
+	encoded := EncodeDeposit(&Deposit{To: to, Data: data})
+	for _, nc := range c.nodes {
+		WriteMsg(nc.stream, MsgDeposit, encoded)
+	}
+	return nil
+}
+
+// Fanout hands items sealed for several peers to every connected node,
+// which push each to its recipient if registered with them. A recipient
+// registered with several nodes gets each item from every one of them.
+func (c *Client) Fanout(items []Deposit) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.nodes) == 0 {
+		return fmt.Errorf("not connected to any node")
+	}
+	encoded := EncodeFanout(&Fanout{Items: items})
+	for _, nc := range c.nodes {
+		WriteMsg(nc.stream, MsgFanout, encoded)
+	}
+	return nil
+}
+
+// Revoke publishes a revocation statement through every connected node,
+// and through the nodes connected later. Nodes that predate revocations
+// drop it.
+func (c *Client) Revoke(statement []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.revokes = append(c.revokes, statement)
+	if len(c.nodes) == 0 {
+		return fmt.Errorf("not connected to any node")
+	}
+	encoded := EncodeRevoke(&Revoke{Statement: statement})
+	for _, nc := range c.nodes {
+		WriteMsg(nc.stream, MsgRevoke, encoded)
+	}
+	return nil
+}
+
+// LeaveRoom leaves room on every connected node.
+func (c *Client) LeaveRoom(room string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.rooms[room]; !ok {
+		return
+	}
+	delete(c.rooms, room)
+	encoded := EncodeRoomJoin(&RoomJoin{Room: room})
+	for _, nc := range c.nodes {
+		WriteMsg(nc.stream, MsgLeaveRoom, encoded)
+	}
+}
+
+// setRoomMembersLocked records what nodeID reports about a joined room (nil
+// once it reports nothing) and passes the merged membership to the handler
+// when it changed.
+func (c *Client) setRoomMembersLocked(room string, nodeID peer.ID, members []string) {
+	byNode := c.rooms[room]
+	before := mergeMembers(byNode)
+	if members == nil {
+		delete(byNode, nodeID)
+	} else {
+		byNode[nodeID] = members
+	}
+	after := mergeMembers(byNode)
+	if h, ok := c.handler.(RoomHandler); ok && !slices.Equal(before, after) {
+		h.OnRoomMembers(room, after)
+	}
+}
+
+func mergeMembers(byNode map[peer.ID][]string) []string {
+	var all []string
+	for _, members := range byNode {
+		all = append(all, members...)
+	}
+	slices.Sort(all)
+	return slices.Compact(all)
+}
+
+// PresenceFilter returns the current presence filter.
+func (c *Client) PresenceFilter() PresenceFilter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.filter
+}
+
 // Close disconnects from all nodes.
 func (c *Client) Close() {
 	c.mu.Lock()
@@ -285,6 +662,13 @@ func (c *Client) Close() {
 	}
 }
 
+// authFailed tells the handler, if it listens, that node refused us.
+func (c *Client) authFailed(node peer.ID, reason string) {
+	if h, ok := c.handler.(AuthFailureHandler); ok {
+		h.OnAuthFailure(node, reason)
+	}
+}
+
 // ConnectAll connects to multiple nodes in parallel.
 func (c *Client) ConnectAll(ctx context.Context, nodeAddrs []string) error {
 	var wg sync.WaitGroup
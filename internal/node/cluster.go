@@ -0,0 +1,395 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/pivaldi/tmd/internal/keyid"
+)
+
+// Clustering lets several nodes share registration and presence state
+// through a Backend. Each node still owns the streams of the peers
+// registered with it, but it publishes those registrations as leased
+// Records and derives the peer list it serves from all live records. A
+// node that restarts or goes away leaves its records behind until their
+// lease runs out, so its peers do not appear offline to the rest of the
+// cluster while they reconnect.
+
+// DefaultLease is how long a registration survives without renewal.
+const DefaultLease = 30 * time.Second
+
+// ClusterConfig is the "cluster" section of the node config.
+type ClusterConfig struct {
+	Backend    string            `json:"backend"`              // "redis" or "federation"
+	Redis      string            `json:"redis"`                // redis://[user:pass@]host:port/db
+	Prefix     string            `json:"prefix"`               // key prefix, default "tmd"
+	Lease      string            `json:"lease"`                // e.g. "30s", default DefaultLease
+	Federation *FederationConfig `json:"federation,omitempty"` // with the "federation" backend
+}
+
+// Open connects the configured backend and parses the lease. The
+// federation backend gossips on h until ctx is done, logging to logf. The
+// returned func releases the backend.
+func (c *ClusterConfig) Open(ctx context.Context, h host.Host, logf func(string, ...any)) (Backend, time.Duration, func(), error) {
+	lease := DefaultLease
+	if c.Lease != "" {
+		d, err := time.ParseDuration(c.Lease)
+		if err != nil || d <= 0 {
+			return nil, 0, nil, fmt.Errorf("cluster lease %q: must be a positive duration", c.Lease)
+		}
+		lease = d
+	}
+	switch c.Backend {
+	case "redis":
+		b, err := NewRedisBackend(ctx, c.Redis, c.Prefix)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return b, lease, func() { _ = b.Close() }, nil
+	case "federation":
+		if c.Federation == nil {
+			return nil, 0, nil, fmt.Errorf("federation backend without a federation section")
+		}
+		f, err := NewFederation(ctx, h, c.Federation, lease, logf)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return f, lease, func() {}, nil
+	default:
+		return nil, 0, nil, fmt.Errorf("unknown cluster backend %q", c.Backend)
+	}
+}
+
+// Record is one peer registration held by one node.
+type Record struct {
+	Node     string      `json:"node"` // node peer ID
+	Nickname string      `json:"nick"`
+	PeerID   string      `json:"peer_id"`
+	Addrs    []string    `json:"addrs"`
+	HPKEPub  []byte      `json:"hpke_pub"`
+	KeyID    keyid.KeyID `json:"key_id"`
+	Hints    []AddrHint  `json:"hints,omitempty"`
+	Presence string      `json:"presence,omitempty"`
+	Profile  []byte      `json:"profile,omitempty"`
+	KeySig   []byte      `json:"key_sig,omitempty"`
+	Rooms    []string    `json:"rooms,omitempty"`
+	Expires  time.Time   `json:"expires"`
+}
+
+// Backend stores cluster state. Implementations must drop records once
+// they expire.
+type Backend interface {
+	// Put creates or renews r until r.Expires.
+	Put(ctx context.Context, r Record) error
+	// Delete removes the record of nickname held by node.
+	Delete(ctx context.Context, node, nickname string) error
+	// List returns every unexpired record.
+	List(ctx context.Context) ([]Record, error)
+	// Watch signals whenever any node may have changed the state. The
+	// channel is closed when ctx is done.
+	Watch(ctx context.Context) (<-chan struct{}, error)
+}
+
+func recordFor(node peer.ID, p *onlinePeer, expires time.Time) Record {
+	return Record{
+		Node:     node.String(),
+		Nickname: p.Nickname,
+		PeerID:   p.PeerID.String(),
+		Addrs:    addrStrings(p.Addrs),
+		HPKEPub:  p.HPKEPub,
+		KeyID:    p.KeyID,
+		Hints:    p.Hints,
+		Presence: p.Presence,
+		Profile:  p.Profile,
+		KeySig:   p.KeySig,
+		Rooms:    p.Rooms,
+		Expires:  expires,
+	}
+}
+
+func (r Record) peerInfo() (PeerInfo, error) {
+	id, err := peer.Decode(r.PeerID)
+	if err != nil {
+		return PeerInfo{}, err
+	}
+	addrs := make([]multiaddr.Multiaddr, 0, len(r.Addrs))
+	for _, a := range r.Addrs {
+		m, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return PeerInfo{}, err
+		}
+		addrs = append(addrs, m)
+	}
+	return PeerInfo{Nickname: r.Nickname, PeerID: id, Addrs: addrs, HPKEPub: r.HPKEPub, KeyID: r.KeyID, Hints: r.Hints, Presence: r.Presence, Profile: r.Profile, KeySig: r.KeySig}, nil
+}
+
+func samePeer(a, b PeerInfo) bool {
+	return a.PeerID == b.PeerID && bytes.Equal(a.HPKEPub, b.HPKEPub) && a.Presence == b.Presence &&
+		slices.EqualFunc(a.Addrs, b.Addrs, func(x, y multiaddr.Multiaddr) bool { return x.Equal(y) })
+}
+
+// cluster is the clustering state of a Server.
+type cluster struct {
+	ctx     context.Context // done when the node stops clustering
+	backend Backend
+	lease   time.Duration
+	logf    func(format string, args ...any)
+
+	refreshMu sync.Mutex          // serializes refresh
+	viewMu    sync.RWMutex        // guards view and rooms
+	view      map[string]PeerInfo // nickname -> peer, cluster-wide
+	rooms     map[string][]string // nickname -> rooms, cluster-wide
+}
+
+// EnableCluster shares this node's registrations through backend and
+// serves the cluster-wide peer list. Call it before clients connect; it
+// runs until ctx is done. Errors after startup are reported to logf.
+func (s *Server) EnableCluster(ctx context.Context, backend Backend, lease time.Duration, logf func(string, ...any)) error {
+	if lease <= 0 {
+		lease = DefaultLease
+	}
+	if logf == nil {
+		logf = func(string, ...any) {}
+	}
+	c := &cluster{ctx: ctx, backend: backend, lease: lease, logf: logf, view: make(map[string]PeerInfo)}
+
+	changes, err := backend.Watch(ctx)
+	if err != nil {
+		return fmt.Errorf("cluster watch: %w", err)
+	}
+	s.mu.Lock()
+	s.cluster = c
+	s.mu.Unlock()
+	if err := s.refresh(ctx); err != nil {
+		return fmt.Errorf("cluster list: %w", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				// Leave records in place: peers stay visible to the
+				// cluster until the lease expires or they reconnect.
+				return
+			case _, ok := <-changes:
+				if !ok {
+					return
+				}
+			case <-ticker.C:
+				s.renew(ctx)
+			}
+			if err := s.refresh(ctx); err != nil {
+				logf("cluster refresh: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// publish records a local registration in the backend.
+func (s *Server) publish(ctx context.Context, p *onlinePeer) error {
+	c := s.cluster
+	return c.backend.Put(ctx, recordFor(s.host.ID(), p, time.Now().Add(c.lease)))
+}
+
+// renew extends the lease of every local registration.
+func (s *Server) renew(ctx context.Context) {
+	s.mu.RLock()
+	local := make([]*onlinePeer, 0, len(s.online))
+	for _, p := range s.online {
+		local = append(local, p)
+	}
+	s.mu.RUnlock()
+
+	for _, p := range local {
+		if err := s.publish(ctx, p); err != nil {
+			s.cluster.logf("cluster renew %s: %v", p.Nickname, err)
+		}
+	}
+}
+
+// refresh rebuilds the cluster-wide view from the backend and pushes the
+// differences to locally connected peers.
+func (s *Server) refresh(ctx context.Context) error {
+	c := s.cluster
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	records, err := c.backend.List(ctx)
+	if err != nil {
+		return err
+	}
+	next := make(map[string]PeerInfo)
+	nextRooms := make(map[string][]string)
+	newest := make(map[string]time.Time)
+	for _, r := range records {
+		info, err := r.peerInfo()
+		if err != nil {
+			c.logf("cluster: skipping bad record for %s: %v", r.Nickname, err)
+			continue
+		}
+		if r.Expires.After(newest[r.Nickname]) {
+			next[r.Nickname] = info
+			nextRooms[r.Nickname] = r.Rooms
+			newest[r.Nickname] = r.Expires
+		}
+	}
+
+	c.viewMu.Lock()
+	prev, prevRooms := c.view, c.rooms
+	c.view, c.rooms = next, nextRooms
+	c.viewMu.Unlock()
+
+	for nick, info := range next {
+		p := &onlinePeer{Nickname: nick, PeerID: info.PeerID, Addrs: info.Addrs, HPKEPub: info.HPKEPub, KeyID: info.KeyID, Hints: info.Hints, Presence: info.Presence, Profile: info.Profile, KeySig: info.KeySig}
+		old, ok := prev[nick]
+		switch {
+		case ok && samePeer(old, info):
+		case ok && old.PeerID == info.PeerID && bytes.Equal(old.HPKEPub, info.HPKEPub):
+			// Same identity, new addresses or presence.
+			s.broadcastPeer(MsgPeerUpdated, p)
+		default:
+			s.broadcastJoined(p)
+		}
+	}
+	for nick := range prev {
+		if _, ok := next[nick]; !ok {
+			s.broadcastLeft(nick)
+		}
+	}
+	for _, room := range changedRooms(prevRooms, nextRooms) {
+		s.pushRoom(room)
+	}
+	return nil
+}
+
+// changedRooms lists the rooms whose membership differs between two
+// nickname -> rooms views.
+func changedRooms(prev, next map[string][]string) []string {
+	changed := make(map[string]bool)
+	diff := func(a, b map[string][]string) {
+		for nick, rooms := range a {
+			for _, room := range rooms {
+				if !slices.Contains(b[nick], room) {
+					changed[room] = true
+				}
+			}
+		}
+	}
+	diff(prev, next)
+	diff(next, prev)
+	return slices.Sorted(maps.Keys(changed))
+}
+
+// roomMembers lists the members of room cluster-wide, sorted.
+func (c *cluster) roomMembers(room string) []string {
+	c.viewMu.RLock()
+	defer c.viewMu.RUnlock()
+	var members []string
+	for nick, rooms := range c.rooms {
+		if slices.Contains(rooms, room) {
+			members = append(members, nick)
+		}
+	}
+	slices.Sort(members)
+	return members
+}
+
+// peer returns the cluster-wide registration of nickname.
+func (c *cluster) peer(nickname string) (PeerInfo, bool) {
+	c.viewMu.RLock()
+	defer c.viewMu.RUnlock()
+	p, ok := c.view[nickname]
+	return p, ok
+}
+
+func (c *cluster) peers() []PeerInfo {
+	c.viewMu.RLock()
+	defer c.viewMu.RUnlock()
+	list := make([]PeerInfo, 0, len(c.view))
+	for _, p := range c.view {
+		list = append(list, p)
+	}
+	return list
+}
+
+// MemoryBackend is an in-process Backend. Servers in the same process can
+// share one; it is mainly useful for tests.
+type MemoryBackend struct {
+	mu       sync.Mutex
+	records  map[[2]string]Record // (node, nickname) -> record
+	watchers map[chan struct{}]struct{}
+}
+
+// NewMemoryBackend returns an empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		records:  make(map[[2]string]Record),
+		watchers: make(map[chan struct{}]struct{}),
+	}
+}
+
+func (m *MemoryBackend) Put(_ context.Context, r Record) error {
+	m.mu.Lock()
+	m.records[[2]string{r.Node, r.Nickname}] = r
+	m.notifyLocked()
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryBackend) Delete(_ context.Context, node, nickname string) error {
+	m.mu.Lock()
+	delete(m.records, [2]string{node, nickname})
+	m.notifyLocked()
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryBackend) List(context.Context) ([]Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var out []Record
+	for k, r := range m.records {
+		if !r.Expires.After(now) {
+			delete(m.records, k)
+			continue
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func (m *MemoryBackend) Watch(ctx context.Context) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+	m.mu.Lock()
+	m.watchers[ch] = struct{}{}
+	m.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		delete(m.watchers, ch)
+		close(ch)
+		m.mu.Unlock()
+	}()
+	return ch, nil
+}
+
+func (m *MemoryBackend) notifyLocked() {
+	for ch := range m.watchers {
+		select {
+		case ch <- struct{}{}:
+		default: // a signal is already pending
+		}
+	}
+}
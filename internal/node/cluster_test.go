@@ -0,0 +1,214 @@
+package node
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/pivaldi/tmd/internal/p2p"
+)
+
+type peerEvent struct {
+	joined   bool
+	nickname string
+}
+
+type recordingHandler chan peerEvent
+
+func (h recordingHandler) OnPeerJoined(info PeerInfo, _ peer.ID) { h <- peerEvent{true, info.Nickname} }
+func (h recordingHandler) OnPeerLeft(nickname string, _ peer.ID) { h <- peerEvent{false, nickname} }
+func (recordingHandler) OnNodeConnected(peer.ID)                 {}
+func (recordingHandler) OnNodeDisconnected(peer.ID)              {}
+
+func (h recordingHandler) expect(t *testing.T, want peerEvent, timeout time.Duration) {
+	t.Helper()
+	select {
+	case got := <-h:
+		if got != want {
+			t.Fatalf("got event %+v, want %+v", got, want)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("no event %+v after %s", want, timeout)
+	}
+}
+
+func newTestHost(t *testing.T) host.Host {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := p2p.NewHost(priv, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func nodeAddr(s *Server) string {
+	for _, a := range s.Addrs() {
+		if _, err := a.ValueForProtocol(4); err == nil { // ip4
+			return fmt.Sprintf("%s/p2p/%s", a, s.ID())
+		}
+	}
+	return ""
+}
+
+func TestClusterSharesPresence(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &Config{Peers: map[string]string{"alice": "ta", "bob": "tb"}}
+	backend := NewMemoryBackend()
+	lease := 300 * time.Millisecond
+
+	srvA := NewServer(newTestHost(t), cfg)
+	ctxA, stopA := context.WithCancel(ctx)
+	if err := srvA.EnableCluster(ctxA, backend, lease, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+	srvB := NewServer(newTestHost(t), cfg)
+	if err := srvB.EnableCluster(ctx, backend, lease, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+
+	aliceEvents := make(recordingHandler, 16)
+	alice := NewClient(newTestHost(t), "alice", "ta", []byte("alice-hpke"), make([]byte, 8), aliceEvents)
+	if err := alice.Connect(ctx, nodeAddr(srvA)); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	bobEvents := make(recordingHandler, 16)
+	bob := NewClient(newTestHost(t), "bob", "tb", []byte("bob-hpke"), make([]byte, 8), bobEvents)
+	if err := bob.Connect(ctx, nodeAddr(srvB)); err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	// Each sees the other although they registered with different nodes.
+	bobEvents.expect(t, peerEvent{true, "alice"}, 2*time.Second)
+	aliceEvents.expect(t, peerEvent{true, "bob"}, 2*time.Second)
+
+	// Address updates cross nodes as updates, not as a second join.
+	roamed := multiaddr.StringCast("/ip4/192.0.2.7/tcp/9000")
+	bob.UpdateAddrs([]multiaddr.Multiaddr{roamed})
+	waitForAddr(t, alice, "bob", roamed)
+	select {
+	case ev := <-aliceEvents:
+		t.Fatalf("unexpected event %+v on address update", ev)
+	default:
+	}
+
+	// Rooms span nodes.
+	if err := alice.JoinRoom("#dev"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.JoinRoom("#dev"); err != nil {
+		t.Fatal(err)
+	}
+	waitForMembers(t, alice, "#dev", "alice,bob")
+
+	// A second client cannot take a nickname held on another node.
+	mallory := NewClient(newTestHost(t), "alice", "ta", []byte("other-hpke"), make([]byte, 8), nil)
+	if err := mallory.Connect(ctx, nodeAddr(srvB)); err == nil {
+		t.Fatal("duplicate nickname accepted by the other node")
+	}
+
+	// Node A goes away without cleaning up, as in a crash or restart:
+	// alice stays online for bob until her lease runs out.
+	stopA()
+	srvA.host.Close()
+	select {
+	case ev := <-bobEvents:
+		t.Fatalf("unexpected event %+v within the lease", ev)
+	case <-time.After(lease / 2):
+	}
+	bobEvents.expect(t, peerEvent{false, "alice"}, 2*time.Second)
+}
+
+func TestRedisBackend(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b, err := NewRedisBackend(ctx, "redis://"+mr.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	changes, err := b.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := Record{Node: "n1", Nickname: "alice", PeerID: "p", Addrs: []string{"/ip4/127.0.0.1/tcp/1"}, Expires: time.Now().Add(10 * time.Second)}
+	if err := b.Put(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no change notification after Put")
+	}
+	if !mr.Exists("tmd:peer:n1:alice") {
+		t.Fatalf("keys = %v", mr.Keys())
+	}
+
+	got, err := b.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Nickname != "alice" || !got[0].Expires.Equal(rec.Expires) {
+		t.Fatalf("List = %+v", got)
+	}
+
+	// Records expire with their lease.
+	mr.FastForward(11 * time.Second)
+	if got, _ := b.List(ctx); len(got) != 0 {
+		t.Fatalf("List after expiry = %+v", got)
+	}
+
+	stale := rec
+	stale.Expires = time.Now().Add(-time.Second)
+	if err := b.Put(ctx, stale); err == nil {
+		t.Fatal("Put of an expired record succeeded")
+	}
+	if err := b.Put(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, "n1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.List(ctx); len(got) != 0 {
+		t.Fatalf("List after Delete = %+v", got)
+	}
+}
+
+// waitForMembers waits until c's merged membership of room is members.
+func waitForMembers(t *testing.T, c *Client, room, members string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c.mu.RLock()
+		got := strings.Join(mergeMembers(c.rooms[room]), ",")
+		c.mu.RUnlock()
+		if got == members {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s members = %q, want %q", room, got, members)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
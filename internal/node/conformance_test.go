@@ -0,0 +1,424 @@
+package node
+
+import (
+	"bytes"
+	"flag"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/pivaldi/tmd/internal/conformance"
+)
+
+var update = flag.Bool("update", false, "regenerate golden conformance vectors")
+
+// nodeVectors builds every node protocol message from its vector inputs.
+var nodeVectors = []struct {
+	name   string
+	typ    byte
+	inputs map[string]string
+	encode func(in map[string]string) []byte
+}{
+	{
+		name: "register",
+		typ:  MsgRegister,
+		inputs: map[string]string{
+			"nickname": "alice",
+			"token":    "secret-alice",
+			"hpke_pub": "5a8aa0d2a1d3d9a2b6c1e0f4d3c2b1a0918273645546372819a0b1c2d3e4f506",
+			"key_id":   "7a1b2c3d4e5f6071",
+		},
+		encode: func(in map[string]string) []byte {
+			return EncodeRegister(&Register{
+				Nickname: in["nickname"],
+				Token:    in["token"],
+				HPKEPub:  conformance.Hex(in["hpke_pub"]),
+				KeyID:    conformance.Hex(in["key_id"]),
+			})
+		},
+	},
+	{
+		name:   "register_ok",
+		typ:    MsgRegisterOK,
+		inputs: map[string]string{"peer_id": "12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp"},
+		encode: func(in map[string]string) []byte {
+			id, _ := peer.Decode(in["peer_id"])
+			return EncodeRegisterOK(&RegisterOK{PeerID: id})
+		},
+	},
+	{
+		name:   "register_fail",
+		typ:    MsgRegisterFail,
+		inputs: map[string]string{"reason": "invalid token"},
+		encode: func(in map[string]string) []byte {
+			return EncodeRegisterFail(&RegisterFail{Reason: in["reason"]})
+		},
+	},
+	{
+		name: "peer_joined",
+		typ:  MsgPeerJoined,
+		inputs: map[string]string{
+			"nickname": "bob",
+			"peer_id":  "12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp",
+			"addr":     "/ip4/127.0.0.1/tcp/9000",
+			"hpke_pub": "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+			"key_id":   "4211223344556677",
+		},
+		encode: func(in map[string]string) []byte {
+			return EncodePeerJoined(vectorPeerJoined(in))
+		},
+	},
+	{
+		name: "peer_joined_hints",
+		typ:  MsgPeerJoined,
+		inputs: map[string]string{
+			"nickname":   "bob",
+			"peer_id":    "12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp",
+			"addr":       "/ip4/10.1.0.5/tcp/9000",
+			"hpke_pub":   "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+			"key_id":     "4211223344556677",
+			"region":     "eu-west",
+			"latency_us": "1500",
+		},
+		encode: func(in map[string]string) []byte {
+			j := vectorPeerJoined(in)
+			us, _ := strconv.Atoi(in["latency_us"])
+			j.Hints = []AddrHint{{Region: in["region"], Latency: time.Duration(us) * time.Microsecond}}
+			return EncodePeerJoined(j)
+		},
+	},
+	{
+		name:   "peer_left",
+		typ:    MsgPeerLeft,
+		inputs: map[string]string{"nickname": "carol"},
+		encode: func(in map[string]string) []byte {
+			return EncodePeerLeft(&PeerLeft{Nickname: in["nickname"]})
+		},
+	},
+	{
+		name: "peer_list",
+		typ:  MsgPeerList,
+		inputs: map[string]string{
+			"nickname": "bob",
+			"peer_id":  "12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp",
+			"addr":     "/ip4/127.0.0.1/tcp/9000",
+			"hpke_pub": "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+			"key_id":   "4211223344556677",
+		},
+		encode: func(in map[string]string) []byte {
+			j := vectorPeerJoined(in)
+			return EncodePeerList(&PeerList{Peers: []PeerInfo{{
+				Nickname: j.Nickname,
+				PeerID:   j.PeerID,
+				Addrs:    j.Addrs,
+				HPKEPub:  j.HPKEPub,
+				KeyID:    j.KeyID,
+			}}})
+		},
+	},
+	{
+		name:   "update_addrs",
+		typ:    MsgUpdateAddrs,
+		inputs: map[string]string{"addrs": "/ip4/192.0.2.7/tcp/9000,/ip6/2001:db8::7/tcp/9000"},
+		encode: func(in map[string]string) []byte {
+			var addrs []multiaddr.Multiaddr
+			for _, a := range strings.Split(in["addrs"], ",") {
+				addrs = append(addrs, multiaddr.StringCast(a))
+			}
+			return EncodeUpdateAddrs(&UpdateAddrs{Addrs: addrs})
+		},
+	},
+	{
+		name: "peer_updated",
+		typ:  MsgPeerUpdated,
+		inputs: map[string]string{
+			"nickname": "bob",
+			"peer_id":  "12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp",
+			"addr":     "/ip4/192.0.2.7/tcp/9000",
+			"hpke_pub": "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+			"key_id":   "4211223344556677",
+		},
+		encode: func(in map[string]string) []byte {
+			return EncodePeerJoined(vectorPeerJoined(in))
+		},
+	},
+	{
+		name:   "subscribe",
+		typ:    MsgSubscribe,
+		inputs: map[string]string{"follow": "bob,carol", "mute": "dave"},
+		encode: func(in map[string]string) []byte {
+			return EncodeSubscribe(&PresenceFilter{
+				Follow: strings.Split(in["follow"], ","),
+				Mute:   strings.Split(in["mute"], ","),
+			})
+		},
+	},
+	{
+		name:   "join_room",
+		typ:    MsgJoinRoom,
+		inputs: map[string]string{"room": "#dev"},
+		encode: func(in map[string]string) []byte {
+			return EncodeRoomJoin(&RoomJoin{Room: in["room"]})
+		},
+	},
+	{
+		name:   "room_members",
+		typ:    MsgRoomMembers,
+		inputs: map[string]string{"room": "#dev", "members": "alice,bob"},
+		encode: func(in map[string]string) []byte {
+			return EncodeRoomMembers(&RoomMembers{Room: in["room"], Members: strings.Split(in["members"], ",")})
+		},
+	},
+	{
+		name:   "deposit",
+		typ:    MsgDeposit,
+		inputs: map[string]string{"to": "bob", "data": "0a0b0c0d"},
+		encode: func(in map[string]string) []byte {
+			return EncodeDeposit(&Deposit{To: in["to"], Data: conformance.Hex(in["data"])})
+		},
+	},
+	{
+		name:   "mail",
+		typ:    MsgMail,
+		inputs: map[string]string{"from": "alice", "data": "0a0b0c0d"},
+		encode: func(in map[string]string) []byte {
+			return EncodeMail(&Mail{From: in["from"], Data: conformance.Hex(in["data"])})
+		},
+	},
+	{
+		name:   "fanout",
+		typ:    MsgFanout,
+		inputs: map[string]string{"to": "bob,carol", "data": "0a0b0c0d"},
+		encode: func(in map[string]string) []byte {
+			var f Fanout
+			for _, to := range strings.Split(in["to"], ",") {
+				f.Items = append(f.Items, Deposit{To: to, Data: conformance.Hex(in["data"])})
+			}
+			return EncodeFanout(&f)
+		},
+	},
+	{
+		name: "register_presence",
+		typ:  MsgRegister,
+		inputs: map[string]string{
+			"nickname": "alice",
+			"token":    "secret-alice",
+			"hpke_pub": "5a8aa0d2a1d3d9a2b6c1e0f4d3c2b1a0918273645546372819a0b1c2d3e4f506",
+			"key_id":   "7a1b2c3d4e5f6071",
+			"presence": PresenceAway,
+		},
+		encode: func(in map[string]string) []byte {
+			return EncodeRegister(&Register{
+				Nickname: in["nickname"],
+				Token:    in["token"],
+				HPKEPub:  conformance.Hex(in["hpke_pub"]),
+				KeyID:    conformance.Hex(in["key_id"]),
+				Presence: in["presence"],
+			})
+		},
+	},
+	{
+		name: "peer_joined_presence",
+		typ:  MsgPeerJoined,
+		inputs: map[string]string{
+			"nickname": "bob",
+			"peer_id":  "12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp",
+			"addr":     "/ip4/127.0.0.1/tcp/9000",
+			"hpke_pub": "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+			"key_id":   "4211223344556677",
+			"presence": PresenceBusy,
+		},
+		encode: func(in map[string]string) []byte {
+			j := vectorPeerJoined(in)
+			j.Presence = in["presence"]
+			return EncodePeerJoined(j)
+		},
+	},
+	{
+		name:   "set_presence",
+		typ:    MsgSetPresence,
+		inputs: map[string]string{"presence": PresenceAway},
+		encode: func(in map[string]string) []byte {
+			return EncodeSetPresence(&SetPresence{Presence: in["presence"]})
+		},
+	},
+	{
+		name: "register_profile",
+		typ:  MsgRegister,
+		inputs: map[string]string{
+			"nickname": "alice",
+			"token":    "secret-alice",
+			"hpke_pub": "5a8aa0d2a1d3d9a2b6c1e0f4d3c2b1a0918273645546372819a0b1c2d3e4f506",
+			"key_id":   "7a1b2c3d4e5f6071",
+			"profile":  "00000005416c696365",
+		},
+		encode: func(in map[string]string) []byte {
+			return EncodeRegister(&Register{
+				Nickname: in["nickname"],
+				Token:    in["token"],
+				HPKEPub:  conformance.Hex(in["hpke_pub"]),
+				KeyID:    conformance.Hex(in["key_id"]),
+				Profile:  conformance.Hex(in["profile"]),
+			})
+		},
+	},
+	{
+		name: "peer_joined_profile",
+		typ:  MsgPeerJoined,
+		inputs: map[string]string{
+			"nickname": "bob",
+			"peer_id":  "12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp",
+			"addr":     "/ip4/127.0.0.1/tcp/9000",
+			"hpke_pub": "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+			"key_id":   "4211223344556677",
+			"profile":  "00000003426f62",
+		},
+		encode: func(in map[string]string) []byte {
+			j := vectorPeerJoined(in)
+			j.Profile = conformance.Hex(in["profile"])
+			return EncodePeerJoined(j)
+		},
+	},
+	{
+		name: "register_key_sig",
+		typ:  MsgRegister,
+		inputs: map[string]string{
+			"nickname": "alice",
+			"token":    "secret-alice",
+			"hpke_pub": "5a8aa0d2a1d3d9a2b6c1e0f4d3c2b1a0918273645546372819a0b1c2d3e4f506",
+			"key_id":   "7a1b2c3d4e5f6071",
+			"key_sig":  strings.Repeat("5c", MaxKeySigSize),
+		},
+		encode: func(in map[string]string) []byte {
+			return EncodeRegister(&Register{
+				Nickname: in["nickname"],
+				Token:    in["token"],
+				HPKEPub:  conformance.Hex(in["hpke_pub"]),
+				KeyID:    conformance.Hex(in["key_id"]),
+				KeySig:   conformance.Hex(in["key_sig"]),
+			})
+		},
+	},
+	{
+		name: "peer_joined_key_sig",
+		typ:  MsgPeerJoined,
+		inputs: map[string]string{
+			"nickname": "bob",
+			"peer_id":  "12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp",
+			"addr":     "/ip4/127.0.0.1/tcp/9000",
+			"hpke_pub": "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+			"key_id":   "4211223344556677",
+			"key_sig":  strings.Repeat("b0", MaxKeySigSize),
+		},
+		encode: func(in map[string]string) []byte {
+			j := vectorPeerJoined(in)
+			j.KeySig = conformance.Hex(in["key_sig"])
+			return EncodePeerJoined(j)
+		},
+	},
+	{
+		name:   "register_challenge",
+		typ:    MsgRegisterChallenge,
+		inputs: map[string]string{"nonce": strings.Repeat("9e", RegisterNonceSize)},
+		encode: func(in map[string]string) []byte {
+			return EncodeRegisterChallenge(&RegisterChallenge{Nonce: conformance.Hex(in["nonce"])})
+		},
+	},
+	{
+		name:   "register_proof",
+		typ:    MsgRegisterProof,
+		inputs: map[string]string{"signature": strings.Repeat("a5", MaxKeySigSize)},
+		encode: func(in map[string]string) []byte {
+			return EncodeRegisterProof(&RegisterProof{Signature: conformance.Hex(in["signature"])})
+		},
+	},
+}
+
+func vectorPeerJoined(in map[string]string) *PeerJoined {
+	id, _ := peer.Decode(in["peer_id"])
+	addr, _ := multiaddr.NewMultiaddr(in["addr"])
+	return &PeerJoined{
+		Nickname: in["nickname"],
+		PeerID:   id,
+		Addrs:    []multiaddr.Multiaddr{addr},
+		HPKEPub:  conformance.Hex(in["hpke_pub"]),
+		KeyID:    conformance.Hex(in["key_id"]),
+	}
+}
+
+func TestConformanceNode(t *testing.T) {
+	if *update {
+		suite := &conformance.Suite{Description: "discovery node protocol (" + ProtocolID + ")"}
+		for _, v := range nodeVectors {
+			suite.Vectors = append(suite.Vectors, conformance.Vector{
+				Name:   v.name,
+				Type:   v.typ,
+				Inputs: v.inputs,
+				Frame:  conformance.Frame(v.typ, v.encode(v.inputs)),
+			})
+		}
+		if err := conformance.Save("../conformance/vectors", "node", suite); err != nil {
+			t.Fatalf("save vectors: %v", err)
+		}
+		t.Skip("vectors regenerated; rerun without -update to verify")
+	}
+
+	suite, err := conformance.Load("node")
+	if err != nil {
+		t.Fatalf("load vectors: %v", err)
+	}
+	if len(suite.Vectors) != len(nodeVectors) {
+		t.Fatalf("expected %d vectors, got %d", len(nodeVectors), len(suite.Vectors))
+	}
+
+	for i, v := range suite.Vectors {
+		want := nodeVectors[i]
+		if v.Name != want.name || v.Type != want.typ {
+			t.Fatalf("vector %d: got %s/%d, want %s/%d", i, v.Name, v.Type, want.name, want.typ)
+		}
+		if got := conformance.Frame(v.Type, want.encode(v.Inputs)); got != v.Frame {
+			t.Fatalf("%s: encoding mismatch\n got  %s\n want %s", v.Name, got, v.Frame)
+		}
+
+		// Golden frames must also round-trip through ReadMsg and the decoders.
+		typ, payload, err := ReadMsg(bytes.NewReader(conformance.Hex(v.Frame)))
+		if err != nil || typ != v.Type {
+			t.Fatalf("%s: ReadMsg: typ=%d err=%v", v.Name, typ, err)
+		}
+		if err := decodeNodeMsg(typ, payload); err != nil {
+			t.Fatalf("%s: decode: %v", v.Name, err)
+		}
+	}
+}
+
+func decodeNodeMsg(typ byte, payload []byte) error {
+	var err error
+	switch typ {
+	case MsgRegister:
+		_, err = DecodeRegister(payload)
+	case MsgRegisterOK:
+		_, err = DecodeRegisterOK(payload)
+	case MsgRegisterFail:
+		_, err = DecodeRegisterFail(payload)
+	case MsgPeerJoined, MsgPeerUpdated:
+		_, err = DecodePeerJoined(payload)
+	case MsgPeerLeft:
+		_, err = DecodePeerLeft(payload)
+	case MsgPeerList:
+		_, err = DecodePeerList(payload)
+	case MsgSubscribe:
+		_, err = DecodeSubscribe(payload)
+	case MsgUpdateAddrs:
+		_, err = DecodeUpdateAddrs(payload)
+	case MsgDeposit:
+		_, err = DecodeDeposit(payload)
+	case MsgMail:
+		_, err = DecodeMail(payload)
+	case MsgFanout:
+		_, err = DecodeFanout(payload)
+	}
+	return err
+}
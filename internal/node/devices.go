@@ -0,0 +1,43 @@
+package node
+
+import "strings"
+
+// A nickname may register several devices at once: each registers as
+// "nickname/device" with the nickname's token and keys of its own, and is
+// announced as a peer of its own under that name. The ACL, presence
+// filters and tokens apply to the nickname, so devices of one nickname
+// always see each other.
+const (
+	DeviceSep     = "/"
+	maxDeviceName = 32
+)
+
+// DeviceName returns the name a device of nickname registers as; an empty
+// device is the nickname itself.
+func DeviceName(nickname, device string) string {
+	if device == "" {
+		return nickname
+	}
+	return nickname + DeviceSep + device
+}
+
+// SplitDevice splits a registered name into its nickname and device;
+// device is empty for names without one.
+func SplitDevice(name string) (nickname, device string) {
+	nickname, device, _ = strings.Cut(name, DeviceSep)
+	return nickname, device
+}
+
+// ValidDevice reports whether device is a device name: 1 to 32 lowercase
+// letters, digits, '-' or '_'.
+func ValidDevice(device string) bool {
+	if device == "" || len(device) > maxDeviceName {
+		return false
+	}
+	for _, r := range device {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package node
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDevices(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cfg := &Config{
+		Peers: map[string]string{"alice": "ta", "bob": "tb", "carol": "tc"},
+		ACL:   &ACL{Groups: map[string][]string{"ab": {"alice", "bob"}}},
+	}
+	srv := NewServer(newTestHost(t), cfg)
+	connect := func(name, token string, h recordingHandler) (*Client, error) {
+		c := NewClient(newTestHost(t), name, token, []byte(name+"-hpke"), make([]byte, 8), h)
+		t.Cleanup(c.Close)
+		return c, c.Connect(ctx, nodeAddr(srv))
+	}
+
+	bob := make(recordingHandler, 16)
+	carol := make(recordingHandler, 16)
+	if _, err := connect("bob", "tb", bob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connect("carol", "tc", carol); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two devices of alice register at once, with alice's token, and see
+	// each other.
+	laptop := make(recordingHandler, 16)
+	if _, err := connect("alice/laptop", "ta", laptop); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connect("alice/phone", "ta", make(recordingHandler, 16)); err != nil {
+		t.Fatal(err)
+	}
+	bob.expect(t, peerEvent{true, "alice/laptop"}, 2*time.Second)
+	bob.expect(t, peerEvent{true, "alice/phone"}, 2*time.Second)
+	laptop.expect(t, peerEvent{true, "bob"}, 2*time.Second)
+	laptop.expect(t, peerEvent{true, "alice/phone"}, 2*time.Second)
+
+	// The ACL applies to the nickname.
+	select {
+	case ev := <-carol:
+		t.Fatalf("carol got %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	for _, c := range []struct{ name, token, fail string }{
+		{"alice/phone", "ta", "already in use"},
+		{"alice/Phone!", "ta", "invalid device name"},
+		{"alice/tablet", "tb", "invalid token"},
+		{"zed/laptop", "ta", "unknown nickname"},
+	} {
+		if _, err := connect(c.name, c.token, make(recordingHandler, 16)); err == nil || !strings.Contains(err.Error(), c.fail) {
+			t.Fatalf("%s: %v, want %q", c.name, err, c.fail)
+		}
+	}
+}
+
+func TestDeviceName(t *testing.T) {
+	if n := DeviceName("alice", "laptop"); n != "alice/laptop" {
+		t.Fatalf("DeviceName = %q", n)
+	}
+	if n := DeviceName("alice", ""); n != "alice" {
+		t.Fatalf("DeviceName without device = %q", n)
+	}
+	if nick, dev := SplitDevice("alice/laptop"); nick != "alice" || dev != "laptop" {
+		t.Fatalf("SplitDevice = %q %q", nick, dev)
+	}
+	if nick, dev := SplitDevice("alice"); nick != "alice" || dev != "" {
+		t.Fatalf("SplitDevice without device = %q %q", nick, dev)
+	}
+	f := PresenceFilter{Mute: []string{"alice"}}
+	if f.Allows("alice/laptop") {
+		t.Fatal("muting alice let a device of alice through")
+	}
+}
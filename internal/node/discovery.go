@@ -0,0 +1,84 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
+)
+
+// DNSPrefix marks a --nodes entry resolved through DNS, e.g.
+// "dns:nodes.example.org".
+const DNSPrefix = "dns:"
+
+// maxDNSAddrDepth bounds dnsaddr records pointing at further dnsaddr
+// records.
+const maxDNSAddrDepth = 4
+
+// ResolveNodeAddrs expands "dns:<domain>" entries into node multiaddrs by
+// looking up dnsaddr TXT records (_dnsaddr.<domain>, values
+// "dnsaddr=/ip4/.../tcp/.../p2p/<nodeID>"); other entries are returned
+// unchanged. Operators can thus rotate node addresses and node keys by
+// editing DNS. A nil resolver uses the system resolver.
+func ResolveNodeAddrs(ctx context.Context, resolver *madns.Resolver, entries []string) ([]string, error) {
+	if resolver == nil {
+		resolver = madns.DefaultResolver
+	}
+
+	var out []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		domain, ok := strings.CutPrefix(entry, DNSPrefix)
+		if !ok {
+			if entry != "" {
+				out = append(out, entry)
+			}
+			continue
+		}
+
+		root, err := multiaddr.NewMultiaddr("/dnsaddr/" + domain)
+		if err != nil {
+			return nil, fmt.Errorf("node address %s: %w", entry, err)
+		}
+		addrs, err := resolveDNSAddr(ctx, resolver, root, maxDNSAddrDepth)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", entry, err)
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("resolve %s: no dnsaddr records with a node ID", entry)
+		}
+		out = append(out, addrs...)
+	}
+	return out, nil
+}
+
+func resolveDNSAddr(ctx context.Context, resolver *madns.Resolver, maddr multiaddr.Multiaddr, depth int) ([]string, error) {
+	if depth == 0 {
+		return nil, errors.New("dnsaddr records nested too deeply")
+	}
+	resolved, err := resolver.Resolve(ctx, maddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, a := range resolved {
+		if _, err := a.ValueForProtocol(multiaddr.P_DNSADDR); err == nil {
+			nested, err := resolveDNSAddr(ctx, resolver, a, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, nested...)
+			continue
+		}
+		// Connect needs the node ID to authenticate the node.
+		if _, err := a.ValueForProtocol(multiaddr.P_P2P); err != nil {
+			continue
+		}
+		out = append(out, a.String())
+	}
+	return out, nil
+}
@@ -0,0 +1,43 @@
+package node
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	madns "github.com/multiformats/go-multiaddr-dns"
+)
+
+const (
+	testNodeA = "/ip4/192.0.2.1/tcp/4001/p2p/12D3KooWGzxzKZYveHXtpG6AsrUJBcWxHBFS2HsEoGTxrMLvKXtf"
+	testNodeB = "/ip4/192.0.2.2/udp/4001/quic-v1/p2p/12D3KooWJWoaqZhDaoEFshF7Rh1bpY9ohihFhzcW6d69Lr2NASuq"
+)
+
+func TestResolveNodeAddrs(t *testing.T) {
+	resolver, err := madns.NewResolver(madns.WithDefaultResolver(&madns.MockResolver{
+		TXT: map[string][]string{
+			"_dnsaddr.example.org": {
+				"dnsaddr=" + testNodeA,
+				"dnsaddr=/dnsaddr/eu.example.org",
+				"dnsaddr=/ip4/192.0.2.9/tcp/4001", // no node ID: skipped
+			},
+			"_dnsaddr.eu.example.org": {"dnsaddr=" + testNodeB},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ResolveNodeAddrs(context.Background(), resolver, []string{"dns:example.org", " /ip4/127.0.0.1/tcp/1/p2p/x ", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{testNodeA, testNodeB, "/ip4/127.0.0.1/tcp/1/p2p/x"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q\nwant %q", got, want)
+	}
+
+	if _, err := ResolveNodeAddrs(context.Background(), resolver, []string{"dns:missing.example.org"}); err == nil {
+		t.Fatal("expected error for a domain without records")
+	}
+}
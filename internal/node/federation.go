@@ -0,0 +1,392 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Federation is a Backend for nodes run apart, without a shared store:
+// each node keeps its own registrations and gossips them, as a roster, to
+// the nodes it federates with, which pass them on. Peers registered on
+// one node are thus discovered by clients of any node federated with it,
+// directly or through others. Every record is tagged with the node it
+// was registered on (Record.Node), which is the roster's origin.
+//
+// Rosters carry a sequence number that grows with each roster of their
+// origin and a hop count. A node drops its own rosters, rosters not newer
+// than the last one it has of their origin, and rosters that went through
+// MaxHops nodes; it forwards the others to the nodes it federates with
+// but the one it got them from. So a roster crosses each link once,
+// whatever loops the federation has. A roster replaces the previous one
+// of its origin, and its records last for the roster's TTL; a node that
+// goes away leaves its peers online until then, as in a cluster.
+//
+// The origin signs its roster, bar the hop count, with its node key (see
+// rosterSignInput), so the nodes passing it on cannot change its records
+// or its sequence number, nor make up rosters of other nodes. Nodes only
+// take rosters from the nodes they list.
+
+// FederationProtocolID is the protocol nodes gossip rosters on.
+const FederationProtocolID = protocol.ID("/tmd/federation/1.0.0")
+
+// DefaultMaxHops bounds how far a roster travels by default.
+const DefaultMaxHops = 4
+
+// maxRosterTTL caps the TTL a roster may ask for.
+const maxRosterTTL = 10 * time.Minute
+
+// msgRoster is the only message of the federation protocol.
+const msgRoster byte = 1
+
+// FederationConfig is the "federation" part of a cluster section.
+type FederationConfig struct {
+	Peers   []string `json:"peers"`    // nodes to gossip with, as multiaddrs ending in /p2p/<id>
+	MaxHops int      `json:"max_hops"` // default DefaultMaxHops
+}
+
+// rosterSignContext starts the bytes a node signs its rosters over.
+const rosterSignContext = "tmd roster v1"
+
+// roster is the registrations of one node.
+type roster struct {
+	Origin  string          `json:"origin"` // node peer ID
+	Seq     uint64          `json:"seq"`
+	Hops    int             `json:"hops"`    // nodes it went through after its origin
+	TTL     int64           `json:"ttl_ms"`  // how long its records last
+	Records json.RawMessage `json:"records"` // []Record, as signed
+	Sig     []byte          `json:"sig"`     // by the origin's key, over rosterSignInput
+}
+
+// rosterSignInput returns the bytes the origin of ro signs: "tmd roster
+// v1" || 0 || origin || 0 || u64(seq) || u64(ttl) || records.
+func rosterSignInput(ro roster) []byte {
+	var b bytes.Buffer
+	b.WriteString(rosterSignContext)
+	b.WriteByte(0)
+	b.WriteString(ro.Origin)
+	b.WriteByte(0)
+	_ = binary.Write(&b, binary.BigEndian, ro.Seq)
+	_ = binary.Write(&b, binary.BigEndian, ro.TTL)
+	b.Write(ro.Records)
+	return b.Bytes()
+}
+
+// verifyRoster checks that ro is signed by the key of its origin.
+func verifyRoster(ro roster) error {
+	origin, err := peer.Decode(ro.Origin)
+	if err != nil {
+		return fmt.Errorf("bad origin: %w", err)
+	}
+	pub, err := origin.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("no key in origin: %w", err)
+	}
+	ok, err := pub.Verify(rosterSignInput(ro), ro.Sig)
+	if err != nil || !ok {
+		return errors.New("not signed by its origin")
+	}
+	return nil
+}
+
+// remoteRoster is the last roster taken of an origin.
+type remoteRoster struct {
+	seq     uint64
+	records []Record
+}
+
+// Federation gossips rosters with other nodes; it is safe for concurrent
+// use.
+type Federation struct {
+	host    host.Host
+	peers   []peer.AddrInfo
+	maxHops int
+	lease   time.Duration
+	logf    func(format string, args ...any)
+	kick    chan struct{}
+
+	mu       sync.Mutex
+	seq      uint64
+	local    map[string]Record       // nickname -> record of ours
+	remote   map[string]remoteRoster // origin -> its last roster
+	watchers map[chan struct{}]struct{}
+}
+
+// NewFederation gossips this node's registrations with the nodes of cfg
+// until ctx is done. Records from other nodes last lease after the
+// roster that brought them, unless that roster asks for less.
+func NewFederation(ctx context.Context, h host.Host, cfg *FederationConfig, lease time.Duration, logf func(string, ...any)) (*Federation, error) {
+	if logf == nil {
+		logf = func(string, ...any) {}
+	}
+	f := &Federation{
+		host:     h,
+		maxHops:  cfg.MaxHops,
+		lease:    lease,
+		logf:     logf,
+		kick:     make(chan struct{}, 1),
+		local:    make(map[string]Record),
+		remote:   make(map[string]remoteRoster),
+		watchers: make(map[chan struct{}]struct{}),
+	}
+	if f.maxHops <= 0 {
+		f.maxHops = DefaultMaxHops
+	}
+	for _, s := range cfg.Peers {
+		info, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("federation peer %q: %w", s, err)
+		}
+		if info.ID == h.ID() {
+			return nil, fmt.Errorf("federation peer %q is this node", s)
+		}
+		f.peers = append(f.peers, *info)
+	}
+	h.SetStreamHandler(FederationProtocolID, f.handle)
+	go func() {
+		<-ctx.Done()
+		h.RemoveStreamHandler(FederationProtocolID)
+	}()
+	go f.gossipLoop(ctx)
+	f.changed()
+	return f, nil
+}
+
+func (f *Federation) Put(_ context.Context, r Record) error {
+	f.mu.Lock()
+	f.local[r.Nickname] = r
+	f.notifyLocked()
+	f.mu.Unlock()
+	f.changed()
+	return nil
+}
+
+func (f *Federation) Delete(_ context.Context, node, nickname string) error {
+	f.mu.Lock()
+	if r, ok := f.local[nickname]; ok && r.Node == node {
+		delete(f.local, nickname)
+	}
+	f.notifyLocked()
+	f.mu.Unlock()
+	f.changed()
+	return nil
+}
+
+func (f *Federation) List(context.Context) ([]Record, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	var out []Record
+	for _, r := range f.local {
+		if r.Expires.After(now) {
+			out = append(out, r)
+		}
+	}
+	for origin, ro := range f.remote {
+		live := slices.DeleteFunc(ro.records, func(r Record) bool { return !r.Expires.After(now) })
+		if len(live) == 0 {
+			delete(f.remote, origin)
+			continue
+		}
+		ro.records = live
+		f.remote[origin] = ro
+		out = append(out, live...)
+	}
+	return out, nil
+}
+
+func (f *Federation) Watch(ctx context.Context) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+	f.mu.Lock()
+	f.watchers[ch] = struct{}{}
+	f.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		delete(f.watchers, ch)
+		close(ch)
+		f.mu.Unlock()
+	}()
+	return ch, nil
+}
+
+func (f *Federation) notifyLocked() {
+	for ch := range f.watchers {
+		select {
+		case ch <- struct{}{}:
+		default: // a signal is already pending
+		}
+	}
+}
+
+// changed schedules our roster for gossip. Renewals put every record in
+// turn; they leave with one roster.
+func (f *Federation) changed() {
+	select {
+	case f.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (f *Federation) gossipLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.kick:
+		}
+		ro, err := f.ownRoster()
+		if err != nil {
+			f.logf("federation: %v", err)
+			continue
+		}
+		f.forward(ctx, ro, "")
+	}
+}
+
+// ownRoster returns our records as a new roster, signed. Sequence numbers
+// start from the clock so that they keep growing across restarts.
+func (f *Federation) ownRoster() (roster, error) {
+	f.mu.Lock()
+	f.seq = max(f.seq+1, uint64(time.Now().UnixNano()))
+	records := make([]Record, 0, len(f.local))
+	for _, r := range f.local {
+		records = append(records, r)
+	}
+	ro := roster{Origin: f.host.ID().String(), Seq: f.seq, TTL: f.lease.Milliseconds()}
+	f.mu.Unlock()
+	return f.signRoster(ro, records)
+}
+
+// signRoster sets the records of ro and signs it with our node key.
+func (f *Federation) signRoster(ro roster, records []Record) (roster, error) {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return roster{}, fmt.Errorf("encode roster: %w", err)
+	}
+	ro.Records = data
+	priv := f.host.Peerstore().PrivKey(f.host.ID())
+	if priv == nil {
+		return roster{}, errors.New("no node key to sign rosters with")
+	}
+	if ro.Sig, err = priv.Sign(rosterSignInput(ro)); err != nil {
+		return roster{}, fmt.Errorf("sign roster: %w", err)
+	}
+	return ro, nil
+}
+
+// forward sends ro to the nodes we federate with but from and its origin.
+func (f *Federation) forward(ctx context.Context, ro roster, from peer.ID) {
+	data, err := json.Marshal(ro)
+	if err != nil {
+		f.logf("federation: encode roster: %v", err)
+		return
+	}
+	for _, to := range f.peers {
+		if to.ID == from || to.ID.String() == ro.Origin {
+			continue
+		}
+		go func() {
+			if err := f.send(ctx, to, data); err != nil {
+				f.logf("federation: gossip to %s: %v", to.ID, err)
+			}
+		}()
+	}
+}
+
+func (f *Federation) send(ctx context.Context, to peer.AddrInfo, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := f.host.Connect(ctx, to); err != nil {
+		return err
+	}
+	stream, err := f.host.NewStream(ctx, to.ID, FederationProtocolID)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	return WriteMsg(stream, msgRoster, data)
+}
+
+// handle takes a roster from a node we federate with.
+func (f *Federation) handle(stream network.Stream) {
+	defer stream.Close()
+	from := stream.Conn().RemotePeer()
+	if !slices.ContainsFunc(f.peers, func(p peer.AddrInfo) bool { return p.ID == from }) {
+		f.logf("federation: roster from unknown node %s refused", from)
+		return
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	typ, data, err := ReadMsg(stream)
+	if err != nil {
+		return
+	}
+	if typ != msgRoster {
+		f.logf("federation: unexpected message %d from %s", typ, from)
+		return
+	}
+	var ro roster
+	if err := json.Unmarshal(data, &ro); err != nil {
+		f.logf("federation: bad roster from %s: %v", from, err)
+		return
+	}
+	if err := f.take(ro); err != nil {
+		if errors.Is(err, errStaleRoster) {
+			return // it came round another way first
+		}
+		f.logf("federation: roster of %s from %s: %v", ro.Origin, from, err)
+		return
+	}
+	if ro.Hops+1 < f.maxHops {
+		ro.Hops++
+		f.forward(context.Background(), ro, from)
+	}
+}
+
+// errStaleRoster reports a roster already seen, or older.
+var errStaleRoster = errors.New("not newer than the last one")
+
+// take stores ro if it is a new roster of another node, signed by it.
+func (f *Federation) take(ro roster) error {
+	switch {
+	case ro.Origin == f.host.ID().String():
+		return errors.New("our own roster")
+	case ro.Hops < 0 || ro.Hops >= f.maxHops:
+		return fmt.Errorf("%d hops", ro.Hops)
+	}
+	if err := verifyRoster(ro); err != nil {
+		return err
+	}
+	var records []Record
+	if err := json.Unmarshal(ro.Records, &records); err != nil {
+		return fmt.Errorf("bad records: %w", err)
+	}
+	ttl := min(time.Duration(ro.TTL)*time.Millisecond, f.lease, maxRosterTTL)
+	expires := time.Now().Add(ttl)
+	for i, r := range records {
+		if r.Node != ro.Origin {
+			return fmt.Errorf("record of %s tagged with node %s", r.Nickname, r.Node)
+		}
+		records[i].Expires = expires
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if old, ok := f.remote[ro.Origin]; ok && ro.Seq <= old.seq {
+		return errStaleRoster
+	}
+	f.remote[ro.Origin] = remoteRoster{seq: ro.Seq, records: records}
+	f.notifyLocked()
+	return nil
+}
@@ -0,0 +1,135 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestFederation checks that peers registered on one node are discovered
+// by the clients of a node federated with it through a third one, tagged
+// with their node, and that rosters going round a loop are dropped.
+func TestFederation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A - B - C, and C - A to close a loop.
+	srvA := NewServer(newTestHost(t), &Config{Peers: map[string]string{"alice": "ta"}})
+	srvB := NewServer(newTestHost(t), &Config{Peers: map[string]string{}})
+	srvC := NewServer(newTestHost(t), &Config{Peers: map[string]string{"carol": "tc"}})
+	lease := 500 * time.Millisecond
+	federate := func(srv *Server, peers ...*Server) *Federation {
+		cfg := &FederationConfig{MaxHops: 3}
+		for _, p := range peers {
+			cfg.Peers = append(cfg.Peers, nodeAddr(p))
+		}
+		f, err := NewFederation(ctx, srv.host, cfg, lease, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.EnableCluster(ctx, f, lease, t.Logf); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	fedA := federate(srvA, srvB, srvC)
+	fedB := federate(srvB, srvA, srvC)
+	fedC := federate(srvC, srvB, srvA)
+
+	if _, err := NewFederation(ctx, srvA.host, &FederationConfig{Peers: []string{nodeAddr(srvA)}}, lease, nil); err == nil {
+		t.Fatal("a node federating with itself was accepted")
+	}
+
+	aliceEvents := make(recordingHandler, 16)
+	alice := NewClient(newTestHost(t), "alice", "ta", []byte("alice-hpke"), make([]byte, 8), aliceEvents)
+	if err := alice.Connect(ctx, nodeAddr(srvA)); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	carolEvents := make(recordingHandler, 16)
+	carol := NewClient(newTestHost(t), "carol", "tc", []byte("carol-hpke"), make([]byte, 8), carolEvents)
+	if err := carol.Connect(ctx, nodeAddr(srvC)); err != nil {
+		t.Fatal(err)
+	}
+	defer carol.Close()
+
+	carolEvents.expect(t, peerEvent{true, "alice"}, 3*time.Second)
+	aliceEvents.expect(t, peerEvent{true, "carol"}, 3*time.Second)
+	records, _ := fedC.List(ctx)
+	for _, r := range records {
+		want := srvC.ID().String()
+		if r.Nickname == "alice" {
+			want = srvA.ID().String()
+		}
+		if r.Node != want {
+			t.Fatalf("%s tagged with node %s, want %s", r.Nickname, r.Node, want)
+		}
+	}
+
+	// Renewals keep alice online past her lease.
+	select {
+	case ev := <-carolEvents:
+		t.Fatalf("unexpected event %+v while renewed", ev)
+	case <-time.After(2 * lease):
+	}
+
+	// Rosters of our own, replayed, forged or unsigned are dropped.
+	ownRoster := func(f *Federation) roster {
+		ro, err := f.ownRoster()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ro
+	}
+	own := ownRoster(fedA)
+	if err := fedA.take(own); err == nil {
+		t.Fatal("a node took its own roster back")
+	}
+	if err := fedC.take(own); err != nil {
+		t.Fatal(err)
+	}
+	if err := fedC.take(own); err != errStaleRoster {
+		t.Fatalf("replayed roster: %v, want %v", err, errStaleRoster)
+	}
+	far := ownRoster(fedA)
+	far.Hops = 3
+	if err := fedC.take(far); err == nil {
+		t.Fatal("roster past max hops taken")
+	}
+	mixed, err := fedA.signRoster(roster{Origin: srvA.ID().String(), Seq: far.Seq + 1}, []Record{{Node: srvB.ID().String(), Nickname: "mallory"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fedC.take(mixed); err == nil {
+		t.Fatal("roster with a record of another node taken")
+	}
+
+	// Node B, passing on node A's rosters, can neither change them nor
+	// make one up for node A.
+	altered := ownRoster(fedA)
+	altered.Records = []byte(`[{"node":"` + srvA.ID().String() + `","nick":"mallory"}]`)
+	if err := fedC.take(altered); err == nil {
+		t.Fatal("roster with records its origin did not sign taken")
+	}
+	bumped := ownRoster(fedA)
+	bumped.Seq++
+	if err := fedC.take(bumped); err == nil {
+		t.Fatal("roster with a sequence number its origin did not sign taken")
+	}
+	madeUp, err := fedB.signRoster(roster{Origin: srvA.ID().String(), Seq: bumped.Seq + 1}, []Record{{Node: srvA.ID().String(), Nickname: "mallory"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fedC.take(madeUp); err == nil {
+		t.Fatal("roster of node A signed by node B taken")
+	}
+	unsigned := ownRoster(fedA)
+	unsigned.Sig = nil
+	if err := fedC.take(unsigned); err == nil {
+		t.Fatal("unsigned roster taken")
+	}
+
+	// Alice leaves: carol learns it from the next roster of node A.
+	alice.Close()
+	carolEvents.expect(t, peerEvent{false, "alice"}, 3*time.Second)
+}
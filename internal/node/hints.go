@@ -0,0 +1,97 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// AddrHint annotates one advertised address so clients can order their
+// dial attempts. Hints are optional: PeerInfo.Hints is either empty or
+// parallel to PeerInfo.Addrs.
+type AddrHint struct {
+	Region  string        `json:"region,omitempty"`  // from the node's region table, "" if unknown
+	Latency time.Duration `json:"latency,omitempty"` // node-measured RTT via this address, 0 if unknown
+}
+
+// AddrHintsConfig is the "addr_hints" section of the node config.
+type AddrHintsConfig struct {
+	Regions map[string]string `json:"regions"` // CIDR -> region name
+	Latency bool              `json:"latency"` // ping peers when they register
+}
+
+// latencyProbeTimeout bounds the registration ping.
+const latencyProbeTimeout = time.Second
+
+func (c *AddrHintsConfig) validate() error {
+	for cidr := range c.Regions {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("addr_hints region %q: %w", cidr, err)
+		}
+	}
+	return nil
+}
+
+// region returns the region of the longest matching prefix.
+func (c *AddrHintsConfig) region(ip netip.Addr) string {
+	best, bestBits := "", -1
+	for cidr, name := range c.Regions {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil || !prefix.Contains(ip) {
+			continue
+		}
+		if prefix.Bits() > bestBits {
+			best, bestBits = name, prefix.Bits()
+		}
+	}
+	return best
+}
+
+// hintAddrs annotates the addresses of a peer registering over conn. It
+// returns nil when hints are disabled.
+func (s *Server) hintAddrs(conn network.Conn, addrs []multiaddr.Multiaddr) []AddrHint {
+	cfg := s.config.AddrHints
+	if cfg == nil {
+		return nil
+	}
+
+	var rtt time.Duration
+	var connIP netip.Addr
+	if cfg.Latency {
+		ctx, cancel := context.WithTimeout(context.Background(), latencyProbeTimeout)
+		if res := <-ping.Ping(ctx, s.host, conn.RemotePeer()); res.Error == nil {
+			rtt = res.RTT
+		}
+		cancel()
+		connIP = addrIP(conn.RemoteMultiaddr())
+	}
+
+	hints := make([]AddrHint, len(addrs))
+	for i, a := range addrs {
+		ip := addrIP(a)
+		if ip.IsValid() {
+			hints[i].Region = cfg.region(ip)
+		}
+		// The RTT was measured over the connection's path, so only
+		// addresses on the same IP share it.
+		if rtt > 0 && ip.IsValid() && ip == connIP {
+			hints[i].Latency = rtt
+		}
+	}
+	return hints
+}
+
+func addrIP(a multiaddr.Multiaddr) netip.Addr {
+	ip, err := manet.ToIP(a)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
@@ -0,0 +1,79 @@
+package node
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddrHintsRegion(t *testing.T) {
+	cfg := &AddrHintsConfig{Regions: map[string]string{
+		"10.0.0.0/8":  "eu",
+		"10.2.0.0/16": "eu-west",
+		"::/0":        "v6",
+	}}
+	for ip, want := range map[string]string{
+		"10.1.2.3":    "eu",
+		"10.2.2.3":    "eu-west",
+		"192.0.2.1":   "",
+		"2001:db8::1": "v6",
+	} {
+		if got := cfg.region(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("region(%s) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestLoadConfigRejectsBadRegion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.json")
+	cfg := `{"peers": {"alice": "t"}, "addr_hints": {"regions": {"10.0.0.0/33": "eu"}}}`
+	if err := os.WriteFile(path, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("LoadConfig accepted an invalid CIDR")
+	}
+}
+
+func TestServerAnnotatesAddrs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &Config{
+		Peers:     map[string]string{"alice": "ta", "bob": "tb"},
+		AddrHints: &AddrHintsConfig{Regions: map[string]string{"127.0.0.0/8": "loopback"}, Latency: true},
+	}
+	srv := NewServer(newTestHost(t), cfg)
+
+	bob := NewClient(newTestHost(t), "bob", "tb", []byte("bob-hpke"), make([]byte, 8), make(recordingHandler, 16))
+	if err := bob.Connect(ctx, nodeAddr(srv)); err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	alice := NewClient(newTestHost(t), "alice", "ta", []byte("alice-hpke"), make([]byte, 8), make(recordingHandler, 16))
+	if err := alice.Connect(ctx, nodeAddr(srv)); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	info, ok := alice.GetPeer("bob")
+	if !ok {
+		t.Fatal("bob not listed")
+	}
+	if len(info.Hints) != len(info.Addrs) {
+		t.Fatalf("%d hints for %d addrs", len(info.Hints), len(info.Addrs))
+	}
+	measured := false
+	for i, h := range info.Hints {
+		ip := addrIP(info.Addrs[i])
+		if ip.IsLoopback() && h.Region != "loopback" {
+			t.Errorf("%s: region %q", info.Addrs[i], h.Region)
+		}
+		measured = measured || h.Latency > 0
+	}
+	if !measured {
+		t.Errorf("no latency measured: %+v", info.Hints)
+	}
+}
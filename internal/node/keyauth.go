@@ -0,0 +1,166 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// A nickname listed in the config's keys section registers by key instead
+// of by token. The node answers its Register with a REGISTER_CHALLENGE and
+// the peer signs
+//
+//	"tmd node register v1" || 0 || node peer ID || 0 || nickname || 0 || nonce
+//
+// with the key of its libp2p peer ID, which must be one of the Ed25519 keys
+// listed for the nickname (hex, as tmd prints them at startup). Its
+// devices register with keys of their own from the same list. The
+// signature is good for one node and one attempt, so nothing on the wire
+// can be replayed; the token of such a nickname is ignored.
+const (
+	RegisterSignContext = "tmd node register v1"
+	RegisterNonceSize   = 32
+)
+
+// RegisterChallenge is sent by the node to a peer registering by key.
+type RegisterChallenge struct {
+	Nonce []byte
+}
+
+// RegisterProof answers a RegisterChallenge.
+type RegisterProof struct {
+	Signature []byte
+}
+
+// Encode/Decode RegisterChallenge
+func EncodeRegisterChallenge(c *RegisterChallenge) []byte {
+	return c.Nonce
+}
+
+func DecodeRegisterChallenge(data []byte) (*RegisterChallenge, error) {
+	if len(data) != RegisterNonceSize {
+		return nil, fmt.Errorf("bad nonce size: %d", len(data))
+	}
+	return &RegisterChallenge{Nonce: data}, nil
+}
+
+// Encode/Decode RegisterProof
+func EncodeRegisterProof(p *RegisterProof) []byte {
+	return p.Signature
+}
+
+func DecodeRegisterProof(data []byte) (*RegisterProof, error) {
+	if len(data) == 0 || len(data) > MaxKeySigSize {
+		return nil, fmt.Errorf("bad signature size: %d", len(data))
+	}
+	return &RegisterProof{Signature: data}, nil
+}
+
+// RegisterSignInput returns the bytes a peer registering as nickname with
+// node signs.
+func RegisterSignInput(node peer.ID, nickname string, nonce []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(RegisterSignContext)
+	b.WriteByte(0)
+	b.WriteString(string(node))
+	b.WriteByte(0)
+	b.WriteString(nickname)
+	b.WriteByte(0)
+	b.Write(nonce)
+	return b.Bytes()
+}
+
+// validateKeys checks that the keys section holds Ed25519 keys.
+func validateKeys(keys map[string][]string) error {
+	for nickname, list := range keys {
+		for _, k := range list {
+			if raw, err := hex.DecodeString(k); err != nil || len(raw) != 32 {
+				return fmt.Errorf("keys of %s: %q is not a hex Ed25519 key", nickname, k)
+			}
+		}
+	}
+	return nil
+}
+
+// Nicknames returns the nicknames the config admits, by token or by key,
+// sorted.
+func (c *Config) Nicknames() []string {
+	var names []string
+	for nickname := range c.Peers {
+		names = append(names, nickname)
+	}
+	for nickname := range c.Keys {
+		if _, ok := c.Peers[nickname]; !ok {
+			names = append(names, nickname)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// admits reports whether nickname is configured, by token or by key.
+func (c *Config) admits(nickname string) bool {
+	_, byToken := c.Peers[nickname]
+	_, byKey := c.Keys[nickname]
+	return byToken || byKey
+}
+
+// challengeRegistration has the peer at the other end of stream prove that
+// the key of its peer ID, one of allowed, registers nickname.
+func (s *Server) challengeRegistration(stream network.Stream, nickname string, allowed []string) error {
+	id := stream.Conn().RemotePeer()
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("no key in peer ID")
+	}
+	raw, err := pub.Raw()
+	if err != nil || !slices.Contains(allowed, hex.EncodeToString(raw)) {
+		return fmt.Errorf("key not allowed for %s", nickname)
+	}
+
+	nonce := make([]byte, RegisterNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("challenge: %v", err)
+	}
+	if err := WriteMsg(stream, MsgRegisterChallenge, EncodeRegisterChallenge(&RegisterChallenge{Nonce: nonce})); err != nil {
+		return err
+	}
+	typ, payload, err := ReadMsg(stream)
+	if err != nil {
+		return err
+	}
+	if typ != MsgRegisterProof {
+		return fmt.Errorf("expected RegisterProof message")
+	}
+	proof, err := DecodeRegisterProof(payload)
+	if err != nil {
+		return fmt.Errorf("invalid RegisterProof message")
+	}
+	if ok, err := pub.Verify(RegisterSignInput(s.host.ID(), nickname, nonce), proof.Signature); err != nil || !ok {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// proveRegistration answers the challenge of node with the host's key.
+func (c *Client) proveRegistration(stream network.Stream, node peer.ID, payload []byte) error {
+	chal, err := DecodeRegisterChallenge(payload)
+	if err != nil {
+		return err
+	}
+	priv := c.host.Peerstore().PrivKey(c.host.ID())
+	if priv == nil {
+		return fmt.Errorf("no host key to sign the registration with")
+	}
+	sig, err := priv.Sign(RegisterSignInput(node, c.nickname, chal.Nonce))
+	if err != nil {
+		return fmt.Errorf("sign registration: %w", err)
+	}
+	return WriteMsg(stream, MsgRegisterProof, EncodeRegisterProof(&RegisterProof{Signature: sig}))
+}
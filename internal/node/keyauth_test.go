@@ -0,0 +1,80 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+func hostKey(t *testing.T, h host.Host) string {
+	t.Helper()
+	raw, err := h.Peerstore().PubKey(h.ID()).Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(raw)
+}
+
+func TestRegisterByKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	laptop, phone, mallory := newTestHost(t), newTestHost(t), newTestHost(t)
+	cfg := &Config{
+		Peers: map[string]string{"alice": "ta", "bob": "tb"},
+		Keys:  map[string][]string{"alice": {hostKey(t, laptop), hostKey(t, phone)}},
+	}
+	srv := NewServer(newTestHost(t), cfg)
+
+	connect := func(h host.Host, nick, token string, events recordingHandler) error {
+		c := NewClient(h, nick, token, []byte(nick+"-hpke"), make([]byte, KeyIDSize), events)
+		t.Cleanup(c.Close)
+		return c.Connect(ctx, nodeAddr(srv))
+	}
+
+	bobEvents := make(recordingHandler, 16)
+	if err := connect(newTestHost(t), "bob", "tb", bobEvents); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(laptop, "alice", "", make(recordingHandler, 16)); err != nil {
+		t.Fatalf("registering by key: %v", err)
+	}
+	bobEvents.expect(t, peerEvent{true, "alice"}, 2*time.Second)
+	if err := connect(phone, "alice/phone", "", make(recordingHandler, 16)); err != nil {
+		t.Fatalf("registering a device by key: %v", err)
+	}
+	bobEvents.expect(t, peerEvent{true, "alice/phone"}, 2*time.Second)
+
+	// Another key, even with the token, is refused.
+	err := connect(mallory, "alice/mallory", "ta", make(recordingHandler, 16))
+	if err == nil || !strings.Contains(err.Error(), "key not allowed") {
+		t.Fatalf("registering with an unlisted key: %v", err)
+	}
+}
+
+func TestRegisterProofBoundToNode(t *testing.T) {
+	nonce := make([]byte, RegisterNonceSize)
+	a, b := newTestHost(t), newTestHost(t)
+	if string(RegisterSignInput(a.ID(), "alice", nonce)) == string(RegisterSignInput(b.ID(), "alice", nonce)) {
+		t.Fatal("a proof for one node is good for another")
+	}
+	if string(RegisterSignInput(a.ID(), "alice", nonce)) == string(RegisterSignInput(a.ID(), "alice/phone", nonce)) {
+		t.Fatal("a proof for one nickname is good for another")
+	}
+}
+
+func TestLoadConfigRejectsBadKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.json")
+	if err := os.WriteFile(path, []byte(`{"keys": {"alice": ["not-hex"]}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("LoadConfig accepted a key that is not hex Ed25519")
+	}
+}
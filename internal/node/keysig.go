@@ -0,0 +1,68 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// A peer signs its HPKE key with the Ed25519 identity key of its libp2p
+// peer ID, so that anyone handed the key by a node can tell whether the
+// peer itself vouched for it: a node substituting an HPKE key of its own
+// cannot sign it. Nodes check the signature a peer registers with and pass
+// it on; clients check it again, since they do not trust nodes to.
+const (
+	KeySignContext = "tmd hpke key v1"
+	MaxKeySigSize  = 64 // an Ed25519 signature
+)
+
+// KeySignInput returns the bytes a peer signs to vouch for its HPKE key:
+// "tmd hpke key v1" || 0 || nickname || 0 || keyID || hpkePub.
+func KeySignInput(nickname string, keyID, hpkePub []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(KeySignContext)
+	b.WriteByte(0)
+	b.WriteString(nickname)
+	b.WriteByte(0)
+	b.Write(keyID)
+	b.Write(hpkePub)
+	return b.Bytes()
+}
+
+// VerifyKeySig checks that sig vouches for the HPKE key of nickname with
+// the key of its peer ID. Nodes refuse registrations without one.
+func VerifyKeySig(id peer.ID, nickname string, keyID, hpkePub, sig []byte) error {
+	if len(sig) == 0 {
+		return fmt.Errorf("HPKE key of %s is not signed", nickname)
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("no key in peer ID: %w", err)
+	}
+	ok, err := pub.Verify(KeySignInput(nickname, keyID, hpkePub), sig)
+	if err != nil || !ok {
+		return fmt.Errorf("HPKE key of %s is not signed by its peer ID", nickname)
+	}
+	return nil
+}
+
+// ownKeySig returns the signature over our HPKE key to register with: the
+// one set with SetKeySig, or one made with the host key.
+func (c *Client) ownKeySig() ([]byte, error) {
+	c.mu.RLock()
+	sig := c.keySig
+	c.mu.RUnlock()
+	if len(sig) > 0 {
+		return sig, nil
+	}
+	priv := c.host.Peerstore().PrivKey(c.host.ID())
+	if priv == nil {
+		return nil, fmt.Errorf("no host key to sign our HPKE key with")
+	}
+	sig, err := priv.Sign(KeySignInput(c.nickname, c.keyID, c.hpkePub))
+	if err != nil {
+		return nil, fmt.Errorf("sign HPKE key: %w", err)
+	}
+	return sig, nil
+}
@@ -0,0 +1,85 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestServerChecksKeySig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &Config{Peers: map[string]string{"alice": "ta", "bob": "tb", "mallory": "tm"}}
+	srv := NewServer(newTestHost(t), cfg)
+
+	signedClient := func(nick string, hpkePub, signedPub []byte, events recordingHandler) *Client {
+		h := newTestHost(t)
+		sig := signKey(t, h, nick, signedPub)
+		c := NewClient(h, nick, cfg.Peers[nick], hpkePub, make([]byte, KeyIDSize), events)
+		if err := c.SetKeySig(sig); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		return c
+	}
+
+	aliceEvents := make(recordingHandler, 16)
+	alice := signedClient("alice", []byte("alice-hpke"), []byte("alice-hpke"), aliceEvents)
+	if err := alice.Connect(ctx, nodeAddr(srv)); err != nil {
+		t.Fatal(err)
+	}
+	bob := signedClient("bob", []byte("bob-hpke"), []byte("bob-hpke"), make(recordingHandler, 16))
+	if err := bob.Connect(ctx, nodeAddr(srv)); err != nil {
+		t.Fatal(err)
+	}
+	aliceEvents.expect(t, peerEvent{true, "bob"}, 2*time.Second)
+	info, _ := alice.GetPeer("bob")
+	if err := VerifyKeySig(info.PeerID, info.Nickname, info.KeyID, info.HPKEPub, info.KeySig); err != nil {
+		t.Fatalf("announced key signature: %v", err)
+	}
+	info.HPKEPub = []byte("node-hpke")
+	if err := VerifyKeySig(info.PeerID, info.Nickname, info.KeyID, info.HPKEPub, info.KeySig); err == nil {
+		t.Fatal("a substituted HPKE key verified")
+	}
+
+	// A signature over another key is refused at registration.
+	mallory := signedClient("mallory", []byte("mallory-hpke"), []byte("other-hpke"), make(recordingHandler, 16))
+	if err := mallory.Connect(ctx, nodeAddr(srv)); err == nil {
+		t.Fatal("registered with a key signature that does not verify")
+	}
+
+	// So is a registration without one.
+	h := newTestHost(t)
+	addr, err := peer.AddrInfoFromString(nodeAddr(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Connect(ctx, *addr); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := h.NewStream(ctx, srv.ID(), ProtocolID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	reg := &Register{Nickname: "mallory", Token: "tm", HPKEPub: []byte("mallory-hpke"), KeyID: make([]byte, KeyIDSize)}
+	if err := WriteMsg(stream, MsgRegister, EncodeRegister(reg)); err != nil {
+		t.Fatal(err)
+	}
+	if typ, _, err := ReadMsg(stream); err != nil || typ != MsgRegisterFail {
+		t.Fatalf("unsigned registration: got message %d, %v", typ, err)
+	}
+}
+
+func signKey(t *testing.T, h host.Host, nickname string, hpkePub []byte) []byte {
+	t.Helper()
+	sig, err := h.Peerstore().PrivKey(h.ID()).Sign(KeySignInput(nickname, make([]byte, KeyIDSize), hpkePub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
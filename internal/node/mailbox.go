@@ -0,0 +1,97 @@
+package node
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// Mailbox limits. Deposits past them are dropped: the node never tells the
+// depositor whether a payload was kept or delivered.
+const (
+	maxMailSize = 64 << 10 // bytes of data in one deposit
+	maxMailbox  = 256      // payloads kept per recipient; the oldest go first
+	mailTTL     = 7 * 24 * time.Hour
+)
+
+// heldMail is a deposit waiting for its recipient.
+type heldMail struct {
+	Mail
+	at time.Time
+}
+
+// deposit keeps a payload from nickname for d.To, or pushes it at once if
+// d.To is registered here. Only configured peers that from may see receive
+// mail. In a cluster the payload stays on this node.
+func (s *Server) deposit(from string, d *Deposit) {
+	if !s.mayMail(from, d) {
+		return
+	}
+	m := Mail{From: from, Data: d.Data}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stream, ok := s.streams[d.To]; ok {
+		WriteMsg(stream, MsgMail, EncodeMail(&m))
+		return
+	}
+	box := append(s.pruneMailLocked(d.To), heldMail{Mail: m, at: time.Now()})
+	if len(box) > maxMailbox {
+		box = box[len(box)-maxMailbox:]
+	}
+	s.mail[d.To] = box
+}
+
+// fanout pushes each item of f to its recipient, if registered here.
+func (s *Server) fanout(from string, f *Fanout) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range f.Items {
+		stream, ok := s.streams[d.To]
+		if !ok || !s.mayMail(from, &d) {
+			continue
+		}
+		WriteMsg(stream, MsgMail, EncodeMail(&Mail{From: from, Data: d.Data}))
+	}
+}
+
+// mayMail reports whether from may send d: to a configured peer, or a
+// device of one, it may see, other than itself, within maxMailSize.
+func (s *Server) mayMail(from string, d *Deposit) bool {
+	nickname, _ := SplitDevice(d.To)
+	return s.config.admits(nickname) && d.To != from && len(d.Data) <= maxMailSize && s.config.ACL.CanSee(from, d.To)
+}
+
+// deliverMail pushes what was deposited for nickname, oldest first, and
+// forgets it. It holds the lock so that new deposits queue behind.
+func (s *Server) deliverMail(nickname string, stream network.Stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	box := s.pruneMailLocked(nickname)
+	delete(s.mail, nickname)
+	for _, m := range box {
+		if err := WriteMsg(stream, MsgMail, EncodeMail(&m.Mail)); err != nil {
+			return
+		}
+	}
+}
+
+// heldMailLocked counts the payloads waiting for offline peers.
+func (s *Server) heldMailLocked() int {
+	n := 0
+	for _, box := range s.mail {
+		n += len(box)
+	}
+	return n
+}
+
+// pruneMailLocked drops the expired payloads held for nickname and returns
+// the others.
+func (s *Server) pruneMailLocked(nickname string) []heldMail {
+	box := s.mail[nickname]
+	cutoff := time.Now().Add(-mailTTL)
+	for len(box) > 0 && box[0].at.Before(cutoff) {
+		box = box[1:]
+	}
+	return box
+}
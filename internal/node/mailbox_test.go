@@ -0,0 +1,150 @@
+package node
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// mailHandler records presence events and mail.
+type mailHandler struct {
+	recordingHandler
+	mail chan Mail
+}
+
+func (h mailHandler) OnMail(from string, data []byte, _ peer.ID) {
+	h.mail <- Mail{From: from, Data: data}
+}
+
+func (h mailHandler) expectMail(t *testing.T, want Mail) {
+	t.Helper()
+	select {
+	case got := <-h.mail:
+		if got.From != want.From || string(got.Data) != string(want.Data) {
+			t.Fatalf("got mail %s/%q, want %s/%q", got.From, got.Data, want.From, want.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no mail %q", want.Data)
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	admin := newTestHost(t)
+	cfg := &Config{
+		Peers:  map[string]string{"alice": "ta", "bob": "tb", "carol": "tc"},
+		ACL:    &ACL{Groups: map[string][]string{"ab": {"alice", "bob"}}},
+		Admins: []string{admin.ID().String()},
+	}
+	srv := NewServer(newTestHost(t), cfg)
+	connect := func(nick string, h PeerHandler) *Client {
+		c := NewClient(newTestHost(t), nick, cfg.Peers[nick], []byte(nick+"-hpke"), make([]byte, 8), h)
+		if err := c.Connect(ctx, nodeAddr(srv)); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		return c
+	}
+
+	alice := connect("alice", make(recordingHandler, 16))
+	for _, d := range []Deposit{
+		{To: "bob", Data: []byte("sealed 1")},
+		{To: "zed", Data: []byte("unknown peer")},
+		{To: "carol", Data: []byte("hidden by the ACL")},
+		{To: "bob", Data: make([]byte, maxMailSize+1)},
+		{To: "bob", Data: []byte("sealed 2")},
+	} {
+		if err := alice.Deposit(d.To, d.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		st, err := QueryStatus(ctx, admin, nodeAddr(srv))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mail == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node holds %d payloads, want 2", st.Mail)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Held mail is pushed in order on registration, then live.
+	bob := mailHandler{make(recordingHandler, 16), make(chan Mail, 16)}
+	connect("bob", bob)
+	bob.expectMail(t, Mail{From: "alice", Data: []byte("sealed 1")})
+	bob.expectMail(t, Mail{From: "alice", Data: []byte("sealed 2")})
+
+	if err := alice.Deposit("bob", []byte("sealed 3")); err != nil {
+		t.Fatal(err)
+	}
+	bob.expectMail(t, Mail{From: "alice", Data: []byte("sealed 3")})
+
+	if st, err := QueryStatus(ctx, admin, nodeAddr(srv)); err != nil || st.Mail != 0 {
+		t.Fatalf("after delivery: %+v %v", st, err)
+	}
+}
+
+func TestFanout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	admin := newTestHost(t)
+	cfg := &Config{
+		Peers:  map[string]string{"alice": "ta", "bob": "tb", "carol": "tc", "dave": "td"},
+		ACL:    &ACL{Groups: map[string][]string{"abd": {"alice", "bob", "dave"}}},
+		Admins: []string{admin.ID().String()},
+	}
+	srv := NewServer(newTestHost(t), cfg)
+	connect := func(nick string, h PeerHandler) *Client {
+		c := NewClient(newTestHost(t), nick, cfg.Peers[nick], []byte(nick+"-hpke"), make([]byte, 8), h)
+		if err := c.Connect(ctx, nodeAddr(srv)); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		return c
+	}
+
+	bob := mailHandler{make(recordingHandler, 16), make(chan Mail, 16)}
+	carol := mailHandler{make(recordingHandler, 16), make(chan Mail, 16)}
+	connect("bob", bob)
+	connect("carol", carol)
+	alice := connect("alice", make(recordingHandler, 16))
+	err := alice.Fanout([]Deposit{
+		{To: "bob", Data: []byte("for bob")},
+		{To: "carol", Data: []byte("hidden by the ACL")},
+		{To: "dave", Data: []byte("offline")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.expectMail(t, Mail{From: "alice", Data: []byte("for bob")})
+
+	// Only online peers get fanned-out items: nothing is held for dave.
+	st, err := QueryStatus(ctx, admin, nodeAddr(srv))
+	if err != nil || st.Mail != 0 {
+		t.Fatalf("status = %+v, %v", st, err)
+	}
+	select {
+	case m := <-carol.mail:
+		t.Fatalf("carol got %q", m.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDepositNeedsNode(t *testing.T) {
+	c := NewClient(newTestHost(t), "alice", "ta", nil, make([]byte, 8), nil)
+	if err := c.Deposit("bob", []byte("x")); err == nil || !strings.Contains(err.Error(), "not connected") {
+		t.Fatalf("Deposit without nodes: %v", err)
+	}
+}
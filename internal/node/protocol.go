@@ -5,16 +5,18 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
+	"github.com/pivaldi/tmd/internal/keyid"
 )
 
 // ProtocolID for node discovery
 const ProtocolID = "/tmd/node/1.0.0"
 
 // KeyIDSize is the size of key fingerprints in bytes.
-const KeyIDSize = 8
+const KeyIDSize = keyid.Size
 
 // Message types
 const (
@@ -24,6 +26,21 @@ const (
 	MsgPeerList     byte = 4
 	MsgPeerJoined   byte = 5
 	MsgPeerLeft     byte = 6
+	MsgSubscribe    byte = 7
+	MsgUpdateAddrs  byte = 8  // client -> node, after registration
+	MsgPeerUpdated  byte = 9  // node -> client, PeerJoined payload
+	MsgJoinRoom     byte = 10 // client -> node, RoomJoin payload
+	MsgLeaveRoom    byte = 11 // client -> node, RoomJoin payload
+	MsgRoomMembers  byte = 12 // node -> client
+	MsgDeposit      byte = 13 // client -> node, Deposit payload
+	MsgMail         byte = 14 // node -> client, Mail payload
+	MsgFanout       byte = 15 // client -> node, Fanout payload
+	MsgSetPresence  byte = 16 // client -> node, SetPresence payload
+	MsgRevoke       byte = 17 // client -> node, Revoke payload
+	MsgRevocation   byte = 18 // node -> client, Revocation payload
+
+	MsgRegisterChallenge byte = 19 // node -> client, RegisterChallenge payload (see keyauth.go)
+	MsgRegisterProof     byte = 20 // client -> node, RegisterProof payload
 )
 
 // Register is sent by peer to node to authenticate.
@@ -31,7 +48,10 @@ type Register struct {
 	Nickname string
 	Token    string
 	HPKEPub  []byte
-	KeyID    []byte // 8-byte key fingerprint
+	KeyID    keyid.KeyID // fingerprint of HPKEPub; legacy ones are widened
+	Presence string      // empty: available
+	Profile  []byte      // signed by the peer, opaque to nodes; may be empty
+	KeySig   []byte      // HPKEPub signed by the peer (see keysig.go); may be empty
 }
 
 // RegisterOK confirms successful registration.
@@ -50,7 +70,11 @@ type PeerInfo struct {
 	PeerID   peer.ID
 	Addrs    []multiaddr.Multiaddr
 	HPKEPub  []byte
-	KeyID    []byte // 8-byte key fingerprint
+	KeyID    keyid.KeyID // fingerprint of HPKEPub; legacy ones are widened
+	Hints    []AddrHint  // empty, or one per address
+	Presence string      // empty: available
+	Profile  []byte      // as registered; may be empty
+	KeySig   []byte      // as registered; may be empty
 }
 
 // PeerList is sent to new peers with all online peers.
@@ -64,7 +88,114 @@ type PeerJoined struct {
 	PeerID   peer.ID
 	Addrs    []multiaddr.Multiaddr
 	HPKEPub  []byte
-	KeyID    []byte // 8-byte key fingerprint
+	KeyID    keyid.KeyID // fingerprint of HPKEPub; legacy ones are widened
+	Hints    []AddrHint  // empty, or one per address
+	Presence string      // empty: available
+	Profile  []byte      // as registered; may be empty
+	KeySig   []byte      // as registered; may be empty
+}
+
+// Presence values. Peers that never set one, including those that predate
+// presence, are available.
+const (
+	PresenceAvailable = "available"
+	PresenceAway      = "away"
+	PresenceBusy      = "busy"
+)
+
+// MaxProfileSize bounds the profile a peer registers. Nodes pass it on
+// without looking inside.
+const MaxProfileSize = 1024
+
+// ValidPresence reports whether p is empty or a known presence value.
+func ValidPresence(p string) bool {
+	switch p {
+	case "", PresenceAvailable, PresenceAway, PresenceBusy:
+		return true
+	}
+	return false
+}
+
+// SetPresence changes the presence of a registered peer. The node answers
+// nothing; it fans the change out as MsgPeerUpdated.
+type SetPresence struct {
+	Presence string
+}
+
+// UpdateAddrs replaces the advertised addresses of a registered peer. The
+// node answers nothing; it fans the change out as MsgPeerUpdated, whose
+// payload is encoded like PeerJoined.
+type UpdateAddrs struct {
+	Addrs []multiaddr.Multiaddr
+}
+
+// RoomJoin adds the sender to a room (MsgJoinRoom) or removes it
+// (MsgLeaveRoom). The node answers nothing; it pushes the new membership
+// to every member as RoomMembers.
+type RoomJoin struct {
+	Room string
+}
+
+// RoomMembers is the membership of a room, as far as the receiving member
+// may see it. It includes the receiver.
+type RoomMembers struct {
+	Room    string
+	Members []string
+}
+
+// maxRoomName bounds room names, "#" included.
+const maxRoomName = 64
+
+// ValidRoom reports whether name is a room name: "#" followed by up to 63
+// characters other than spaces and control characters.
+func ValidRoom(name string) bool {
+	if len(name) < 2 || len(name) > maxRoomName || name[0] != '#' {
+		return false
+	}
+	for _, r := range name[1:] {
+		if r <= ' ' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Deposit leaves a payload with the node for a registered peer that is
+// offline; the node pushes it as Mail when that peer registers. Data is
+// opaque to the node: clients seal it to the recipient's key.
+type Deposit struct {
+	To   string
+	Data []byte
+}
+
+// Mail is a deposited payload, pushed to its recipient. From is the
+// nickname the depositor registered with.
+type Mail struct {
+	From string
+	Data []byte
+}
+
+// Fanout asks the node to push each item, as Mail, to its recipient if
+// that peer is registered with the node; items for other peers are
+// dropped. Clients seal each item to its recipient, so one Fanout replaces
+// a session per peer without the node reading the payloads.
+type Fanout struct {
+	Items []Deposit
+}
+
+// Revoke publishes a statement, signed by the peer and opaque to nodes,
+// that one of its keys is compromised. The node keeps it and pushes it as
+// a Revocation to the peers that may see the revoker, now and whenever
+// they register.
+type Revoke struct {
+	Statement []byte
+}
+
+// Revocation is a published statement. From is the nickname that
+// published it, set by the node.
+type Revocation struct {
+	From      string
+	Statement []byte
 }
 
 // PeerLeft is broadcast when a peer goes offline.
@@ -72,6 +203,52 @@ type PeerLeft struct {
 	Nickname string
 }
 
+// PresenceFilter selects the peers whose presence a client wants to hear
+// about. It is sent to nodes in a Subscribe message (MsgSubscribe) at any
+// time after registration; nodes that predate it ignore it, so clients also
+// apply it locally.
+type PresenceFilter struct {
+	Follow []string // when non-empty, only these peers are announced
+	Mute   []string // never announced
+}
+
+// Allows reports whether presence events about nickname pass the filter.
+// The devices of a nickname pass as the nickname.
+func (f PresenceFilter) Allows(nickname string) bool {
+	nickname, _ = SplitDevice(nickname)
+	for _, m := range f.Mute {
+		if m == nickname {
+			return false
+		}
+	}
+	if len(f.Follow) == 0 {
+		return true
+	}
+	for _, m := range f.Follow {
+		if m == nickname {
+			return true
+		}
+	}
+	return false
+}
+
+func (f PresenceFilter) isZero() bool {
+	return len(f.Follow) == 0 && len(f.Mute) == 0
+}
+
+// Decoding limits. Lengths read off the wire are checked against them,
+// and against what is left of the message, before anything is allocated;
+// decoders refuse bytes left over after the last field they know.
+const (
+	// MaxMsgSize bounds a message, type included.
+	MaxMsgSize = 16 << 20
+	// MaxNicknameSize bounds a nickname, device included.
+	MaxNicknameSize = 256
+	// maxFieldSize bounds the other fields but payloads: tokens, keys,
+	// addresses, regions, reasons.
+	maxFieldSize = 4 << 10
+)
+
 // Wire format helpers
 func writeBlob(w io.Writer, b []byte) error {
 	var hdr [4]byte
@@ -83,12 +260,19 @@ func writeBlob(w io.Writer, b []byte) error {
 	return err
 }
 
-func readBlob(r io.Reader) ([]byte, error) {
+// readBlob reads a blob of at most max bytes.
+func readBlob(r *bytes.Reader, max int) ([]byte, error) {
 	var hdr [4]byte
 	if _, err := io.ReadFull(r, hdr[:]); err != nil {
 		return nil, err
 	}
 	n := binary.BigEndian.Uint32(hdr[:])
+	switch {
+	case uint64(n) > uint64(max):
+		return nil, fmt.Errorf("field of %d bytes exceeds %d", n, max)
+	case int64(n) > int64(r.Len()):
+		return nil, fmt.Errorf("field of %d bytes overruns the message", n)
+	}
 	b := make([]byte, n)
 	if _, err := io.ReadFull(r, b); err != nil {
 		return nil, err
@@ -100,14 +284,22 @@ func writeString(w io.Writer, s string) error {
 	return writeBlob(w, []byte(s))
 }
 
-func readString(r io.Reader) (string, error) {
-	b, err := readBlob(r)
+func readString(r *bytes.Reader, max int) (string, error) {
+	b, err := readBlob(r, max)
 	if err != nil {
 		return "", err
 	}
 	return string(b), nil
 }
 
+// expectEnd refuses bytes left in r after the last field.
+func expectEnd(r *bytes.Reader) error {
+	if r.Len() > 0 {
+		return fmt.Errorf("%d trailing bytes", r.Len())
+	}
+	return nil
+}
+
 // WriteMsg writes a typed message to the stream.
 func WriteMsg(w io.Writer, typ byte, payload []byte) error {
 	total := uint32(1 + len(payload))
@@ -123,7 +315,8 @@ func WriteMsg(w io.Writer, typ byte, payload []byte) error {
 	return err
 }
 
-// ReadMsg reads a typed message from the stream.
+// ReadMsg reads a typed message from the stream, refusing messages over
+// MaxMsgSize before allocating them.
 func ReadMsg(r io.Reader) (byte, []byte, error) {
 	var hdr [4]byte
 	if _, err := io.ReadFull(r, hdr[:]); err != nil {
@@ -133,6 +326,9 @@ func ReadMsg(r io.Reader) (byte, []byte, error) {
 	if n < 1 {
 		return 0, nil, fmt.Errorf("bad msg length")
 	}
+	if n > MaxMsgSize {
+		return 0, nil, fmt.Errorf("message of %d bytes exceeds %d", n, MaxMsgSize)
+	}
 	var typ [1]byte
 	if _, err := io.ReadFull(r, typ[:]); err != nil {
 		return 0, nil, err
@@ -151,35 +347,62 @@ func EncodeRegister(r *Register) []byte {
 	writeString(&b, r.Token)
 	writeBlob(&b, r.HPKEPub)
 	writeBlob(&b, r.KeyID) // 8-byte key fingerprint
+	// Optional trailers: the presence (possibly empty, when a profile
+	// follows), then the profile (possibly empty, when a key signature
+	// follows), then the key signature.
+	if r.Presence != "" || len(r.Profile) > 0 || len(r.KeySig) > 0 {
+		writeString(&b, r.Presence)
+	}
+	if len(r.Profile) > 0 || len(r.KeySig) > 0 {
+		writeBlob(&b, r.Profile)
+	}
+	if len(r.KeySig) > 0 {
+		writeBlob(&b, r.KeySig)
+	}
 	return b.Bytes()
 }
 
 func DecodeRegister(data []byte) (*Register, error) {
 	r := bytes.NewReader(data)
-	nickname, err := readString(r)
+	nickname, err := readString(r, MaxNicknameSize)
 	if err != nil {
 		return nil, err
 	}
-	token, err := readString(r)
+	token, err := readString(r, maxFieldSize)
 	if err != nil {
 		return nil, err
 	}
-	hpkePub, err := readBlob(r)
+	hpkePub, err := readBlob(r, maxFieldSize)
 	if err != nil {
 		return nil, err
 	}
-	keyID, err := readBlob(r)
+	rawKeyID, err := readBlob(r, maxFieldSize)
 	if err != nil {
 		return nil, err
 	}
-	if len(keyID) != KeyIDSize {
-		return nil, fmt.Errorf("invalid keyID size: %d", len(keyID))
+	keyID, err := keyid.Resolve(rawKeyID, hpkePub)
+	if err != nil {
+		return nil, err
+	}
+	presence, profile, err := readPresenceProfile(r)
+	if err != nil {
+		return nil, err
+	}
+	keySig, err := readKeySig(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectEnd(r); err != nil {
+		return nil, err
 	}
 	return &Register{
 		Nickname: nickname,
 		Token:    token,
 		HPKEPub:  hpkePub,
 		KeyID:    keyID,
+		Presence: presence,
+		Profile:  profile,
+		KeySig:   keySig,
 	}, nil
 }
 
@@ -189,6 +412,9 @@ func EncodeRegisterOK(r *RegisterOK) []byte {
 }
 
 func DecodeRegisterOK(data []byte) (*RegisterOK, error) {
+	if len(data) > maxFieldSize {
+		return nil, fmt.Errorf("peer ID of %d bytes", len(data))
+	}
 	return &RegisterOK{PeerID: peer.ID(data)}, nil
 }
 
@@ -198,6 +424,9 @@ func EncodeRegisterFail(r *RegisterFail) []byte {
 }
 
 func DecodeRegisterFail(data []byte) (*RegisterFail, error) {
+	if len(data) > maxFieldSize {
+		return nil, fmt.Errorf("reason of %d bytes", len(data))
+	}
 	return &RegisterFail{Reason: string(data)}, nil
 }
 
@@ -206,52 +435,82 @@ func EncodePeerJoined(p *PeerJoined) []byte {
 	var b bytes.Buffer
 	writeString(&b, p.Nickname)
 	writeString(&b, string(p.PeerID))
-	// Encode addrs count + each addr
-	binary.Write(&b, binary.BigEndian, uint32(len(p.Addrs)))
-	for _, addr := range p.Addrs {
-		writeBlob(&b, addr.Bytes())
-	}
+	writeAddrs(&b, p.Addrs)
 	writeBlob(&b, p.HPKEPub)
 	writeBlob(&b, p.KeyID) // 8-byte key fingerprint
+	// Optional trailers, only written when set so older clients and nodes
+	// keep exchanging the original layout: the address hints (possibly
+	// none, when more follows), the presence (possibly empty, when a
+	// profile follows), the profile (possibly empty, when a key signature
+	// follows), then the key signature.
+	more := p.Presence != "" || len(p.Profile) > 0 || len(p.KeySig) > 0
+	if len(p.Hints) > 0 || more {
+		binary.Write(&b, binary.BigEndian, uint32(len(p.Hints)))
+		for _, h := range p.Hints {
+			writeString(&b, h.Region)
+			binary.Write(&b, binary.BigEndian, uint32(h.Latency.Microseconds()))
+		}
+	}
+	if more {
+		writeString(&b, p.Presence)
+	}
+	if len(p.Profile) > 0 || len(p.KeySig) > 0 {
+		writeBlob(&b, p.Profile)
+	}
+	if len(p.KeySig) > 0 {
+		writeBlob(&b, p.KeySig)
+	}
 	return b.Bytes()
 }
 
 func DecodePeerJoined(data []byte) (*PeerJoined, error) {
 	r := bytes.NewReader(data)
-	nickname, err := readString(r)
+	nickname, err := readString(r, MaxNicknameSize)
 	if err != nil {
 		return nil, err
 	}
-	peerIDStr, err := readString(r)
+	peerIDStr, err := readString(r, maxFieldSize)
 	if err != nil {
 		return nil, err
 	}
-	var addrCount uint32
-	if err := binary.Read(r, binary.BigEndian, &addrCount); err != nil {
+	addrs, err := readAddrs(r)
+	if err != nil {
 		return nil, err
 	}
-	addrs := make([]multiaddr.Multiaddr, addrCount)
-	for i := range addrs {
-		addrBytes, err := readBlob(r)
-		if err != nil {
+	hpkePub, err := readBlob(r, maxFieldSize)
+	if err != nil {
+		return nil, err
+	}
+	rawKeyID, err := readBlob(r, maxFieldSize)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := keyid.Resolve(rawKeyID, hpkePub)
+	if err != nil {
+		return nil, err
+	}
+	var hints []AddrHint
+	if r.Len() > 0 {
+		if hints, err = readHints(r); err != nil {
 			return nil, err
 		}
-		addr, err := multiaddr.NewMultiaddrBytes(addrBytes)
-		if err != nil {
-			return nil, err
+		switch {
+		case len(hints) == 0:
+			hints = nil
+		case len(hints) != len(addrs):
+			return nil, fmt.Errorf("got %d address hints for %d addresses", len(hints), len(addrs))
 		}
-		addrs[i] = addr
 	}
-	hpkePub, err := readBlob(r)
+	presence, profile, err := readPresenceProfile(r)
 	if err != nil {
 		return nil, err
 	}
-	keyID, err := readBlob(r)
+	keySig, err := readKeySig(r)
 	if err != nil {
 		return nil, err
 	}
-	if len(keyID) != KeyIDSize {
-		return nil, fmt.Errorf("invalid keyID size: %d", len(keyID))
+	if err := expectEnd(r); err != nil {
+		return nil, err
 	}
 	return &PeerJoined{
 		Nickname: nickname,
@@ -259,18 +518,364 @@ func DecodePeerJoined(data []byte) (*PeerJoined, error) {
 		Addrs:    addrs,
 		HPKEPub:  hpkePub,
 		KeyID:    keyID,
+		Hints:    hints,
+		Presence: presence,
+		Profile:  profile,
+		KeySig:   keySig,
 	}, nil
 }
 
+// readPresenceProfile reads the optional presence and profile trailers.
+func readPresenceProfile(r *bytes.Reader) (presence string, profile []byte, err error) {
+	if r.Len() == 0 {
+		return "", nil, nil
+	}
+	if presence, err = readPresence(r); err != nil {
+		return "", nil, err
+	}
+	if r.Len() == 0 {
+		return presence, nil, nil
+	}
+	if profile, err = readBlob(r, MaxProfileSize); err != nil {
+		return "", nil, fmt.Errorf("profile: %w", err)
+	}
+	return presence, profile, nil
+}
+
+// readKeySig reads the optional key signature trailer.
+func readKeySig(r *bytes.Reader) ([]byte, error) {
+	if r.Len() == 0 {
+		return nil, nil
+	}
+	sig, err := readBlob(r, MaxKeySigSize)
+	if err != nil {
+		return nil, fmt.Errorf("key signature: %w", err)
+	}
+	return sig, nil
+}
+
+func readPresence(r *bytes.Reader) (string, error) {
+	p, err := readString(r, maxFieldSize)
+	if err != nil {
+		return "", err
+	}
+	if !ValidPresence(p) {
+		return "", fmt.Errorf("bad presence %q", p)
+	}
+	return p, nil
+}
+
+func readHints(r *bytes.Reader) ([]AddrHint, error) {
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	if int(count) > r.Len()/8 {
+		return nil, fmt.Errorf("bad hint count: %d", count)
+	}
+	hints := make([]AddrHint, count)
+	for i := range hints {
+		region, err := readString(r, maxFieldSize)
+		if err != nil {
+			return nil, err
+		}
+		var micros uint32
+		if err := binary.Read(r, binary.BigEndian, &micros); err != nil {
+			return nil, err
+		}
+		hints[i] = AddrHint{Region: region, Latency: time.Duration(micros) * time.Microsecond}
+	}
+	return hints, nil
+}
+
+// writeAddrs encodes addrs as a u32 count followed by one blob per addr.
+func writeAddrs(w io.Writer, addrs []multiaddr.Multiaddr) {
+	binary.Write(w, binary.BigEndian, uint32(len(addrs)))
+	for _, addr := range addrs {
+		writeBlob(w, addr.Bytes())
+	}
+}
+
+func readAddrs(r *bytes.Reader) ([]multiaddr.Multiaddr, error) {
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	if int(count) > r.Len()/4 {
+		return nil, fmt.Errorf("bad address count: %d", count)
+	}
+	addrs := make([]multiaddr.Multiaddr, count)
+	for i := range addrs {
+		addrBytes, err := readBlob(r, maxFieldSize)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := multiaddr.NewMultiaddrBytes(addrBytes)
+		if err != nil {
+			return nil, err
+		}
+		addrs[i] = addr
+	}
+	return addrs, nil
+}
+
+// Encode/Decode UpdateAddrs
+func EncodeUpdateAddrs(u *UpdateAddrs) []byte {
+	var b bytes.Buffer
+	writeAddrs(&b, u.Addrs)
+	return b.Bytes()
+}
+
+func DecodeUpdateAddrs(data []byte) (*UpdateAddrs, error) {
+	r := bytes.NewReader(data)
+	addrs, err := readAddrs(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectEnd(r); err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("empty address update")
+	}
+	return &UpdateAddrs{Addrs: addrs}, nil
+}
+
+// Encode/Decode SetPresence
+func EncodeSetPresence(p *SetPresence) []byte {
+	return []byte(p.Presence)
+}
+
+func DecodeSetPresence(data []byte) (*SetPresence, error) {
+	if !ValidPresence(string(data)) {
+		return nil, fmt.Errorf("bad presence %q", data)
+	}
+	return &SetPresence{Presence: string(data)}, nil
+}
+
+// Encode/Decode RoomJoin
+func EncodeRoomJoin(j *RoomJoin) []byte {
+	return []byte(j.Room)
+}
+
+func DecodeRoomJoin(data []byte) (*RoomJoin, error) {
+	if !ValidRoom(string(data)) {
+		return nil, fmt.Errorf("bad room name %q", data)
+	}
+	return &RoomJoin{Room: string(data)}, nil
+}
+
+// Encode/Decode RoomMembers
+func EncodeRoomMembers(m *RoomMembers) []byte {
+	var b bytes.Buffer
+	writeString(&b, m.Room)
+	writeStrings(&b, m.Members)
+	return b.Bytes()
+}
+
+func DecodeRoomMembers(data []byte) (*RoomMembers, error) {
+	r := bytes.NewReader(data)
+	room, err := readString(r, maxRoomName)
+	if err != nil {
+		return nil, err
+	}
+	if !ValidRoom(room) {
+		return nil, fmt.Errorf("bad room name %q", room)
+	}
+	members, err := readStrings(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectEnd(r); err != nil {
+		return nil, err
+	}
+	return &RoomMembers{Room: room, Members: members}, nil
+}
+
+// Encode/Decode Deposit
+func EncodeDeposit(d *Deposit) []byte {
+	var b bytes.Buffer
+	writeString(&b, d.To)
+	writeBlob(&b, d.Data)
+	return b.Bytes()
+}
+
+func DecodeDeposit(data []byte) (*Deposit, error) {
+	r := bytes.NewReader(data)
+	to, err := readString(r, MaxNicknameSize)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := readBlob(r, maxMailSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectEnd(r); err != nil {
+		return nil, err
+	}
+	return &Deposit{To: to, Data: payload}, nil
+}
+
+// Encode/Decode Mail
+func EncodeMail(m *Mail) []byte {
+	var b bytes.Buffer
+	writeString(&b, m.From)
+	writeBlob(&b, m.Data)
+	return b.Bytes()
+}
+
+func DecodeMail(data []byte) (*Mail, error) {
+	r := bytes.NewReader(data)
+	from, err := readString(r, MaxNicknameSize)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := readBlob(r, maxMailSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectEnd(r); err != nil {
+		return nil, err
+	}
+	return &Mail{From: from, Data: payload}, nil
+}
+
+// Encode/Decode Revoke
+func EncodeRevoke(r *Revoke) []byte {
+	return r.Statement
+}
+
+func DecodeRevoke(data []byte) (*Revoke, error) {
+	if len(data) == 0 || len(data) > maxRevocationSize {
+		return nil, fmt.Errorf("bad revocation length: %d", len(data))
+	}
+	return &Revoke{Statement: data}, nil
+}
+
+// Encode/Decode Revocation
+func EncodeRevocation(r *Revocation) []byte {
+	var b bytes.Buffer
+	writeString(&b, r.From)
+	writeBlob(&b, r.Statement)
+	return b.Bytes()
+}
+
+func DecodeRevocation(data []byte) (*Revocation, error) {
+	r := bytes.NewReader(data)
+	from, err := readString(r, MaxNicknameSize)
+	if err != nil {
+		return nil, err
+	}
+	statement, err := readBlob(r, maxRevocationSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectEnd(r); err != nil {
+		return nil, err
+	}
+	return &Revocation{From: from, Statement: statement}, nil
+}
+
+// Encode/Decode Fanout
+func EncodeFanout(f *Fanout) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(len(f.Items)))
+	for _, d := range f.Items {
+		writeString(&b, d.To)
+		writeBlob(&b, d.Data)
+	}
+	return b.Bytes()
+}
+
+func DecodeFanout(data []byte) (*Fanout, error) {
+	r := bytes.NewReader(data)
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	if int(count) > r.Len()/8 {
+		return nil, fmt.Errorf("bad fanout count: %d", count)
+	}
+	f := &Fanout{Items: make([]Deposit, count)}
+	for i := range f.Items {
+		to, err := readString(r, MaxNicknameSize)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := readBlob(r, maxMailSize)
+		if err != nil {
+			return nil, err
+		}
+		f.Items[i] = Deposit{To: to, Data: payload}
+	}
+	if err := expectEnd(r); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
 // Encode/Decode PeerLeft
 func EncodePeerLeft(p *PeerLeft) []byte {
 	return []byte(p.Nickname)
 }
 
 func DecodePeerLeft(data []byte) (*PeerLeft, error) {
+	if len(data) > MaxNicknameSize {
+		return nil, fmt.Errorf("nickname of %d bytes", len(data))
+	}
 	return &PeerLeft{Nickname: string(data)}, nil
 }
 
+// Encode/Decode Subscribe
+func EncodeSubscribe(f *PresenceFilter) []byte {
+	var b bytes.Buffer
+	writeStrings(&b, f.Follow)
+	writeStrings(&b, f.Mute)
+	return b.Bytes()
+}
+
+func DecodeSubscribe(data []byte) (*PresenceFilter, error) {
+	r := bytes.NewReader(data)
+	follow, err := readStrings(r)
+	if err != nil {
+		return nil, err
+	}
+	mute, err := readStrings(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectEnd(r); err != nil {
+		return nil, err
+	}
+	return &PresenceFilter{Follow: follow, Mute: mute}, nil
+}
+
+func writeStrings(w io.Writer, list []string) {
+	binary.Write(w, binary.BigEndian, uint32(len(list)))
+	for _, s := range list {
+		writeString(w, s)
+	}
+}
+
+func readStrings(r *bytes.Reader) ([]string, error) {
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	if int(count) > r.Len()/4 {
+		return nil, fmt.Errorf("bad string count: %d", count)
+	}
+	var list []string
+	for range count {
+		s, err := readString(r, MaxNicknameSize)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
 // Encode/Decode PeerList
 func EncodePeerList(p *PeerList) []byte {
 	var b bytes.Buffer
@@ -282,6 +887,10 @@ func EncodePeerList(p *PeerList) []byte {
 			Addrs:    peer.Addrs,
 			HPKEPub:  peer.HPKEPub,
 			KeyID:    peer.KeyID,
+			Hints:    peer.Hints,
+			Presence: peer.Presence,
+			Profile:  peer.Profile,
+			KeySig:   peer.KeySig,
 		}
 		encoded := EncodePeerJoined(joined)
 		writeBlob(&b, encoded)
@@ -295,9 +904,12 @@ func DecodePeerList(data []byte) (*PeerList, error) {
 	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
 		return nil, err
 	}
+	if int(count) > r.Len()/4 {
+		return nil, fmt.Errorf("bad peer count: %d", count)
+	}
 	peers := make([]PeerInfo, count)
 	for i := range peers {
-		peerData, err := readBlob(r)
+		peerData, err := readBlob(r, MaxMsgSize)
 		if err != nil {
 			return nil, err
 		}
@@ -311,7 +923,14 @@ func DecodePeerList(data []byte) (*PeerList, error) {
 			Addrs:    joined.Addrs,
 			HPKEPub:  joined.HPKEPub,
 			KeyID:    joined.KeyID,
+			Hints:    joined.Hints,
+			Presence: joined.Presence,
+			Profile:  joined.Profile,
+			KeySig:   joined.KeySig,
 		}
 	}
+	if err := expectEnd(r); err != nil {
+		return nil, err
+	}
 	return &PeerList{Peers: peers}, nil
 }
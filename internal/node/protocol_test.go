@@ -1,10 +1,15 @@
 package node
 
 import (
+	"bytes"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
+	"github.com/pivaldi/tmd/internal/keyid"
 )
 
 func TestEncodeDecodeRegister(t *testing.T) {
@@ -62,6 +67,217 @@ func TestEncodeDecodePeerJoined(t *testing.T) {
 	}
 }
 
+func TestEncodeDecodePeerJoinedHints(t *testing.T) {
+	a1, _ := multiaddr.NewMultiaddr("/ip4/10.1.0.5/tcp/9000")
+	a2, _ := multiaddr.NewMultiaddr("/ip4/10.2.0.5/tcp/9000")
+	orig := &PeerJoined{
+		Nickname: "bob",
+		PeerID:   peer.ID("12D3KooWtest"),
+		Addrs:    []multiaddr.Multiaddr{a1, a2},
+		HPKEPub:  []byte{5, 6, 7, 8},
+		KeyID:    []byte{0x42, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77},
+		Hints:    []AddrHint{{Region: "eu-west", Latency: 1500 * time.Microsecond}, {Region: "us-east"}},
+	}
+
+	decoded, err := DecodePeerJoined(EncodePeerJoined(orig))
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded.Hints, orig.Hints) {
+		t.Fatalf("hints = %+v, want %+v", decoded.Hints, orig.Hints)
+	}
+
+	// Without hints the encoding is the original layout.
+	orig.Hints = nil
+	decoded, err = DecodePeerJoined(EncodePeerJoined(orig))
+	if err != nil || decoded.Hints != nil {
+		t.Fatalf("decode without hints: %+v, %v", decoded, err)
+	}
+
+	// A hint count that does not match the addresses is rejected.
+	orig.Hints = []AddrHint{{Region: "eu-west"}}
+	if _, err := DecodePeerJoined(EncodePeerJoined(orig)); err == nil {
+		t.Fatal("decoded mismatched hints")
+	}
+}
+
+func TestEncodeDecodePresence(t *testing.T) {
+	reg := &Register{Nickname: "alice", Token: "t", HPKEPub: []byte{1}, KeyID: make([]byte, KeyIDSize), Presence: PresenceAway}
+	decodedReg, err := DecodeRegister(EncodeRegister(reg))
+	if err != nil || decodedReg.Presence != PresenceAway {
+		t.Fatalf("decode register: %+v, %v", decodedReg, err)
+	}
+
+	addr, _ := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/9000")
+	joined := &PeerJoined{
+		Nickname: "bob",
+		PeerID:   peer.ID("bob-id"),
+		Addrs:    []multiaddr.Multiaddr{addr},
+		HPKEPub:  []byte{1},
+		KeyID:    make([]byte, KeyIDSize),
+		Presence: PresenceBusy,
+	}
+	decoded, err := DecodePeerJoined(EncodePeerJoined(joined))
+	if err != nil || decoded.Presence != PresenceBusy || decoded.Hints != nil {
+		t.Fatalf("decode without hints: %+v, %v", decoded, err)
+	}
+	joined.Hints = []AddrHint{{Region: "eu-west"}}
+	decoded, err = DecodePeerJoined(EncodePeerJoined(joined))
+	if err != nil || decoded.Presence != PresenceBusy || len(decoded.Hints) != 1 {
+		t.Fatalf("decode with hints: %+v, %v", decoded, err)
+	}
+
+	if p, err := DecodeSetPresence(EncodeSetPresence(&SetPresence{Presence: PresenceAway})); err != nil || p.Presence != PresenceAway {
+		t.Fatalf("decode set presence: %+v, %v", p, err)
+	}
+	if _, err := DecodeSetPresence([]byte("asleep")); err == nil {
+		t.Fatal("decoded an unknown presence")
+	}
+	reg.Presence = "asleep"
+	if _, err := DecodeRegister(EncodeRegister(reg)); err == nil {
+		t.Fatal("decoded a register with an unknown presence")
+	}
+}
+
+func TestEncodeDecodeProfile(t *testing.T) {
+	profile := []byte("signed profile")
+	reg := &Register{Nickname: "alice", Token: "t", HPKEPub: []byte{1}, KeyID: make([]byte, KeyIDSize), Profile: profile}
+	decodedReg, err := DecodeRegister(EncodeRegister(reg))
+	if err != nil || decodedReg.Presence != "" || !bytes.Equal(decodedReg.Profile, profile) {
+		t.Fatalf("decode register: %+v, %v", decodedReg, err)
+	}
+
+	addr, _ := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/9000")
+	joined := &PeerJoined{
+		Nickname: "bob",
+		PeerID:   peer.ID("bob-id"),
+		Addrs:    []multiaddr.Multiaddr{addr},
+		HPKEPub:  []byte{1},
+		KeyID:    make([]byte, KeyIDSize),
+		Presence: PresenceAway,
+		Profile:  profile,
+	}
+	decoded, err := DecodePeerJoined(EncodePeerJoined(joined))
+	if err != nil || decoded.Presence != PresenceAway || !bytes.Equal(decoded.Profile, profile) {
+		t.Fatalf("decode peer joined: %+v, %v", decoded, err)
+	}
+
+	reg.Profile = make([]byte, MaxProfileSize+1)
+	if _, err := DecodeRegister(EncodeRegister(reg)); err == nil {
+		t.Fatal("decoded an oversized profile")
+	}
+}
+
+func TestEncodeDecodeKeySig(t *testing.T) {
+	sig := bytes.Repeat([]byte{7}, MaxKeySigSize)
+	reg := &Register{Nickname: "alice", Token: "t", HPKEPub: []byte{1}, KeyID: make([]byte, KeyIDSize), KeySig: sig}
+	decodedReg, err := DecodeRegister(EncodeRegister(reg))
+	if err != nil || decodedReg.Presence != "" || len(decodedReg.Profile) != 0 || !bytes.Equal(decodedReg.KeySig, sig) {
+		t.Fatalf("decode register: %+v, %v", decodedReg, err)
+	}
+
+	addr, _ := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/9000")
+	list := &PeerList{Peers: []PeerInfo{{
+		Nickname: "bob",
+		PeerID:   peer.ID("bob-id"),
+		Addrs:    []multiaddr.Multiaddr{addr},
+		HPKEPub:  []byte{1},
+		KeyID:    make([]byte, KeyIDSize),
+		KeySig:   sig,
+	}}}
+	decoded, err := DecodePeerList(EncodePeerList(list))
+	if err != nil || len(decoded.Peers) != 1 || decoded.Peers[0].Hints != nil || !bytes.Equal(decoded.Peers[0].KeySig, sig) {
+		t.Fatalf("decode peer list: %+v, %v", decoded, err)
+	}
+
+	reg.KeySig = make([]byte, MaxKeySigSize+1)
+	if _, err := DecodeRegister(EncodeRegister(reg)); err == nil {
+		t.Fatal("decoded an oversized key signature")
+	}
+}
+
+// TestStrictDecoding checks that decoders refuse fields over their limit
+// or past the end of the message, bytes after the last field and messages
+// over MaxMsgSize.
+func TestStrictDecoding(t *testing.T) {
+	reg := EncodeRegister(&Register{Nickname: "alice", Token: "t", HPKEPub: []byte{1}, KeyID: make([]byte, KeyIDSize)})
+	if _, err := DecodeRegister(append(reg, 0)); err == nil {
+		t.Fatal("trailing byte accepted")
+	}
+	if _, err := DecodeRegister(EncodeRegister(&Register{Nickname: strings.Repeat("a", MaxNicknameSize+1), KeyID: make([]byte, KeyIDSize)})); err == nil {
+		t.Fatal("oversized nickname accepted")
+	}
+	if _, err := DecodeMail([]byte{0xff, 0xff, 0xff, 0xff}); err == nil {
+		t.Fatal("overrunning blob accepted")
+	}
+	if _, err := DecodePeerList([]byte{0xff, 0xff, 0xff, 0xff}); err == nil {
+		t.Fatal("peer count past the message accepted")
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0x7f, 0xff, 0xff, 0xff, MsgRegister})
+	if _, _, err := ReadMsg(&buf); err == nil {
+		t.Fatal("message over MaxMsgSize accepted")
+	}
+}
+
+func TestEncodeDecodeUpdateAddrs(t *testing.T) {
+	a1, _ := multiaddr.NewMultiaddr("/ip4/192.0.2.7/tcp/9000")
+	a2, _ := multiaddr.NewMultiaddr("/ip6/2001:db8::7/tcp/9000")
+	decoded, err := DecodeUpdateAddrs(EncodeUpdateAddrs(&UpdateAddrs{Addrs: []multiaddr.Multiaddr{a1, a2}}))
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(decoded.Addrs) != 2 || !decoded.Addrs[0].Equal(a1) || !decoded.Addrs[1].Equal(a2) {
+		t.Fatalf("addrs = %v", decoded.Addrs)
+	}
+	if _, err := DecodeUpdateAddrs(EncodeUpdateAddrs(&UpdateAddrs{})); err == nil {
+		t.Fatal("decoded an empty update")
+	}
+}
+
+func TestEncodeDecodeRooms(t *testing.T) {
+	decoded, err := DecodeRoomMembers(EncodeRoomMembers(&RoomMembers{Room: "#dev", Members: []string{"alice", "bob"}}))
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if decoded.Room != "#dev" || len(decoded.Members) != 2 || decoded.Members[1] != "bob" {
+		t.Fatalf("decoded = %+v", decoded)
+	}
+
+	for _, room := range []string{"#dev", "#a-b.c", "#" + strings.Repeat("x", 63)} {
+		if j, err := DecodeRoomJoin(EncodeRoomJoin(&RoomJoin{Room: room})); err != nil || j.Room != room {
+			t.Fatalf("room %q: %+v %v", room, j, err)
+		}
+	}
+	for _, room := range []string{"", "#", "dev", "#two words", "#" + strings.Repeat("x", 64)} {
+		if _, err := DecodeRoomJoin(EncodeRoomJoin(&RoomJoin{Room: room})); err == nil {
+			t.Fatalf("room %q accepted", room)
+		}
+	}
+}
+
+func TestEncodeDecodeMail(t *testing.T) {
+	d, err := DecodeDeposit(EncodeDeposit(&Deposit{To: "bob", Data: []byte{1, 2, 3}}))
+	if err != nil || d.To != "bob" || string(d.Data) != "\x01\x02\x03" {
+		t.Fatalf("deposit = %+v, %v", d, err)
+	}
+	m, err := DecodeMail(EncodeMail(&Mail{From: "alice", Data: []byte("sealed")}))
+	if err != nil || m.From != "alice" || string(m.Data) != "sealed" {
+		t.Fatalf("mail = %+v, %v", m, err)
+	}
+	if _, err := DecodeMail([]byte{0, 0, 0, 5, 'a'}); err == nil {
+		t.Fatal("decoded a truncated mail")
+	}
+	f, err := DecodeFanout(EncodeFanout(&Fanout{Items: []Deposit{{To: "bob", Data: []byte("b")}, {To: "carol", Data: []byte("c")}}}))
+	if err != nil || len(f.Items) != 2 || f.Items[1].To != "carol" || string(f.Items[1].Data) != "c" {
+		t.Fatalf("fanout = %+v, %v", f, err)
+	}
+	if _, err := DecodeFanout([]byte{0xff, 0xff, 0xff, 0xff}); err == nil {
+		t.Fatal("decoded a fanout with a bad count")
+	}
+}
+
 func TestEncodeDecodePeerList(t *testing.T) {
 	addr1, _ := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/9001")
 	addr2, _ := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/9002")
@@ -143,3 +359,61 @@ func TestEncodeDecodeRegisterFail(t *testing.T) {
 		t.Fatalf("reason mismatch")
 	}
 }
+
+func TestEncodeDecodeSubscribe(t *testing.T) {
+	orig := &PresenceFilter{Follow: []string{"bob", "carol"}, Mute: []string{"dave"}}
+
+	data := EncodeSubscribe(orig)
+	decoded, err := DecodeSubscribe(data)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded, orig) {
+		t.Fatalf("got %+v, want %+v", decoded, orig)
+	}
+
+	if _, err := DecodeSubscribe([]byte{0xff, 0xff, 0xff, 0xff}); err == nil {
+		t.Fatal("accepted an oversized count")
+	}
+}
+
+func TestPresenceFilterAllows(t *testing.T) {
+	var all PresenceFilter
+	if !all.Allows("bob") {
+		t.Fatal("zero filter must allow everyone")
+	}
+
+	f := PresenceFilter{Follow: []string{"bob", "dave"}, Mute: []string{"dave"}}
+	for nick, want := range map[string]bool{"bob": true, "carol": false, "dave": false} {
+		if got := f.Allows(nick); got != want {
+			t.Errorf("Allows(%s) = %v, want %v", nick, got, want)
+		}
+	}
+}
+
+func TestDecodeLegacyKeyID(t *testing.T) {
+	hpkePub := []byte("alice-hpke")
+	full := keyid.Of(hpkePub)
+	reg := &Register{Nickname: "alice", Token: "t", HPKEPub: hpkePub, KeyID: keyid.KeyID{full[0]}}
+	decoded, err := DecodeRegister(EncodeRegister(reg))
+	if err != nil {
+		t.Fatalf("legacy register: %v", err)
+	}
+	if !bytes.Equal(decoded.KeyID, full) {
+		t.Fatalf("legacy register keyID = %x, want it widened to %x", decoded.KeyID, full)
+	}
+	reg.KeyID = keyid.KeyID{full[0] + 1}
+	if _, err := DecodeRegister(EncodeRegister(reg)); err == nil {
+		t.Fatal("a legacy keyID of another key was accepted")
+	}
+
+	joined := &PeerJoined{Nickname: "alice", PeerID: peer.ID("alice-id"), HPKEPub: hpkePub, KeyID: keyid.KeyID{full[0]}}
+	d, err := DecodePeerJoined(EncodePeerJoined(joined))
+	if err != nil {
+		t.Fatalf("legacy peer joined: %v", err)
+	}
+	if !bytes.Equal(d.KeyID, full) {
+		t.Fatalf("legacy peer joined keyID = %x, want %x", d.KeyID, full)
+	}
+}
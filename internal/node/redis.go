@@ -0,0 +1,136 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBackend stores cluster state in Redis: one key per registration
+// ("<prefix>:peer:<node>:<nick>") holding the JSON Record with a native
+// TTL matching its lease, plus a pub/sub channel ("<prefix>:events") on
+// which every change is announced.
+type RedisBackend struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisBackend connects to the Redis server at url
+// (redis://[user:pass@]host:port/db). prefix namespaces the keys so
+// several clusters can share a server; it defaults to "tmd".
+func NewRedisBackend(ctx context.Context, url, prefix string) (*RedisBackend, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("redis url: %w", err)
+	}
+	if prefix == "" {
+		prefix = "tmd"
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	return &RedisBackend{client: client, prefix: prefix}, nil
+}
+
+// Close releases the connection pool.
+func (r *RedisBackend) Close() error {
+	return r.client.Close()
+}
+
+func (r *RedisBackend) key(node, nickname string) string {
+	return r.prefix + ":peer:" + node + ":" + nickname
+}
+
+func (r *RedisBackend) channel() string {
+	return r.prefix + ":events"
+}
+
+func (r *RedisBackend) Put(ctx context.Context, rec Record) error {
+	ttl := time.Until(rec.Expires)
+	if ttl <= 0 {
+		return errors.New("redis: record already expired")
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := r.client.Set(ctx, r.key(rec.Node, rec.Nickname), data, ttl).Err(); err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, r.channel(), "put").Err()
+}
+
+func (r *RedisBackend) Delete(ctx context.Context, node, nickname string) error {
+	if err := r.client.Del(ctx, r.key(node, nickname)).Err(); err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, r.channel(), "delete").Err()
+}
+
+func (r *RedisBackend) List(ctx context.Context) ([]Record, error) {
+	var keys []string
+	iter := r.client.Scan(ctx, 0, r.prefix+":peer:*", 256).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	vals, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0, len(vals))
+	for _, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			continue // expired between SCAN and MGET
+		}
+		var rec Record
+		if err := json.Unmarshal([]byte(s), &rec); err != nil {
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func (r *RedisBackend) Watch(ctx context.Context) (<-chan struct{}, error) {
+	sub := r.client.Subscribe(ctx, r.channel())
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, fmt.Errorf("redis subscribe: %w", err)
+	}
+
+	out := make(chan struct{}, 1)
+	go func() {
+		defer close(out)
+		defer sub.Close()
+		msgs := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-msgs:
+				if !ok {
+					return
+				}
+				select {
+				case out <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,60 @@
+package node
+
+import (
+	"bytes"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// Revocation limits. Statements past them are dropped.
+const (
+	maxRevocationSize = 1 << 10 // bytes of one statement
+	maxRevocations    = 16      // statements kept per peer; the oldest go first
+)
+
+// revoke keeps a statement published by nickname and pushes it to the
+// peers that may see it. Statements are kept for the life of the node; in
+// a cluster they stay on this node, so clients publish to every node they
+// are connected to.
+func (s *Server) revoke(from string, r *Revoke) {
+	if len(r.Statement) > maxRevocationSize {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.revoked[from]
+	for _, st := range kept {
+		if bytes.Equal(st, r.Statement) {
+			return
+		}
+	}
+	kept = append(kept, r.Statement)
+	if len(kept) > maxRevocations {
+		kept = kept[len(kept)-maxRevocations:]
+	}
+	s.revoked[from] = kept
+
+	encoded := EncodeRevocation(&Revocation{From: from, Statement: r.Statement})
+	for viewer, stream := range s.streams {
+		if viewer != from && s.config.ACL.CanSee(viewer, from) {
+			WriteMsg(stream, MsgRevocation, encoded)
+		}
+	}
+}
+
+// deliverRevocations pushes the statements kept from the peers nickname
+// may see, its own included.
+func (s *Server) deliverRevocations(nickname string, stream network.Stream) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for from, kept := range s.revoked {
+		if !s.config.ACL.CanSee(nickname, from) {
+			continue
+		}
+		for _, st := range kept {
+			if err := WriteMsg(stream, MsgRevocation, EncodeRevocation(&Revocation{From: from, Statement: st})); err != nil {
+				return
+			}
+		}
+	}
+}
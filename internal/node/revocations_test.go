@@ -0,0 +1,96 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// revocationHandler records presence events and revocations.
+type revocationHandler struct {
+	recordingHandler
+	revoked chan Revocation
+}
+
+func (h revocationHandler) OnRevocation(from string, statement []byte, _ peer.ID) {
+	h.revoked <- Revocation{From: from, Statement: statement}
+}
+
+func (h revocationHandler) expect(t *testing.T, want Revocation) {
+	t.Helper()
+	select {
+	case got := <-h.revoked:
+		if got.From != want.From || string(got.Statement) != string(want.Statement) {
+			t.Fatalf("got revocation %s/%q, want %s/%q", got.From, got.Statement, want.From, want.Statement)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no revocation %q", want.Statement)
+	}
+}
+
+func (h revocationHandler) expectNone(t *testing.T) {
+	t.Helper()
+	select {
+	case got := <-h.revoked:
+		t.Fatalf("got revocation %s/%q", got.From, got.Statement)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRevocations(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cfg := &Config{
+		Peers: map[string]string{"alice": "ta", "bob": "tb", "carol": "tc", "dave": "td"},
+		ACL:   &ACL{Groups: map[string][]string{"abd": {"alice", "bob", "dave"}}},
+	}
+	srv := NewServer(newTestHost(t), cfg)
+	connect := func(nick string, h PeerHandler) *Client {
+		c := NewClient(newTestHost(t), nick, cfg.Peers[nick], []byte(nick+"-hpke"), make([]byte, 8), h)
+		if err := c.Connect(ctx, nodeAddr(srv)); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		return c
+	}
+
+	bob := revocationHandler{make(recordingHandler, 16), make(chan Revocation, 16)}
+	carol := revocationHandler{make(recordingHandler, 16), make(chan Revocation, 16)}
+	connect("bob", bob)
+	connect("carol", carol)
+	alice := connect("alice", make(recordingHandler, 16))
+
+	// Published statements are pushed at once to the peers that may see
+	// alice, once each.
+	for _, st := range []string{"signed 1", "signed 1", string(make([]byte, maxRevocationSize+1)), "signed 2"} {
+		if err := alice.Revoke([]byte(st)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bob.expect(t, Revocation{From: "alice", Statement: []byte("signed 1")})
+	bob.expect(t, Revocation{From: "alice", Statement: []byte("signed 2")})
+	bob.expectNone(t)
+	carol.expectNone(t)
+
+	// They are kept for the peers registering later.
+	dave := revocationHandler{make(recordingHandler, 16), make(chan Revocation, 16)}
+	connect("dave", dave)
+	dave.expect(t, Revocation{From: "alice", Statement: []byte("signed 1")})
+	dave.expect(t, Revocation{From: "alice", Statement: []byte("signed 2")})
+}
+
+func TestEncodeDecodeRevocation(t *testing.T) {
+	r, err := DecodeRevocation(EncodeRevocation(&Revocation{From: "alice", Statement: []byte("signed")}))
+	if err != nil || r.From != "alice" || string(r.Statement) != "signed" {
+		t.Fatalf("revocation = %+v, %v", r, err)
+	}
+	if _, err := DecodeRevocation([]byte{0, 0, 0, 5, 'a'}); err == nil {
+		t.Fatal("decoded a truncated revocation")
+	}
+	if _, err := DecodeRevoke(nil); err == nil {
+		t.Fatal("decoded an empty revoke")
+	}
+}
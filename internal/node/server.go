@@ -1,21 +1,30 @@
 package node
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
+	"github.com/pivaldi/tmd/internal/keyid"
 )
 
 // Config for the node server.
 type Config struct {
-	Listen string            `json:"listen"`
-	Peers  map[string]string `json:"peers"` // nickname -> token
+	Listen    string              `json:"listen"`
+	Peers     map[string]string   `json:"peers"`                // nickname -> token
+	Keys      map[string][]string `json:"keys,omitempty"`       // nickname -> Ed25519 keys, hex; registers by key (see keyauth.go)
+	Cluster   *ClusterConfig      `json:"cluster,omitempty"`    // nil: standalone node
+	ACL       *ACL                `json:"acl,omitempty"`        // nil: every peer sees every peer
+	AddrHints *AddrHintsConfig    `json:"addr_hints,omitempty"` // nil: addresses go out unannotated
+	Admins    []string            `json:"admins,omitempty"`     // peer IDs allowed to query status
 }
 
 // LoadConfig loads config from a JSON file.
@@ -28,17 +37,41 @@ func LoadConfig(path string) (*Config, error) {
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("parse config: %w", err)
 	}
+	if cfg.ACL != nil {
+		if err := cfg.ACL.validate(); err != nil {
+			return nil, fmt.Errorf("parse config: %w", err)
+		}
+	}
+	if cfg.AddrHints != nil {
+		if err := cfg.AddrHints.validate(); err != nil {
+			return nil, fmt.Errorf("parse config: %w", err)
+		}
+	}
+	if err := validateKeys(cfg.Keys); err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+	for _, id := range cfg.Admins {
+		if _, err := peer.Decode(id); err != nil {
+			return nil, fmt.Errorf("parse config: admin %q: %w", id, err)
+		}
+	}
 	return &cfg, nil
 }
 
 // Server is the node discovery server.
 type Server struct {
-	host   host.Host
-	config *Config
-
-	mu      sync.RWMutex
-	online  map[string]*onlinePeer       // nickname -> peer info
-	streams map[string]network.Stream    // nickname -> stream for push
+	host    host.Host
+	config  *Config
+	started time.Time
+
+	mu       sync.RWMutex
+	online   map[string]*onlinePeer    // nickname -> peer info
+	streams  map[string]network.Stream // nickname -> stream for push
+	filters  map[string]PresenceFilter // nickname -> presence subscription
+	activity map[string]time.Time      // nickname -> last message received
+	mail     map[string][]heldMail     // nickname -> deposits awaiting it
+	revoked  map[string][][]byte       // nickname -> revocation statements it published
+	cluster  *cluster                  // nil unless EnableCluster was called
 }
 
 type onlinePeer struct {
@@ -46,22 +79,34 @@ type onlinePeer struct {
 	PeerID   peer.ID
 	Addrs    []multiaddr.Multiaddr
 	HPKEPub  []byte
-	KeyID    []byte // 8-byte key fingerprint
+	KeyID    keyid.KeyID
+	Hints    []AddrHint
+	Presence string
+	Profile  []byte
+	KeySig   []byte
+	Since    time.Time // registration time
+	Rooms    []string  // sorted
 }
 
 // NewServer creates a new node server.
 func NewServer(h host.Host, cfg *Config) *Server {
 	s := &Server{
-		host:    h,
-		config:  cfg,
-		online:  make(map[string]*onlinePeer),
-		streams: make(map[string]network.Stream),
+		host:     h,
+		config:   cfg,
+		online:   make(map[string]*onlinePeer),
+		streams:  make(map[string]network.Stream),
+		filters:  make(map[string]PresenceFilter),
+		activity: make(map[string]time.Time),
+		mail:     make(map[string][]heldMail),
+		revoked:  make(map[string][][]byte),
+		started:  time.Now(),
 	}
 
 	// Wrap handler in goroutine to allow concurrent connections
 	h.SetStreamHandler(ProtocolID, func(stream network.Stream) {
 		go s.handleStream(stream)
 	})
+	h.SetStreamHandler(StatusProtocolID, s.handleStatus)
 
 	return s
 }
@@ -85,28 +130,60 @@ func (s *Server) handleStream(stream network.Stream) {
 		return
 	}
 
-	// Validate token
-	expectedToken, ok := s.config.Peers[reg.Nickname]
-	if !ok {
-		s.sendFail(stream, "unknown nickname")
+	// Validate the key or token; devices use their nickname's.
+	nickname, device := SplitDevice(reg.Nickname)
+	if device != "" && !ValidDevice(device) {
+		s.sendFail(stream, "invalid device name")
 		return
 	}
-	if reg.Token != expectedToken {
-		s.sendFail(stream, "invalid token")
+	if allowed, ok := s.config.Keys[nickname]; ok {
+		if err := s.challengeRegistration(stream, reg.Nickname, allowed); err != nil {
+			s.sendFail(stream, err.Error())
+			return
+		}
+	} else {
+		expectedToken, ok := s.config.Peers[nickname]
+		if !ok {
+			s.sendFail(stream, "unknown nickname")
+			return
+		}
+		if reg.Token != expectedToken {
+			s.sendFail(stream, "invalid token")
+			return
+		}
+	}
+
+	// Get peer's addresses from the connection
+	peerID := stream.Conn().RemotePeer()
+	if err := VerifyKeySig(peerID, reg.Nickname, reg.KeyID, reg.HPKEPub, reg.KeySig); err != nil {
+		s.sendFail(stream, "HPKE key signature missing or invalid")
 		return
 	}
+	addrs := s.host.Peerstore().Addrs(peerID)
+	if len(addrs) == 0 {
+		// Identify may not have completed yet; the address the peer dialed
+		// from is reachable thanks to TCP port reuse.
+		addrs = append(addrs, stream.Conn().RemoteMultiaddr())
+	}
+	// Annotating may ping the peer, so do it before taking the lock.
+	hints := s.hintAddrs(stream.Conn(), addrs)
 
 	// Check if already online
 	s.mu.Lock()
+	cl := s.cluster
 	if _, exists := s.online[reg.Nickname]; exists {
 		s.mu.Unlock()
 		s.sendFail(stream, "nickname already in use")
 		return
 	}
-
-	// Get peer's addresses from the connection
-	peerID := stream.Conn().RemotePeer()
-	addrs := s.host.Peerstore().Addrs(peerID)
+	if cl != nil {
+		// The same identity may hold registrations on several nodes.
+		if p, ok := cl.peer(reg.Nickname); ok && p.PeerID != peerID {
+			s.mu.Unlock()
+			s.sendFail(stream, "nickname already in use")
+			return
+		}
+	}
 
 	newPeer := &onlinePeer{
 		Nickname: reg.Nickname,
@@ -114,14 +191,29 @@ func (s *Server) handleStream(stream network.Stream) {
 		Addrs:    addrs,
 		HPKEPub:  reg.HPKEPub,
 		KeyID:    reg.KeyID,
+		Hints:    hints,
+		Presence: reg.Presence,
+		Profile:  reg.Profile,
+		KeySig:   reg.KeySig,
+		Since:    time.Now(),
 	}
 
 	// Build peer list before adding new peer
-	peerList := s.buildPeerList()
+	var peerList []PeerInfo
+	if cl != nil {
+		for _, p := range cl.peers() {
+			if p.Nickname != reg.Nickname && s.config.ACL.CanSee(reg.Nickname, p.Nickname) {
+				peerList = append(peerList, p)
+			}
+		}
+	} else {
+		peerList = s.buildPeerList(reg.Nickname)
+	}
 
 	// Add to online peers
 	s.online[reg.Nickname] = newPeer
 	s.streams[reg.Nickname] = stream
+	s.activity[reg.Nickname] = newPeer.Since
 	s.mu.Unlock()
 
 	// Send RegisterOK
@@ -136,55 +228,298 @@ func (s *Server) handleStream(stream network.Stream) {
 		return
 	}
 
-	// Broadcast PeerJoined to others
-	s.broadcastJoined(newPeer)
+	// Mail deposited while the peer was away comes before anything else.
+	s.deliverMail(reg.Nickname, stream)
+	s.deliverRevocations(reg.Nickname, stream)
 
-	// Keep stream open for push messages, wait for close
-	buf := make([]byte, 1)
+	// Broadcast PeerJoined to others; in a cluster the refresh does it for
+	// every node.
+	if cl != nil {
+		s.clusterSync(func(ctx context.Context) error { return s.publish(ctx, newPeer) })
+	} else {
+		s.broadcastJoined(newPeer)
+	}
+
+	// Keep stream open for push messages and subscription updates, wait
+	// for close
 	for {
-		_, err := stream.Read(buf)
+		typ, payload, err := ReadMsg(stream)
 		if err != nil {
 			break
 		}
+		s.touch(reg.Nickname)
+		switch typ {
+		case MsgSubscribe:
+			if f, err := DecodeSubscribe(payload); err == nil {
+				s.setFilter(reg.Nickname, *f)
+			}
+		case MsgUpdateAddrs:
+			if u, err := DecodeUpdateAddrs(payload); err == nil {
+				s.updateAddrs(reg.Nickname, stream.Conn(), u.Addrs)
+			}
+		case MsgSetPresence:
+			if p, err := DecodeSetPresence(payload); err == nil {
+				s.setPresence(reg.Nickname, p.Presence)
+			}
+		case MsgJoinRoom, MsgLeaveRoom:
+			if j, err := DecodeRoomJoin(payload); err == nil {
+				s.setRoom(reg.Nickname, j.Room, typ == MsgJoinRoom)
+			}
+		case MsgDeposit:
+			if d, err := DecodeDeposit(payload); err == nil {
+				s.deposit(reg.Nickname, d)
+			}
+		case MsgFanout:
+			if f, err := DecodeFanout(payload); err == nil {
+				s.fanout(reg.Nickname, f)
+			}
+		case MsgRevoke:
+			if r, err := DecodeRevoke(payload); err == nil {
+				s.revoke(reg.Nickname, r)
+			}
+		}
 	}
 
 	// Peer disconnected
-	s.removePeer(reg.Nickname)
-	s.broadcastLeft(reg.Nickname)
+	left := s.removePeer(reg.Nickname)
+	if cl != nil {
+		if cl.ctx.Err() != nil {
+			// The node is shutting down: leave the record to its lease.
+			return
+		}
+		s.clusterSync(func(ctx context.Context) error {
+			return cl.backend.Delete(ctx, s.host.ID().String(), reg.Nickname)
+		})
+	} else {
+		s.broadcastLeft(reg.Nickname)
+		if left != nil {
+			for _, room := range left.Rooms {
+				s.pushRoom(room)
+			}
+		}
+	}
+}
+
+// clusterSync applies a local change to the cluster backend and refreshes
+// the view so that connected peers are notified.
+func (s *Server) clusterSync(change func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := change(ctx); err != nil {
+		s.cluster.logf("cluster update: %v", err)
+	}
+	if err := s.refresh(ctx); err != nil {
+		s.cluster.logf("cluster refresh: %v", err)
+	}
+}
+
+// updateAddrs replaces the advertised addresses of nickname and pushes
+// them to the peers that see it.
+func (s *Server) updateAddrs(nickname string, conn network.Conn, addrs []multiaddr.Multiaddr) {
+	hints := s.hintAddrs(conn, addrs)
+
+	s.mu.Lock()
+	old, ok := s.online[nickname]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	// Replace rather than mutate: the cluster publishes peers outside mu.
+	updated := *old
+	updated.Addrs = addrs
+	updated.Hints = hints
+	s.online[nickname] = &updated
+	cl := s.cluster
+	s.mu.Unlock()
+
+	if cl != nil {
+		s.clusterSync(func(ctx context.Context) error { return s.publish(ctx, &updated) })
+	} else {
+		s.broadcastPeer(MsgPeerUpdated, &updated)
+	}
+}
+
+// setPresence changes the presence of nickname and pushes it to the peers
+// that see it.
+func (s *Server) setPresence(nickname, presence string) {
+	s.mu.Lock()
+	old, ok := s.online[nickname]
+	if !ok || old.Presence == presence {
+		s.mu.Unlock()
+		return
+	}
+	updated := *old
+	updated.Presence = presence
+	s.online[nickname] = &updated
+	cl := s.cluster
+	s.mu.Unlock()
+
+	if cl != nil {
+		s.clusterSync(func(ctx context.Context) error { return s.publish(ctx, &updated) })
+	} else {
+		s.broadcastPeer(MsgPeerUpdated, &updated)
+	}
+}
+
+// setRoom adds nickname to room or removes it from it, and pushes the new
+// membership to the room.
+func (s *Server) setRoom(nickname, room string, join bool) {
+	s.mu.Lock()
+	old, ok := s.online[nickname]
+	if !ok || slices.Contains(old.Rooms, room) == join {
+		s.mu.Unlock()
+		return
+	}
+	updated := *old
+	if join {
+		updated.Rooms = append(slices.Clone(old.Rooms), room)
+		slices.Sort(updated.Rooms)
+	} else {
+		updated.Rooms = slices.DeleteFunc(slices.Clone(old.Rooms), func(r string) bool { return r == room })
+	}
+	s.online[nickname] = &updated
+	cl := s.cluster
+	s.mu.Unlock()
+
+	if cl != nil {
+		s.clusterSync(func(ctx context.Context) error { return s.publish(ctx, &updated) })
+	} else {
+		s.pushRoom(room)
+	}
+}
+
+// pushRoom sends the membership of room to its locally connected members,
+// each seeing only the members the ACL lets it see.
+func (s *Server) pushRoom(room string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var members []string
+	if s.cluster != nil {
+		members = s.cluster.roomMembers(room)
+	} else {
+		for _, p := range s.online {
+			if slices.Contains(p.Rooms, room) {
+				members = append(members, p.Nickname)
+			}
+		}
+		slices.Sort(members)
+	}
+
+	for _, viewer := range members {
+		stream, ok := s.streams[viewer]
+		if !ok {
+			continue // registered with another node
+		}
+		visible := slices.DeleteFunc(slices.Clone(members), func(m string) bool {
+			return m != viewer && !s.config.ACL.CanSee(viewer, m)
+		})
+		WriteMsg(stream, MsgRoomMembers, EncodeRoomMembers(&RoomMembers{Room: room, Members: visible}))
+	}
+}
+
+// setFilter replaces the presence subscription of nickname and announces
+// the peers it now reveals or hides.
+func (s *Server) setFilter(nickname string, f PresenceFilter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, ok := s.streams[nickname]
+	if !ok {
+		return
+	}
+	old := s.filters[nickname]
+	s.filters[nickname] = f
+
+	var peers []PeerInfo
+	if s.cluster != nil {
+		peers = s.cluster.peers()
+	} else {
+		peers = s.buildPeerList(nickname)
+	}
+	for _, p := range peers {
+		if p.Nickname == nickname || !s.config.ACL.CanSee(nickname, p.Nickname) {
+			continue
+		}
+		was, now := old.Allows(p.Nickname), f.Allows(p.Nickname)
+		switch {
+		case now && !was:
+			WriteMsg(stream, MsgPeerJoined, EncodePeerJoined(&PeerJoined{
+				Nickname: p.Nickname,
+				PeerID:   p.PeerID,
+				Addrs:    p.Addrs,
+				HPKEPub:  p.HPKEPub,
+				KeyID:    p.KeyID,
+				Hints:    p.Hints,
+				Presence: p.Presence,
+				Profile:  p.Profile,
+				KeySig:   p.KeySig,
+			}))
+		case was && !now:
+			WriteMsg(stream, MsgPeerLeft, EncodePeerLeft(&PeerLeft{Nickname: p.Nickname}))
+		}
+	}
+}
+
+// announces reports whether presence of target is pushed to viewer.
+func (s *Server) announces(viewer, target string) bool {
+	return s.config.ACL.CanSee(viewer, target) && s.filters[viewer].Allows(target)
 }
 
 func (s *Server) sendFail(stream network.Stream, reason string) {
 	WriteMsg(stream, MsgRegisterFail, EncodeRegisterFail(&RegisterFail{Reason: reason}))
 }
 
-func (s *Server) buildPeerList() []PeerInfo {
+// buildPeerList lists the online peers viewer may see.
+func (s *Server) buildPeerList(viewer string) []PeerInfo {
 	var list []PeerInfo
 	for _, p := range s.online {
+		if !s.config.ACL.CanSee(viewer, p.Nickname) {
+			continue
+		}
 		list = append(list, PeerInfo{
 			Nickname: p.Nickname,
 			PeerID:   p.PeerID,
 			Addrs:    p.Addrs,
 			HPKEPub:  p.HPKEPub,
 			KeyID:    p.KeyID,
+			Hints:    p.Hints,
+			Presence: p.Presence,
+			Profile:  p.Profile,
+			KeySig:   p.KeySig,
 		})
 	}
 	return list
 }
 
-func (s *Server) removePeer(nickname string) {
+// removePeer forgets nickname and returns its registration, if any.
+func (s *Server) removePeer(nickname string) *onlinePeer {
 	s.mu.Lock()
+	p := s.online[nickname]
 	delete(s.online, nickname)
 	delete(s.streams, nickname)
+	delete(s.filters, nickname)
+	delete(s.activity, nickname)
 	s.mu.Unlock()
+	return p
 }
 
 func (s *Server) broadcastJoined(p *onlinePeer) {
+	s.broadcastPeer(MsgPeerJoined, p)
+}
+
+// broadcastPeer pushes p as a PeerJoined-encoded message of type typ.
+func (s *Server) broadcastPeer(typ byte, p *onlinePeer) {
 	msg := &PeerJoined{
 		Nickname: p.Nickname,
 		PeerID:   p.PeerID,
 		Addrs:    p.Addrs,
 		HPKEPub:  p.HPKEPub,
 		KeyID:    p.KeyID,
+		Hints:    p.Hints,
+		Presence: p.Presence,
+		Profile:  p.Profile,
+		KeySig:   p.KeySig,
 	}
 	encoded := EncodePeerJoined(msg)
 
@@ -192,8 +527,8 @@ func (s *Server) broadcastJoined(p *onlinePeer) {
 	defer s.mu.RUnlock()
 
 	for nickname, stream := range s.streams {
-		if nickname != p.Nickname {
-			WriteMsg(stream, MsgPeerJoined, encoded)
+		if nickname != p.Nickname && s.announces(nickname, p.Nickname) {
+			WriteMsg(stream, typ, encoded)
 		}
 	}
 }
@@ -205,8 +540,10 @@ func (s *Server) broadcastLeft(nickname string) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	for _, stream := range s.streams {
-		WriteMsg(stream, MsgPeerLeft, encoded)
+	for viewer, stream := range s.streams {
+		if s.announces(viewer, nickname) {
+			WriteMsg(stream, MsgPeerLeft, encoded)
+		}
 	}
 }
 
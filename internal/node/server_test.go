@@ -0,0 +1,191 @@
+package node
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+func TestServerPresenceSubscription(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &Config{Peers: map[string]string{"alice": "ta", "bob": "tb", "carol": "tc"}}
+	srv := NewServer(newTestHost(t), cfg)
+
+	connect := func(nick string, events recordingHandler) *Client {
+		c := NewClient(newTestHost(t), nick, cfg.Peers[nick], []byte(nick+"-hpke"), make([]byte, 8), events)
+		if err := c.Connect(ctx, nodeAddr(srv)); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		return c
+	}
+	quiet := func(h recordingHandler) {
+		t.Helper()
+		select {
+		case ev := <-h:
+			t.Fatalf("unexpected event %+v", ev)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	aliceEvents := make(recordingHandler, 16)
+	alice := connect("alice", aliceEvents)
+	alice.SetPresenceFilter(PresenceFilter{Mute: []string{"bob"}})
+
+	connect("bob", make(recordingHandler, 16))
+	connect("carol", make(recordingHandler, 16))
+	aliceEvents.expect(t, peerEvent{true, "carol"}, 2*time.Second)
+	quiet(aliceEvents)
+
+	// The node honoured the subscription: bob was never pushed to alice.
+	alice.mu.RLock()
+	_, tracked := alice.peers["bob"]
+	alice.mu.RUnlock()
+	if tracked {
+		t.Fatal("node pushed a muted peer")
+	}
+	if _, ok := alice.GetPeer("bob"); ok {
+		t.Fatal("GetPeer returned a muted peer")
+	}
+
+	// Following only bob hides carol and makes the node push bob.
+	alice.SetPresenceFilter(PresenceFilter{Follow: []string{"bob"}})
+	aliceEvents.expect(t, peerEvent{true, "bob"}, 2*time.Second)
+	quiet(aliceEvents)
+	if peers := alice.GetAllPeers(); len(peers) != 1 || peers[0].Nickname != "bob" {
+		t.Fatalf("GetAllPeers = %+v, want only bob", peers)
+	}
+}
+
+func TestServerPushesAddrUpdates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &Config{Peers: map[string]string{"alice": "ta", "bob": "tb", "carol": "tc"}}
+	srv := NewServer(newTestHost(t), cfg)
+
+	connect := func(nick string) *Client {
+		c := NewClient(newTestHost(t), nick, cfg.Peers[nick], []byte(nick+"-hpke"), make([]byte, 8), make(recordingHandler, 16))
+		if err := c.Connect(ctx, nodeAddr(srv)); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		return c
+	}
+	alice := connect("alice")
+	bob := connect("bob")
+
+	roamed := multiaddr.StringCast("/ip4/192.0.2.7/tcp/9000")
+	bob.UpdateAddrs([]multiaddr.Multiaddr{roamed})
+
+	waitForAddr(t, alice, "bob", roamed)
+
+	// Peers registering later get the new addresses in their peer list.
+	carol := connect("carol")
+	if info, _ := carol.GetPeer("bob"); len(info.Addrs) != 1 || !info.Addrs[0].Equal(roamed) {
+		t.Fatalf("carol sees bob at %v", info.Addrs)
+	}
+}
+
+// waitForAddr waits until c sees nickname at the single address addr.
+func waitForAddr(t *testing.T, c *Client, nickname string, addr multiaddr.Multiaddr) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		info, ok := c.GetPeer(nickname)
+		if ok && len(info.Addrs) == 1 && info.Addrs[0].Equal(addr) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s seen at %v, want %s", nickname, info.Addrs, addr)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// roomRecorder also records room memberships, as "room: a,b".
+type roomRecorder struct {
+	recordingHandler
+	rooms chan string
+}
+
+func newRoomRecorder() roomRecorder {
+	return roomRecorder{make(recordingHandler, 16), make(chan string, 16)}
+}
+
+func (h roomRecorder) OnRoomMembers(room string, members []string) {
+	h.rooms <- room + ": " + strings.Join(members, ",")
+}
+
+func (h roomRecorder) expectRoom(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case got := <-h.rooms:
+		if got != want {
+			t.Fatalf("got membership %q, want %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no membership %q", want)
+	}
+}
+
+func TestServerRooms(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &Config{Peers: map[string]string{"alice": "ta", "bob": "tb", "carol": "tc"}}
+	srv := NewServer(newTestHost(t), cfg)
+
+	connect := func(nick string, h PeerHandler) *Client {
+		c := NewClient(newTestHost(t), nick, cfg.Peers[nick], []byte(nick+"-hpke"), make([]byte, 8), h)
+		if err := c.Connect(ctx, nodeAddr(srv)); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		return c
+	}
+
+	aliceRooms := newRoomRecorder()
+	alice := connect("alice", aliceRooms)
+	bobRooms := newRoomRecorder()
+	bob := connect("bob", bobRooms)
+	carol := connect("carol", make(recordingHandler, 16))
+
+	if err := alice.JoinRoom("#dev"); err != nil {
+		t.Fatal(err)
+	}
+	aliceRooms.expectRoom(t, "#dev: alice")
+	if err := bob.JoinRoom("#dev"); err != nil {
+		t.Fatal(err)
+	}
+	aliceRooms.expectRoom(t, "#dev: alice,bob")
+	bobRooms.expectRoom(t, "#dev: alice,bob")
+	if err := carol.JoinRoom("#ops"); err != nil {
+		t.Fatal(err)
+	}
+
+	bob.LeaveRoom("#dev")
+	aliceRooms.expectRoom(t, "#dev: alice")
+
+	// Members that disconnect leave their rooms.
+	if err := bob.JoinRoom("#dev"); err != nil {
+		t.Fatal(err)
+	}
+	aliceRooms.expectRoom(t, "#dev: alice,bob")
+	bob.Close()
+	aliceRooms.expectRoom(t, "#dev: alice")
+
+	select {
+	case m := <-aliceRooms.rooms:
+		t.Fatalf("unexpected membership %q", m)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := alice.JoinRoom("dev"); err == nil {
+		t.Fatal("room name without # accepted")
+	}
+}
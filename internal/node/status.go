@@ -0,0 +1,173 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// StatusProtocolID serves node status to the peer IDs in Config.Admins.
+// The querier opens a stream and reads one JSON-encoded StatusReply frame.
+const StatusProtocolID = "/tmd/node/status/1.0.0"
+
+// msgStatus is the only message type on the status protocol.
+const msgStatus byte = 1
+
+// Status is a snapshot of a running node.
+type Status struct {
+	PeerID  string        `json:"peer_id"`
+	Addrs   []string      `json:"addrs"`
+	Started time.Time     `json:"started"`
+	Uptime  time.Duration `json:"uptime"`
+	Peers   []PeerStatus  `json:"peers"` // registered on this node, by nickname
+	Mail    int           `json:"mail"`  // deposits held for offline peers
+	Config  ConfigSummary `json:"config"`
+}
+
+// PeerStatus describes one peer registered on the node.
+type PeerStatus struct {
+	Nickname   string    `json:"nickname"`
+	PeerID     string    `json:"peer_id"`
+	Addrs      []string  `json:"addrs"`
+	Since      time.Time `json:"since"`       // registration time
+	LastActive time.Time `json:"last_active"` // last message from the peer
+}
+
+// ConfigSummary describes the node config without its secrets.
+type ConfigSummary struct {
+	AllowedPeers int    `json:"allowed_peers"`
+	Cluster      string `json:"cluster,omitempty"` // backend name, "" when standalone
+	ClusterPeers int    `json:"cluster_peers,omitempty"`
+	ACL          bool   `json:"acl"`
+	AddrHints    bool   `json:"addr_hints"`
+}
+
+// StatusReply is the status protocol response.
+type StatusReply struct {
+	Status *Status `json:"status,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// Status returns a snapshot of the node.
+func (s *Server) Status() *Status {
+	now := time.Now()
+	st := &Status{
+		PeerID:  s.host.ID().String(),
+		Addrs:   addrStrings(s.host.Addrs()),
+		Started: s.started,
+		Uptime:  now.Sub(s.started).Round(time.Second),
+		Config: ConfigSummary{
+			AllowedPeers: len(s.config.Nicknames()),
+			ACL:          s.config.ACL != nil,
+			AddrHints:    s.config.AddrHints != nil,
+		},
+	}
+
+	s.mu.RLock()
+	for _, p := range s.online {
+		st.Peers = append(st.Peers, PeerStatus{
+			Nickname:   p.Nickname,
+			PeerID:     p.PeerID.String(),
+			Addrs:      addrStrings(p.Addrs),
+			Since:      p.Since,
+			LastActive: s.activity[p.Nickname],
+		})
+	}
+	st.Mail = s.heldMailLocked()
+	cl := s.cluster
+	s.mu.RUnlock()
+	sort.Slice(st.Peers, func(i, j int) bool { return st.Peers[i].Nickname < st.Peers[j].Nickname })
+
+	if cl != nil {
+		st.Config.Cluster = "custom"
+		if s.config.Cluster != nil {
+			st.Config.Cluster = s.config.Cluster.Backend
+		}
+		st.Config.ClusterPeers = len(cl.peers())
+	}
+	return st
+}
+
+func (s *Server) handleStatus(stream network.Stream) {
+	defer stream.Close()
+
+	var reply StatusReply
+	if slices.Contains(s.config.Admins, stream.Conn().RemotePeer().String()) {
+		reply.Status = s.Status()
+	} else {
+		reply.Error = "not an admin of this node"
+	}
+	data, err := json.Marshal(&reply)
+	if err != nil {
+		return
+	}
+	WriteMsg(stream, msgStatus, data)
+}
+
+// touch records activity from a registered peer.
+func (s *Server) touch(nickname string) {
+	s.mu.Lock()
+	if _, ok := s.online[nickname]; ok {
+		s.activity[nickname] = time.Now()
+	}
+	s.mu.Unlock()
+}
+
+// QueryStatus fetches the status of the node at nodeAddr, a /p2p/
+// multiaddr. h must carry a peer ID listed in the node's admins.
+func QueryStatus(ctx context.Context, h host.Host, nodeAddr string) (*Status, error) {
+	maddr, err := multiaddr.NewMultiaddr(nodeAddr)
+	if err != nil {
+		return nil, fmt.Errorf("parse node address: %w", err)
+	}
+	info, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return nil, fmt.Errorf("extract peer info: %w", err)
+	}
+	if err := h.Connect(ctx, *info); err != nil {
+		return nil, fmt.Errorf("connect to node: %w", err)
+	}
+	stream, err := h.NewStream(ctx, info.ID, StatusProtocolID)
+	if err != nil {
+		return nil, fmt.Errorf("open stream: %w", err)
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetReadDeadline(deadline)
+	}
+
+	typ, payload, err := ReadMsg(stream)
+	if err != nil {
+		return nil, fmt.Errorf("read status: %w", err)
+	}
+	if typ != msgStatus {
+		return nil, fmt.Errorf("unexpected message type: %d", typ)
+	}
+	var reply StatusReply
+	if err := json.Unmarshal(payload, &reply); err != nil {
+		return nil, fmt.Errorf("decode status: %w", err)
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("node refused: %s", reply.Error)
+	}
+	if reply.Status == nil {
+		return nil, fmt.Errorf("empty status reply")
+	}
+	return reply.Status, nil
+}
+
+func addrStrings(addrs []multiaddr.Multiaddr) []string {
+	out := make([]string, len(addrs))
+	for i, a := range addrs {
+		out[i] = a.String()
+	}
+	return out
+}
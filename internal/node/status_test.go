@@ -0,0 +1,43 @@
+package node
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryStatus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	admin := newTestHost(t)
+	cfg := &Config{
+		Peers:  map[string]string{"alice": "ta", "bob": "tb"},
+		ACL:    &ACL{},
+		Admins: []string{admin.ID().String()},
+	}
+	srv := NewServer(newTestHost(t), cfg)
+
+	alice := NewClient(newTestHost(t), "alice", "ta", []byte("alice-hpke"), make([]byte, 8), make(recordingHandler, 16))
+	if err := alice.Connect(ctx, nodeAddr(srv)); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	st, err := QueryStatus(ctx, admin, nodeAddr(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.PeerID != srv.ID().String() || st.Config.AllowedPeers != 2 || !st.Config.ACL || st.Config.Cluster != "" {
+		t.Fatalf("status = %+v", st)
+	}
+	if len(st.Peers) != 1 || st.Peers[0].Nickname != "alice" || st.Peers[0].Since.IsZero() || st.Peers[0].LastActive.Before(st.Peers[0].Since) {
+		t.Fatalf("peers = %+v", st.Peers)
+	}
+
+	// Any other identity is refused.
+	if _, err := QueryStatus(ctx, newTestHost(t), nodeAddr(srv)); err == nil || !strings.Contains(err.Error(), "not an admin") {
+		t.Fatalf("non-admin query: %v", err)
+	}
+}
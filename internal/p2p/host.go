@@ -1,11 +1,15 @@
 package p2p
 
 import (
+	"crypto/rand"
 	"fmt"
 
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/p2p/transport/quicreuse"
+	"github.com/quic-go/quic-go"
+	"go.uber.org/fx"
 )
 
 // NewHost creates a libp2p host with the given private key.
@@ -13,13 +17,38 @@ import (
 func NewHost(priv crypto.PrivKey, port int) (host.Host, error) {
 	listenAddr := fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port)
 
-	h, err := libp2p.New(
+	opts := []libp2p.Option{
 		libp2p.Identity(priv),
 		libp2p.ListenAddrStrings(listenAddr),
-	)
+	}
+	if _, ok := priv.(*signerKey); ok {
+		// QUIC derives its reset and token keys from the raw private
+		// key, which a signer does not give out: draw them per process.
+		opts = append(opts, libp2p.QUICReuse(randomQUICKeys))
+	}
+	h, err := libp2p.New(opts...)
 	if err != nil {
 		return nil, fmt.Errorf("create libp2p host: %w", err)
 	}
 
 	return h, nil
 }
+
+// randomQUICKeys builds the QUIC connection manager with random stateless
+// reset and token keys, for hosts whose private key is held by a signer.
+func randomQUICKeys(lifecycle fx.Lifecycle) (*quicreuse.ConnManager, error) {
+	var reset quic.StatelessResetKey
+	var token quic.TokenGeneratorKey
+	if _, err := rand.Read(reset[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(token[:]); err != nil {
+		return nil, err
+	}
+	cm, err := quicreuse.NewConnManager(reset, token)
+	if err != nil {
+		return nil, err
+	}
+	lifecycle.Append(fx.StopHook(cm.Close))
+	return cm, nil
+}
@@ -0,0 +1,50 @@
+package p2p
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	libp2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	pb "github.com/libp2p/go-libp2p/core/crypto/pb"
+)
+
+// signerKey is a libp2p Ed25519 private key whose signatures come from a
+// crypto.Signer, such as a key held in hardware. Its raw bytes are not
+// available, which libp2p only needs to persist keys.
+type signerKey struct {
+	signer crypto.Signer
+	pub    libp2pcrypto.PubKey
+}
+
+// SignerKey returns a libp2p private key signing with s, whose public key
+// must be Ed25519. The host's peer ID then embeds that key.
+func SignerKey(s crypto.Signer) (libp2pcrypto.PrivKey, error) {
+	edPub, ok := s.Public().(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("signer key is %T, not Ed25519", s.Public())
+	}
+	pub, err := libp2pcrypto.UnmarshalEd25519PublicKey(edPub)
+	if err != nil {
+		return nil, err
+	}
+	return &signerKey{signer: s, pub: pub}, nil
+}
+
+func (k *signerKey) Type() pb.KeyType { return pb.KeyType_Ed25519 }
+
+func (k *signerKey) Raw() ([]byte, error) {
+	return nil, errors.New("private key is held by a signer")
+}
+
+func (k *signerKey) Equals(o libp2pcrypto.Key) bool {
+	other, ok := o.(*signerKey)
+	return ok && other.pub.Equals(k.pub)
+}
+
+func (k *signerKey) Sign(data []byte) ([]byte, error) {
+	return k.signer.Sign(nil, data, crypto.Hash(0))
+}
+
+func (k *signerKey) GetPublic() libp2pcrypto.PubKey { return k.pub }
@@ -0,0 +1,49 @@
+package p2p
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	libp2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestSignerKeyHost(t *testing.T) {
+	_, edPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := SignerKey(edPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	std, err := libp2pcrypto.UnmarshalEd25519PrivateKey(edPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := peer.IDFromPrivateKey(std)
+
+	a, err := NewHost(priv, 0)
+	if err != nil {
+		t.Fatalf("NewHost with a signer: %v", err)
+	}
+	defer a.Close()
+	if a.ID() != want {
+		t.Fatalf("peer ID %s, want %s", a.ID(), want)
+	}
+
+	// The security handshake signs with the signer.
+	other, _, _ := libp2pcrypto.GenerateEd25519Key(nil)
+	c, err := NewHost(other, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx, peer.AddrInfo{ID: a.ID(), Addrs: a.Addrs()}); err != nil {
+		t.Fatalf("connect to signer host: %v", err)
+	}
+}
@@ -0,0 +1,363 @@
+// Package pins keeps the keys each peer nickname was first seen with
+// (trust on first use), so a node or a peer presenting other keys for the
+// same nickname later is caught.
+package pins
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Pin is the keys a nickname was first seen with.
+type Pin struct {
+	Nickname string    `json:"nick"`
+	EdPub    []byte    `json:"ed_pub"`
+	HPKEPub  []byte    `json:"hpke_pub"`
+	Pinned   time.Time `json:"pinned"`
+	Verified time.Time `json:"verified,omitzero"` // when the user checked the keys (see Verify)
+	Accepted time.Time `json:"accepted,omitzero"` // when the user accepted the peer's messages (see Accept)
+	Signed   time.Time `json:"signed,omitzero"`   // when the peer first signed its HPKE key (see MarkSigned)
+	Vouchers []Voucher `json:"vouched_by,omitempty"`
+}
+
+// Voucher is a peer that vouched for the keys of a pin (see Vouch).
+type Voucher struct {
+	Nickname string    `json:"nick"`
+	At       time.Time `json:"at"`
+}
+
+// Status is the result of checking keys against the Store.
+type Status int
+
+const (
+	New     Status = iota // nickname not pinned yet
+	Match                 // keys match the pin
+	Changed               // nickname pinned with other keys
+	Pending               // nickname not pinned, too few vouches for the keys yet (see Vouch)
+)
+
+// Store is a JSON file of pins, keyed by nickname.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	pins    map[string]Pin
+	pending map[string][]Pin // vouched keys of unpinned nicknames, not saved
+}
+
+// OpenStore loads the store at path; a missing file yields an empty store.
+func OpenStore(path string) (*Store, error) {
+	s := &Store{path: path, pins: make(map[string]Pin), pending: make(map[string][]Pin)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read pins: %w", err)
+	}
+	var list []Pin
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse pins: %w", err)
+	}
+	for _, p := range list {
+		s.pins[p.Nickname] = p
+	}
+	return s, nil
+}
+
+// Check compares keys presented for nickname with its pin. A nil Store
+// pins nothing.
+func (s *Store) Check(nickname string, edPub, hpkePub []byte) (Status, Pin) {
+	if s == nil {
+		return New, Pin{}
+	}
+	s.mu.Lock()
+	p, ok := s.pins[nickname]
+	s.mu.Unlock()
+	switch {
+	case !ok:
+		return New, Pin{}
+	case bytes.Equal(p.EdPub, edPub) && bytes.Equal(p.HPKEPub, hpkePub):
+		return Match, p
+	default:
+		return Changed, p
+	}
+}
+
+// Get returns the pin of nickname, if any.
+func (s *Store) Get(nickname string) (Pin, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pins[nickname]
+	return p, ok
+}
+
+// Observe checks keys presented for nickname and pins them, saving the
+// store, if the nickname was not pinned yet.
+func (s *Store) Observe(nickname string, edPub, hpkePub []byte) (Status, Pin, error) {
+	if s == nil {
+		return New, Pin{}, nil
+	}
+	s.mu.Lock()
+	p, ok := s.pins[nickname]
+	if !ok {
+		p = Pin{Nickname: nickname, EdPub: edPub, HPKEPub: hpkePub, Pinned: time.Now().UTC()}
+		s.pins[nickname] = p
+		delete(s.pending, nickname)
+	}
+	s.mu.Unlock()
+	switch {
+	case !ok:
+		return New, p, s.save()
+	case bytes.Equal(p.EdPub, edPub) && bytes.Equal(p.HPKEPub, hpkePub):
+		return Match, p, nil
+	default:
+		return Changed, p, nil
+	}
+}
+
+// Verify marks the pin of nickname as checked by the user, e.g. by
+// comparing a short authentication string, and saves the store. It
+// returns the pin, and whether nickname is pinned.
+func (s *Store) Verify(nickname string) (Pin, bool, error) {
+	s.mu.Lock()
+	p, ok := s.pins[nickname]
+	if ok {
+		p.Verified = time.Now().UTC()
+		s.pins[nickname] = p
+	}
+	s.mu.Unlock()
+	if !ok {
+		return Pin{}, false, nil
+	}
+	return p, true, s.save()
+}
+
+// MarkSigned records that the peer pinned as nickname signs its HPKE key,
+// so that keys it presents unsigned later can be refused, and saves the
+// store if that is new. It reports whether nickname is pinned.
+func (s *Store) MarkSigned(nickname string) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	s.mu.Lock()
+	p, ok := s.pins[nickname]
+	mark := ok && p.Signed.IsZero()
+	if mark {
+		p.Signed = time.Now().UTC()
+		s.pins[nickname] = p
+	}
+	s.mu.Unlock()
+	if !mark {
+		return ok, nil
+	}
+	return true, s.save()
+}
+
+// Accept marks the peer pinned as nickname as one whose messages the user
+// takes, checked keys or not, and saves the store. It returns
+// the pin, and whether nickname is pinned.
+func (s *Store) Accept(nickname string) (Pin, bool, error) {
+	s.mu.Lock()
+	p, ok := s.pins[nickname]
+	if ok && p.Accepted.IsZero() {
+		p.Accepted = time.Now().UTC()
+		s.pins[nickname] = p
+	}
+	s.mu.Unlock()
+	if !ok {
+		return Pin{}, false, nil
+	}
+	return p, true, s.save()
+}
+
+// Vouch records that the peer voucher vouched for keys as those of
+// nickname, and saves the store. An unpinned nickname is pinned to them
+// only once threshold verified vouchers vouched for the same keys; until
+// then the status is Pending and the vouches are kept in memory only.
+// Keys other than the pinned ones are not recorded: the status is then
+// Changed, for the caller to report.
+func (s *Store) Vouch(nickname string, edPub, hpkePub []byte, voucher string, threshold int) (Status, Pin, error) {
+	s.mu.Lock()
+	p, ok := s.pins[nickname]
+	if !ok {
+		p = s.pendingVouch(nickname, edPub, hpkePub, voucher)
+		if s.vouches(p) < threshold {
+			s.mu.Unlock()
+			return Pending, p, nil
+		}
+		p.Pinned = time.Now().UTC()
+		s.pins[nickname] = p
+		delete(s.pending, nickname)
+		s.mu.Unlock()
+		return New, p, s.save()
+	}
+	if !bytes.Equal(p.EdPub, edPub) || !bytes.Equal(p.HPKEPub, hpkePub) {
+		s.mu.Unlock()
+		return Changed, p, nil
+	}
+	p.Vouchers = withVoucher(p.Vouchers, voucher)
+	s.pins[nickname] = p
+	s.mu.Unlock()
+	return Match, p, s.save()
+}
+
+// pendingVouch records the vouch of voucher for the keys of the unpinned
+// nickname, dropping one it made for other keys, and returns the
+// candidate pin of those keys. s.mu must be held.
+func (s *Store) pendingVouch(nickname string, edPub, hpkePub []byte, voucher string) Pin {
+	var found Pin
+	var kept []Pin
+	for _, c := range s.pending[nickname] {
+		if bytes.Equal(c.EdPub, edPub) && bytes.Equal(c.HPKEPub, hpkePub) {
+			found = c
+			continue
+		}
+		c.Vouchers = slices.DeleteFunc(slices.Clone(c.Vouchers), func(v Voucher) bool { return v.Nickname == voucher })
+		if len(c.Vouchers) > 0 {
+			kept = append(kept, c)
+		}
+	}
+	if found.Nickname == "" {
+		found = Pin{Nickname: nickname, EdPub: edPub, HPKEPub: hpkePub}
+	}
+	found.Vouchers = withVoucher(found.Vouchers, voucher)
+	s.pending[nickname] = append(kept, found)
+	return found
+}
+
+// withVoucher returns vs with voucher's vouch renewed.
+func withVoucher(vs []Voucher, voucher string) []Voucher {
+	vs = slices.DeleteFunc(slices.Clone(vs), func(v Voucher) bool { return v.Nickname == voucher })
+	return append(vs, Voucher{Nickname: voucher, At: time.Now().UTC()})
+}
+
+// Vouches counts the vouchers of p whose own pins are verified: a voucher
+// whose keys changed since, or were never checked, does not count.
+func (s *Store) Vouches(p Pin) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.vouches(p)
+}
+
+// vouches is Vouches with s.mu held.
+func (s *Store) vouches(p Pin) int {
+	n := 0
+	for _, v := range p.Vouchers {
+		if vp, ok := s.pins[v.Nickname]; ok && !vp.Verified.IsZero() && v.Nickname != p.Nickname {
+			n++
+		}
+	}
+	return n
+}
+
+// Replace pins nickname to other keys, after the user checked them, and
+// saves the store. The new pin is not verified, but accepted.
+func (s *Store) Replace(nickname string, edPub, hpkePub []byte) error {
+	s.mu.Lock()
+	now := time.Now().UTC()
+	s.pins[nickname] = Pin{Nickname: nickname, EdPub: edPub, HPKEPub: hpkePub, Pinned: now, Accepted: now}
+	delete(s.pending, nickname)
+	s.mu.Unlock()
+	return s.save()
+}
+
+// Rotate moves the pin of nickname to the HPKE key hpkePub, for a peer
+// that rotated it under the pinned Ed25519 key edPub, and saves the
+// store; the caller checks that edPub signed hpkePub. It reports whether
+// it did: not for an unpinned nickname, another Ed25519 key or the pinned
+// HPKE key. The pin keeps when it was made but loses its verification
+// and vouches, which were for the keys it had, but stays accepted and
+// signed: the identity key is the same.
+func (s *Store) Rotate(nickname string, edPub, hpkePub []byte) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	s.mu.Lock()
+	p, ok := s.pins[nickname]
+	if !ok || !bytes.Equal(p.EdPub, edPub) || bytes.Equal(p.HPKEPub, hpkePub) {
+		s.mu.Unlock()
+		return false, nil
+	}
+	s.pins[nickname] = Pin{Nickname: nickname, EdPub: p.EdPub, HPKEPub: hpkePub, Pinned: p.Pinned, Accepted: p.Accepted, Signed: p.Signed}
+	s.mu.Unlock()
+	return true, s.save()
+}
+
+// Forget drops the pin of nickname, so the next keys seen are pinned, and
+// reports whether there was one.
+func (s *Store) Forget(nickname string) (bool, error) {
+	s.mu.Lock()
+	_, ok := s.pins[nickname]
+	delete(s.pins, nickname)
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, s.save()
+}
+
+// All returns the pins, sorted by nickname.
+func (s *Store) All() []Pin {
+	s.mu.Lock()
+	list := make([]Pin, 0, len(s.pins))
+	for _, p := range s.pins {
+		list = append(list, p)
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Nickname < list[j].Nickname })
+	return list
+}
+
+// Merge adds pins taken from another store, such as those of an identity
+// moved here, and saves the store. A nickname pinned to the same keys
+// keeps the earlier pin, verification and acceptance of the two; one pinned to other
+// keys is left alone and returned, for the user to sort out.
+func (s *Store) Merge(list []Pin) ([]Pin, error) {
+	var conflicts []Pin
+	s.mu.Lock()
+	for _, in := range list {
+		p, ok := s.pins[in.Nickname]
+		switch {
+		case !ok:
+			s.pins[in.Nickname] = in
+			delete(s.pending, in.Nickname)
+		case bytes.Equal(p.EdPub, in.EdPub) && bytes.Equal(p.HPKEPub, in.HPKEPub):
+			if in.Pinned.Before(p.Pinned) {
+				p.Pinned = in.Pinned
+			}
+			if !in.Verified.IsZero() && (p.Verified.IsZero() || in.Verified.Before(p.Verified)) {
+				p.Verified = in.Verified
+			}
+			if !in.Accepted.IsZero() && (p.Accepted.IsZero() || in.Accepted.Before(p.Accepted)) {
+				p.Accepted = in.Accepted
+			}
+			if !in.Signed.IsZero() && (p.Signed.IsZero() || in.Signed.Before(p.Signed)) {
+				p.Signed = in.Signed
+			}
+			s.pins[in.Nickname] = p
+		default:
+			conflicts = append(conflicts, in)
+		}
+	}
+	s.mu.Unlock()
+	return conflicts, s.save()
+}
+
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.All(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("write pins: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package pins
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pins.json")
+	s, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed, hpke := []byte("ed-bob"), []byte("hpke-bob")
+	if status, _, err := s.Observe("bob", ed, hpke); err != nil || status != New {
+		t.Fatalf("first contact: %v %v", status, err)
+	}
+
+	s, err = OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, p, _ := s.Observe("bob", ed, hpke); status != Match || p.Pinned.IsZero() {
+		t.Fatalf("same keys: %v %+v", status, p)
+	}
+	if status, _ := s.Check("bob", ed, []byte("other")); status != Changed {
+		t.Fatalf("changed HPKE key: status %v", status)
+	}
+	if status, _, _ := s.Observe("bob", []byte("other"), hpke); status != Changed {
+		t.Fatalf("changed Ed25519 key: status %v", status)
+	}
+	if status, _ := s.Check("bob", ed, hpke); status != Match {
+		t.Fatal("a changed key replaced the pin")
+	}
+
+	if p, ok, err := s.Verify("bob"); !ok || err != nil || p.Verified.IsZero() {
+		t.Fatalf("Verify = %+v, %v, %v", p, ok, err)
+	}
+	if _, ok, _ := s.Verify("carol"); ok {
+		t.Fatal("verified a nickname never pinned")
+	}
+	s, _ = OpenStore(path)
+	if _, p := s.Check("bob", ed, hpke); p.Verified.IsZero() {
+		t.Fatal("verification not saved")
+	}
+	if p, ok, err := s.Accept("bob"); !ok || err != nil || p.Accepted.IsZero() {
+		t.Fatalf("Accept = %+v, %v, %v", p, ok, err)
+	}
+	if _, ok, _ := s.Accept("carol"); ok {
+		t.Fatal("accepted a nickname never pinned")
+	}
+
+	if err := s.Replace("bob", []byte("other"), hpke); err != nil {
+		t.Fatal(err)
+	}
+	if status, p := s.Check("bob", []byte("other"), hpke); status != Match || !p.Verified.IsZero() || p.Accepted.IsZero() {
+		t.Fatalf("replaced pin: status %v, %+v", status, p)
+	}
+	if ok, err := s.Forget("bob"); !ok || err != nil {
+		t.Fatalf("Forget = %v, %v", ok, err)
+	}
+	if status, _ := s.Check("bob", ed, hpke); status != New {
+		t.Fatalf("forgotten pin: status %v", status)
+	}
+	var none *Store
+	if status, _ := none.Check("bob", ed, hpke); status != New {
+		t.Fatalf("nil store: status %v", status)
+	}
+}
+
+func TestMarkSigned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pins.json")
+	s, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.MarkSigned("bob"); ok {
+		t.Fatal("marked an unpinned nickname")
+	}
+	ed, hpke := []byte("ed-bob"), []byte("hpke-bob")
+	_, _, _ = s.Observe("bob", ed, hpke)
+	if ok, err := s.MarkSigned("bob"); !ok || err != nil {
+		t.Fatalf("MarkSigned = %v, %v", ok, err)
+	}
+	_, _ = s.Rotate("bob", ed, []byte("hpke-bob-2"))
+	reopened, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := reopened.Get("bob"); p.Signed.IsZero() {
+		t.Fatalf("signed mark lost after rotation and reload: %+v", p)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pins.json")
+	s, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Observe("bob", []byte("ed-bob"), []byte("hpke-bob")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Observe("carol", []byte("ed-carol"), []byte("hpke-carol")); err != nil {
+		t.Fatal(err)
+	}
+
+	verified := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	conflicts, err := s.Merge([]Pin{
+		{Nickname: "bob", EdPub: []byte("ed-bob"), HPKEPub: []byte("hpke-bob"), Pinned: verified, Verified: verified},
+		{Nickname: "carol", EdPub: []byte("ed-other"), HPKEPub: []byte("hpke-carol"), Pinned: verified},
+		{Nickname: "dave", EdPub: []byte("ed-dave"), HPKEPub: []byte("hpke-dave"), Pinned: verified},
+	})
+	if err != nil || len(conflicts) != 1 || conflicts[0].Nickname != "carol" {
+		t.Fatalf("Merge = %+v, %v; want carol in conflict", conflicts, err)
+	}
+
+	s, err = OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, p := s.Check("bob", []byte("ed-bob"), []byte("hpke-bob")); status != Match || !p.Verified.Equal(verified) || !p.Pinned.Equal(verified) {
+		t.Fatalf("merged bob: %v %+v; want the earlier pin, verified", status, p)
+	}
+	if status, _ := s.Check("carol", []byte("ed-carol"), []byte("hpke-carol")); status != Match {
+		t.Fatal("a conflicting pin replaced carol's")
+	}
+	if status, _ := s.Check("dave", []byte("ed-dave"), []byte("hpke-dave")); status != Match {
+		t.Fatal("dave was not added")
+	}
+	if all := s.All(); len(all) != 3 || all[0].Nickname != "bob" || all[2].Nickname != "dave" {
+		t.Fatalf("All = %+v", all)
+	}
+}
+
+func TestVouch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pins.json")
+	s, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nick := range []string{"alice", "bob", "mallory"} {
+		if _, _, err := s.Observe(nick, []byte("ed-"+nick), []byte("hpke-"+nick)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Verify("alice")
+	s.Verify("bob")
+
+	// Carol is pinned only once two verified peers vouched for the same
+	// keys: alice's vouch again, mallory's, or bob's for other keys do not
+	// make two.
+	ed, hpke := []byte("ed-carol"), []byte("hpke-carol")
+	if status, p, err := s.Vouch("carol", ed, hpke, "alice", 2); err != nil || status != Pending || s.Vouches(p) != 1 {
+		t.Fatalf("first vouch: %v %+v %v", status, p, err)
+	}
+	s.Vouch("carol", ed, hpke, "alice", 2)
+	s.Vouch("carol", ed, hpke, "mallory", 2)
+	if status, _, _ := s.Vouch("carol", []byte("ed-other"), hpke, "bob", 2); status != Pending {
+		t.Fatalf("vouch for other keys: %v", status)
+	}
+	if _, ok := s.Get("carol"); ok {
+		t.Fatal("carol was pinned below the threshold")
+	}
+	status, p, err := s.Vouch("carol", ed, hpke, "bob", 2)
+	if err != nil || status != New || len(p.Vouchers) != 3 {
+		t.Fatalf("vouches: %v %+v %v", status, p, err)
+	}
+	if n := s.Vouches(p); n != 2 {
+		t.Fatalf("Vouches = %d, want 2: mallory is not verified", n)
+	}
+	if status, _, _ := s.Vouch("carol", ed, hpke, "bob", 2); status != Match {
+		t.Fatalf("vouch for the pinned keys: %v", status)
+	}
+	if status, _, _ := s.Vouch("carol", []byte("ed-other"), hpke, "bob", 2); status != Changed {
+		t.Fatalf("vouch for other keys: %v", status)
+	}
+
+	s, _ = OpenStore(path)
+	if _, p := s.Check("carol", ed, hpke); s.Vouches(p) != 2 || !p.Verified.IsZero() {
+		t.Fatalf("reloaded carol: %+v", p)
+	}
+	// New keys for bob, accepted but unchecked, take back bob's vouch.
+	s.Replace("bob", []byte("ed-bob2"), []byte("hpke-bob"))
+	if _, p := s.Check("carol", ed, hpke); s.Vouches(p) != 1 {
+		t.Fatalf("Vouches = %d after bob's keys changed, want 1", s.Vouches(p))
+	}
+}
+
+func TestRotate(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "pins.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed, hpke := []byte("ed-bob"), []byte("hpke-bob")
+	if ok, _ := s.Rotate("bob", ed, hpke); ok {
+		t.Fatal("rotated an unpinned nickname")
+	}
+	_, first, _ := s.Observe("bob", ed, hpke)
+	_, _, _ = s.Verify("bob")
+	_, _, _ = s.Accept("bob")
+	if ok, _ := s.Rotate("bob", []byte("ed-mallory"), []byte("hpke-mallory")); ok {
+		t.Fatal("rotated under another Ed25519 key")
+	}
+	if ok, _ := s.Rotate("bob", ed, hpke); ok {
+		t.Fatal("rotated to the pinned HPKE key")
+	}
+	if ok, err := s.Rotate("bob", ed, []byte("hpke-bob-2")); !ok || err != nil {
+		t.Fatalf("Rotate = %v, %v", ok, err)
+	}
+	status, p := s.Check("bob", ed, []byte("hpke-bob-2"))
+	if status != Match || !p.Pinned.Equal(first.Pinned) || !p.Verified.IsZero() || p.Accepted.IsZero() {
+		t.Fatalf("rotated pin: status %v, %+v", status, p)
+	}
+}
@@ -0,0 +1,315 @@
+// Package ratchet implements the Double Ratchet of Signal's specification
+// (https://signal.org/docs/specifications/doubleratchet/) over X25519,
+// HKDF-SHA256, HMAC-SHA256 and ChaCha20-Poly1305.
+//
+// Each message is sealed with a key used once and then forgotten, and
+// every time a party replies it moves to a new Diffie-Hellman key: whoever
+// later steals the parties' long-term keys, or the state of a session,
+// cannot open what was sent before.
+//
+// The two parties agree on a shared secret beforehand (see Agree). The
+// initiator, who sends first, knows the responder's first ratchet key;
+// the responder starts from its private key and can only send once it has
+// received a message.
+package ratchet
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// KeySize is the size of X25519 keys and of the shared secret.
+	KeySize = 32
+	// HeaderSize is the size of a message header: the sender's ratchet
+	// key, the length of its previous sending chain, and the message's
+	// number in the current one.
+	HeaderSize = KeySize + 4 + 4
+	// Overhead is what sealing adds to a plaintext.
+	Overhead = HeaderSize + chacha20poly1305.Overhead
+	// MaxSkip bounds the message keys a session derives ahead of time for
+	// messages that did not arrive yet, per chain and in total.
+	MaxSkip = 1000
+)
+
+var (
+	rootInfo  = []byte("tmd ratchet v1 root")
+	agreeInfo = []byte("tmd ratchet v1 agree")
+)
+
+// ErrCannotSend is returned by Seal on a responder session that has not
+// received a message yet.
+var ErrCannotSend = errors.New("ratchet: no message received yet")
+
+// GenerateKey returns a new X25519 ratchet key.
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// Agree derives the shared secret of a session from the concatenated
+// outputs of its Diffie-Hellman exchanges, bound to context. Both parties
+// must pass the outputs in the same order.
+func Agree(context []byte, dhs ...[]byte) ([]byte, error) {
+	var ikm []byte
+	for _, dh := range dhs {
+		ikm = append(ikm, dh...)
+	}
+	sk := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, context, agreeInfo), sk); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+type skippedKey struct {
+	dh string
+	n  uint32
+}
+
+// Session is one side of a Double Ratchet conversation. It is safe for
+// concurrent use.
+type Session struct {
+	mu sync.Mutex
+	state
+}
+
+type state struct {
+	dhs     *ecdh.PrivateKey // our ratchet key
+	dhr     []byte           // theirs; nil until known
+	rk      []byte           // root key
+	cks     []byte           // sending chain key; nil until we may send
+	ckr     []byte           // receiving chain key
+	ns, nr  uint32           // message numbers in the sending and receiving chains
+	pn      uint32           // length of our previous sending chain
+	skipped map[skippedKey][]byte
+	order   []skippedKey // skipped keys, oldest first
+}
+
+// NewInitiator starts the session of the party sending first, from the
+// shared secret sk and the responder's first ratchet key.
+func NewInitiator(sk []byte, theirs *ecdh.PublicKey) (*Session, error) {
+	if len(sk) != KeySize {
+		return nil, fmt.Errorf("ratchet: shared secret of %d bytes", len(sk))
+	}
+	dhs, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	dh, err := dhs.ECDH(theirs)
+	if err != nil {
+		return nil, err
+	}
+	rk, cks, err := kdfRoot(sk, dh)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{state: state{
+		dhs:     dhs,
+		dhr:     theirs.Bytes(),
+		rk:      rk,
+		cks:     cks,
+		skipped: make(map[skippedKey][]byte),
+	}}, nil
+}
+
+// NewResponder starts the session of the party receiving first, from the
+// shared secret sk and its first ratchet key, whose public half the
+// initiator was given.
+func NewResponder(sk []byte, ours *ecdh.PrivateKey) (*Session, error) {
+	if len(sk) != KeySize {
+		return nil, fmt.Errorf("ratchet: shared secret of %d bytes", len(sk))
+	}
+	return &Session{state: state{
+		dhs:     ours,
+		rk:      bytes.Clone(sk),
+		skipped: make(map[skippedKey][]byte),
+	}}, nil
+}
+
+// Seal encrypts plaintext, authenticating ad with it, and returns the
+// message: header || ciphertext.
+func (s *Session) Seal(plaintext, ad []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cks == nil {
+		return nil, ErrCannotSend
+	}
+	var mk []byte
+	s.cks, mk = kdfChain(s.cks)
+	header := make([]byte, 0, HeaderSize)
+	header = append(header, s.dhs.PublicKey().Bytes()...)
+	header = binary.BigEndian.AppendUint32(header, s.pn)
+	header = binary.BigEndian.AppendUint32(header, s.ns)
+	s.ns++
+	return seal(mk, header, plaintext, ad)
+}
+
+// Open decrypts a message sealed by the other party with ad. A message
+// that does not open leaves the session as it was.
+func (s *Session) Open(message, ad []byte) ([]byte, error) {
+	if len(message) < Overhead {
+		return nil, errors.New("ratchet: message too short")
+	}
+	header, ciphertext := message[:HeaderSize], message[HeaderSize:]
+	dh := header[:KeySize]
+	pn := binary.BigEndian.Uint32(header[KeySize:])
+	n := binary.BigEndian.Uint32(header[KeySize+4:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := skippedKey{dh: string(dh), n: n}
+	if mk, ok := s.skipped[key]; ok {
+		plain, err := open(mk, header, ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+		s.forget(key)
+		return plain, nil
+	}
+
+	// Work on a copy, kept only if the message opens.
+	next := s.state
+	next.skipped = make(map[skippedKey][]byte, len(s.skipped))
+	for k, v := range s.skipped {
+		next.skipped[k] = v
+	}
+	next.order = append([]skippedKey(nil), s.order...)
+	if !bytes.Equal(dh, next.dhr) {
+		if err := next.skip(pn); err != nil {
+			return nil, err
+		}
+		if err := next.step(dh); err != nil {
+			return nil, err
+		}
+	}
+	if err := next.skip(n); err != nil {
+		return nil, err
+	}
+	var mk []byte
+	next.ckr, mk = kdfChain(next.ckr)
+	next.nr++
+	plain, err := open(mk, header, ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+	s.state = next
+	return plain, nil
+}
+
+// skip keeps the keys of the messages of the receiving chain before
+// number until, for when they arrive.
+func (st *state) skip(until uint32) error {
+	if st.ckr == nil {
+		return nil
+	}
+	if until < st.nr {
+		return errors.New("ratchet: message key already used")
+	}
+	if until-st.nr > MaxSkip {
+		return fmt.Errorf("ratchet: more than %d messages skipped", MaxSkip)
+	}
+	for st.nr < until {
+		var mk []byte
+		st.ckr, mk = kdfChain(st.ckr)
+		key := skippedKey{dh: string(st.dhr), n: st.nr}
+		st.skipped[key] = mk
+		st.order = append(st.order, key)
+		st.nr++
+	}
+	for len(st.order) > MaxSkip {
+		delete(st.skipped, st.order[0])
+		st.order = st.order[1:]
+	}
+	return nil
+}
+
+// step moves to the other party's new ratchet key dh, and to a new one of
+// ours.
+func (st *state) step(dh []byte) error {
+	theirs, err := ecdh.X25519().NewPublicKey(dh)
+	if err != nil {
+		return fmt.Errorf("ratchet: %w", err)
+	}
+	st.pn, st.ns, st.nr = st.ns, 0, 0
+	st.dhr = bytes.Clone(dh)
+	out, err := st.dhs.ECDH(theirs)
+	if err != nil {
+		return fmt.Errorf("ratchet: %w", err)
+	}
+	if st.rk, st.ckr, err = kdfRoot(st.rk, out); err != nil {
+		return err
+	}
+	if st.dhs, err = GenerateKey(); err != nil {
+		return err
+	}
+	if out, err = st.dhs.ECDH(theirs); err != nil {
+		return fmt.Errorf("ratchet: %w", err)
+	}
+	st.rk, st.cks, err = kdfRoot(st.rk, out)
+	return err
+}
+
+func (s *Session) forget(key skippedKey) {
+	delete(s.skipped, key)
+	for i, k := range s.order {
+		if k == key {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// kdfRoot returns the next root key and a chain key from the root key
+// and a Diffie-Hellman output.
+func kdfRoot(rk, dh []byte) (root, chain []byte, err error) {
+	out := make([]byte, 2*KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dh, rk, rootInfo), out); err != nil {
+		return nil, nil, err
+	}
+	return out[:KeySize], out[KeySize:], nil
+}
+
+// kdfChain returns the next chain key and a message key.
+func kdfChain(ck []byte) (next, mk []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write([]byte{1})
+	mk = mac.Sum(nil)
+	mac = hmac.New(sha256.New, ck)
+	mac.Write([]byte{2})
+	return mac.Sum(nil), mk
+}
+
+// seal encrypts with a message key, which is used for this message only,
+// so the nonce is fixed.
+func seal(mk, header, plaintext, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(mk)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return aead.Seal(header, nonce, plaintext, append(bytes.Clone(ad), header...)), nil
+}
+
+func open(mk, header, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(mk)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	plain, err := aead.Open(nil, nonce, ciphertext, append(bytes.Clone(ad), header...))
+	if err != nil {
+		return nil, errors.New("ratchet: message does not open")
+	}
+	return plain, nil
+}
@@ -0,0 +1,106 @@
+package ratchet
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func newPair(t *testing.T) (alice, bob *Session) {
+	t.Helper()
+	sk, err := Agree([]byte("test"), []byte("dh1"), []byte("dh2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice, err = NewInitiator(sk, bobKey.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if bob, err = NewResponder(sk, bobKey); err != nil {
+		t.Fatal(err)
+	}
+	return alice, bob
+}
+
+func mustSeal(t *testing.T, s *Session, text string) []byte {
+	t.Helper()
+	m, err := s.Seal([]byte(text), []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func mustOpen(t *testing.T, s *Session, m []byte, want string) {
+	t.Helper()
+	plain, err := s.Open(m, []byte("ad"))
+	if err != nil {
+		t.Fatalf("open %q: %v", want, err)
+	}
+	if string(plain) != want {
+		t.Fatalf("opened %q, want %q", plain, want)
+	}
+}
+
+func TestConversation(t *testing.T) {
+	alice, bob := newPair(t)
+	if _, err := bob.Seal([]byte("early"), nil); err != ErrCannotSend {
+		t.Fatalf("responder sealed before receiving: %v", err)
+	}
+
+	for round := range 3 {
+		for i := range 3 {
+			text := fmt.Sprintf("a%d.%d", round, i)
+			mustOpen(t, bob, mustSeal(t, alice, text), text)
+		}
+		text := fmt.Sprintf("b%d", round)
+		mustOpen(t, alice, mustSeal(t, bob, text), text)
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	alice, bob := newPair(t)
+	m0 := mustSeal(t, alice, "m0")
+	m1 := mustSeal(t, alice, "m1")
+	m2 := mustSeal(t, alice, "m2")
+	mustOpen(t, bob, m2, "m2")
+
+	// Bob replies, Alice moves to a new chain; the old one's messages
+	// still open.
+	mustOpen(t, alice, mustSeal(t, bob, "r"), "r")
+	m3 := mustSeal(t, alice, "m3")
+	mustOpen(t, bob, m3, "m3")
+	mustOpen(t, bob, m0, "m0")
+	mustOpen(t, bob, m1, "m1")
+
+	if _, err := bob.Open(m1, []byte("ad")); err == nil {
+		t.Fatal("a message opened twice")
+	}
+}
+
+func TestTamperedLeavesState(t *testing.T) {
+	alice, bob := newPair(t)
+	m := mustSeal(t, alice, "hello")
+	bad := bytes.Clone(m)
+	bad[len(bad)-1] ^= 1
+	if _, err := bob.Open(bad, []byte("ad")); err == nil {
+		t.Fatal("tampered message opened")
+	}
+	if _, err := bob.Open(m, []byte("other ad")); err == nil {
+		t.Fatal("message opened with other associated data")
+	}
+	mustOpen(t, bob, m, "hello")
+}
+
+func TestMaxSkip(t *testing.T) {
+	alice, bob := newPair(t)
+	for range MaxSkip + 1 {
+		mustSeal(t, alice, "lost")
+	}
+	if _, err := bob.Open(mustSeal(t, alice, "late"), []byte("ad")); err == nil {
+		t.Fatalf("opened a message after more than %d skipped", MaxSkip)
+	}
+}
@@ -0,0 +1,418 @@
+package rendezvous
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/record"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// A Point is a client of a libp2p rendezvous point, as specified in
+// libp2p/specs rendezvous: peers register their signed peer record under
+// a namespace with the point and discover the others registered there.
+// It is a discovery.Discovery, so a Service runs on it as on the DHT.
+// Messages are protobuf, each prefixed with its uvarint length.
+
+// PointProtocolID is the protocol of libp2p rendezvous points.
+const PointProtocolID = protocol.ID("/rendezvous/1.0.0")
+
+const (
+	// MaxPointTTL is the longest registration points accept.
+	MaxPointTTL = 72 * time.Hour
+	// maxPointMessage bounds a message from a point.
+	maxPointMessage = 4 << 20
+	// maxNamespace is the longest namespace points accept.
+	maxNamespace = 255
+)
+
+// Message types and the OK status of the rendezvous protocol.
+const (
+	pointRegister         = 0
+	pointRegisterResponse = 1
+	pointUnregister       = 2
+	pointDiscover         = 3
+	pointDiscoverResponse = 4
+	pointOK               = 0
+)
+
+// registration is a peer's signed peer record registered under ns.
+type registration struct {
+	ns  string
+	spr []byte // sealed peer.PeerRecord
+	ttl uint64 // seconds
+}
+
+// pointMessage is the one message type of the protocol; which fields are
+// set depends on typ.
+type pointMessage struct {
+	typ    uint64
+	reg    registration   // register
+	regs   []registration // discover response
+	ns     string         // unregister, discover
+	limit  uint64         // discover
+	cookie []byte         // discover, discover response
+	status uint64         // responses
+	text   string         // responses
+	ttl    uint64         // register response
+}
+
+func appendRegistration(b []byte, r registration) []byte {
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, r.ns)
+	if r.spr != nil {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.spr)
+	}
+	if r.ttl != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, r.ttl)
+	}
+	return b
+}
+
+// encode returns the protobuf of a request: register, unregister or
+// discover.
+func (m pointMessage) encode() []byte {
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, m.typ)
+	var body []byte
+	field := protowire.Number(0)
+	switch m.typ {
+	case pointRegister:
+		field, body = 2, appendRegistration(nil, m.reg)
+	case pointUnregister:
+		field = 4
+		body = protowire.AppendTag(nil, 1, protowire.BytesType)
+		body = protowire.AppendString(body, m.ns)
+	case pointDiscover:
+		field = 5
+		body = protowire.AppendTag(nil, 1, protowire.BytesType)
+		body = protowire.AppendString(body, m.ns)
+		body = protowire.AppendTag(body, 2, protowire.VarintType)
+		body = protowire.AppendVarint(body, m.limit)
+		if m.cookie != nil {
+			body = protowire.AppendTag(body, 3, protowire.BytesType)
+			body = protowire.AppendBytes(body, m.cookie)
+		}
+	}
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, body)
+}
+
+// eachField calls f with every field of a protobuf message: f reports how
+// many bytes of the value it consumed, or a negative number to skip it.
+func eachField(b []byte, f func(num protowire.Number, typ protowire.Type, v []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if m := f(num, typ, b); m > 0 {
+			b = b[m:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// The field helpers return the bytes they consumed, or -1.
+func varintField(typ protowire.Type, b []byte, dst *uint64) int {
+	if typ != protowire.VarintType {
+		return -1
+	}
+	v, n := protowire.ConsumeVarint(b)
+	if n > 0 {
+		*dst = v
+	}
+	return n
+}
+
+func bytesField(typ protowire.Type, b []byte, dst *[]byte) int {
+	if typ != protowire.BytesType {
+		return -1
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n > 0 {
+		*dst = append([]byte(nil), v...)
+	}
+	return n
+}
+
+func stringField(typ protowire.Type, b []byte, dst *string) int {
+	var v []byte
+	n := bytesField(typ, b, &v)
+	if n > 0 {
+		*dst = string(v)
+	}
+	return n
+}
+
+func decodeRegistration(b []byte) (registration, error) {
+	var r registration
+	err := eachField(b, func(num protowire.Number, typ protowire.Type, v []byte) int {
+		switch num {
+		case 1:
+			return stringField(typ, v, &r.ns)
+		case 2:
+			return bytesField(typ, v, &r.spr)
+		case 3:
+			return varintField(typ, v, &r.ttl)
+		}
+		return -1
+	})
+	return r, err
+}
+
+// decodePointMessage decodes a message of any type; requests are what a
+// point reads, responses what a Point does.
+func decodePointMessage(b []byte) (pointMessage, error) {
+	var m pointMessage
+	var inner []byte
+	var innerField protowire.Number
+	err := eachField(b, func(num protowire.Number, typ protowire.Type, v []byte) int {
+		if num == 1 {
+			return varintField(typ, v, &m.typ)
+		}
+		if num >= 2 && num <= 6 {
+			innerField = num
+			return bytesField(typ, v, &inner)
+		}
+		return -1
+	})
+	if err != nil {
+		return m, err
+	}
+	if innerField != protowire.Number(m.typ+2) {
+		return m, fmt.Errorf("rendezvous message of type %d without its body", m.typ)
+	}
+	switch m.typ {
+	case pointRegister:
+		m.reg, err = decodeRegistration(inner)
+	case pointRegisterResponse:
+		err = eachField(inner, func(num protowire.Number, typ protowire.Type, v []byte) int {
+			switch num {
+			case 1:
+				return varintField(typ, v, &m.status)
+			case 2:
+				return stringField(typ, v, &m.text)
+			case 3:
+				return varintField(typ, v, &m.ttl)
+			}
+			return -1
+		})
+	case pointUnregister, pointDiscover:
+		err = eachField(inner, func(num protowire.Number, typ protowire.Type, v []byte) int {
+			switch num {
+			case 1:
+				return stringField(typ, v, &m.ns)
+			case 2:
+				return varintField(typ, v, &m.limit)
+			case 3:
+				return bytesField(typ, v, &m.cookie)
+			}
+			return -1
+		})
+	case pointDiscoverResponse:
+		err = eachField(inner, func(num protowire.Number, typ protowire.Type, v []byte) int {
+			switch num {
+			case 1:
+				var rb []byte
+				n := bytesField(typ, v, &rb)
+				if n > 0 {
+					r, rerr := decodeRegistration(rb)
+					if rerr != nil {
+						return -1
+					}
+					m.regs = append(m.regs, r)
+				}
+				return n
+			case 2:
+				return bytesField(typ, v, &m.cookie)
+			case 3:
+				return varintField(typ, v, &m.status)
+			case 4:
+				return stringField(typ, v, &m.text)
+			}
+			return -1
+		})
+	default:
+		err = fmt.Errorf("unknown rendezvous message type %d", m.typ)
+	}
+	return m, err
+}
+
+func writePointMessage(w io.Writer, b []byte) error {
+	_, err := w.Write(append(binary.AppendUvarint(nil, uint64(len(b))), b...))
+	return err
+}
+
+func readPointMessage(r *bufio.Reader) (pointMessage, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return pointMessage{}, err
+	}
+	if size > maxPointMessage {
+		return pointMessage{}, fmt.Errorf("rendezvous message of %d bytes", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return pointMessage{}, err
+	}
+	return decodePointMessage(b)
+}
+
+// Point registers with and discovers from one rendezvous point.
+type Point struct {
+	host host.Host
+	info peer.AddrInfo
+}
+
+// NewPoint returns a client of the rendezvous point at addr, a multiaddr
+// ending in /p2p/<id>.
+func NewPoint(h host.Host, addr string) (*Point, error) {
+	info, err := peer.AddrInfoFromString(addr)
+	if err != nil {
+		return nil, fmt.Errorf("rendezvous point %q: %w", addr, err)
+	}
+	return &Point{host: h, info: *info}, nil
+}
+
+// roundTrip sends req to the point and returns its answer, if req has one.
+func (p *Point) roundTrip(ctx context.Context, req pointMessage, answer bool) (pointMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := p.host.Connect(ctx, p.info); err != nil {
+		return pointMessage{}, err
+	}
+	stream, err := p.host.NewStream(ctx, p.info.ID, PointProtocolID)
+	if err != nil {
+		return pointMessage{}, err
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	if err := writePointMessage(stream, req.encode()); err != nil {
+		return pointMessage{}, err
+	}
+	if !answer {
+		return pointMessage{}, nil
+	}
+	resp, err := readPointMessage(bufio.NewReader(stream))
+	if err != nil {
+		return pointMessage{}, err
+	}
+	if resp.typ != req.typ+1 {
+		return pointMessage{}, fmt.Errorf("rendezvous point answered with message type %d", resp.typ)
+	}
+	if resp.status != pointOK {
+		return pointMessage{}, fmt.Errorf("rendezvous point: status %d: %s", resp.status, resp.text)
+	}
+	return resp, nil
+}
+
+// Advertise registers our signed peer record under ns.
+func (p *Point) Advertise(ctx context.Context, ns string, opts ...discovery.Option) (time.Duration, error) {
+	var options discovery.Options
+	if err := options.Apply(opts...); err != nil {
+		return 0, err
+	}
+	if len(ns) == 0 || len(ns) > maxNamespace {
+		return 0, fmt.Errorf("bad rendezvous namespace %q", ns)
+	}
+	ttl := options.Ttl
+	if ttl <= 0 || ttl > MaxPointTTL {
+		ttl = min(DefaultTTL, MaxPointTTL)
+	}
+	env, err := record.Seal(peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: p.host.ID(), Addrs: p.host.Addrs()}), p.host.Peerstore().PrivKey(p.host.ID()))
+	if err != nil {
+		return 0, err
+	}
+	spr, err := env.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.roundTrip(ctx, pointMessage{typ: pointRegister, reg: registration{ns: ns, spr: spr, ttl: uint64(ttl / time.Second)}}, true)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(resp.ttl) * time.Second, nil
+}
+
+// Unregister removes our registration under ns.
+func (p *Point) Unregister(ctx context.Context, ns string) error {
+	_, err := p.roundTrip(ctx, pointMessage{typ: pointUnregister, ns: ns}, false)
+	return err
+}
+
+// FindPeers returns the peers registered under ns, whose peer records
+// their own keys sealed.
+func (p *Point) FindPeers(ctx context.Context, ns string, opts ...discovery.Option) (<-chan peer.AddrInfo, error) {
+	var options discovery.Options
+	if err := options.Apply(opts...); err != nil {
+		return nil, err
+	}
+	limit := options.Limit
+	if limit <= 0 {
+		limit = MaxPeers
+	}
+	var (
+		found  []peer.AddrInfo
+		cookie []byte
+	)
+	for len(found) < limit {
+		resp, err := p.roundTrip(ctx, pointMessage{typ: pointDiscover, ns: ns, limit: uint64(limit - len(found)), cookie: cookie}, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resp.regs {
+			info, err := peerRecord(r.spr)
+			if err != nil {
+				continue
+			}
+			found = append(found, info)
+		}
+		if len(resp.regs) == 0 || len(resp.cookie) == 0 {
+			break
+		}
+		cookie = resp.cookie
+	}
+	ch := make(chan peer.AddrInfo, len(found))
+	for _, info := range found[:min(len(found), limit)] {
+		ch <- info
+	}
+	close(ch)
+	return ch, nil
+}
+
+// peerRecord opens a sealed peer record.
+func peerRecord(spr []byte) (peer.AddrInfo, error) {
+	env, rec, err := record.ConsumeEnvelope(spr, peer.PeerRecordEnvelopeDomain)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	pr, ok := rec.(*peer.PeerRecord)
+	if !ok {
+		return peer.AddrInfo{}, errors.New("not a peer record")
+	}
+	if !pr.PeerID.MatchesPublicKey(env.PublicKey) {
+		return peer.AddrInfo{}, errors.New("peer record not sealed by its peer")
+	}
+	return peer.AddrInfo{ID: pr.PeerID, Addrs: pr.Addrs}, nil
+}
@@ -0,0 +1,284 @@
+package rendezvous
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// The interop test runs Point against a rendezvous point that does not
+// share its codec: it reads and writes messages through the protobuf
+// runtime, from the rendezvous.proto of libp2p/specs that
+// go-libp2p-rendezvous and the other implementations compile.
+
+// rendezvousSchema returns the Message of rendezvous.proto.
+func rendezvousSchema(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+	const pkg = ".rendezvous.pb.Message."
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(num),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   typ.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(pkg + typeName)
+		}
+		return f
+	}
+	enum := func(name string, values ...string) *descriptorpb.EnumDescriptorProto {
+		e := &descriptorpb.EnumDescriptorProto{Name: proto.String(name)}
+		for _, v := range values {
+			name, num, _ := strings.Cut(v, "=")
+			n, _ := strconv.Atoi(num)
+			e.Value = append(e.Value, &descriptorpb.EnumValueDescriptorProto{Name: proto.String(name), Number: proto.Int32(int32(n))})
+		}
+		return e
+	}
+	const (
+		str   = descriptorpb.FieldDescriptorProto_TYPE_STRING
+		bytes = descriptorpb.FieldDescriptorProto_TYPE_BYTES
+		u64   = descriptorpb.FieldDescriptorProto_TYPE_UINT64
+		enm   = descriptorpb.FieldDescriptorProto_TYPE_ENUM
+		msg   = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+	)
+	registrations := field("registrations", 1, msg, "Register")
+	registrations.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("rendezvous.proto"),
+		Package: proto.String("rendezvous.pb"),
+		Syntax:  proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Message"),
+			EnumType: []*descriptorpb.EnumDescriptorProto{
+				enum("MessageType", "REGISTER=0", "REGISTER_RESPONSE=1", "UNREGISTER=2", "DISCOVER=3", "DISCOVER_RESPONSE=4"),
+				enum("ResponseStatus", "OK=0", "E_INVALID_NAMESPACE=100", "E_INVALID_SIGNED_PEER_RECORD=101",
+					"E_INVALID_TTL=102", "E_INVALID_COOKIE=103", "E_NOT_AUTHORIZED=200", "E_INTERNAL_ERROR=300", "E_UNAVAILABLE=400"),
+			},
+			NestedType: []*descriptorpb.DescriptorProto{
+				{Name: proto.String("Register"), Field: []*descriptorpb.FieldDescriptorProto{
+					field("ns", 1, str, ""), field("signedPeerRecord", 2, bytes, ""), field("ttl", 3, u64, ""),
+				}},
+				{Name: proto.String("RegisterResponse"), Field: []*descriptorpb.FieldDescriptorProto{
+					field("status", 1, enm, "ResponseStatus"), field("statusText", 2, str, ""), field("ttl", 3, u64, ""),
+				}},
+				{Name: proto.String("Unregister"), Field: []*descriptorpb.FieldDescriptorProto{
+					field("ns", 1, str, ""),
+				}},
+				{Name: proto.String("Discover"), Field: []*descriptorpb.FieldDescriptorProto{
+					field("ns", 1, str, ""), field("limit", 2, u64, ""), field("cookie", 3, bytes, ""),
+				}},
+				{Name: proto.String("DiscoverResponse"), Field: []*descriptorpb.FieldDescriptorProto{
+					registrations, field("cookie", 2, bytes, ""),
+					field("status", 3, enm, "ResponseStatus"), field("statusText", 4, str, ""),
+				}},
+			},
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("type", 1, enm, "MessageType"),
+				field("register", 2, msg, "Register"),
+				field("registerResponse", 3, msg, "RegisterResponse"),
+				field("unregister", 4, msg, "Unregister"),
+				field("discover", 5, msg, "Discover"),
+				field("discoverResponse", 6, msg, "DiscoverResponse"),
+			},
+		}},
+	}
+	fd, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd.Messages().ByName("Message")
+}
+
+// fieldOf returns the field of m called name.
+func fieldOf(m protoreflect.Message, name string) protoreflect.FieldDescriptor {
+	return m.Descriptor().Fields().ByName(protoreflect.Name(name))
+}
+
+func getField(m protoreflect.Message, name string) protoreflect.Value {
+	return m.Get(fieldOf(m, name))
+}
+
+func setField(m protoreflect.Message, name string, v protoreflect.Value) {
+	m.Set(fieldOf(m, name), v)
+}
+
+// schemaPoint is a rendezvous point speaking rendezvous.proto through
+// the protobuf runtime. It answers discoveries one registration at a time
+// so clients must follow its cookies, and refuses the namespace closed.
+type schemaPoint struct {
+	t      *testing.T
+	schema protoreflect.MessageDescriptor
+
+	mu   sync.Mutex
+	regs map[string][]peer.ID
+	sprs map[peer.ID][]byte
+}
+
+func (sp *schemaPoint) serve(stream network.Stream) {
+	defer stream.Close()
+	r := bufio.NewReader(stream)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return
+	}
+	req := dynamicpb.NewMessage(sp.schema)
+	if err := proto.Unmarshal(b, req); err != nil {
+		sp.t.Errorf("point: request does not parse as rendezvous.proto: %v", err)
+		return
+	}
+	from := stream.Conn().RemotePeer()
+	resp := dynamicpb.NewMessage(sp.schema)
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	switch typ := getField(req, "type").Enum(); typ {
+	case pointRegister:
+		reg := getField(req, "register").Message()
+		ns := getField(reg, "ns").String()
+		body := resp.NewField(fieldOf(resp, "registerResponse")).Message()
+		switch {
+		case ns == "closed":
+			setField(body, "status", protoreflect.ValueOfEnum(200))
+			setField(body, "statusText", protoreflect.ValueOfString("not authorized"))
+		default:
+			spr := getField(reg, "signedPeerRecord").Bytes()
+			if info, err := peerRecord(spr); err != nil || info.ID != from {
+				sp.t.Errorf("point: registration without %s's signed peer record: %v", from, err)
+			}
+			if _, ok := sp.sprs[from]; !ok {
+				sp.regs[ns] = append(sp.regs[ns], from)
+			}
+			sp.sprs[from] = spr
+			setField(body, "status", protoreflect.ValueOfEnum(0))
+			setField(body, "ttl", getField(reg, "ttl"))
+		}
+		setField(resp, "type", protoreflect.ValueOfEnum(pointRegisterResponse))
+		setField(resp, "registerResponse", protoreflect.ValueOfMessage(body))
+	case pointUnregister:
+		ns := getField(getField(req, "unregister").Message(), "ns").String()
+		ids := sp.regs[ns]
+		for i, id := range ids {
+			if id == from {
+				sp.regs[ns] = append(ids[:i:i], ids[i+1:]...)
+				delete(sp.sprs, from)
+				break
+			}
+		}
+		return
+	case pointDiscover:
+		disc := getField(req, "discover").Message()
+		ns := getField(disc, "ns").String()
+		if getField(disc, "limit").Uint() == 0 {
+			sp.t.Errorf("point: discover without a limit")
+		}
+		next, _ := strconv.Atoi(string(getField(disc, "cookie").Bytes()))
+		body := resp.NewField(fieldOf(resp, "discoverResponse")).Message()
+		if next < len(sp.regs[ns]) {
+			id := sp.regs[ns][next]
+			regs := body.Mutable(fieldOf(body, "registrations")).List()
+			reg := regs.NewElement().Message()
+			setField(reg, "ns", protoreflect.ValueOfString(ns))
+			setField(reg, "signedPeerRecord", protoreflect.ValueOfBytes(sp.sprs[id]))
+			setField(reg, "ttl", protoreflect.ValueOfUint64(3600))
+			regs.Append(protoreflect.ValueOfMessage(reg))
+			next++
+		}
+		setField(body, "cookie", protoreflect.ValueOfBytes([]byte(strconv.Itoa(next))))
+		setField(body, "status", protoreflect.ValueOfEnum(0))
+		setField(resp, "type", protoreflect.ValueOfEnum(pointDiscoverResponse))
+		setField(resp, "discoverResponse", protoreflect.ValueOfMessage(body))
+	default:
+		sp.t.Errorf("point: unexpected message type %d", typ)
+		return
+	}
+	out, err := proto.Marshal(resp)
+	if err != nil {
+		sp.t.Error(err)
+		return
+	}
+	_, _ = stream.Write(append(binary.AppendUvarint(nil, uint64(len(out))), out...))
+}
+
+// TestPointInterop checks Point against a rendezvous point that encodes
+// rendezvous.proto with the protobuf runtime: registering, discovering
+// across pages, unregistering, and an error status.
+func TestPointInterop(t *testing.T) {
+	ctx := context.Background()
+	pointHost := newHost(t)
+	sp := &schemaPoint{t: t, schema: rendezvousSchema(t), regs: make(map[string][]peer.ID), sprs: make(map[peer.ID][]byte)}
+	pointHost.SetStreamHandler(PointProtocolID, sp.serve)
+	addr := pointHost.Addrs()[0].String() + "/p2p/" + pointHost.ID().String()
+
+	var points []*Point
+	for range 3 {
+		point, err := NewPoint(newHost(t), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl, err := point.Advertise(ctx, "team", discovery.TTL(2*time.Hour)); err != nil || ttl != 2*time.Hour {
+			t.Fatalf("advertise: %s, %v", ttl, err)
+		}
+		points = append(points, point)
+	}
+
+	found := func(want int) {
+		t.Helper()
+		ch, err := points[0].FindPeers(ctx, "team")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[peer.ID]bool)
+		for info := range ch {
+			if len(info.Addrs) == 0 {
+				t.Errorf("%s found without addresses", info.ID)
+			}
+			seen[info.ID] = true
+		}
+		if len(seen) != want {
+			t.Fatalf("found %d peers, want %d", len(seen), want)
+		}
+	}
+	found(3)
+
+	if err := points[2].Unregister(ctx, "team"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		sp.mu.Lock()
+		n := len(sp.regs["team"])
+		sp.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the point never saw the unregister")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	found(2)
+
+	if _, err := points[0].Advertise(ctx, "closed"); err == nil || !strings.Contains(err.Error(), "status 200: not authorized") {
+		t.Fatalf("advertise to a closed namespace: %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package rendezvous
+
+import (
+	"bufio"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testPoint is a minimal rendezvous point: it keeps registrations in
+// memory and answers discoveries with all of them, ignoring TTLs.
+type testPoint struct {
+	mu   sync.Mutex
+	regs map[string]map[peer.ID]registration
+}
+
+func (tp *testPoint) serve(stream network.Stream) {
+	defer stream.Close()
+	req, err := readPointMessage(bufio.NewReader(stream))
+	if err != nil {
+		return
+	}
+	from := stream.Conn().RemotePeer()
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	switch req.typ {
+	case pointRegister:
+		resp := pointMessage{typ: pointRegisterResponse, ttl: req.reg.ttl}
+		if info, err := peerRecord(req.reg.spr); err != nil || info.ID != from {
+			resp.status, resp.text = 101, "invalid signed peer record"
+		} else {
+			if tp.regs[req.reg.ns] == nil {
+				tp.regs[req.reg.ns] = make(map[peer.ID]registration)
+			}
+			tp.regs[req.reg.ns][from] = req.reg
+		}
+		_ = writePointMessage(stream, resp.encodeResponse())
+	case pointUnregister:
+		delete(tp.regs[req.ns], from)
+	case pointDiscover:
+		resp := pointMessage{typ: pointDiscoverResponse}
+		for _, r := range tp.regs[req.ns] {
+			resp.regs = append(resp.regs, r)
+		}
+		_ = writePointMessage(stream, resp.encodeResponse())
+	}
+}
+
+// encodeResponse returns the protobuf of a response: register or
+// discover.
+func (m pointMessage) encodeResponse() []byte {
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, m.typ)
+	var body []byte
+	if m.typ == pointRegisterResponse {
+		body = protowire.AppendTag(body, 1, protowire.VarintType)
+		body = protowire.AppendVarint(body, m.status)
+		body = protowire.AppendTag(body, 2, protowire.BytesType)
+		body = protowire.AppendString(body, m.text)
+		body = protowire.AppendTag(body, 3, protowire.VarintType)
+		body = protowire.AppendVarint(body, m.ttl)
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		return protowire.AppendBytes(b, body)
+	}
+	for _, r := range m.regs {
+		body = protowire.AppendTag(body, 1, protowire.BytesType)
+		body = protowire.AppendBytes(body, appendRegistration(nil, r))
+	}
+	if m.cookie != nil {
+		body = protowire.AppendTag(body, 2, protowire.BytesType)
+		body = protowire.AppendBytes(body, m.cookie)
+	}
+	body = protowire.AppendTag(body, 3, protowire.VarintType)
+	body = protowire.AppendVarint(body, m.status)
+	body = protowire.AppendTag(body, 4, protowire.BytesType)
+	body = protowire.AppendString(body, m.text)
+	b = protowire.AppendTag(b, 6, protowire.BytesType)
+	return protowire.AppendBytes(b, body)
+}
+
+// TestPoint checks that peers registered at a rendezvous point find each
+// other through it, and that a peer unregistered is no longer found.
+func TestPoint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pointHost := newHost(t)
+	tp := &testPoint{regs: make(map[string]map[peer.ID]registration)}
+	pointHost.SetStreamHandler(PointProtocolID, tp.serve)
+	addr := pointHost.Addrs()[0].String() + "/p2p/" + pointHost.ID().String()
+
+	start := func(nickname string) (*Service, *Point, recorder) {
+		h := newHost(t)
+		point, err := NewPoint(h, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events := make(recorder, 16)
+		s, err := New(h, point, Config{Key: "team", Logf: t.Logf}, events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Publish(signedRecord(t, h, nickname)); err != nil {
+			t.Fatal(err)
+		}
+		h.SetStreamHandler(ProtocolID, s.serve)
+		if ttl, err := point.Advertise(ctx, s.ns, discovery.TTL(time.Hour)); err != nil || ttl != time.Hour {
+			t.Fatalf("advertise: %s, %v", ttl, err)
+		}
+		return s, point, events
+	}
+	alice, _, aliceEvents := start("alice")
+	bob, bobPoint, _ := start("bob")
+
+	if err := alice.Lookup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	aliceEvents.expect(t, event{"joined", "bob", ""})
+	if err := bob.Lookup(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bobPoint.Unregister(ctx, bob.ns); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		found, err := bobPoint.FindPeers(ctx, bob.ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for range found {
+			n++
+		}
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d peers registered after bob unregistered", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := alice.Lookup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	aliceEvents.expect(t, event{"left", "bob", ""})
+}
@@ -0,0 +1,396 @@
+// Package rendezvous lets peers find each other without a tmd-node. Every
+// peer advertises itself under a namespace derived from a rendezvous key
+// shared by its group, on a libp2p Discovery such as the Kademlia DHT or a
+// rendezvous point (see Point), and serves its Record, sealed in a libp2p
+// signed envelope with its peer key, on ProtocolID. Peers looking up the
+// namespace fetch the record of each provider and keep it only if the
+// provider's own key sealed it and signed its HPKE key (see
+// node.VerifyKeySig), so neither the discovery nor a provider can pass
+// off keys of another peer.
+//
+// Providers are looked up every Interval. A peer whose record can no
+// longer be fetched has left: provider records outlive the peers that
+// published them by hours on the DHT.
+package rendezvous
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/record"
+	"github.com/multiformats/go-multiaddr"
+
+	"github.com/pivaldi/tmd/internal/keyid"
+	"github.com/pivaldi/tmd/internal/node"
+)
+
+// ProtocolID is the protocol a peer serves its sealed record on.
+const ProtocolID = protocol.ID("/tmd/rendezvous/1.0.0")
+
+const (
+	// DefaultInterval is how often providers are looked up.
+	DefaultInterval = time.Minute
+	// DefaultTTL is how long an advertisement lasts; it is renewed
+	// before it runs out.
+	DefaultTTL = 3 * time.Hour
+	// MaxPeers bounds the providers taken from one lookup.
+	MaxPeers = 1000
+	// maxRecordSize bounds a sealed record.
+	maxRecordSize = 64 << 10
+	// msgRecord is the only message of ProtocolID.
+	msgRecord byte = 1
+)
+
+// Namespace returns the namespace peers sharing key advertise under.
+func Namespace(key string) string {
+	return "/tmd/rendezvous/" + key
+}
+
+// Record is what a peer publishes about itself.
+type Record struct {
+	Nickname string      `json:"nick"`
+	Addrs    []string    `json:"addrs"`
+	HPKEPub  []byte      `json:"hpke_pub"`
+	KeyID    keyid.KeyID `json:"key_id"`
+	KeySig   []byte      `json:"key_sig"`
+	Presence string      `json:"presence,omitempty"`
+	Profile  []byte      `json:"profile,omitempty"`
+	Seq      uint64      `json:"seq"` // grows with each record of the peer
+}
+
+func (*Record) Domain() string { return "tmd-rendezvous-record" }
+func (*Record) Codec() []byte  { return []byte("/tmd/rendezvous-record") }
+
+func (r *Record) MarshalRecord() ([]byte, error) { return json.Marshal(r) }
+func (r *Record) UnmarshalRecord(b []byte) error { return json.Unmarshal(b, r) }
+
+// peerInfo checks that id sealed r and signed its HPKE key, and returns r
+// as announced by a node.
+func (r *Record) peerInfo(id peer.ID) (node.PeerInfo, error) {
+	if r.Nickname == "" || len(r.Nickname) > node.MaxNicknameSize {
+		return node.PeerInfo{}, fmt.Errorf("bad nickname %q", r.Nickname)
+	}
+	if err := node.VerifyKeySig(id, r.Nickname, r.KeyID, r.HPKEPub, r.KeySig); err != nil {
+		return node.PeerInfo{}, err
+	}
+	addrs := make([]multiaddr.Multiaddr, 0, len(r.Addrs))
+	for _, a := range r.Addrs {
+		m, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return node.PeerInfo{}, err
+		}
+		addrs = append(addrs, m)
+	}
+	return node.PeerInfo{Nickname: r.Nickname, PeerID: id, Addrs: addrs, HPKEPub: r.HPKEPub, KeyID: r.KeyID, Presence: r.Presence, Profile: r.Profile, KeySig: r.KeySig}, nil
+}
+
+// Config configures a Service.
+type Config struct {
+	Key      string                           // rendezvous key shared by the group
+	Interval time.Duration                    // default DefaultInterval
+	TTL      time.Duration                    // default DefaultTTL
+	Logf     func(format string, args ...any) // without a prefix
+}
+
+// known is a peer found at the last lookup.
+type known struct {
+	info node.PeerInfo
+	seq  uint64
+}
+
+// Service publishes our record and reports the peers it finds to a
+// node.PeerHandler, as a node would; nodeID is empty in its events. It is
+// safe for concurrent use.
+type Service struct {
+	host    host.Host
+	disc    discovery.Discovery
+	ns      string
+	cfg     Config
+	handler node.PeerHandler
+
+	mu     sync.Mutex
+	self   Record
+	sealed []byte
+	peers  map[peer.ID]known
+	nicks  map[string]peer.ID
+}
+
+// New returns a Service finding the peers that share cfg.Key on disc.
+// Publish our record, then Run it.
+func New(h host.Host, disc discovery.Discovery, cfg Config, handler node.PeerHandler) (*Service, error) {
+	if cfg.Key == "" {
+		return nil, errors.New("empty rendezvous key")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultTTL
+	}
+	if cfg.Logf == nil {
+		cfg.Logf = func(string, ...any) {}
+	}
+	return &Service{
+		host:    h,
+		disc:    disc,
+		ns:      Namespace(cfg.Key),
+		cfg:     cfg,
+		handler: handler,
+		peers:   make(map[peer.ID]known),
+		nicks:   make(map[string]peer.ID),
+	}, nil
+}
+
+// Publish seals r with our peer key and serves it from now on. Addrs
+// defaults to the addresses of the host.
+func (s *Service) Publish(r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.publishLocked(r)
+}
+
+func (s *Service) publishLocked(r Record) error {
+	if len(r.Addrs) == 0 {
+		for _, a := range s.host.Addrs() {
+			r.Addrs = append(r.Addrs, a.String())
+		}
+	}
+	// Sequence numbers start from the clock so that they keep growing
+	// across restarts.
+	r.Seq = max(s.self.Seq+1, uint64(time.Now().UnixNano()))
+	env, err := record.Seal(&r, s.host.Peerstore().PrivKey(s.host.ID()))
+	if err != nil {
+		return fmt.Errorf("seal record: %w", err)
+	}
+	sealed, err := env.Marshal()
+	if err != nil {
+		return err
+	}
+	s.self, s.sealed = r, sealed
+	return nil
+}
+
+// SetPresence republishes our record with presence.
+func (s *Service) SetPresence(presence string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.self
+	r.Presence = presence
+	return s.publishLocked(r)
+}
+
+// SetProfile republishes our record with profile.
+func (s *Service) SetProfile(profile []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.self
+	r.Profile = profile
+	return s.publishLocked(r)
+}
+
+// Run serves our record, advertises it and looks up providers until ctx
+// is done.
+func (s *Service) Run(ctx context.Context) {
+	s.host.SetStreamHandler(ProtocolID, s.serve)
+	defer s.host.RemoveStreamHandler(ProtocolID)
+	go s.advertise(ctx)
+
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Lookup(ctx); err != nil && ctx.Err() == nil {
+			s.cfg.Logf("lookup: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// advertise renews our advertisement before it runs out.
+func (s *Service) advertise(ctx context.Context) {
+	for {
+		wait := s.cfg.Interval
+		ttl, err := s.disc.Advertise(ctx, s.ns, discovery.TTL(s.cfg.TTL))
+		switch {
+		case err != nil && ctx.Err() == nil:
+			s.cfg.Logf("advertise: %v", err)
+		case err == nil && ttl > 0:
+			wait = max(wait, 7*ttl/8)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// serve sends our sealed record.
+func (s *Service) serve(stream network.Stream) {
+	defer stream.Close()
+	s.mu.Lock()
+	sealed := s.sealed
+	s.mu.Unlock()
+	if sealed == nil {
+		_ = stream.Reset()
+		return
+	}
+	_ = stream.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_ = node.WriteMsg(stream, msgRecord, sealed)
+}
+
+// Lookup finds the providers of the namespace once, fetches their records
+// and reports the peers that joined, changed or left since the last one.
+func (s *Service) Lookup(ctx context.Context) error {
+	found, err := s.disc.FindPeers(ctx, s.ns, discovery.Limit(MaxPeers))
+	if err != nil {
+		return err
+	}
+	type result struct {
+		rec  Record
+		info node.PeerInfo
+	}
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make(map[peer.ID]result)
+	)
+	for ai := range found {
+		if ai.ID == s.host.ID() || ai.ID == "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec, info, err := s.fetch(ctx, ai)
+			if err != nil {
+				s.cfg.Logf("record of %s: %v", ai.ID.ShortString(), err)
+				return
+			}
+			mu.Lock()
+			results[ai.ID] = result{rec, info}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	s.mu.Lock()
+	var joined, updated []node.PeerInfo
+	var left []string
+	for id, k := range s.peers {
+		if _, ok := results[id]; !ok {
+			delete(s.peers, id)
+			delete(s.nicks, k.info.Nickname)
+			left = append(left, k.info.Nickname)
+		}
+	}
+	// Deterministic order, so that of two peers claiming a nickname the
+	// same one wins everywhere.
+	ids := make([]peer.ID, 0, len(results))
+	for id := range results {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		res := results[id]
+		nick := res.info.Nickname
+		if holder, ok := s.nicks[nick]; ok && holder != id {
+			s.cfg.Logf("%s claims %s, held by %s; ignoring it", id.ShortString(), nick, holder.ShortString())
+			continue
+		}
+		old, ok := s.peers[id]
+		switch {
+		case !ok:
+			joined = append(joined, res.info)
+		case res.rec.Seq <= old.seq:
+			continue
+		case old.info.Nickname != nick || !bytes.Equal(old.info.HPKEPub, res.info.HPKEPub):
+			// A new identity under the same peer ID: announce it anew.
+			delete(s.nicks, old.info.Nickname)
+			left = append(left, old.info.Nickname)
+			joined = append(joined, res.info)
+		default:
+			updated = append(updated, res.info)
+		}
+		s.peers[id] = known{info: res.info, seq: res.rec.Seq}
+		s.nicks[nick] = id
+	}
+	s.mu.Unlock()
+
+	for _, nick := range left {
+		s.handler.OnPeerLeft(nick, "")
+	}
+	for _, info := range joined {
+		s.handler.OnPeerJoined(info, "")
+	}
+	if h, ok := s.handler.(node.PeerUpdateHandler); ok {
+		for _, info := range updated {
+			h.OnPeerUpdated(info, "")
+		}
+	}
+	return nil
+}
+
+// Peers returns the peers found at the last lookup.
+func (s *Service) Peers() []node.PeerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]node.PeerInfo, 0, len(s.peers))
+	for _, k := range s.peers {
+		list = append(list, k.info)
+	}
+	return list
+}
+
+// fetch gets the sealed record of a provider and checks it.
+func (s *Service) fetch(ctx context.Context, ai peer.AddrInfo) (Record, node.PeerInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := s.host.Connect(ctx, ai); err != nil {
+		return Record{}, node.PeerInfo{}, err
+	}
+	stream, err := s.host.NewStream(ctx, ai.ID, ProtocolID)
+	if err != nil {
+		return Record{}, node.PeerInfo{}, err
+	}
+	defer stream.Close()
+	_ = stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	typ, data, err := node.ReadMsg(stream)
+	if err != nil {
+		return Record{}, node.PeerInfo{}, err
+	}
+	if typ != msgRecord || len(data) > maxRecordSize {
+		return Record{}, node.PeerInfo{}, fmt.Errorf("unexpected message %d of %d bytes", typ, len(data))
+	}
+	var rec Record
+	env, err := record.ConsumeTypedEnvelope(data, &rec)
+	if err != nil {
+		return Record{}, node.PeerInfo{}, err
+	}
+	signer, err := peer.IDFromPublicKey(env.PublicKey)
+	if err != nil {
+		return Record{}, node.PeerInfo{}, err
+	}
+	if signer != ai.ID {
+		return Record{}, node.PeerInfo{}, fmt.Errorf("record sealed by %s", signer.ShortString())
+	}
+	info, err := rec.peerInfo(ai.ID)
+	return rec, info, err
+}
@@ -0,0 +1,178 @@
+package rendezvous
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mocks"
+
+	"github.com/pivaldi/tmd/internal/keyid"
+	"github.com/pivaldi/tmd/internal/node"
+	"github.com/pivaldi/tmd/internal/p2p"
+)
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+type event struct {
+	kind     string
+	nickname string
+	presence string
+}
+
+type recorder chan event
+
+func (r recorder) OnPeerJoined(info node.PeerInfo, _ peer.ID) {
+	r <- event{"joined", info.Nickname, info.Presence}
+}
+func (r recorder) OnPeerUpdated(info node.PeerInfo, _ peer.ID) {
+	r <- event{"updated", info.Nickname, info.Presence}
+}
+func (r recorder) OnPeerLeft(nickname string, _ peer.ID) { r <- event{"left", nickname, ""} }
+func (recorder) OnNodeConnected(peer.ID)                 {}
+func (recorder) OnNodeDisconnected(peer.ID)              {}
+
+func (r recorder) expect(t *testing.T, want ...event) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-r:
+			if got != w {
+				t.Fatalf("got %+v, want %+v", got, w)
+			}
+		default:
+			t.Fatalf("no event %+v", w)
+		}
+	}
+	select {
+	case got := <-r:
+		t.Fatalf("unexpected event %+v", got)
+	default:
+	}
+}
+
+func newHost(t *testing.T) host.Host {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := p2p.NewHost(priv, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// signedRecord returns the record of nickname on h, its HPKE key signed
+// with the key of h.
+func signedRecord(t *testing.T, h host.Host, nickname string) Record {
+	t.Helper()
+	hpke := []byte("hpke-" + nickname)
+	kid := keyid.Of(hpke)
+	sig, err := h.Peerstore().PrivKey(h.ID()).Sign(node.KeySignInput(nickname, kid, hpke))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Record{Nickname: nickname, HPKEPub: hpke, KeyID: kid, KeySig: sig}
+}
+
+// TestRendezvous checks that peers sharing a key find each other, with
+// their presence, through the discovery alone, that records not sealed
+// and signed by their provider are refused, and that a peer whose record
+// can no longer be fetched has left.
+func TestRendezvous(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := mocks.NewDiscoveryServer(realClock{})
+
+	start := func(nickname string) (*Service, recorder, host.Host) {
+		h := newHost(t)
+		events := make(recorder, 16)
+		s, err := New(h, mocks.NewDiscoveryClient(h, server), Config{Key: "team", Interval: time.Hour, Logf: t.Logf}, events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Publish(signedRecord(t, h, nickname)); err != nil {
+			t.Fatal(err)
+		}
+		h.SetStreamHandler(ProtocolID, s.serve)
+		if _, err := s.disc.Advertise(ctx, s.ns, discovery.TTL(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		return s, events, h
+	}
+	alice, aliceEvents, _ := start("alice")
+	bob, _, bobHost := start("bob")
+
+	// Another group does not show up.
+	other := newHost(t)
+	if _, err := mocks.NewDiscoveryClient(other, server).Advertise(ctx, Namespace("other"), discovery.TTL(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.Lookup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	aliceEvents.expect(t, event{"joined", "bob", ""})
+	if got := alice.Peers(); len(got) != 1 || got[0].PeerID != bobHost.ID() || len(got[0].Addrs) == 0 {
+		t.Fatalf("peers = %+v", got)
+	}
+
+	// Nothing changed: nothing to report. A new presence is an update.
+	if err := alice.Lookup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	aliceEvents.expect(t)
+	if err := bob.SetPresence("away"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Lookup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	aliceEvents.expect(t, event{"updated", "bob", "away"})
+
+	// Mallory serves bob's record, and then her own with an HPKE key
+	// she did not sign.
+	_, _, malloryHost := start("mallory")
+	bob.mu.Lock()
+	stolen := bob.sealed
+	bob.mu.Unlock()
+	mallory, _ := New(malloryHost, nil, Config{Key: "team"}, nil)
+	mallory.sealed = stolen
+	malloryHost.SetStreamHandler(ProtocolID, mallory.serve)
+	if err := alice.Lookup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	aliceEvents.expect(t)
+
+	forged := signedRecord(t, malloryHost, "carol")
+	forged.HPKEPub = []byte("someone else's")
+	env, err := record.Seal(&forged, malloryHost.Peerstore().PrivKey(malloryHost.ID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mallory.sealed, err = env.Marshal(); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Lookup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	aliceEvents.expect(t)
+
+	// Bob goes away; his advertisement stays, as on the DHT.
+	bobHost.Close()
+	if err := alice.Lookup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	aliceEvents.expect(t, event{"left", "bob", ""})
+}
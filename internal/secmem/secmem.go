@@ -0,0 +1,69 @@
+// Package secmem keeps secrets out of ordinary Go memory: a Buffer is
+// allocated outside the Go heap, so the garbage collector never copies
+// it, locked so it is not swapped to disk, kept out of core dumps where
+// the OS allows it, and wiped once the secret is no longer needed.
+//
+// Locking can fail, for instance past RLIMIT_MEMLOCK (ulimit -l); the
+// buffer is then still usable and wiped, and Locked says so. On systems
+// without mmap a Buffer is an ordinary slice that is only wiped.
+package secmem
+
+import "runtime"
+
+// Buffer is memory for secrets.
+type Buffer struct {
+	b      []byte
+	locked bool
+	wiped  bool
+}
+
+// New returns a zeroed buffer of size bytes.
+func New(size int) (*Buffer, error) {
+	b, locked, err := alloc(size)
+	if err != nil {
+		return nil, err
+	}
+	return &Buffer{b: b, locked: locked}, nil
+}
+
+// Copy returns a buffer holding a copy of secret, and wipes secret.
+func Copy(secret []byte) (*Buffer, error) {
+	buf, err := New(len(secret))
+	if err != nil {
+		return nil, err
+	}
+	copy(buf.b, secret)
+	Wipe(secret)
+	return buf, nil
+}
+
+// Bytes returns the memory of the buffer.
+func (b *Buffer) Bytes() []byte {
+	return b.b
+}
+
+// Locked reports whether the buffer is locked in memory.
+func (b *Buffer) Locked() bool {
+	return b.locked
+}
+
+// Wipe zeroes the buffer and unlocks it. The memory stays mapped, so
+// that a goroutine still holding a key at shutdown reads zeros rather
+// than faulting. Wiping twice is harmless.
+func (b *Buffer) Wipe() {
+	if b == nil || b.wiped {
+		return
+	}
+	Wipe(b.b)
+	if b.locked {
+		unlock(b.b)
+		b.locked = false
+	}
+	b.wiped = true
+}
+
+// Wipe zeroes b.
+func Wipe(b []byte) {
+	clear(b)
+	runtime.KeepAlive(b)
+}
@@ -0,0 +1,8 @@
+package secmem
+
+import "golang.org/x/sys/unix"
+
+// dontDump keeps b out of core dumps.
+func dontDump(b []byte) {
+	_ = unix.Madvise(b, unix.MADV_DONTDUMP)
+}
@@ -0,0 +1,6 @@
+//go:build unix && !linux
+
+package secmem
+
+// dontDump does nothing: only Linux can keep memory out of core dumps.
+func dontDump([]byte) {}
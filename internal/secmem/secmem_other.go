@@ -0,0 +1,18 @@
+//go:build !unix
+
+package secmem
+
+import "fmt"
+
+// Lockable reports whether buffers can be locked in memory here.
+const Lockable = false
+
+// alloc returns ordinary memory: without mmap, it cannot be locked.
+func alloc(size int) ([]byte, bool, error) {
+	if size <= 0 {
+		return nil, false, fmt.Errorf("secmem: size %d", size)
+	}
+	return make([]byte, size), false, nil
+}
+
+func unlock([]byte) {}
@@ -0,0 +1,33 @@
+package secmem
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCopyWipe(t *testing.T) {
+	secret := []byte("a secret of 32 bytes, or nearly")
+	want := bytes.Clone(secret)
+	buf, err := Copy(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("Copy holds %q", buf.Bytes())
+	}
+	if !bytes.Equal(secret, make([]byte, len(secret))) {
+		t.Fatal("Copy left the original")
+	}
+	if Lockable && !buf.Locked() {
+		t.Log("buffer not locked: RLIMIT_MEMLOCK too low here?")
+	}
+
+	buf.Wipe()
+	buf.Wipe()
+	if !bytes.Equal(buf.Bytes(), make([]byte, len(want))) || buf.Locked() {
+		t.Fatal("Wipe left the secret, or the lock")
+	}
+	if _, err := New(0); err == nil {
+		t.Fatal("empty buffer allocated")
+	}
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package secmem
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Lockable reports whether buffers can be locked in memory here.
+const Lockable = true
+
+// alloc maps size bytes of anonymous memory and locks them.
+func alloc(size int) ([]byte, bool, error) {
+	if size <= 0 {
+		return nil, false, fmt.Errorf("secmem: size %d", size)
+	}
+	b, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, false, fmt.Errorf("secmem: %w", err)
+	}
+	dontDump(b)
+	return b, unix.Mlock(b) == nil, nil
+}
+
+func unlock(b []byte) {
+	_ = unix.Munlock(b)
+}
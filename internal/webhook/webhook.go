@@ -0,0 +1,261 @@
+// Package webhook delivers received messages to an external HTTPS endpoint.
+//
+// Each event is POSTed as JSON. The body is authenticated with
+// HMAC-SHA256 over "timestamp.body" using a shared secret; the receiver
+// checks the X-Tmd-Signature and X-Tmd-Timestamp headers (see Verify).
+// Deliveries are queued and sent in the background, retrying with
+// exponential backoff on network errors, 429 and 5xx responses.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Header names set on every delivery.
+const (
+	HeaderSignature = "X-Tmd-Signature"
+	HeaderTimestamp = "X-Tmd-Timestamp"
+	HeaderEvent     = "X-Tmd-Event"
+)
+
+// Defaults used when the corresponding Config field is zero.
+const (
+	DefaultMaxAttempts = 5
+	DefaultBackoff     = 500 * time.Millisecond
+	DefaultTimeout     = 10 * time.Second
+	queueSize          = 256
+)
+
+// Config describes the endpoint and delivery policy.
+type Config struct {
+	URL         string
+	Secret      []byte
+	MaxAttempts int           // total attempts per event
+	Backoff     time.Duration // delay before the first retry, doubled each time
+	Client      *http.Client  // optional, e.g. for custom TLS roots
+
+	// OnError is called when an event is dropped after all attempts.
+	OnError func(ev Event, err error)
+}
+
+// Event is the JSON document POSTed for each received message.
+type Event struct {
+	Kind      string    `json:"kind"` // "direct" or "broadcast"
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Sender queues events and delivers them in the background. A nil Sender
+// accepts and drops every event, so callers need no nil checks.
+type Sender struct {
+	cfg    Config
+	client *http.Client
+	queue  chan Event
+
+	mu     sync.Mutex // guards closed and sends on queue
+	closed bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New validates cfg and starts the delivery worker. The endpoint must use
+// https, except for loopback hosts which may use plain http for local
+// testing.
+func New(cfg Config) (*Sender, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: parse url: %w", err)
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !isLoopback(u.Hostname()) {
+			return nil, fmt.Errorf("webhook: %s must use https", cfg.URL)
+		}
+	default:
+		return nil, fmt.Errorf("webhook: unsupported scheme %q", u.Scheme)
+	}
+	if len(cfg.Secret) == 0 {
+		return nil, errors.New("webhook: secret is required")
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = DefaultMaxAttempts
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = DefaultBackoff
+	}
+
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Sender{
+		cfg:    cfg,
+		client: client,
+		queue:  make(chan Event, queueSize),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Deliver queues ev for delivery without blocking. If the queue is full,
+// or the Sender is closed, the event is dropped and reported through
+// OnError.
+func (s *Sender) Deliver(ev Event) {
+	if s == nil {
+		return
+	}
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now().UTC()
+	}
+	s.mu.Lock()
+	var err error
+	if s.closed {
+		err = errors.New("webhook: sender closed")
+	} else {
+		select {
+		case s.queue <- ev:
+		default:
+			err = errors.New("webhook: queue full")
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		s.fail(ev, err)
+	}
+}
+
+// Close stops accepting events and waits until every queued event has
+// been delivered or has exhausted its attempts. Later calls do nothing.
+func (s *Sender) Close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+	s.wg.Wait()
+	s.cancel()
+}
+
+func (s *Sender) run() {
+	defer s.wg.Done()
+	for ev := range s.queue {
+		if err := s.deliverWithRetry(ev); err != nil {
+			s.fail(ev, err)
+		}
+	}
+}
+
+func (s *Sender) fail(ev Event, err error) {
+	if s.cfg.OnError != nil {
+		s.cfg.OnError(ev, err)
+	}
+}
+
+func (s *Sender) deliverWithRetry(ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("webhook: encode event: %w", err)
+	}
+
+	backoff := s.cfg.Backoff
+	var lastErr error
+	for attempt := 1; attempt <= s.cfg.MaxAttempts; attempt++ {
+		retry, err := s.post(ev.Kind, body)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry || attempt == s.cfg.MaxAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-s.ctx.Done():
+			return lastErr
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("webhook: giving up after %d attempts: %w", s.cfg.MaxAttempts, lastErr)
+}
+
+// post sends one attempt and reports whether a failure is worth retrying.
+func (s *Sender) post(kind string, body []byte) (bool, error) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, kind)
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderSignature, Sign(s.cfg.Secret, ts, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+}
+
+// Sign returns the X-Tmd-Signature value for a body sent at timestamp ts.
+func Sign(secret []byte, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a delivery's signature headers against body. Receivers
+// should additionally reject timestamps too far from their own clock.
+func Verify(secret []byte, ts, signature string, body []byte) bool {
+	return hmac.Equal([]byte(Sign(secret, ts, body)), []byte(signature))
+}
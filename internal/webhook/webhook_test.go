@@ -0,0 +1,145 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewValidatesURL(t *testing.T) {
+	secret := []byte("s3cret")
+	for _, bad := range []string{"http://example.org/hook", "ftp://example.org", "://bad"} {
+		if _, err := New(Config{URL: bad, Secret: secret}); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+	if _, err := New(Config{URL: "https://example.org/hook"}); err == nil {
+		t.Fatal("expected error without secret")
+	}
+
+	s, err := New(Config{URL: "http://127.0.0.1:1/hook", Secret: secret})
+	if err != nil {
+		t.Fatalf("loopback http should be allowed: %v", err)
+	}
+	s.Close()
+}
+
+func TestDeliverSigned(t *testing.T) {
+	secret := []byte("s3cret")
+	got := make(chan Event, 1)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !Verify(secret, r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderSignature), body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		var ev Event
+		if err := json.Unmarshal(body, &ev); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got <- ev
+	}))
+	defer srv.Close()
+
+	s, err := New(Config{URL: srv.URL, Secret: secret, Client: srv.Client()})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	s.Deliver(Event{Kind: "direct", From: "alice", To: "bob", Message: "hi"})
+
+	select {
+	case ev := <-got:
+		if ev.From != "alice" || ev.Message != "hi" || ev.Timestamp.IsZero() {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+}
+
+func TestRetryOnServerError(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := New(Config{URL: srv.URL, Secret: []byte("k"), Client: srv.Client(), Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	s.Deliver(Event{Kind: "direct", From: "alice", Message: "retry me"})
+	s.Close()
+
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var failed []Event
+	s, err := New(Config{
+		URL: srv.URL, Secret: []byte("k"), Client: srv.Client(), Backoff: time.Millisecond,
+		OnError: func(ev Event, err error) {
+			mu.Lock()
+			failed = append(failed, ev)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	s.Deliver(Event{Kind: "broadcast", From: "carol", Message: "nope"})
+	s.Close()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("expected 1 attempt, got %d", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(failed) != 1 || failed[0].From != "carol" {
+		t.Fatalf("expected failure callback, got %+v", failed)
+	}
+}
+
+func TestDeliverAfterClose(t *testing.T) {
+	var failed atomic.Int32
+	s, err := New(Config{
+		URL: "http://127.0.0.1:1/hook", Secret: []byte("k"),
+		OnError: func(Event, error) { failed.Add(1) },
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	s.Close()
+	s.Deliver(Event{Kind: "direct", From: "alice", Message: "late"})
+	s.Close()
+	if n := failed.Load(); n != 1 {
+		t.Fatalf("expected the late event to be reported, got %d failures", n)
+	}
+}
+
+func TestNilSender(t *testing.T) {
+	var s *Sender
+	s.Deliver(Event{Kind: "direct"})
+	s.Close()
+}
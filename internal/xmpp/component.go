@@ -0,0 +1,287 @@
+// Package xmpp implements an XMPP external component (XEP-0114) that
+// exposes tmd peers as JIDs.
+//
+// The component connects to an XMPP server under its own domain (for
+// example tmd.example.org). A message from an allowed XMPP user to
+// bob@tmd.example.org is handed to tmd and sealed to bob; messages that
+// tmd receives from alice are delivered to the allowed users as coming
+// from alice@tmd.example.org. All HPKE sealing happens on the tmd side;
+// the XMPP leg is only protected by the server's own transport security.
+package xmpp
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	nsComponent = "jabber:component:accept"
+	nsStream    = "http://etherx.jabber.org/streams"
+)
+
+// Config describes the component connection.
+type Config struct {
+	Server string   `json:"server"` // XMPP server component port, e.g. localhost:5347
+	Domain string   `json:"domain"` // component domain, e.g. tmd.example.org
+	Secret string   `json:"secret"` // shared component secret
+	Users  []string `json:"users"`  // bare JIDs allowed to talk through the gateway
+}
+
+// LoadConfig reads a JSON component config.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read xmpp config: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse xmpp config: %w", err)
+	}
+	if cfg.Server == "" || cfg.Domain == "" || cfg.Secret == "" || len(cfg.Users) == 0 {
+		return nil, errors.New("xmpp config: server, domain, secret and users are required")
+	}
+	return &cfg, nil
+}
+
+// Sender delivers XMPP-originated messages into tmd.
+type Sender interface {
+	Send(to, message string) (reply string, err error)
+}
+
+// Message is a chat message stanza.
+type Message struct {
+	XMLName xml.Name `xml:"message"`
+	From    string   `xml:"from,attr,omitempty"`
+	To      string   `xml:"to,attr"`
+	Type    string   `xml:"type,attr,omitempty"`
+	ID      string   `xml:"id,attr,omitempty"`
+	Body    string   `xml:"body,omitempty"`
+	Error   *Error   `xml:"error,omitempty"`
+}
+
+// Error is a stanza error.
+type Error struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:"text"`
+}
+
+// Component is a connected, authenticated XMPP component session.
+type Component struct {
+	cfg    Config
+	sender Sender
+	logf   func(format string, args ...any)
+
+	conn net.Conn
+	dec  *xml.Decoder
+
+	writeMu sync.Mutex
+	allowed map[string]bool
+}
+
+// Dial connects to the server and performs the component handshake.
+func Dial(ctx context.Context, cfg Config, sender Sender, logf func(format string, args ...any)) (*Component, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", cfg.Server)
+	if err != nil {
+		return nil, fmt.Errorf("xmpp: dial %s: %w", cfg.Server, err)
+	}
+	c, err := NewComponent(conn, cfg, sender, logf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewComponent performs the component handshake over an established
+// connection.
+func NewComponent(conn net.Conn, cfg Config, sender Sender, logf func(format string, args ...any)) (*Component, error) {
+	if logf == nil {
+		logf = func(string, ...any) {}
+	}
+	c := &Component{
+		cfg:     cfg,
+		sender:  sender,
+		logf:    logf,
+		conn:    conn,
+		dec:     xml.NewDecoder(conn),
+		allowed: make(map[string]bool, len(cfg.Users)),
+	}
+	for _, u := range cfg.Users {
+		c.allowed[bareJID(u)] = true
+	}
+
+	if err := c.handshake(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Component) handshake() error {
+	header := fmt.Sprintf("<?xml version='1.0'?><stream:stream xmlns='%s' xmlns:stream='%s' to='%s'>",
+		nsComponent, nsStream, xmlEscape(c.cfg.Domain))
+	if err := c.writeRaw(header); err != nil {
+		return fmt.Errorf("xmpp: open stream: %w", err)
+	}
+
+	// Server stream header carries the stream id used in the digest.
+	var streamID string
+	for streamID == "" {
+		tok, err := c.dec.Token()
+		if err != nil {
+			return fmt.Errorf("xmpp: read stream header: %w", err)
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "stream" {
+			for _, a := range se.Attr {
+				if a.Name.Local == "id" {
+					streamID = a.Value
+				}
+			}
+			if streamID == "" {
+				return errors.New("xmpp: stream header without id")
+			}
+		}
+	}
+
+	if err := c.writeRaw("<handshake>" + HandshakeDigest(streamID, c.cfg.Secret) + "</handshake>"); err != nil {
+		return fmt.Errorf("xmpp: send handshake: %w", err)
+	}
+
+	se, err := c.nextElement()
+	if err != nil {
+		return fmt.Errorf("xmpp: read handshake reply: %w", err)
+	}
+	if se.Name.Local != "handshake" {
+		return fmt.Errorf("xmpp: handshake rejected (%s)", se.Name.Local)
+	}
+	return c.dec.Skip()
+}
+
+// HandshakeDigest is the XEP-0114 credential: hex(SHA1(streamID || secret)).
+func HandshakeDigest(streamID, secret string) string {
+	sum := sha1.Sum([]byte(streamID + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Component) nextElement() (xml.StartElement, error) {
+	for {
+		tok, err := c.dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			return t, nil
+		case xml.EndElement:
+			if t.Name.Local == "stream" {
+				return xml.StartElement{}, io.EOF
+			}
+		}
+	}
+}
+
+// Serve reads stanzas until the stream ends, relaying messages addressed
+// to <nickname>@domain into tmd.
+func (c *Component) Serve() error {
+	for {
+		se, err := c.nextElement()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if se.Name.Local != "message" {
+			if err := c.dec.Skip(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var m Message
+		if err := c.dec.DecodeElement(&m, &se); err != nil {
+			return err
+		}
+		c.handleMessage(m)
+	}
+}
+
+func (c *Component) handleMessage(m Message) {
+	if m.Body == "" || m.Type == "error" {
+		return
+	}
+	nickname, domain, _ := strings.Cut(bareJID(m.To), "@")
+	if domain != c.cfg.Domain || nickname == "" {
+		return
+	}
+	if !c.allowed[bareJID(m.From)] {
+		c.bounce(m, "auth", "not allowed to use this gateway")
+		return
+	}
+
+	go func() {
+		if _, err := c.sender.Send(nickname, m.Body); err != nil {
+			c.logf("[xmpp] relay from %s to %s failed: %v", m.From, nickname, err)
+			c.bounce(m, "cancel", err.Error())
+		}
+	}()
+}
+
+func (c *Component) bounce(m Message, typ, text string) {
+	_ = c.send(Message{From: m.To, To: m.From, Type: "error", ID: m.ID, Error: &Error{Type: typ, Text: text}})
+}
+
+// Relay delivers a message received from a tmd peer to every allowed user,
+// from <nickname>@domain.
+func (c *Component) Relay(nickname, body string) error {
+	from := strings.ToLower(nickname) + "@" + c.cfg.Domain
+	var firstErr error
+	for _, u := range c.cfg.Users {
+		if err := c.send(Message{From: from, To: u, Type: "chat", Body: body}); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (c *Component) send(m Message) error {
+	data, err := xml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return c.writeRaw(string(data))
+}
+
+func (c *Component) writeRaw(s string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := io.WriteString(c.conn, s)
+	return err
+}
+
+// Close ends the stream and closes the connection.
+func (c *Component) Close() error {
+	_ = c.writeRaw("</stream:stream>")
+	return c.conn.Close()
+}
+
+func bareJID(jid string) string {
+	bare, _, _ := strings.Cut(jid, "/")
+	return strings.ToLower(bare)
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
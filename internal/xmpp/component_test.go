@@ -0,0 +1,135 @@
+package xmpp
+
+import (
+	"bufio"
+	"encoding/xml"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeSender struct {
+	got chan string
+}
+
+func (f *fakeSender) Send(to, message string) (string, error) {
+	f.got <- to + ": " + message
+	return "message received", nil
+}
+
+// fakeServer plays the XMPP server side of the component protocol.
+func fakeServer(t *testing.T, conn net.Conn, secret string) *bufio.Reader {
+	t.Helper()
+	r := bufio.NewReader(conn)
+
+	header, err := r.ReadString('>') // <?xml ...?>
+	if err != nil {
+		t.Fatalf("read xml decl: %v", err)
+	}
+	if !strings.HasPrefix(header, "<?xml") {
+		t.Fatalf("unexpected start %q", header)
+	}
+	stream, _ := r.ReadString('>')
+	if !strings.Contains(stream, "jabber:component:accept") || !strings.Contains(stream, "to='tmd.example.org'") {
+		t.Fatalf("bad stream header %q", stream)
+	}
+	io.WriteString(conn, "<?xml version='1.0'?><stream:stream xmlns:stream='http://etherx.jabber.org/streams' xmlns='jabber:component:accept' from='tmd.example.org' id='abc123'>")
+
+	hs, _ := r.ReadString('>')
+	digest, _ := r.ReadString('>')
+	if hs != "<handshake>" || !strings.HasPrefix(digest, HandshakeDigest("abc123", secret)) {
+		t.Fatalf("bad handshake %q %q", hs, digest)
+	}
+	io.WriteString(conn, "<handshake/>")
+	return r
+}
+
+func testConfig() Config {
+	return Config{Domain: "tmd.example.org", Secret: "s3cret", Users: []string{"dave@example.org"}}
+}
+
+func TestComponentRoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	f := &fakeSender{got: make(chan string, 1)}
+	type result struct {
+		c   *Component
+		err error
+	}
+	ready := make(chan result, 1)
+	go func() {
+		c, err := NewComponent(client, testConfig(), f, nil)
+		ready <- result{c, err}
+	}()
+
+	r := fakeServer(t, server, "s3cret")
+	res := <-ready
+	if res.err != nil {
+		t.Fatalf("handshake: %v", res.err)
+	}
+	comp := res.c
+	go comp.Serve()
+
+	// XMPP user -> tmd peer.
+	io.WriteString(server, `<message from='dave@example.org/phone' to='bob@tmd.example.org' type='chat'><body>hi &amp; bye</body></message>`)
+	select {
+	case got := <-f.got:
+		if got != "bob: hi & bye" {
+			t.Fatalf("unexpected relay %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not relayed to tmd")
+	}
+
+	// tmd peer -> XMPP user.
+	go comp.Relay("Alice", "hello <xmpp>")
+	dec := xml.NewDecoder(r)
+	var m Message
+	if err := dec.Decode(&m); err != nil {
+		t.Fatalf("decode relayed message: %v", err)
+	}
+	if m.From != "alice@tmd.example.org" || m.To != "dave@example.org" || m.Body != "hello <xmpp>" {
+		t.Fatalf("unexpected stanza %+v", m)
+	}
+}
+
+func TestComponentRejectsUnknownUser(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	f := &fakeSender{got: make(chan string, 1)}
+	ready := make(chan *Component, 1)
+	go func() {
+		c, _ := NewComponent(client, testConfig(), f, nil)
+		ready <- c
+	}()
+	r := fakeServer(t, server, "s3cret")
+	comp := <-ready
+	go comp.Serve()
+
+	io.WriteString(server, `<message from='mallory@evil.org' to='bob@tmd.example.org' type='chat' id='m1'><body>let me in</body></message>`)
+
+	var m Message
+	if err := xml.NewDecoder(r).Decode(&m); err != nil {
+		t.Fatalf("decode bounce: %v", err)
+	}
+	if m.Type != "error" || m.To != "mallory@evil.org" || m.ID != "m1" || m.Error == nil {
+		t.Fatalf("expected error bounce, got %+v", m)
+	}
+	select {
+	case got := <-f.got:
+		t.Fatalf("message from unknown user relayed: %q", got)
+	default:
+	}
+}
+
+func TestHandshakeDigest(t *testing.T) {
+	if got := HandshakeDigest("3BF96D32", "secret"); got != "b09ea9b3b7f586be8a08d0a3dd7466f110aeb136" {
+		t.Fatalf("unexpected digest %q", got)
+	}
+}
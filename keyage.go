@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+// The seed file notes when the HPKE key was made or last rotated, and
+// when it expires, if it does. The client warns once at start and then
+// daily when the key is older than --key-max-age, or expires within
+// keyExpiryNotice. `tmd identity rotate` moves the seed file to the next
+// generation of HPKE key (see identity.DeriveKeysGen), which the client
+// announces on its next start: it registers with the nodes and signs its
+// Hellos with the new key, signed by the same identity key (see
+// keysig.go). Peers that pinned the old key follow the new one, since
+// the identity key they pinned signed it (see pins.go); the Ed25519 key
+// and the peer ID stay. The mnemonic and passphrase backups restore the
+// first generation.
+const (
+	// defaultKeyMaxAge is --key-max-age's default, in days.
+	defaultKeyMaxAge = 365
+	// keyExpiryNotice is how long before the keys expire the client
+	// starts warning.
+	keyExpiryNotice = 14 * 24 * time.Hour
+	// keyReminderInterval is how often a running client checks again.
+	keyReminderInterval = 24 * time.Hour
+)
+
+// keyAge is what the seed file says of the age of our HPKE key.
+type keyAge struct {
+	Since   time.Time     // when the key was made or rotated; zero if unknown
+	Expires time.Time     // zero if the key does not expire
+	MaxAge  time.Duration // warn past this age; 0 never
+	Rotate  string        // the command rotating the key, for the warning
+}
+
+// reminder returns the warning due at now, "" if none.
+func (a keyAge) reminder(now time.Time) string {
+	hint := fmt.Sprintf("rotate it with '%s' and restart", a.Rotate)
+	switch {
+	case !a.Expires.IsZero() && !now.Before(a.Expires):
+		return fmt.Sprintf("your HPKE key expired on %s: %s", a.Expires.Local().Format(time.DateOnly), hint)
+	case !a.Expires.IsZero() && a.Expires.Sub(now) <= keyExpiryNotice:
+		return fmt.Sprintf("your HPKE key expires on %s (in %s): %s", a.Expires.Local().Format(time.DateOnly), days(a.Expires.Sub(now)), hint)
+	case a.MaxAge > 0 && !a.Since.IsZero() && now.Sub(a.Since) > a.MaxAge:
+		return fmt.Sprintf("your HPKE key is %s old, over --key-max-age %s: %s", days(now.Sub(a.Since)), days(a.MaxAge), hint)
+	}
+	return ""
+}
+
+// days formats d in whole days, rounded up.
+func days(d time.Duration) string {
+	n := int((d + 24*time.Hour - 1) / (24 * time.Hour))
+	if n == 1 {
+		return "1 day"
+	}
+	return fmt.Sprintf("%d days", n)
+}
+
+// startKeyReminders shows the reminder for a now and every interval,
+// until the returned function is called.
+func (p *connPool) startKeyReminders(a keyAge, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	remind := func() {
+		if msg := a.reminder(time.Now()); msg != "" {
+			p.console.Errorf("%s", msg)
+		}
+	}
+	remind()
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				remind()
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// runIdentityRotate moves a seed file to the next generation of HPKE key.
+func runIdentityRotate(args []string) error {
+	fs := flag.NewFlagSet("identity rotate", flag.ExitOnError)
+	var seedSel seedFlags
+	addSeedFlags(fs, &seedSel, "path to seed file, or keyring:<name> for an OS keyring entry (required, or --identity)")
+	expires := fs.Int("expires", 0, "days the new key is good for, after which the client warns at start (0: no expiry)")
+	fs.Parse(args)
+
+	if !seedSel.set() {
+		return fmt.Errorf("--seed (or --identity) is required")
+	}
+	if *expires < 0 {
+		return fmt.Errorf("--expires must not be negative")
+	}
+	seedPath, err := seedSel.path(false)
+	if err != nil {
+		return err
+	}
+	f, err := identity.LoadSeedFile(seedPath)
+	if err != nil {
+		return err
+	}
+	if f.Derivation != identity.DerivationHKDF {
+		return fmt.Errorf("%s uses the old key derivation; see 'tmd keygen --upgrade'", seedPath)
+	}
+	old, err := f.DeriveKeys()
+	if err != nil {
+		return fmt.Errorf("derive keys: %w", err)
+	}
+	f.HPKEGen++
+	f.Rotated = time.Now().UTC().Truncate(time.Second)
+	f.Expires = time.Time{}
+	if *expires > 0 {
+		f.Expires = f.Rotated.AddDate(0, 0, *expires)
+	}
+	keys, err := f.DeriveKeys()
+	if err != nil {
+		return fmt.Errorf("derive keys: %w", err)
+	}
+	if err := identity.SaveSeedFile(seedPath, f); err != nil {
+		return fmt.Errorf("save seed: %w", err)
+	}
+
+	fmt.Printf("HPKE key rotated in %s (generation %d)\n", seedPath, f.HPKEGen)
+	fmt.Printf("PeerID: %s (unchanged)\n", keys.PeerID)
+	fmt.Printf("HPKE KeyID: %x (was %x)\n", keys.KeyID, old.KeyID)
+	if !f.Expires.IsZero() {
+		fmt.Printf("Expires: %s\n", f.Expires.Format(time.DateOnly))
+	}
+	fmt.Println("Restart the client to announce the new key; peers that pinned the old one follow it.")
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/identity"
+	"github.com/pivaldi/tmd/internal/pins"
+)
+
+func TestKeyAgeReminder(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	a := keyAge{Since: now.AddDate(0, 0, -100), MaxAge: 365 * 24 * time.Hour, Rotate: "tmd identity rotate --seed a.key"}
+	if msg := a.reminder(now); msg != "" {
+		t.Fatalf("young key: %q", msg)
+	}
+	a.Since = now.AddDate(0, 0, -400)
+	if msg := a.reminder(now); !strings.Contains(msg, "400 days old") || !strings.Contains(msg, a.Rotate) {
+		t.Fatalf("old key: %q", msg)
+	}
+	a.MaxAge = 0
+	if msg := a.reminder(now); msg != "" {
+		t.Fatalf("--key-max-age 0 warned: %q", msg)
+	}
+
+	a.Expires = now.AddDate(0, 0, 30)
+	if msg := a.reminder(now); msg != "" {
+		t.Fatalf("expiry a month away: %q", msg)
+	}
+	a.Expires = now.AddDate(0, 0, 3)
+	if msg := a.reminder(now); !strings.Contains(msg, "expires on") || !strings.Contains(msg, "in 3 days") {
+		t.Fatalf("expiry in 3 days: %q", msg)
+	}
+	a.Expires = now.Add(-time.Hour)
+	if msg := a.reminder(now); !strings.Contains(msg, "expired on") {
+		t.Fatalf("expired key: %q", msg)
+	}
+}
+
+func TestIdentityRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alice.key")
+	seed, _ := identity.GenerateSeed()
+	created := time.Now().UTC().AddDate(-2, 0, 0).Truncate(time.Second)
+	if err := identity.SaveSeedFile(path, &identity.SeedFile{Seed: seed, Derivation: identity.DerivationHKDF, Created: created, Nickname: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := identity.DeriveKeys(seed)
+
+	if err := runIdentityRotate([]string{"--seed", path, "--expires", "90"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := identity.LoadSeedFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.HPKEGen != 1 || !f.Created.Equal(created) || f.Nickname != "alice" || f.Rotated.IsZero() || !f.Expires.Equal(f.Rotated.AddDate(0, 0, 90)) {
+		t.Fatalf("rotated seed file: %+v", f)
+	}
+	after, err := f.DeriveKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.PeerID != before.PeerID || bytes.Equal(after.HPKEPubBytes, before.HPKEPubBytes) {
+		t.Fatal("rotation did not keep the peer ID and replace the HPKE key")
+	}
+	if msg := (keyAge{Since: f.KeysSince(), Expires: f.Expires, MaxAge: 365 * 24 * time.Hour}).reminder(time.Now()); msg != "" {
+		t.Fatalf("freshly rotated key: %q", msg)
+	}
+
+	// A peer that pinned the old key follows the new one, signed by the
+	// pinned identity key, but not a new key under another identity key.
+	p := newTestPool("bob")
+	p.setConsole(newHeadlessConsole())
+	store, err := pins.OpenStore(filepath.Join(t.TempDir(), "pins.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setPinStore(store)
+	_, _, _ = store.Observe("alice", before.Ed25519Pub, before.HPKEPubBytes)
+	other, _ := identity.DeriveKeysGen(seed, identity.DerivationHKDF, 2)
+	p.followRotation("alice", []byte("another identity key, 32 bytes!"), other.HPKEPubBytes, "its Hello")
+	if status, _ := store.Check("alice", before.Ed25519Pub, before.HPKEPubBytes); status != pins.Match {
+		t.Fatal("the pin followed a key under another identity key")
+	}
+	p.followRotation("alice", after.Ed25519Pub, after.HPKEPubBytes, "its Hello")
+	if status, _ := store.Check("alice", after.Ed25519Pub, after.HPKEPubBytes); status != pins.Match {
+		t.Fatal("the pin did not follow the rotated key")
+	}
+}
@@ -1,35 +1,100 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 
+	"github.com/pivaldi/tmd/internal/contact"
 	"github.com/pivaldi/tmd/internal/identity"
 )
 
 func runKeygen(args []string) error {
 	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
-	outPath := fs.String("out", "", "output path for seed file (required)")
+	var out seedFlags
+	fs.StringVar(&out.seed, "out", "", "output path for seed file, or keyring:<name> to store it in the OS keyring (required, or --identity)")
+	fs.StringVar(&out.identity, "identity", "", "name of the identity to create in the keystore, instead of --out")
+	fs.StringVar(&out.keystore, "keystore", "", keystoreUsage)
+	words := fs.Bool("words", false, "also print the seed as a 24-word BIP39 mnemonic, for a paper backup")
+	showQR := fs.Bool("qr", false, "also print the public identity as a contact QR code, for peers to scan and pin")
+	fromMnemonic := fs.Bool("from-mnemonic", false, "restore the seed from its 24-word mnemonic, read from stdin")
+	fromPassphrase := fs.Bool("from-passphrase", false, "derive the seed from a passphrase and the nickname, read from $"+seedPassphraseEnv+" or stdin")
+	upgrade := fs.String("upgrade", "", "seed file using the old key derivation or file format, to write with the current ones")
+	nick := fs.String("nick", "", "nickname to note in the seed file, used when the client is run without --nick (default: the --identity name)")
 	fs.Parse(args)
 
-	if *outPath == "" {
-		return fmt.Errorf("--out is required")
+	if !out.set() {
+		return fmt.Errorf("--out or --identity is required")
+	}
+	sources := 0
+	for _, set := range []bool{*upgrade != "", *fromMnemonic, *fromPassphrase} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("--upgrade, --from-mnemonic and --from-passphrase each give the seed: use one")
+	}
+	outPath, err := out.path(true)
+	if err != nil {
+		return err
 	}
 
-	// Check if file exists
-	if _, err := os.Stat(*outPath); err == nil {
-		return fmt.Errorf("file already exists: %s", *outPath)
+	// Check if the file or keyring entry exists
+	if exists, err := identity.SeedExists(outPath); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("seed already exists: %s", outPath)
 	}
 
-	// Generate seed
-	seed, err := identity.GenerateSeed()
-	if err != nil {
+	// An identity of the keystore is named for its nickname unless told,
+	// or the file upgraded notes another
+	givenNick := *nick != ""
+	if *nick == "" {
+		*nick = out.identity
+	}
+
+	if *showQR && *nick == "" {
+		return fmt.Errorf("--qr needs --nick (or --identity): the contact card names you")
+	}
+
+	// Generate seed, restore it from its words or passphrase, or take an
+	// old one
+	var seed []byte
+	if *upgrade != "" {
+		var old *identity.SeedFile
+		if old, err = upgradeSeed(*upgrade); err != nil {
+			return err
+		}
+		seed = old.Seed
+		if !givenNick && old.Nickname != "" {
+			*nick = old.Nickname
+		}
+	} else if *fromPassphrase {
+		if *nick == "" {
+			return fmt.Errorf("--from-passphrase needs --nick (or --identity): the seed depends on it")
+		}
+		passphrase, err := readPassphrase(os.Stdin, seedPassphraseEnv, "Seed passphrase: ", true)
+		if err != nil {
+			return err
+		}
+		if seed, err = identity.SeedFromPassphrase(passphrase, *nick); err != nil {
+			return err
+		}
+	} else if *fromMnemonic {
+		fmt.Fprintf(os.Stderr, "Enter the %d words:\n", identity.MnemonicWords)
+		if seed, err = readMnemonic(os.Stdin); err != nil {
+			return fmt.Errorf("restore seed: %w", err)
+		}
+	} else if seed, err = identity.GenerateSeed(); err != nil {
 		return fmt.Errorf("generate seed: %w", err)
 	}
 
 	// Save seed
-	if err := identity.SaveSeed(*outPath, seed); err != nil {
+	if err := identity.SaveSeedFile(outPath, &identity.SeedFile{Seed: seed, Derivation: identity.DerivationHKDF, Nickname: *nick}); err != nil {
 		return fmt.Errorf("save seed: %w", err)
 	}
 
@@ -39,9 +104,80 @@ func runKeygen(args []string) error {
 		return fmt.Errorf("derive keys: %w", err)
 	}
 
-	fmt.Printf("Seed written to %s\n", *outPath)
+	fmt.Printf("Seed written to %s\n", outPath)
 	fmt.Printf("PeerID: %s\n", keys.PeerID)
 	fmt.Printf("HPKE KeyID: %x\n", keys.KeyID)
 
+	if *showQR {
+		card, err := selfCard(*nick, keys.PeerID, keys.HPKEPubBytes, nil, keys.Ed25519Priv)
+		if err != nil {
+			return err
+		}
+		fmt.Println()
+		if err := contact.Render(os.Stdout, card.Encode()); err != nil {
+			return err
+		}
+		printCard(card)
+		fmt.Printf("\n%s\n", card.Encode())
+	}
+
+	if *words {
+		mnemonic, err := identity.Mnemonic(seed)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\nWrite these words down and keep them offline; anyone who has them is you:\n\n")
+		list := strings.Fields(mnemonic)
+		for i := 0; i < len(list); i += 6 {
+			fmt.Printf("  %s\n", strings.Join(list[i:i+6], " "))
+		}
+		fmt.Printf("\nRestore with: tmd keygen --from-mnemonic --out <file>\n")
+	}
+	if *fromPassphrase {
+		fmt.Printf("The same passphrase and --nick %s give this identity again; anyone who guesses it is you.\n", *nick)
+	}
 	return nil
 }
+
+// seedPassphraseEnv holds the passphrase of `tmd keygen --from-passphrase`,
+// for scripts building test fleets; without it, it is read from stdin.
+const seedPassphraseEnv = "TMD_SEED_PASSPHRASE"
+
+// upgradeSeed loads a seed file to write in the current format. One using
+// DerivationDirect gets the current derivation too: it shows the keys the
+// file had, which the upgraded file no longer gives. One of an earlier
+// file format only keeps its keys.
+func upgradeSeed(path string) (*identity.SeedFile, error) {
+	f, err := identity.LoadSeedFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if f.Derivation != identity.DerivationDirect {
+		if f.Version == identity.SeedFileVersion {
+			return nil, fmt.Errorf("%s already uses the current key derivation and file format", path)
+		}
+		fmt.Printf("Rewriting %s in the current file format; its keys stay the same.\n\n", path)
+		return f, nil
+	}
+	old, err := identity.DeriveKeysWith(f.Seed, f.Derivation)
+	if err != nil {
+		return nil, fmt.Errorf("derive keys: %w", err)
+	}
+	fmt.Printf("Old PeerID: %s\n", old.PeerID)
+	fmt.Printf("Old HPKE KeyID: %x\n", old.KeyID)
+	fmt.Printf("Your peers will see new keys: share a new contact card and attestation.\n\n")
+	return f, nil
+}
+
+// readMnemonic reads words from r until it has a whole mnemonic or r ends.
+func readMnemonic(r io.Reader) ([]byte, error) {
+	var words []string
+	sc := bufio.NewScanner(r)
+	for len(words) < identity.MnemonicWords && sc.Scan() {
+		words = append(words, strings.Fields(sc.Text())...)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return identity.SeedFromMnemonic(strings.Join(words, " "))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+func TestKeygenFromPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(seedPassphraseEnv, "fleet passphrase for node seeds")
+
+	// The same passphrase and nickname give the same seed.
+	first, again := filepath.Join(dir, "a.key"), filepath.Join(dir, "b.key")
+	for _, out := range []string{first, again} {
+		if err := runKeygen([]string{"--from-passphrase", "--nick", "node1", "--out", out}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := identity.LoadSeedFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := identity.LoadSeedFile(again)
+	if err != nil || !bytes.Equal(a.Seed, b.Seed) || b.Nickname != "node1" {
+		t.Fatalf("recreated seed: %+v, %v; want the same seed for node1", b, err)
+	}
+
+	if err := runKeygen([]string{"--from-passphrase", "--out", filepath.Join(dir, "c.key")}); err == nil {
+		t.Fatal("--from-passphrase without a nickname accepted")
+	}
+	if err := runKeygen([]string{"--from-passphrase", "--from-mnemonic", "--nick", "node1", "--out", filepath.Join(dir, "d.key")}); err == nil {
+		t.Fatal("two seed sources accepted")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"fmt"
+	"sync"
+
+	"github.com/pivaldi/tmd/internal/node"
+)
+
+// Our HPKE key goes out signed with our Ed25519 identity key, in our node
+// registrations and in our Hellos (see node.KeySignInput). A peer announced
+// by a node with a signature that does not verify against its peer ID is
+// ignored: the node, or someone on the way, swapped its HPKE key. Nodes
+// refuse unsigned registrations, but peers predating key signatures send
+// none in their Hellos, and older nodes announce them unsigned, so a
+// missing signature is accepted until the peer has been seen signed: from
+// then on, for the run and in its pin, its keys must come signed, or a
+// node could strip the signature and swap in a key of its own.
+
+// signedPeers are the peers seen with a signed HPKE key this run.
+type signedPeers struct {
+	mu   sync.Mutex
+	seen map[PeerID]bool
+}
+
+// signOwnKey signs our HPKE key with selfSigner, once, before anything is
+// sent.
+func (p *connPool) signOwnKey() error {
+	sig, err := p.selfSigner.Sign(nil, node.KeySignInput(string(p.nickname), p.keyID, p.selfHPKEPubBytes), crypto.Hash(0))
+	if err != nil {
+		return fmt.Errorf("sign HPKE key: %w", err)
+	}
+	p.keySig = sig
+	return nil
+}
+
+// checkKeySig verifies the key signature of a peer announced by a node,
+// if it has one (see refuseUnsigned).
+func checkKeySig(info node.PeerInfo) error {
+	if len(info.KeySig) == 0 {
+		return nil
+	}
+	return node.VerifyKeySig(info.PeerID, info.Nickname, info.KeyID, info.HPKEPub, info.KeySig)
+}
+
+// checkHelloKeySig verifies the key signature of a Hello, if it has one
+// (see refuseUnsigned), with the key the Hello is signed with.
+func checkHelloKeySig(h Hello) error {
+	if len(h.KeySig) == 0 {
+		return nil
+	}
+	if !ed25519.Verify(ed25519.PublicKey(h.SenderEdPub), node.KeySignInput(string(h.SenderID), h.SenderKeyID, h.SenderHPKEPub), h.KeySig) {
+		return fmt.Errorf("HPKE key of %s is not signed by its identity key", h.SenderID)
+	}
+	return nil
+}
+
+// refuseUnsigned fails for keys presented for nickname without a
+// signature once the peer has been seen signing its key.
+func (p *connPool) refuseUnsigned(nickname PeerID, keySig []byte) error {
+	if len(keySig) > 0 {
+		return nil
+	}
+	p.signed.mu.Lock()
+	seen := p.signed.seen[nickname]
+	p.signed.mu.Unlock()
+	if p.pinned != nil {
+		if pin, ok := p.pinned.Get(string(nickname)); ok && !pin.Signed.IsZero() {
+			seen = true
+		}
+	}
+	if seen {
+		return fmt.Errorf("HPKE key of %s comes unsigned, but it was signed before", nickname)
+	}
+	return nil
+}
+
+// noteSigned records that nickname presented its keys with a signature
+// that verified, in its pin too once it is pinned.
+func (p *connPool) noteSigned(nickname PeerID, keySig []byte) {
+	if len(keySig) == 0 {
+		return
+	}
+	p.signed.mu.Lock()
+	if p.signed.seen == nil {
+		p.signed.seen = make(map[PeerID]bool)
+	}
+	p.signed.seen[nickname] = true
+	p.signed.mu.Unlock()
+	if _, err := p.pinned.MarkSigned(string(nickname)); err != nil {
+		p.console.Errorf("pins: %v", err)
+	}
+}
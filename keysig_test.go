@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/pivaldi/tmd/internal/identity"
+	"github.com/pivaldi/tmd/internal/keyid"
+	"github.com/pivaldi/tmd/internal/node"
+	"github.com/pivaldi/tmd/internal/pins"
+)
+
+func TestKeySig(t *testing.T) {
+	keys, err := identity.DeriveKeys(bytes.Repeat([]byte{7}, identity.SeedSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite := hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	p := newConnPool(nil, NewPeerTable(), suite, hpke.KEM_X25519_HKDF_SHA256.Scheme(), "bob", keys.KeyID, keys.Ed25519Priv, keys.HPKEPubBytes)
+	if err := p.signOwnKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	info := node.PeerInfo{Nickname: "bob", PeerID: keys.PeerID, HPKEPub: keys.HPKEPubBytes, KeyID: keys.KeyID, KeySig: p.keySig}
+	if err := checkKeySig(info); err != nil {
+		t.Fatalf("announced key rejected: %v", err)
+	}
+	hello := Hello{SenderID: "bob", SenderKeyID: keys.KeyID, SenderEdPub: keys.Ed25519Pub, SenderHPKEPub: keys.HPKEPubBytes, KeySig: p.keySig}
+	if err := checkHelloKeySig(hello); err != nil {
+		t.Fatalf("Hello key rejected: %v", err)
+	}
+
+	// A node handing out its own HPKE key for bob.
+	swapped := info
+	swapped.HPKEPub = bytes.Repeat([]byte{1}, len(keys.HPKEPubBytes))
+	if err := checkKeySig(swapped); err == nil {
+		t.Fatal("a substituted HPKE key verified")
+	}
+	swapped = info
+	swapped.Nickname = "mallory"
+	if err := checkKeySig(swapped); err == nil {
+		t.Fatal("a key signed for another nickname verified")
+	}
+	hello.SenderHPKEPub = bytes.Repeat([]byte{1}, len(keys.HPKEPubBytes))
+	if err := checkHelloKeySig(hello); err == nil {
+		t.Fatal("a Hello with a substituted HPKE key verified")
+	}
+
+	// Peers predating key signatures.
+	info.KeySig = nil
+	if err := checkKeySig(info); err != nil {
+		t.Fatalf("unsigned key rejected: %v", err)
+	}
+}
+
+// TestStrippedKeySig has a node strip bob's key signature and announce
+// its own HPKE key for him, after bob was seen signed.
+func TestStrippedKeySig(t *testing.T) {
+	bob, err := identity.DeriveKeys(bytes.Repeat([]byte{7}, identity.SeedSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite := hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	signer := newConnPool(nil, NewPeerTable(), suite, hpke.KEM_X25519_HKDF_SHA256.Scheme(), "bob", bob.KeyID, bob.Ed25519Priv, bob.HPKEPubBytes)
+	if err := signer.signOwnKey(); err != nil {
+		t.Fatal(err)
+	}
+	signed := node.PeerInfo{Nickname: "bob", PeerID: bob.PeerID, HPKEPub: bob.HPKEPubBytes, KeyID: bob.KeyID, KeySig: signer.keySig}
+	swapped := signed
+	swapped.KeySig = nil
+	swapped.HPKEPub = bytes.Repeat([]byte{1}, len(bob.HPKEPubBytes))
+	swapped.KeyID = keyid.Of(swapped.HPKEPub)
+
+	pinPath := filepath.Join(t.TempDir(), "pins.json")
+	alice := func() *peerHandler {
+		store, err := pins.OpenStore(pinPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := newConnPool(nil, NewPeerTable(), suite, hpke.KEM_X25519_HKDF_SHA256.Scheme(), "alice", nil, nil, nil)
+		p.setPinStore(store)
+		return &peerHandler{peerTable: p.peerTable, console: p.console, pool: p}
+	}
+
+	h := alice()
+	h.OnPeerJoined(signed, "")
+	h.OnPeerJoined(swapped, "")
+	if info, ok := h.peerTable.Get("bob"); !ok || !bytes.Equal(info.HPKEPub, bob.HPKEPubBytes) {
+		t.Fatalf("bob's key was swapped: %x", info.HPKEPub)
+	}
+
+	// The pin remembers that bob signs, after a restart too.
+	h = alice()
+	h.OnPeerJoined(swapped, "")
+	if _, ok := h.peerTable.Get("bob"); ok {
+		t.Fatal("an unsigned key was taken for a peer pinned as signed")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+// seedFlags name the seed of a command: a path with --seed, or an identity
+// of a keystore with --identity.
+type seedFlags struct {
+	seed     string
+	identity string
+	keystore string
+}
+
+// addSeedFlags adds --seed, --identity and --keystore to fs; seedUsage
+// describes --seed.
+func addSeedFlags(fs *flag.FlagSet, sf *seedFlags, seedUsage string) {
+	fs.StringVar(&sf.seed, "seed", "", seedUsage)
+	fs.StringVar(&sf.identity, "identity", "", "name of an identity in the keystore, instead of --seed")
+	fs.StringVar(&sf.keystore, "keystore", "", keystoreUsage)
+}
+
+const keystoreUsage = "keystore directory for --identity (default: tmd/identities in the user config directory)"
+
+// set reports whether a seed was named.
+func (sf *seedFlags) set() bool {
+	return sf.seed != "" || sf.identity != ""
+}
+
+// path returns the seed path named, "" if none. With create, the keystore
+// directory of an --identity is made, for writing the seed into.
+func (sf *seedFlags) path(create bool) (string, error) {
+	if sf.identity == "" {
+		return sf.seed, nil
+	}
+	if sf.seed != "" {
+		return "", fmt.Errorf("give a seed path or --identity, not both")
+	}
+	ks, err := openKeystore(sf.keystore)
+	if err != nil {
+		return "", err
+	}
+	if create {
+		if err := ks.Init(); err != nil {
+			return "", fmt.Errorf("keystore: %w", err)
+		}
+	}
+	return ks.Path(sf.identity)
+}
+
+// openKeystore returns the keystore in dir, or the default one.
+func openKeystore(dir string) (identity.Keystore, error) {
+	if dir == "" {
+		var err error
+		if dir, err = identity.DefaultKeystoreDir(); err != nil {
+			return identity.Keystore{}, err
+		}
+	}
+	return identity.Keystore{Dir: dir}, nil
+}
+
+// runIdentityList prints the identities of a keystore.
+func runIdentityList(args []string) error {
+	fs := flag.NewFlagSet("identity list", flag.ExitOnError)
+	dir := fs.String("keystore", "", keystoreUsage)
+	fs.Parse(args)
+
+	ks, err := openKeystore(*dir)
+	if err != nil {
+		return err
+	}
+	entries, err := ks.List()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Printf("No identities in %s (create one with 'tmd keygen --identity <name>')\n", ks.Dir)
+		return nil
+	}
+	for _, e := range entries {
+		if e.Err != nil {
+			fmt.Printf("%-16s  unreadable: %v\n", e.Name, e.Err)
+			continue
+		}
+		keys, err := e.File.DeriveKeys()
+		if err != nil {
+			fmt.Printf("%-16s  unreadable: %v\n", e.Name, err)
+			continue
+		}
+		line := fmt.Sprintf("%-16s  %s  keyID=%s", e.Name, keys.PeerID, keys.KeyID)
+		if e.File.Nickname != "" {
+			line += "  nick=" + e.File.Nickname
+		}
+		if !e.File.Created.IsZero() {
+			line += "  created=" + e.File.Created.Format("2006-01-02")
+		}
+		if !e.File.Rotated.IsZero() {
+			line += "  rotated=" + e.File.Rotated.Format("2006-01-02")
+		}
+		if !e.File.Expires.IsZero() {
+			line += "  expires=" + e.File.Expires.Format("2006-01-02")
+		}
+		if e.File.Derivation == identity.DerivationDirect {
+			line += "  (old key derivation: see 'tmd keygen --upgrade')"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+func TestKeystoreIdentities(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "identities")
+	if err := runKeygen([]string{"--identity", "work", "--keystore", dir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runKeygen([]string{"--identity", "work", "--keystore", dir}); err == nil {
+		t.Fatal("keygen overwrote an identity")
+	}
+
+	sel := seedFlags{identity: "work", keystore: dir}
+	path, err := sel.path(false)
+	if err != nil || path != filepath.Join(dir, "work.key") {
+		t.Fatalf("path = %q, %v", path, err)
+	}
+	// Named after the identity, it runs without --nick.
+	f, err := identity.LoadSeedFile(path)
+	if err != nil || f.Nickname != "work" {
+		t.Fatalf("keystore seed: %+v, %v; want nickname work", f, err)
+	}
+	if err := runIdentityList([]string{"--keystore", dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	sel.seed = "other.key"
+	if _, err := sel.path(false); err == nil {
+		t.Fatal("--seed and --identity both accepted")
+	}
+	sel = seedFlags{identity: "../escape", keystore: dir}
+	if _, err := sel.path(false); err == nil {
+		t.Fatal("an identity name outside the keystore accepted")
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+
+	"github.com/pivaldi/tmd/internal/keyid"
+	"github.com/pivaldi/tmd/internal/node"
+)
+
+// With --mdns, peers on the same LAN find each other without a node:
+// libp2p mDNS announces our host on the local network, and every peer it
+// finds is asked for a LAN HELLO on lanProtocolID. A LAN HELLO is an
+// ordinary signed HELLO (nickname, key ID, Ed25519 and HPKE keys, key
+// signature, profile) whose challenge is lanContext and the peer IDs of
+// its sender and receiver, so it cannot be replayed to another peer or
+// sent back. Its Ed25519 key must be the one of the sender's peer ID. The
+// dialer sends its own first; the listener checks it and answers with its
+// own. Each side then hands the other to the peer handler as if a node
+// announced it, so pins, trust and contact cards apply. Known LAN peers
+// are asked again every lanInterval; one that does not answer has left.
+const (
+	lanProtocolID = protocol.ID("/tmd/lan/1.0.0")
+	mdnsService   = "_tmd._udp"
+	lanContext    = "tmd lan hello v1"
+	lanInterval   = time.Minute
+)
+
+// lanChallenge returns the challenge of a LAN HELLO from one peer ID to
+// another.
+func lanChallenge(from, to peer.ID) []byte {
+	var b bytes.Buffer
+	b.WriteString(lanContext)
+	b.WriteByte(0)
+	b.WriteString(string(from))
+	b.WriteByte(0)
+	b.WriteString(string(to))
+	return b.Bytes()
+}
+
+// lanDiscovery tracks the peers found on the LAN.
+type lanDiscovery struct {
+	ctx     context.Context
+	host    host.Host
+	pool    *connPool
+	handler *peerHandler
+
+	mu    sync.Mutex
+	peers map[peer.ID]node.PeerInfo
+	nicks map[PeerID]peer.ID
+}
+
+func newLANDiscovery(ctx context.Context, h host.Host, pool *connPool, handler *peerHandler) *lanDiscovery {
+	return &lanDiscovery{
+		ctx:     ctx,
+		host:    h,
+		pool:    pool,
+		handler: handler,
+		peers:   make(map[peer.ID]node.PeerInfo),
+		nicks:   make(map[PeerID]peer.ID),
+	}
+}
+
+// startLAN announces us on the LAN and finds the peers there until the
+// returned func is called.
+func startLAN(h host.Host, pool *connPool, handler *peerHandler) (func(), error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := newLANDiscovery(ctx, h, pool, handler)
+	h.SetStreamHandler(lanProtocolID, l.serve)
+	svc := mdns.NewMdnsService(h, mdnsService, l)
+	if err := svc.Start(); err != nil {
+		h.RemoveStreamHandler(lanProtocolID)
+		cancel()
+		return nil, fmt.Errorf("mdns: %w", err)
+	}
+	go l.recheck()
+	return func() {
+		cancel()
+		_ = svc.Close()
+		h.RemoveStreamHandler(lanProtocolID)
+	}, nil
+}
+
+// HandlePeerFound implements mdns.Notifee.
+func (l *lanDiscovery) HandlePeerFound(ai peer.AddrInfo) {
+	if ai.ID == l.host.ID() {
+		return
+	}
+	l.mu.Lock()
+	_, known := l.peers[ai.ID]
+	l.mu.Unlock()
+	if known {
+		return
+	}
+	go func() {
+		if err := l.probe(ai); err != nil {
+			l.pool.console.AddHistory(fmt.Sprintf("[lan] %s: %v", ai.ID.ShortString(), err))
+		}
+	}()
+}
+
+// recheck asks the known LAN peers for their HELLO every lanInterval.
+func (l *lanDiscovery) recheck() {
+	ticker := time.NewTicker(lanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		l.mu.Lock()
+		known := make([]peer.ID, 0, len(l.peers))
+		for id := range l.peers {
+			known = append(known, id)
+		}
+		l.mu.Unlock()
+		for _, id := range known {
+			if err := l.probe(peer.AddrInfo{ID: id}); err != nil && l.ctx.Err() == nil {
+				l.forget(id)
+			}
+		}
+	}
+}
+
+// ownHello returns our LAN HELLO to a peer ID.
+func (l *lanDiscovery) ownHello(to peer.ID) ([]byte, error) {
+	p := l.pool
+	h := Hello{
+		SenderID:      p.nickname,
+		SenderKeyID:   p.keyID,
+		SenderEdPub:   p.selfEdPub(),
+		SenderHPKEPub: p.selfHPKEPubBytes,
+		KeySig:        p.keySig,
+		Profile:       p.ownProfile(),
+	}
+	sig, err := p.selfSigner.Sign(nil, helloSignInput(lanChallenge(l.host.ID(), to), h), crypto.Hash(0))
+	if err != nil {
+		return nil, fmt.Errorf("sign LAN hello: %w", err)
+	}
+	h.Signature = sig
+	return encodeHello(h), nil
+}
+
+// checkHello decodes and checks the LAN HELLO of a peer ID.
+func (l *lanDiscovery) checkHello(from peer.ID, typ byte, payload []byte) (Hello, error) {
+	if typ != msgHello {
+		return Hello{}, fmt.Errorf("expected a HELLO, got message %d", typ)
+	}
+	h, err := decodeHello(payload)
+	if err != nil {
+		return Hello{}, err
+	}
+	if err := verifySignedHello(l.pool.kemScheme, lanChallenge(from, l.host.ID()), h); err != nil {
+		return Hello{}, err
+	}
+	pub, err := from.ExtractPublicKey()
+	if err != nil {
+		return Hello{}, err
+	}
+	if raw, err := pub.Raw(); err != nil || !bytes.Equal(raw, h.SenderEdPub) {
+		return Hello{}, fmt.Errorf("HELLO of %s is not signed with the key of its peer ID", h.SenderID)
+	}
+	if err := checkHelloKeySig(h); err != nil {
+		return Hello{}, err
+	}
+	if h.SenderKeyID, err = keyid.Resolve(h.SenderKeyID, h.SenderHPKEPub); err != nil {
+		return Hello{}, err
+	}
+	return h, nil
+}
+
+// probe exchanges LAN HELLOs with a peer we dial.
+func (l *lanDiscovery) probe(ai peer.AddrInfo) error {
+	ctx, cancel := context.WithTimeout(l.ctx, 10*time.Second)
+	defer cancel()
+	if len(ai.Addrs) > 0 {
+		if err := l.host.Connect(ctx, ai); err != nil {
+			return err
+		}
+	}
+	stream, err := l.host.NewStream(ctx, ai.ID, lanProtocolID)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(10 * time.Second))
+	ours, err := l.ownHello(ai.ID)
+	if err != nil {
+		return err
+	}
+	if err := writeMsg(stream, msgHello, ours); err != nil {
+		return err
+	}
+	typ, payload, err := readMsgLimit(stream, defaultMaxFrame)
+	if err != nil {
+		return err
+	}
+	h, err := l.checkHello(ai.ID, typ, payload)
+	if err != nil {
+		return err
+	}
+	l.found(ai.ID, h)
+	return nil
+}
+
+// serve answers the LAN HELLO of a peer that found us.
+func (l *lanDiscovery) serve(stream network.Stream) {
+	defer stream.Close()
+	from := stream.Conn().RemotePeer()
+	_ = stream.SetDeadline(time.Now().Add(10 * time.Second))
+	typ, payload, err := readMsgLimit(stream, defaultMaxFrame)
+	if err != nil {
+		return
+	}
+	h, err := l.checkHello(from, typ, payload)
+	if err != nil {
+		l.pool.console.Errorf("[lan] %s: %v", from.ShortString(), err)
+		return
+	}
+	ours, err := l.ownHello(from)
+	if err != nil {
+		l.pool.console.Errorf("[lan] %v", err)
+		return
+	}
+	if err := writeMsg(stream, msgHello, ours); err != nil {
+		return
+	}
+	l.found(from, h)
+}
+
+// found hands a LAN peer to the handler when it is new or its keys
+// changed.
+func (l *lanDiscovery) found(id peer.ID, h Hello) {
+	info := node.PeerInfo{
+		Nickname: string(h.SenderID),
+		PeerID:   id,
+		Addrs:    l.host.Peerstore().Addrs(id),
+		HPKEPub:  h.SenderHPKEPub,
+		KeyID:    h.SenderKeyID,
+		Profile:  h.Profile,
+		KeySig:   h.KeySig,
+	}
+	l.mu.Lock()
+	if holder, ok := l.nicks[h.SenderID]; ok && holder != id {
+		l.mu.Unlock()
+		l.pool.console.Errorf("[lan] %s claims %s, found at %s first; ignoring it", id.ShortString(), h.SenderID, holder.ShortString())
+		return
+	}
+	old, known := l.peers[id]
+	if known && old.Nickname == info.Nickname && bytes.Equal(old.HPKEPub, info.HPKEPub) {
+		l.mu.Unlock()
+		return
+	}
+	if known {
+		delete(l.nicks, PeerID(old.Nickname))
+	}
+	l.peers[id] = info
+	l.nicks[h.SenderID] = id
+	l.mu.Unlock()
+
+	if known {
+		l.handler.OnPeerLeft(old.Nickname, "")
+	}
+	l.handler.OnPeerJoined(info, "")
+}
+
+// forget reports a LAN peer that stopped answering as gone.
+func (l *lanDiscovery) forget(id peer.ID) {
+	l.mu.Lock()
+	info, ok := l.peers[id]
+	delete(l.peers, id)
+	if ok {
+		delete(l.nicks, PeerID(info.Nickname))
+	}
+	l.mu.Unlock()
+	if ok {
+		l.handler.OnPeerLeft(info.Nickname, "")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// TestLANDiscovery checks that two peers without a node learn each
+// other's keys from the LAN HELLOs they exchange and can then talk, that
+// a HELLO meant for another peer is refused, and that a peer no longer
+// answering has left.
+func TestLANDiscovery(t *testing.T) {
+	n := newSimNetwork(t)
+	n.startPeer("alice", nil)
+	n.startPeer("bob", nil)
+	alice, bob := n.peer("alice"), n.peer("bob")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lan := func(p *simPeer) *lanDiscovery {
+		l := newLANDiscovery(ctx, p.host, p.pool, &peerHandler{peerTable: p.pool.peerTable, console: p.console, pool: p.pool})
+		p.host.SetStreamHandler(lanProtocolID, l.serve)
+		return l
+	}
+	aliceLAN, bobLAN := lan(alice), lan(bob)
+
+	// What mDNS does once it sees bob.
+	aliceLAN.HandlePeerFound(peer.AddrInfo{ID: bob.host.ID(), Addrs: bob.host.Addrs()})
+	if !alice.console.WaitFor("peer joined: bob", defaultExpectTimeout) || !bob.console.WaitFor("peer joined: alice", defaultExpectTimeout) {
+		t.Fatalf("no LAN join; alice: %q, bob: %q", alice.console.History(), bob.console.History())
+	}
+	got, ok := alice.pool.peerTable.Get("bob")
+	if !ok || got.PeerID != bob.host.ID() || len(got.Addrs) == 0 {
+		t.Fatalf("bob = %+v", got)
+	}
+
+	alice.console.Feed("@bob hello over the LAN")
+	if !bob.console.WaitFor("hello over the LAN", defaultExpectTimeout) {
+		t.Fatalf("message not received; bob: %q", strings.Join(bob.console.History(), "\n"))
+	}
+
+	// A HELLO alice signed for bob does not pass from anyone else.
+	hello, err := aliceLAN.ownHello(bob.host.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bobLAN.checkHello(alice.host.ID(), msgHello, hello); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aliceLAN.checkHello(alice.host.ID(), msgHello, hello); err == nil {
+		t.Fatal("a LAN HELLO was accepted back by its sender")
+	}
+	if _, err := bobLAN.checkHello(bob.host.ID(), msgHello, hello); err == nil {
+		t.Fatal("a LAN HELLO was accepted from another peer ID")
+	}
+
+	// Bob goes away: the next check finds him gone.
+	n.stopPeer("bob")
+	if err := aliceLAN.probe(peer.AddrInfo{ID: bob.host.ID()}); err == nil {
+		t.Fatal("probe of a stopped peer succeeded")
+	}
+	aliceLAN.forget(bob.host.ID())
+	if !alice.console.WaitFor("peer left: bob", time.Second) {
+		t.Fatalf("no leave; alice: %q", alice.console.History())
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/history"
+)
+
+// seenSaveEvery throttles writing a peer's last-seen time to the store
+// while it stays active; going offline is always written.
+const seenSaveEvery = time.Minute
+
+// lastSeen tracks when each peer was last online: node events and any
+// frame or response received from it count.
+type lastSeen struct {
+	mu    sync.Mutex
+	at    map[PeerID]time.Time
+	saved map[PeerID]time.Time // last written to store
+	store *history.Store       // nil unless --history is set
+}
+
+// setLastSeenStore restores the last-seen times kept in s and keeps them
+// there.
+func (p *connPool) setLastSeenStore(s *history.Store) error {
+	list, err := s.LastSeen()
+	if err != nil {
+		return err
+	}
+	p.seenAt.mu.Lock()
+	defer p.seenAt.mu.Unlock()
+	p.seenAt.store = s
+	for _, seen := range list {
+		if seen.Time.After(p.seenAt.at[PeerID(seen.Peer)]) {
+			p.seenAtLocked()[PeerID(seen.Peer)] = seen.Time
+		}
+	}
+	return nil
+}
+
+func (p *connPool) seenAtLocked() map[PeerID]time.Time {
+	if p.seenAt.at == nil {
+		p.seenAt.at = make(map[PeerID]time.Time)
+		p.seenAt.saved = make(map[PeerID]time.Time)
+	}
+	return p.seenAt.at
+}
+
+// sawPeer notes that peer is online now. leaving forces the time to the
+// store.
+func (p *connPool) sawPeer(peer PeerID, leaving bool) {
+	now := time.Now()
+	p.seenAt.mu.Lock()
+	defer p.seenAt.mu.Unlock()
+	p.seenAtLocked()[peer] = now
+	if p.seenAt.store == nil || (!leaving && now.Sub(p.seenAt.saved[peer]) < seenSaveEvery) {
+		return
+	}
+	p.seenAt.saved[peer] = now
+	if err := p.seenAt.store.PutSeen(history.Seen{Peer: string(peer), Time: now}); err != nil {
+		p.console.Errorf("last seen: %v", err)
+	}
+}
+
+// LastSeen returns when peer was last seen online.
+func (p *connPool) LastSeen(peer PeerID) (time.Time, bool) {
+	p.seenAt.mu.Lock()
+	defer p.seenAt.mu.Unlock()
+	t, ok := p.seenAt.at[peer]
+	return t, ok
+}
+
+// offlineSeen lists the peers seen before that are not online, most
+// recently seen first.
+func (p *connPool) offlineSeen() []history.Seen {
+	p.seenAt.mu.Lock()
+	var list []history.Seen
+	for peer, t := range p.seenAt.at {
+		if _, online := p.peerTable.Get(peer); !online && peer != p.nickname {
+			list = append(list, history.Seen{Peer: string(peer), Time: t})
+		}
+	}
+	p.seenAt.mu.Unlock()
+
+	slices.SortFunc(list, func(a, b history.Seen) int { return b.Time.Compare(a.Time) })
+	return list
+}
+
+// seenAgo says how long ago t was, coarsely.
+func seenAgo(t time.Time) string {
+	switch d := time.Since(t); {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	default:
+		return t.Format("2006-01-02 15:04")
+	}
+}
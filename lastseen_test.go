@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/history"
+)
+
+func TestLastSeenPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	seed := make([]byte, 32)
+	store, err := history.Open(path, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newTestPool("alice")
+	pool.setConsole(newHeadlessConsole())
+	if err := pool.setLastSeenStore(store); err != nil {
+		t.Fatal(err)
+	}
+	pool.sawPeer("bob", false)
+	pool.sawPeer("carol", false)
+	pool.sawPeer("bob", true)
+	seen, _ := pool.LastSeen("bob")
+	store.Close()
+
+	store, err = history.Open(path, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	pool = newTestPool("alice")
+	if err := pool.setLastSeenStore(store); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := pool.LastSeen("bob"); !ok || !got.Equal(seen) {
+		t.Fatalf("LastSeen(bob) = %v, %v; want %v", got, ok, seen)
+	}
+	if list := pool.offlineSeen(); len(list) != 2 || list[0].Peer != "bob" {
+		t.Fatalf("offlineSeen = %+v", list)
+	}
+}
+
+func TestSeenAgo(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		10 * time.Second: "just now",
+		5 * time.Minute:  "5m ago",
+		3 * time.Hour:    "3h ago",
+	} {
+		if got := seenAgo(time.Now().Add(-d)); got != want {
+			t.Errorf("seenAgo(-%s) = %q, want %q", d, got, want)
+		}
+	}
+}
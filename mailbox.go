@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/openpcc/twoway"
+	"github.com/pivaldi/tmd/internal/node"
+)
+
+// A message queued in the outbox for a peer whose keys we still know is
+// also left with the discovery nodes, which push it when the peer
+// registers, even if we are offline by then. The deposit is a request
+// sealed to the peer like any other, so nodes only see its size. It
+// carries the outbox entry's message ID: the copy sent when the outbox is
+// flushed is then answered but not shown again.
+const mailMediaType = "text/plain; purpose=mail"
+
+// relayMediaType marks broadcasts the nodes fanned out (see
+// broadcastViaNodes).
+const relayMediaType = "text/plain; purpose=broadcast"
+
+// mailDepositor is the discovery client as used by mail and relayed
+// broadcasts.
+type mailDepositor interface {
+	Deposit(to string, data []byte) error
+	Fanout(items []node.Deposit) error
+}
+
+type mailState struct {
+	mu       sync.Mutex
+	dir      mailDepositor                // nil in standalone mode
+	receiver *twoway.MultiRequestReceiver // set by SetupStreamHandler
+	relay    bool                         // broadcasts go through the nodes
+}
+
+// setMailbox lets the outbox deposit messages with the discovery nodes.
+func (p *connPool) setMailbox(dir mailDepositor) {
+	p.mail.mu.Lock()
+	defer p.mail.mu.Unlock()
+	p.mail.dir = dir
+}
+
+// setRelayBroadcasts sends broadcasts through the discovery nodes rather
+// than over a session to every peer.
+func (p *connPool) setRelayBroadcasts(on bool) {
+	p.mail.mu.Lock()
+	defer p.mail.mu.Unlock()
+	p.mail.relay = on
+}
+
+func (p *connPool) setMailReceiver(receiver *twoway.MultiRequestReceiver) {
+	p.mail.mu.Lock()
+	defer p.mail.mu.Unlock()
+	p.mail.receiver = receiver
+}
+
+// depositMail seals msg to a peer and leaves it with the nodes. It reports
+// whether there was a node to leave it with.
+func (p *connPool) depositMail(to PeerInfo, msg string, messageID []byte) (bool, error) {
+	p.mail.mu.Lock()
+	dir := p.mail.dir
+	p.mail.mu.Unlock()
+	if dir == nil {
+		return false, nil
+	}
+
+	if err := p.checkRevoked(to); err != nil {
+		return false, err
+	}
+	if err := p.checkPeerSuite(to.Nickname, p.suite); err != nil {
+		return false, err
+	}
+	req, _, err := p.seal(to, msg, mailMediaType)
+	if err != nil {
+		return false, err
+	}
+	req.MessageID = messageID
+	if err := dir.Deposit(string(to.Nickname), encodeRequest(req)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// broadcastViaNodes seals msg to each peer and hands the lot to the nodes
+// in one message, which push each copy to its peer. All copies share a
+// message ID, so a peer registered with several nodes shows it once. It
+// reports false, sending nothing, when relaying is off or no node is
+// connected. Nodes do not acknowledge the copies.
+func (p *connPool) broadcastViaNodes(msg string, peers []PeerInfo) ([]BroadcastResult, bool) {
+	p.mail.mu.Lock()
+	dir, relay := p.mail.dir, p.mail.relay
+	p.mail.mu.Unlock()
+	if dir == nil || !relay {
+		return nil, false
+	}
+
+	id, err := newMessageID()
+	if err != nil {
+		return nil, false
+	}
+	results := make([]BroadcastResult, len(peers))
+	var items []node.Deposit
+	for i, to := range peers {
+		results[i] = BroadcastResult{Peer: to.Nickname, Relayed: true}
+		n, err := p.sealNotify(to, msg, relayMediaType)
+		if err != nil {
+			results[i].Err = err
+			p.retryBroadcast(to.Nickname, msg)
+			continue
+		}
+		req := Request{
+			RecipientKeyID: n.RecipientKeyID,
+			EncapKey:       n.EncapKey,
+			MediaType:      n.MediaType,
+			Ciphertext:     n.Ciphertext,
+			MessageID:      id,
+		}
+		items = append(items, node.Deposit{To: string(to.Nickname), Data: encodeRequest(req)})
+	}
+	if err := dir.Fanout(items); err != nil {
+		return nil, false
+	}
+	return results, true
+}
+
+// handleMail opens a message a node kept or relayed for us and shows it,
+// unless it already arrived.
+func (p *connPool) handleMail(from PeerID, data []byte) error {
+	p.mail.mu.Lock()
+	receiver := p.mail.receiver
+	p.mail.mu.Unlock()
+	if receiver == nil {
+		return fmt.Errorf("mail from %s before the stream handler is set up", from)
+	}
+
+	if info, ok := p.peerTable.Get(from); ok && p.checkBlocked(info) != nil {
+		return nil // dropped unopened
+	}
+
+	req, err := decodeRequest(data)
+	if err != nil {
+		return fmt.Errorf("decode mail: %w", err)
+	}
+	if mt := baseMediaType(req.MediaType); mt != mailMediaType && mt != relayMediaType {
+		return fmt.Errorf("mail of media type %q", req.MediaType)
+	}
+	plain, err := p.openNotify(Notify{
+		RecipientKeyID: req.RecipientKeyID,
+		EncapKey:       req.EncapKey,
+		MediaType:      req.MediaType,
+		Ciphertext:     req.Ciphertext,
+	}, receiver)
+	if err != nil {
+		return err
+	}
+	if len(req.MessageID) > 0 && !p.firstSeen(from, req.MessageID) {
+		return nil
+	}
+
+	if baseMediaType(req.MediaType) == relayMediaType {
+		p.showBroadcastFrom(from, string(plain))
+		p.notifyReceived(receivedMessage{Kind: "broadcast", From: from, Text: string(plain)})
+		return nil
+	}
+	p.clearTyping(from)
+	if len(req.MessageID) > 0 {
+		p.rememberReceived(from, req.MessageID, string(plain))
+	}
+	p.showDirectFrom(from, string(plain))
+	p.notifyReceived(receivedMessage{Kind: "direct", From: from, Text: string(plain)})
+	return nil
+}
@@ -1,19 +1,37 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/ed25519"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cloudflare/circl/hpke"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
+	"github.com/pivaldi/tmd/internal/addrbook"
+	"github.com/pivaldi/tmd/internal/attest"
+	"github.com/pivaldi/tmd/internal/audit"
+	"github.com/pivaldi/tmd/internal/chaos"
+	"github.com/pivaldi/tmd/internal/contact"
+	"github.com/pivaldi/tmd/internal/gateway"
+	"github.com/pivaldi/tmd/internal/history"
+	"github.com/pivaldi/tmd/internal/hwkey"
 	"github.com/pivaldi/tmd/internal/identity"
 	"github.com/pivaldi/tmd/internal/node"
 	"github.com/pivaldi/tmd/internal/p2p"
+	"github.com/pivaldi/tmd/internal/pins"
+	"github.com/pivaldi/tmd/internal/secmem"
+	"github.com/pivaldi/tmd/internal/webhook"
 )
 
 func main() {
@@ -21,63 +39,321 @@ func main() {
 	if len(os.Args) > 1 && os.Args[1] == "keygen" {
 		if err := runKeygen(os.Args[2:]); err != nil {
 			fmt.Fprintf(os.Stderr, "keygen error: %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 		return
 	}
 
+	// Handle attest/trust subcommands (OpenPGP/SSH key import)
+	if len(os.Args) > 1 && (os.Args[1] == "attest" || os.Args[1] == "trust") {
+		run := runAttest
+		if os.Args[1] == "trust" {
+			run = runTrust
+		}
+		if err := run(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s error: %v\n", os.Args[1], err)
+			exit(1)
+		}
+		return
+	}
+
+	// Handle contact subcommand (QR contact exchange)
+	if len(os.Args) > 1 && os.Args[1] == "contact" {
+		if err := runContact(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "contact error: %v\n", err)
+			exit(1)
+		}
+		return
+	}
+
+	// Handle identity subcommand (moving an identity between machines)
+	if len(os.Args) > 1 && os.Args[1] == "identity" {
+		if err := runIdentity(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "identity error: %v\n", err)
+			exit(1)
+		}
+		return
+	}
+
+	// `tmd rpc` takes the client flags but speaks JSON-RPC on stdin/stdout
+	// instead of running the TUI.
+	rpcMode := len(os.Args) > 1 && os.Args[1] == "rpc"
+	if rpcMode {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	var (
-		seedPath  string
+		seedSel   seedFlags
 		nickname  string
 		token     string
 		nodesStr  string
+		dhtKey    string
+		dhtBoot   string
+		lan       bool
+		pointAddr string
+		pointKey  string
 		port      int
+		chaosSpec string
+		rekeySpec string
+		keyMaxAge int
+		trustPath string
+		pinsPath  string
+		auditPath string
+		vouches   int
+		confirm   bool
+		requests  bool
+		bookPath  string
+		addrPath  string
+		hookURL   string
+		gwAddr    string
+		grpcAddr  string
+		ircAddr   string
+		matrixCfg string
+		xmppCfg   string
+		emailCfg  string
+		autoCfg   string
+		region    string
+		histPath  string
+		xferDir   string
+		relay     bool
+		gossip    bool
+		gossipMin int
+		pad       bool
+		early     bool
+		legacy    bool
+		sign      bool
+		profile   Profile
+		avatar    string
+		device    string
+		devices   string
+		signerArg string
 	)
-	flag.StringVar(&seedPath, "seed", "", "path to seed file (required)")
-	flag.StringVar(&nickname, "nick", "", "nickname for this peer (required)")
-	flag.StringVar(&token, "token", "", "authentication token (required)")
-	flag.StringVar(&nodesStr, "nodes", "", "comma-separated list of discovery node addresses")
+	addSeedFlags(flag.CommandLine, &seedSel, "path to seed file, or keyring:<name> for an OS keyring entry (required, or --identity)")
+	flag.StringVar(&nickname, "nick", "", "nickname for this peer (required unless the seed file notes one)")
+	flag.StringVar(&token, "token", "", "authentication token; not needed with nodes listing our key")
+	flag.StringVar(&nodesStr, "nodes", "", "comma-separated list of discovery node addresses, or dns:<domain> to read them from dnsaddr TXT records")
+	flag.StringVar(&dhtKey, "dht", "", "serverless mode: find the peers sharing this rendezvous key on the libp2p Kademlia DHT, without a node")
+	flag.StringVar(&dhtBoot, "dht-bootstrap", "", "with --dht, comma-separated DHT bootstrap peer addresses (default: the public libp2p bootstrap peers)")
+	flag.StringVar(&pointAddr, "rendezvous", "", "register at and find peers through the libp2p rendezvous point at this address (/p2p/ form), alongside or instead of nodes")
+	flag.StringVar(&pointKey, "rendezvous-key", "tmd", "with --rendezvous, the key the group registers under")
+	flag.BoolVar(&lan, "mdns", false, "find peers on the local network with mDNS, without a node; keys are exchanged in signed HELLOs")
 	flag.IntVar(&port, "port", 0, "port to listen on (0 = random)")
+	flag.StringVar(&pinsPath, "pins", "", "file pinning the keys each peer is first seen with; peers presenting other keys later are refused (see /repin)")
+	flag.IntVar(&vouches, "vouches", defaultVouchThreshold, "with --pins, how many peers you verified must vouch for a peer's keys (see /vouch) to mark it vouched")
+	flag.StringVar(&auditPath, "audit", "", "append security events (key mismatches, failed Hellos, revoked keys, node refusals) to this tamper-evident log (see /audit)")
+	flag.BoolVar(&requests, "requests", false, "with --pins, keep direct messages of peers you did not accept, verify or see vouched for in a requests pane, without autoreply, until /accept")
+	flag.BoolVar(&confirm, "confirm-unverified", false, "with --pins, send a direct message to a peer not verified with /verify only when typed twice")
+	flag.StringVar(&bookPath, "contacts", "", "contacts file written by 'tmd contact scan'; its peers are reachable without a node")
+	flag.StringVar(&addrPath, "addressbook", "", "file keeping the peers nodes announced (keys, addresses, trust, /note), encrypted with a key derived from the seed, so they are reachable after a restart without a node")
+	flag.StringVar(&trustPath, "trusted", "", "trust store written by 'tmd trust'; peers whose keys differ are refused")
+	flag.StringVar(&hookURL, "webhook", "", "HTTPS endpoint receiving each incoming message as signed JSON (secret in $TMD_WEBHOOK_SECRET)")
+	flag.StringVar(&gwAddr, "gateway", "", "loopback address for the HTTP message gateway, e.g. 127.0.0.1:8080 (token in $TMD_GATEWAY_TOKEN)")
+	flag.StringVar(&grpcAddr, "grpc", "", "loopback address for the gRPC event API, e.g. 127.0.0.1:7070 (token in $TMD_GRPC_TOKEN)")
+	flag.StringVar(&ircAddr, "irc", "", "loopback address for the local IRC server, e.g. 127.0.0.1:6667 (password in $TMD_IRC_PASSWORD)")
+	flag.StringVar(&matrixCfg, "matrix", "", "path to a Matrix bridge config (application-service mode)")
+	flag.StringVar(&xmppCfg, "xmpp", "", "path to an XMPP component gateway config")
+	flag.StringVar(&emailCfg, "email", "", "path to an SMTP notifier config; mails direct messages received while idle (password in $TMD_SMTP_PASSWORD)")
+	flag.StringVar(&autoCfg, "autoreply", "", "JSON file of rules answering direct messages instead of \""+ackReply+"\" (away message, keywords)")
+	flag.StringVar(&region, "region", "", "dial peer addresses the discovery node places in this region first (see the node's addr_hints)")
+	flag.StringVar(&device, "device", "", "run as this device of the identity in --seed, with keys derived for it, registered as nick/device (e.g. laptop)")
+	flag.StringVar(&signerArg, "signer", "", "sign Hellos with a hardware-held Ed25519 key instead of the seed's: ssh-agent, or ssh-agent:SHA256:<fingerprint> among several")
+	flag.StringVar(&devices, "devices", "", "comma-separated nicknames of the other devices of this identity, to sync history and outbox with")
+	flag.StringVar(&histPath, "history", "", "file keeping the history and direct queue across restarts, encrypted with a key derived from the seed")
+	flag.StringVar(&xferDir, "transfers", "", "directory keeping unfinished file transfers so they resume after a restart (default: under the system temp directory)")
+	flag.BoolVar(&relay, "relay-broadcasts", false, "send broadcasts as one bundle through the discovery nodes instead of a session per peer")
+	flag.BoolVar(&gossip, "gossip", false, "run libp2p gossipsub: /sub and /pub topics, and broadcasts to --gossip-min peers or more published once; peers without it miss those broadcasts")
+	flag.IntVar(&gossipMin, "gossip-min", gossipBroadcastMin, "with --gossip, the number of peers from which broadcasts are published on gossipsub rather than sent to each peer")
+	flag.BoolVar(&pad, "pad", false, "pad sealed messages to size buckets so their length does not show in the ciphertext")
+	flag.BoolVar(&early, "early", false, "send the first request to a peer in the Hello to save a round trip; it is then sealed to the HPKE key only, without the session's forward secrecy")
+	flag.BoolVar(&legacy, "legacy-hellos", false, "accept Hellos from peers predating HPKE suite negotiation or Hello bindings, which do not sign the suites or the binding we offer; each is audited as a downgrade")
+	flag.BoolVar(&sign, "sign", false, "sign each message we send with our Ed25519 key, and flag messages received unsigned")
+	flag.StringVar(&rekeySpec, "rekey", "", "replace channel and room keys after this much under one key, e.g. messages=100000,bytes=64MiB (0 for no limit; default messages=1048576,bytes=1GiB)")
+	flag.IntVar(&keyMaxAge, "key-max-age", defaultKeyMaxAge, "warn when the HPKE key is older than this many days (0: never); rotate it with 'tmd identity rotate'")
+	flag.StringVar(&profile.DisplayName, "name", "", "display name in the profile peers see with /whois")
+	flag.StringVar(&avatar, "avatar", "", "avatar image whose SHA-256 goes in the profile")
+	flag.StringVar(&profile.Note, "note", "", "short note in the profile")
+	flag.StringVar(&chaosSpec, "chaos", "", "debug: inject network faults, e.g. latency=50ms,jitter=20ms,reorder=0.05,truncate=0.01,reset=0.01,seed=42")
 	flag.Parse()
 
-	if seedPath == "" || nickname == "" || token == "" {
-		fmt.Println("usage: tmd --seed <seed.key> --nick <nickname> --token <token> --nodes <node1,node2,...>")
-		fmt.Println("       tmd keygen --out seed.key")
+	seedPath, err := seedSel.path(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		exit(2)
+	}
+
+	// The seed file may note the nickname it was made for; errors reading
+	// it are left to loading the seed below.
+	if seedPath != "" && nickname == "" {
+		if f, err := identity.LoadSeedFile(seedPath); err == nil {
+			nickname = f.Nickname
+			secmem.Wipe(f.Seed)
+		}
+	}
+
+	if seedPath == "" || nickname == "" {
+		fmt.Println("usage: tmd --seed <seed.key> --nick <nickname> [--token <token>] --nodes <node1,node2,...>")
+		fmt.Println("       tmd --identity <name> [--keystore <dir>] ...  (an identity of the keystore instead of --seed)")
+		fmt.Println("       tmd rpc --seed <seed.key> --nick <nickname> [--token <token>] ...  (JSON-RPC on stdio)")
+		fmt.Println("       tmd contact qr --seed seed.key --nick <nickname> | tmd contact scan [--image <file>]")
+		fmt.Println("       tmd keygen --out seed.key [--nick <nickname>] [--words]  (or --from-mnemonic to restore from the words)")
+		fmt.Println("       tmd keygen --out seed.key --from-passphrase --nick <nickname>  (passphrase in $TMD_SEED_PASSPHRASE or stdin)")
+		fmt.Println("       tmd keygen --out seed.key --upgrade old.key  (seed file of an older key derivation or format)")
+		fmt.Println("       tmd keygen --identity <name> [--nick <nickname>]  (in the keystore) | tmd identity list [--keystore <dir>]")
+		fmt.Println("       tmd identity export --seed seed.key --out id.bundle [--nick <nickname>] [--pins pins.json]")
+		fmt.Println("       tmd identity import --in id.bundle --seed seed.key [--pins pins.json]  (passphrase in $TMD_BUNDLE_PASSPHRASE or stdin)")
+		fmt.Println("       tmd identity rotate --seed seed.key [--expires <days>]  (a new HPKE key; the peer ID stays)")
+		fmt.Println("       tmd attest --seed seed.key --nick <nickname> --ssh|--pgp <pubkey>")
+		fmt.Println("       tmd trust --ssh|--pgp <pubkey> --attestation <file> [--store trusted.json]")
 		fmt.Println("")
 		fmt.Println("Required flags:")
-		fmt.Println("  --seed   path to seed file (create with 'tmd keygen')")
-		fmt.Println("  --nick   your nickname")
-		fmt.Println("  --token  authentication token for node registration")
+		fmt.Println("  --seed     path to seed file, or keyring:<name> for one in the OS keyring (create with 'tmd keygen')")
+		fmt.Println("  --identity instead of --seed, the seed of this name in the keystore (--keystore <dir>)")
+		fmt.Println("  --nick     your nickname (defaults to the one noted by 'tmd keygen --nick')")
 		fmt.Println("")
 		fmt.Println("Optional flags:")
-		fmt.Println("  --nodes  comma-separated discovery node addresses")
-		fmt.Println("  --port   port to listen on (default: random)")
-		os.Exit(2)
+		fmt.Println("  --token    authentication token for node registration; nodes listing your")
+		fmt.Println("             Ed25519 key in their keys section have you sign a challenge instead")
+		fmt.Println("  --nodes    comma-separated discovery node addresses (dns:<domain> resolves dnsaddr records)")
+		fmt.Println("  --port     port to listen on (default: random)")
+		fmt.Println("  --contacts peers imported with 'tmd contact scan'")
+		fmt.Println("  --addressbook keep the peers nodes announced in this encrypted file (see /book)")
+		fmt.Println("  --trusted  trust store of peers verified with 'tmd trust'")
+		fmt.Println("  --pins     pin peer keys on first contact in this file")
+		fmt.Println("  --vouches  verified peers vouching for a peer's keys to mark it vouched (default 2)")
+		fmt.Println("  --audit    record security events in this tamper-evident log, shown by /audit")
+		fmt.Println("  --confirm-unverified  ask before sending to peers not verified with /verify")
+		fmt.Println("  --requests messages of peers not accepted yet wait in a requests pane (see /accept)")
+		fmt.Println("  --webhook  POST received messages to this HTTPS URL (HMAC key in $TMD_WEBHOOK_SECRET)")
+		fmt.Println("  --gateway  serve the local HTTP message gateway on this address (token in $TMD_GATEWAY_TOKEN)")
+		fmt.Println("  --grpc     serve the gRPC Subscribe event feed on this address (token in $TMD_GRPC_TOKEN)")
+		fmt.Println("  --irc      serve a local IRC interface on this address (password in $TMD_IRC_PASSWORD)")
+		fmt.Println("  --matrix   bridge peers to a Matrix room using this appservice config")
+		fmt.Println("  --xmpp     expose peers as JIDs through an XMPP component (config file)")
+		fmt.Println("  --email    email a summary of direct messages received while idle (config file)")
+		fmt.Println("  --region   dial peer addresses the node hints are in this region first")
+		fmt.Println("  --history  keep the history and direct queue in this encrypted file")
+		fmt.Println("  --device   run as one device of the nickname, with keys of its own (nick/device)")
+		fmt.Println("  --devices  the identity's other devices, to sync history and outbox with")
+		fmt.Println("  --signer   sign Hellos with a PIV/FIDO2/TPM key exposed by an SSH agent (ssh-agent[:SHA256:...])")
+		fmt.Println("  --transfers keep unfinished file transfers in this directory")
+		fmt.Println("  --relay-broadcasts send broadcasts through the discovery nodes")
+		fmt.Println("  --gossip   carry /sub topics and broadcasts to --gossip-min (8) peers or more on gossipsub")
+		fmt.Println("  --pad      pad sealed messages to size buckets (256 B, 1K, 4K, 16K, 64K)")
+		fmt.Println("  --early    send the first request to a peer in the Hello, without forward secrecy")
+		fmt.Println("  --sign     sign sent messages (non-repudiation); flag unsigned ones received")
+		fmt.Println("  --rekey    replace channel and room keys after messages=N,bytes=SIZE under one key")
+		fmt.Println("  --key-max-age warn when the HPKE key is older than this many days (default 365)")
+		fmt.Println("  --name, --avatar, --note  signed profile shown by /whois")
+		fmt.Println("  --chaos    debug: inject latency/reorder/truncate/reset faults on peer streams")
+		exit(2)
+	}
+
+	chaosCfg, err := chaos.ParseConfig(chaosSpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		exit(2)
+	}
+	rekey, err := parseRekeyLimits(rekeySpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		exit(2)
+	}
+	if vouches < 1 {
+		fmt.Fprintf(os.Stderr, "--vouches must be at least 1\n")
+		exit(2)
+	}
+	if keyMaxAge < 0 {
+		fmt.Fprintf(os.Stderr, "--key-max-age must not be negative\n")
+		exit(2)
 	}
 
 	// Load seed
-	seed, err := identity.LoadSeed(seedPath)
+	seedFile, err := identity.LoadSeedFile(seedPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "load seed: %v\n", err)
-		os.Exit(1)
+		exit(1)
 	}
+	seed, derivation := seedFile.Seed, seedFile.Derivation
+	if derivation == identity.DerivationDirect {
+		fmt.Fprintf(os.Stderr, "%s uses the old key derivation; see 'tmd keygen --upgrade'\n", seedPath)
+	}
+	// The seed stays for the history and device sync keys, locked in
+	// memory and wiped on shutdown; Copy wipes the one read from the file.
+	seedMem, err := secmem.Copy(seed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load seed: %v\n", err)
+		exit(1)
+	}
+	defer wipeSecrets()
+	onExit(seedMem.Wipe)
+	go wipeOnSignal()
+	seed = seedMem.Bytes()
 
-	// Derive keys
-	keys, err := identity.DeriveKeys(seed)
+	// Derive keys, from the device's own seed with --device, which also
+	// registers as nickname/device
+	keySeed := seed
+	if strings.Contains(nickname, node.DeviceSep) {
+		fmt.Fprintf(os.Stderr, "nickname %q: use --device for devices\n", nickname)
+		exit(2)
+	}
+	if device != "" {
+		if !node.ValidDevice(device) {
+			fmt.Fprintf(os.Stderr, "device: bad name %q (lowercase letters, digits, - and _)\n", device)
+			exit(2)
+		}
+		if keySeed, err = identity.DeviceSeed(seed, device); err != nil {
+			fmt.Fprintf(os.Stderr, "device: %v\n", err)
+			exit(2)
+		}
+		nickname = node.DeviceName(nickname, device)
+	}
+	keys, err := identity.DeriveKeysGen(keySeed, derivation, seedFile.HPKEGen)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "derive keys: %v\n", err)
-		os.Exit(1)
+		exit(1)
+	}
+	if device != "" {
+		secmem.Wipe(keySeed)
+	}
+	onExit(keys.Wipe)
+	if secmem.Lockable && !seedMem.Locked() {
+		fmt.Fprintf(os.Stderr, "warning: could not lock the seed in memory (raise ulimit -l); it may be swapped to disk\n")
+	}
+
+	// With --signer, Hellos, profiles and revocations are signed by the
+	// hardware key, which is also the host's identity; the HPKE key and
+	// the history key still come from the seed.
+	var signer crypto.Signer = keys.Ed25519Priv
+	if signerArg != "" {
+		hw, err := hwkey.Open(signerArg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "signer: %v\n", err)
+			exit(1)
+		}
+		if keys.Libp2pPriv, err = p2p.SignerKey(hw); err != nil {
+			fmt.Fprintf(os.Stderr, "signer: %v\n", err)
+			exit(1)
+		}
+		if keys.PeerID, err = peer.IDFromPrivateKey(keys.Libp2pPriv); err != nil {
+			fmt.Fprintf(os.Stderr, "signer: %v\n", err)
+			exit(1)
+		}
+		keys.Ed25519Pub = hw.Public().(ed25519.PublicKey)
+		keys.Libp2pPub = keys.Libp2pPriv.GetPublic()
+		signer = hw
+		fmt.Fprintf(os.Stderr, "signing with agent key %s\n", hw.Fingerprint())
 	}
 
 	// Create libp2p host
 	h, err := p2p.NewHost(keys.Libp2pPriv, port)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "create host: %v\n", err)
-		os.Exit(1)
+		exit(1)
 	}
 	defer h.Close()
 
-	// HPKE suite used by twoway.
+	// HPKE suite used by twoway for mail and for peers predating suite
+	// negotiation; sessions negotiate theirs (see suites.go).
 	suite := hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
 	kemScheme := hpke.KEM_X25519_HKDF_SHA256.Scheme()
 
@@ -94,17 +370,255 @@ func main() {
 	}
 
 	// Connection pool for outgoing connections (reused).
-	pool := newConnPool(h, peerTable, suite, kemScheme, PeerID(nickname), keys.KeyID, keys.Ed25519Priv, keys.HPKEPubBytes)
+	pool := newConnPool(h, peerTable, suite, kemScheme, PeerID(nickname), keys.KeyID, signer, keys.HPKEPubBytes)
+	if avatar != "" {
+		if profile.AvatarHash, err = avatarHash(avatar); err != nil {
+			fmt.Fprintf(os.Stderr, "avatar: %v\n", err)
+			exit(2)
+		}
+	}
+	if err := pool.setProfile(profile); err != nil {
+		fmt.Fprintf(os.Stderr, "profile: %v\n", err)
+		exit(2)
+	}
+	if err := pool.signOwnKey(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		exit(2)
+	}
 
-	// Console manager with TUI.
-	console, err := newConsole(selfInfo, pool)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to initialize TUI: %v\n", err)
-		os.Exit(1)
+	// Console manager with TUI; in rpc mode stdout belongs to the protocol
+	// and the history goes to stderr.
+	var console Console
+	var store *history.Store
+	if rpcMode {
+		console = newLogConsole(os.Stderr)
+	} else {
+		if histPath != "" {
+			store, err = history.Open(histPath, seed)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				exit(1)
+			}
+		}
+		tui, err := newTUIConsole()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to initialize TUI: %v\n", err)
+			exit(1)
+		}
+		if store != nil {
+			if err := tui.setStore(store); err != nil {
+				tui.Errorf("history: %v", err)
+				_ = store.Close()
+				store = nil
+			}
+		}
+		console = tui
 	}
 	defer console.Close()
 
 	pool.setConsole(console)
+	if store != nil {
+		if err := pool.setOutboxStore(store); err != nil {
+			console.Errorf("outbox: %v", err)
+		}
+		if err := pool.setLastSeenStore(store); err != nil {
+			console.Errorf("last seen: %v", err)
+		}
+		if err := pool.setScheduleStore(store); err != nil {
+			console.Errorf("schedule: %v", err)
+		}
+	}
+	pool.setChaos(chaos.New(chaosCfg))
+	pool.setRegion(region)
+	pool.setPadding(pad)
+	pool.setEarlyRequests(early)
+	pool.setLegacyHellos(legacy)
+	pool.setSigning(sign)
+	pool.setRekeyLimits(rekey)
+	pool.setVouchThreshold(vouches)
+	if xferDir == "" {
+		xferDir = filepath.Join(os.TempDir(), "tmd-"+strings.ReplaceAll(nickname, node.DeviceSep, "-"))
+	}
+	if err := pool.setTransferDir(xferDir); err != nil {
+		console.Errorf("transfers: %v", err)
+	}
+	if chaosCfg.Enabled() {
+		console.AddHistory(fmt.Sprintf("[chaos] fault injection enabled: %+v", chaosCfg))
+	}
+
+	var contacts *contact.Book
+	if bookPath != "" {
+		book, err := contact.OpenBook(bookPath)
+		if err != nil {
+			console.Errorf("%v", err)
+		} else {
+			contacts = book
+			for _, card := range book.Cards() {
+				if err := addContactPeer(peerTable, card); err != nil {
+					console.Errorf("contact %s: %v", card.Nickname, err)
+					continue
+				}
+				console.AddHistory(fmt.Sprintf("[contacts] %s loaded (keyID=%x)", card.Nickname, card.KeyID()))
+			}
+		}
+	}
+
+	if addrPath != "" {
+		book, err := addrbook.Open(addrPath, seed)
+		if err != nil {
+			console.Errorf("%v", err)
+		} else {
+			pool.setAddressBook(book)
+			for _, err := range loadAddressBook(peerTable, book) {
+				console.Errorf("address book: %v", err)
+			}
+		}
+	}
+
+	if trustPath != "" {
+		store, err := attest.OpenStore(trustPath)
+		if err != nil {
+			console.Errorf("%v", err)
+		} else {
+			pool.setTrustStore(store)
+		}
+	}
+
+	if pinsPath != "" {
+		store, err := pins.OpenStore(pinsPath)
+		if err != nil {
+			console.Errorf("%v", err)
+		} else {
+			pool.setPinStore(store)
+			pool.setConfirmUnverified(confirm)
+			pool.setMessageRequests(requests)
+		}
+	}
+
+	if auditPath != "" {
+		auditLog, err := audit.Open(auditPath, seed)
+		if err != nil {
+			console.Errorf("%v", err)
+		} else {
+			defer auditLog.Close()
+			pool.setAuditLog(auditLog)
+			if _, err := auditLog.Verify(); err != nil {
+				console.Errorf("WARNING: %v (see /audit)", err)
+			}
+		}
+	}
+
+	if hookURL != "" {
+		hook, err := webhook.New(webhook.Config{
+			URL:    hookURL,
+			Secret: []byte(os.Getenv("TMD_WEBHOOK_SECRET")),
+			OnError: func(ev webhook.Event, err error) {
+				console.Errorf("webhook: dropped %s message from %s: %v", ev.Kind, ev.From, err)
+			},
+		})
+		if err != nil {
+			console.Errorf("%v", err)
+		} else {
+			defer hook.Close()
+			pool.onReceive(func(m receivedMessage) {
+				hook.Deliver(webhook.Event{Kind: m.Kind, From: string(m.From), To: nickname, Message: m.Text})
+			})
+			console.AddHistory(fmt.Sprintf("[webhook] delivering received messages to %s", hookURL))
+		}
+	}
+
+	if gwAddr != "" {
+		gw, err := gateway.Listen(gwAddr, os.Getenv("TMD_GATEWAY_TOKEN"), poolSender{pool: pool, console: console, via: "gateway"})
+		if err != nil {
+			console.Errorf("%v", err)
+		} else {
+			defer gw.Close()
+			console.AddHistory(fmt.Sprintf("[gateway] accepting messages on %s/v1/messages", gw.URL()))
+		}
+	}
+
+	if grpcAddr != "" {
+		stop, err := startGRPCAPI(grpcAddr, pool, console)
+		if err != nil {
+			console.Errorf("%v", err)
+		} else {
+			defer stop()
+		}
+	}
+
+	if ircAddr != "" {
+		stop, err := startIRCServer(ircAddr, pool, console)
+		if err != nil {
+			console.Errorf("%v", err)
+		} else {
+			defer stop()
+		}
+	}
+
+	if matrixCfg != "" {
+		stop, err := startMatrixBridge(matrixCfg, pool, console)
+		if err != nil {
+			console.Errorf("%v", err)
+		} else {
+			defer stop()
+		}
+	}
+
+	if xmppCfg != "" {
+		stop, err := startXMPPGateway(xmppCfg, pool, console)
+		if err != nil {
+			console.Errorf("%v", err)
+		} else {
+			defer stop()
+		}
+	}
+
+	if devices != "" {
+		var list []PeerID
+		for _, d := range strings.Split(devices, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				list = append(list, PeerID(d))
+			}
+		}
+		if err := pool.setDevices(seed, list); err != nil {
+			console.Errorf("%v", err)
+		} else {
+			defer pool.startDeviceSync(deviceSyncInterval)()
+			console.AddHistory(fmt.Sprintf("[sync] syncing with %s", strings.Join(peerNames(list), ", ")))
+		}
+	}
+
+	rotate := "tmd identity rotate --seed " + seedSel.seed
+	if seedSel.identity != "" {
+		rotate = "tmd identity rotate --identity " + seedSel.identity
+	}
+	defer pool.startKeyReminders(keyAge{
+		Since:   seedFile.KeysSince(),
+		Expires: seedFile.Expires,
+		MaxAge:  time.Duration(keyMaxAge) * 24 * time.Hour,
+		Rotate:  rotate,
+	}, keyReminderInterval)()
+
+	if autoCfg != "" {
+		rules, err := loadAutoReplies(autoCfg)
+		if err != nil {
+			console.Errorf("%v", err)
+		} else {
+			pool.setAutoReplies(rules)
+			console.AddHistory(fmt.Sprintf("[autoreply] %d rules loaded", len(rules)))
+		}
+	}
+
+	var input Console = console
+	if emailCfg != "" {
+		c, stop, err := startEmailNotifier(emailCfg, nickname, pool, console)
+		if err != nil {
+			console.Errorf("%v", err)
+		} else {
+			input = c
+			defer stop()
+		}
+	}
 
 	// Setup stream handler for incoming connections
 	if err := pool.SetupStreamHandler(keys.HPKEPriv); err != nil {
@@ -112,63 +626,335 @@ func main() {
 	}
 
 	// Show startup info
-	console.Usage(PeerID(nickname), keys.KeyID, keys.Ed25519Pub, keys.HPKEPubBytes, keys.PeerID.String())
+	printUsage(console, PeerID(nickname), keys.KeyID, keys.Ed25519Pub, keys.HPKEPubBytes, keys.PeerID.String())
 
 	// Connect to discovery nodes if specified
 	if nodesStr != "" {
-		nodeAddrs := strings.Split(nodesStr, ",")
-		nodeClient := node.NewClient(h, nickname, token, keys.HPKEPubBytes, keys.KeyID, &peerHandler{
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		nodeAddrs, err := node.ResolveNodeAddrs(ctx, nil, strings.Split(nodesStr, ","))
+		cancel()
+		if err != nil {
+			console.Errorf("[node] %v", err)
+		}
+		handler := &peerHandler{
 			peerTable: peerTable,
 			console:   console,
 			pool:      pool,
-		})
+			contacts:  contacts,
+		}
+		nodeClient := node.NewClient(h, nickname, token, keys.HPKEPubBytes, keys.KeyID, handler)
+		pool.setPresenceApplier(func(f node.PresenceFilter) { handler.applyPresenceFilter(nodeClient, f) })
+		pool.setRoomDirectory(nodeClient)
+		pool.setMailbox(nodeClient)
+		pool.setPresenceAdvertiser(nodeClient)
+		pool.setRevocationPublisher(nodeClient)
+		if err := nodeClient.SetProfile(pool.ownProfile()); err != nil {
+			console.Errorf("[node] %v", err)
+		}
+		if err := nodeClient.SetKeySig(pool.keySig); err != nil {
+			console.Errorf("[node] %v", err)
+		}
+		pool.setRelayBroadcasts(relay)
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
 		if err := nodeClient.ConnectAll(ctx, nodeAddrs); err != nil {
 			console.Printf("[node] warning: %v\n", err)
 		}
 		cancel()
+		if err := nodeClient.WatchAddrs(context.Background()); err != nil {
+			console.Errorf("[node] %v", err)
+		}
 
 		// Show connected peers
 		for _, p := range nodeClient.GetAllPeers() {
 			console.AddHistory(fmt.Sprintf("[node] peer online: %s", p.Nickname))
 		}
-	} else {
+	} else if dhtKey == "" && pointAddr == "" && !lan {
 		console.AddHistory("[node] no discovery nodes specified, running in standalone mode")
 	}
 
+	if dhtKey != "" {
+		handler := &peerHandler{
+			peerTable: peerTable,
+			console:   console,
+			pool:      pool,
+			contacts:  contacts,
+		}
+		stop, err := startDHT(h, dhtKey, dhtBoot, handler, pool)
+		if err != nil {
+			console.Errorf("[dht] %v", err)
+		} else {
+			defer stop()
+			console.AddHistory(fmt.Sprintf("[dht] looking for peers under rendezvous key %q", dhtKey))
+		}
+	}
+
+	if gossip {
+		pool.setGossipBroadcastMin(gossipMin)
+		stop, err := pool.startGossip()
+		if err != nil {
+			console.Errorf("[gossip] %v", err)
+		} else {
+			defer stop()
+		}
+	}
+
+	if pointAddr != "" {
+		handler := &peerHandler{
+			peerTable: peerTable,
+			console:   console,
+			pool:      pool,
+			contacts:  contacts,
+		}
+		stop, err := startPoint(h, pointAddr, pointKey, handler, pool)
+		if err != nil {
+			console.Errorf("[rendezvous] %v", err)
+		} else {
+			defer stop()
+			console.AddHistory(fmt.Sprintf("[rendezvous] registered at %s under %q", pointAddr, pointKey))
+		}
+	}
+
+	if lan {
+		handler := &peerHandler{
+			peerTable: peerTable,
+			console:   console,
+			pool:      pool,
+			contacts:  contacts,
+		}
+		stop, err := startLAN(h, pool, handler)
+		if err != nil {
+			console.Errorf("[lan] %v", err)
+		} else {
+			defer stop()
+			console.AddHistory("[lan] looking for peers on the local network (mDNS)")
+		}
+	}
+
 	defer pool.AnnounceDisconnexion() // Announce disconnection to all peers before exiting
 
-	console.REPL(pool)
+	if rpcMode {
+		if err := runRPC(os.Stdin, os.Stdout, pool, console); err != nil {
+			console.Errorf("rpc: %v", err)
+		}
+		return
+	}
+	REPL(input, selfInfo, pool)
+}
+
+// secrets are wiped, last registered first, when main returns, exits
+// through exit or gets SIGINT or SIGTERM: os.Exit skips deferred calls,
+// and the signals would end the process without either.
+var (
+	secretsMu sync.Mutex
+	secrets   []func()
+)
+
+// onExit registers wipe to run before the process ends.
+func onExit(wipe func()) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets = append(secrets, wipe)
+}
+
+// wipeSecrets runs the wipes registered with onExit.
+func wipeSecrets() {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for i := len(secrets) - 1; i >= 0; i-- {
+		secrets[i]()
+	}
+	secrets = nil
+}
+
+// wipeOnSignal exits through exit on SIGINT or SIGTERM.
+func wipeOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	exit(128 + int(sig.(syscall.Signal)))
+}
+
+// exit wipes the secrets, then exits with code.
+func exit(code int) {
+	wipeSecrets()
+	os.Exit(code)
 }
 
 // peerHandler implements node.PeerHandler to receive peer events
 type peerHandler struct {
 	peerTable *PeerTable
-	console   *console
+	console   Console
 	pool      *connPool
+	contacts  *contact.Book // nil unless --contacts is set
 }
 
 func (h *peerHandler) OnPeerJoined(info node.PeerInfo, nodeID peer.ID) {
-	// Convert node.PeerInfo to main.PeerInfo
+	if err := checkKeySig(info); err != nil {
+		h.console.Errorf("node announced %s with an HPKE key it did not sign; ignoring it: %v", info.Nickname, err)
+		h.pool.auditf(audit.UnsignedKey, PeerID(info.Nickname), "announced by node %s: %v", nodeID, err)
+		return
+	}
+	if err := h.pool.refuseUnsigned(PeerID(info.Nickname), info.KeySig); err != nil {
+		h.console.Errorf("node announced %s without its key signature; ignoring it: %v", info.Nickname, err)
+		h.pool.auditf(audit.UnsignedKey, PeerID(info.Nickname), "announced by node %s: %v", nodeID, err)
+		return
+	}
+	peerInfo := peerInfoFromNode(info)
+	if card, ok := h.contacts.Get(info.Nickname); ok && (card.PeerID != info.PeerID.String() || !bytes.Equal(card.HPKEPub, info.HPKEPub)) {
+		h.console.Errorf("node announced %s with keys that differ from the scanned contact card; keeping the card", info.Nickname)
+		h.pool.auditf(audit.KeyMismatch, PeerID(info.Nickname), "announced by node %s with keys other than its contact card's", nodeID)
+		return
+	}
+	// The keys are checked before the peer goes in the table: one
+	// announced with keys other than its pinned or attested ones, or
+	// revoked, is left out, and nothing is sent to it.
+	h.followRotation(info, peerInfo)
+	if err := h.pool.observePeer(peerInfo); err != nil {
+		return
+	}
+	if err := h.pool.checkRevoked(peerInfo); err != nil {
+		h.console.Errorf("peer %s joined with a revoked key; ignoring it: %v", info.Nickname, err)
+		h.pool.auditf(audit.RevokedKey, peerInfo.Nickname, "announced by node %s: %v", nodeID, err)
+		return
+	}
+	status, e := h.pool.trustStatus(peerInfo)
+	if status == attest.Mismatch {
+		h.console.Errorf("peer %s joined with keys that do not match the identity attested by %s; ignoring it", info.Nickname, e.External)
+		h.pool.auditf(audit.KeyMismatch, peerInfo.Nickname, "announced by node %s with keys other than those attested by %s", nodeID, e.External)
+		return
+	}
+	h.pool.noteSigned(peerInfo.Nickname, info.KeySig)
+	h.peerTable.Add(peerInfo)
+	if status == attest.Verified {
+		h.pool.noteFrom(peerInfo.Nickname, fmt.Sprintf("[node] peer joined: %s (verified: %s)", info.Nickname, e.External))
+	} else {
+		h.pool.noteFrom(peerInfo.Nickname, fmt.Sprintf("[node] peer joined: %s", info.Nickname))
+	}
+	h.pool.notifyPresence(presenceEvent{Nickname: peerInfo.Nickname, Online: true})
+	h.pool.showPeerPresence(peerInfo.Nickname, peerInfo.Presence)
+	h.pool.sawPeer(peerInfo.Nickname, false)
+	h.pool.rememberPeer(peerInfo)
+	h.pool.learnProfile(peerInfo.Nickname, info.Profile, verifyPeerID(info.PeerID))
+	h.pool.resumeFilesFrom(peerInfo.Nickname)
+	h.pool.flushOutbox(peerInfo.Nickname)
+	h.pool.resumeBroadcasts(peerInfo.Nickname)
+	h.pool.fillMeshSoon()
+	h.pool.syncDevice(peerInfo.Nickname)
+}
+
+// OnPeerUpdated picks up the new addresses of a peer that roamed, so the
+// next dial reaches it without waiting for it to rejoin, or its new
+// presence.
+func (h *peerHandler) OnPeerUpdated(info node.PeerInfo, nodeID peer.ID) {
+	if err := checkKeySig(info); err != nil {
+		h.console.Errorf("node updated %s with an HPKE key it did not sign; ignoring it: %v", info.Nickname, err)
+		h.pool.auditf(audit.UnsignedKey, PeerID(info.Nickname), "updated by node %s: %v", nodeID, err)
+		return
+	}
+	if err := h.pool.refuseUnsigned(PeerID(info.Nickname), info.KeySig); err != nil {
+		h.console.Errorf("node updated %s without its key signature; ignoring it: %v", info.Nickname, err)
+		h.pool.auditf(audit.UnsignedKey, PeerID(info.Nickname), "updated by node %s: %v", nodeID, err)
+		return
+	}
+	if card, ok := h.contacts.Get(info.Nickname); ok && (card.PeerID != info.PeerID.String() || !bytes.Equal(card.HPKEPub, info.HPKEPub)) {
+		h.console.Errorf("node updated %s with keys that differ from the scanned contact card; keeping the card", info.Nickname)
+		h.pool.auditf(audit.KeyMismatch, PeerID(info.Nickname), "updated by node %s with keys other than its contact card's", nodeID)
+		return
+	}
+	peerInfo := peerInfoFromNode(info)
+	h.followRotation(info, peerInfo)
+	if err := h.pool.observePeer(peerInfo); err != nil {
+		return
+	}
+	if err := h.pool.checkRevoked(peerInfo); err != nil {
+		h.console.Errorf("node updated %s with a revoked key; ignoring it: %v", info.Nickname, err)
+		h.pool.auditf(audit.RevokedKey, peerInfo.Nickname, "updated by node %s: %v", nodeID, err)
+		return
+	}
+	if status, e := h.pool.trustStatus(peerInfo); status == attest.Mismatch {
+		h.console.Errorf("node updated %s with keys that do not match the identity attested by %s; ignoring it", info.Nickname, e.External)
+		h.pool.auditf(audit.KeyMismatch, peerInfo.Nickname, "updated by node %s with keys other than those attested by %s", nodeID, e.External)
+		return
+	}
+	h.pool.noteSigned(peerInfo.Nickname, info.KeySig)
+	old, known := h.peerTable.Get(peerInfo.Nickname)
+	h.peerTable.Add(peerInfo)
+	h.pool.host.Peerstore().AddAddrs(info.PeerID, info.Addrs, time.Hour)
+	h.pool.sawPeer(PeerID(info.Nickname), false)
+	h.pool.rememberPeer(peerInfo)
+	if known && orAvailable(old.Presence) != orAvailable(info.Presence) {
+		h.pool.showPeerPresence(PeerID(info.Nickname), info.Presence)
+		h.pool.noteFrom(PeerID(info.Nickname), fmt.Sprintf("[node] %s is now %s", info.Nickname, orAvailable(info.Presence)))
+		return
+	}
+	h.pool.noteFrom(PeerID(info.Nickname), fmt.Sprintf("[node] peer addresses updated: %s", info.Nickname))
+}
+
+// OnRoomMembers passes room memberships to the pool, which rekeys the room.
+func (h *peerHandler) OnRoomMembers(room string, members []string) {
+	h.pool.setRoomMembers(room, members)
+}
+
+// peerInfoFromNode converts a node.PeerInfo to main.PeerInfo.
+// followRotation moves the pin of a peer announced with an HPKE key its
+// identity key signed to that key (see keyage.go).
+func (h *peerHandler) followRotation(info node.PeerInfo, peerInfo PeerInfo) {
+	if len(info.KeySig) == 0 {
+		return
+	}
+	if key, err := identityKey(peerInfo); err == nil {
+		h.pool.followRotation(peerInfo.Nickname, key, peerInfo.HPKEPub, "the node")
+	}
+}
+
+func peerInfoFromNode(info node.PeerInfo) PeerInfo {
 	addrs := make([]multiaddr.Multiaddr, len(info.Addrs))
 	copy(addrs, info.Addrs)
 
-	peerInfo := PeerInfo{
+	return PeerInfo{
 		Nickname: PeerID(info.Nickname),
 		PeerID:   info.PeerID,
 		Addrs:    addrs,
 		HPKEPub:  info.HPKEPub,
 		KeyID:    info.KeyID,
+		Hints:    info.Hints,
+		Presence: info.Presence,
 	}
-	h.peerTable.Add(peerInfo)
-	h.console.AddHistory(fmt.Sprintf("[node] peer joined: %s", info.Nickname))
 }
 
 func (h *peerHandler) OnPeerLeft(nickname string, nodeID peer.ID) {
+	info, ok := h.peerTable.Get(PeerID(nickname))
+	if !ok {
+		info = PeerInfo{Nickname: PeerID(nickname)}
+	}
 	h.peerTable.Remove(PeerID(nickname))
+	h.pool.takeRefused(PeerID(nickname))
 	h.pool.RemoveSession(PeerID(nickname))
-	h.console.AddHistory(fmt.Sprintf("[node] peer left: %s", nickname))
+	h.pool.peerLeft(info)
+	h.pool.showPeerPresence(PeerID(nickname), "")
+	h.pool.sawPeer(PeerID(nickname), true)
+	h.pool.noteFrom(PeerID(nickname), fmt.Sprintf("[node] peer left: %s", nickname))
+	h.pool.notifyPresence(presenceEvent{Nickname: PeerID(nickname), Online: false})
+}
+
+// OnMail shows the messages peers left with a node while we were away.
+func (h *peerHandler) OnMail(from string, data []byte, nodeID peer.ID) {
+	if err := h.pool.handleMail(PeerID(from), data); err != nil {
+		h.console.Errorf("mail from %s: %v", from, err)
+	}
+}
+
+// OnAuthFailure records a node refusing our registration.
+func (h *peerHandler) OnAuthFailure(nodeID peer.ID, reason string) {
+	h.pool.auditf(audit.NodeAuth, "", "node %s: %s", nodeID, reason)
+}
+
+// OnRevocation checks the revocation statements peers published.
+func (h *peerHandler) OnRevocation(from string, statement []byte, nodeID peer.ID) {
+	if err := h.pool.handleRevocation(PeerID(from), statement); err != nil {
+		h.console.Errorf("revocation from %s: %v", from, err)
+	}
 }
 
 func (h *peerHandler) OnNodeConnected(nodeID peer.ID) {
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// maxMentions bounds the broadcasts mentioning us that /mentions lists;
+// the oldest go first.
+const maxMentions = 100
+
+// mentionConsole is implemented by consoles that can draw attention to a
+// history line, e.g. a broadcast mentioning the user.
+type mentionConsole interface {
+	// AddMention appends a highlighted line to the history and alerts
+	// the user.
+	AddMention(text string)
+}
+
+// mentionLog holds the broadcasts that mentioned us, oldest first.
+type mentionLog struct {
+	mu   sync.Mutex
+	list []mention
+}
+
+type mention struct {
+	at   time.Time
+	from PeerID
+	text string
+}
+
+// mentions returns the nicknames mentioned as @nickname in text, in order
+// and without repeats. Surrounding punctuation is not part of a nickname.
+func mentions(text string) []PeerID {
+	var out []PeerID
+	for word := range strings.FieldsSeq(text) {
+		name, ok := strings.CutPrefix(strings.TrimLeft(word, "(\"'"), "@")
+		if !ok {
+			continue
+		}
+		end := strings.IndexFunc(name, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' && r != '.'
+		})
+		if end >= 0 {
+			name = name[:end]
+		}
+		name = strings.TrimRight(name, ".")
+		if name != "" && !contains(out, PeerID(name)) {
+			out = append(out, PeerID(name))
+		}
+	}
+	return out
+}
+
+func contains(ids []PeerID, id PeerID) bool {
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
+// showBroadcastFrom shows a broadcast received from a peer, highlighted
+// when it mentions us. Broadcasts from muted peers are not shown.
+func (p *connPool) showBroadcastFrom(from PeerID, text string) {
+	if p.Muted(from) {
+		return
+	}
+	line := fmt.Sprintf("[broadcast from %s] %s", from, text)
+	if !contains(mentions(text), p.nickname) {
+		p.console.AddHistory(line)
+		return
+	}
+
+	p.mentions.mu.Lock()
+	p.mentions.list = append(p.mentions.list, mention{at: time.Now(), from: from, text: text})
+	if len(p.mentions.list) > maxMentions {
+		p.mentions.list = p.mentions.list[len(p.mentions.list)-maxMentions:]
+	}
+	p.mentions.mu.Unlock()
+
+	if mc, ok := p.console.(mentionConsole); ok {
+		mc.AddMention(line)
+		return
+	}
+	p.console.AddHistory(line)
+}
+
+// runMentions handles "/mentions": it lists the broadcasts that
+// mentioned us.
+func runMentions(c Console, pool *connPool) {
+	pool.mentions.mu.Lock()
+	list := append([]mention(nil), pool.mentions.list...)
+	pool.mentions.mu.Unlock()
+
+	if len(list) == 0 {
+		c.Printf("[mentions] none")
+		return
+	}
+	for _, m := range list {
+		c.Printf("[mentions] %s %s: %s", m.at.Format("15:04"), m.from, m.text)
+	}
+}
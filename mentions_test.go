@@ -0,0 +1,21 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMentions(t *testing.T) {
+	for text, want := range map[string][]PeerID{
+		"hi @bob":                   {"bob"},
+		"@bob, @carol. and @bob!":   {"bob", "carol"},
+		"ping @alice.smith... now":  {"alice.smith"},
+		"mail bob@example.org":      nil,
+		"just @ alone":              nil,
+		"(@dave) @eve_2: @frank-x?": {"dave", "eve_2", "frank-x"},
+	} {
+		if got := mentions(text); !slices.Equal(got, want) {
+			t.Errorf("mentions(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
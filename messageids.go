@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Message IDs tell resends apart from new messages. Each request carries
+// a random ID, kept when it is resent on a repaired session; the receiver
+// remembers the IDs it got from each peer for dedupWindow and shows a
+// message only the first time. The ID is also an idempotency key: the
+// receiver keeps the response it sent for as long, and answers a resend
+// with it rather than acting on the message again.
+const (
+	messageIDSize = 16
+	dedupWindow   = 10 * time.Minute
+	// dedupMax bounds the IDs remembered; the oldest go first.
+	dedupMax = 4096
+)
+
+func newMessageID() ([]byte, error) {
+	id := make([]byte, messageIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("message ID: %w", err)
+	}
+	return id, nil
+}
+
+// seenMessages are the message IDs received lately, by sender and ID,
+// with the responses sent to them.
+type seenMessages struct {
+	mu        sync.Mutex
+	at        map[string]time.Time
+	responses map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	mediaType string
+	text      string
+}
+
+func seenKey(from PeerID, id []byte) string {
+	return string(from) + "\x00" + string(id)
+}
+
+// firstSeen records a message ID from a peer and reports whether it is
+// new within the window. IDs are scoped to their sender, so a peer cannot
+// suppress another's messages by reusing their IDs.
+func (p *connPool) firstSeen(from PeerID, id []byte) bool {
+	key := seenKey(from, id)
+	now := time.Now()
+
+	p.seen.mu.Lock()
+	defer p.seen.mu.Unlock()
+	if at, ok := p.seen.at[key]; ok && now.Sub(at) < dedupWindow {
+		return false
+	}
+	if p.seen.at == nil {
+		p.seen.at = make(map[string]time.Time)
+	}
+	if len(p.seen.at) >= dedupMax {
+		p.seen.pruneLocked(now)
+	}
+	p.seen.at[key] = now
+	delete(p.seen.responses, key)
+	return true
+}
+
+// rememberResponse keeps the response sent to a message from a peer, for
+// resends of it. Messages without an ID are not kept.
+func (p *connPool) rememberResponse(from PeerID, id []byte, mediaType, text string) {
+	if len(id) == 0 {
+		return
+	}
+	key := seenKey(from, id)
+	p.seen.mu.Lock()
+	defer p.seen.mu.Unlock()
+	if _, ok := p.seen.at[key]; !ok {
+		return // expired since
+	}
+	if p.seen.responses == nil {
+		p.seen.responses = make(map[string]cachedResponse)
+	}
+	p.seen.responses[key] = cachedResponse{mediaType: mediaType, text: text}
+}
+
+// responseFor returns the response sent to an earlier copy of a message.
+func (p *connPool) responseFor(from PeerID, id []byte) (cachedResponse, bool) {
+	p.seen.mu.Lock()
+	defer p.seen.mu.Unlock()
+	r, ok := p.seen.responses[seenKey(from, id)]
+	return r, ok
+}
+
+// pruneLocked drops the expired IDs, or the oldest one if none expired.
+func (s *seenMessages) pruneLocked(now time.Time) {
+	var oldest string
+	var oldestAt time.Time
+	for k, at := range s.at {
+		if now.Sub(at) >= dedupWindow {
+			delete(s.at, k)
+			delete(s.responses, k)
+			continue
+		}
+		if oldest == "" || at.Before(oldestAt) {
+			oldest, oldestAt = k, at
+		}
+	}
+	if len(s.at) >= dedupMax {
+		delete(s.at, oldest)
+		delete(s.responses, oldest)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests whose media type has a registered Handler are routed to it
+// instead of being shown as direct messages: peers call each other's
+// named methods over the same sealed request/response exchange, e.g.
+// "application/x-tmd-rpc; method=getTime". Requests for a method nobody
+// registered get a failedRespMediaType response.
+const methodMediaTypeBase = "application/x-tmd-rpc"
+
+// methodMediaType is the media type of calls to a method.
+func methodMediaType(method string) string {
+	return mime.FormatMediaType(methodMediaTypeBase, map[string]string{"method": method})
+}
+
+// canonicalMediaType normalizes case, spacing and parameter order, so
+// equivalent media types route alike. Unparsable ones are kept as is.
+func canonicalMediaType(mediaType string) string {
+	base, params, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return mediaType
+	}
+	if s := mime.FormatMediaType(base, params); s != "" {
+		return s
+	}
+	return mediaType
+}
+
+// requestRoutes are the handlers registered with onRequest, by canonical
+// media type.
+type requestRoutes struct {
+	mu     sync.RWMutex
+	byType map[string]Handler
+}
+
+// onRequest routes requests of the given media type to h.
+func (p *connPool) onRequest(mediaType string, h Handler) {
+	p.routes.mu.Lock()
+	defer p.routes.mu.Unlock()
+	if p.routes.byType == nil {
+		p.routes.byType = make(map[string]Handler)
+	}
+	p.routes.byType[canonicalMediaType(mediaType)] = h
+}
+
+// onMethod serves calls to a named method with h.
+func (p *connPool) onMethod(method string, h Handler) {
+	p.onRequest(methodMediaType(method), h)
+}
+
+// route returns the Handler requests of mediaType are routed to. Method
+// calls nobody serves get one that fails them.
+func (p *connPool) route(mediaType string) (Handler, bool) {
+	mt := canonicalMediaType(mediaType)
+	p.routes.mu.RLock()
+	h, ok := p.routes.byType[mt]
+	p.routes.mu.RUnlock()
+	if ok {
+		return h, true
+	}
+	if base, params, err := mime.ParseMediaType(mt); err == nil && base == methodMediaTypeBase {
+		return HandlerFunc(func(context.Context, PeerInfo, string, []byte) (string, []byte, error) {
+			return "", nil, fmt.Errorf("no method %q", params["method"])
+		}), true
+	}
+	return nil, false
+}
+
+// Call calls a method of a peer with params and returns its result.
+func (p *connPool) Call(to PeerInfo, method string, params []byte) ([]byte, error) {
+	r, err := p.sendRequest(to, string(params), methodMediaType(method), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(r.Text), nil
+}
+
+// serveBuiltinMethods registers the methods every peer serves.
+func (p *connPool) serveBuiltinMethods() {
+	p.onMethod("getTime", HandlerFunc(func(context.Context, PeerInfo, string, []byte) (string, []byte, error) {
+		return "", []byte(time.Now().UTC().Format(time.RFC3339)), nil
+	}))
+}
+
+// runCall handles "/call <peer> <method> [params]".
+func runCall(c Console, pool *connPool, args string) {
+	fields := strings.SplitN(args, " ", 3)
+	if len(fields) < 2 {
+		c.Errorf("usage: /call <peer> <method> [params]")
+		return
+	}
+	to, ok := pool.peerTable.Get(PeerID(fields[0]))
+	if !ok {
+		c.Errorf("unknown peer: %s", fields[0])
+		return
+	}
+	var params string
+	if len(fields) == 3 {
+		params = fields[2]
+	}
+	method := fields[1]
+	go func() {
+		result, err := pool.Call(to, method, []byte(params))
+		if err != nil {
+			c.Errorf("call %s %s: %v", to.Nickname, method, err)
+			return
+		}
+		c.Printf("[call %s %s] %s", to.Nickname, method, result)
+	}()
+}
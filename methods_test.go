@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRouteByMediaType(t *testing.T) {
+	pool := newTestPool("alice")
+	pool.onMethod("sum", HandlerFunc(func(context.Context, PeerInfo, string, []byte) (string, []byte, error) {
+		return "", []byte("3"), nil
+	}))
+
+	for _, mt := range []string{
+		"application/x-tmd-rpc; method=sum",
+		"Application/X-TMD-RPC;Method=sum",
+		`application/x-tmd-rpc; method="sum"`,
+	} {
+		h, ok := pool.route(mt)
+		if !ok {
+			t.Fatalf("route(%q): not routed", mt)
+		}
+		if _, resp, err := h.Handle(context.Background(), PeerInfo{}, mt, nil); err != nil || string(resp) != "3" {
+			t.Errorf("route(%q) answered %q, %v", mt, resp, err)
+		}
+	}
+
+	if h, ok := pool.route(methodMediaType("nope")); !ok {
+		t.Error("unknown method: not routed")
+	} else if _, _, err := h.Handle(context.Background(), PeerInfo{}, "", nil); err == nil {
+		t.Error("unknown method: no error")
+	}
+	if _, ok := pool.route(interactiveReqMediaType); ok {
+		t.Error("direct messages are routed")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// muteList holds the peers muted with /mute. Muting is local: muted peers
+// still reach us and get receipts, but their direct messages only go to
+// the history, not the queue, and their typing, broadcasts and node
+// events are not shown.
+type muteList struct {
+	mu    sync.Mutex
+	peers map[PeerID]bool
+}
+
+// Mute mutes peer, and reports whether it was not muted yet.
+func (p *connPool) Mute(peer PeerID) bool {
+	p.mutes.mu.Lock()
+	defer p.mutes.mu.Unlock()
+	if p.mutes.peers[peer] {
+		return false
+	}
+	if p.mutes.peers == nil {
+		p.mutes.peers = make(map[PeerID]bool)
+	}
+	p.mutes.peers[peer] = true
+	return true
+}
+
+// Unmute unmutes peer, and reports whether it was muted.
+func (p *connPool) Unmute(peer PeerID) bool {
+	p.mutes.mu.Lock()
+	defer p.mutes.mu.Unlock()
+	if !p.mutes.peers[peer] {
+		return false
+	}
+	delete(p.mutes.peers, peer)
+	return true
+}
+
+// Muted reports whether peer is muted.
+func (p *connPool) Muted(peer PeerID) bool {
+	p.mutes.mu.Lock()
+	defer p.mutes.mu.Unlock()
+	return p.mutes.peers[peer]
+}
+
+// mutedPeers lists the muted peers, sorted.
+func (p *connPool) mutedPeers() []string {
+	p.mutes.mu.Lock()
+	defer p.mutes.mu.Unlock()
+	var list []string
+	for peer := range p.mutes.peers {
+		list = append(list, string(peer))
+	}
+	slices.Sort(list)
+	return list
+}
+
+// muteMark is shown after a muted peer's name in /peers.
+func (p *connPool) muteMark(peer PeerID) string {
+	if p.Muted(peer) {
+		return " [muted]"
+	}
+	return ""
+}
+
+// showDirectFrom shows a direct message received from a peer: queued and
+// in the history, only in the history if the peer is muted, or among the
+// requests if it is untrusted (see requests.go).
+func (p *connPool) showDirectFrom(from PeerID, text string) {
+	if p.Muted(from) {
+		p.console.AddHistory(fmt.Sprintf("[from %s] %s", from, text))
+		return
+	}
+	if p.untrusted(from) {
+		p.addRequest(from, text)
+		return
+	}
+	p.console.AddDirectMessage(from, text)
+}
+
+// noteFrom adds a line about a peer to the history, unless it is muted.
+func (p *connPool) noteFrom(peer PeerID, line string) {
+	if !p.Muted(peer) {
+		p.console.AddHistory(line)
+	}
+}
+
+var muteCommands = map[string]bool{"/mute": true, "/unmute": true, "/muted": true}
+
+// runMuteCommand handles "/mute <peer>...", "/unmute <peer>..." and
+// "/muted".
+func runMuteCommand(c Console, pool *connPool, cmd string, nicks []string) {
+	if cmd != "/muted" && len(nicks) == 0 {
+		c.Errorf("usage: %s <peer>...", cmd)
+		return
+	}
+	for _, nick := range nicks {
+		switch cmd {
+		case "/mute":
+			if pool.Mute(PeerID(nick)) {
+				pool.clearTyping(PeerID(nick))
+			}
+		case "/unmute":
+			if !pool.Unmute(PeerID(nick)) {
+				c.Errorf("%s is not muted", nick)
+			}
+		}
+	}
+	muted := "nobody"
+	if list := pool.mutedPeers(); len(list) > 0 {
+		muted = strings.Join(list, ", ")
+	}
+	c.Printf("[mute] muted: %s", muted)
+}
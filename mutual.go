@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	"github.com/pivaldi/tmd/internal/audit"
+)
+
+// The listener signs a HELLO too, so that the dialer checks the keys of
+// the peer it dialed rather than trusting the libp2p peer ID alone. Once
+// it accepted the dialer's HELLO, the listener answers with a
+// RESPONDER_HELLO before any other frame: its own keys, signed over
+// "tmd responder hello v1" || 0 || the bytes the dialer's HELLO signed
+// (the challenge and, if bound, the binding), so it answers this HELLO and
+// cannot be taken for a dialer's. The dialer checks the signature, that
+// the keys are those it dialed and sealed to, and that they match the
+// peer's pin, and drops the session otherwise. The listener says it
+// answers by offering featureMutual (see features.go); dialers predating
+// responder HELLOs skip the frame as unknown, and listeners predating
+// them are trusted by their peer ID as before.
+const responderContext = "tmd responder hello v1"
+
+// responderSignInput returns the bytes a responder HELLO's signature
+// covers, for a dialer's HELLO that signed signed.
+func responderSignInput(signed []byte, h Hello) []byte {
+	return append([]byte(responderContext+"\x00"), helloSignInput(signed, h)...)
+}
+
+// responderHello returns our RESPONDER_HELLO for a dialer's HELLO that
+// signed signed.
+func (p *connPool) responderHello(signed []byte) ([]byte, error) {
+	h := Hello{
+		SenderID:      p.nickname,
+		SenderKeyID:   p.keyID,
+		SenderEdPub:   p.selfEdPub(),
+		SenderHPKEPub: p.selfHPKEPubBytes,
+		KeySig:        p.keySig,
+	}
+	sig, err := p.selfSigner.Sign(nil, responderSignInput(signed, h), crypto.Hash(0))
+	if err != nil {
+		return nil, fmt.Errorf("sign responder hello: %w", err)
+	}
+	h.Signature = sig
+	return encodeHello(h), nil
+}
+
+// responderCheck returns the check of the first frame of a session to to
+// whose HELLO signed signed: the RESPONDER_HELLO.
+func (p *connPool) responderCheck(to PeerInfo, signed []byte) func(typ byte, payload []byte) error {
+	return func(typ byte, payload []byte) error {
+		h, err := verifyResponder(to, signed, typ, payload)
+		if err != nil {
+			p.console.Errorf("[%s] %s: responder verify failed: %v", p.nickname, to.Nickname, err)
+			p.auditf(audit.HelloFailed, to.Nickname, "responder HELLO from %s: %v", to.PeerID, err)
+			return err
+		}
+		if len(h.KeySig) > 0 {
+			p.followRotation(to.Nickname, h.SenderEdPub, h.SenderHPKEPub, "its responder Hello")
+		}
+		if err := p.refuseUnsigned(to.Nickname, h.KeySig); err != nil {
+			p.console.Errorf("[%s] %s: responder verify failed: %v", p.nickname, to.Nickname, err)
+			p.auditf(audit.UnsignedKey, to.Nickname, "responder HELLO from %s: %v", to.PeerID, err)
+			return err
+		}
+		if err := p.observeKeys(to.Nickname, h.SenderEdPub, h.SenderHPKEPub, "its responder Hello"); err != nil {
+			return err
+		}
+		p.noteSigned(to.Nickname, h.KeySig)
+		return nil
+	}
+}
+
+// verifyResponder checks a RESPONDER_HELLO from to, whose HELLO signed
+// signed, against the keys we dialed it with.
+func verifyResponder(to PeerInfo, signed []byte, typ byte, payload []byte) (Hello, error) {
+	if typ != msgRespHello {
+		return Hello{}, fmt.Errorf("expected RESPONDER_HELLO, got %d", typ)
+	}
+	h, err := decodeHello(payload)
+	if err != nil {
+		return Hello{}, err
+	}
+	if len(h.SenderEdPub) != ed25519.PublicKeySize || len(h.Signature) != ed25519.SignatureSize {
+		return Hello{}, errors.New("bad key or signature length")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(h.SenderEdPub), responderSignInput(signed, h), h.Signature) {
+		return Hello{}, fmt.Errorf("invalid signature for %s", h.SenderID)
+	}
+	if err := checkHelloKeySig(h); err != nil {
+		return Hello{}, err
+	}
+	if h.SenderID != to.Nickname {
+		return Hello{}, fmt.Errorf("answered as %s", h.SenderID)
+	}
+	key, err := identityKey(to)
+	if err != nil {
+		return Hello{}, err
+	}
+	if !bytes.Equal(h.SenderEdPub, key) {
+		return Hello{}, errors.New("identity key does not match its peer ID")
+	}
+	if !to.KeyID.Matches(h.SenderKeyID) || !bytes.Equal(h.SenderHPKEPub, to.HPKEPub) {
+		return Hello{}, errors.New("HPKE key differs from the one we sealed to")
+	}
+	return h, nil
+}
+
+// acceptResponder passes the first frame of the stream to the check of
+// the responder HELLO ps waits for.
+func (ps *peerSession) acceptResponder(typ byte, payload []byte) error {
+	check := ps.checkResponder
+	ps.checkResponder = nil
+	return check(typ, payload)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pivaldi/tmd/internal/conformance"
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+// TestResponderHello checks that the dialer accepts the listener's
+// RESPONDER_HELLO only for its own HELLO and with the keys it dialed.
+func TestResponderHello(t *testing.T) {
+	alice, err := identity.DeriveKeysWith(conformance.Hex(aliceSeed), seedDerivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := identity.DeriveKeysWith(conformance.Hex(bobSeed), seedDerivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newConnPool(nil, NewPeerTable(), supportedSuites[0], nil, "bob", bob.KeyID, bob.Ed25519Priv, bob.HPKEPubBytes)
+	signed := conformance.Hex(challenge)
+	payload, err := p.responderHello(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := PeerInfo{Nickname: "bob", PeerID: bob.PeerID, HPKEPub: bob.HPKEPubBytes, KeyID: bob.KeyID}
+	if _, err := verifyResponder(to, signed, msgRespHello, payload); err != nil {
+		t.Fatalf("responder HELLO rejected: %v", err)
+	}
+
+	// Another frame first, another challenge, or other keys than dialed.
+	if _, err := verifyResponder(to, signed, msgResponse, payload); err == nil {
+		t.Fatal("accepted another frame in place of the responder HELLO")
+	}
+	if _, err := verifyResponder(to, signed[1:], msgRespHello, payload); err == nil {
+		t.Fatal("responder HELLO verified for another challenge")
+	}
+	for name, other := range map[string]PeerInfo{
+		"nickname": {Nickname: "carol", PeerID: bob.PeerID, HPKEPub: bob.HPKEPubBytes, KeyID: bob.KeyID},
+		"peer ID":  {Nickname: "bob", PeerID: alice.PeerID, HPKEPub: bob.HPKEPubBytes, KeyID: bob.KeyID},
+		"HPKE key": {Nickname: "bob", PeerID: bob.PeerID, HPKEPub: alice.HPKEPubBytes, KeyID: alice.KeyID},
+	} {
+		if _, err := verifyResponder(other, signed, msgRespHello, payload); err == nil {
+			t.Fatalf("responder HELLO accepted with another %s", name)
+		}
+	}
+
+	// Nor does it pass for a dialer's HELLO.
+	h, err := decodeHello(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySignedHello(nil, signed, h); err == nil {
+		t.Fatal("a responder HELLO verified as a dialer's")
+	}
+}
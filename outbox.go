@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/history"
+	"github.com/pivaldi/tmd/internal/node"
+)
+
+// outboxState holds the direct messages typed for peers that were
+// offline. They are sent, in order, when the peer joins again; with
+// --history they survive restarts.
+type outboxState struct {
+	mu       sync.Mutex
+	store    *history.Store // nil: kept in memory only
+	next     uint64
+	pending  []history.Outgoing
+	left     map[PeerID]PeerInfo // peers seen leaving, as last known: messages to them are queued
+	flushing map[PeerID]bool
+}
+
+// offlineError is returned by sends that could not reach the peer, before
+// anything was written.
+type offlineError struct {
+	peer PeerID
+	err  error
+}
+
+func (e *offlineError) Error() string { return fmt.Sprintf("connect to %s: %v", e.peer, e.err) }
+func (e *offlineError) Unwrap() error { return e.err }
+
+// setOutboxStore restores the outbox kept in s and keeps it there.
+func (p *connPool) setOutboxStore(s *history.Store) error {
+	out, err := s.Outbox()
+	if err != nil {
+		return err
+	}
+	p.outbox.mu.Lock()
+	p.outbox.store = s
+	p.outbox.pending = out
+	for _, o := range out {
+		p.outbox.next = max(p.outbox.next, o.ID)
+	}
+	p.outbox.mu.Unlock()
+
+	p.showOutbox()
+	return nil
+}
+
+// peerLeft notes that a peer went offline, so messages to it are queued
+// rather than refused as sent to an unknown peer. Its keys, if known, are
+// kept to leave the messages with the nodes too.
+func (p *connPool) peerLeft(info PeerInfo) {
+	p.outbox.mu.Lock()
+	defer p.outbox.mu.Unlock()
+	if p.outbox.left == nil {
+		p.outbox.left = make(map[PeerID]PeerInfo)
+	}
+	p.outbox.left[info.Nickname] = info
+}
+
+// queuesFor reports whether messages to a peer that is not online go to
+// the outbox: it left while we watched, or messages to it already wait.
+func (p *connPool) queuesFor(nickname PeerID) bool {
+	p.outbox.mu.Lock()
+	defer p.outbox.mu.Unlock()
+	_, left := p.outbox.left[nickname]
+	return left || slices.ContainsFunc(p.outbox.pending, func(o history.Outgoing) bool {
+		return PeerID(o.To) == nickname
+	})
+}
+
+// leftDevices returns the peers that left, nickname itself or devices of
+// it (see PeerTable.Devices), by name.
+func (p *connPool) leftDevices(nickname PeerID) []PeerID {
+	p.outbox.mu.Lock()
+	defer p.outbox.mu.Unlock()
+	var names []PeerID
+	for name := range p.outbox.left {
+		if name == nickname || strings.HasPrefix(string(name), string(nickname)+node.DeviceSep) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// queueOutgoing adds a message to the outbox, and leaves it with the
+// nodes when the peer's keys are known (see mailbox.go).
+func (p *connPool) queueOutgoing(to PeerID, msg string) error {
+	id, err := newMessageID()
+	if err != nil {
+		return err
+	}
+	p.outbox.mu.Lock()
+	p.outbox.next++
+	o := history.Outgoing{ID: p.outbox.next, To: string(to), Message: msg, Time: time.Now(), MessageID: id}
+	p.outbox.pending = append(p.outbox.pending, o)
+	store := p.outbox.store
+	info := p.outbox.left[to]
+	p.outbox.mu.Unlock()
+
+	p.showOutbox()
+	if len(info.HPKEPub) > 0 {
+		if _, err := p.depositMail(info, msg, id); err != nil {
+			p.console.Errorf("mail to %s: %v", to, err)
+		}
+	}
+	if store != nil {
+		return store.PutOutgoing(o)
+	}
+	return nil
+}
+
+// dropOutgoing removes message id from the outbox and reports whether it
+// was there.
+func (p *connPool) dropOutgoing(id uint64) bool {
+	p.outbox.mu.Lock()
+	i := slices.IndexFunc(p.outbox.pending, func(o history.Outgoing) bool { return o.ID == id })
+	if i < 0 {
+		p.outbox.mu.Unlock()
+		return false
+	}
+	p.outbox.pending = slices.Delete(p.outbox.pending, i, i+1)
+	store := p.outbox.store
+	p.outbox.mu.Unlock()
+
+	p.showOutbox()
+	if store != nil {
+		if err := store.DeleteOutgoing(id); err != nil {
+			p.console.Errorf("outbox: %v", err)
+		}
+	}
+	return true
+}
+
+// Outbox returns the queued messages, oldest first.
+func (p *connPool) Outbox() []history.Outgoing {
+	p.outbox.mu.Lock()
+	defer p.outbox.mu.Unlock()
+	return slices.Clone(p.outbox.pending)
+}
+
+// showOutbox keeps the number of queued messages in the status area.
+func (p *connPool) showOutbox() {
+	n := len(p.Outbox())
+	if n == 0 {
+		p.setStatus("outbox", "")
+		return
+	}
+	p.setStatus("outbox", fmt.Sprintf("%d in outbox", n))
+}
+
+// flushOutbox sends the messages queued for a peer that joined, oldest
+// first, each once the previous one is on the wire. It stops at the first
+// failure; the rest wait for the next join.
+func (p *connPool) flushOutbox(nickname PeerID) {
+	p.outbox.mu.Lock()
+	delete(p.outbox.left, nickname)
+	if p.outbox.flushing[nickname] {
+		p.outbox.mu.Unlock()
+		return
+	}
+	if p.outbox.flushing == nil {
+		p.outbox.flushing = make(map[PeerID]bool)
+	}
+	p.outbox.flushing[nickname] = true
+	p.outbox.mu.Unlock()
+
+	go func() {
+		defer func() {
+			p.outbox.mu.Lock()
+			delete(p.outbox.flushing, nickname)
+			p.outbox.mu.Unlock()
+		}()
+		for {
+			i := slices.IndexFunc(p.Outbox(), func(o history.Outgoing) bool { return PeerID(o.To) == nickname })
+			if i < 0 {
+				return
+			}
+			o := p.Outbox()[i]
+			to, ok := p.peerTable.Get(nickname)
+			if !ok {
+				return
+			}
+			sent := make(chan struct{})
+			failed := make(chan struct{})
+			sendDirect(p.console, p, to, o.Message, o.MessageID, func() { close(sent) }, func(err error) {
+				p.console.Errorf("outbox: %s still unreachable: %v", nickname, err)
+				close(failed)
+			})
+			select {
+			case <-sent:
+				p.dropOutgoing(o.ID)
+			case <-failed:
+				return
+			}
+		}
+	}()
+}
+
+// runOutboxCommand handles "/outbox" and "/unqueue <n>".
+func runOutboxCommand(c Console, pool *connPool, cmd, args string) {
+	if cmd == "/unqueue" {
+		id, err := strconv.ParseUint(args, 10, 64)
+		if err != nil {
+			c.Errorf("usage: /unqueue <n>")
+			return
+		}
+		if !pool.dropOutgoing(id) {
+			c.Errorf("no message %d in the outbox", id)
+			return
+		}
+		c.Printf("[outbox] message %d dropped", id)
+		return
+	}
+
+	out, others := pool.Outbox(), pool.deviceOutboxes()
+	n := len(out)
+	for _, list := range others {
+		n += len(list)
+	}
+	if n == 0 {
+		c.Printf("[outbox] empty")
+		return
+	}
+	for _, o := range out {
+		c.Printf("%d  to %s, queued %s: %s", o.ID, o.To, o.Time.Format("Jan 2 15:04"), o.Message)
+	}
+	// Those of our other devices are sent by them.
+	for _, d := range slices.Sorted(maps.Keys(others)) {
+		for _, o := range others[d] {
+			c.Printf("-  to %s, queued %s on %s: %s", o.To, o.Time.Format("Jan 2 15:04"), d, o.Message)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// With --pad, plaintexts sealed with twoway (requests, responses,
+// notifies, mail) are padded to a size bucket first, so the nodes and
+// anyone watching the network only learn the bucket of a message, not
+// its length. The padding is an 0x80 byte followed by zeros (ISO/IEC
+// 7816-4), and the sealed media type gets paddedSuffix so the receiver
+// knows to strip it; the media type is bound to the ciphertext, so the
+// suffix cannot be added or removed on the way. Streams, rooms and
+// channels are not padded.
+const paddedSuffix = "; padded=1"
+
+// padBuckets are the sizes padded plaintexts are rounded up to; larger
+// ones are rounded up to a multiple of the last.
+var padBuckets = []int{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10}
+
+// padSize returns the bucket for n bytes of plaintext and the 0x80 byte.
+func padSize(n int) int {
+	n++
+	for _, b := range padBuckets {
+		if n <= b {
+			return b
+		}
+	}
+	last := padBuckets[len(padBuckets)-1]
+	return (n + last - 1) / last * last
+}
+
+// pad returns plain padded to its bucket.
+func pad(plain []byte) []byte {
+	out := make([]byte, padSize(len(plain)))
+	copy(out, plain)
+	out[len(plain)] = 0x80
+	return out
+}
+
+// unpad strips what pad added.
+func unpad(padded []byte) ([]byte, error) {
+	// Scan bytes, not runes: the plaintext may be binary (see ratchets.go),
+	// and 0x80 may continue a UTF-8 sequence.
+	i := len(padded) - 1
+	for i >= 0 && padded[i] == 0 {
+		i--
+	}
+	if i < 0 || padded[i] != 0x80 {
+		return nil, errors.New("bad padding")
+	}
+	return padded[:i], nil
+}
+
+// baseMediaType returns a sealed media type without paddedSuffix and
+// ratchetSuffix, for checks made before or after opening.
+func baseMediaType(mediaType []byte) string {
+	mt, _ := strings.CutSuffix(string(mediaType), paddedSuffix)
+	mt, _ = strings.CutSuffix(mt, ratchetSuffix)
+	return mt
+}
+
+// unpadOpened strips the padding from a plaintext opened under mediaType,
+// if it was padded, and returns the media type it was sent as.
+func unpadOpened(mediaType, plain []byte) ([]byte, []byte, error) {
+	mt, padded := strings.CutSuffix(string(mediaType), paddedSuffix)
+	if !padded {
+		return mediaType, plain, nil
+	}
+	plain, err := unpad(plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []byte(mt), plain, nil
+}
+
+// padFor returns the media type and plaintext to seal: padded when on.
+func padFor(on bool, mediaType, msg string) (string, string) {
+	if !on {
+		return mediaType, msg
+	}
+	return mediaType + paddedSuffix, string(pad([]byte(msg)))
+}
+
+// setPadding turns padding of what we seal on or off; it is set before
+// anything is sent.
+func (p *connPool) setPadding(on bool) {
+	p.padding = on
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPadRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 255, 256, 1000, 70000} {
+		plain := bytes.Repeat([]byte{0}, n) // trailing zeros are kept
+		padded := pad(plain)
+		if len(padded) != padSize(n) || len(padded) <= n {
+			t.Fatalf("pad(%d bytes) = %d bytes", n, len(padded))
+		}
+		got, err := unpad(padded)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("unpad(pad(%d bytes)) = %d bytes, %v", n, len(got), err)
+		}
+	}
+	if got := padSize(255); got != 256 {
+		t.Fatalf("padSize(255) = %d, want 256", got)
+	}
+	if got := padSize(256); got != 1024 {
+		t.Fatalf("padSize(256) = %d, want 1024", got)
+	}
+	if got := padSize(64 << 10); got != 128<<10 {
+		t.Fatalf("padSize(64 KiB) = %d, want 128 KiB", got)
+	}
+	// 0xC2 0x80 is a UTF-8 rune; the marker is still found.
+	if got, err := unpad(pad([]byte{0xC2})); err != nil || !bytes.Equal(got, []byte{0xC2}) {
+		t.Fatalf("unpad(pad(C2)) = %x, %v", got, err)
+	}
+	if _, err := unpad(make([]byte, 16)); err == nil {
+		t.Fatal("unpad accepted all zeros")
+	}
+}
+
+func TestSealPadsToBuckets(t *testing.T) {
+	p := newTestPool("alice")
+	pub, _, err := p.kemScheme.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, _ := pub.MarshalBinary()
+	bob := PeerInfo{Nickname: "bob", HPKEPub: pubBytes, KeyID: make([]byte, KeyIDSize)}
+
+	size := func(msg string) int {
+		req, _, err := p.seal(bob, msg, notifyMediaType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(req.Ciphertext)
+	}
+	if size("a") == size(strings.Repeat("a", 200)) {
+		t.Fatal("unpadded ciphertexts of different lengths have one size")
+	}
+
+	p.setPadding(true)
+	short, long := size("a"), size(strings.Repeat("a", 200))
+	if short != long {
+		t.Fatalf("padded ciphertexts: %d and %d bytes", short, long)
+	}
+	if size(strings.Repeat("a", 300)) == short {
+		t.Fatal("a longer message stayed in the first bucket")
+	}
+	req, _, _ := p.seal(bob, "a", notifyMediaType)
+	if string(req.MediaType) != notifyMediaType+paddedSuffix || baseMediaType(req.MediaType) != notifyMediaType {
+		t.Fatalf("media type = %q", req.MediaType)
+	}
+}
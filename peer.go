@@ -1,14 +1,21 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/cloudflare/circl/hpke"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
+	"github.com/pivaldi/tmd/internal/keyid"
+	"github.com/pivaldi/tmd/internal/node"
+	"github.com/pivaldi/tmd/internal/ratchet"
 )
 
 // PeerID is now the nickname (string identifier for the peer)
@@ -20,7 +27,9 @@ type PeerInfo struct {
 	PeerID   peer.ID               // libp2p peer ID
 	Addrs    []multiaddr.Multiaddr // peer's addresses
 	HPKEPub  []byte                // HPKE public key for encryption
-	KeyID    []byte                // 8-byte key fingerprint
+	KeyID    keyid.KeyID           // 8-byte key fingerprint
+	Hints    []node.AddrHint       // node annotations, parallel to Addrs when set
+	Presence string                // available, away or busy; empty: available
 }
 
 // PeerTable manages dynamically discovered peers
@@ -61,6 +70,34 @@ func (pt *PeerTable) Get(nickname PeerID) (PeerInfo, bool) {
 	return *p, true
 }
 
+// ByPeerID retrieves a peer by libp2p peer ID
+func (pt *PeerTable) ByPeerID(id peer.ID) (PeerInfo, bool) {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+	for _, p := range pt.peers {
+		if p.PeerID == id {
+			return *p, true
+		}
+	}
+	return PeerInfo{}, false
+}
+
+// Devices returns the online peers a message to nickname goes to: the
+// peer itself and each of its devices (see node.DeviceName), by name. A
+// device name only matches itself.
+func (pt *PeerTable) Devices(nickname PeerID) []PeerInfo {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+	var result []PeerInfo
+	for name, p := range pt.peers {
+		if name == nickname || strings.HasPrefix(string(name), string(nickname)+node.DeviceSep) {
+			result = append(result, *p)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Nickname < result[j].Nickname })
+	return result
+}
+
 // All returns all peers in the table
 func (pt *PeerTable) All() []PeerInfo {
 	pt.mu.RLock()
@@ -76,24 +113,71 @@ type peerSession struct {
 	to     PeerInfo
 	stream network.Stream
 
-	writeMu sync.Mutex
+	sendLimit uint32 // peer's frame limit
+	fragments bool   // peer reassembles fragmented messages
+	recvLimit uint32 // our advertised frame limit
+
+	suite hpke.Suite // negotiated in the handshake (see suites.go)
+
+	writes sendQueue // interactive requests first, bulk frames last
+	hello  *Hello    // held for the first request until written (see early.go); guarded by writes
 
 	nextID uint64
 
 	pendingMu sync.Mutex
 	pending   map[uint64]chan Response
+	streams   map[uint64]*streamBody     // response ciphertexts of SendStream
+	windows   map[uint64]*streamWindow   // credit left to SendStream request bodies
+	receipts  map[uint64]func(kind byte) // interactive requests awaiting receipts
+
+	dead     atomic.Bool
+	closed   atomic.Bool        // closed on purpose: goodbye, peer left, shutdown
+	onLost   func(*peerSession) // called once if the stream fails otherwise
+	lostOnce sync.Once
 
-	dead atomic.Bool
+	onChannel func(typ byte, payload []byte) // CHAN_* frames (see channels.go)
+
+	checkResponder func(typ byte, payload []byte) error // the first frame, if the listener answers HELLOs (see mutual.go)
+
+	completeRatchet func(listenerPub []byte) (*ratchet.Session, error) // until the RATCHET frame
+	ratchet         atomic.Pointer[ratchet.Session]                    // nil until then (see ratchets.go)
+	ratcheted       chan struct{}                                      // closed once requests may be sealed; nil to not wait (see early.go)
+	ratchetOnce     sync.Once
+
+	takesKeys bool                        // the listener offers featureSessionKeys (see sessionkeys.go)
+	keying    atomic.Bool                 // a request keying the session was sealed
+	keys      atomic.Pointer[sessionKeys] // nil until the response to that request opened
 }
 
+// errSessionLost is returned by DoRequest when the stream failed before the
+// response arrived. The request may be resubmitted on a repaired session.
+var errSessionLost = errors.New("connection lost")
+
 func (ps *peerSession) isAlive() bool {
 	return ps != nil && !ps.dead.Load()
 }
 
+// close tears the session down on purpose; it is not repaired.
+func (ps *peerSession) close() {
+	ps.closed.Store(true)
+	ps.failAll()
+}
+
+// broken tears down a session whose stream failed and, unless it was
+// closed on purpose, reports it so the pool can repair it. onLost runs
+// before the waiters are released so that they find the repair under way.
+func (ps *peerSession) broken() {
+	if !ps.closed.Load() && ps.onLost != nil {
+		ps.lostOnce.Do(func() { ps.onLost(ps) })
+	}
+	ps.failAll()
+}
+
 func (ps *peerSession) failAll() {
 	if ps.dead.CompareAndSwap(false, true) {
 		_ = ps.stream.Close()
 	}
+	ps.ratchetReady() // the request fails to send rather than wait
 
 	ps.pendingMu.Lock()
 	defer ps.pendingMu.Unlock()
@@ -101,15 +185,52 @@ func (ps *peerSession) failAll() {
 		delete(ps.pending, id)
 		close(ch) // best-effort unblock waiters
 	}
+	clear(ps.receipts)
+	for id, body := range ps.streams {
+		delete(ps.streams, id)
+		body.abort(errSessionLost)
+	}
+	for id, window := range ps.windows {
+		delete(ps.windows, id)
+		window.close()
+	}
 }
 
 func (ps *peerSession) readLoop() {
 	for {
-		typ, payload, err := readMsg(ps.stream)
+		typ, payload, err := readMessage(ps.stream, ps.recvLimit)
 		if err != nil {
-			ps.failAll()
+			ps.broken()
 			return
 		}
+		if ps.checkResponder != nil {
+			if err := ps.acceptResponder(typ, payload); err != nil {
+				ps.close()
+				return
+			}
+			continue
+		}
+		if typ == msgStreamData || typ == msgStreamEnd || typ == msgStreamCred {
+			ps.streamFrame(typ, payload)
+			continue
+		}
+		if typ == msgReceipt {
+			ps.receipt(payload)
+			continue
+		}
+		if typ == msgRatchet {
+			if err := ps.acceptRatchet(payload); err != nil {
+				ps.broken()
+				return
+			}
+			continue
+		}
+		if typ == msgChanData || typ == msgChanClose || typ == msgChanRekey {
+			if ps.onChannel != nil {
+				ps.onChannel(typ, payload)
+			}
+			continue
+		}
 		if typ != msgResponse {
 			// For this demo, outbound sessions only expect responses.
 			continue
@@ -131,9 +252,16 @@ func (ps *peerSession) readLoop() {
 	}
 }
 
-func (ps *peerSession) DoRequest(req Request) (Response, error) {
+// DoRequest sends req and waits for its response, for req.Timeout if it
+// is set. sent is called once the request is written; receipt, if not
+// nil, with the kind of each receipt the receiver sends for it, which may
+// come after the response.
+func (ps *peerSession) DoRequest(req Request, sent func(), receipt func(kind byte)) (Response, error) {
 	if ps.dead.Load() {
-		return Response{}, fmt.Errorf("session is closed")
+		if ps.closed.Load() {
+			return Response{}, fmt.Errorf("session is closed")
+		}
+		return Response{}, errSessionLost
 	}
 
 	id := atomic.AddUint64(&ps.nextID, 1)
@@ -142,25 +270,99 @@ func (ps *peerSession) DoRequest(req Request) (Response, error) {
 	ch := make(chan Response, 1)
 	ps.pendingMu.Lock()
 	ps.pending[id] = ch
+	if receipt != nil {
+		ps.receipts[id] = receipt
+	}
 	ps.pendingMu.Unlock()
 
-	ps.writeMu.Lock()
-	err := writeMsg(ps.stream, msgRequest, encodeRequest(req))
-	ps.writeMu.Unlock()
+	err := ps.writes.do(requestClass(req), func() error {
+		return ps.writeRequest(req)
+	})
 	if err != nil {
 		ps.pendingMu.Lock()
 		delete(ps.pending, id)
+		delete(ps.receipts, id)
 		ps.pendingMu.Unlock()
-		return Response{}, err
+		var tooLarge *frameTooLargeError
+		if errors.As(err, &tooLarge) {
+			return Response{}, fmt.Errorf("to %s: %w", ps.to.Nickname, err)
+		}
+		ps.broken()
+		return Response{}, fmt.Errorf("%w: %v", errSessionLost, err)
 	}
+	sent()
 
-	resp, ok := <-ch
+	var expired <-chan time.Time
+	if req.Timeout > 0 {
+		timer := time.NewTimer(req.Timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var resp Response
+	var ok bool
+	select {
+	case resp, ok = <-ch:
+	case <-expired:
+		ps.pendingMu.Lock()
+		delete(ps.pending, id)
+		delete(ps.receipts, id)
+		ps.pendingMu.Unlock()
+		return Response{}, fmt.Errorf("%w: no response from %s within %s", errRequestExpired, ps.to.Nickname, req.Timeout.Round(time.Millisecond))
+	}
 	if !ok {
-		return Response{}, fmt.Errorf("connection closed")
+		if ps.closed.Load() {
+			return Response{}, fmt.Errorf("connection closed")
+		}
+		return Response{}, errSessionLost
 	}
 	return resp, nil
 }
 
+// receipt passes a RECEIPT on to the request it is for. A read receipt is
+// the last one a request gets.
+func (ps *peerSession) receipt(payload []byte) {
+	r, err := decodeReceipt(payload)
+	if err != nil {
+		return
+	}
+	ps.pendingMu.Lock()
+	fn := ps.receipts[r.RequestID]
+	if r.Kind == receiptRead {
+		delete(ps.receipts, r.RequestID)
+	}
+	ps.pendingMu.Unlock()
+	if fn != nil {
+		fn(r.Kind)
+	}
+}
+
+// send writes a message that expects nothing in return (a notify or a
+// room message).
+func (ps *peerSession) send(typ byte, payload []byte) error {
+	if ps.dead.Load() {
+		if ps.closed.Load() {
+			return fmt.Errorf("session is closed")
+		}
+		return errSessionLost
+	}
+
+	err := ps.writes.do(classOf(typ), func() error {
+		if err := ps.writeHello(); err != nil {
+			return err
+		}
+		return writeMsgLimit(ps.stream, typ, payload, ps.sendLimit, ps.fragments)
+	})
+	if err != nil {
+		var tooLarge *frameTooLargeError
+		if errors.As(err, &tooLarge) {
+			return fmt.Errorf("to %s: %w", ps.to.Nickname, err)
+		}
+		ps.broken()
+		return fmt.Errorf("%w: %v", errSessionLost, err)
+	}
+	return nil
+}
+
 // -------------------- Helpers --------------------
 
 func splitFirstWord(s string) (first string, rest string, ok bool) {
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/attest"
+	"github.com/pivaldi/tmd/internal/audit"
+	"github.com/pivaldi/tmd/internal/keyid"
+	"github.com/pivaldi/tmd/internal/pins"
+)
+
+// With --pins, the keys each nickname is first seen with, announced by a
+// node or presented in a Hello, are pinned; other keys for the same
+// nickname later are refused both ways until the user checks them and
+// runs /repin.
+
+// setPinStore enables pinning peer keys on first contact.
+func (p *connPool) setPinStore(s *pins.Store) {
+	p.pinned = s
+}
+
+// observeKeys checks the keys presented for nickname, via a node or a
+// Hello, against its pin, pinning them on first contact. Changed keys are
+// reported loudly and returned as an error.
+func (p *connPool) observeKeys(nickname PeerID, edPub, hpkePub []byte, via string) error {
+	status, pin, err := p.pinned.Observe(string(nickname), edPub, hpkePub)
+	if err != nil {
+		p.console.Errorf("pins: %v", err)
+	}
+	if p.pinned != nil {
+		trust := p.trustOf(status, pin)
+		if status == pins.New {
+			trust = p.trustOf(pins.Match, pin)
+		}
+		p.showPeerTrust(nickname, trust)
+	}
+	if status != pins.Changed {
+		return nil
+	}
+	p.console.Errorf("WARNING: %s presented keys (via %s) that differ from the ones pinned on %s. Someone may be impersonating %s: messages to and from it are refused. Check its keys with it, then /repin %s",
+		nickname, via, pin.Pinned.Local().Format(time.DateOnly), nickname, nickname)
+	p.auditf(audit.KeyMismatch, nickname, "keys via %s differ from those pinned on %s", via, pin.Pinned.Format(time.DateOnly))
+	return fmt.Errorf("%s: keys changed since first contact (see /repin)", nickname)
+}
+
+// followRotation moves the pin of nickname to a new HPKE key presented
+// with the pinned Ed25519 key and signed by it (see keysig.go): the peer
+// rotated its HPKE key (see keyage.go). Callers check the signature.
+func (p *connPool) followRotation(nickname PeerID, edPub, hpkePub []byte, via string) {
+	ok, err := p.pinned.Rotate(string(nickname), edPub, hpkePub)
+	if err != nil {
+		p.console.Errorf("pins: %v", err)
+	}
+	if !ok {
+		return
+	}
+	p.console.AddHistory(fmt.Sprintf("[pins] %s rotated its HPKE key (via %s, signed by its pinned identity key): pinned keyID=%s; check it again with /verify %s",
+		nickname, via, keyid.Of(hpkePub), nickname))
+	p.auditf(audit.KeyRotated, nickname, "new HPKE key %s via %s, signed by the pinned identity key", keyid.Of(hpkePub), via)
+}
+
+// observePeer is observeKeys for a peer announced by a node. A peer
+// announced with other keys than its pin is kept aside for /repin.
+func (p *connPool) observePeer(info PeerInfo) error {
+	if p.pinned == nil {
+		return nil
+	}
+	key, err := identityKey(info)
+	if err != nil {
+		p.console.Errorf("pins: %v", err)
+		return err
+	}
+	if err := p.observeKeys(info.Nickname, key, info.HPKEPub, "the node"); err != nil {
+		p.refuse(info)
+		return err
+	}
+	p.takeRefused(info.Nickname)
+	return nil
+}
+
+// pinStatus reports how to relates to its pin; a peer known by nickname
+// only has no keys to compare.
+func (p *connPool) pinStatus(to PeerInfo) pins.Status {
+	if p.pinned == nil || to.PeerID == "" {
+		return pins.New
+	}
+	key, err := identityKey(to)
+	if err != nil {
+		return pins.Changed
+	}
+	status, _ := p.pinned.Check(string(to.Nickname), key, to.HPKEPub)
+	return status
+}
+
+// checkKeys refuses peers whose keys are revoked, or differ from the
+// attested or pinned ones.
+func (p *connPool) checkKeys(to PeerInfo) error {
+	if err := p.checkRevoked(to); err != nil {
+		return err
+	}
+	if status, e := p.trustStatus(to); status == attest.Mismatch {
+		return fmt.Errorf("%s: keys do not match the identity attested by %s", to.Nickname, e.External)
+	}
+	if p.pinStatus(to) == pins.Changed {
+		return fmt.Errorf("%s: keys changed since first contact (see /repin)", to.Nickname)
+	}
+	return nil
+}
+
+// repin pins a peer to the keys it is online with now, those a node
+// announced it with last if they were refused, or drops its pin when
+// offline so the next keys seen are pinned.
+func (p *connPool) repin(nickname PeerID) (PeerInfo, bool, error) {
+	if p.pinned == nil {
+		return PeerInfo{}, false, errors.New("no pin store (see --pins)")
+	}
+	info, online := p.peerTable.Get(nickname)
+	refused, wasRefused := p.takeRefused(nickname)
+	if wasRefused {
+		info, online = refused, true
+	}
+	if !online {
+		_, err := p.pinned.Forget(string(nickname))
+		p.showPeerTrust(nickname, peerUnknown)
+		return PeerInfo{}, false, err
+	}
+	key, err := identityKey(info)
+	if err != nil {
+		return PeerInfo{}, false, err
+	}
+	if err := p.pinned.Replace(string(nickname), key, info.HPKEPub); err != nil {
+		return PeerInfo{}, false, err
+	}
+	if wasRefused {
+		p.peerTable.Add(info)
+	}
+	p.showPeerTrust(nickname, peerTOFU)
+	return info, true, nil
+}
+
+// refusedPeers are the peers a node last announced with keys other than
+// their pins. They stay out of the peer table until /repin takes the keys.
+type refusedPeers struct {
+	mu   sync.Mutex
+	last map[PeerID]PeerInfo
+}
+
+// refuse keeps info as the last refused announcement of its peer.
+func (p *connPool) refuse(info PeerInfo) {
+	p.refused.mu.Lock()
+	defer p.refused.mu.Unlock()
+	if p.refused.last == nil {
+		p.refused.last = make(map[PeerID]PeerInfo)
+	}
+	p.refused.last[info.Nickname] = info
+}
+
+// takeRefused returns and forgets the refused announcement of nickname.
+func (p *connPool) takeRefused(nickname PeerID) (PeerInfo, bool) {
+	p.refused.mu.Lock()
+	defer p.refused.mu.Unlock()
+	info, ok := p.refused.last[nickname]
+	delete(p.refused.last, nickname)
+	return info, ok
+}
+
+// refusedAll returns the refused announcements, sorted by nickname.
+func (p *connPool) refusedAll() []PeerInfo {
+	p.refused.mu.Lock()
+	list := make([]PeerInfo, 0, len(p.refused.last))
+	for _, info := range p.refused.last {
+		list = append(list, info)
+	}
+	p.refused.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Nickname < list[j].Nickname })
+	return list
+}
+
+// runRepin handles "/repin peer".
+func runRepin(c Console, pool *connPool, args string) {
+	nickname := PeerID(strings.TrimPrefix(strings.TrimSpace(args), "@"))
+	if nickname == "" {
+		c.Errorf("usage: /repin <peer>")
+		return
+	}
+	info, online, err := pool.repin(nickname)
+	switch {
+	case err != nil:
+		c.Errorf("repin: %v", err)
+	case online:
+		c.Printf("[pins] %s pinned to keyID=%x (peerID=%s)", nickname, info.KeyID, info.PeerID.ShortString())
+		pool.flushOutbox(nickname)
+	default:
+		c.Printf("[pins] %s is offline: its pin is dropped, and the next keys it presents are pinned", nickname)
+	}
+}
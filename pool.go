@@ -3,10 +3,14 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdh"
 	"crypto/ed25519"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -16,7 +20,14 @@ import (
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/openpcc/twoway"
-	"golang.org/x/sync/errgroup"
+	"github.com/pivaldi/tmd/internal/addrbook"
+	"github.com/pivaldi/tmd/internal/attest"
+	"github.com/pivaldi/tmd/internal/audit"
+	"github.com/pivaldi/tmd/internal/chaos"
+	"github.com/pivaldi/tmd/internal/keyid"
+	"github.com/pivaldi/tmd/internal/pins"
+	"github.com/pivaldi/tmd/internal/ratchet"
+	"golang.org/x/sync/singleflight"
 )
 
 // ProtocolID for tmd messaging protocol
@@ -24,55 +35,232 @@ const ProtocolID = "/tmd/msg/1.0.0"
 
 // -------------------- Connection reuse + multiplexing --------------------
 type connPool struct {
-	console          *console
+	console          Console
 	host             host.Host
 	peerTable        *PeerTable
-	suite            hpke.Suite
+	suite            hpke.Suite   // for mail and peers predating suites
+	suites           []hpke.Suite // offered in handshakes, strongest first (see suites.go)
 	kemScheme        kem.Scheme
 	nickname         PeerID
-	keyID            []byte // 8-byte key fingerprint
-	selfEdPriv       ed25519.PrivateKey
+	keyID            keyid.KeyID   // 8-byte key fingerprint
+	selfSigner       crypto.Signer // Ed25519: the seed key, or a hardware one (--signer)
 	selfHPKEPubBytes []byte
+	keySig           []byte // selfHPKEPubBytes signed (see keysig.go)
+	ratchetKey       *ecdh.PrivateKey
+	chaos            *chaos.Injector // nil unless --chaos is set
+	trust            *attest.Store   // nil unless --trusted is set
+	pinned           *pins.Store     // nil unless --pins is set
+	audit            *audit.Log      // nil unless --audit is set
+	book             *addrbook.Book  // nil unless --addressbook is set
+	maxFrame         uint32          // largest inbound frame, advertised in the handshake
+	region           string          // dial addresses hinted in this region first
+	padding          bool            // pad plaintexts to size buckets before sealing (--pad)
+	earlyRequests    bool            // let first requests ride in the Hello though ratchets are on (--early)
+	legacyHellos     bool            // accept Hellos from dialers predating suites or bindings (--legacy-hellos)
+	signing          bool            // sign what we send, flag what comes unsigned (--sign)
+	rekey            rekeyLimits     // when channel and room keys are replaced (--rekey)
+	vouchThreshold   int             // verified vouchers making a pinned peer vouched (--vouches)
+
+	subs     subscriptions    // /follow and /hide
+	held     heldReplies      // interactive requests awaiting /reply
+	rooms    roomState        // /join
+	topics   topicState       // /sub, gossiped broadcasts
+	files    fileTransfers    // incoming /send-file transfers
+	streams  streamHandlers   // onStream
+	unread   unreadReceipts   // read receipts due once the user sees a message
+	seen     seenMessages     // message IDs received lately, to drop resends
+	typing   typingState      // typing signals sent and shown
+	outbox   outboxState      // direct messages to offline peers
+	retries  broadcastRetries // broadcasts peers missed
+	mail     mailState        // outbox messages left with the nodes
+	edits    editableMessages // direct messages /edit and /delete may change
+	mentions mentionLog       // broadcasts mentioning us, for /mentions
+	seenAt   lastSeen         // when peers were last online, for /peers
+	blocks   blockList        // identity keys refused both ways (/block)
+	revoked  revocationState  // keys revoked by their owners (/revoke)
+	mutes    muteList         // peers shown quietly (/mute)
+	sched    scheduler        // messages to send later (/schedule)
+	replies  autoReplies      // rules answering direct messages (--autoreply)
+	handler  handlerState     // answers requests; defaultHandler if unset
+	routes   requestRoutes    // handlers by media type (onRequest, onMethod)
+	chans    channelState     // duplex channels (/chan)
+	devices  deviceSync       // our other devices (--devices)
+	verify   verifyState      // direct messages awaiting confirmation (--confirm-unverified)
+	requests requestState     // direct messages of untrusted peers (--requests)
+	profiles profiles         // ours, and peers' for /whois
+	refused  refusedPeers     // peers announced with keys other than their pins (see pins.go)
+	signed   signedPeers      // peers whose HPKE keys came signed (see keysig.go)
+
+	receiversMu sync.RWMutex
+	receivers   []func(receivedMessage)
+	presence    []func(presenceEvent)
+	delivered   []func(deliveredMessage)
 
 	mu       sync.Mutex
 	sessions map[PeerID]*peerSession
+	repairs  map[PeerID]*sessionRepair // lost sessions being redialled
+	dials    singleflight.Group        // one dial per peer at a time, by nickname
 }
 
-func newConnPool(h host.Host, peerTable *PeerTable, suite hpke.Suite, kemScheme kem.Scheme, nickname PeerID, keyID []byte, selfEdPriv ed25519.PrivateKey, selfHPKEPubBytes []byte) *connPool {
-	return &connPool{
+func newConnPool(h host.Host, peerTable *PeerTable, suite hpke.Suite, kemScheme kem.Scheme, nickname PeerID, keyID keyid.KeyID, selfSigner crypto.Signer, selfHPKEPubBytes []byte) *connPool {
+	p := &connPool{
 		host:             h,
 		peerTable:        peerTable,
 		suite:            suite,
+		suites:           supportedSuites,
 		kemScheme:        kemScheme,
 		nickname:         nickname,
 		keyID:            keyID,
-		selfEdPriv:       selfEdPriv,
+		selfSigner:       selfSigner,
 		selfHPKEPubBytes: selfHPKEPubBytes,
+		console:          nopConsole{},
+		maxFrame:         defaultMaxFrame,
+		rekey:            defaultRekeyLimits,
+		vouchThreshold:   defaultVouchThreshold,
 		sessions:         make(map[PeerID]*peerSession),
+		repairs:          make(map[PeerID]*sessionRepair),
 	}
+	p.serveBuiltinMethods()
+	return p
 }
 
-func (p *connPool) setConsole(c *console) {
+// selfEdPub returns our Ed25519 key, the one Hellos are signed with.
+func (p *connPool) selfEdPub() ed25519.PublicKey {
+	return p.selfSigner.Public().(ed25519.PublicKey)
+}
+
+func (p *connPool) setConsole(c Console) {
 	p.console = c
+	if rc, ok := c.(readConsole); ok {
+		rc.OnRead(p.markRead)
+	}
+	if tc, ok := c.(typingConsole); ok {
+		tc.OnTyping(p.sendTyping)
+	}
+}
+
+// receivedMessage is a decrypted inbound message as seen by subscribers.
+type receivedMessage struct {
+	Kind string // "direct" or "broadcast"
+	From PeerID
+	Text string
+}
+
+// onReceive registers fn to be called for every received message, after
+// it has been shown on the console. Integrations (webhook, bridges) use it
+// to forward traffic; fn must not block.
+func (p *connPool) onReceive(fn func(receivedMessage)) {
+	p.receiversMu.Lock()
+	defer p.receiversMu.Unlock()
+	p.receivers = append(p.receivers, fn)
+}
+
+func (p *connPool) notifyReceived(m receivedMessage) {
+	p.receiversMu.RLock()
+	defer p.receiversMu.RUnlock()
+	for _, fn := range p.receivers {
+		fn(m)
+	}
+}
+
+// presenceEvent reports a peer appearing or disappearing from discovery.
+type presenceEvent struct {
+	Nickname PeerID
+	Online   bool
+}
+
+// onPresence registers fn to be called when discovery reports a peer
+// joining or leaving; fn must not block.
+func (p *connPool) onPresence(fn func(presenceEvent)) {
+	p.receiversMu.Lock()
+	defer p.receiversMu.Unlock()
+	p.presence = append(p.presence, fn)
+}
+
+func (p *connPool) notifyPresence(ev presenceEvent) {
+	p.receiversMu.RLock()
+	defer p.receiversMu.RUnlock()
+	for _, fn := range p.presence {
+		fn(ev)
+	}
+}
+
+// deliveredMessage is a sent message the recipient has acknowledged.
+type deliveredMessage struct {
+	To   PeerID
+	Text string // as sent on the wire, including the broadcast tag
+}
+
+// onDelivered registers fn to be called when a peer acknowledges a
+// message; fn must not block.
+func (p *connPool) onDelivered(fn func(deliveredMessage)) {
+	p.receiversMu.Lock()
+	defer p.receiversMu.Unlock()
+	p.delivered = append(p.delivered, fn)
+}
+
+func (p *connPool) notifyDelivered(m deliveredMessage) {
+	p.receiversMu.RLock()
+	defer p.receiversMu.RUnlock()
+	for _, fn := range p.delivered {
+		fn(m)
+	}
+}
+
+// setChaos enables fault injection on every peer stream (debug only).
+func (p *connPool) setChaos(in *chaos.Injector) {
+	p.chaos = in
+}
+
+// setTrustStore enables checking peers against attested identities.
+func (p *connPool) setTrustStore(s *attest.Store) {
+	p.trust = s
+}
+
+// trustStatus reports how to relates to the trust store.
+func (p *connPool) trustStatus(to PeerInfo) (attest.Status, attest.Entry) {
+	return p.trust.Check(string(to.Nickname), to.PeerID, to.HPKEPub)
 }
 
 func (p *connPool) NewSession(to PeerInfo) (*peerSession, error) {
+	return p.newSession(to, false)
+}
+
+// requestSession is NewSession for a request about to be sent: a session
+// dialed for it holds its HELLO back for the request (see early.go).
+func (p *connPool) requestSession(to PeerInfo) (*peerSession, error) {
+	return p.newSession(to, true)
+}
+
+func (p *connPool) newSession(to PeerInfo, early bool) (*peerSession, error) {
 	// Create a new session if does not exists or not alive.
 	ps, ok := p.GetSession(to)
 	if ok {
 		return ps, nil
 	}
+	if ps, ok, err := p.awaitRepair(to.Nickname); ok {
+		return ps, err
+	}
 
-	ps, err := p.dialAndHandshake(to)
+	// Concurrent sends share one dial: two streams to a peer could deliver
+	// frames out of order, such as a room message before its sender key.
+	v, err, _ := p.dials.Do(string(to.Nickname), func() (any, error) {
+		if ps, ok := p.GetSession(to); ok {
+			return ps, nil
+		}
+		ps, err := p.dialAndHandshake(to, early)
+		if err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		p.sessions[to.Nickname] = ps
+		p.mu.Unlock()
+		return ps, nil
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	p.mu.Lock()
-	p.sessions[to.Nickname] = ps
-	p.mu.Unlock()
-
-	return ps, nil
+	return v.(*peerSession), nil
 }
 
 func (p *connPool) GetSession(to PeerInfo) (*peerSession, bool) {
@@ -90,105 +278,368 @@ func (p *connPool) RemoveSession(peerID PeerID) {
 	p.mu.Lock()
 	s := p.sessions[peerID]
 	delete(p.sessions, peerID)
+	p.stopRepairLocked(peerID)
 	p.mu.Unlock()
 
 	if s != nil {
-		s.failAll()
+		s.close()
 	}
 
-	if p.console != nil {
-		p.console.AddHistory(fmt.Sprintf("[net] disconnected from %s", peerID))
-	}
+	p.console.AddHistory(fmt.Sprintf("[net] disconnected from %s", peerID))
 }
 
+// SendRequest delivers msg to to and returns the response, which the
+// receiver sends at once.
 func (p *connPool) SendRequest(to PeerInfo, msg string) (string, error) {
-	// Get existing session or create new one
-	psession, err := p.NewSession(to)
+	r, err := p.sendRequest(to, msg, reqMediaType, nil, nil, nil)
+	return r.Text, err
+}
+
+// reply is the response to a request.
+type reply struct {
+	Text  string
+	Quote string // excerpt of the request, if the reply quotes it
+}
+
+// sendInteractive delivers msg as a request the receiver may answer with
+// /reply, and returns that answer (ackReply if none came within the
+// receiver's reply window). messageID, if not nil, is sent instead of a
+// new one (see messageids.go). sent, if not nil, is called once the request
+// is on the wire, and receipt with the kind of each receipt the receiver
+// sends back (see receipts.go).
+func (p *connPool) sendInteractive(to PeerInfo, msg string, messageID []byte, sent func(), receipt func(kind byte)) (reply, error) {
+	if messageID == nil {
+		var err error
+		if messageID, err = newMessageID(); err != nil {
+			return reply{}, err
+		}
+	}
+	// Sent messages may be edited (see edits.go).
+	onSent := func() {
+		p.rememberSent(to.Nickname, messageID, msg)
+		if sent != nil {
+			sent()
+		}
+	}
+	return p.sendRequest(to, msg, interactiveReqMediaType, messageID, onSent, receipt)
+}
+
+func (p *connPool) sendRequest(to PeerInfo, msg, mediaType string, messageID []byte, sent func(), receipt func(kind byte)) (reply, error) {
+	if err := p.checkKeys(to); err != nil {
+		return reply{}, err
+	}
+	if err := p.checkBlocked(to); err != nil {
+		return reply{}, err
+	}
+
+	req := Request{MessageID: messageID}
+	if mediaType == interactiveReqMediaType {
+		req.Priority = priorityInteractive
+	}
+	if req.MessageID == nil {
+		var err error
+		if req.MessageID, err = newMessageID(); err != nil {
+			return reply{}, err
+		}
+	}
+
+	signedType, signedMsg, err := p.signFor(to.Nickname, mediaType, msg, req.MessageID)
 	if err != nil {
-		return "", fmt.Errorf("connect to %s: %w", to.Nickname, err)
+		return reply{}, err
 	}
 
+	// Get existing session or create new one. A request whose session was
+	// lost before the response is resent once the session is repaired,
+	// sealed anew for the ratchet of the new session.
+	var resp Response
+	var psession *peerSession
+	var respOpenFn twoway.ResponseOpenerFunc
+	var sentOnce sync.Once
+	onSent := func() {
+		if sent != nil {
+			sentOnce.Do(sent)
+		}
+	}
+	deadline := time.Now().Add(requestTimeout)
+	for attempt := 0; ; attempt++ {
+		var err error
+		psession, err = p.requestSession(to)
+		if err != nil {
+			return reply{}, &offlineError{peer: to.Nickname, err: err}
+		}
+		psession.awaitRatchet(deadline)
+		var sealed Request
+		if sealed, respOpenFn, err = p.sealFor(psession, to, signedMsg, signedType); err != nil {
+			return reply{}, err
+		}
+		req.RecipientKeyID, req.EncapKey = sealed.RecipientKeyID, sealed.EncapKey
+		req.MediaType, req.Ciphertext = sealed.MediaType, sealed.Ciphertext
+		// A resend only gets the time left.
+		if req.Timeout = time.Until(deadline); req.Timeout <= 0 {
+			return reply{}, fmt.Errorf("%w: no response from %s within %s", errRequestExpired, to.Nickname, requestTimeout)
+		}
+		resp, err = psession.DoRequest(req, onSent, receipt)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errSessionLost) || attempt == maxResubmits {
+			return reply{}, err
+		}
+	}
+
+	// Open response using respOpenFn returned by EncapsulateKey.
+	respOpener, err := respOpenFn(bytes.NewReader(resp.Ciphertext), resp.MediaType)
+	if err != nil {
+		return reply{}, err
+	}
+	respPlain, err := io.ReadAll(respOpener)
+	if err != nil {
+		return reply{}, err
+	}
+	if resp.MediaType, respPlain, err = unpadOpened(resp.MediaType, respPlain); err != nil {
+		return reply{}, fmt.Errorf("response from %s: %w", to.Nickname, err)
+	}
+	if resp.MediaType, respPlain, err = openRatcheted(psession.ratchet.Load(), resp.MediaType, respPlain); err != nil {
+		return reply{}, fmt.Errorf("response from %s: %w", to.Nickname, err)
+	}
+
+	p.sawPeer(to.Nickname, false)
+	if string(resp.MediaType) == expiredRespMediaType {
+		return reply{}, fmt.Errorf("%w: %s dropped it before answering", errRequestExpired, to.Nickname)
+	}
+	if string(resp.MediaType) == failedRespMediaType {
+		return reply{}, fmt.Errorf("%s could not handle it: %s", to.Nickname, respPlain)
+	}
+	if _, routed := p.route(mediaType); !routed {
+		p.notifyDelivered(deliveredMessage{To: to.Nickname, Text: msg})
+	}
+	if quote, text, ok := parseQuotedReply(resp.MediaType, respPlain, req.MessageID); ok {
+		return reply{Text: text, Quote: quote}, nil
+	}
+	return reply{Text: string(respPlain)}, nil
+}
+
+// seal encrypts msg to to's HPKE key as a twoway request. The request ID
+// is left for DoRequest to set.
+func (p *connPool) seal(to PeerInfo, msg, mediaType string) (Request, twoway.ResponseOpenerFunc, error) {
+	return p.sealWith(p.suite, nil, to, msg, mediaType)
+}
+
+// sealWith seals msg with the ratchet rs first, if not nil (see
+// ratchets.go), then to to's HPKE key with suite.
+func (p *connPool) sealWith(suite hpke.Suite, rs *ratchet.Session, to PeerInfo, msg, mediaType string) (Request, twoway.ResponseOpenerFunc, error) {
+	mediaType, msg, err := p.sealable(rs, mediaType, msg)
+	if err != nil {
+		return Request{}, nil, err
+	}
+	return p.sealTwoway(twoway.NewMultiRequestSender(suite, rand.Reader), to, msg, mediaType)
+}
+
+// sealable returns the media type and plaintext to seal for msg: sealed
+// with the ratchet rs, if not nil, and padded with --pad.
+func (p *connPool) sealable(rs *ratchet.Session, mediaType, msg string) (string, string, error) {
+	mediaType, msg, err := ratchetFor(rs, mediaType, msg)
+	if err != nil {
+		return "", "", fmt.Errorf("ratchet: %w", err)
+	}
+	mediaType, msg = padFor(p.padding, mediaType, msg)
+	return mediaType, msg, nil
+}
+
+// sealTwoway seals msg to to's HPKE key with sender.
+func (p *connPool) sealTwoway(sender *twoway.MultiRequestSender, to PeerInfo, msg, mediaType string) (Request, twoway.ResponseOpenerFunc, error) {
 	// Build one request ciphertext (twoway request/response).
-	sender := twoway.NewMultiRequestSender(p.suite, rand.Reader)
-	reqMediaType := []byte("text/plain; purpose=req")
-	reqSealer, err := sender.NewRequestSealer(strings.NewReader(msg), reqMediaType)
+	reqSealer, err := sender.NewRequestSealer(strings.NewReader(msg), []byte(mediaType))
 	if err != nil {
-		return "", fmt.Errorf("NewRequestSealer: %w", err)
+		return Request{}, nil, fmt.Errorf("NewRequestSealer: %w", err)
 	}
 	reqCiphertext, err := io.ReadAll(reqSealer)
 	if err != nil {
-		return "", fmt.Errorf("read request ciphertext: %w", err)
+		return Request{}, nil, fmt.Errorf("read request ciphertext: %w", err)
 	}
 
 	// Receiver's pinned HPKE public key (from peer table).
 	toHPKEPub, err := p.kemScheme.UnmarshalBinaryPublicKey(to.HPKEPub)
 	if err != nil {
-		return "", fmt.Errorf("unmarshal HPKE pub for %s: %w", to.Nickname, err)
+		return Request{}, nil, fmt.Errorf("unmarshal HPKE pub for %s: %w", to.Nickname, err)
 	}
 
-	// Use first byte of KeyID for twoway library compatibility
-	encapKey, respOpenFn, err := reqSealer.EncapsulateKey(to.KeyID[0], toHPKEPub)
+	// twoway names the recipient's key with a single byte
+	encapKey, respOpenFn, err := reqSealer.EncapsulateKey(to.KeyID.Short(), toHPKEPub)
 	if err != nil {
-		return "", fmt.Errorf("EncapsulateKey(to=%s): %w", to.Nickname, err)
+		return Request{}, nil, fmt.Errorf("EncapsulateKey(to=%s): %w", to.Nickname, err)
 	}
 
-	req := Request{
-		RequestID:      0, // set inside DoRequest
+	return Request{
+		RequestID:      0,        // set inside DoRequest
 		RecipientKeyID: to.KeyID, // full 8-byte fingerprint
 		EncapKey:       encapKey,
-		MediaType:      reqMediaType,
+		MediaType:      []byte(mediaType),
 		Ciphertext:     reqCiphertext,
-	}
+	}, respOpenFn, nil
+}
 
-	resp, err := psession.DoRequest(req)
-	if err != nil {
-		return "", err
+// SendNotify delivers msg to a peer without waiting for a response, for
+// traffic nobody answers (presence pings, status updates).
+func (p *connPool) SendNotify(to PeerInfo, msg string) error {
+	return p.sendNotify(to, msg, notifyMediaType)
+}
+
+func (p *connPool) sendNotify(to PeerInfo, msg, mediaType string) error {
+	if err := p.checkKeys(to); err != nil {
+		return err
+	}
+	if err := p.checkBlocked(to); err != nil {
+		return err
 	}
+	return p.sendOneWayWith(to, msgNotify, func(ps *peerSession) ([]byte, error) {
+		n, err := p.sealNotifyWith(ps.suite, ps.ratchet.Load(), to, msg, mediaType)
+		if err != nil {
+			return nil, err
+		}
+		return encodeNotify(n), nil
+	})
+}
 
-	// Open response using respOpenFn returned by EncapsulateKey.
-	respOpener, err := respOpenFn(bytes.NewReader(resp.Ciphertext), resp.MediaType)
-	if err != nil {
-		return "", err
+// sealNotify seals msg to a peer for a one-way frame.
+func (p *connPool) sealNotify(to PeerInfo, msg, mediaType string) (Notify, error) {
+	if err := p.checkKeys(to); err != nil {
+		return Notify{}, err
 	}
-	respPlain, err := io.ReadAll(respOpener)
+	if err := p.checkBlocked(to); err != nil {
+		return Notify{}, err
+	}
+	return p.sealNotifyWith(p.suite, nil, to, msg, mediaType)
+}
+
+// sealNotifyWith seals msg for a one-way frame with suite, and with the
+// ratchet rs first if not nil.
+func (p *connPool) sealNotifyWith(suite hpke.Suite, rs *ratchet.Session, to PeerInfo, msg, mediaType string) (Notify, error) {
+	req, _, err := p.sealWith(suite, rs, to, msg, mediaType)
 	if err != nil {
-		return "", err
+		return Notify{}, err
 	}
+	return Notify{
+		RecipientKeyID: req.RecipientKeyID,
+		EncapKey:       req.EncapKey,
+		MediaType:      req.MediaType,
+		Ciphertext:     req.Ciphertext,
+	}, nil
+}
 
-	return string(respPlain), nil
+// sendOneWay writes a message that expects no response to a peer. A
+// message whose session is found lost is resent once the session is
+// repaired; one lost in flight is not noticed.
+func (p *connPool) sendOneWay(to PeerInfo, typ byte, payload []byte) error {
+	return p.sendOneWayWith(to, typ, func(*peerSession) ([]byte, error) { return payload, nil })
 }
 
-func (p *connPool) Broadcast(msg string) error {
-	var g errgroup.Group
+// sendOneWayWith is sendOneWay for a payload built for each session it is
+// sent on.
+func (p *connPool) sendOneWayWith(to PeerInfo, typ byte, build func(*peerSession) ([]byte, error)) error {
+	for attempt := 0; ; attempt++ {
+		psession, err := p.NewSession(to)
+		if err != nil {
+			return fmt.Errorf("connect to %s: %w", to.Nickname, err)
+		}
+		payload, err := build(psession)
+		if err != nil {
+			return err
+		}
+		err = psession.send(typ, payload)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, errSessionLost) || attempt == maxResubmits {
+			return err
+		}
+	}
+}
+
+// broadcastPrefix tags the plaintext of broadcast requests.
+const broadcastPrefix = "[BROADCAST]"
+
+// BroadcastResult is the outcome of a broadcast for one peer.
+type BroadcastResult struct {
+	Peer PeerID
+	Err  error
+	RTT  time.Duration // until the peer acknowledged; zero on error
+	// Relayed is set when the nodes took the message for the peer, which
+	// then sends no acknowledgement.
+	Relayed bool
+	// Gossiped is set when the message was published on gossipsub,
+	// which is not acknowledged either (see topics.go).
+	Gossiped bool
+}
 
+// Broadcast sends msg to every known peer at once and returns each
+// peer's outcome, by nickname. Peers that failed get it again later (see
+// broadcasts.go). With setRelayBroadcasts, the nodes deliver it instead;
+// with --gossip, broadcasts to many peers are published once on a topic.
+func (p *connPool) Broadcast(msg string) []BroadcastResult {
 	// Tag broadcast messages with a special prefix
-	broadcastMsg := "[BROADCAST]" + msg
+	broadcastMsg := broadcastPrefix + msg
 
+	var peers []PeerInfo
 	for _, peerInfo := range p.peerTable.All() {
-		if peerInfo.Nickname == p.nickname {
-			continue
+		if peerInfo.Nickname != p.nickname {
+			peers = append(peers, peerInfo)
 		}
+	}
 
-		to := peerInfo
-		g.Go(func() error {
-			_, err := p.SendRequest(to, broadcastMsg)
-			if err != nil {
-				return fmt.Errorf("to %s: %w", to.Nickname, err)
-			}
+	if results, ok := p.broadcastViaNodes(msg, peers); ok {
+		return results
+	}
+	if results, ok := p.broadcastViaTopic(msg, peers); ok {
+		return results
+	}
 
-			return nil
+	results := make([]BroadcastResult, len(peers))
+	var wg sync.WaitGroup
+	for i, to := range peers {
+		wg.Go(func() {
+			start := time.Now()
+			results[i] = BroadcastResult{Peer: to.Nickname}
+			if _, err := p.SendRequest(to, broadcastMsg); err != nil {
+				results[i].Err = err
+				p.retryBroadcast(to.Nickname, msg)
+				return
+			}
+			results[i].RTT = time.Since(start)
 		})
 	}
+	wg.Wait()
 
-	return g.Wait()
+	slices.SortFunc(results, func(a, b BroadcastResult) int { return strings.Compare(string(a.Peer), string(b.Peer)) })
+	return results
 }
 
-func (p *connPool) dialAndHandshake(to PeerInfo) (*peerSession, error) {
+// broadcastErr joins the failures of a broadcast; it is nil if every peer
+// received it.
+func broadcastErr(results []BroadcastResult) error {
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("to %s: %w", r.Peer, r.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dialAndHandshake opens a session to to. With early, the HELLO waits
+// for the first request if the listener takes it along (see early.go).
+func (p *connPool) dialAndHandshake(to PeerInfo, early bool) (*peerSession, error) {
+	if err := p.checkBlocked(to); err != nil {
+		return nil, err
+	}
+
 	// Connect to peer using libp2p
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Add peer's addresses to peerstore
+	// Try the addresses the node hints at first, then add all of the
+	// peer's addresses to peerstore
+	p.dialPreferred(ctx, to)
 	p.host.Peerstore().AddAddrs(to.PeerID, to.Addrs, time.Hour)
 
 	// Open stream
@@ -196,9 +647,10 @@ func (p *connPool) dialAndHandshake(to PeerInfo) (*peerSession, error) {
 	if err != nil {
 		return nil, fmt.Errorf("open stream: %w", err)
 	}
+	stream = p.chaos.Wrap(stream)
 
-	// 1) Read CHALLENGE from receiver.
-	typ, chal, err := readMsg(stream)
+	// 1) Read CHALLENGE (and the receiver's frame limit and suites).
+	typ, payload, err := readMsg(stream)
 	if err != nil {
 		_ = stream.Close()
 		return nil, err
@@ -207,39 +659,111 @@ func (p *connPool) dialAndHandshake(to PeerInfo) (*peerSession, error) {
 		_ = stream.Close()
 		return nil, fmt.Errorf("expected CHALLENGE, got %d", typ)
 	}
-	if len(chal) != 32 {
+	chal, peerMaxFrame, offered, features, err := decodeChallenge(payload)
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	suite, suites, err := p.dialerSuite(to.Nickname, offered)
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	sendLimit, fragments, err := negotiateFrameLimit(peerMaxFrame)
+	if err != nil {
 		_ = stream.Close()
-		return nil, fmt.Errorf("bad challenge length: %d", len(chal))
+		return nil, err
 	}
 
-	// 2) Send signed HELLO (identity).
+	// 2) Send signed HELLO (identity), offering a ratchet.
+	ratchetPub, completeRatchet, err := p.offerRatchet(to)
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
 	hello := Hello{
 		SenderID:      p.nickname,
 		SenderKeyID:   p.keyID,
-		SenderEdPub:   p.selfEdPriv.Public().(ed25519.PublicKey),
+		SenderEdPub:   p.selfEdPub(),
 		SenderHPKEPub: p.selfHPKEPubBytes,
 		Signature:     nil,
+		MaxFrame:      p.maxFrame,
+		Profile:       p.ownProfile(),
+		RatchetPub:    ratchetPub,
+		Suites:        encodeSuites(suites),
+		KeySig:        p.keySig,
 	}
-	hello.Signature = ed25519.Sign(p.selfEdPriv, helloSignInput(chal, hello))
-	if err := writeMsg(stream, msgHello, encodeHello(hello)); err != nil {
+	signed := chal
+	if len(hello.Suites) > 0 {
+		signed = payload // the listener's suites too
+		if features&featureBinding != 0 {
+			hello.Features |= featureBinding
+			signed = append(slices.Clip(signed), channelBinding(p.host.ID(), stream.Conn().RemotePeer(), stream.Protocol(), suite)...)
+		}
+	}
+	if hello.Signature, err = p.selfSigner.Sign(nil, helloSignInput(signed, hello), crypto.Hash(0)); err != nil {
 		_ = stream.Close()
-		return nil, err
+		return nil, fmt.Errorf("sign hello: %w", err)
 	}
-
 	ps := &peerSession{
-		to:      to,
-		stream:  stream,
-		pending: make(map[uint64]chan Response),
+		to:        to,
+		stream:    stream,
+		sendLimit: sendLimit,
+		fragments: fragments,
+		recvLimit: p.maxFrame,
+		suite:     suite,
+		pending:   make(map[uint64]chan Response),
+		streams:   make(map[uint64]*streamBody),
+		windows:   make(map[uint64]*streamWindow),
+		receipts:  make(map[uint64]func(kind byte)),
+		onLost:    p.sessionLost,
+
+		completeRatchet: completeRatchet,
+		takesKeys:       features&featureSessionKeys != 0,
 	}
-	go ps.readLoop()
-
-	if p.console != nil {
-		p.console.AddHistory(fmt.Sprintf("[net] connected to %s (%s)", to.Nickname, to.PeerID.ShortString()))
+	if features&featureMutual != 0 {
+		ps.checkResponder = p.responderCheck(to, signed)
 	}
+	takesEarly := features&featureEarly != 0
+	if early && takesEarly && (completeRatchet == nil || p.earlyRequests) {
+		ps.hello = &hello
+	} else {
+		if err := writeMsg(stream, msgHello, encodeHello(hello)); err != nil {
+			_ = stream.Close()
+			return nil, err
+		}
+		if takesEarly && completeRatchet != nil {
+			ps.ratcheted = make(chan struct{})
+			time.AfterFunc(ratchetWait, ps.ratchetReady)
+		}
+	}
+	ps.onChannel = func(typ byte, payload []byte) {
+		if err := p.channelFrame(to.Nickname, true, typ, payload, ps, ps.send); err != nil {
+			p.console.Errorf("%v", err)
+		}
+	}
+	go func() {
+		ps.readLoop()
+		p.dropChannelsVia(ps)
+	}()
+
+	p.console.AddHistory(fmt.Sprintf("[net] connected to %s (%s)", to.Nickname, to.PeerID.ShortString()))
 
 	return ps, nil
 }
 
+// negotiateFrameLimit returns the frame limit to honour when writing to a
+// peer that advertised maxFrame, and whether it reassembles fragments.
+func negotiateFrameLimit(maxFrame uint32) (limit uint32, fragments bool, err error) {
+	if maxFrame == 0 {
+		return defaultMaxFrame, false, nil
+	}
+	if maxFrame < minMaxFrame {
+		return 0, false, fmt.Errorf("peer frame limit %d is below the %d-byte minimum", maxFrame, minMaxFrame)
+	}
+	return maxFrame, true, nil
+}
+
 // AnnouncePresence establishes connections to all other peers to announce this peer is online
 func (p *connPool) AnnouncePresence() {
 	for _, peerInfo := range p.peerTable.All() {
@@ -273,9 +797,12 @@ func (p *connPool) AnnounceDisconnexion() {
 	for peerID, s := range sessions {
 		if s.isAlive() {
 			// Send goodbye message before closing
-			s.writeMu.Lock()
-			_ = writeMsg(s.stream, msgGoodbye, encoded)
-			s.writeMu.Unlock()
+			_ = s.writes.do(sendHigh, func() error {
+				if err := s.writeHello(); err != nil {
+					return err
+				}
+				return writeMsg(s.stream, msgGoodbye, encoded)
+			})
 		}
 		p.RemoveSession(peerID)
 	}
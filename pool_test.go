@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/openpcc/twoway"
+)
+
+// BenchmarkSendRequest measures one request and its response, sealed and
+// opened as sealFor, the stream handler and Reply do: with twoway and a
+// sender made for each request (fresh, what sealWith does) or kept for
+// the session (reused), or with the session's keys (session), as requests
+// after the first on a session are (see sessionkeys.go). kem is the HPKE
+// setup alone, which EncapsulateKey runs for every twoway request
+// whichever sender seals it.
+//
+//	go test -run '^$' -bench SendRequest -benchmem
+//
+// On a Xeon VM, fresh and reused both take about 190µs per round trip,
+// the KEM setup alone about 110µs of it: a MultiRequestSender only holds
+// the suite and the random source, so reusing it saves nothing. A
+// session-keyed round trip takes about 2.6µs, with 16 allocations rather
+// than 345.
+func BenchmarkSendRequest(b *testing.B) {
+	suite := hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	pub, priv, err := hpke.KEM_X25519_HKDF_SHA256.Scheme().GenerateKeyPair()
+	if err != nil {
+		b.Fatal(err)
+	}
+	const keyID = 7
+	receiver, err := twoway.NewMultiRequestReceiver(suite, keyID, priv, rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	msg := strings.Repeat("x", 200)
+	mediaType := []byte(reqMediaType)
+
+	roundTrip := func(b *testing.B, sender *twoway.MultiRequestSender) {
+		sealer, err := sender.NewRequestSealer(strings.NewReader(msg), mediaType)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ct, err := io.ReadAll(sealer)
+		if err != nil {
+			b.Fatal(err)
+		}
+		encapKey, openResp, err := sealer.EncapsulateKey(keyID, pub)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		opener, err := receiver.NewRequestOpener(encapKey, bytes.NewReader(ct), mediaType)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadAll(opener); err != nil {
+			b.Fatal(err)
+		}
+		respSealer, err := opener.NewResponseSealer(strings.NewReader("ok"), []byte(respMediaType))
+		if err != nil {
+			b.Fatal(err)
+		}
+		respCt, err := io.ReadAll(respSealer)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		respOpener, err := openResp(bytes.NewReader(respCt), []byte(respMediaType))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if got, err := io.ReadAll(respOpener); err != nil || string(got) != "ok" {
+			b.Fatalf("response %q, %v", got, err)
+		}
+	}
+
+	b.Run("fresh", func(b *testing.B) {
+		for b.Loop() {
+			roundTrip(b, twoway.NewMultiRequestSender(suite, rand.Reader))
+		}
+	})
+	b.Run("reused", func(b *testing.B) {
+		sender := twoway.NewMultiRequestSender(suite, rand.Reader)
+		for b.Loop() {
+			roundTrip(b, sender)
+		}
+	})
+	b.Run("session", func(b *testing.B) {
+		secret := make([]byte, chanSecretSize)
+		_, _ = rand.Read(secret)
+		dialer, _ := newSessionKeys(secret, "alice", "bob")
+		listener, _ := newSessionKeys(secret, "alice", "bob")
+		for b.Loop() {
+			_, sealed := dialer.seal(dialer.req, []byte(msg), mediaType)
+			n, _, err := openSealed(listener.req, sealed, mediaType)
+			if err != nil {
+				b.Fatal(err)
+			}
+			resp, _ := listener.responses(n)(respMediaType, "ok")
+			if _, got, err := openSealed(dialer.resp, resp, respAD([]byte(respMediaType), n)); err != nil || string(got) != "ok" {
+				b.Fatalf("response %q, %v", got, err)
+			}
+		}
+	})
+	b.Run("kem", func(b *testing.B) {
+		for b.Loop() {
+			s, err := suite.NewSender(pub, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, _, err := s.Setup(rand.Reader); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
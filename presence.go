@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pivaldi/tmd/internal/node"
+)
+
+// subscriptions holds the presence filter edited with /follow and /hide.
+// apply pushes it to the discovery client; it is nil in standalone mode,
+// where there are no presence events to filter.
+type subscriptions struct {
+	mu     sync.Mutex
+	filter node.PresenceFilter
+	apply  func(node.PresenceFilter)
+
+	status    string             // our presence, set with /status
+	advertise presenceAdvertiser // nil in standalone mode
+}
+
+// presenceAdvertiser tells the discovery nodes our presence; it is the
+// discovery client.
+type presenceAdvertiser interface {
+	SetPresence(presence string) error
+}
+
+// presenceConsole is implemented by consoles that show the presence of
+// peers next to them.
+type presenceConsole interface {
+	// SetPeerPresence shows presence next to peer; empty or
+	// node.PresenceAvailable clears it.
+	SetPeerPresence(peer PeerID, presence string)
+}
+
+// setPresenceApplier connects /follow and /hide to the discovery client.
+func (p *connPool) setPresenceApplier(fn func(node.PresenceFilter)) {
+	p.subs.mu.Lock()
+	defer p.subs.mu.Unlock()
+	p.subs.apply = fn
+}
+
+// setPresenceAdvertiser connects /status to the discovery client.
+func (p *connPool) setPresenceAdvertiser(a presenceAdvertiser) {
+	p.subs.mu.Lock()
+	defer p.subs.mu.Unlock()
+	p.subs.advertise = a
+}
+
+// SetPresence advertises our presence through the discovery nodes.
+func (p *connPool) SetPresence(presence string) error {
+	p.subs.mu.Lock()
+	defer p.subs.mu.Unlock()
+	if p.subs.advertise == nil {
+		return fmt.Errorf("no discovery nodes to tell")
+	}
+	if err := p.subs.advertise.SetPresence(presence); err != nil {
+		return err
+	}
+	p.subs.status = presence
+	return nil
+}
+
+// Presence returns our presence as last set with SetPresence.
+func (p *connPool) Presence() string {
+	p.subs.mu.Lock()
+	defer p.subs.mu.Unlock()
+	return orAvailable(p.subs.status)
+}
+
+func orAvailable(presence string) string {
+	if presence == "" {
+		return node.PresenceAvailable
+	}
+	return presence
+}
+
+// presenceMark is shown after a peer's name when it is not available.
+func presenceMark(presence string) string {
+	if orAvailable(presence) == node.PresenceAvailable {
+		return ""
+	}
+	return " [" + presence + "]"
+}
+
+// showPeerPresence passes the presence of a peer to the console, if it
+// shows presence.
+func (p *connPool) showPeerPresence(peer PeerID, presence string) {
+	if c, ok := p.console.(presenceConsole); ok {
+		c.SetPeerPresence(peer, presence)
+	}
+}
+
+// runStatus handles "/status [available|away|busy]": without an argument
+// it shows our presence.
+func runStatus(c Console, pool *connPool, args string) {
+	if args == "" {
+		c.Printf("[presence] you are %s", pool.Presence())
+		return
+	}
+	if err := pool.SetPresence(args); err != nil {
+		c.Errorf("status: %v", err)
+		return
+	}
+	if args == node.PresenceAvailable {
+		pool.setStatus("presence", "")
+	} else {
+		pool.setStatus("presence", "you are "+args)
+	}
+	c.Printf("[presence] you are %s", args)
+}
+
+// updatePresenceFilter edits the filter with change and applies it.
+func (p *connPool) updatePresenceFilter(change func(*node.PresenceFilter)) node.PresenceFilter {
+	p.subs.mu.Lock()
+	defer p.subs.mu.Unlock()
+
+	f := node.PresenceFilter{
+		Follow: slices.Clone(p.subs.filter.Follow),
+		Mute:   slices.Clone(p.subs.filter.Mute),
+	}
+	change(&f)
+	p.subs.filter = f
+	if p.subs.apply != nil {
+		p.subs.apply(f)
+	}
+	return f
+}
+
+var presenceCommands = map[string]bool{"/follow": true, "/unfollow": true, "/hide": true, "/unhide": true}
+
+// runPresenceCommand handles /follow, /unfollow, /hide and /unhide. With a
+// non-empty follow list only followed peers are shown; hidden peers never
+// are. Either way such peers are dropped from the peer table, so they
+// must be followed or unhidden before messaging them.
+func runPresenceCommand(c Console, pool *connPool, cmd string, nicks []string) {
+	if len(nicks) == 0 && cmd != "/follow" {
+		c.Errorf("usage: %s <peer>...", cmd)
+		return
+	}
+
+	f := pool.updatePresenceFilter(func(f *node.PresenceFilter) {
+		for _, nick := range nicks {
+			switch cmd {
+			case "/follow":
+				f.Follow = addName(f.Follow, nick)
+				f.Mute = removeName(f.Mute, nick)
+			case "/unfollow":
+				f.Follow = removeName(f.Follow, nick)
+			case "/hide":
+				f.Mute = addName(f.Mute, nick)
+				f.Follow = removeName(f.Follow, nick)
+			case "/unhide":
+				f.Mute = removeName(f.Mute, nick)
+			}
+		}
+	})
+
+	following := "everyone"
+	if len(f.Follow) > 0 {
+		following = strings.Join(f.Follow, ", ")
+	}
+	hidden := "nobody"
+	if len(f.Mute) > 0 {
+		hidden = strings.Join(f.Mute, ", ")
+	}
+	c.Printf("[presence] following %s; hidden: %s", following, hidden)
+}
+
+func addName(list []string, name string) []string {
+	if slices.Contains(list, name) {
+		return list
+	}
+	return append(list, name)
+}
+
+func removeName(list []string, name string) []string {
+	return slices.DeleteFunc(list, func(s string) bool { return s == name })
+}
+
+// applyPresenceFilter sends f to the discovery client and resyncs the peer
+// table with the peers it now reports.
+func (h *peerHandler) applyPresenceFilter(client *node.Client, f node.PresenceFilter) {
+	client.SetPresenceFilter(f)
+
+	for _, p := range h.peerTable.All() {
+		if p.Nickname != h.pool.nickname && !f.Allows(string(p.Nickname)) {
+			h.peerTable.Remove(p.Nickname)
+		}
+	}
+	for _, info := range client.GetAllPeers() {
+		if _, ok := h.peerTable.Get(PeerID(info.Nickname)); !ok {
+			h.peerTable.Add(peerInfoFromNode(info))
+		}
+	}
+}
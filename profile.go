@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// A profile is what a peer says about itself: a display name, the SHA-256
+// of an avatar image and a short note. It is signed with the peer's
+// Ed25519 identity key over its nickname, so the discovery nodes can pass
+// it on (opaque to them) next to the Hello that carries it too: receivers
+// check it against the key of the Hello, or the one in the libp2p peer ID
+// the node announced.
+const (
+	maxDisplayName     = 64  // bytes
+	maxProfileNote     = 280 // bytes
+	profileSignContext = "tmd profile v1"
+
+	// maxSignedProfile bounds an encoded profile: four length-prefixed
+	// blobs at their largest.
+	maxSignedProfile = 4*4 + maxDisplayName + sha256.Size + maxProfileNote + ed25519.SignatureSize
+)
+
+// Profile is a peer's self-description.
+type Profile struct {
+	DisplayName string
+	AvatarHash  []byte // SHA-256 of the avatar image, or empty
+	Note        string
+}
+
+func (pr Profile) validate() error {
+	switch {
+	case len(pr.DisplayName) > maxDisplayName:
+		return fmt.Errorf("display name longer than %d bytes", maxDisplayName)
+	case len(pr.Note) > maxProfileNote:
+		return fmt.Errorf("note longer than %d bytes", maxProfileNote)
+	case len(pr.AvatarHash) != 0 && len(pr.AvatarHash) != sha256.Size:
+		return fmt.Errorf("avatar hash must be %d bytes", sha256.Size)
+	case !utf8.ValidString(pr.DisplayName) || !utf8.ValidString(pr.Note):
+		return errors.New("profile text is not UTF-8")
+	}
+	return nil
+}
+
+func (pr Profile) empty() bool {
+	return pr.DisplayName == "" && len(pr.AvatarHash) == 0 && pr.Note == ""
+}
+
+// avatarHash returns the SHA-256 of the image at path.
+func avatarHash(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// Signed profile layout: blob(display name) || blob(avatar hash) ||
+// blob(note) || blob(signature). The signature covers
+// "tmd profile v1" || 0 || nickname || 0 || the three field blobs.
+func profileFields(pr Profile) []byte {
+	var b bytes.Buffer
+	_ = writeBlob(&b, []byte(pr.DisplayName))
+	_ = writeBlob(&b, pr.AvatarHash)
+	_ = writeBlob(&b, []byte(pr.Note))
+	return b.Bytes()
+}
+
+func profileSignInput(nickname PeerID, fields []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(profileSignContext)
+	b.WriteByte(0)
+	b.WriteString(string(nickname))
+	b.WriteByte(0)
+	b.Write(fields)
+	return b.Bytes()
+}
+
+// signProfile encodes pr for nickname, signed with priv.
+func signProfile(pr Profile, nickname PeerID, priv crypto.Signer) ([]byte, error) {
+	if err := pr.validate(); err != nil {
+		return nil, err
+	}
+	fields := profileFields(pr)
+	var b bytes.Buffer
+	b.Write(fields)
+	sig, err := priv.Sign(nil, profileSignInput(nickname, fields), crypto.Hash(0))
+	if err != nil {
+		return nil, fmt.Errorf("sign profile: %w", err)
+	}
+	_ = writeBlob(&b, sig)
+	return b.Bytes(), nil
+}
+
+// openProfile decodes a profile signed for nickname, checking the
+// signature with verify.
+func openProfile(signed []byte, nickname PeerID, verify func(msg, sig []byte) bool) (Profile, error) {
+	r := bytes.NewReader(signed)
+	var blobs [4][]byte
+	for i := range blobs {
+		b, err := readBlob(r)
+		if err != nil {
+			return Profile{}, fmt.Errorf("decode profile: %w", err)
+		}
+		blobs[i] = b
+	}
+	pr := Profile{DisplayName: string(blobs[0]), AvatarHash: blobs[1], Note: string(blobs[2])}
+	if len(pr.AvatarHash) == 0 {
+		pr.AvatarHash = nil
+	}
+	if err := pr.validate(); err != nil {
+		return Profile{}, err
+	}
+	fields := signed[:len(signed)-r.Len()-4-len(blobs[3])]
+	if !verify(profileSignInput(nickname, fields), blobs[3]) {
+		return Profile{}, errors.New("bad profile signature")
+	}
+	return pr, nil
+}
+
+// verifyEd checks signatures with an Ed25519 public key from a Hello.
+func verifyEd(pub []byte) func(msg, sig []byte) bool {
+	return func(msg, sig []byte) bool {
+		return len(pub) == ed25519.PublicKeySize && ed25519.Verify(ed25519.PublicKey(pub), msg, sig)
+	}
+}
+
+// verifyPeerID checks signatures with the key embedded in a libp2p peer
+// ID, which tmd derives from the same seed as the Hello key.
+func verifyPeerID(id peer.ID) func(msg, sig []byte) bool {
+	return func(msg, sig []byte) bool {
+		pub, err := id.ExtractPublicKey()
+		if err != nil {
+			return false
+		}
+		ok, err := pub.Verify(msg, sig)
+		return err == nil && ok
+	}
+}
+
+// profiles holds our signed profile and the verified profiles of peers.
+type profiles struct {
+	mu     sync.Mutex
+	own    []byte // signed; nil when we have none
+	byPeer map[PeerID]Profile
+}
+
+// setProfile signs pr as our profile, sent in Hello and to nodes
+// registered with afterwards.
+func (p *connPool) setProfile(pr Profile) error {
+	var signed []byte
+	if !pr.empty() {
+		var err error
+		if signed, err = signProfile(pr, p.nickname, p.selfSigner); err != nil {
+			return err
+		}
+	}
+	p.profiles.mu.Lock()
+	defer p.profiles.mu.Unlock()
+	p.profiles.own = signed
+	return nil
+}
+
+// ownProfile returns our signed profile, or nil.
+func (p *connPool) ownProfile() []byte {
+	p.profiles.mu.Lock()
+	defer p.profiles.mu.Unlock()
+	return p.profiles.own
+}
+
+// learnProfile keeps the profile a peer sent, if its signature holds.
+// An empty profile is ignored.
+func (p *connPool) learnProfile(from PeerID, signed []byte, verify func(msg, sig []byte) bool) {
+	if len(signed) == 0 {
+		return
+	}
+	pr, err := openProfile(signed, from, verify)
+	if err != nil {
+		p.console.Errorf("profile from %s: %v", from, err)
+		return
+	}
+	p.profiles.mu.Lock()
+	defer p.profiles.mu.Unlock()
+	if p.profiles.byPeer == nil {
+		p.profiles.byPeer = make(map[PeerID]Profile)
+	}
+	p.profiles.byPeer[from] = pr
+}
+
+// Profile returns the verified profile of a peer.
+func (p *connPool) Profile(peer PeerID) (Profile, bool) {
+	p.profiles.mu.Lock()
+	defer p.profiles.mu.Unlock()
+	pr, ok := p.profiles.byPeer[peer]
+	return pr, ok
+}
+
+// runWhois handles "/whois <peer>".
+func runWhois(c Console, pool *connPool, args string) {
+	nick := PeerID(args)
+	if nick == "" {
+		c.Errorf("usage: /whois <peer>")
+		return
+	}
+	pr, ok := pool.Profile(nick)
+	if nick == pool.nickname {
+		var err error
+		pr, err = openProfile(pool.ownProfile(), nick, verifyEd(pool.selfEdPub()))
+		ok = err == nil
+	}
+	if !ok {
+		c.Printf("[whois] %s has no profile", nick)
+		return
+	}
+	name := pr.DisplayName
+	if name == "" {
+		name = "(no display name)"
+	}
+	c.Printf("[whois] %s: %s", nick, name)
+	if pr.Note != "" {
+		c.Printf("[whois]   note: %s", pr.Note)
+	}
+	if len(pr.AvatarHash) > 0 {
+		c.Printf("[whois]   avatar sha256: %x", pr.AvatarHash)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+func TestSignedProfile(t *testing.T) {
+	keys, err := identity.DeriveKeys(bytes.Repeat([]byte{7}, identity.SeedSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	avatar := sha256.Sum256([]byte("png"))
+	pr := Profile{DisplayName: "Bob B.", AvatarHash: avatar[:], Note: "on call"}
+	signed, err := signProfile(pr, "bob", keys.Ed25519Priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signed) > maxSignedProfile {
+		t.Fatalf("signed profile is %d bytes, max %d", len(signed), maxSignedProfile)
+	}
+
+	for name, verify := range map[string]func(msg, sig []byte) bool{
+		"hello key": verifyEd(keys.Ed25519Pub),
+		"peer ID":   verifyPeerID(keys.PeerID),
+	} {
+		got, err := openProfile(signed, "bob", verify)
+		if err != nil || got.DisplayName != pr.DisplayName || got.Note != pr.Note || !bytes.Equal(got.AvatarHash, pr.AvatarHash) {
+			t.Fatalf("%s: openProfile = %+v, %v", name, got, err)
+		}
+	}
+
+	if _, err := openProfile(signed, "mallory", verifyEd(keys.Ed25519Pub)); err == nil {
+		t.Fatal("profile opened for another nickname")
+	}
+	tampered := bytes.Clone(signed)
+	tampered[5] ^= 1
+	if _, err := openProfile(tampered, "bob", verifyEd(keys.Ed25519Pub)); err == nil {
+		t.Fatal("tampered profile opened")
+	}
+	if _, err := signProfile(Profile{Note: strings.Repeat("x", maxProfileNote+1)}, "bob", keys.Ed25519Priv); err == nil {
+		t.Fatal("signed an oversized note")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"unicode/utf8"
+)
+
+// A reply to a request that carries a message ID quotes it: the response
+// media type names the message answered, and the text starts with an
+// excerpt of it on a "> " line. Senders that predate quoting show that
+// text as is, which reads as a quoted reply anyway.
+const (
+	quoteParam = "; quote="
+	// quoteExcerptLen bounds the excerpt, in runes.
+	quoteExcerptLen = 60
+)
+
+// quotedRespMediaType is the response media type of a reply to the
+// message with the given ID.
+func quotedRespMediaType(messageID []byte) string {
+	return respMediaType + quoteParam + hex.EncodeToString(messageID)
+}
+
+// quoteText prefixes a reply to msg with its excerpt.
+func quoteText(msg, text string) string {
+	return "> " + excerpt(msg) + "\n" + text
+}
+
+// parseQuotedReply splits a response quoting the message with the given
+// ID into the excerpt and the reply text. ok is false for responses that
+// quote nothing, or another message.
+func parseQuotedReply(mediaType, plain, messageID []byte) (quote, text string, ok bool) {
+	id, found := strings.CutPrefix(string(mediaType), respMediaType+quoteParam)
+	if !found || len(messageID) == 0 {
+		return "", "", false
+	}
+	if got, err := hex.DecodeString(id); err != nil || !bytes.Equal(got, messageID) {
+		return "", "", false
+	}
+	line, text, found := strings.Cut(string(plain), "\n")
+	quote, quoted := strings.CutPrefix(line, "> ")
+	if !found || !quoted {
+		return "", "", false
+	}
+	return quote, text, true
+}
+
+// excerpt is the first line of msg, shortened to quoteExcerptLen runes.
+func excerpt(msg string) string {
+	line, _, more := strings.Cut(msg, "\n")
+	if utf8.RuneCountInString(line) > quoteExcerptLen {
+		line = string([]rune(line)[:quoteExcerptLen])
+		more = true
+	}
+	if more {
+		line += "…"
+	}
+	return line
+}
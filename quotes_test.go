@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQuotedReply(t *testing.T) {
+	id := []byte("0123456789abcdef")
+	mt := []byte(quotedRespMediaType(id))
+	quote, text, ok := parseQuotedReply(mt, []byte(quoteText("lunch?\nat noon", "sure")), id)
+	if !ok || quote != "lunch?…" || text != "sure" {
+		t.Fatalf("parseQuotedReply = %q %q %v", quote, text, ok)
+	}
+
+	for name, c := range map[string]struct {
+		mediaType, plain, id string
+	}{
+		"plain response":  {respMediaType, "> x\ny", string(id)},
+		"other message":   {string(mt), "> x\ny", "fedcba9876543210"},
+		"no quote line":   {string(mt), "just text", string(id)},
+		"no message ID":   {string(mt), "> x\ny", ""},
+		"bad hex in type": {respMediaType + quoteParam + "zz", "> x\ny", string(id)},
+	} {
+		if _, _, ok := parseQuotedReply([]byte(c.mediaType), []byte(c.plain), []byte(c.id)); ok {
+			t.Errorf("%s: parsed as a quote", name)
+		}
+	}
+
+	long := strings.Repeat("é", quoteExcerptLen+5)
+	if got := excerpt(long); got != strings.Repeat("é", quoteExcerptLen)+"…" {
+		t.Fatalf("excerpt = %q", got)
+	}
+}
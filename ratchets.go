@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pivaldi/tmd/internal/ratchet"
+)
+
+// Requests, their responses and notifies sent on a session stream are
+// sealed twice: to the receiver's HPKE key as before, and inside that with
+// a Double Ratchet (internal/ratchet) the two ends set up for the stream.
+// The dialer offers a new X25519 key in its Hello; a listener that knows
+// ratchets answers with a new key of its own in a RATCHET frame, and both
+// derive the session's secret from three Diffie-Hellman exchanges (both
+// new keys, and each new key with the other side's HPKE key), as X3DH
+// does. Every message key is used once and forgotten, and each response
+// moves to new keys, so stealing the HPKE private keys later opens no
+// past message of the session.
+//
+// Ratcheted messages get ratchetSuffix on their media type, inside the
+// paddedSuffix, and the ratchet binds the media type they were sent as.
+// The dialer ratchets once the RATCHET frame arrived: a request sent
+// before that, or to a peer predating ratchets, is sealed to the HPKE key
+// only. Sessions live as long as their stream; a request resent on a
+// repaired session is sealed anew. Mail kept by the nodes, file transfers,
+// streams, typing notices, and rooms are not ratcheted.
+const (
+	ratchetSuffix  = "; ratchet=1"
+	ratchetContext = "tmd ratchet v1"
+)
+
+// ratchetAgreeContext binds a session's secret to its two ends and their
+// HPKE keys.
+func ratchetAgreeContext(dialer, listener PeerID, dialerHPKE, listenerHPKE []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(ratchetContext)
+	for _, f := range [][]byte{[]byte(dialer), []byte(listener), dialerHPKE, listenerHPKE} {
+		_ = writeBlob(&b, f)
+	}
+	return b.Bytes()
+}
+
+// setRatchetKey keeps our HPKE private key as an X25519 key for the
+// ratchet agreements; SetupStreamHandler calls it.
+func (p *connPool) setRatchetKey(hpkePriv []byte) error {
+	k, err := ecdh.X25519().NewPrivateKey(hpkePriv)
+	if err != nil {
+		return fmt.Errorf("ratchet key: %w", err)
+	}
+	p.ratchetKey = k
+	return nil
+}
+
+// offerRatchet returns the key the dialer puts in its Hello to to, and
+// the function completing the session once the listener's key arrives;
+// both are nil if ratchets are off.
+func (p *connPool) offerRatchet(to PeerInfo) ([]byte, func(listenerPub []byte) (*ratchet.Session, error), error) {
+	if p.ratchetKey == nil {
+		return nil, nil, nil
+	}
+	eph, err := ratchet.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	complete := func(listenerPub []byte) (*ratchet.Session, error) {
+		theirEph, err := ecdh.X25519().NewPublicKey(listenerPub)
+		if err != nil {
+			return nil, err
+		}
+		theirStatic, err := ecdh.X25519().NewPublicKey(to.HPKEPub)
+		if err != nil {
+			return nil, err
+		}
+		dh1, err := eph.ECDH(theirEph)
+		if err != nil {
+			return nil, err
+		}
+		dh2, err := eph.ECDH(theirStatic)
+		if err != nil {
+			return nil, err
+		}
+		dh3, err := p.ratchetKey.ECDH(theirEph)
+		if err != nil {
+			return nil, err
+		}
+		sk, err := ratchet.Agree(ratchetAgreeContext(p.nickname, to.Nickname, p.selfHPKEPubBytes, to.HPKEPub), dh1, dh2, dh3)
+		if err != nil {
+			return nil, err
+		}
+		return ratchet.NewInitiator(sk, theirEph)
+	}
+	return eph.PublicKey().Bytes(), complete, nil
+}
+
+// answerRatchet sets up the listener's session for the ratchet key in a
+// Hello, and returns it with the key to send back in a RATCHET frame. It
+// returns nils if the dialer offered none.
+func (p *connPool) answerRatchet(hello Hello) (*ratchet.Session, []byte, error) {
+	if len(hello.RatchetPub) == 0 || p.ratchetKey == nil {
+		return nil, nil, nil
+	}
+	theirEph, err := ecdh.X25519().NewPublicKey(hello.RatchetPub)
+	if err != nil {
+		return nil, nil, err
+	}
+	theirStatic, err := ecdh.X25519().NewPublicKey(hello.SenderHPKEPub)
+	if err != nil {
+		return nil, nil, err
+	}
+	eph, err := ratchet.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	dh1, err := eph.ECDH(theirEph)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh2, err := p.ratchetKey.ECDH(theirEph)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh3, err := eph.ECDH(theirStatic)
+	if err != nil {
+		return nil, nil, err
+	}
+	sk, err := ratchet.Agree(ratchetAgreeContext(hello.SenderID, p.nickname, hello.SenderHPKEPub, p.selfHPKEPubBytes), dh1, dh2, dh3)
+	if err != nil {
+		return nil, nil, err
+	}
+	rs, err := ratchet.NewResponder(sk, eph)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rs, eph.PublicKey().Bytes(), nil
+}
+
+// acceptRatchet completes the dialer's session with the listener's key
+// from a RATCHET frame.
+func (ps *peerSession) acceptRatchet(payload []byte) error {
+	if ps.completeRatchet == nil {
+		return errors.New("unexpected RATCHET frame")
+	}
+	if len(payload) != ratchet.KeySize {
+		return fmt.Errorf("bad ratchet key length: %d", len(payload))
+	}
+	rs, err := ps.completeRatchet(payload)
+	if err != nil {
+		return err
+	}
+	ps.completeRatchet = nil
+	ps.ratchet.Store(rs)
+	ps.ratchetReady()
+	return nil
+}
+
+// ratchetFor seals msg with rs when it is set and may send, returning the
+// media type and plaintext to seal to the HPKE key.
+func ratchetFor(rs *ratchet.Session, mediaType, msg string) (string, string, error) {
+	if rs == nil {
+		return mediaType, msg, nil
+	}
+	sealed, err := rs.Seal([]byte(msg), []byte(mediaType))
+	if errors.Is(err, ratchet.ErrCannotSend) {
+		return mediaType, msg, nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return mediaType + ratchetSuffix, string(sealed), nil
+}
+
+// openRatcheted opens a plaintext opened under mediaType with rs, if it
+// was ratcheted, and returns the media type it was sent as.
+func openRatcheted(rs *ratchet.Session, mediaType, plain []byte) ([]byte, []byte, error) {
+	mt, ratcheted := strings.CutSuffix(string(mediaType), ratchetSuffix)
+	if !ratcheted {
+		return mediaType, plain, nil
+	}
+	if rs == nil {
+		return nil, nil, errors.New("ratcheted message outside a ratchet session")
+	}
+	plain, err := rs.Open(plain, []byte(mt))
+	if err != nil {
+		return nil, nil, err
+	}
+	return []byte(mt), plain, nil
+}
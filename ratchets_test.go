@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/cloudflare/circl/kem"
+	"github.com/openpcc/twoway"
+)
+
+// ratchetPeer is a pool with HPKE keys, its info as peers see it, and a
+// receiver opening what is sealed to it.
+type ratchetPeer struct {
+	pool     *connPool
+	info     PeerInfo
+	receiver *twoway.MultiRequestReceiver
+}
+
+func newRatchetPeer(t *testing.T, nickname PeerID) ratchetPeer {
+	t.Helper()
+	p := newTestPool(nickname)
+	pub, priv, err := p.kemScheme.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.selfHPKEPubBytes, _ = pub.MarshalBinary()
+	privBytes, _ := priv.(kem.PrivateKey).MarshalBinary()
+	if err := p.setRatchetKey(privBytes); err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := twoway.NewMultiRequestReceiver(p.suite, p.keyID[0], priv, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ratchetPeer{pool: p, info: PeerInfo{Nickname: nickname, HPKEPub: p.selfHPKEPubBytes, KeyID: p.keyID}, receiver: receiver}
+}
+
+func TestRatchetedNotify(t *testing.T) {
+	alice, bob := newRatchetPeer(t, "alice"), newRatchetPeer(t, "bob")
+
+	offer, complete, err := alice.pool.offerRatchet(bob.info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := Hello{SenderID: "alice", SenderHPKEPub: alice.info.HPKEPub, RatchetPub: offer}
+	bobSession, answer, err := bob.pool.answerRatchet(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceSession, err := complete(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := alice.pool.sealNotifyWith(alice.pool.suite, aliceSession, bob.info, "hi", notifyMediaType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(n.MediaType) != notifyMediaType+ratchetSuffix || baseMediaType(n.MediaType) != notifyMediaType {
+		t.Fatalf("media type = %q", n.MediaType)
+	}
+	// Bob's HPKE key alone does not open it.
+	if _, err := bob.pool.openNotify(n, bob.receiver); err == nil {
+		t.Fatal("opened a ratcheted notify without the ratchet")
+	}
+	plain, err := bob.pool.openNotifyWith(bobSession, n, bob.receiver)
+	if err != nil || string(plain) != "hi" {
+		t.Fatalf("openNotifyWith = %q, %v", plain, err)
+	}
+	if _, err := bob.pool.openNotifyWith(bobSession, n, bob.receiver); err == nil {
+		t.Fatal("opened a ratcheted notify twice")
+	}
+
+	// Bob may answer once he received from alice.
+	mt, sealed, err := ratchetFor(bobSession, respMediaType, ackReply)
+	if err != nil || mt != respMediaType+ratchetSuffix {
+		t.Fatalf("ratchetFor = %q, %v", mt, err)
+	}
+	if mtOut, plain, err := openRatcheted(aliceSession, []byte(mt), []byte(sealed)); err != nil || string(mtOut) != respMediaType || string(plain) != ackReply {
+		t.Fatalf("openRatcheted = %q %q, %v", mtOut, plain, err)
+	}
+}
+
+func TestRatchetBoundToHPKEKeys(t *testing.T) {
+	alice, bob, carol := newRatchetPeer(t, "alice"), newRatchetPeer(t, "bob"), newRatchetPeer(t, "carol")
+
+	// Carol answers the offer alice made to bob, under bob's name.
+	offer, complete, err := alice.pool.offerRatchet(bob.info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol.pool.nickname = "bob"
+	carolSession, answer, err := carol.pool.answerRatchet(Hello{SenderID: "alice", SenderHPKEPub: alice.info.HPKEPub, RatchetPub: offer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceSession, err := complete(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, sealed, err := ratchetFor(aliceSession, notifyMediaType, "for bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openRatcheted(carolSession, []byte(mt), []byte(sealed)); err == nil {
+		t.Fatal("a listener without bob's HPKE key opened a message to bob")
+	}
+
+	// No offer, no ratchet.
+	if rs, pub, err := bob.pool.answerRatchet(Hello{SenderID: "alice", SenderHPKEPub: alice.info.HPKEPub}); rs != nil || pub != nil || err != nil {
+		t.Fatalf("answerRatchet without an offer = %v, %x, %v", rs, pub, err)
+	}
+}
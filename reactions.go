@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A reaction is a short string, usually an emoji, attached to a direct
+// message received from a peer. It goes back to the sender as a sealed
+// notify naming the message ID (laid out as an edit), and both sides show
+// it after the message's history line. Messages are the ones remembered
+// for edits (see edits.go).
+const (
+	reactionMediaType = "application/x-tmd-reaction"
+	// maxReactionSize bounds a reaction in bytes; it fits the longest
+	// emoji sequences.
+	maxReactionSize = 32
+)
+
+// reactionConsole is implemented by consoles that show reactions next to
+// the message they react to.
+type reactionConsole interface {
+	// AddReaction shows reaction after the latest history line for which
+	// match is true, and reports whether there was one.
+	AddReaction(match func(line string) bool, reaction string) bool
+}
+
+func validReaction(r string) error {
+	if r == "" || len(r) > maxReactionSize {
+		return fmt.Errorf("reaction must be 1 to %d bytes", maxReactionSize)
+	}
+	if strings.IndexFunc(r, func(c rune) bool { return unicode.IsSpace(c) || unicode.IsControl(c) }) >= 0 {
+		return errors.New("reaction must not contain spaces")
+	}
+	return nil
+}
+
+// React sends a reaction to the nth latest message received from a peer
+// (1 is the latest) and returns that message.
+func (p *connPool) React(to PeerInfo, n int, reaction string) (string, error) {
+	if err := validReaction(reaction); err != nil {
+		return "", err
+	}
+	p.edits.mu.Lock()
+	list := p.edits.received[to.Nickname]
+	if n < 1 || n > len(list) {
+		p.edits.mu.Unlock()
+		return "", fmt.Errorf("no message #%d from %s (%d remembered)", n, to.Nickname, len(list))
+	}
+	m := list[len(list)-n]
+	p.edits.mu.Unlock()
+
+	if err := p.sendNotify(to, string(encodeEdit(m.id, reaction)), reactionMediaType); err != nil {
+		return "", err
+	}
+	return m.text, nil
+}
+
+// handleReaction shows a peer's reaction to a message we sent it.
+func (p *connPool) handleReaction(from PeerID, plain []byte) error {
+	id, reaction, err := decodeEdit(plain)
+	if err != nil {
+		return fmt.Errorf("decode reaction: %w", err)
+	}
+	if err := validReaction(reaction); err != nil {
+		return fmt.Errorf("reaction from %s: %w", from, err)
+	}
+
+	p.edits.mu.Lock()
+	var text string
+	found := false
+	for _, m := range p.edits.sent[from] {
+		if bytes.Equal(m.id, id) {
+			text, found = m.text, true
+			break
+		}
+	}
+	p.edits.mu.Unlock()
+	if !found {
+		return nil
+	}
+
+	line := fmt.Sprintf("[%s to %s] %s", p.nickname, from, text)
+	if !p.showReaction(func(l string) bool { return l == line }, from, reaction) {
+		p.console.AddHistory(fmt.Sprintf("[%s reacted %s] %s", from, reaction, excerpt(text)))
+	}
+	return nil
+}
+
+// showReaction attaches "reaction peer" to a history line, if the console
+// can.
+func (p *connPool) showReaction(match func(line string) bool, from PeerID, reaction string) bool {
+	rc, ok := p.console.(reactionConsole)
+	return ok && rc.AddReaction(match, reaction+" "+string(from))
+}
+
+// runReact handles "/react <peer>[#n] <reaction>", where n counts back
+// from the latest message received from peer.
+func runReact(c Console, pool *connPool, args string) {
+	const usage = "usage: /react <peer>[#n] <reaction>"
+	target, reaction, ok := splitFirstWord(args)
+	if !ok {
+		c.Errorf(usage)
+		return
+	}
+	peer, num, numbered := strings.Cut(target, "#")
+	n := 1
+	if numbered {
+		var err error
+		if n, err = strconv.Atoi(num); err != nil || n < 1 {
+			c.Errorf(usage)
+			return
+		}
+	}
+	to, found := pool.peerTable.Get(PeerID(peer))
+	if !found {
+		c.Errorf("unknown peer: %s", peer)
+		return
+	}
+	text, err := pool.React(to, n, reaction)
+	if err != nil {
+		c.Errorf("react: %v", err)
+		return
+	}
+	match := func(line string) bool { return isMessageLine(line, to.Nickname, text) }
+	if !pool.showReaction(match, pool.nickname, reaction) {
+		c.Printf("[%s reacted %s] %s", pool.nickname, reaction, excerpt(text))
+	}
+}
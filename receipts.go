@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+)
+
+// Receipt kinds, in the order an interactive request goes through them.
+// The receiver sends a delivered receipt when the request arrives and a
+// read receipt once the user has seen it (see readConsole). Senders that
+// predate receipts ignore them.
+const (
+	receiptDelivered byte = 1
+	receiptRead      byte = 2
+)
+
+// receiptState names the state a receipt kind moves a message to.
+func receiptState(kind byte) string {
+	switch kind {
+	case receiptDelivered:
+		return "delivered"
+	case receiptRead:
+		return "read"
+	}
+	return "sent"
+}
+
+// unreadReceipts are the received interactive requests whose read receipt
+// is still due, oldest first per sender.
+type unreadReceipts struct {
+	mu      sync.Mutex
+	pending map[PeerID][]unreadRequest
+}
+
+type unreadRequest struct {
+	requestID uint64
+	out       *responder
+}
+
+// ackDelivered sends a delivered receipt for an interactive request and
+// keeps it until the user reads it.
+func (p *connPool) ackDelivered(from PeerID, requestID uint64, out *responder) {
+	_ = out.write(msgReceipt, encodeReceipt(Receipt{RequestID: requestID, Kind: receiptDelivered}))
+
+	p.unread.mu.Lock()
+	defer p.unread.mu.Unlock()
+	if p.unread.pending == nil {
+		p.unread.pending = make(map[PeerID][]unreadRequest)
+	}
+	p.unread.pending[from] = append(p.unread.pending[from], unreadRequest{requestID: requestID, out: out})
+}
+
+// markRead sends the read receipts for every request from peer so far.
+// Receipts whose stream has closed are lost.
+func (p *connPool) markRead(from PeerID) {
+	p.unread.mu.Lock()
+	list := p.unread.pending[from]
+	delete(p.unread.pending, from)
+	p.unread.mu.Unlock()
+
+	for _, u := range list {
+		_ = u.out.write(msgReceipt, encodeReceipt(Receipt{RequestID: u.requestID, Kind: receiptRead}))
+	}
+}
+
+// dropUnread forgets the read receipts due on a closed stream.
+func (p *connPool) dropUnread(out *responder) {
+	p.unread.mu.Lock()
+	defer p.unread.mu.Unlock()
+	for from, list := range p.unread.pending {
+		kept := list[:0]
+		for _, u := range list {
+			if u.out != out {
+				kept = append(kept, u)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.unread.pending, from)
+		} else {
+			p.unread.pending[from] = kept
+		}
+	}
+}
+
+// sentMessage follows one sent message on a receiptConsole. The line is
+// added once the message is on the wire, and receipts update it; one that
+// comes first is shown when the line is added.
+type sentMessage struct {
+	c    receiptConsole
+	text string
+
+	mu    sync.Mutex
+	id    uint64
+	added bool
+	kind  byte
+}
+
+func (m *sentMessage) sent() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.id = m.c.AddSent(m.text)
+	m.added = true
+	if m.kind != 0 {
+		m.c.SetReceipt(m.id, receiptState(m.kind))
+	}
+}
+
+func (m *sentMessage) receipt(kind byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if kind <= m.kind || kind > receiptRead {
+		return
+	}
+	m.kind = kind
+	if m.added {
+		m.c.SetReceipt(m.id, receiptState(kind))
+	}
+}
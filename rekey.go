@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Requests, notifies and file chunks are each sealed to a new HPKE
+// encapsulation, but a channel keeps the keys of its CHAN_OPEN and a room
+// the sender key last sent to its members. Both are replaced once a key
+// has sealed rekeyLimits' worth of messages or bytes. A channel sender
+// re-runs the encapsulation to the receiver's HPKE key for its direction
+// and sends the result in a CHAN_REKEY frame before the first frame under
+// the new key; a room member sends a new sender key to the members, as it
+// does when the membership changes.
+const chanRekeyContext = "tmd channel v1 rekey"
+
+// rekeyLimits says when a key is replaced; 0 turns a limit off.
+type rekeyLimits struct {
+	Messages uint64 // sealed under one key
+	Bytes    uint64 // of plaintext sealed under one key
+}
+
+// defaultRekeyLimits apply without --rekey.
+var defaultRekeyLimits = rekeyLimits{Messages: 1 << 20, Bytes: 1 << 30}
+
+// rekeyCount is what a key has sealed.
+type rekeyCount struct {
+	messages, bytes uint64
+}
+
+func (c *rekeyCount) add(n int) {
+	c.messages++
+	c.bytes += uint64(n)
+}
+
+// due reports whether a key that sealed c must be replaced before sealing
+// n more bytes. A key that sealed nothing is kept, however large n is.
+func (l rekeyLimits) due(c rekeyCount, n int) bool {
+	if c.messages == 0 {
+		return false
+	}
+	return l.Messages > 0 && c.messages >= l.Messages || l.Bytes > 0 && c.bytes+uint64(n) > l.Bytes
+}
+
+// parseRekeyLimits parses --rekey: "messages=N,bytes=SIZE", where SIZE
+// may end in KiB, MiB or GiB. Limits not given keep their default.
+func parseRekeyLimits(spec string) (rekeyLimits, error) {
+	l := defaultRekeyLimits
+	if strings.TrimSpace(spec) == "" {
+		return l, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return rekeyLimits{}, fmt.Errorf("rekey: expected key=value, got %q", part)
+		}
+		var err error
+		switch key {
+		case "messages":
+			l.Messages, err = strconv.ParseUint(val, 10, 64)
+		case "bytes":
+			l.Bytes, err = parseSize(val)
+		default:
+			return rekeyLimits{}, fmt.Errorf("rekey: unknown option %q", key)
+		}
+		if err != nil {
+			return rekeyLimits{}, fmt.Errorf("rekey: %s: %w", key, err)
+		}
+	}
+	return l, nil
+}
+
+// parseSize parses a byte count with an optional KiB, MiB or GiB suffix.
+func parseSize(s string) (uint64, error) {
+	shift := 0
+	for i, suffix := range []string{"KiB", "MiB", "GiB"} {
+		if num, ok := strings.CutSuffix(s, suffix); ok {
+			s, shift = num, 10*(i+1)
+			break
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > ^uint64(0)>>shift {
+		return 0, fmt.Errorf("size out of range: %s", s)
+	}
+	return n << shift, nil
+}
+
+// setRekeyLimits sets when channel and room keys are replaced; it is set
+// before anything is sent.
+func (p *connPool) setRekeyLimits(l rekeyLimits) {
+	p.rekey = l
+}
+
+// chanRekeyInfo is the HPKE info of a new key for channel id from sender
+// to receiver.
+func chanRekeyInfo(sender, receiver PeerID, id uint64) []byte {
+	info := []byte(chanRekeyContext + "\x00" + string(sender) + "\x00" + string(receiver) + "\x00")
+	return binary.BigEndian.AppendUint64(info, id)
+}
+
+// rekeyChannel encapsulates a new sending key for a channel to its peer,
+// for the frames from number seq on.
+func (p *connPool) rekeyChannel(key chanKey, seq uint64) (ChanRekey, cipher.AEAD, error) {
+	to, ok := p.peerTable.Get(key.peer)
+	if !ok {
+		return ChanRekey{}, nil, fmt.Errorf("unknown peer: %s", key.peer)
+	}
+	pub, err := p.kemScheme.UnmarshalBinaryPublicKey(to.HPKEPub)
+	if err != nil {
+		return ChanRekey{}, nil, fmt.Errorf("%s: bad HPKE key: %w", to.Nickname, err)
+	}
+	sender, err := p.suite.NewSender(pub, chanRekeyInfo(p.nickname, to.Nickname, key.id))
+	if err != nil {
+		return ChanRekey{}, nil, err
+	}
+	enc, sealer, err := sender.Setup(rand.Reader)
+	if err != nil {
+		return ChanRekey{}, nil, err
+	}
+	aeads, err := chanKeys(sealer.Export([]byte(chanExportContext), chanSecretSize), chanRekeyContext, 1)
+	if err != nil {
+		return ChanRekey{}, nil, err
+	}
+	return ChanRekey{ChannelID: key.id, Seq: seq, RecipientKeyID: to.KeyID, EncapKey: enc}, aeads[0], nil
+}
+
+// acceptChanRekey opens the new receiving key of a channel from a
+// CHAN_REKEY.
+func (p *connPool) acceptChanRekey(from PeerID, c *channel, k ChanRekey) error {
+	if string(k.RecipientKeyID) != string(p.keyID) {
+		return fmt.Errorf("rekey for keyID=%x (expected %x)", k.RecipientKeyID, p.keyID)
+	}
+	p.chans.mu.Lock()
+	priv := p.chans.priv
+	p.chans.mu.Unlock()
+	receiver, err := p.suite.NewReceiver(priv, chanRekeyInfo(from, p.nickname, k.ChannelID))
+	if err != nil {
+		return err
+	}
+	opener, err := receiver.Setup(k.EncapKey)
+	if err != nil {
+		return fmt.Errorf("rekey: %w", err)
+	}
+	aeads, err := chanKeys(opener.Export([]byte(chanExportContext), chanSecretSize), chanRekeyContext, 1)
+	if err != nil {
+		return err
+	}
+	return c.rekeyRecv(k.Seq, aeads[0])
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestParseRekeyLimits(t *testing.T) {
+	for _, c := range []struct {
+		spec string
+		want rekeyLimits
+	}{
+		{"", defaultRekeyLimits},
+		{"messages=10", rekeyLimits{Messages: 10, Bytes: defaultRekeyLimits.Bytes}},
+		{"messages=0, bytes=64MiB", rekeyLimits{Messages: 0, Bytes: 64 << 20}},
+		{"bytes=4096", rekeyLimits{Messages: defaultRekeyLimits.Messages, Bytes: 4096}},
+	} {
+		got, err := parseRekeyLimits(c.spec)
+		if err != nil || got != c.want {
+			t.Fatalf("parseRekeyLimits(%q) = %+v, %v; want %+v", c.spec, got, err, c.want)
+		}
+	}
+	for _, spec := range []string{"messages", "keys=1", "bytes=1TiB", "bytes=-1", "bytes=99999999999GiB"} {
+		if _, err := parseRekeyLimits(spec); err == nil {
+			t.Fatalf("parseRekeyLimits(%q) accepted", spec)
+		}
+	}
+}
+
+func TestRekeyDue(t *testing.T) {
+	l := rekeyLimits{Messages: 3, Bytes: 100}
+	if l.due(rekeyCount{}, 1000) {
+		t.Fatal("a key that sealed nothing is due")
+	}
+	if l.due(rekeyCount{messages: 2, bytes: 50}, 50) {
+		t.Fatal("due below both limits")
+	}
+	if !l.due(rekeyCount{messages: 3, bytes: 3}, 1) {
+		t.Fatal("not due at the message limit")
+	}
+	if !l.due(rekeyCount{messages: 1, bytes: 60}, 41) {
+		t.Fatal("not due past the byte limit")
+	}
+	if (rekeyLimits{}).due(rekeyCount{messages: 1 << 40, bytes: 1 << 50}, 1) {
+		t.Fatal("due without limits")
+	}
+}
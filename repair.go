@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Dead sessions are redialled in the background with exponential backoff:
+// repairBaseDelay, doubled up to repairMaxDelay, for repairAttempts tries.
+const (
+	repairBaseDelay = 250 * time.Millisecond
+	repairMaxDelay  = 8 * time.Second
+	repairAttempts  = 6
+)
+
+// maxResubmits bounds how often SendRequest resends one request over
+// repaired sessions.
+const maxResubmits = 3
+
+// sessionRepair tracks the re-establishment of one lost session. done is
+// closed once ps or err is set.
+type sessionRepair struct {
+	done chan struct{}
+	stop chan struct{} // closed when the session is removed on purpose
+	kick chan struct{} // retry now: the peer just reached us
+	ps   *peerSession
+	err  error
+}
+
+// sessionLost is the onLost hook of every outbound session.
+func (p *connPool) sessionLost(ps *peerSession) {
+	nick := ps.to.Nickname
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sessions[nick] != ps || p.repairs[nick] != nil {
+		// Replaced, removed or already being repaired.
+		return
+	}
+	r := &sessionRepair{
+		done: make(chan struct{}),
+		stop: make(chan struct{}),
+		kick: make(chan struct{}, 1),
+	}
+	p.repairs[nick] = r
+	go p.repair(nick, r)
+}
+
+func (p *connPool) repair(nick PeerID, r *sessionRepair) {
+	ps, err := p.redial(nick, r)
+
+	p.mu.Lock()
+	stopped := p.repairs[nick] != r
+	if !stopped {
+		delete(p.repairs, nick)
+	}
+	if ps != nil && stopped {
+		ps.close()
+		ps, err = nil, fmt.Errorf("session to %s was closed", nick)
+	}
+	if ps != nil {
+		p.sessions[nick] = ps
+	}
+	r.ps, r.err = ps, err
+	close(r.done)
+	p.mu.Unlock()
+
+	if err != nil && !stopped {
+		p.console.Errorf("[net] lost session to %s: %v", nick, err)
+	}
+}
+
+// redial tries to re-establish nick's session until it succeeds, runs out
+// of attempts or the repair is stopped.
+func (p *connPool) redial(nick PeerID, r *sessionRepair) (*peerSession, error) {
+	delay := repairBaseDelay
+	var err error
+	for range repairAttempts {
+		select {
+		case <-r.stop:
+			return nil, fmt.Errorf("session to %s was closed", nick)
+		case <-r.kick:
+		case <-time.After(delay):
+		}
+		// Dial the latest addresses: the peer may have roamed.
+		to, ok := p.peerTable.Get(nick)
+		if !ok {
+			return nil, fmt.Errorf("unknown peer: %s", nick)
+		}
+		var ps *peerSession
+		if ps, err = p.dialAndHandshake(to, false); err == nil {
+			return ps, nil
+		}
+		delay = min(2*delay, repairMaxDelay)
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", repairAttempts, err)
+}
+
+// awaitRepair waits for a repair of nick's session, if one is under way.
+func (p *connPool) awaitRepair(nick PeerID) (*peerSession, bool, error) {
+	p.mu.Lock()
+	r := p.repairs[nick]
+	p.mu.Unlock()
+	if r == nil {
+		return nil, false, nil
+	}
+	<-r.done
+	return r.ps, true, r.err
+}
+
+// kickRepair makes a pending repair of nick's session retry at once. It
+// reports whether one was pending.
+func (p *connPool) kickRepair(nick PeerID) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r := p.repairs[nick]
+	if r == nil {
+		return false
+	}
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// stopRepairLocked abandons the repair of nick's session, if any.
+func (p *connPool) stopRepairLocked(nick PeerID) {
+	if r := p.repairs[nick]; r != nil {
+		delete(p.repairs, nick)
+		close(r.stop)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionRepairResubmitsPending(t *testing.T) {
+	if testing.Short() {
+		t.Skip("needs loopback networking")
+	}
+	n := newSimNetwork(t)
+	n.tokens["alice"] = "token-alice"
+	n.tokens["bob"] = "token-bob"
+	n.startNode("n1")
+	n.startPeer("alice", []string{"n1"})
+	n.startPeer("bob", []string{"n1"})
+	alice, bob := n.peer("alice"), n.peer("bob")
+	if !alice.console.WaitFor("peer joined: bob", defaultExpectTimeout) {
+		t.Fatal("alice never saw bob")
+	}
+	to, _ := alice.pool.peerTable.Get("bob")
+
+	// Drop the connection while bob holds the first message, before he
+	// answers it: alice's request is pending when her session dies.
+	var once sync.Once
+	bob.pool.onReceive(func(m receivedMessage) {
+		once.Do(func() { _ = bob.host.Network().ClosePeer(alice.host.ID()) })
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := alice.pool.SendRequest(to, "survives the drop")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("send across a dropped session: %v", err)
+		}
+	case <-time.After(defaultExpectTimeout):
+		t.Fatal("send never completed")
+	}
+
+	// The request reached bob again on the repaired session, where its
+	// message ID marked it as a resend: he shows it once.
+	if got := bob.console.Queue("alice"); len(got) != 1 || got[0] != "survives the drop" {
+		t.Fatalf("bob's queue from alice: %q", got)
+	}
+	if _, ok := alice.pool.GetSession(to); !ok {
+		t.Fatal("alice has no live session to bob")
+	}
+	for _, line := range alice.console.History() {
+		if strings.Contains(line, "[error]") {
+			t.Fatalf("transient failure surfaced: %q", line)
+		}
+	}
+}
+
+func TestFirstSeen(t *testing.T) {
+	pool := newTestPool("bob")
+	id := bytes.Repeat([]byte{1}, messageIDSize)
+	if !pool.firstSeen("alice", id) {
+		t.Fatal("new ID reported seen")
+	}
+	if pool.firstSeen("alice", id) {
+		t.Fatal("resend not recognised")
+	}
+	if !pool.firstSeen("carol", id) {
+		t.Fatal("another sender's ID suppressed")
+	}
+
+	// Expired IDs are forgotten once the window is full.
+	pool.seen.at["alice\x00"+string(id)] = time.Now().Add(-dedupWindow)
+	for i := range dedupMax {
+		pool.firstSeen("dave", binary.BigEndian.AppendUint64(nil, uint64(i)))
+	}
+	if !pool.firstSeen("alice", id) {
+		t.Fatal("expired ID still seen")
+	}
+	if len(pool.seen.at) > dedupMax {
+		t.Fatalf("%d IDs remembered", len(pool.seen.at))
+	}
+}
+
+func TestResendGetsCachedResponse(t *testing.T) {
+	if testing.Short() {
+		t.Skip("needs loopback networking")
+	}
+	n := newSimNetwork(t)
+	n.tokens["alice"] = "token-alice"
+	n.tokens["bob"] = "token-bob"
+	n.startNode("n1")
+	n.startPeer("alice", []string{"n1"})
+	n.startPeer("bob", []string{"n1"})
+	alice, bob := n.peer("alice"), n.peer("bob")
+	if !alice.console.WaitFor("peer joined: bob", defaultExpectTimeout) {
+		t.Fatal("alice never saw bob")
+	}
+	to, _ := alice.pool.peerTable.Get("bob")
+	id := bytes.Repeat([]byte{7}, messageIDSize)
+
+	done := make(chan reply, 1)
+	go func() {
+		r, err := alice.pool.sendInteractive(to, "lunch?", id, nil, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- r
+	}()
+	if !bob.console.WaitFor("[from alice] lunch?", defaultExpectTimeout) {
+		t.Fatal("bob never got the message")
+	}
+	bob.console.Feed("/reply alice sure")
+	if first := <-done; first.Text != "sure" {
+		t.Fatalf("first reply = %+v", first)
+	}
+
+	// The same message again, as after a reconnect: bob answers with his
+	// earlier reply without showing it or holding it for /reply.
+	again, err := alice.pool.sendInteractive(to, "lunch?", id, nil, nil)
+	if err != nil || again.Text != "sure" || again.Quote != "lunch?" {
+		t.Fatalf("resend got %+v, %v", again, err)
+	}
+	if got := bob.console.Queue("alice"); len(got) != 0 {
+		t.Fatalf("bob's queue from alice: %q", got)
+	}
+}
+
+func TestResponseFor(t *testing.T) {
+	pool := newTestPool("bob")
+	id := bytes.Repeat([]byte{1}, messageIDSize)
+	pool.rememberResponse("alice", id, respMediaType, "early")
+	if _, ok := pool.responseFor("alice", id); ok {
+		t.Fatal("response kept for an unseen message")
+	}
+	pool.firstSeen("alice", id)
+	pool.rememberResponse("alice", id, respMediaType, "sure")
+	if r, ok := pool.responseFor("alice", id); !ok || r.text != "sure" {
+		t.Fatalf("responseFor = %+v, %v", r, ok)
+	}
+	if _, ok := pool.responseFor("carol", id); ok {
+		t.Fatal("response shared across senders")
+	}
+
+	// An expired ID seen again starts afresh.
+	pool.seen.at[seenKey("alice", id)] = time.Now().Add(-dedupWindow)
+	pool.firstSeen("alice", id)
+	if _, ok := pool.responseFor("alice", id); ok {
+		t.Fatal("stale response kept")
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/attest"
+	"github.com/pivaldi/tmd/internal/pins"
+)
+
+// REPL runs the main input loop, reading commands from c until /quit or
+// until the console is closed.
+func REPL(c Console, self PeerInfo, pool *connPool) {
+	for {
+		line, ok := c.ReadLine()
+		if !ok {
+			return
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "/") {
+			cmd, args, _ := strings.Cut(line, " ")
+			if !runCommand(c, pool, cmd, args) {
+				return
+			}
+			continue
+		}
+
+		// Direct message if line starts with @peer
+		if strings.HasPrefix(line, "@") {
+			toTag, msg, ok := splitFirstWord(line)
+			if !ok {
+				c.Errorf("usage: @peer <message>")
+				continue
+			}
+
+			toTag = strings.TrimPrefix(toTag, "@")
+			sendToDevices(c, self, pool, PeerID(toTag), msg)
+			continue
+		}
+
+		// Room message if line starts with #room
+		if strings.HasPrefix(line, "#") {
+			name, msg, ok := splitFirstWord(line)
+			if !ok {
+				c.Errorf("usage: #room <message>")
+				continue
+			}
+			sendRoom(c, pool, name, msg)
+			continue
+		}
+
+		// Otherwise: broadcast to everyone else.
+		showBroadcast(c, self, line, pool.Broadcast(line))
+	}
+}
+
+// showBroadcast reports which peers received a broadcast, with their
+// round trip, and which failed.
+func showBroadcast(c Console, self PeerInfo, line string, results []BroadcastResult) {
+	var sent []string
+	for _, r := range results {
+		if r.Err != nil {
+			c.Errorf("broadcast to %s failed, will retry: %v", r.Peer, r.Err)
+			continue
+		}
+		if r.Relayed {
+			sent = append(sent, fmt.Sprintf("%s via node", r.Peer))
+			continue
+		}
+		if r.Gossiped {
+			sent = append(sent, fmt.Sprintf("%s via gossip", r.Peer))
+			continue
+		}
+		sent = append(sent, fmt.Sprintf("%s %s", r.Peer, r.RTT.Round(time.Millisecond)))
+	}
+	count := fmt.Sprintf("%d", len(sent))
+	if len(sent) < len(results) {
+		count = fmt.Sprintf("%d of %d", len(sent), len(results))
+	}
+	summary := fmt.Sprintf("[broadcast] %s sent to %s peers: %s", self.Nickname, count, line)
+	if len(sent) > 0 {
+		summary += " (" + strings.Join(sent, ", ") + ")"
+	}
+	c.Printf("%s", summary)
+}
+
+// runCommand runs the slash command cmd with args. Unknown commands are
+// reported, never broadcast. It returns false on /quit.
+func runCommand(c Console, pool *connPool, cmd, args string) bool {
+	switch cmd {
+	case "/reply":
+		runReply(c, pool, args)
+	case "/notify":
+		runNotify(c, pool, args)
+	case "/join", "/leave", "/rooms":
+		runRoomCommand(c, pool, cmd, args)
+	case "/sub", "/unsub", "/topics", "/pub":
+		runTopicCommand(c, pool, cmd, args)
+	case "/send-file", "/files", "/save", "/discard", "/resume":
+		runFileCommand(c, pool, cmd, args)
+	case "/outbox", "/unqueue":
+		runOutboxCommand(c, pool, cmd, args)
+	case "/edit", "/delete":
+		runEditCommand(c, pool, cmd, args)
+	case "/react":
+		runReact(c, pool, args)
+	case "/forward":
+		runForward(c, pool, args)
+	case "/mentions":
+		runMentions(c, pool)
+	case "/status":
+		runStatus(c, pool, strings.TrimSpace(args))
+	case "/whois":
+		runWhois(c, pool, strings.TrimSpace(args))
+	case "/block", "/unblock", "/blocked":
+		runBlockCommand(c, pool, cmd, strings.TrimSpace(args))
+	case "/schedule", "/scheduled", "/unschedule":
+		runScheduleCommand(c, pool, cmd, strings.TrimSpace(args))
+	case "/autoreply":
+		runAutoReply(c, pool, strings.TrimSpace(args))
+	case "/call":
+		runCall(c, pool, strings.TrimSpace(args))
+	case "/chan", "/unchan":
+		runChannelCommand(c, pool, cmd, strings.TrimSpace(args))
+	case "/search":
+		runSearch(c, strings.TrimSpace(args))
+	case "/export":
+		runExport(c, pool, strings.TrimSpace(args))
+	case "/sync":
+		runSync(c, pool)
+	case "/repin":
+		runRepin(c, pool, args)
+	case "/fingerprint":
+		runFingerprint(c, pool, args)
+	case "/verify":
+		runVerify(c, pool, args)
+	case "/revoke":
+		runRevoke(c, pool, args)
+	case "/myqr":
+		runMyQR(c, pool, args)
+	case "/audit":
+		runAudit(c, pool, args)
+	case "/vouch":
+		runVouch(c, pool, args)
+	case "/book":
+		runBook(c, pool, strings.TrimSpace(args))
+	case "/note":
+		runNote(c, pool, strings.TrimSpace(args))
+	case "/forget":
+		runForget(c, pool, strings.TrimSpace(args))
+	case "/requests", "/accept", "/decline":
+		runRequestCommand(c, pool, cmd, strings.TrimSpace(args))
+	case "/suite":
+		runSuite(c, pool, strings.TrimSpace(args))
+	case "/quit", "/exit":
+		return false
+	case "/peers":
+		listPeers(c, pool)
+	default:
+		switch {
+		case presenceCommands[cmd]:
+			runPresenceCommand(c, pool, cmd, strings.Fields(args))
+		case muteCommands[cmd]:
+			runMuteCommand(c, pool, cmd, strings.Fields(args))
+		default:
+			c.Errorf("unknown command: %s", cmd)
+		}
+	}
+	return true
+}
+
+// runNotify handles "/notify <peer> <text>": a one-way message that is
+// shown to the peer but neither queued nor answered.
+func runNotify(c Console, pool *connPool, args string) {
+	peer, text, ok := splitFirstWord(args)
+	if !ok {
+		c.Errorf("usage: /notify <peer> <text>")
+		return
+	}
+	to, found := pool.peerTable.Get(PeerID(peer))
+	if !found {
+		c.Errorf("unknown peer: %s", peer)
+		return
+	}
+	if err := pool.SendNotify(to, text); err != nil {
+		c.Errorf("notify %s failed: %v", peer, err)
+		return
+	}
+	c.Printf("[%s notify to %s] %s", pool.nickname, peer, text)
+}
+
+func listPeers(c Console, pool *connPool) {
+	peers := pool.peerTable.All()
+	if len(peers) == 0 {
+		c.Printf("No online peers")
+	}
+	for _, p := range peers {
+		mark := ""
+		switch status, e := pool.trustStatus(p); status {
+		case attest.Verified:
+			mark = " [verified: " + e.External + "]"
+		case attest.Mismatch:
+			mark = " [KEY MISMATCH]"
+		}
+		if _, ok := pool.revokedPeer(p); ok {
+			mark += " [REVOKED]"
+		}
+		switch {
+		case pool.pinStatus(p) == pins.Changed:
+			mark += " [KEYS CHANGED]"
+		case pool.peerTrust(p) == peerVerified:
+			mark += " [verified]"
+		case pool.peerTrust(p) == peerVouched:
+			mark += " [vouched]"
+		case pool.peerTrust(p) == peerTOFU:
+			mark += " [tofu]"
+		case pool.peerTrust(p) == peerUntrusted:
+			mark += " [untrusted]"
+		}
+		c.Printf("- %s%s%s (peerID=%s) keyID=%s%s", p.Nickname, presenceMark(p.Presence), pool.muteMark(p.Nickname), p.PeerID.ShortString(), p.KeyID, mark)
+	}
+	for _, p := range pool.refusedAll() {
+		c.Printf("- %s (peerID=%s) keyID=%s [KEYS CHANGED] (not added; see /repin)", p.Nickname, p.PeerID.ShortString(), p.KeyID)
+	}
+	for _, seen := range pool.offlineSeen() {
+		c.Printf("- %s offline, last seen %s", seen.Peer, seenAgo(seen.Time))
+	}
+}
+
+// sendToDevices sends msg to a peer on each of its devices that is
+// online, sealed to the keys of each. When none is, it is queued for the
+// ones that left.
+func sendToDevices(c Console, self PeerInfo, pool *connPool, nickname PeerID, msg string) {
+	if devices := pool.peerTable.Devices(nickname); len(devices) > 0 {
+		for _, to := range devices {
+			sendTo(c, self, pool, to, msg)
+		}
+		return
+	}
+	left := pool.leftDevices(nickname)
+	if len(left) == 0 && pool.queuesFor(nickname) {
+		left = []PeerID{nickname}
+	}
+	if len(left) == 0 {
+		c.Errorf("unknown peer: %s", nickname)
+		return
+	}
+	for _, name := range left {
+		queueTo(c, pool, name, msg)
+	}
+}
+
+func sendTo(c Console, self PeerInfo, pool *connPool, to PeerInfo, msg string) {
+	if to.Nickname == self.Nickname {
+		c.Errorf("can't send to self")
+		return
+	}
+
+	// Clear queue for this peer
+	_ = c.ClearQueue(to.Nickname)
+
+	// Nothing is queued for a peer whose keys are refused.
+	if err := pool.checkKeys(to); err != nil {
+		c.Errorf("send failed: %v", err)
+		return
+	}
+	if pool.holdUnverified(to, msg) {
+		c.Printf("[verify] %s is not verified: send the same message again to send it anyway, or check its keys (/fingerprint %s, then /verify %s)", to.Nickname, to.Nickname, to.Nickname)
+		return
+	}
+	// Writing to an untrusted peer accepts it.
+	if pool.untrusted(to.Nickname) {
+		if err := pool.acceptPeer(to.Nickname); err != nil {
+			c.Errorf("accept: %v", err)
+		}
+	}
+
+	// Messages already waiting for the peer go first.
+	if pool.queuesFor(to.Nickname) {
+		queueTo(c, pool, to.Nickname, msg)
+		pool.flushOutbox(to.Nickname)
+		return
+	}
+	sendDirect(c, pool, to, msg, nil, nil, func(err error) {
+		var offline *offlineError
+		if !errors.As(err, &offline) {
+			c.Errorf("send failed: %v", err)
+			return
+		}
+		queueTo(c, pool, to.Nickname, msg)
+	})
+}
+
+// queueTo puts a message to an offline peer in the outbox.
+func queueTo(c Console, pool *connPool, to PeerID, msg string) {
+	if err := pool.queueOutgoing(to, msg); err != nil {
+		c.Errorf("outbox: %v", err)
+	}
+	c.Printf("[outbox] %s is offline; message queued until it joins: %s", to, msg)
+}
+
+// sendDirect sends msg to a peer in the background and shows it once it
+// is on the wire. sent, if not nil, is called then too; unsent is called
+// instead if the send fails before that. messageID is passed on to
+// sendInteractive.
+func sendDirect(c Console, pool *connPool, to PeerInfo, msg string, messageID []byte, sent func(), unsent func(err error)) {
+	// Consoles that can show receipts mark the line sent, delivered, read.
+	line := fmt.Sprintf("[%s to %s] %s", pool.nickname, to.Nickname, msg)
+	show := func() { c.Printf("%s", line) }
+	var receipt func(kind byte)
+	if rc, ok := c.(receiptConsole); ok {
+		m := &sentMessage{c: rc, text: line}
+		show, receipt = m.sent, m.receipt
+	}
+	var wasSent atomic.Bool
+	onSent := func() {
+		wasSent.Store(true)
+		show()
+		if sent != nil {
+			sent()
+		}
+	}
+
+	// The receiver may take its time to /reply: wait in the background.
+	go func() {
+		reply, err := pool.sendInteractive(to, msg, messageID, onSent, receipt)
+		if err != nil && !wasSent.Load() && unsent != nil {
+			unsent(err)
+			return
+		}
+		if err != nil {
+			c.Errorf("send failed: %v", err)
+			return
+		}
+		if reply.Quote != "" {
+			c.AddHistory("  > " + reply.Quote)
+		}
+		if reply.Text != ackReply {
+			c.AddHistory(fmt.Sprintf("[reply from %s] %s", to.Nickname, reply.Text))
+		}
+	}()
+}
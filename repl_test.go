@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/circl/hpke"
+)
+
+func newTestPool(nickname PeerID) *connPool {
+	suite := hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	return newConnPool(nil, NewPeerTable(), suite, hpke.KEM_X25519_HKDF_SHA256.Scheme(), nickname, make([]byte, KeyIDSize), nil, nil)
+}
+
+func TestREPLHeadless(t *testing.T) {
+	c := newHeadlessConsole()
+	pool := newTestPool("alice")
+	pool.setConsole(c)
+	self := PeerInfo{Nickname: "alice"}
+
+	done := make(chan struct{})
+	go func() {
+		REPL(c, self, pool)
+		close(done)
+	}()
+
+	c.Feed("/peers")
+	if !c.WaitFor("No online peers", time.Second) {
+		t.Fatalf("missing peer list output: %q", c.History())
+	}
+
+	c.Feed("@carol hi there")
+	if !c.WaitFor("[error] unknown peer: carol", time.Second) {
+		t.Fatalf("missing unknown peer error: %q", c.History())
+	}
+
+	c.Feed("@carol")
+	if !c.WaitFor("[error] usage: @peer <message>", time.Second) {
+		t.Fatalf("missing usage error: %q", c.History())
+	}
+
+	c.Feed("/reply carol")
+	if !c.WaitFor("[error] usage: /reply <peer>[#n] <text>", time.Second) {
+		t.Fatalf("missing reply usage error: %q", c.History())
+	}
+
+	c.Feed("/reply carol thanks")
+	if !c.WaitFor("[error] no message is awaiting a reply from carol", time.Second) {
+		t.Fatalf("missing no-pending error: %q", c.History())
+	}
+
+	c.Feed("/shrug ok")
+	if !c.WaitFor("[error] unknown command: /shrug", time.Second) {
+		t.Fatalf("missing unknown command error: %q", c.History())
+	}
+
+	pool.peerTable.Add(PeerInfo{Nickname: "alice"})
+	c.Feed("@alice hello me")
+	if !c.WaitFor("[error] can't send to self", time.Second) {
+		t.Fatalf("missing self-send error: %q", c.History())
+	}
+
+	c.Feed("/quit")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("REPL did not exit on /quit")
+	}
+}
+
+func TestREPLExitsOnClose(t *testing.T) {
+	c := newHeadlessConsole()
+	done := make(chan struct{})
+	go func() {
+		REPL(c, PeerInfo{Nickname: "alice"}, newTestPool("alice"))
+		close(done)
+	}()
+
+	c.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("REPL did not exit when console closed")
+	}
+}
+
+func TestHeadlessConsoleQueue(t *testing.T) {
+	c := newHeadlessConsole()
+	c.AddDirectMessage("bob", "one")
+	c.AddDirectMessage("bob", "two")
+
+	if got := c.Queue("bob"); len(got) != 2 || got[1] != "two" {
+		t.Fatalf("unexpected queue: %q", got)
+	}
+	if n := c.ClearQueue("bob"); n != 2 {
+		t.Fatalf("ClearQueue returned %d", n)
+	}
+	if !c.WaitFor("[from bob] one", 0) {
+		t.Fatalf("direct message not in history: %q", c.History())
+	}
+}
+
+func TestShowBroadcast(t *testing.T) {
+	c := newHeadlessConsole()
+	self := PeerInfo{Nickname: "alice"}
+	results := []BroadcastResult{
+		{Peer: "bob", RTT: 12 * time.Millisecond},
+		{Peer: "carol", Err: errors.New("connection refused")},
+		{Peer: "dave", RTT: 3400 * time.Microsecond},
+	}
+	showBroadcast(c, self, "hello all", results)
+	for _, want := range []string{
+		"[error] broadcast to carol failed, will retry: connection refused",
+		"[broadcast] alice sent to 2 of 3 peers: hello all (bob 12ms, dave 3ms)",
+	} {
+		if !c.WaitFor(want, 0) {
+			t.Fatalf("missing %q: %q", want, c.History())
+		}
+	}
+	if err := broadcastErr(results); err == nil || err.Error() != "to carol: connection refused" {
+		t.Fatalf("broadcastErr = %v", err)
+	}
+
+	showBroadcast(c, self, "anyone?", nil)
+	if !c.WaitFor("[broadcast] alice sent to 0 peers: anyone?", 0) {
+		t.Fatalf("empty broadcast: %q", c.History())
+	}
+	if err := broadcastErr(nil); err != nil {
+		t.Fatalf("broadcastErr(nil) = %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/openpcc/twoway"
+	"github.com/pivaldi/tmd/internal/ratchet"
+)
+
+// Request media types. An interactive request asks the receiver to answer
+// it with /reply; any other request is acknowledged with ackReply at once.
+// Receivers that predate interactive replies acknowledge both.
+const (
+	reqMediaType            = "text/plain; purpose=req"
+	interactiveReqMediaType = "text/plain; purpose=req; reply=interactive"
+	respMediaType           = "text/plain; purpose=resp"
+	notifyMediaType         = "text/plain; purpose=notify"
+)
+
+// ackReply is the response to requests nobody answered.
+const ackReply = "message received"
+
+// replyWindow is how long an interactive request waits for /reply before
+// it is acknowledged with ackReply.
+const replyWindow = 60 * time.Second
+
+// responder writes responses on one inbound stream. Held replies are
+// answered from the REPL or a timer while the stream handler keeps reading.
+type responder struct {
+	writes    sendQueue
+	stream    network.Stream
+	sendLimit uint32
+	fragments bool
+	padding   bool             // pad responses (--pad)
+	ratchet   *ratchet.Session // the stream's, or nil (see ratchets.go)
+	keys      *sessionKeys     // the session's, once keyed (see sessionkeys.go); read loop only
+}
+
+func (r *responder) respond(requestID uint64, seal responseSealer, text string) error {
+	return r.respondAs(requestID, seal, respMediaType, text)
+}
+
+// respondAs responds with a media type other than respMediaType.
+func (r *responder) respondAs(requestID uint64, seal responseSealer, mediaType, text string) error {
+	mediaType, text, err := ratchetFor(r.ratchet, mediaType, text)
+	if err != nil {
+		return fmt.Errorf("ratchet: %w", err)
+	}
+	mediaType, text = padFor(r.padding, mediaType, text)
+	cipher, err := seal(mediaType, text)
+	if err != nil {
+		return err
+	}
+
+	resp := Response{RequestID: requestID, MediaType: []byte(mediaType), Ciphertext: cipher}
+	return r.write(msgResponse, encodeResponse(resp))
+}
+
+// responseSealer seals the response to an opened request, of media type
+// mediaType: with the request's HPKE context, or the session's keys (see
+// sessionkeys.go).
+type responseSealer func(mediaType, text string) ([]byte, error)
+
+// twowayResponses returns the sealer of the response to a request opener
+// opened.
+func twowayResponses(opener *twoway.RequestOpener) responseSealer {
+	return func(mediaType, text string) ([]byte, error) {
+		sealer, err := opener.NewResponseSealer(strings.NewReader(text), []byte(mediaType))
+		if err != nil {
+			return nil, fmt.Errorf("NewResponseSealer: %w", err)
+		}
+		cipher, err := io.ReadAll(sealer)
+		if err != nil {
+			return nil, fmt.Errorf("read response cipher: %w", err)
+		}
+		return cipher, nil
+	}
+}
+
+// write sends one message on the stream.
+func (r *responder) write(typ byte, payload []byte) error {
+	return r.writes.do(classOf(typ), func() error {
+		return writeMsgLimit(r.stream, typ, payload, r.sendLimit, r.fragments)
+	})
+}
+
+// heldReply is an interactive request waiting for /reply.
+type heldReply struct {
+	from      PeerID
+	messageID []byte        // nil for senders that predate message IDs
+	text      string        // the request, quoted by the reply
+	timeout   time.Duration // the sender's, or 0 (see deadlines.go)
+	requestID uint64
+	seal      responseSealer
+	out       *responder
+	timer     *time.Timer
+}
+
+// heldReplies are the interactive requests awaiting an answer, oldest
+// first per peer.
+type heldReplies struct {
+	mu      sync.Mutex
+	pending map[PeerID][]*heldReply
+}
+
+var errNoHeldReply = errors.New("no message is awaiting a reply")
+
+// holdReply keeps the response to an interactive request open until
+// Reply answers it or replyWindow elapses, or the sender's timeout if it
+// is shorter: the request is then answered as expired.
+func (p *connPool) holdReply(h *heldReply) {
+	window, expired := replyWindow, false
+	if h.timeout > 0 && h.timeout < window {
+		window, expired = h.timeout, true
+	}
+	p.held.mu.Lock()
+	defer p.held.mu.Unlock()
+	if p.held.pending == nil {
+		p.held.pending = make(map[PeerID][]*heldReply)
+	}
+	p.held.pending[h.from] = append(p.held.pending[h.from], h)
+	h.timer = time.AfterFunc(window, func() {
+		if !p.takeHeld(h) {
+			return
+		}
+		if expired {
+			_ = p.answerHeld(h, expiredRespMediaType, expiredReply)
+			return
+		}
+		_ = p.answerHeld(h, respMediaType, ackReply)
+	})
+}
+
+// retargetHeld moves the reply held for an earlier copy of h's message to
+// h's request, on which the sender now waits. It reports whether such a
+// reply was held.
+func (p *connPool) retargetHeld(h *heldReply) bool {
+	p.held.mu.Lock()
+	defer p.held.mu.Unlock()
+	for _, x := range p.held.pending[h.from] {
+		if x.messageID != nil && bytes.Equal(x.messageID, h.messageID) {
+			x.requestID, x.seal, x.out = h.requestID, h.seal, h.out
+			return true
+		}
+	}
+	return false
+}
+
+// takeHeld removes h from the pending replies, reporting whether it was
+// still pending.
+func (p *connPool) takeHeld(h *heldReply) bool {
+	p.held.mu.Lock()
+	defer p.held.mu.Unlock()
+	list := p.held.pending[h.from]
+	for i, x := range list {
+		if x == h {
+			p.held.pending[h.from] = append(list[:i:i], list[i+1:]...)
+			if len(p.held.pending[h.from]) == 0 {
+				delete(p.held.pending, h.from)
+			}
+			h.timer.Stop()
+			return true
+		}
+	}
+	return false
+}
+
+// dropHeld forgets the replies held on a closed stream. Replies to
+// requests with a message ID are kept: the sender resends them once its
+// session is repaired, and retargetHeld moves them to the new stream.
+func (p *connPool) dropHeld(out *responder) {
+	p.held.mu.Lock()
+	var gone []*heldReply
+	for _, list := range p.held.pending {
+		for _, h := range list {
+			if h.out == out && h.messageID == nil {
+				gone = append(gone, h)
+			}
+		}
+	}
+	p.held.mu.Unlock()
+	for _, h := range gone {
+		p.takeHeld(h)
+	}
+}
+
+// Reply answers an interactive request from peer with text: the nth one
+// awaiting a reply, counting from 1, or the oldest if n is 0. Requests
+// with a message ID are quoted (see quotes.go). It returns the request
+// answered.
+func (p *connPool) Reply(from PeerID, n int, text string) (string, error) {
+	p.held.mu.Lock()
+	var h *heldReply
+	list := p.held.pending[from]
+	if n == 0 && len(list) > 0 {
+		h = list[0]
+	} else if n > 0 && n <= len(list) {
+		h = list[n-1]
+	}
+	p.held.mu.Unlock()
+
+	if h == nil || !p.takeHeld(h) {
+		if n > 0 && len(list) > 0 {
+			return "", fmt.Errorf("%w from %s as #%d (there are %d)", errNoHeldReply, from, n, len(list))
+		}
+		return "", fmt.Errorf("%w from %s (use @%s to send a new message)", errNoHeldReply, from, from)
+	}
+	var err error
+	if h.messageID != nil {
+		err = p.answerHeld(h, quotedRespMediaType(h.messageID), quoteText(h.text, text))
+	} else {
+		err = p.answerHeld(h, respMediaType, text)
+	}
+	if err != nil {
+		return "", fmt.Errorf("reply to %s: %w", from, err)
+	}
+	return h.text, nil
+}
+
+// answerHeld writes the response to a held request, and keeps it for
+// resends of the request.
+func (p *connPool) answerHeld(h *heldReply, mediaType, text string) error {
+	p.rememberResponse(h.from, h.messageID, mediaType, text)
+	return h.out.respondAs(h.requestID, h.seal, mediaType, text)
+}
+
+// runReply handles "/reply <peer>[#n] <text>".
+func runReply(c Console, pool *connPool, args string) {
+	target, text, ok := splitFirstWord(args)
+	if !ok {
+		c.Errorf("usage: /reply <peer>[#n] <text>")
+		return
+	}
+	peer, num, numbered := strings.Cut(target, "#")
+	n := 0
+	if numbered {
+		var err error
+		if n, err = strconv.Atoi(num); err != nil || n < 1 {
+			c.Errorf("usage: /reply <peer>[#n] <text>")
+			return
+		}
+	}
+	quoted, err := pool.Reply(PeerID(peer), n, text)
+	if err != nil {
+		c.Errorf("%v", err)
+		return
+	}
+	_ = c.ClearQueue(PeerID(peer))
+	c.AddHistory("  > " + excerpt(quoted))
+	c.Printf("[%s reply to %s] %s", pool.nickname, peer, text)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pivaldi/tmd/internal/pins"
+)
+
+// With --requests (and --pins), a peer is untrusted until the user takes
+// its messages: it /verify'd its keys, enough verified peers vouched for
+// them, or the user accepted it, with /accept, by sending it a direct
+// message or by /repin. The direct messages of an untrusted peer are
+// message requests, as Matrix has invites: they go to a requests pane of
+// their own, not to the queue, and get no autoreply. Once the peer is
+// trusted (tofu, vouched or verified), its requests move to the queue;
+// /decline drops them, leaving it untrusted. Requests are not kept across
+// restarts, and only the latest are kept: anyone can send them. Requests
+// from untrusted peers reach neither a Handler set with setHandler nor
+// routed methods (see handler.go).
+const peerUntrusted = "untrusted"
+
+const (
+	maxRequestPeers    = 50 // peers with requests; the earliest is dropped
+	maxRequestsPerPeer = 20 // requests kept per peer; the oldest is dropped
+)
+
+// requestState holds the direct messages of untrusted peers.
+type requestState struct {
+	mu      sync.Mutex
+	on      bool
+	pending map[PeerID][]string
+	order   []PeerID // peers in pending, by their first request
+}
+
+// requestConsole is implemented by consoles that show message requests
+// in a pane of their own.
+type requestConsole interface {
+	// SetRequests shows the messages of peer awaiting /accept; none
+	// removes the peer.
+	SetRequests(peer PeerID, messages []string)
+}
+
+// setMessageRequests makes the direct messages of untrusted peers wait
+// for /accept.
+func (p *connPool) setMessageRequests(on bool) {
+	p.requests.mu.Lock()
+	p.requests.on = on
+	p.requests.mu.Unlock()
+}
+
+func (p *connPool) requestsOn() bool {
+	p.requests.mu.Lock()
+	defer p.requests.mu.Unlock()
+	return p.requests.on
+}
+
+// untrusted reports whether the direct messages of peer are requests.
+func (p *connPool) untrusted(peer PeerID) bool {
+	if p.pinned == nil || !p.requestsOn() {
+		return false
+	}
+	pin, ok := p.pinned.Get(string(peer))
+	return !ok || p.trustOf(pins.Match, pin) == peerUntrusted
+}
+
+// addRequest keeps a direct message of an untrusted peer for /accept.
+func (p *connPool) addRequest(from PeerID, text string) {
+	p.requests.mu.Lock()
+	if p.requests.pending == nil {
+		p.requests.pending = make(map[PeerID][]string)
+	}
+	first := len(p.requests.pending[from]) == 0
+	var dropped PeerID
+	if first {
+		if len(p.requests.order) >= maxRequestPeers {
+			dropped = p.requests.order[0]
+			p.requests.order = p.requests.order[1:]
+			delete(p.requests.pending, dropped)
+		}
+		p.requests.order = append(p.requests.order, from)
+	}
+	list := append(p.requests.pending[from], text)
+	if len(list) > maxRequestsPerPeer {
+		list = slices.Delete(list, 0, len(list)-maxRequestsPerPeer)
+	}
+	p.requests.pending[from] = list
+	list = slices.Clone(list)
+	p.requests.mu.Unlock()
+
+	c, ok := p.console.(requestConsole)
+	if !ok {
+		p.console.AddHistory(fmt.Sprintf("[request from %s] %s", from, text))
+		return
+	}
+	if dropped != "" {
+		c.SetRequests(dropped, nil)
+	}
+	c.SetRequests(from, list)
+	if first {
+		p.console.AddHistory(fmt.Sprintf("[requests] %s, not trusted yet, sent you a message: /accept %s to read it in the queue, or /decline %s", from, from, from))
+	}
+}
+
+// takeRequests removes and returns the requests of peer.
+func (p *connPool) takeRequests(peer PeerID) []string {
+	p.requests.mu.Lock()
+	list := p.requests.pending[peer]
+	delete(p.requests.pending, peer)
+	if i := slices.Index(p.requests.order, peer); i >= 0 {
+		p.requests.order = slices.Delete(p.requests.order, i, i+1)
+	}
+	p.requests.mu.Unlock()
+	if c, ok := p.console.(requestConsole); ok && len(list) > 0 {
+		c.SetRequests(peer, nil)
+	}
+	return list
+}
+
+// releaseRequests moves the requests of a peer now trusted to the queue.
+func (p *connPool) releaseRequests(peer PeerID) {
+	for _, text := range p.takeRequests(peer) {
+		p.showDirectFrom(peer, text)
+	}
+}
+
+// pendingRequests returns the requests by peer, sorted by peer.
+func (p *connPool) pendingRequests() ([]PeerID, map[PeerID][]string) {
+	p.requests.mu.Lock()
+	defer p.requests.mu.Unlock()
+	peers := make([]PeerID, 0, len(p.requests.pending))
+	pending := make(map[PeerID][]string, len(p.requests.pending))
+	for peer, list := range p.requests.pending {
+		peers = append(peers, peer)
+		pending[peer] = slices.Clone(list)
+	}
+	slices.Sort(peers)
+	return peers, pending
+}
+
+// acceptPeer marks a pinned peer as one whose messages the user takes.
+func (p *connPool) acceptPeer(nickname PeerID) error {
+	if p.pinned == nil {
+		return errors.New("no pin store (see --pins)")
+	}
+	pin, ok, err := p.pinned.Accept(string(nickname))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s has no pinned keys yet", nickname)
+	}
+	p.showPeerTrust(nickname, p.trustOf(pins.Match, pin))
+	return nil
+}
+
+// runRequestCommand handles "/requests", "/accept peer" and
+// "/decline peer".
+func runRequestCommand(c Console, pool *connPool, cmd, args string) {
+	nickname := PeerID(strings.TrimPrefix(args, "@"))
+	if cmd != "/requests" && (nickname == "" || strings.Contains(args, " ")) {
+		c.Errorf("usage: %s <peer>", cmd)
+		return
+	}
+	switch cmd {
+	case "/requests":
+		peers, pending := pool.pendingRequests()
+		if len(peers) == 0 {
+			c.Printf("[requests] none")
+			return
+		}
+		for _, peer := range peers {
+			c.Printf("[requests] %s (%d):", peer, len(pending[peer]))
+			for _, text := range pending[peer] {
+				c.Printf("  %s", text)
+			}
+		}
+	case "/accept":
+		if err := pool.acceptPeer(nickname); err != nil {
+			c.Errorf("accept: %v", err)
+			return
+		}
+		c.Printf("[requests] %s accepted", nickname)
+	case "/decline":
+		n := len(pool.takeRequests(nickname))
+		if n == 0 {
+			c.Errorf("no requests from %s", nickname)
+			return
+		}
+		c.Printf("[requests] %d request(s) from %s declined", n, nickname)
+	}
+}
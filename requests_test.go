@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/pivaldi/tmd/internal/pins"
+)
+
+// TestMessageRequests checks that the direct messages of a peer not
+// accepted yet wait among the requests without autoreply, and move to the
+// queue once it is accepted.
+func TestMessageRequests(t *testing.T) {
+	store, err := pins.OpenStore(filepath.Join(t.TempDir(), "pins.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newHeadlessConsole()
+	pool := newTestPool("alice")
+	pool.setConsole(c)
+	pool.setPinStore(store)
+	pool.setMessageRequests(true)
+	pool.setAutoReplies([]autoRule{{Reply: "away"}})
+	for _, nick := range []PeerID{"bob", "carol"} {
+		if err := pool.observeKeys(nick, []byte("ed-"+nick), []byte("hpke-"+nick), "the node"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := c.PeerTrust("bob"); got != peerUntrusted {
+		t.Fatalf("bob on first contact: %q, want %q", got, peerUntrusted)
+	}
+
+	pool.showDirectFrom("bob", "hi")
+	pool.showDirectFrom("bob", "it's bob")
+	pool.showDirectFrom("carol", "buy now")
+	if got := c.Requests("bob"); len(got) != 2 || got[0] != "hi" || len(c.Queue("bob")) != 0 {
+		t.Fatalf("requests %q, queue %q", got, c.Queue("bob"))
+	}
+	_, resp, err := pool.defaultHandler(context.Background(), PeerInfo{Nickname: "bob"}, reqMediaType, []byte("hi"))
+	if err != nil || string(resp) != ackReply {
+		t.Fatalf("untrusted peer got %q, %v; want %q", resp, err, ackReply)
+	}
+
+	runRequestCommand(c, pool, "/accept", "bob")
+	if got := c.Queue("bob"); len(got) != 2 || len(c.Requests("bob")) != 0 {
+		t.Fatalf("after /accept: queue %q, requests %q", got, c.Requests("bob"))
+	}
+	if got := c.PeerTrust("bob"); got != peerTOFU {
+		t.Fatalf("accepted bob: %q, want %q", got, peerTOFU)
+	}
+	pool.showDirectFrom("bob", "thanks")
+	if got := c.Queue("bob"); len(got) != 3 {
+		t.Fatalf("queue after /accept = %q", got)
+	}
+	if _, resp, _ := pool.defaultHandler(context.Background(), PeerInfo{Nickname: "bob"}, reqMediaType, []byte("hi")); string(resp) != "away" {
+		t.Fatalf("accepted peer got %q, want the autoreply", resp)
+	}
+
+	runRequestCommand(c, pool, "/decline", "carol")
+	if len(c.Requests("carol")) != 0 || len(c.Queue("carol")) != 0 || !pool.untrusted("carol") {
+		t.Fatal("/decline did not drop carol's requests, or trusted carol")
+	}
+	if pool.untrusted("bob") {
+		t.Fatal("bob untrusted after /accept")
+	}
+}
+
+// TestMessageRequestLimits checks that the requests kept are bounded per
+// peer and in peers, dropping the oldest, and that untrusted peers reach
+// neither the Handler nor routed methods.
+func TestMessageRequestLimits(t *testing.T) {
+	store, err := pins.OpenStore(filepath.Join(t.TempDir(), "pins.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newHeadlessConsole()
+	pool := newTestPool("alice")
+	pool.setConsole(c)
+	pool.setPinStore(store)
+	pool.setMessageRequests(true)
+
+	for i := range maxRequestsPerPeer + 5 {
+		pool.showDirectFrom("bob", fmt.Sprint(i))
+	}
+	if got := c.Requests("bob"); len(got) != maxRequestsPerPeer || got[0] != "5" {
+		t.Fatalf("%d requests from bob, first %q; want %d from \"5\"", len(got), got[0], maxRequestsPerPeer)
+	}
+	for i := range maxRequestPeers {
+		pool.showDirectFrom(PeerID(fmt.Sprint("spam", i)), "buy now")
+	}
+	if peers, _ := pool.pendingRequests(); len(peers) != maxRequestPeers || len(c.Requests("bob")) != 0 {
+		t.Fatalf("%d peers with requests, bob's %q; want %d, bob's dropped", len(peers), c.Requests("bob"), maxRequestPeers)
+	}
+
+	called := false
+	pool.setHandler(HandlerFunc(func(context.Context, PeerInfo, string, []byte) (string, []byte, error) {
+		called = true
+		return "", []byte("bot"), nil
+	}))
+	hello := Hello{SenderID: "carol"}
+	req := Request{MediaType: []byte(reqMediaType)}
+	resp, err := pool.handleRequest(hello, "", req, []byte("hi"))
+	if err != nil || called || resp.text != ackReply {
+		t.Fatalf("untrusted carol: %q, %v, Handler called %v; want %q without the Handler", resp.text, err, called, ackReply)
+	}
+	if _, err := pool.handleRouted(pool.requestHandler(), hello, "", req, []byte("{}")); !errors.Is(err, errNotAccepted) || called {
+		t.Fatalf("routed method for untrusted carol: %v, called %v", err, called)
+	}
+	if err := pool.observeKeys("carol", []byte("ed-carol"), []byte("hpke-carol"), "the node"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.acceptPeer("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := pool.handleRequest(hello, "", req, []byte("hi")); err != nil || !called || resp.text != "bot" {
+		t.Fatalf("accepted carol: %q, %v, Handler called %v", resp.text, err, called)
+	}
+}
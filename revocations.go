@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pivaldi/tmd/internal/keyid"
+)
+
+// A revocation statement declares one of our keys compromised. It names
+// the KeyID, the HPKE key it fingerprints and the Ed25519 key of the same
+// identity, and is signed with that Ed25519 key over our nickname: holding
+// the key is enough to revoke it, and whoever stole it can only make
+// everyone stop using it. /revoke publishes ours through the discovery
+// nodes, which keep it and push it to every peer that may see us; they
+// refuse to encrypt to the key from then on and drop sessions using it.
+const (
+	revokeSignContext = "tmd revoke v1"
+	maxRevokeReason   = 280 // bytes
+)
+
+// errRevoked is returned for messages to peers whose key is revoked.
+var errRevoked = errors.New("key is revoked")
+
+// revocation is an opened revocation statement.
+type revocation struct {
+	KeyID   []byte
+	EdPub   ed25519.PublicKey
+	HPKEPub []byte
+	At      time.Time
+	Reason  string
+}
+
+// revocationPublisher publishes our revocation statements; it is the
+// discovery client.
+type revocationPublisher interface {
+	Revoke(statement []byte) error
+}
+
+type revocationState struct {
+	mu      sync.Mutex
+	publish revocationPublisher   // nil in standalone mode
+	byKeyID map[string]revocation // KeyID -> statement
+	byEdKey map[string]revocation // Ed25519 key -> statement
+}
+
+// setRevocationPublisher connects /revoke to the discovery client.
+func (p *connPool) setRevocationPublisher(pub revocationPublisher) {
+	p.revoked.mu.Lock()
+	defer p.revoked.mu.Unlock()
+	p.revoked.publish = pub
+}
+
+// Signed revocation layout: blob(keyID) || blob(Ed25519 key) ||
+// blob(HPKE key) || blob(u64 unix seconds) || blob(reason) ||
+// blob(signature). The signature covers "tmd revoke v1" || 0 || nickname
+// || 0 || the five field blobs.
+func revocationFields(r revocation) []byte {
+	var b bytes.Buffer
+	_ = writeBlob(&b, r.KeyID)
+	_ = writeBlob(&b, r.EdPub)
+	_ = writeBlob(&b, r.HPKEPub)
+	_ = writeBlob(&b, binary.BigEndian.AppendUint64(nil, uint64(r.At.Unix())))
+	_ = writeBlob(&b, []byte(r.Reason))
+	return b.Bytes()
+}
+
+func revocationSignInput(nickname PeerID, fields []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(revokeSignContext)
+	b.WriteByte(0)
+	b.WriteString(string(nickname))
+	b.WriteByte(0)
+	b.Write(fields)
+	return b.Bytes()
+}
+
+// signRevocation encodes a statement revoking the keys of priv and hpkePub
+// for nickname, signed with priv.
+func signRevocation(nickname PeerID, priv crypto.Signer, hpkePub []byte, reason string, at time.Time) ([]byte, error) {
+	if len(reason) > maxRevokeReason || !utf8.ValidString(reason) {
+		return nil, fmt.Errorf("reason must be UTF-8 of at most %d bytes", maxRevokeReason)
+	}
+	r := revocation{
+		KeyID:   keyid.Of(hpkePub),
+		EdPub:   priv.Public().(ed25519.PublicKey),
+		HPKEPub: hpkePub,
+		At:      at,
+		Reason:  reason,
+	}
+	fields := revocationFields(r)
+	sig, err := priv.Sign(nil, revocationSignInput(nickname, fields), crypto.Hash(0))
+	if err != nil {
+		return nil, fmt.Errorf("sign revocation: %w", err)
+	}
+	var b bytes.Buffer
+	b.Write(fields)
+	_ = writeBlob(&b, sig)
+	return b.Bytes(), nil
+}
+
+// openRevocation decodes a statement published by nickname and checks its
+// signature with the Ed25519 key it revokes.
+func openRevocation(statement []byte, nickname PeerID) (revocation, error) {
+	r := bytes.NewReader(statement)
+	var blobs [6][]byte
+	for i := range blobs {
+		b, err := readBlob(r)
+		if err != nil {
+			return revocation{}, fmt.Errorf("decode revocation: %w", err)
+		}
+		blobs[i] = b
+	}
+	switch {
+	case r.Len() != 0:
+		return revocation{}, errors.New("decode revocation: trailing bytes")
+	case len(blobs[1]) != ed25519.PublicKeySize || len(blobs[3]) != 8:
+		return revocation{}, errors.New("decode revocation: bad field size")
+	case !bytes.Equal(blobs[0], keyid.Of(blobs[2])):
+		return revocation{}, errors.New("revocation: keyID does not match the HPKE key")
+	case len(blobs[4]) > maxRevokeReason || !utf8.Valid(blobs[4]):
+		return revocation{}, errors.New("revocation: bad reason")
+	}
+	fields := statement[:len(statement)-4-len(blobs[5])]
+	if !ed25519.Verify(blobs[1], revocationSignInput(nickname, fields), blobs[5]) {
+		return revocation{}, errors.New("revocation: bad signature")
+	}
+	return revocation{
+		KeyID:   blobs[0],
+		EdPub:   blobs[1],
+		HPKEPub: blobs[2],
+		At:      time.Unix(int64(binary.BigEndian.Uint64(blobs[3])), 0),
+		Reason:  string(blobs[4]),
+	}, nil
+}
+
+// learnRevocation records r and reports whether it is new.
+func (p *connPool) learnRevocation(r revocation) bool {
+	p.revoked.mu.Lock()
+	defer p.revoked.mu.Unlock()
+	if _, ok := p.revoked.byKeyID[string(r.KeyID)]; ok {
+		return false
+	}
+	if p.revoked.byKeyID == nil {
+		p.revoked.byKeyID = make(map[string]revocation)
+		p.revoked.byEdKey = make(map[string]revocation)
+	}
+	p.revoked.byKeyID[string(r.KeyID)] = r
+	p.revoked.byEdKey[string(r.EdPub)] = r
+	return true
+}
+
+// revokedKeys returns the revocation covering a KeyID or an Ed25519 key,
+// if any.
+func (p *connPool) revokedKeys(keyID, edPub []byte) (revocation, bool) {
+	p.revoked.mu.Lock()
+	defer p.revoked.mu.Unlock()
+	if r, ok := p.revoked.byKeyID[string(keyID)]; ok && len(keyID) > 0 {
+		return r, true
+	}
+	r, ok := p.revoked.byEdKey[string(edPub)]
+	return r, ok && len(edPub) > 0
+}
+
+// revokedPeer returns the revocation covering the keys of a peer, if any.
+func (p *connPool) revokedPeer(to PeerInfo) (revocation, bool) {
+	var edPub []byte
+	if to.PeerID != "" {
+		edPub, _ = identityKey(to)
+	}
+	return p.revokedKeys(to.KeyID, edPub)
+}
+
+// checkRevoked fails with errRevoked if to's keys are revoked.
+func (p *connPool) checkRevoked(to PeerInfo) error {
+	if r, ok := p.revokedPeer(to); ok {
+		return fmt.Errorf("%s: %w (keyID=%x, on %s)", to.Nickname, errRevoked, r.KeyID, r.At.Local().Format(time.DateOnly))
+	}
+	return nil
+}
+
+// handleRevocation checks a statement a node pushed and, if new, refuses
+// the key from now on and drops our session using it.
+func (p *connPool) handleRevocation(from PeerID, statement []byte) error {
+	r, err := openRevocation(statement, from)
+	if err != nil {
+		return err
+	}
+	if !p.learnRevocation(r) {
+		return nil
+	}
+	when := r.At.Local().Format(time.DateOnly)
+	if bytes.Equal(r.KeyID, p.keyID) {
+		p.console.Errorf("WARNING: our key %x was revoked on %s (%s): peers refuse to encrypt to it. Create new keys with 'tmd keygen' and restart with them", r.KeyID, when, r.Reason)
+		return nil
+	}
+	p.console.Errorf("WARNING: %s revoked its key %x on %s (%s): messages to it are refused", from, r.KeyID, when, r.Reason)
+	p.mu.Lock()
+	var flagged []PeerID
+	for nick, s := range p.sessions {
+		if _, ok := p.revokedPeer(s.to); ok {
+			flagged = append(flagged, nick)
+		}
+	}
+	p.mu.Unlock()
+	for _, nick := range flagged {
+		p.console.Errorf("[revoked] our session with %s uses a revoked key: closing it", nick)
+		p.RemoveSession(nick)
+	}
+	return nil
+}
+
+// revoke signs a statement revoking our keys, publishes it through the
+// nodes and stops encrypting to them ourselves.
+func (p *connPool) revoke(reason string) ([]byte, error) {
+	p.revoked.mu.Lock()
+	pub := p.revoked.publish
+	p.revoked.mu.Unlock()
+	if pub == nil {
+		return nil, errors.New("no discovery nodes to publish it through")
+	}
+	statement, err := signRevocation(p.nickname, p.selfSigner, p.selfHPKEPubBytes, reason, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := pub.Revoke(statement); err != nil {
+		return nil, err
+	}
+	r, err := openRevocation(statement, p.nickname)
+	if err != nil {
+		return nil, err
+	}
+	p.learnRevocation(r)
+	return r.KeyID, nil
+}
+
+// runRevoke handles "/revoke reason".
+func runRevoke(c Console, pool *connPool, args string) {
+	reason := strings.TrimSpace(args)
+	if reason == "" {
+		c.Errorf("usage: /revoke <reason> (revokes our keys for good)")
+		return
+	}
+	keyID, err := pool.revoke(reason)
+	if err != nil {
+		c.Errorf("revoke: %v", err)
+		return
+	}
+	c.Printf("[revoke] key %x is revoked and published through the nodes; peers will refuse to encrypt to it", keyID)
+	c.Printf("[revoke] create new keys with 'tmd keygen' and restart with them")
+}
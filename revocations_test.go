@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+func TestRevocationStatement(t *testing.T) {
+	keys, err := identity.DeriveKeys(bytes.Repeat([]byte{1}, identity.SeedSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1_700_000_000, 0)
+	statement, err := signRevocation("alice", keys.Ed25519Priv, keys.HPKEPubBytes, "laptop stolen", at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := openRevocation(statement, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r.KeyID, keys.KeyID) || !r.At.Equal(at) || r.Reason != "laptop stolen" {
+		t.Fatalf("opened %+v", r)
+	}
+
+	// Published by another nickname, or altered on the way.
+	if _, err := openRevocation(statement, "mallory"); err == nil {
+		t.Fatal("opened under another nickname")
+	}
+	for i := range statement {
+		bad := bytes.Clone(statement)
+		bad[i] ^= 1
+		if _, err := openRevocation(bad, "alice"); err == nil {
+			t.Fatalf("opened with byte %d flipped", i)
+		}
+	}
+	if _, err := openRevocation(append(bytes.Clone(statement), 0), "alice"); err == nil {
+		t.Fatal("opened with a trailing byte")
+	}
+	if _, err := signRevocation("alice", keys.Ed25519Priv, keys.HPKEPubBytes, string(make([]byte, maxRevokeReason+1)), at); err == nil {
+		t.Fatal("signed an overlong reason")
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pivaldi/tmd/internal/node"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sync/errgroup"
+)
+
+// Rooms are named groups ("#name") whose membership the discovery nodes
+// keep. Each member encrypts its messages to a room once, under its own
+// sender key for that room, and sends the same ciphertext to every member.
+// Sender keys travel pairwise, sealed to each member as notifies, and are
+// replaced whenever the membership changes so that former members cannot
+// read later messages. A receiver looks keys up by the authenticated peer
+// of the session a message came in on, so members cannot speak for each
+// other.
+
+// senderKeyMediaType marks notifies carrying a sender key.
+const senderKeyMediaType = "application/x-tmd-sender-key"
+
+// roomDirectory is the discovery client as used by rooms.
+type roomDirectory interface {
+	JoinRoom(room string) error
+	LeaveRoom(room string)
+}
+
+// senderKey is one generation of a member's key for a room.
+type senderKey struct {
+	gen uint32
+	key []byte
+}
+
+type room struct {
+	members []PeerID // as last reported by the nodes, without us
+	own     senderKey
+	sealed  rekeyCount    // under own (see rekey.go)
+	keyed   chan struct{} // closed once own has been sent to members
+
+	// Keys of the other members: the latest generation and the one before,
+	// for messages sent just before a change.
+	keys map[PeerID][]senderKey
+}
+
+// roomState holds the rooms joined with /join.
+type roomState struct {
+	mu    sync.Mutex
+	dir   roomDirectory // nil in standalone mode
+	rooms map[string]*room
+}
+
+// setRoomDirectory connects /join and /leave to the discovery client.
+func (p *connPool) setRoomDirectory(dir roomDirectory) {
+	p.rooms.mu.Lock()
+	defer p.rooms.mu.Unlock()
+	p.rooms.dir = dir
+}
+
+func newSenderKey(gen uint32) senderKey {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		panic(err) // crypto/rand does not fail
+	}
+	return senderKey{gen: gen, key: key}
+}
+
+// JoinRoom joins name; members show up once the nodes report them.
+func (p *connPool) JoinRoom(name string) error {
+	p.rooms.mu.Lock()
+	defer p.rooms.mu.Unlock()
+	if p.rooms.dir == nil {
+		return fmt.Errorf("rooms need a discovery node")
+	}
+	if _, ok := p.rooms.rooms[name]; ok {
+		return nil
+	}
+	if err := p.rooms.dir.JoinRoom(name); err != nil {
+		return err
+	}
+	if p.rooms.rooms == nil {
+		p.rooms.rooms = make(map[string]*room)
+	}
+	keyed := make(chan struct{})
+	close(keyed) // nobody to send it to yet
+	p.rooms.rooms[name] = &room{own: newSenderKey(1), keyed: keyed, keys: make(map[PeerID][]senderKey)}
+	return nil
+}
+
+// LeaveRoom leaves name and forgets its keys.
+func (p *connPool) LeaveRoom(name string) error {
+	p.rooms.mu.Lock()
+	defer p.rooms.mu.Unlock()
+	if _, ok := p.rooms.rooms[name]; !ok {
+		return fmt.Errorf("not in %s", name)
+	}
+	delete(p.rooms.rooms, name)
+	if p.rooms.dir != nil {
+		p.rooms.dir.LeaveRoom(name)
+	}
+	return nil
+}
+
+// Rooms lists the joined rooms and their other members.
+func (p *connPool) Rooms() map[string][]PeerID {
+	p.rooms.mu.Lock()
+	defer p.rooms.mu.Unlock()
+	out := make(map[string][]PeerID, len(p.rooms.rooms))
+	for name, r := range p.rooms.rooms {
+		out[name] = slices.Clone(r.members)
+	}
+	return out
+}
+
+// setRoomMembers applies the membership reported by the nodes: our sender
+// key is replaced and sent to the new member list.
+func (p *connPool) setRoomMembers(name string, members []string) {
+	var others []PeerID
+	for _, m := range members {
+		if PeerID(m) != p.nickname {
+			others = append(others, PeerID(m))
+		}
+	}
+
+	p.rooms.mu.Lock()
+	r, ok := p.rooms.rooms[name]
+	if !ok || slices.Equal(r.members, others) {
+		p.rooms.mu.Unlock()
+		return
+	}
+	for nick := range r.keys {
+		if !slices.Contains(others, nick) {
+			delete(r.keys, nick)
+		}
+	}
+	r.members = others
+	p.renewSenderKey(name, r)
+	p.rooms.mu.Unlock()
+
+	p.console.AddHistory(fmt.Sprintf("[%s] members: %s", name, memberList(others, p.nickname)))
+}
+
+// renewSenderKey replaces our sender key for a room and sends it to the
+// members in the background; p.rooms.mu is held.
+func (p *connPool) renewSenderKey(name string, r *room) {
+	r.own = newSenderKey(r.own.gen + 1)
+	r.sealed = rekeyCount{}
+	keyed := make(chan struct{})
+	r.keyed = keyed
+	key, members := r.own, slices.Clone(r.members)
+
+	go func() {
+		defer close(keyed)
+		payload := encodeSenderKey(name, key)
+		var g errgroup.Group
+		for _, nick := range members {
+			to, ok := p.peerTable.Get(nick)
+			if !ok {
+				continue
+			}
+			g.Go(func() error {
+				if err := p.sendNotify(to, string(payload), senderKeyMediaType); err != nil {
+					p.console.Errorf("%s: key for %s: %v", name, nick, err)
+				}
+				return nil
+			})
+		}
+		_ = g.Wait()
+	}()
+}
+
+// SendRoom encrypts msg once under our sender key for name and sends it to
+// every member, returning how many got it.
+func (p *connPool) SendRoom(name, msg string) (int, error) {
+	p.rooms.mu.Lock()
+	r, ok := p.rooms.rooms[name]
+	if !ok {
+		p.rooms.mu.Unlock()
+		return 0, fmt.Errorf("not in %s (use /join %s)", name, name)
+	}
+	if p.rekey.due(r.sealed, len(msg)) {
+		p.renewSenderKey(name, r)
+	}
+	r.sealed.add(len(msg))
+	members, key, keyed := slices.Clone(r.members), r.own, r.keyed
+	p.rooms.mu.Unlock()
+
+	// Members must have the key before messages sealed with it.
+	<-keyed
+
+	aead, err := chacha20poly1305.NewX(key.key)
+	if err != nil {
+		return 0, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, err
+	}
+	m := RoomMessage{Room: name, Gen: key.gen, Nonce: nonce}
+	m.Ciphertext = aead.Seal(nil, nonce, []byte(msg), roomAD(name, p.nickname, key.gen))
+	payload := encodeRoomMessage(m)
+
+	var (
+		g    errgroup.Group
+		mu   sync.Mutex
+		sent int
+		errs []error
+	)
+	for _, nick := range members {
+		to, ok := p.peerTable.Get(nick)
+		if !ok {
+			continue
+		}
+		g.Go(func() error {
+			err := p.sendOneWay(to, msgRoom, payload)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", nick, err))
+			} else {
+				sent++
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return sent, errors.Join(errs...)
+}
+
+// acceptSenderKey stores a sender key received from a member.
+func (p *connPool) acceptSenderKey(from PeerID, payload []byte) error {
+	name, key, err := decodeSenderKey(payload)
+	if err != nil {
+		return err
+	}
+	p.rooms.mu.Lock()
+	defer p.rooms.mu.Unlock()
+	r, ok := p.rooms.rooms[name]
+	if !ok {
+		return nil // left meanwhile
+	}
+	keys := append(r.keys[from], key)
+	if len(keys) > 2 {
+		keys = keys[len(keys)-2:]
+	}
+	r.keys[from] = keys
+	return nil
+}
+
+// handleRoomMessage opens a room message from a member and shows it. Like
+// notifies, room messages are not passed to onReceive subscribers.
+func (p *connPool) handleRoomMessage(from PeerID, payload []byte) error {
+	m, err := decodeRoomMessage(payload)
+	if err != nil {
+		return fmt.Errorf("decode room message: %w", err)
+	}
+
+	p.rooms.mu.Lock()
+	var key []byte
+	if r, ok := p.rooms.rooms[m.Room]; ok {
+		for _, k := range r.keys[from] {
+			if k.gen == m.Gen {
+				key = k.key
+			}
+		}
+	}
+	p.rooms.mu.Unlock()
+	if key == nil {
+		p.console.Errorf("%s: message from %s under an unknown key", m.Room, from)
+		return nil
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	if len(m.Nonce) != aead.NonceSize() {
+		return fmt.Errorf("room message from %s: bad nonce", from)
+	}
+	plain, err := aead.Open(nil, m.Nonce, m.Ciphertext, roomAD(m.Room, from, m.Gen))
+	if err != nil {
+		p.console.Errorf("%s: cannot decrypt message from %s", m.Room, from)
+		return nil
+	}
+	p.console.AddHistory(fmt.Sprintf("[%s %s] %s", m.Room, from, plain))
+	return nil
+}
+
+// memberList formats the members of a room, us included.
+func memberList(others []PeerID, self PeerID) string {
+	names := append(peerNames(others), string(self))
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+// roomAD binds a room message to its room, sender and key generation.
+func roomAD(name string, from PeerID, gen uint32) []byte {
+	var b bytes.Buffer
+	_ = writeBlob(&b, []byte(name))
+	_ = writeBlob(&b, []byte(from))
+	_ = binary.Write(&b, binary.BigEndian, gen)
+	return b.Bytes()
+}
+
+// Sender key payload: blob(room) || blob(u32 gen) || blob(key)
+func encodeSenderKey(name string, k senderKey) []byte {
+	var b bytes.Buffer
+	var gen [4]byte
+	binary.BigEndian.PutUint32(gen[:], k.gen)
+	_ = writeBlob(&b, []byte(name))
+	_ = writeBlob(&b, gen[:])
+	_ = writeBlob(&b, k.key)
+	return b.Bytes()
+}
+
+func decodeSenderKey(p []byte) (string, senderKey, error) {
+	r := bytes.NewReader(p)
+	name, err := readBlob(r)
+	if err != nil {
+		return "", senderKey{}, err
+	}
+	gen, err := readBlob(r)
+	if err != nil {
+		return "", senderKey{}, err
+	}
+	key, err := readBlob(r)
+	if err != nil {
+		return "", senderKey{}, err
+	}
+	if len(gen) != 4 || len(key) != chacha20poly1305.KeySize {
+		return "", senderKey{}, fmt.Errorf("bad sender key")
+	}
+	return string(name), senderKey{gen: binary.BigEndian.Uint32(gen), key: key}, nil
+}
+
+// runRoomCommand handles /join, /leave and /rooms.
+func runRoomCommand(c Console, pool *connPool, cmd, args string) {
+	name := strings.TrimSpace(args)
+	switch cmd {
+	case "/join":
+		if !node.ValidRoom(name) {
+			c.Errorf("usage: /join #room")
+			return
+		}
+		if err := pool.JoinRoom(name); err != nil {
+			c.Errorf("%v", err)
+			return
+		}
+		c.Printf("[%s] joined", name)
+	case "/leave":
+		if err := pool.LeaveRoom(name); err != nil {
+			c.Errorf("%v", err)
+			return
+		}
+		c.Printf("[%s] left", name)
+	case "/rooms":
+		rooms := pool.Rooms()
+		if len(rooms) == 0 {
+			c.Printf("No rooms joined")
+			return
+		}
+		for _, name := range slices.Sorted(maps.Keys(rooms)) {
+			c.Printf("%s: %s", name, memberList(rooms[name], pool.nickname))
+		}
+	}
+}
+
+// sendRoom handles "#room message".
+func sendRoom(c Console, pool *connPool, name, msg string) {
+	n, err := pool.SendRoom(name, msg)
+	if err != nil && n == 0 {
+		c.Errorf("%v", err)
+		return
+	}
+	c.Printf("[%s %s] %s", name, pool.nickname, msg)
+	if err != nil {
+		c.Errorf("%s: not delivered to %v", name, err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/pivaldi/tmd/internal/gateway"
+	"github.com/pivaldi/tmd/internal/jsonrpc"
+)
+
+// Error codes returned by `tmd rpc` methods, in the JSON-RPC
+// implementation-defined range.
+const (
+	rpcCodeUnknownPeer = -32001
+	rpcCodeSendFailed  = -32002
+)
+
+type rpcSendParams struct {
+	To      string `json:"to,omitempty"` // empty broadcasts
+	Message string `json:"message"`
+}
+
+type rpcSendResult struct {
+	Reply string `json:"reply,omitempty"`
+}
+
+type rpcPeer struct {
+	Nickname string `json:"nick"`
+	PeerID   string `json:"peer_id"`
+	KeyID    string `json:"key_id"`
+}
+
+type rpcSubscribeParams struct {
+	Events []string `json:"events,omitempty"` // default: all
+}
+
+// rpcMessage is the params of the "message" notification.
+type rpcMessage struct {
+	Kind string `json:"kind"`
+	From string `json:"from"`
+	Text string `json:"message"`
+}
+
+// rpcPresence is the params of the "presence" notification.
+type rpcPresence struct {
+	Nickname string `json:"nick"`
+	Online   bool   `json:"online"`
+}
+
+// runRPC serves JSON-RPC 2.0 on r/w until r reaches EOF. Methods:
+//
+//	send {to?, message} -> {reply}   (no "to" broadcasts)
+//	listPeers           -> [{nick, peer_id, key_id}]
+//	subscribe {events?} -> {events}  (enables "message"/"presence" notifications)
+func runRPC(r io.Reader, w io.Writer, pool *connPool, c Console) error {
+	srv := jsonrpc.NewServer(w)
+	sender := poolSender{pool: pool, console: c, via: "rpc"}
+
+	var (
+		subMu      sync.RWMutex
+		subscribed = map[string]bool{}
+	)
+	wants := func(event string) bool {
+		subMu.RLock()
+		defer subMu.RUnlock()
+		return subscribed[event]
+	}
+
+	srv.Register("send", func(raw json.RawMessage) (any, error) {
+		var p rpcSendParams
+		if err := json.Unmarshal(raw, &p); err != nil || p.Message == "" {
+			return nil, jsonrpc.InvalidParams("expected {to?, message}")
+		}
+		if p.To == "" {
+			if err := sender.Broadcast(p.Message); err != nil {
+				return nil, &jsonrpc.Error{Code: rpcCodeSendFailed, Message: err.Error()}
+			}
+			return rpcSendResult{}, nil
+		}
+		reply, err := sender.Send(p.To, p.Message)
+		switch {
+		case errors.Is(err, gateway.ErrUnknownPeer):
+			return nil, &jsonrpc.Error{Code: rpcCodeUnknownPeer, Message: err.Error()}
+		case err != nil:
+			return nil, &jsonrpc.Error{Code: rpcCodeSendFailed, Message: err.Error()}
+		}
+		return rpcSendResult{Reply: reply}, nil
+	})
+
+	srv.Register("listPeers", func(json.RawMessage) (any, error) {
+		peers := []rpcPeer{}
+		for _, p := range pool.peerTable.All() {
+			if p.Nickname == pool.nickname {
+				continue
+			}
+			peers = append(peers, rpcPeer{Nickname: string(p.Nickname), PeerID: p.PeerID.String(), KeyID: hex.EncodeToString(p.KeyID)})
+		}
+		return peers, nil
+	})
+
+	srv.Register("subscribe", func(raw json.RawMessage) (any, error) {
+		var p rpcSubscribeParams
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &p); err != nil {
+				return nil, jsonrpc.InvalidParams("expected {events?}")
+			}
+		}
+		if len(p.Events) == 0 {
+			p.Events = []string{"message", "presence"}
+		}
+		subMu.Lock()
+		defer subMu.Unlock()
+		for _, ev := range p.Events {
+			if ev != "message" && ev != "presence" {
+				return nil, jsonrpc.InvalidParams("unknown event %q", ev)
+			}
+			subscribed[ev] = true
+		}
+		return rpcSubscribeParams{Events: p.Events}, nil
+	})
+
+	pool.onReceive(func(m receivedMessage) {
+		if wants("message") {
+			_ = srv.Notify("message", rpcMessage{Kind: m.Kind, From: string(m.From), Text: m.Text})
+		}
+	})
+	pool.onPresence(func(ev presenceEvent) {
+		if wants("presence") {
+			_ = srv.Notify("presence", rpcPresence{Nickname: string(ev.Nickname), Online: ev.Online})
+		}
+	})
+
+	return srv.Serve(r)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rpcClient drives runRPC over pipes.
+type rpcClient struct {
+	t     *testing.T
+	in    *io.PipeWriter
+	lines chan string
+}
+
+func startRPC(t *testing.T, pool *connPool) *rpcClient {
+	t.Helper()
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	c := &rpcClient{t: t, in: inW, lines: make(chan string, 16)}
+
+	go func() {
+		_ = runRPC(inR, outW, pool, newHeadlessConsole())
+		outW.Close()
+	}()
+	go func() {
+		sc := bufio.NewScanner(outR)
+		for sc.Scan() {
+			c.lines <- sc.Text()
+		}
+		close(c.lines)
+	}()
+	t.Cleanup(func() { inW.Close() })
+	return c
+}
+
+func (c *rpcClient) call(line string) map[string]any {
+	c.t.Helper()
+	if _, err := io.WriteString(c.in, line+"\n"); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.next()
+}
+
+func (c *rpcClient) next() map[string]any {
+	c.t.Helper()
+	select {
+	case line, ok := <-c.lines:
+		if !ok {
+			c.t.Fatal("rpc output closed")
+		}
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			c.t.Fatalf("bad output %q: %v", line, err)
+		}
+		return m
+	case <-time.After(2 * time.Second):
+		c.t.Fatal("timed out waiting for rpc output")
+		return nil
+	}
+}
+
+func TestRPC(t *testing.T) {
+	pool := newTestPool("alice")
+	c := startRPC(t, pool)
+
+	resp := c.call(`{"jsonrpc":"2.0","id":1,"method":"listPeers"}`)
+	if peers, ok := resp["result"].([]any); !ok || len(peers) != 0 {
+		t.Fatalf("listPeers = %v", resp)
+	}
+
+	resp = c.call(`{"jsonrpc":"2.0","id":2,"method":"send","params":{"to":"carol","message":"hi"}}`)
+	if e, _ := resp["error"].(map[string]any); e == nil || e["code"] != float64(rpcCodeUnknownPeer) {
+		t.Fatalf("send to unknown peer = %v", resp)
+	}
+
+	resp = c.call(`{"jsonrpc":"2.0","id":3,"method":"send","params":{"to":"carol"}}`)
+	if e, _ := resp["error"].(map[string]any); e == nil || e["code"] != float64(-32602) {
+		t.Fatalf("send without message = %v", resp)
+	}
+
+	// Nothing is pushed before subscribe.
+	pool.notifyReceived(receivedMessage{Kind: "direct", From: "bob", Text: "early"})
+
+	resp = c.call(`{"jsonrpc":"2.0","id":4,"method":"subscribe"}`)
+	if resp["id"] != float64(4) || resp["error"] != nil {
+		t.Fatalf("subscribe = %v", resp)
+	}
+
+	pool.notifyReceived(receivedMessage{Kind: "direct", From: "bob", Text: "hello"})
+	n := c.next()
+	if n["method"] != "message" || !strings.Contains(toJSON(n["params"]), `"message":"hello"`) {
+		t.Fatalf("message notification = %v", n)
+	}
+
+	pool.notifyPresence(presenceEvent{Nickname: "bob", Online: false})
+	n = c.next()
+	if n["method"] != "presence" || toJSON(n["params"]) != `{"nick":"bob","online":false}` {
+		t.Fatalf("presence notification = %v", n)
+	}
+}
+
+func toJSON(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
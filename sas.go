@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+// A short authentication string (SAS) lets two users check, over a phone
+// call or in person, that each has the other's real keys: both compute it
+// from the Ed25519 and HPKE keys of the two of them, so a man in the
+// middle substituting either key changes it. It is shown as words and as
+// a numeric code; reading either one is enough.
+const (
+	sasContext = "tmd sas v1"
+	sasWords   = 6  // 66 bits
+	sasDigits  = 12 // about 40 bits, in groups of 4
+)
+
+// sasParty is the keys of one side of a SAS.
+type sasParty struct {
+	edPub   ed25519.PublicKey
+	hpkePub []byte
+}
+
+func (s sasParty) encode() []byte {
+	var b []byte
+	for _, k := range [][]byte{s.edPub, s.hpkePub} {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(k)))
+		b = append(b, k...)
+	}
+	return b
+}
+
+// shortAuthString returns the SAS of two parties, as words and digits.
+// The parties are ordered by their keys, so both sides get the same.
+func shortAuthString(a, b sasParty) (words, code string) {
+	ea, eb := a.encode(), b.encode()
+	if bytes.Compare(ea, eb) > 0 {
+		ea, eb = eb, ea
+	}
+	h := sha256.New()
+	h.Write([]byte(sasContext))
+	h.Write(ea)
+	h.Write(eb)
+	sum := h.Sum(nil)
+
+	n := binary.BigEndian.Uint64(sum[24:]) % 1_000_000_000_000
+	digits := fmt.Sprintf("%0*d", sasDigits, n)
+	groups := make([]string, 0, sasDigits/4)
+	for i := 0; i < sasDigits; i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(identity.Words(sum, sasWords), " "), strings.Join(groups, " ")
+}
+
+// fingerprint returns the SAS between us and a peer online now.
+func (p *connPool) fingerprint(peer PeerID) (words, code string, err error) {
+	info, ok := p.peerTable.Get(peer)
+	if !ok {
+		return "", "", fmt.Errorf("%s is offline: its keys are not known", peer)
+	}
+	key, err := identityKey(info)
+	if err != nil {
+		return "", "", err
+	}
+	self := sasParty{edPub: p.selfEdPub(), hpkePub: p.selfHPKEPubBytes}
+	words, code = shortAuthString(self, sasParty{edPub: key, hpkePub: info.HPKEPub})
+	return words, code, nil
+}
+
+// runFingerprint handles "/fingerprint peer".
+func runFingerprint(c Console, pool *connPool, args string) {
+	peer := PeerID(strings.TrimPrefix(strings.TrimSpace(args), "@"))
+	if peer == "" {
+		c.Errorf("usage: /fingerprint <peer>")
+		return
+	}
+	words, code, err := pool.fingerprint(peer)
+	if err != nil {
+		c.Errorf("fingerprint: %v", err)
+		return
+	}
+	c.Printf("[fingerprint] %s and %s: compare with %s out of band (e.g. over a phone call)", pool.nickname, peer, peer)
+	c.Printf("[fingerprint]   words: %s", words)
+	c.Printf("[fingerprint]   code:  %s", code)
+	c.Printf("[fingerprint] if %s reads anything else, one of you has the wrong keys", peer)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+func sasPartyFor(t *testing.T, fill byte) sasParty {
+	t.Helper()
+	keys, err := identity.DeriveKeys(bytes.Repeat([]byte{fill}, identity.SeedSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sasParty{edPub: keys.Ed25519Pub, hpkePub: keys.HPKEPubBytes}
+}
+
+func TestShortAuthString(t *testing.T) {
+	alice, bob, mallory := sasPartyFor(t, 1), sasPartyFor(t, 2), sasPartyFor(t, 3)
+
+	words, code := shortAuthString(alice, bob)
+	if w, c := shortAuthString(bob, alice); w != words || c != code {
+		t.Fatalf("sides differ: %q %q / %q %q", words, code, w, c)
+	}
+	if n := len(strings.Fields(words)); n != sasWords {
+		t.Fatalf("%d words: %q", n, words)
+	}
+	if len(strings.ReplaceAll(code, " ", "")) != sasDigits {
+		t.Fatalf("code %q", code)
+	}
+
+	// A substituted key, either one, changes both forms.
+	for _, other := range []sasParty{
+		mallory,
+		{edPub: bob.edPub, hpkePub: mallory.hpkePub},
+		{edPub: mallory.edPub, hpkePub: bob.hpkePub},
+	} {
+		if w, c := shortAuthString(alice, other); w == words || c == code {
+			t.Fatalf("substituted key kept %q / %q", w, c)
+		}
+	}
+}
@@ -0,0 +1,1450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/audit"
+	"github.com/pivaldi/tmd/internal/hwkey"
+	"github.com/pivaldi/tmd/internal/identity"
+	"github.com/pivaldi/tmd/internal/node"
+	"github.com/pivaldi/tmd/internal/pins"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// defaultExpectTimeout bounds how long an Expect step waits for output.
+const defaultExpectTimeout = 10 * time.Second
+
+// scenario is a small builder DSL for end-to-end tests. It declares the
+// node topology and peers, then a sequence of steps (typed input, waits,
+// shutdowns) with expected outcomes, and runs them on a simNetwork:
+//
+//	newScenario("direct message").
+//		Node("n1").
+//		Peer("alice", "n1").
+//		Peer("bob", "n1").
+//		Expect("alice", "peer joined: bob").
+//		Send("alice", "bob", "hi").
+//		ExpectQueued("bob", "alice", "hi").
+//		Run(t)
+//
+// Steps run in order; each Expect waits until the peer's history contains
+// the given text, so scenarios need no explicit sleeps.
+type scenario struct {
+	name   string
+	nodes  []string
+	peers  []scenarioPeer
+	setups map[string][]peerSetup
+	steps  []scenarioStep
+}
+
+type scenarioPeer struct {
+	nickname string
+	nodes    []string
+}
+
+type scenarioStep struct {
+	desc string
+	run  func(n *simNetwork) error
+}
+
+func newScenario(name string) *scenario {
+	return &scenario{name: name}
+}
+
+// Node declares a discovery node.
+func (s *scenario) Node(name string) *scenario {
+	s.nodes = append(s.nodes, name)
+	return s
+}
+
+// Peer declares a peer registered on the given nodes. Peers start in
+// declaration order before any step runs.
+func (s *scenario) Peer(nickname string, nodes ...string) *scenario {
+	s.peers = append(s.peers, scenarioPeer{nickname: nickname, nodes: nodes})
+	return s
+}
+
+// Setup configures a declared peer before it starts, and again whenever
+// it restarts, as its flags would. Settings a running peer reads without
+// a lock belong here rather than in a step.
+func (s *scenario) Setup(nickname string, setup peerSetup) *scenario {
+	if s.setups == nil {
+		s.setups = make(map[string][]peerSetup)
+	}
+	s.setups[nickname] = append(s.setups[nickname], setup)
+	return s
+}
+
+func (s *scenario) step(desc string, run func(n *simNetwork) error) *scenario {
+	s.steps = append(s.steps, scenarioStep{desc: desc, run: run})
+	return s
+}
+
+// Type feeds a raw input line into a peer's console.
+func (s *scenario) Type(nickname, line string) *scenario {
+	return s.step(fmt.Sprintf("%s types %q", nickname, line), func(n *simNetwork) error {
+		n.peer(nickname).console.Feed(line)
+		return nil
+	})
+}
+
+// Compose reports a partly typed line on a peer's console, as keystrokes
+// in the TUI do.
+func (s *scenario) Compose(nickname, partial string) *scenario {
+	return s.step(fmt.Sprintf("%s composes %q", nickname, partial), func(n *simNetwork) error {
+		n.peer(nickname).console.Compose(partial)
+		return nil
+	})
+}
+
+// Send types a direct message and waits for the local send confirmation.
+func (s *scenario) Send(from, to, msg string) *scenario {
+	return s.Type(from, "@"+to+" "+msg).
+		Expect(from, fmt.Sprintf("[%s to %s] %s", from, to, msg))
+}
+
+// Broadcast types a plain line, which is sent to every known peer.
+func (s *scenario) Broadcast(from, msg string) *scenario {
+	return s.Type(from, msg)
+}
+
+// Expect waits until a peer's history contains text.
+func (s *scenario) Expect(nickname, text string) *scenario {
+	return s.step(fmt.Sprintf("%s sees %q", nickname, text), func(n *simNetwork) error {
+		c := n.peer(nickname).console
+		if !c.WaitFor(text, defaultExpectTimeout) {
+			return fmt.Errorf("timed out; history:\n  %s", strings.Join(c.History(), "\n  "))
+		}
+		return nil
+	})
+}
+
+// ExpectNot checks that a peer's history does not contain text.
+func (s *scenario) ExpectNot(nickname, text string) *scenario {
+	return s.step(fmt.Sprintf("%s does not see %q", nickname, text), func(n *simNetwork) error {
+		for _, line := range n.peer(nickname).console.History() {
+			if strings.Contains(line, text) {
+				return fmt.Errorf("unexpected line %q", line)
+			}
+		}
+		return nil
+	})
+}
+
+// ExpectStatus waits until a peer's status area shows text.
+func (s *scenario) ExpectStatus(nickname, text string) *scenario {
+	return s.step(fmt.Sprintf("%s shows status %q", nickname, text), func(n *simNetwork) error {
+		c := n.peer(nickname).console
+		deadline := time.Now().Add(defaultExpectTimeout)
+		for !slices.Contains(c.Status(), text) {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out; status: %q", c.Status())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	})
+}
+
+// ExpectNoStatus waits for a peer's status area to be empty.
+func (s *scenario) ExpectNoStatus(nickname string) *scenario {
+	return s.step(fmt.Sprintf("%s shows no status", nickname), func(n *simNetwork) error {
+		c := n.peer(nickname).console
+		deadline := time.Now().Add(defaultExpectTimeout)
+		for len(c.Status()) > 0 {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out; status: %q", c.Status())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	})
+}
+
+// ExpectQueued checks that msg from sender sits in the peer's direct queue.
+func (s *scenario) ExpectQueued(nickname, from, msg string) *scenario {
+	return s.Expect(nickname, fmt.Sprintf("[from %s] %s", from, msg)).
+		step(fmt.Sprintf("%s has %q from %s queued", nickname, msg, from), func(n *simNetwork) error {
+			for _, q := range n.peer(nickname).console.Queue(PeerID(from)) {
+				if q == msg {
+					return nil
+				}
+			}
+			return fmt.Errorf("queue from %s: %q", from, n.peer(nickname).console.Queue(PeerID(from)))
+		})
+}
+
+// Stop shuts a peer down (goodbye to sessions, node disconnect).
+func (s *scenario) Stop(nickname string) *scenario {
+	return s.step(fmt.Sprintf("%s stops", nickname), func(n *simNetwork) error {
+		n.stopPeer(nickname)
+		return nil
+	})
+}
+
+// Start brings a stopped peer back on the nodes it was declared with.
+func (s *scenario) Start(nickname string) *scenario {
+	i := slices.IndexFunc(s.peers, func(p scenarioPeer) bool { return p.nickname == nickname })
+	return s.step(fmt.Sprintf("%s starts", nickname), func(n *simNetwork) error {
+		if i < 0 {
+			return fmt.Errorf("undeclared peer %q", nickname)
+		}
+		n.startPeer(nickname, s.peers[i].nodes)
+		return nil
+	})
+}
+
+// Run builds the network and executes every step, failing the test on the
+// first unmet expectation.
+func (s *scenario) Run(t *testing.T) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("scenario tests need loopback networking")
+	}
+
+	n := newSimNetwork(t)
+	for _, p := range s.peers {
+		nick, _ := node.SplitDevice(p.nickname)
+		n.tokens[nick] = "token-" + nick
+	}
+	for _, name := range s.nodes {
+		n.startNode(name)
+	}
+	maps.Copy(n.setups, s.setups)
+	for _, p := range s.peers {
+		n.startPeer(p.nickname, p.nodes)
+	}
+
+	for i, st := range s.steps {
+		if err := st.run(n); err != nil {
+			t.Fatalf("%s: step %d (%s): %v", s.name, i+1, st.desc, err)
+		}
+	}
+}
+
+func TestScenarioDirectMessage(t *testing.T) {
+	newScenario("direct message").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Send("alice", "bob", "hello bob").
+		ExpectQueued("bob", "alice", "hello bob").
+		Send("bob", "alice", "hi alice").
+		ExpectQueued("alice", "bob", "hi alice").
+		Run(t)
+}
+
+func TestScenarioBroadcast(t *testing.T) {
+	newScenario("broadcast").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Peer("carol", "n1").
+		Expect("alice", "peer joined: carol").
+		Broadcast("alice", "hello all").
+		Expect("bob", "[broadcast from alice] hello all").
+		Expect("carol", "[broadcast from alice] hello all").
+		Expect("alice", "[broadcast] alice sent to").
+		ExpectNot("bob", "[from alice] hello all").
+		Run(t)
+}
+
+func TestScenarioMentions(t *testing.T) {
+	newScenario("mentions").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Peer("carol", "n1").
+		Expect("alice", "peer joined: carol").
+		Broadcast("alice", "standup in 5, @bob: you're first").
+		Expect("bob", "[mention] [broadcast from alice] standup in 5, @bob: you're first").
+		Expect("carol", "[broadcast from alice] standup in 5").
+		ExpectNot("carol", "[mention]").
+		Type("bob", "/mentions").
+		Expect("bob", "alice: standup in 5, @bob: you're first").
+		Type("carol", "/mentions").
+		Expect("carol", "[mentions] none").
+		Run(t)
+}
+
+func TestScenarioPresenceStatus(t *testing.T) {
+	newScenario("presence status").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Type("bob", "/status away").
+		Expect("bob", "[presence] you are away").
+		Expect("alice", "[node] bob is now away").
+		step("alice's console shows bob away", func(n *simNetwork) error {
+			if got := n.peer("alice").console.PeerPresence("bob"); got != "away" {
+				return fmt.Errorf("presence = %q", got)
+			}
+			return nil
+		}).
+		Type("alice", "/peers").
+		Expect("alice", "- bob [away] (peerID=").
+		Type("bob", "/status asleep").
+		Expect("bob", `[error] status: bad presence "asleep"`).
+		Type("bob", "/status available").
+		Expect("alice", "[node] bob is now available").
+		Run(t)
+}
+
+func TestScenarioWhois(t *testing.T) {
+	newScenario("whois").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Type("alice", "/whois bob").
+		Expect("alice", "[whois] bob: Bob").
+		Expect("alice", "[whois]   note: simulated peer").
+		Type("alice", "/whois alice").
+		Expect("alice", "[whois] alice: Alice").
+		Type("alice", "/whois carol").
+		Expect("alice", "[whois] carol has no profile").
+		Run(t)
+}
+
+func TestScenarioMyQR(t *testing.T) {
+	newScenario("myqr").
+		Node("n1").
+		Peer("alice", "n1").
+		Type("alice", "/myqr").
+		Expect("alice", "[myqr] Nickname:   alice").
+		Expect("alice", "[myqr] Ed25519:    ").
+		Expect("alice", "[myqr] HPKE KeyID: ").
+		Expect("alice", "[myqr] TMD1:").
+		Run(t)
+}
+
+func TestScenarioBlock(t *testing.T) {
+	newScenario("block").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Type("alice", "/block bob").
+		Expect("alice", "[block] blocked bob").
+		Type("alice", "/blocked").
+		Expect("alice", "[block] bob (key ").
+		Type("alice", "@bob hi").
+		Expect("alice", "bob: peer is blocked").
+		// alice drops bob's session before its RATCHET: the request waits
+		// for it and is never sent.
+		Type("bob", "@alice let me in").
+		Expect("bob", "send failed").
+		ExpectNot("alice", "[from bob]").
+		Type("alice", "/unblock bob").
+		Expect("alice", "[block] unblocked bob").
+		Send("bob", "alice", "thanks").
+		Expect("alice", "[from bob] thanks").
+		ExpectNot("alice", "let me in").
+		Run(t)
+}
+
+func TestScenarioSpoofedNickname(t *testing.T) {
+	newScenario("spoofed nickname").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Peer("carol").
+		Setup("carol", func(_ *simNetwork, p *connPool) error {
+			p.nickname = "alice"
+			return p.signOwnKey()
+		}).
+		Expect("bob", "peer joined: alice").
+		step("carol finds bob", func(n *simNetwork) error {
+			bob := n.peer("bob")
+			n.peer("carol").pool.peerTable.Add(PeerInfo{Nickname: "bob", PeerID: bob.host.ID(), Addrs: bob.host.Addrs(), HPKEPub: bob.pool.selfHPKEPubBytes, KeyID: bob.pool.keyID})
+			return nil
+		}).
+		Type("carol", "@bob it's alice, really").
+		Expect("bob", "identity verify failed: alice connected from").
+		Expect("carol", "send failed").
+		Send("alice", "bob", "this is alice").
+		Expect("bob", "[from alice] this is alice").
+		ExpectNot("bob", "really").
+		Run(t)
+}
+
+func TestScenarioSchedule(t *testing.T) {
+	soon := func(n *simNetwork, to, msg string) error {
+		at := time.Now().Add(300 * time.Millisecond).Format(time.RFC3339Nano)
+		n.peer("alice").console.Feed(fmt.Sprintf("/schedule @%s %s %s", to, at, msg))
+		return nil
+	}
+	newScenario("scheduled messages").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Peer("carol", "n1").
+		Expect("alice", "peer joined: carol").
+		Type("alice", "/schedule @bob 2000-01-01T10:00 too late").
+		Expect("alice", "is in the past").
+		step("alice schedules a message to bob", func(n *simNetwork) error { return soon(n, "bob", "good morning") }).
+		Expect("alice", "[schedule] message 1 to bob").
+		Type("alice", "/scheduled").
+		Expect("alice", "1  to bob at").
+		Stop("carol").
+		Expect("alice", "peer left: carol").
+		step("alice schedules a message to carol", func(n *simNetwork) error { return soon(n, "carol", "are you up?") }).
+		ExpectQueued("bob", "alice", "good morning").
+		Expect("alice", "[outbox] carol is offline; message queued until it joins: are you up?").
+		Type("alice", "/scheduled").
+		Expect("alice", "[schedule] nothing scheduled").
+		Run(t)
+}
+
+func TestScenarioAutoReply(t *testing.T) {
+	newScenario("autoreply").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		step("alice sets an away rule", func(n *simNetwork) error {
+			r := autoRule{Presence: "away", Reply: "Back on Monday."}
+			if err := r.compile(); err != nil {
+				return err
+			}
+			n.peer("alice").pool.setAutoReplies([]autoRule{r})
+			return nil
+		}).
+		Send("bob", "alice", "are you there?").
+		ExpectQueued("alice", "bob", "are you there?").
+		ExpectNot("alice", "[autoreply to bob]").
+		Type("alice", "/status away").
+		Expect("alice", "[presence] you are away").
+		Send("bob", "alice", "hello?").
+		Expect("bob", "[reply from alice] Back on Monday.").
+		Expect("alice", "[autoreply to bob] Back on Monday.").
+		Type("alice", "/autoreply").
+		Expect("alice", "[autoreply] 1  from=* match=* presence=away: Back on Monday.").
+		Run(t)
+}
+
+func TestScenarioHandler(t *testing.T) {
+	newScenario("request handler").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		step("bob runs an echo bot", func(n *simNetwork) error {
+			alice := n.peer("alice").host.ID()
+			n.peer("bob").pool.setHandler(HandlerFunc(func(ctx context.Context, from PeerInfo, mediaType string, plain []byte) (string, []byte, error) {
+				if _, ok := ctx.Deadline(); !ok {
+					return "", nil, errors.New("no deadline")
+				}
+				if from.PeerID != alice {
+					return "", nil, fmt.Errorf("from %s, not alice's peer ID", from.PeerID)
+				}
+				if strings.HasPrefix(string(plain), "fail") {
+					return "", nil, errors.New("no idea")
+				}
+				return "", []byte(fmt.Sprintf("%s said %q", from.Nickname, plain)), nil
+			}))
+			return nil
+		}).
+		Send("alice", "bob", "ping").
+		Expect("bob", "[from alice] ping").
+		Expect("alice", `[reply from bob] alice said "ping"`).
+		Send("alice", "bob", "fail please").
+		Expect("alice", "send failed: bob could not handle it: no idea").
+		step("bob stops the bot", func(n *simNetwork) error {
+			n.peer("bob").pool.setHandler(nil)
+			return nil
+		}).
+		Send("alice", "bob", "back to normal?").
+		ExpectQueued("bob", "alice", "back to normal?").
+		ExpectNot("alice", `alice said "back`).
+		Run(t)
+}
+
+func TestScenarioMethodCalls(t *testing.T) {
+	newScenario("method calls").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		step("bob serves upper", func(n *simNetwork) error {
+			n.peer("bob").pool.onMethod("upper", HandlerFunc(func(_ context.Context, from PeerInfo, _ string, params []byte) (string, []byte, error) {
+				return "", []byte(string(from.Nickname) + ": " + strings.ToUpper(string(params))), nil
+			}))
+			return nil
+		}).
+		Type("alice", "/call bob upper shout this").
+		Expect("alice", "[call bob upper] alice: SHOUT THIS").
+		Type("alice", "/call bob getTime").
+		Expect("alice", "[call bob getTime] 20").
+		Type("alice", "/call bob lower x").
+		Expect("alice", `call bob lower: bob could not handle it: no method "lower"`).
+		ExpectNot("bob", "[from alice]").
+		Run(t)
+}
+
+func TestScenarioSearch(t *testing.T) {
+	newScenario("search history").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Send("bob", "alice", "the build is green").
+		Send("bob", "alice", "lunch?").
+		Expect("alice", "[from bob] lunch?").
+		Type("alice", "/search BUILD").
+		Expect("alice", "[search] match 1 of 1").
+		step("alice sees bob's line", func(n *simNetwork) error {
+			line, ok := n.peer("alice").console.Searched()
+			if !ok || !strings.Contains(line, "the build is green") {
+				return fmt.Errorf("search shows %q", line)
+			}
+			return nil
+		}).
+		Type("alice", "/search search").
+		Expect("alice", "[search] no match").
+		Run(t)
+}
+
+func TestScenarioExport(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath, mdPath := filepath.Join(dir, "bob.json"), filepath.Join(dir, "bob.md")
+	newScenario("export a conversation").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Send("alice", "bob", "lunch?").
+		Expect("alice", "[alice to bob] lunch? (delivered)").
+		Send("bob", "alice", "sure").
+		Expect("alice", "[from bob] sure").
+		Type("alice", "/export @bob "+jsonPath).
+		Expect("alice", "[export] 2 messages with bob written to").
+		Type("alice", "/export @bob "+mdPath).
+		Expect("alice", "[export] 2 messages with bob written to").
+		Type("alice", "/export @bob "+filepath.Join(dir, "bob.txt")).
+		Expect("alice", "want a .md or .json file").
+		step("the exports hold both messages", func(n *simNetwork) error {
+			data, err := os.ReadFile(jsonPath)
+			if err != nil {
+				return err
+			}
+			var e exportedConversation
+			if err := json.Unmarshal(data, &e); err != nil {
+				return err
+			}
+			if e.Identity != "not verified" || len(e.Messages) != 2 {
+				return fmt.Errorf("export = %+v", e)
+			}
+			out, in := e.Messages[0], e.Messages[1]
+			if out.Direction != "out" || out.Text != "lunch?" || out.State == "sent" || out.Time.IsZero() {
+				return fmt.Errorf("sent message = %+v", out)
+			}
+			if in.Direction != "in" || in.Kind != "from bob" || in.Text != "sure" {
+				return fmt.Errorf("received message = %+v", in)
+			}
+			md, err := os.ReadFile(mdPath)
+			if err != nil {
+				return err
+			}
+			if !strings.Contains(string(md), "→ **alice to bob** lunch?") || !strings.Contains(string(md), "← **from bob** sure") {
+				return fmt.Errorf("markdown:\n%s", md)
+			}
+			return nil
+		}).
+		Run(t)
+}
+
+func TestScenarioDeviceSync(t *testing.T) {
+	seed := bytes.Repeat([]byte{1}, identity.SeedSize)
+	other := bytes.Repeat([]byte{2}, identity.SeedSize)
+	devices := func(nick string, seed []byte, devices ...PeerID) func(n *simNetwork) error {
+		return func(n *simNetwork) error { return n.peer(nick).pool.setDevices(seed, devices) }
+	}
+	newScenario("device sync").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("phone", "n1").
+		Peer("bob", "n1").
+		Peer("mallory", "n1").
+		step("alice and phone are devices of one identity", devices("alice", seed, "phone")).
+		step("phone knows alice", devices("phone", seed, "alice")).
+		step("mallory claims alice", devices("mallory", other, "alice")).
+		Expect("alice", "peer joined: bob").
+		Expect("phone", "peer joined: alice").
+		Send("bob", "alice", "lunch?").
+		Expect("alice", "[from bob] lunch?").
+		Send("alice", "bob", "sure").
+		Expect("bob", "[from alice] sure").
+		step("alice queues a message for carol", func(n *simNetwork) error {
+			return n.peer("alice").pool.queueOutgoing("carol", "see you")
+		}).
+		Type("phone", "/sync").
+		Expect("phone", "[sync] 2 lines from alice").
+		Expect("phone", "[from bob] lunch?").
+		Expect("phone", "[alice to bob] sure").
+		Type("phone", "/outbox").
+		Expect("phone", "to carol, queued").
+		Expect("phone", "on alice: see you").
+		Type("phone", "/sync").
+		Expect("phone", "[sync] 0 lines from alice").
+		Type("alice", "/sync").
+		Expect("alice", "[sync] 0 lines from phone").
+		Type("mallory", "/sync").
+		Expect("mallory", "mallory is not one of our devices").
+		Run(t)
+}
+
+// pinKeys gives a peer a pin store, as --pins does.
+func pinKeys(n *simNetwork, p *connPool) error {
+	store, err := pins.OpenStore(filepath.Join(n.t.TempDir(), "pins.json"))
+	if err != nil {
+		return err
+	}
+	p.setPinStore(store)
+	return nil
+}
+
+func TestScenarioFingerprint(t *testing.T) {
+	sas := func(n *simNetwork, nickname string) []string {
+		var lines []string
+		for _, line := range n.peer(nickname).console.History() {
+			if strings.HasPrefix(line, "[fingerprint]   ") {
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	}
+	newScenario("fingerprint").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Peer("carol", "n1").
+		Expect("alice", "peer joined: bob").
+		Expect("alice", "peer joined: carol").
+		Expect("bob", "peer joined: alice").
+		Type("alice", "/fingerprint bob").
+		Expect("alice", "[fingerprint]   code:").
+		Type("bob", "/fingerprint @alice").
+		Expect("bob", "[fingerprint]   code:").
+		step("alice and bob read the same", func(n *simNetwork) error {
+			a, b := sas(n, "alice"), sas(n, "bob")
+			if len(a) != 2 || !slices.Equal(a, b) {
+				return fmt.Errorf("alice %q, bob %q", a, b)
+			}
+			return nil
+		}).
+		Type("alice", "/fingerprint carol").
+		Expect("alice", "[fingerprint] alice and carol").
+		step("another peer reads something else", func(n *simNetwork) error {
+			if a := sas(n, "alice"); len(a) != 4 || a[0] == a[2] || a[1] == a[3] {
+				return fmt.Errorf("alice %q", a)
+			}
+			return nil
+		}).
+		Type("alice", "/fingerprint dave").
+		Expect("alice", "fingerprint: dave is offline").
+		Run(t)
+}
+
+func TestScenarioKeyPinning(t *testing.T) {
+	newScenario("keys pinned on first contact").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Setup("alice", pinKeys).
+		Expect("bob", "peer joined: alice").
+		Send("bob", "alice", "hi").
+		Expect("alice", "[from bob] hi").
+		Stop("bob").
+		step("bob gets new keys", func(n *simNetwork) error {
+			delete(n.idents, "bob")
+			return nil
+		}).
+		Start("bob").
+		Expect("alice", "WARNING: bob presented keys (via the node)").
+		// bob is not added with the changed keys, so nothing is sent to
+		// it: what alice types waits for /repin.
+		Type("alice", "@bob still you?").
+		Expect("alice", "[outbox] bob is offline; message queued until it joins: still you?").
+		Expect("bob", "peer joined: alice").
+		Type("bob", "@alice it's me").
+		Expect("alice", "WARNING: bob presented keys (via its Hello)").
+		ExpectNot("bob", "still you?").
+		ExpectNot("alice", "[from bob] it's me").
+		Type("alice", "/peers").
+		Expect("alice", "[KEYS CHANGED] (not added; see /repin)").
+		Type("alice", "/repin bob").
+		Expect("alice", "[pins] bob pinned to keyID=").
+		Expect("bob", "[from alice] still you?").
+		Send("alice", "bob", "welcome back").
+		Expect("bob", "[from alice] welcome back").
+		Run(t)
+}
+
+func TestScenarioAudit(t *testing.T) {
+	newScenario("security events audited").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Setup("alice", func(n *simNetwork, p *connPool) error {
+			dir := n.t.TempDir()
+			store, err := pins.OpenStore(filepath.Join(dir, "pins.json"))
+			if err != nil {
+				return err
+			}
+			log, err := audit.Open(filepath.Join(dir, "audit.log"), bytes.Repeat([]byte{7}, identity.SeedSize))
+			if err != nil {
+				return err
+			}
+			n.t.Cleanup(func() { log.Close() })
+			p.setPinStore(store)
+			p.setAuditLog(log)
+			return nil
+		}).
+		Type("bob", "/audit").
+		Expect("bob", "[audit] no audit log (see --audit)").
+		Type("alice", "/audit").
+		Expect("alice", "[audit] no events").
+		Expect("bob", "peer joined: alice").
+		Send("bob", "alice", "hi").
+		Expect("alice", "[from bob] hi").
+		Stop("bob").
+		step("bob gets new keys", func(n *simNetwork) error {
+			delete(n.idents, "bob")
+			return nil
+		}).
+		Start("bob").
+		Expect("alice", "WARNING: bob presented keys (via the node)").
+		Type("alice", "/audit").
+		Expect("alice", "[audit] 1 ").
+		Expect("alice", "key-mismatch bob: keys via the node differ from those pinned on").
+		Expect("alice", "[audit] chain intact through event 1").
+		Run(t)
+}
+
+func TestScenarioDevices(t *testing.T) {
+	newScenario("one nickname on several devices").
+		Node("n1").
+		Peer("alice/laptop", "n1").
+		Peer("alice/phone", "n1").
+		Peer("bob", "n1").
+		Expect("bob", "peer joined: alice/phone").
+		Type("bob", "@alice hi both").
+		Expect("bob", "[bob to alice/laptop] hi both").
+		Expect("bob", "[bob to alice/phone] hi both").
+		Expect("alice/laptop", "[from bob] hi both").
+		Expect("alice/phone", "[from bob] hi both").
+		// Our other devices are peers too.
+		Type("alice/laptop", "@alice note to self").
+		Expect("alice/phone", "[from alice/laptop] note to self").
+		// A device name reaches that device only.
+		Type("bob", "@alice/phone phone only").
+		Expect("alice/phone", "[from bob] phone only").
+		ExpectNot("alice/laptop", "phone only").
+		// Devices that left get the message when they are back.
+		Stop("alice/phone").
+		Stop("alice/laptop").
+		Expect("bob", "peer left: alice/phone").
+		Expect("bob", "peer left: alice/laptop").
+		Type("bob", "@alice later").
+		Expect("bob", "[outbox] alice/laptop is offline").
+		Expect("bob", "[outbox] alice/phone is offline").
+		Start("alice/phone").
+		Expect("alice/phone", "[from bob] later").
+		Run(t)
+}
+
+func TestScenarioRevocation(t *testing.T) {
+	newScenario("key revocation").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Peer("carol", "n1").
+		Stop("carol").
+		Send("alice", "bob", "hi").
+		Expect("bob", "[from alice] hi").
+		Type("bob", "/revoke").
+		Expect("bob", "usage: /revoke <reason>").
+		Type("bob", "/revoke laptop stolen").
+		Expect("bob", "[revoke] key").
+		Expect("alice", "WARNING: bob revoked its key").
+		Expect("alice", "(laptop stolen): messages to it are refused").
+		Expect("alice", "[revoked] our session with bob uses a revoked key: closing it").
+		Type("alice", "@bob still there?").
+		Expect("alice", "send failed: bob: key is revoked").
+		ExpectNot("bob", "still there?").
+		Type("alice", "/peers").
+		Expect("alice", "[REVOKED]").
+		// Nodes keep the statement for peers registering later, bob
+		// included.
+		Start("carol").
+		Expect("carol", "WARNING: bob revoked its key").
+		Stop("bob").
+		Start("bob").
+		Expect("bob", "WARNING: our key").
+		Stop("bob").
+		step("bob gets new keys", func(n *simNetwork) error {
+			delete(n.idents, "bob")
+			return nil
+		}).
+		Start("bob").
+		Expect("bob", "peer joined: alice").
+		Send("alice", "bob", "welcome back").
+		Expect("bob", "[from alice] welcome back").
+		Run(t)
+}
+
+func TestScenarioVerify(t *testing.T) {
+	trustIs := func(want string) func(n *simNetwork) error {
+		return func(n *simNetwork) error {
+			if got := n.peer("alice").console.PeerTrust("bob"); got != want {
+				return fmt.Errorf("bob is %q", got)
+			}
+			return nil
+		}
+	}
+	newScenario("verified peers").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Setup("alice", pinKeys).
+		Setup("alice", func(_ *simNetwork, p *connPool) error {
+			p.setConfirmUnverified(true)
+			return nil
+		}).
+		Type("alice", "/verify carol").
+		Expect("alice", "verify: carol has no pinned keys yet").
+		Expect("bob", "peer joined: alice").
+		Send("bob", "alice", "hi").
+		Expect("alice", "[from bob] hi").
+		step("bob is pinned on first use", trustIs(peerTOFU)).
+		Type("alice", "@bob hello").
+		Expect("alice", "[verify] bob is not verified").
+		ExpectNot("bob", "hello").
+		Send("alice", "bob", "hello").
+		Expect("bob", "[from alice] hello").
+		Type("alice", "/peers").
+		Expect("alice", "[tofu]").
+		Type("alice", "/verify bob").
+		Expect("alice", "[verify] bob is verified").
+		step("bob is verified", trustIs(peerVerified)).
+		Send("alice", "bob", "checked").
+		Expect("bob", "[from alice] checked").
+		Type("alice", "/peers").
+		Expect("alice", "[verified]").
+		Run(t)
+}
+
+func TestScenarioVouch(t *testing.T) {
+	newScenario("verified peers vouch for others").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Peer("carol", "n1").
+		Setup("alice", pinKeys).
+		Setup("bob", pinKeys).
+		Setup("bob", func(_ *simNetwork, p *connPool) error {
+			p.setVouchThreshold(1)
+			return nil
+		}).
+		Expect("carol", "peer joined: alice").
+		Send("carol", "alice", "hi alice").
+		Expect("alice", "[from carol] hi alice").
+		Send("alice", "bob", "hi bob").
+		Expect("bob", "[from alice] hi bob").
+		Type("alice", "/vouch carol bob").
+		Expect("alice", "vouch: carol is not verified").
+		Type("alice", "/verify carol").
+		Expect("alice", "[verify] carol is verified").
+		// bob has not verified alice yet: her vouch does not count.
+		Type("alice", "/vouch carol bob").
+		Expect("alice", "[vouch] sent the keys of carol to bob").
+		Expect("bob", "[vouch] ignored a vouch from alice: it is not verified").
+		Type("bob", "/verify alice").
+		Expect("bob", "[verify] alice is verified").
+		Type("alice", "/vouch carol").
+		Expect("bob", "[vouch] alice vouches for the keys of carol (1 of 1 verified vouchers): vouched").
+		Type("bob", "/peers").
+		Expect("bob", "[vouched]").
+		Run(t)
+}
+
+func TestScenarioPadding(t *testing.T) {
+	newScenario("padded messages").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Setup("alice", func(_ *simNetwork, p *connPool) error {
+			p.setPadding(true)
+			return nil
+		}).
+		Expect("alice", "peer joined: bob").
+		Expect("bob", "peer joined: alice").
+		Send("alice", "bob", "hi bob").
+		Expect("bob", "[from alice] hi bob").
+		Type("bob", "/reply alice hello").
+		Expect("alice", "[reply from bob] hello").
+		Send("bob", "alice", "lunch?").
+		Expect("alice", "[from bob] lunch?").
+		Type("alice", "/notify bob brb").
+		Expect("bob", "[notify from alice] brb").
+		Run(t)
+}
+
+func TestScenarioChannel(t *testing.T) {
+	newScenario("duplex channel").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Type("alice", "/chan bob hello").
+		Expect("alice", "[chan] opened a channel with bob").
+		Expect("bob", "[chan] alice opened a channel").
+		Expect("bob", "[chan alice] alice: hello").
+		Type("bob", "/chan alice hi back").
+		Expect("alice", "[chan bob] bob: hi back").
+		ExpectNot("bob", "[chan] opened a channel with alice").
+		Type("alice", "/chan bob second").
+		Expect("bob", "[chan alice] alice: second").
+		Type("alice", "/unchan bob").
+		Expect("bob", "[chan] alice closed the channel").
+		Type("bob", "/unchan alice").
+		Expect("bob", "[error] no channel with alice").
+		Run(t)
+}
+
+func TestScenarioPeerLeaves(t *testing.T) {
+	newScenario("peer leaves").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Stop("bob").
+		Expect("alice", "peer left: bob").
+		Type("alice", "@bob are you there?").
+		Expect("alice", "[outbox] bob is offline; message queued until it joins: are you there?").
+		Type("alice", "/peers").
+		Expect("alice", "- bob offline, last seen just now").
+		Run(t)
+}
+
+func TestScenarioOutbox(t *testing.T) {
+	newScenario("outbox").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Stop("bob").
+		Expect("alice", "peer left: bob").
+		Type("alice", "@bob first").
+		Type("alice", "@bob second").
+		ExpectStatus("alice", "2 in outbox").
+		Type("alice", "/outbox").
+		Expect("alice", "2  to bob").
+		Type("alice", "/unqueue 9").
+		Expect("alice", "[error] no message 9 in the outbox").
+		Start("bob").
+		Expect("alice", "[alice to bob] second").
+		ExpectQueued("bob", "alice", "first").
+		ExpectQueued("bob", "alice", "second").
+		ExpectNoStatus("alice").
+		Type("alice", "/outbox").
+		Expect("alice", "[outbox] empty").
+		Run(t)
+}
+
+func TestScenarioMailbox(t *testing.T) {
+	newScenario("node mailbox").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Stop("bob").
+		Expect("alice", "peer left: bob").
+		Type("alice", "@bob see you later").
+		Expect("alice", "[outbox] bob is offline").
+		Stop("alice").
+		Start("bob").
+		ExpectQueued("bob", "alice", "see you later").
+		Run(t)
+}
+
+func TestScenarioTwoNodes(t *testing.T) {
+	newScenario("peers on different nodes").
+		Node("n1").
+		Node("n2").
+		Peer("alice", "n1", "n2").
+		Peer("bob", "n2").
+		Expect("alice", "peer joined: bob").
+		Send("alice", "bob", "across nodes").
+		ExpectQueued("bob", "alice", "across nodes").
+		Run(t)
+}
+
+func TestScenarioMute(t *testing.T) {
+	newScenario("local mute").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Type("alice", "/mute bob").
+		Expect("alice", "[mute] muted: bob").
+		Type("alice", "/peers").
+		Expect("alice", "- bob [muted] (peerID=").
+		Send("bob", "alice", "psst").
+		Expect("alice", "[from bob] psst").
+		Broadcast("bob", "anyone?").
+		Expect("bob", "[broadcast] bob sent to").
+		ExpectNot("alice", "anyone?").
+		Type("alice", "/unmute bob").
+		Expect("alice", "[mute] muted: nobody").
+		Send("bob", "alice", "hello again").
+		ExpectQueued("alice", "bob", "hello again").
+		step("psst was not queued", func(n *simNetwork) error {
+			if q := n.peer("alice").console.Queue("bob"); len(q) != 1 {
+				return fmt.Errorf("queue for bob = %q", q)
+			}
+			return nil
+		}).
+		Run(t)
+}
+
+func TestScenarioMuteAndFollow(t *testing.T) {
+	newScenario("presence subscriptions").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Peer("carol", "n1").
+		Expect("alice", "peer joined: carol").
+		Type("alice", "/hide bob").
+		Expect("alice", "[presence] following everyone; hidden: bob").
+		Type("alice", "@bob still there?").
+		Expect("alice", "[error] unknown peer: bob").
+		Stop("bob").
+		Stop("carol").
+		Expect("alice", "peer left: carol").
+		ExpectNot("alice", "peer left: bob").
+		Type("alice", "/follow carol").
+		Expect("alice", "[presence] following carol; hidden: bob").
+		Run(t)
+}
+
+func TestScenarioReply(t *testing.T) {
+	newScenario("interactive reply").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Send("alice", "bob", "lunch?").
+		ExpectQueued("bob", "alice", "lunch?").
+		Type("bob", "/reply alice sure, noon").
+		Expect("bob", "[bob reply to alice] sure, noon").
+		Expect("alice", "[reply from bob] sure, noon").
+		Type("bob", "/reply alice again").
+		Expect("bob", "[error] no message is awaiting a reply from alice").
+		Run(t)
+}
+
+func TestScenarioQuotedReply(t *testing.T) {
+	newScenario("numbered reply quotes the message").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Send("alice", "bob", "lunch?").
+		Send("alice", "bob", "or dinner?").
+		ExpectQueued("bob", "alice", "or dinner?").
+		Type("bob", "/reply alice#2 dinner").
+		Expect("bob", "  > or dinner?").
+		Expect("bob", "[bob reply to alice] dinner").
+		Expect("alice", "  > or dinner?").
+		Expect("alice", "[reply from bob] dinner").
+		Type("bob", "/reply alice#2 no").
+		Expect("bob", "[error] no message is awaiting a reply from alice as #2 (there are 1)").
+		Type("bob", "/reply alice sure").
+		Expect("alice", "  > lunch?").
+		Run(t)
+}
+
+func TestScenarioEditDelete(t *testing.T) {
+	newScenario("edit and delete sent messages").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Send("alice", "bob", "lunch at 12?").
+		Send("alice", "bob", "bring cake").
+		ExpectQueued("bob", "alice", "bring cake").
+		Type("alice", "/edit bob#2 lunch at 1?").
+		Expect("alice", "[alice to bob] lunch at 1? (edited)").
+		Expect("bob", "[from alice] lunch at 1? (edited)").
+		ExpectQueued("bob", "alice", "lunch at 1?").
+		Type("alice", "/delete bob").
+		Expect("alice", "[alice to bob] (deleted) bring cake").
+		Expect("bob", "[from alice] (deleted)").
+		Type("alice", "/edit bob#3 nope").
+		Expect("alice", "[error] edit: no message #3 sent to bob (1 remembered)").
+		Run(t)
+}
+
+func TestScenarioReactions(t *testing.T) {
+	newScenario("reactions").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Send("alice", "bob", "lunch?").
+		Send("alice", "bob", "cake?").
+		ExpectQueued("bob", "alice", "cake?").
+		Type("bob", "/react alice#2 👍").
+		Expect("bob", "[from alice] lunch?  👍 bob").
+		Expect("alice", "[alice to bob] lunch? (delivered)  👍 bob").
+		Type("bob", "/react alice two words").
+		Expect("bob", "[error] react: reaction must not contain spaces").
+		Type("bob", "/react alice#3 👍").
+		Expect("bob", "[error] react: no message #3 from alice (2 remembered)").
+		Run(t)
+}
+
+func TestScenarioForward(t *testing.T) {
+	newScenario("forwarding").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Peer("carol", "n1").
+		Expect("bob", "peer joined: carol").
+		Send("alice", "bob", "lunch?").
+		Send("alice", "bob", "meet at 5").
+		ExpectQueued("bob", "alice", "meet at 5").
+		Type("bob", "/forward alice @carol").
+		Expect("bob", "[bob to carol] (forwarded from alice) meet at 5").
+		ExpectQueued("carol", "bob", "(forwarded from alice) meet at 5").
+		Type("bob", "/forward alice#2 carol").
+		ExpectQueued("carol", "bob", "(forwarded from alice) lunch?").
+		Type("bob", "/forward alice#3 @carol").
+		Expect("bob", "[error] forward: no message #3 from alice (2 remembered)").
+		Run(t)
+}
+
+func TestScenarioReceipts(t *testing.T) {
+	newScenario("delivery and read receipts").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Send("alice", "bob", "lunch?").
+		Expect("alice", "[alice to bob] lunch? (delivered)").
+		ExpectQueued("bob", "alice", "lunch?").
+		Type("bob", "/reply alice sure").
+		Expect("alice", "[reply from bob] sure").
+		Expect("alice", "[alice to bob] lunch? (read)").
+		Run(t)
+}
+
+func TestScenarioTyping(t *testing.T) {
+	newScenario("typing indicator").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Compose("alice", "@bob are you").
+		ExpectStatus("bob", "alice is typing").
+		Send("alice", "bob", "are you there?").
+		ExpectQueued("bob", "alice", "are you there?").
+		ExpectNoStatus("bob").
+		Run(t)
+}
+
+func TestScenarioNotify(t *testing.T) {
+	newScenario("one-way notify").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Type("alice", "/notify bob back in 5").
+		Expect("alice", "[alice notify to bob] back in 5").
+		Expect("bob", "[notify from alice] back in 5").
+		Send("alice", "bob", "still there?").
+		ExpectQueued("bob", "alice", "still there?").
+		ExpectNot("bob", "[from alice] back in 5").
+		Run(t)
+}
+
+func TestScenarioRoom(t *testing.T) {
+	newScenario("room with sender keys").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Peer("carol", "n1").
+		Expect("alice", "peer joined: carol").
+		Type("alice", "/join #dev").
+		Type("bob", "/join #dev").
+		Expect("alice", "[#dev] members: alice, bob").
+		Expect("bob", "[#dev] members: alice, bob").
+		Type("alice", "#dev standup in 5").
+		Expect("alice", "[#dev alice] standup in 5").
+		Expect("bob", "[#dev alice] standup in 5").
+		Type("bob", "#dev on my way").
+		Expect("alice", "[#dev bob] on my way").
+		Type("bob", "/leave #dev").
+		Expect("alice", "[#dev] members: alice").
+		Type("alice", "#dev bob left").
+		Expect("alice", "[#dev alice] bob left").
+		Type("carol", "#dev hello?").
+		Expect("carol", "[error] not in #dev (use /join #dev)").
+		ExpectNot("carol", "standup").
+		ExpectNot("bob", "bob left").
+		Run(t)
+}
+
+func TestScenarioSendFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "notes.bin")
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*fileChunkSize+1000)/16)
+	if err := os.WriteFile(src, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "saved.bin")
+
+	newScenario("file transfer").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Type("alice", "/send-file bob "+src).
+		Expect("bob", fmt.Sprintf("[file from alice] notes.bin (%d bytes), receiving as 1", len(data))).
+		Expect("bob", "[file from alice] notes.bin received: /save 1 [path] or /discard 1").
+		Expect("alice", "[file to bob] sent notes.bin").
+		Type("bob", "/save 1 "+dst).
+		Expect("bob", "[file] saved 1 as "+dst).
+		step("saved file matches", func(*simNetwork) error {
+			got, err := os.ReadFile(dst)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, data) {
+				return fmt.Errorf("saved %d bytes, want %d", len(got), len(data))
+			}
+			return nil
+		}).
+		Type("bob", "/save 1").
+		Expect("bob", "[error] save 1: no file 1").
+		Run(t)
+}
+
+func TestScenarioResumeFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "big.bin")
+	data := bytes.Repeat([]byte("fedcba9876543210"), (3*fileChunkSize-100)/16)
+	if err := os.WriteFile(src, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "saved.bin")
+
+	newScenario("resumed file transfer").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		step("alice sends the offer and the first chunk only", func(n *simNetwork) error {
+			pool := n.peer("alice").pool
+			to, _ := pool.peerTable.Get("bob")
+			o, err := pool.offerFile(to, src)
+			if err != nil {
+				return err
+			}
+			return pool.sendChunks(to, o, [][2]uint32{{0, 1}})
+		}).
+		ExpectStatus("bob", "big.bin from alice 33%").
+		Type("bob", "/files").
+		Expect("bob", "1. big.bin from alice, 786320 bytes, 1/3 chunks").
+		Type("bob", "/resume 1").
+		Expect("alice", "[file to bob] resuming big.bin").
+		Expect("bob", "[file from alice] big.bin received: /save 1 [path] or /discard 1").
+		Expect("alice", "[file to bob] big.bin delivered").
+		Type("bob", "/save 1 "+dst).
+		Expect("bob", "[file] saved 1 as "+dst).
+		step("saved file matches", func(n *simNetwork) error {
+			got, err := os.ReadFile(dst)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, data) {
+				return fmt.Errorf("saved %d bytes, want %d", len(got), len(data))
+			}
+			if st := n.peer("bob").console.Status(); len(st) != 0 {
+				return fmt.Errorf("status left behind: %q", st)
+			}
+			return nil
+		}).
+		Run(t)
+}
+
+func TestScenarioHardwareSigner(t *testing.T) {
+	newScenario("hardware signer").
+		Node("n1").
+		step("alice's signing key is in an agent", func(n *simNetwork) error {
+			_, priv, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				return err
+			}
+			ag := agent.NewKeyring()
+			if err := ag.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+				return err
+			}
+			s, err := hwkey.FromAgent(ag, "")
+			if err != nil {
+				return err
+			}
+			n.idents["alice"] = simIdentity{signer: s}
+			return nil
+		}).
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Expect("alice", "peer joined: bob").
+		Send("alice", "bob", "signed by the agent").
+		Expect("bob", "[from alice] signed by the agent").
+		Send("bob", "alice", "got it").
+		Expect("alice", "[from bob] got it").
+		Type("bob", "/whois alice").
+		Expect("bob", "Alice").
+		Type("bob", "/fingerprint alice").
+		Expect("bob", "[fingerprint]   words:").
+		// The contact card is signed by the agent key too.
+		Type("alice", "/myqr").
+		Expect("alice", "[myqr] TMD1:").
+		// A restart keeps the agent key, and the peer ID with it.
+		Stop("alice").
+		Start("alice").
+		Expect("alice", "peer joined: bob").
+		Send("alice", "bob", "back").
+		Expect("bob", "[from alice] back").
+		Run(t)
+}
+
+func TestScenarioSuiteNegotiation(t *testing.T) {
+	chacha := supportedSuites[1]
+	sessionSuite := func(n *simNetwork, from, to string) error {
+		p := n.peer(from).pool
+		p.mu.Lock()
+		ps := p.sessions[PeerID(to)]
+		p.mu.Unlock()
+		if ps == nil || ps.suite != chacha {
+			return fmt.Errorf("%s's session to %s does not use the strongest suite in common", from, to)
+		}
+		return nil
+	}
+	newScenario("HPKE suite negotiation").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Setup("alice", func(_ *simNetwork, p *connPool) error {
+			p.suites = supportedSuites[1:] // no AES-256
+			return nil
+		}).
+		Expect("alice", "peer joined: bob").
+		Expect("bob", "peer joined: alice").
+		Send("alice", "bob", "hi bob").
+		Expect("bob", "[from alice] hi bob").
+		Send("bob", "alice", "hi alice").
+		Expect("alice", "[from bob] hi alice").
+		Type("alice", "/notify bob brb").
+		Expect("bob", "[notify from alice] brb").
+		step("both sessions use ChaCha20-Poly1305", func(n *simNetwork) error {
+			if err := sessionSuite(n, "alice", "bob"); err != nil {
+				return err
+			}
+			return sessionSuite(n, "bob", "alice")
+		}).
+		Run(t)
+}
+
+func TestScenarioRekey(t *testing.T) {
+	rekeyEvery2 := func(_ *simNetwork, p *connPool) error {
+		p.setRekeyLimits(rekeyLimits{Messages: 2})
+		return nil
+	}
+	s := newScenario("channel and room keys replaced").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Setup("alice", rekeyEvery2).
+		Setup("bob", rekeyEvery2).
+		Expect("alice", "peer joined: bob").
+		Type("alice", "/chan bob c0").
+		Expect("bob", "[chan alice] alice: c0")
+	for i := 1; i <= 4; i++ {
+		s = s.Type("alice", fmt.Sprintf("/chan bob c%d", i)).
+			Expect("bob", fmt.Sprintf("[chan alice] alice: c%d", i)).
+			Type("bob", fmt.Sprintf("/chan alice r%d", i)).
+			Expect("alice", fmt.Sprintf("[chan bob] bob: r%d", i))
+	}
+	s = s.step("both directions were rekeyed", func(n *simNetwork) error {
+		for _, nick := range []string{"alice", "bob"} {
+			other := map[string]PeerID{"alice": "bob", "bob": "alice"}[nick]
+			c, ok := n.peer(nick).pool.channelWith(other)
+			if !ok {
+				return fmt.Errorf("%s has no channel", nick)
+			}
+			c.mu.Lock()
+			rekeyed := c.rekeyed
+			c.mu.Unlock()
+			if rekeyed == 0 {
+				return fmt.Errorf("%s's sending key was never replaced", nick)
+			}
+		}
+		return nil
+	}).
+		Type("alice", "/join #dev").
+		Type("bob", "/join #dev").
+		Expect("bob", "[#dev] members: alice, bob").
+		Expect("alice", "[#dev] members: alice, bob")
+	for i := range 5 {
+		s = s.Type("alice", fmt.Sprintf("#dev m%d", i)).
+			Expect("bob", fmt.Sprintf("[#dev alice] m%d", i))
+	}
+	s.step("alice's room key was replaced", func(n *simNetwork) error {
+		p := n.peer("alice").pool
+		p.rooms.mu.Lock()
+		defer p.rooms.mu.Unlock()
+		if gen := p.rooms.rooms["#dev"].own.gen; gen < 3 {
+			return fmt.Errorf("room key generation %d after 5 messages", gen)
+		}
+		return nil
+	}).
+		Run(t)
+}
+
+func TestScenarioSignedMessages(t *testing.T) {
+	newScenario("signed messages").
+		Node("n1").
+		Peer("alice", "n1").
+		Peer("bob", "n1").
+		Setup("alice", func(_ *simNetwork, p *connPool) error {
+			p.setSigning(true)
+			return nil
+		}).
+		Expect("alice", "peer joined: bob").
+		Expect("bob", "peer joined: alice").
+		Send("alice", "bob", "hi bob").
+		Expect("bob", "[from alice] hi bob").
+		ExpectNot("bob", "[unsigned]").
+		Send("bob", "alice", "lunch?").
+		Expect("alice", "[from bob] [unsigned] lunch?").
+		Type("alice", "everyone, lunch").
+		Expect("bob", "[broadcast from alice] everyone, lunch").
+		Run(t)
+}
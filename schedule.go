@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/history"
+)
+
+// scheduleLayout is the local time format of /schedule; RFC 3339 times
+// are taken too.
+const scheduleLayout = "2006-01-02T15:04"
+
+// scheduler holds the direct messages to send later, earliest first. A
+// single timer is armed for the earliest; with --history they survive
+// restarts, and those due while tmd was not running are sent on start.
+type scheduler struct {
+	mu      sync.Mutex
+	store   *history.Store // nil: kept in memory only
+	next    uint64
+	pending []history.Scheduled
+	timer   *time.Timer
+}
+
+// setScheduleStore restores the scheduled messages kept in s and keeps
+// them there.
+func (p *connPool) setScheduleStore(s *history.Store) error {
+	list, err := s.Schedule()
+	if err != nil {
+		return err
+	}
+	p.sched.mu.Lock()
+	p.sched.store = s
+	for _, sc := range list {
+		p.sched.next = max(p.sched.next, sc.ID)
+		p.sched.pending = append(p.sched.pending, sc)
+	}
+	sortSchedule(p.sched.pending)
+	p.armScheduleLocked()
+	p.sched.mu.Unlock()
+	return nil
+}
+
+func sortSchedule(list []history.Scheduled) {
+	slices.SortStableFunc(list, func(a, b history.Scheduled) int { return a.At.Compare(b.At) })
+}
+
+// scheduleMessage schedules msg to peer at the given time.
+func (p *connPool) scheduleMessage(to PeerID, at time.Time, msg string) (history.Scheduled, error) {
+	p.sched.mu.Lock()
+	p.sched.next++
+	sc := history.Scheduled{ID: p.sched.next, To: string(to), Message: msg, At: at}
+	p.sched.pending = append(p.sched.pending, sc)
+	sortSchedule(p.sched.pending)
+	p.armScheduleLocked()
+	store := p.sched.store
+	p.sched.mu.Unlock()
+
+	if store != nil {
+		return sc, store.PutScheduled(sc)
+	}
+	return sc, nil
+}
+
+// unschedule cancels scheduled message id and reports whether it was
+// pending.
+func (p *connPool) unschedule(id uint64) bool {
+	p.sched.mu.Lock()
+	i := slices.IndexFunc(p.sched.pending, func(sc history.Scheduled) bool { return sc.ID == id })
+	if i < 0 {
+		p.sched.mu.Unlock()
+		return false
+	}
+	p.sched.pending = slices.Delete(p.sched.pending, i, i+1)
+	p.armScheduleLocked()
+	store := p.sched.store
+	p.sched.mu.Unlock()
+
+	if store != nil {
+		if err := store.DeleteScheduled(id); err != nil {
+			p.console.Errorf("schedule: %v", err)
+		}
+	}
+	return true
+}
+
+// Schedule returns the scheduled messages, earliest first.
+func (p *connPool) Schedule() []history.Scheduled {
+	p.sched.mu.Lock()
+	defer p.sched.mu.Unlock()
+	return slices.Clone(p.sched.pending)
+}
+
+// armScheduleLocked sets the timer for the earliest scheduled message.
+func (p *connPool) armScheduleLocked() {
+	if p.sched.timer != nil {
+		p.sched.timer.Stop()
+		p.sched.timer = nil
+	}
+	if len(p.sched.pending) == 0 {
+		return
+	}
+	p.sched.timer = time.AfterFunc(time.Until(p.sched.pending[0].At), p.sendDue)
+}
+
+// sendDue sends the scheduled messages whose time has come and arms the
+// timer for the next.
+func (p *connPool) sendDue() {
+	now := time.Now()
+	p.sched.mu.Lock()
+	var due []history.Scheduled
+	for len(p.sched.pending) > 0 && !p.sched.pending[0].At.After(now) {
+		due = append(due, p.sched.pending[0])
+		p.sched.pending = p.sched.pending[1:]
+	}
+	p.armScheduleLocked()
+	store := p.sched.store
+	p.sched.mu.Unlock()
+
+	for _, sc := range due {
+		if store != nil {
+			if err := store.DeleteScheduled(sc.ID); err != nil {
+				p.console.Errorf("schedule: %v", err)
+			}
+		}
+		p.sendScheduled(sc)
+	}
+}
+
+// sendScheduled sends a due message if its peer is online, or leaves it
+// in the outbox otherwise.
+func (p *connPool) sendScheduled(sc history.Scheduled) {
+	c, nick := p.console, PeerID(sc.To)
+	to, online := p.peerTable.Get(nick)
+	if !online || p.queuesFor(nick) {
+		queueTo(c, p, nick, sc.Message)
+		if online {
+			p.flushOutbox(nick)
+		}
+		return
+	}
+	c.Printf("[schedule] sending message %d to %s", sc.ID, nick)
+	sendDirect(c, p, to, sc.Message, nil, nil, func(err error) {
+		var offline *offlineError
+		if !errors.As(err, &offline) {
+			c.Errorf("scheduled message to %s: %v", nick, err)
+			return
+		}
+		queueTo(c, p, nick, sc.Message)
+	})
+}
+
+// parseScheduleTime reads a /schedule time: local "2006-01-02T15:04" or
+// RFC 3339.
+func parseScheduleTime(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation(scheduleLayout, s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time %q: want %s", s, scheduleLayout)
+	}
+	return t, nil
+}
+
+// runScheduleCommand handles "/schedule @peer <time> <message>",
+// "/scheduled" and "/unschedule <n>".
+func runScheduleCommand(c Console, pool *connPool, cmd, args string) {
+	switch cmd {
+	case "/unschedule":
+		id, err := strconv.ParseUint(args, 10, 64)
+		if err != nil {
+			c.Errorf("usage: /unschedule <n>")
+			return
+		}
+		if !pool.unschedule(id) {
+			c.Errorf("no scheduled message %d", id)
+			return
+		}
+		c.Printf("[schedule] message %d cancelled", id)
+		return
+	case "/scheduled":
+		list := pool.Schedule()
+		if len(list) == 0 {
+			c.Printf("[schedule] nothing scheduled")
+			return
+		}
+		for _, sc := range list {
+			c.Printf("%d  to %s at %s: %s", sc.ID, sc.To, sc.At.Local().Format("Jan 2 15:04"), sc.Message)
+		}
+		return
+	}
+
+	fields := strings.SplitN(args, " ", 3)
+	if len(fields) < 3 || !strings.HasPrefix(fields[0], "@") || strings.TrimSpace(fields[2]) == "" {
+		c.Errorf("usage: /schedule @peer %s <message>", scheduleLayout)
+		return
+	}
+	to := PeerID(strings.TrimPrefix(fields[0], "@"))
+	if to == pool.nickname {
+		c.Errorf("can't send to self")
+		return
+	}
+	at, err := parseScheduleTime(fields[1])
+	if err != nil {
+		c.Errorf("schedule: %v", err)
+		return
+	}
+	if !at.After(time.Now()) {
+		c.Errorf("schedule: %s is in the past", fields[1])
+		return
+	}
+	sc, err := pool.scheduleMessage(to, at, strings.TrimSpace(fields[2]))
+	if err != nil {
+		c.Errorf("schedule: %v", err)
+	}
+	c.Printf("[schedule] message %d to %s at %s", sc.ID, to, at.Format("Jan 2 15:04"))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// searchConsole is implemented by consoles that can search their history,
+// restored from --history included, and bring matches into view.
+type searchConsole interface {
+	// Search finds the history lines holding every word of query, as
+	// words or word prefixes in any case, and shows the latest. An empty
+	// query shows the next older match of the last search, wrapping
+	// around. It returns the number of matches and which one is shown,
+	// 1 being the latest.
+	Search(query string) (matches, shown int)
+}
+
+// searchPrefix starts the lines /search prints; they are not indexed, so
+// searching again does not find them.
+const searchPrefix = "[search] "
+
+// historyIndex maps the words of history lines to their positions in the
+// history, in order. It is only kept in memory: the store holds sealed
+// lines, and the index is rebuilt from them once opened.
+type historyIndex struct {
+	words map[string][]int
+}
+
+// searchWords splits text into lower-case words.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// add indexes the line at pos. Lines are added in order; a changed line
+// is added again under the same pos.
+func (x *historyIndex) add(pos int, text string) {
+	if strings.HasPrefix(text, searchPrefix) {
+		return
+	}
+	if x.words == nil {
+		x.words = make(map[string][]int)
+	}
+	for _, w := range searchWords(text) {
+		list := x.words[w]
+		if i, found := slices.BinarySearch(list, pos); !found {
+			x.words[w] = slices.Insert(list, i, pos)
+		}
+	}
+}
+
+// reset drops every position.
+func (x *historyIndex) reset() {
+	x.words = nil
+}
+
+// search returns the positions of the lines with every word of query,
+// oldest first. text gives the current line at a position: lines changed
+// since they were indexed are checked again.
+func (x *historyIndex) search(query string, text func(pos int) string) []int {
+	terms := searchWords(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	var hits []int
+	for i, term := range terms {
+		var list []int
+		for w, pos := range x.words {
+			if strings.HasPrefix(w, term) {
+				list = append(list, pos...)
+			}
+		}
+		slices.Sort(list)
+		list = slices.Compact(list)
+		if i == 0 {
+			hits = list
+		} else {
+			hits = slices.DeleteFunc(hits, func(pos int) bool {
+				_, found := slices.BinarySearch(list, pos)
+				return !found
+			})
+		}
+	}
+	return slices.DeleteFunc(hits, func(pos int) bool { return !hasWords(text(pos), terms) })
+}
+
+// hasWords reports whether every term prefixes a word of text.
+func hasWords(text string, terms []string) bool {
+	words := searchWords(text)
+	for _, term := range terms {
+		if !slices.ContainsFunc(words, func(w string) bool { return strings.HasPrefix(w, term) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchState is the last search of a console: the matching positions,
+// oldest first, and the index of the one shown; none once left.
+type searchState struct {
+	hits []int
+	at   int
+}
+
+// next runs query, or moves to the next older hit when query is empty,
+// and returns the search result for searchConsole.
+func (s *searchState) next(x *historyIndex, query string, text func(pos int) string) (matches, shown int) {
+	if strings.TrimSpace(query) != "" {
+		s.hits = x.search(query, text)
+		s.at = len(s.hits) - 1
+	} else if len(s.hits) > 0 {
+		s.at = (s.at - 1 + len(s.hits)) % len(s.hits)
+	}
+	if len(s.hits) == 0 {
+		return 0, 0
+	}
+	return len(s.hits), len(s.hits) - s.at
+}
+
+// current returns the position shown, if searching.
+func (s *searchState) current() (int, bool) {
+	if len(s.hits) == 0 {
+		return 0, false
+	}
+	return s.hits[s.at], true
+}
+
+// runSearch handles "/search <query>" and "/search" (next older match).
+func runSearch(c Console, args string) {
+	sc, ok := c.(searchConsole)
+	if !ok {
+		c.Errorf("search: this console has no history to search")
+		return
+	}
+	n, shown := sc.Search(args)
+	switch {
+	case n > 0:
+		c.Printf(searchPrefix+"match %d of %d (/search for older, Esc to leave)", shown, n)
+	case args == "":
+		c.Errorf("usage: /search <words>")
+	default:
+		c.Printf(searchPrefix + "no match")
+	}
+}
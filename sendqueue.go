@@ -0,0 +1,82 @@
+package main
+
+import "sync"
+
+// Requests may ask to be sent ahead of other traffic: an interactive
+// request carries priorityInteractive, and each session and responder
+// writes waiting frames by class, so that chat is not stuck behind a file
+// transfer or a streamed body. A frame being written is never
+// interrupted; a high-priority one waits for it, then goes first.
+const (
+	priorityNormal      byte = 0 // not sent on the wire
+	priorityInteractive byte = 1
+)
+
+// sendClass orders waiting writes; lower classes go first.
+type sendClass int
+
+const (
+	sendHigh sendClass = iota
+	sendNormal
+	sendBulk
+	numSendClasses
+)
+
+// classOf is the class of a frame written with no request priority.
+func classOf(typ byte) sendClass {
+	switch typ {
+	case msgFileChunk, msgStreamData:
+		return sendBulk
+	}
+	return sendNormal
+}
+
+// requestClass is the class of a request frame.
+func requestClass(req Request) sendClass {
+	if req.Priority == priorityInteractive {
+		return sendHigh
+	}
+	return sendNormal
+}
+
+// sendQueue serialises the writes on one stream, letting waiting writes
+// of a higher class through first. The zero value is ready to use.
+type sendQueue struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	busy    bool
+	waiting [numSendClasses]int
+}
+
+// do runs write once no write is running and none of a higher class is
+// waiting.
+func (q *sendQueue) do(class sendClass, write func() error) error {
+	q.mu.Lock()
+	if q.cond.L == nil {
+		q.cond.L = &q.mu
+	}
+	q.waiting[class]++
+	for q.busy || q.aheadLocked(class) {
+		q.cond.Wait()
+	}
+	q.waiting[class]--
+	q.busy = true
+	q.mu.Unlock()
+
+	defer func() {
+		q.mu.Lock()
+		q.busy = false
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}()
+	return write()
+}
+
+func (q *sendQueue) aheadLocked(class sendClass) bool {
+	for c := range class {
+		if q.waiting[c] > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendQueueOrder(t *testing.T) {
+	var q sendQueue
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		_ = q.do(sendNormal, func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	var mu sync.Mutex
+	var order []sendClass
+	var wg sync.WaitGroup
+	for _, class := range []sendClass{sendBulk, sendNormal, sendHigh} {
+		wg.Go(func() {
+			_ = q.do(class, func() error {
+				mu.Lock()
+				order = append(order, class)
+				mu.Unlock()
+				return nil
+			})
+		})
+		// Let each writer queue up before the next.
+		deadline := time.Now().Add(time.Second)
+		for {
+			q.mu.Lock()
+			queued := q.waiting[class] > 0
+			q.mu.Unlock()
+			if queued || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	if len(order) != 3 || order[0] != sendHigh || order[1] != sendNormal || order[2] != sendBulk {
+		t.Fatalf("write order = %v", order)
+	}
+}
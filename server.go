@@ -3,13 +3,19 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
 
+	"github.com/cloudflare/circl/hpke"
 	"github.com/cloudflare/circl/kem"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/openpcc/twoway"
+	"github.com/pivaldi/tmd/internal/audit"
+	"github.com/pivaldi/tmd/internal/keyid"
+	"github.com/pivaldi/tmd/internal/ratchet"
+	"github.com/pivaldi/tmd/internal/secmem"
 )
 
 type Response struct {
@@ -20,20 +26,38 @@ type Response struct {
 
 // SetupStreamHandler sets up the libp2p stream handler for incoming messages
 func (p *connPool) SetupStreamHandler(selfHPKEPriv kem.PrivateKey) error {
-	// Use first byte of KeyID for twoway library compatibility
-	receiver, err := twoway.NewMultiRequestReceiver(p.suite, p.keyID[0], selfHPKEPriv, rand.Reader)
+	// One receiver per suite a session may use (see suites.go).
+	receivers := make(map[hpke.Suite]*twoway.MultiRequestReceiver)
+	for _, suite := range append([]hpke.Suite{p.suite}, p.suites...) {
+		// twoway names our key with a single byte
+		receiver, err := twoway.NewMultiRequestReceiver(suite, p.keyID.Short(), selfHPKEPriv, rand.Reader)
+		if err != nil {
+			return fmt.Errorf("error in NewMultiRequestReceiver: %w", err)
+		}
+		receivers[suite] = receiver
+	}
+	p.setMailReceiver(receivers[p.suite])
+	privBytes, err := selfHPKEPriv.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("marshal HPKE key: %w", err)
+	}
+	err = p.setRatchetKey(privBytes)
+	secmem.Wipe(privBytes)
 	if err != nil {
-		return fmt.Errorf("error in NewMultiRequestReceiver: %w", err)
+		return err
 	}
+	p.chans.mu.Lock()
+	p.chans.priv = selfHPKEPriv
+	p.chans.mu.Unlock()
 
 	p.host.SetStreamHandler(ProtocolID, func(stream network.Stream) {
-		p.handleStream(stream, receiver)
+		p.handleStream(p.chaos.Wrap(stream), receivers)
 	})
 
 	return nil
 }
 
-func (p *connPool) handleStream(stream network.Stream, receiver *twoway.MultiRequestReceiver) {
+func (p *connPool) handleStream(stream network.Stream, receivers map[hpke.Suite]*twoway.MultiRequestReceiver) {
 	defer func() {
 		_ = stream.Close()
 	}()
@@ -45,7 +69,12 @@ func (p *connPool) handleStream(stream network.Stream, receiver *twoway.MultiReq
 		return
 	}
 
-	if err := writeMsg(stream, msgChallenge, chal); err != nil && p.console != nil {
+	features := featureEarly | featureMutual | featureSessionKeys
+	if len(p.suites) > 0 {
+		features |= featureBinding // see binding.go
+	}
+	chalPayload := encodeChallenge(chal, p.maxFrame, p.suites, features)
+	if err := writeMsg(stream, msgChallenge, chalPayload); err != nil {
 		p.console.Printf("[%s] write challenge: %v\n", p.nickname, err)
 		return
 	}
@@ -55,7 +84,7 @@ func (p *connPool) handleStream(stream network.Stream, receiver *twoway.MultiReq
 	if err != nil {
 		return
 	}
-	if typ != msgHello && p.console != nil {
+	if typ != msgHello {
 		p.console.Printf("[%s] expected HELLO, got %d\n", p.nickname, typ)
 		return
 	}
@@ -64,25 +93,136 @@ func (p *connPool) handleStream(stream network.Stream, receiver *twoway.MultiReq
 		p.console.Errorf("[%s] decode hello: %v\n", p.nickname, err)
 		return
 	}
-	if err := verifySignedHello(p.kemScheme, chal, hello); err != nil {
+	signed, err := p.helloTranscript(stream, chal, chalPayload, hello)
+	if err != nil {
+		p.console.Errorf("[%s] %s: %v\n", p.nickname, hello.SenderID, err)
+		p.auditf(audit.Downgrade, hello.SenderID, "from %s: %v", stream.Conn().RemotePeer(), err)
+		return
+	}
+	if err := verifySignedHello(p.kemScheme, signed, hello); err != nil {
 		p.console.Errorf("[%s] identity verify failed: %v\n", p.nickname, err)
+		p.auditf(audit.HelloFailed, hello.SenderID, "from %s: %v", stream.Conn().RemotePeer(), err)
+		return
+	}
+	if err := checkHelloPeer(hello, stream.Conn().RemotePeer(), p.peerTable); err != nil {
+		p.console.Errorf("[%s] identity verify failed: %v\n", p.nickname, err)
+		p.auditf(audit.HelloFailed, hello.SenderID, "from %s: %v", stream.Conn().RemotePeer(), err)
+		return
+	}
+	if err := checkHelloKeySig(hello); err != nil {
+		p.console.Errorf("[%s] identity verify failed: %v\n", p.nickname, err)
+		p.auditf(audit.HelloFailed, hello.SenderID, "from %s: %v", stream.Conn().RemotePeer(), err)
+		return
+	}
+	if err := p.refuseUnsigned(hello.SenderID, hello.KeySig); err != nil {
+		p.console.Errorf("[%s] identity verify failed: %v\n", p.nickname, err)
+		p.auditf(audit.UnsignedKey, hello.SenderID, "Hello from %s: %v", stream.Conn().RemotePeer(), err)
+		return
+	}
+	// Peers predating full KeyIDs send one byte: widen it from their key.
+	if hello.SenderKeyID, err = keyid.Resolve(hello.SenderKeyID, hello.SenderHPKEPub); err != nil {
+		p.console.Errorf("[%s] identity verify failed: %v\n", p.nickname, err)
+		p.auditf(audit.HelloFailed, hello.SenderID, "from %s: %v", stream.Conn().RemotePeer(), err)
+		return
+	}
+	if len(p.suites) > 0 && hello.Features&featureBinding == 0 {
+		p.auditf(audit.Downgrade, hello.SenderID, "from %s: HELLO without HPKE suites or binding accepted (--legacy-hellos)", stream.Conn().RemotePeer())
+	}
+	suite, err := p.listenerSuite(hello)
+	if err == nil {
+		err = p.checkPeerSuite(hello.SenderID, suite)
+	}
+	if err != nil {
+		p.console.Errorf("[%s] %s: %v\n", p.nickname, hello.SenderID, err)
+		return
+	}
+	// Requests and notifies come sealed with the session's suite; other
+	// frames with the default one.
+	receiver, sessionReceiver := receivers[p.suite], receivers[suite]
+	if p.blockedKey(hello.SenderEdPub) {
+		return
+	}
+	if r, ok := p.revokedKeys(hello.SenderKeyID, hello.SenderEdPub); ok {
+		p.console.Errorf("[revoked] %s connected with revoked key %x: session refused", hello.SenderID, r.KeyID)
+		p.auditf(audit.RevokedKey, hello.SenderID, "connected with revoked key %x: session refused", r.KeyID)
+		return
+	}
+	if len(hello.KeySig) > 0 {
+		p.followRotation(hello.SenderID, hello.SenderEdPub, hello.SenderHPKEPub, "its Hello")
+	}
+	if err := p.observeKeys(hello.SenderID, hello.SenderEdPub, hello.SenderHPKEPub, "its Hello"); err != nil {
+		return
+	}
+	p.noteSigned(hello.SenderID, hello.KeySig)
+
+	sendLimit, fragments, err := negotiateFrameLimit(hello.MaxFrame)
+	if err != nil {
+		p.console.Errorf("[%s] %s: %v\n", p.nickname, hello.SenderID, err)
 		return
 	}
 
 	p.console.AddHistory(fmt.Sprintf("[net] inbound connection from %s", hello.SenderID))
+	p.learnProfile(hello.SenderID, hello.Profile, verifyEd(hello.SenderEdPub))
+	out := &responder{stream: stream, sendLimit: sendLimit, fragments: fragments, padding: p.padding}
+	respHello, err := p.responderHello(signed)
+	if err != nil {
+		p.console.Errorf("[%s] %v", p.nickname, err)
+		return
+	}
+	if err := out.write(msgRespHello, respHello); err != nil {
+		return
+	}
+	rs, ratchetPub, err := p.answerRatchet(hello)
+	if err != nil {
+		p.console.Errorf("[%s] ratchet with %s: %v", p.nickname, hello.SenderID, err)
+		return
+	}
+	if rs != nil {
+		if err := out.write(msgRatchet, ratchetPub); err != nil {
+			return
+		}
+		out.ratchet = rs
+	}
+	defer p.dropHeld(out)
+	defer p.dropChannelsVia(out)
+	defer p.dropUnread(out)
+	in := newInboundStreams()
+	defer in.closeAll()
 
 	// Get peer info from table if available, or create minimal entry
+	// If our session to it is being repaired, the peer is evidently
+	// reachable again: retry now rather than wait for the backoff.
 	peerInfo, ok := p.peerTable.Get(hello.SenderID)
-	if ok {
+	if ok && !p.kickRepair(hello.SenderID) {
 		_, _ = p.NewSession(peerInfo)
 	}
 
-	// Loop: handle multiple requests on the same stream.
+	// Loop: handle multiple requests on the same stream, starting with
+	// the one in the HELLO, if any.
+	early := hello.Request
 	for {
-		typ, reqPayload, err := readMsg(stream)
-		if err != nil {
+		typ, reqPayload := msgRequest, early
+		if len(early) > 0 {
+			early = nil
+		} else if typ, reqPayload, err = readMessage(stream, p.maxFrame); err != nil {
+			var tooLarge *frameTooLargeError
+			if errors.As(err, &tooLarge) {
+				p.console.Errorf("[%s] from %s: %v", p.nickname, hello.SenderID, err)
+			}
+			return
+		}
+		// Blocked since the session started: drop it before opening
+		// anything.
+		if p.blockedKey(hello.SenderEdPub) {
+			return
+		}
+		// Revoked since the session started: flag and drop it.
+		if r, ok := p.revokedKeys(hello.SenderKeyID, hello.SenderEdPub); ok {
+			p.console.Errorf("[revoked] the session from %s uses a revoked key: closing it", hello.SenderID)
+			p.auditf(audit.RevokedKey, hello.SenderID, "session with revoked key %x: closed", r.KeyID)
 			return
 		}
+		p.sawPeer(hello.SenderID, false)
 
 		// Handle goodbye message
 		if typ == msgGoodbye {
@@ -95,6 +235,49 @@ func (p *connPool) handleStream(stream network.Stream, receiver *twoway.MultiReq
 			return
 		}
 
+		if typ == msgNotify {
+			if err := p.handleNotify(hello.SenderID, reqPayload, sessionReceiver, out.ratchet); err != nil {
+				p.console.Printf("[%s] %v\n", p.nickname, err)
+				return
+			}
+			continue
+		}
+		if typ == msgTyping {
+			if err := p.handleTyping(hello.SenderID, reqPayload, receiver); err != nil {
+				p.console.Printf("[%s] %v\n", p.nickname, err)
+				return
+			}
+			continue
+		}
+		if typ == msgRoom {
+			if err := p.handleRoomMessage(hello.SenderID, reqPayload); err != nil {
+				p.console.Printf("[%s] %v\n", p.nickname, err)
+				return
+			}
+			continue
+		}
+		if typ == msgFileOffer || typ == msgFileChunk || typ == msgFileResume {
+			if err := p.handleFileFrame(hello.SenderID, typ, reqPayload, receiver); err != nil {
+				p.console.Printf("[%s] %v\n", p.nickname, err)
+				return
+			}
+			continue
+		}
+		if typ == msgStreamOpen || typ == msgStreamData || typ == msgStreamEnd || typ == msgStreamCred {
+			if err := p.streamFrame(hello.SenderID, typ, reqPayload, in, receiver, out); err != nil {
+				p.console.Printf("[%s] %v\n", p.nickname, err)
+				return
+			}
+			continue
+		}
+		if typ == msgChanOpen || typ == msgChanData || typ == msgChanClose || typ == msgChanRekey {
+			if err := p.channelFrame(hello.SenderID, false, typ, reqPayload, out, out.write); err != nil {
+				p.console.Printf("[%s] %v\n", p.nickname, err)
+				return
+			}
+			continue
+		}
+
 		if typ != msgRequest {
 			continue
 		}
@@ -104,54 +287,168 @@ func (p *connPool) handleStream(stream network.Stream, receiver *twoway.MultiReq
 			return
 		}
 
-		if !bytes.Equal(req.RecipientKeyID, p.keyID) {
+		if !p.keyID.Matches(req.RecipientKeyID) {
 			p.console.Printf("[%s] request for keyID=%x (expected %x)\n", p.nickname, req.RecipientKeyID, p.keyID)
 			return
 		}
 
-		reqOpener, err := receiver.NewRequestOpener(req.EncapKey, bytes.NewReader(req.Ciphertext), req.MediaType)
-		if err != nil {
-			p.console.Printf("[%s] NewRequestOpener: %v\n", p.nickname, err)
+		var plain []byte
+		var seal responseSealer
+		if req.MediaType, plain, seal, err = p.openRequest(hello.SenderID, suite, sessionReceiver, out, req); err != nil {
+			p.console.Printf("[%s] %v\n", p.nickname, err)
 			return
 		}
-
-		plain, err := io.ReadAll(reqOpener)
-		if err != nil {
-			p.console.Printf("[%s] read opened request: %v\n", p.nickname, err)
+		if req.MediaType, plain, err = unpadOpened(req.MediaType, plain); err != nil {
+			p.console.Printf("[%s] opened request: %v\n", p.nickname, err)
+			return
+		}
+		if req.MediaType, plain, err = openRatcheted(out.ratchet, req.MediaType, plain); err != nil {
+			p.console.Printf("[%s] opened request: %v\n", p.nickname, err)
 			return
 		}
+		var signed signStatus
+		req.MediaType, plain, signed = openSigned(hello.SenderEdPub, hello.SenderID, p.nickname, req.MediaType, req.MessageID, plain)
+		flag := p.signatureFlag(signed)
+		if signed == msgBadSignature {
+			p.auditf(audit.ForgedSig, hello.SenderID, "message %x: signature does not verify", req.MessageID)
+		}
+
+		// A resent request (same message ID) is answered but not shown again.
+		dup := len(req.MessageID) > 0 && !p.firstSeen(hello.SenderID, req.MessageID)
+
+		// Requests routed by media type are answered, not shown.
+		if h, ok := p.route(string(req.MediaType)); ok {
+			resp, found := p.responseFor(hello.SenderID, req.MessageID)
+			if !dup || !found {
+				var err error
+				if resp, err = p.handleRouted(h, hello, stream.Conn().RemotePeer(), req, plain); err != nil {
+					resp = cachedResponse{mediaType: failedRespMediaType, text: err.Error()}
+				}
+			}
+			if err := out.respondAs(req.RequestID, seal, resp.mediaType, resp.text); err != nil {
+				p.console.Printf("[%s] write response: %v\n", p.nickname, err)
+				return
+			}
+			p.rememberResponse(hello.SenderID, req.MessageID, resp.mediaType, resp.text)
+			continue
+		}
 
 		// Check if this is a broadcast or direct message
 		msgText := string(plain)
-		if after, ok := strings.CutPrefix(msgText, "[BROADCAST]"); ok {
+		after, isBroadcast := strings.CutPrefix(msgText, broadcastPrefix)
+		if string(req.MediaType) == forwardMediaType {
+			if orig, text, ok := parseForward(msgText); ok {
+				msgText = forwardedLine(orig, text)
+			}
+			isBroadcast = false
+		}
+		if dup {
+			// Already shown
+		} else if isBroadcast {
 			// Broadcast message - only add to history, not queue
-			actualMsg := after
-			p.console.AddHistory(fmt.Sprintf("[broadcast from %s] %s", hello.SenderID, actualMsg))
+			actualMsg := flag + after
+			p.showBroadcastFrom(hello.SenderID, actualMsg)
+			p.notifyReceived(receivedMessage{Kind: "broadcast", From: hello.SenderID, Text: actualMsg})
 		} else {
 			// Direct message - add to both queue and history
-			p.console.AddDirectMessage(PeerID(hello.SenderID), msgText)
-		}
-
-		// Auto-respond with "message received" to satisfy protocol
-		reply := "message received"
-
-		respMediaType := []byte("text/plain; purpose=resp")
-		respSealer, err := reqOpener.NewResponseSealer(strings.NewReader(reply), respMediaType)
-		if err != nil {
-			p.console.Printf("[%s] NewResponseSealer: %v\n", p.nickname, err)
-			return
+			p.clearTyping(hello.SenderID)
+			if len(req.MessageID) > 0 {
+				p.rememberReceived(hello.SenderID, req.MessageID, msgText)
+			}
+			p.showDirectFrom(hello.SenderID, flag+msgText)
+			p.notifyReceived(receivedMessage{Kind: "direct", From: hello.SenderID, Text: flag + msgText})
 		}
 
-		respCipher, err := io.ReadAll(respSealer)
-		if err != nil {
-			p.console.Printf("[%s] read response cipher: %v\n", p.nickname, err)
-			return
+		// The Handler answers; interactive direct messages it holds wait
+		// for /reply. A resend takes over the reply held for the first
+		// copy, if any, or gets the response its first copy got.
+		interactive := !isBroadcast && string(req.MediaType) == interactiveReqMediaType
+		held := &heldReply{from: hello.SenderID, messageID: req.MessageID, text: msgText, timeout: req.Timeout, requestID: req.RequestID, seal: seal, out: out}
+		resp := cachedResponse{mediaType: respMediaType, text: ackReply}
+		if dup {
+			if interactive {
+				p.ackDelivered(hello.SenderID, req.RequestID, out)
+				if p.retargetHeld(held) {
+					continue
+				}
+			}
+			if r, ok := p.responseFor(hello.SenderID, req.MessageID); ok {
+				resp = r
+			}
+		} else {
+			var err error
+			resp, err = p.handleRequest(hello, stream.Conn().RemotePeer(), req, plain)
+			if errors.Is(err, ErrHold) && interactive {
+				p.ackDelivered(hello.SenderID, req.RequestID, out)
+				p.holdReply(held)
+				continue
+			}
+			if err != nil {
+				resp = cachedResponse{mediaType: failedRespMediaType, text: err.Error()}
+			}
 		}
-
-		resp := Response{RequestID: req.RequestID, MediaType: respMediaType, Ciphertext: respCipher}
-		if err := writeMsg(stream, msgResponse, encodeResponse(resp)); err != nil {
+		if err := out.respondAs(req.RequestID, seal, resp.mediaType, resp.text); err != nil {
 			p.console.Printf("[%s] write response: %v\n", p.nickname, err)
 			return
 		}
+		p.rememberResponse(hello.SenderID, req.MessageID, resp.mediaType, resp.text)
+	}
+}
+
+// handleNotify opens a one-way message from a peer and shows it. Nothing is
+// written back, and notifies are not passed to onReceive subscribers: the
+// bridges would relay them as direct messages.
+func (p *connPool) handleNotify(from PeerID, payload []byte, receiver *twoway.MultiRequestReceiver, rs *ratchet.Session) error {
+	n, err := decodeNotify(payload)
+	if err != nil {
+		return fmt.Errorf("decode notify: %w", err)
+	}
+	plain, err := p.openNotifyWith(rs, n, receiver)
+	if err != nil {
+		return err
+	}
+
+	switch mt := baseMediaType(n.MediaType); mt {
+	case senderKeyMediaType:
+		return p.acceptSenderKey(from, plain)
+	case topicKeyMediaType:
+		return p.acceptTopicKey(from, plain)
+	case topicKeyRequestMediaType:
+		return p.sendTopicKey(from, plain)
+	case editMediaType, deleteMediaType:
+		return p.applyEdit(from, plain, mt)
+	case reactionMediaType:
+		return p.handleReaction(from, plain)
+	case vouchMediaType:
+		return p.handleVouch(from, plain)
+	}
+	p.console.AddHistory(fmt.Sprintf("[notify from %s] %s", from, plain))
+	return nil
+}
+
+// openNotify opens a sealed one-way payload addressed to us.
+func (p *connPool) openNotify(n Notify, receiver *twoway.MultiRequestReceiver) ([]byte, error) {
+	return p.openNotifyWith(nil, n, receiver)
+}
+
+// openNotifyWith opens a sealed one-way payload addressed to us, with the
+// ratchet rs if it was ratcheted.
+func (p *connPool) openNotifyWith(rs *ratchet.Session, n Notify, receiver *twoway.MultiRequestReceiver) ([]byte, error) {
+	if !p.keyID.Matches(n.RecipientKeyID) {
+		return nil, fmt.Errorf("notify for keyID=%x (expected %x)", n.RecipientKeyID, p.keyID)
+	}
+	opener, err := receiver.NewRequestOpener(n.EncapKey, bytes.NewReader(n.Ciphertext), n.MediaType)
+	if err != nil {
+		return nil, fmt.Errorf("NewRequestOpener: %w", err)
+	}
+	plain, err := io.ReadAll(opener)
+	if err != nil {
+		return nil, fmt.Errorf("read opened notify: %w", err)
+	}
+	mt, plain, err := unpadOpened(n.MediaType, plain)
+	if err != nil {
+		return nil, err
 	}
+	_, plain, err = openRatcheted(rs, mt, plain)
+	return plain, err
 }
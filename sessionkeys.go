@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"github.com/openpcc/twoway"
+	"github.com/pivaldi/tmd/internal/ratchet"
+)
+
+// Requests after the first on a session skip the HPKE KEM, which takes
+// about half of a request's round trip (see BenchmarkSendRequest). The
+// listener says it takes them by offering featureSessionKeys (see
+// features.go). The dialer seals the first request of such a session with
+// twoway as usual, marked with sessionKeysSuffix on its media type; both
+// ends export a secret from the HPKE context of its encapsulation, as
+// channels do (see channels.go), and derive from it, bound to both
+// nicknames, one ChaCha20-Poly1305 key for requests and one for
+// responses. Once the response to that request opened, and so the
+// listener holds the keys too, the dialer seals later requests on the
+// session with the request key alone: no encapsulation, and a ciphertext
+// of u64(n) || the sealed plaintext, n counting from 0, with the media
+// type as additional data. The listener answers them with the response key
+// the same way, with the request's n after the media type, so a response
+// opens for its own request only. Ratchets still seal inside (see
+// ratchets.go); notifies, streams and channels are sealed as before.
+const (
+	sessionKeysContext = "tmd session keys v1"
+	sessionKeysExport  = "tmd session keys v1 exporter"
+	sessionKeysSuffix  = "; keys=1"
+)
+
+// sessionKeys are the request and response keys of a session.
+type sessionKeys struct {
+	req, resp cipher.AEAD
+	next      atomic.Uint64 // the number of the next frame we seal
+}
+
+// newSessionKeys derives the keys of the session from dialer to listener
+// from the secret exported by its first request.
+func newSessionKeys(secret []byte, dialer, listener PeerID) (*sessionKeys, error) {
+	aeads, err := chanKeys(secret, sessionKeysContext+"\x00"+string(dialer)+"\x00"+string(listener), 2)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionKeys{req: aeads[0], resp: aeads[1]}, nil
+}
+
+// seal seals plain with aead as our next frame.
+func (k *sessionKeys) seal(aead cipher.AEAD, plain, ad []byte) (n uint64, sealed []byte) {
+	n = k.next.Add(1) - 1
+	return n, aead.Seal(binary.BigEndian.AppendUint64(nil, n), chanNonce(n), plain, ad)
+}
+
+// openSealed opens a frame sealed with aead, returning its number.
+func openSealed(aead cipher.AEAD, sealed, ad []byte) (uint64, []byte, error) {
+	if len(sealed) < 8 {
+		return 0, nil, errors.New("session-keyed ciphertext too short")
+	}
+	n := binary.BigEndian.Uint64(sealed)
+	plain, err := aead.Open(nil, chanNonce(n), sealed[8:], ad)
+	if err != nil {
+		return 0, nil, errors.New("session-keyed ciphertext does not open")
+	}
+	return n, plain, nil
+}
+
+// respAD is the additional data of the response to request n.
+func respAD(mediaType []byte, n uint64) []byte {
+	return binary.BigEndian.AppendUint64(bytes.Clone(mediaType), n)
+}
+
+// responses returns the sealer of the response to request n.
+func (k *sessionKeys) responses(n uint64) responseSealer {
+	return func(mediaType, text string) ([]byte, error) {
+		_, sealed := k.seal(k.resp, []byte(text), respAD([]byte(mediaType), n))
+		return sealed, nil
+	}
+}
+
+// exportingSuite is the HPKE suite of a twoway sender or receiver for one
+// request, keeping the context of the encapsulation it sets up.
+type exportingSuite struct {
+	twoway.HPKESuite
+	ctx twoway.HPKEExporter
+}
+
+func (s *exportingSuite) NewSender(pub kem.PublicKey, info []byte) (twoway.HPKESender, error) {
+	sender, err := s.HPKESuite.NewSender(pub, info)
+	if err != nil {
+		return nil, err
+	}
+	return exportingSender{sender, s}, nil
+}
+
+func (s *exportingSuite) NewReceiver(priv kem.PrivateKey, info []byte) (twoway.HPKEReceiver, error) {
+	receiver, err := s.HPKESuite.NewReceiver(priv, info)
+	if err != nil {
+		return nil, err
+	}
+	return exportingReceiver{receiver, s}, nil
+}
+
+// secret exports the session secret from the context set up.
+func (s *exportingSuite) secret() ([]byte, error) {
+	if s.ctx == nil {
+		return nil, errors.New("no HPKE context to export the session keys from")
+	}
+	return s.ctx.Export([]byte(sessionKeysExport), chanSecretSize), nil
+}
+
+type exportingSender struct {
+	twoway.HPKESender
+	s *exportingSuite
+}
+
+func (e exportingSender) Setup(rnd io.Reader) ([]byte, twoway.HPKESealer, error) {
+	enc, sealer, err := e.HPKESender.Setup(rnd)
+	if err == nil {
+		e.s.ctx = sealer
+	}
+	return enc, sealer, err
+}
+
+type exportingReceiver struct {
+	twoway.HPKEReceiver
+	s *exportingSuite
+}
+
+func (e exportingReceiver) Setup(enc []byte) (twoway.HPKEOpener, error) {
+	opener, err := e.HPKEReceiver.Setup(enc)
+	if err == nil {
+		e.s.ctx = opener
+	}
+	return opener, err
+}
+
+// sealFor seals a request on ps: with the session's keys once it has
+// them, as the request keying the session if the listener takes session
+// keys and no request keyed it yet, and as sealWith does otherwise.
+func (p *connPool) sealFor(ps *peerSession, to PeerInfo, msg, mediaType string) (Request, twoway.ResponseOpenerFunc, error) {
+	rs := ps.ratchet.Load()
+	if keys := ps.keys.Load(); keys != nil {
+		return p.sealKeyed(keys, rs, to, msg, mediaType)
+	}
+	if !ps.takesKeys || !ps.keying.CompareAndSwap(false, true) {
+		return p.sealWith(ps.suite, rs, to, msg, mediaType)
+	}
+
+	mediaType, msg, err := p.sealable(rs, mediaType, msg)
+	if err != nil {
+		return Request{}, nil, err
+	}
+	es := &exportingSuite{HPKESuite: twoway.AdaptCirclHPKESuite(ps.suite)}
+	req, openResp, err := p.sealTwoway(twoway.NewMultiRequestSenderWithCustomSuite(es, rand.Reader), to, msg, mediaType+sessionKeysSuffix)
+	if err != nil {
+		return Request{}, nil, err
+	}
+	secret, err := es.secret()
+	if err != nil {
+		return Request{}, nil, err
+	}
+	keys, err := newSessionKeys(secret, p.nickname, to.Nickname)
+	if err != nil {
+		return Request{}, nil, err
+	}
+	// The keys are used once the listener showed it holds them.
+	return req, func(ct io.Reader, mediaType []byte, opts ...twoway.Option) (io.Reader, error) {
+		r, err := openResp(ct, mediaType, opts...)
+		if err != nil || r == nil {
+			return r, err
+		}
+		return &onEOF{Reader: r, f: func() { ps.keys.CompareAndSwap(nil, keys) }}, nil
+	}, nil
+}
+
+// sealKeyed seals a request with the session's keys.
+func (p *connPool) sealKeyed(keys *sessionKeys, rs *ratchet.Session, to PeerInfo, msg, mediaType string) (Request, twoway.ResponseOpenerFunc, error) {
+	mediaType, msg, err := p.sealable(rs, mediaType, msg)
+	if err != nil {
+		return Request{}, nil, err
+	}
+	n, sealed := keys.seal(keys.req, []byte(msg), []byte(mediaType))
+	req := Request{RecipientKeyID: to.KeyID, MediaType: []byte(mediaType), Ciphertext: sealed}
+	return req, func(ct io.Reader, mediaType []byte, _ ...twoway.Option) (io.Reader, error) {
+		b, err := io.ReadAll(ct)
+		if err != nil {
+			return nil, err
+		}
+		_, plain, err := openSealed(keys.resp, b, respAD(mediaType, n))
+		if err != nil {
+			return nil, fmt.Errorf("response: %w", err)
+		}
+		return bytes.NewReader(plain), nil
+	}, nil
+}
+
+// openRequest opens a request on a session from "from" with suite, which
+// receiver opens, and returns its media type, its plaintext and the
+// sealer of its response. A request keying the session sets out.keys; a
+// session-keyed request needs them.
+func (p *connPool) openRequest(from PeerID, suite hpke.Suite, receiver *twoway.MultiRequestReceiver, out *responder, req Request) ([]byte, []byte, responseSealer, error) {
+	if len(req.EncapKey) == 0 {
+		if out.keys == nil {
+			return nil, nil, nil, errors.New("session-keyed request before the session was keyed")
+		}
+		n, plain, err := openSealed(out.keys.req, req.Ciphertext, req.MediaType)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return req.MediaType, plain, out.keys.responses(n), nil
+	}
+
+	mediaType, keying := strings.CutSuffix(string(req.MediaType), sessionKeysSuffix)
+	var es *exportingSuite
+	if keying {
+		p.chans.mu.Lock()
+		priv := p.chans.priv
+		p.chans.mu.Unlock()
+		es = &exportingSuite{HPKESuite: twoway.AdaptCirclHPKESuite(suite)}
+		var err error
+		if receiver, err = twoway.NewMultiRequestReceiverWithCustomSuite(es, p.keyID.Short(), priv, rand.Reader); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	opener, err := receiver.NewRequestOpener(req.EncapKey, bytes.NewReader(req.Ciphertext), req.MediaType)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("NewRequestOpener: %w", err)
+	}
+	plain, err := io.ReadAll(opener)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("read opened request: %w", err)
+	}
+	if keying {
+		secret, err := es.secret()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if out.keys, err = newSessionKeys(secret, from, p.nickname); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return []byte(mediaType), plain, twowayResponses(opener), nil
+}
+
+// onEOF calls f once its reader is read to the end without error.
+type onEOF struct {
+	io.Reader
+	f func()
+}
+
+func (r *onEOF) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if err == io.EOF && r.f != nil {
+		r.f()
+		r.f = nil
+	}
+	return n, err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+// TestSessionKeys checks that the response to the first request of a
+// session keys it, and that later requests and their responses go with
+// the session's keys.
+func TestSessionKeys(t *testing.T) {
+	n := newSimNetwork(t)
+	n.tokens["alice"] = "token-alice"
+	n.tokens["bob"] = "token-bob"
+	n.startNode("n1")
+	n.startPeer("alice", []string{"n1"})
+	n.startPeer("bob", []string{"n1"})
+	alice := n.peer("alice")
+	if !alice.console.WaitFor("peer joined: bob", defaultExpectTimeout) {
+		t.Fatalf("no join; alice: %q", alice.console.History())
+	}
+	bob, _ := alice.pool.peerTable.Get("bob")
+
+	if _, err := alice.pool.SendRequest(bob, "first"); err != nil {
+		t.Fatal(err)
+	}
+	ps, ok := alice.pool.GetSession(bob)
+	if !ok || !ps.takesKeys || ps.keys.Load() == nil {
+		t.Fatal("the first response did not key the session")
+	}
+	for _, msg := range []string{"second", "third"} {
+		if _, err := alice.pool.SendRequest(bob, msg); err != nil {
+			t.Fatal(err)
+		}
+		if !n.peer("bob").console.WaitFor("[from alice] "+msg, defaultExpectTimeout) {
+			t.Fatalf("bob did not get %q: %q", msg, n.peer("bob").console.History())
+		}
+	}
+	req, _, err := alice.pool.sealFor(ps, bob, "keyed", reqMediaType)
+	if err != nil || len(req.EncapKey) != 0 {
+		t.Fatalf("sealed with an encapsulation once keyed: %x, %v", req.EncapKey, err)
+	}
+}
+
+// TestSessionKeysBound checks that a session-keyed response opens for its
+// own request only, and that the keys are bound to both nicknames.
+func TestSessionKeysBound(t *testing.T) {
+	secret := make([]byte, chanSecretSize)
+	_, _ = rand.Read(secret)
+	dialer, err := newSessionKeys(secret, "alice", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, _ := newSessionKeys(secret, "alice", "bob")
+	mt := []byte(reqMediaType)
+
+	n, sealed := dialer.seal(dialer.req, []byte("hi"), mt)
+	got, plain, err := openSealed(listener.req, sealed, mt)
+	if err != nil || got != n || string(plain) != "hi" {
+		t.Fatalf("openSealed = %d %q %v", got, plain, err)
+	}
+	if _, _, err := openSealed(listener.req, sealed, []byte(respMediaType)); err == nil {
+		t.Fatal("opened under another media type")
+	}
+	resp, _ := listener.responses(n)(respMediaType, "ok")
+	if _, plain, err := openSealed(dialer.resp, resp, respAD([]byte(respMediaType), n)); err != nil || !bytes.Equal(plain, []byte("ok")) {
+		t.Fatalf("response: %q, %v", plain, err)
+	}
+	if _, _, err := openSealed(dialer.resp, resp, respAD([]byte(respMediaType), n+1)); err == nil {
+		t.Fatal("a response opened for another request")
+	}
+	other, _ := newSessionKeys(secret, "alice", "carol")
+	if _, _, err := openSealed(other.req, sealed, mt); err == nil {
+		t.Fatal("opened with keys for another listener")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+func TestMessageSignatures(t *testing.T) {
+	keys, err := identity.DeriveKeys(bytes.Repeat([]byte{7}, identity.SeedSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPool("alice")
+	p.selfSigner = keys.Ed25519Priv
+	id := []byte("message-id")
+
+	if mt, msg, _ := p.signFor("bob", reqMediaType, "hi", id); mt != reqMediaType || msg != "hi" {
+		t.Fatalf("signed with --sign off: %q %q", mt, msg)
+	}
+	p.setSigning(true)
+	mt, msg, err := p.signFor("bob", reqMediaType, "hi", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(to PeerID, mediaType, messageID, plain []byte) (string, signStatus) {
+		gotType, got, status := openSigned(keys.Ed25519Pub, "alice", to, mediaType, messageID, plain)
+		if string(gotType) != reqMediaType {
+			t.Fatalf("media type %q after opening", gotType)
+		}
+		return string(got), status
+	}
+	if got, status := open("bob", []byte(mt), id, []byte(msg)); status != msgSigned || got != "hi" {
+		t.Fatalf("openSigned = %q, %v", got, status)
+	}
+	tampered := []byte(msg)
+	tampered[0] ^= 1
+	if _, status := open("bob", []byte(mt), id, tampered); status != msgBadSignature {
+		t.Fatal("a changed message verified")
+	}
+	if _, status := open("carol", []byte(mt), id, []byte(msg)); status != msgBadSignature {
+		t.Fatal("a message to bob verified for carol")
+	}
+	if _, status := open("bob", []byte(mt), []byte("other-id"), []byte(msg)); status != msgBadSignature {
+		t.Fatal("a message verified under another message ID")
+	}
+	if _, status := open("bob", []byte(mt), id, []byte("short")); status != msgBadSignature {
+		t.Fatal("a truncated signature verified")
+	}
+	if got, status := open("bob", []byte(reqMediaType), id, []byte("hi")); status != msgUnsigned || got != "hi" {
+		t.Fatalf("unsigned message: %q, %v", got, status)
+	}
+
+	if p.signatureFlag(msgUnsigned) != unsignedFlag || p.signatureFlag(msgBadSignature) != badSignatureFlag || p.signatureFlag(msgSigned) != "" {
+		t.Fatal("wrong flags with --sign")
+	}
+	p.setSigning(false)
+	if p.signatureFlag(msgUnsigned) != "" {
+		t.Fatal("unsigned message flagged without --sign")
+	}
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/openpcc/twoway"
+)
+
+// Streamed requests carry payloads of any size in bounded memory: both
+// ciphertexts are sealed in twoway chunks and sent as they are produced
+// (STREAM_OPEN, STREAM_DATA..., STREAM_END), and the receiver opens them
+// as they arrive. Each direction of a stream is flow controlled: its
+// sender may have streamBacklog STREAM_DATA frames unread by the
+// receiver's reader, which grants more with STREAM_CREDIT frames as it
+// reads, so a slow reader holds up its own stream but not the session.
+// A receiver serves at most maxInboundStreams requests per session at
+// once.
+const (
+	// streamChunkSize is the plaintext size of a sealed chunk, the most
+	// an opener accepts by default.
+	streamChunkSize = 16 << 10
+	// maxInboundStreams bounds the streamed requests served at once on
+	// one session; more are refused.
+	maxInboundStreams = 8
+	// streamBacklog is how many STREAM_DATA frames a stream's sender
+	// may send before its reader grants more.
+	streamBacklog = 64
+	// respStreamMediaType is the media type of streamed responses; the
+	// request's is chosen by the sender.
+	respStreamMediaType = "application/octet-stream; purpose=resp"
+)
+
+func streamOpts() []twoway.Option {
+	return []twoway.Option{twoway.EnableChunking(), twoway.WithMaxChunkPlaintextLen(streamChunkSize)}
+}
+
+// StreamHandler serves a streamed request: it reads the request body and
+// writes the response to resp. Returning an error aborts the response;
+// the error text is sent to the peer in the clear.
+type StreamHandler func(from PeerID, body io.Reader, resp io.Writer) error
+
+// streamHandlers are the handlers registered with onStream, by media type.
+type streamHandlers struct {
+	mu     sync.RWMutex
+	byType map[string]StreamHandler
+}
+
+// onStream serves streamed requests of the given media type with h.
+// Requests of other media types are drained and acknowledged.
+func (p *connPool) onStream(mediaType string, h StreamHandler) {
+	p.streams.mu.Lock()
+	defer p.streams.mu.Unlock()
+	if p.streams.byType == nil {
+		p.streams.byType = make(map[string]StreamHandler)
+	}
+	p.streams.byType[mediaType] = h
+}
+
+func (p *connPool) streamHandler(mediaType string) StreamHandler {
+	p.streams.mu.RLock()
+	defer p.streams.mu.RUnlock()
+	if h, ok := p.streams.byType[mediaType]; ok {
+		return h
+	}
+	return p.drainStream
+}
+
+// drainStream is the handler for media types nobody registered.
+func (p *connPool) drainStream(from PeerID, body io.Reader, resp io.Writer) error {
+	n, err := io.Copy(io.Discard, body)
+	if err != nil {
+		return err
+	}
+	p.console.AddHistory(fmt.Sprintf("[stream from %s] %d bytes", from, n))
+	_, err = io.WriteString(resp, ackReply)
+	return err
+}
+
+// SendStream sends body to a peer as a streamed request and returns the
+// response as it arrives. body is read as the peer consumes it; the
+// response must be closed. Unlike SendRequest, a stream whose session is
+// lost is not resent: body has been consumed by then.
+//
+// Peers that predate streams ignore them, so ctx should bound the wait.
+func (p *connPool) SendStream(ctx context.Context, to PeerInfo, body io.Reader, mediaType string) (io.ReadCloser, error) {
+	if err := p.checkKeys(to); err != nil {
+		return nil, err
+	}
+	if err := p.checkBlocked(to); err != nil {
+		return nil, err
+	}
+
+	sender := twoway.NewMultiRequestSender(p.suite, rand.Reader)
+	sealer, err := sender.NewRequestSealer(ctxReader{ctx, body}, []byte(mediaType), streamOpts()...)
+	if err != nil {
+		return nil, fmt.Errorf("NewRequestSealer: %w", err)
+	}
+	toHPKEPub, err := p.kemScheme.UnmarshalBinaryPublicKey(to.HPKEPub)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal HPKE pub for %s: %w", to.Nickname, err)
+	}
+	encapKey, respOpenFn, err := sealer.EncapsulateKey(to.KeyID.Short(), toHPKEPub)
+	if err != nil {
+		return nil, fmt.Errorf("EncapsulateKey(to=%s): %w", to.Nickname, err)
+	}
+
+	// Nothing of body is read before the STREAM_OPEN is written, so a
+	// session found lost at that point can still be repaired.
+	open := StreamOpen{RecipientKeyID: to.KeyID, EncapKey: encapKey, MediaType: []byte(mediaType)}
+	for attempt := 0; ; attempt++ {
+		psession, err := p.NewSession(to)
+		if err != nil {
+			return nil, fmt.Errorf("connect to %s: %w", to.Nickname, err)
+		}
+		respBody, err := psession.openStream(ctx, open, sealer)
+		if err == nil {
+			return &streamResponse{body: respBody, open: respOpenFn}, nil
+		}
+		if !errors.Is(err, errSessionLost) || attempt == maxResubmits {
+			return nil, err
+		}
+	}
+}
+
+// openStream writes the STREAM_OPEN for a request and starts sending the
+// request ciphertext. It returns the response ciphertext.
+func (ps *peerSession) openStream(ctx context.Context, open StreamOpen, sealer io.Reader) (*io.PipeReader, error) {
+	open.RequestID = atomic.AddUint64(&ps.nextID, 1)
+	pr, pw := io.Pipe()
+	body := newStreamBody(open.RequestID, pw, func(c StreamCredit) error {
+		return ps.send(msgStreamCred, encodeStreamCredit(c))
+	})
+	window := newStreamWindow()
+	ps.pendingMu.Lock()
+	ps.streams[open.RequestID] = body
+	ps.windows[open.RequestID] = window
+	ps.pendingMu.Unlock()
+	go body.feed()
+
+	if err := ps.send(msgStreamOpen, encodeStreamOpen(open)); err != nil {
+		ps.dropStream(open.RequestID, err)
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		pw.CloseWithError(ctx.Err())
+		window.close()
+	})
+	go func() {
+		if err := pumpStream(open.RequestID, sealer, ps.send, window); err != nil {
+			pw.CloseWithError(err)
+		}
+		ps.dropWindow(open.RequestID)
+		// The response outlives ctx once the request is fully sent.
+		stop()
+	}()
+	return pr, nil
+}
+
+// streamFrame hands a STREAM_DATA, STREAM_END or STREAM_CREDIT for one
+// of our requests to its response reader or request sender.
+func (ps *peerSession) streamFrame(typ byte, payload []byte) {
+	switch typ {
+	case msgStreamCred:
+		c, err := decodeStreamCredit(payload)
+		if err != nil {
+			return
+		}
+		ps.pendingMu.Lock()
+		window := ps.windows[c.RequestID]
+		ps.pendingMu.Unlock()
+		if window != nil {
+			window.grant(c.Frames)
+		}
+	case msgStreamEnd:
+		end, err := decodeStreamEnd(payload)
+		if err != nil {
+			return
+		}
+		ps.pendingMu.Lock()
+		body := ps.streams[end.RequestID]
+		delete(ps.streams, end.RequestID)
+		ps.pendingMu.Unlock()
+		if body != nil {
+			body.finish(end)
+		}
+	case msgStreamData:
+		d, err := decodeStreamData(payload)
+		if err != nil {
+			return
+		}
+		ps.pendingMu.Lock()
+		body := ps.streams[d.RequestID]
+		ps.pendingMu.Unlock()
+		if body != nil && !body.push(d.Data) {
+			ps.dropStream(d.RequestID, errStreamBacklog)
+		}
+	}
+}
+
+// dropStream ends the response of one of our streams with err and stops
+// sending its request.
+func (ps *peerSession) dropStream(id uint64, err error) {
+	ps.pendingMu.Lock()
+	body := ps.streams[id]
+	delete(ps.streams, id)
+	ps.pendingMu.Unlock()
+	if body != nil {
+		body.abort(err)
+	}
+	ps.dropWindow(id)
+}
+
+func (ps *peerSession) dropWindow(id uint64) {
+	ps.pendingMu.Lock()
+	window := ps.windows[id]
+	delete(ps.windows, id)
+	ps.pendingMu.Unlock()
+	if window != nil {
+		window.close()
+	}
+}
+
+// streamResponse opens the response ciphertext on first read: the opener
+// reads its nonce up front.
+type streamResponse struct {
+	body *io.PipeReader
+	open twoway.ResponseOpenerFunc
+
+	once sync.Once
+	r    io.Reader
+	err  error
+}
+
+func (s *streamResponse) Read(b []byte) (int, error) {
+	s.once.Do(func() {
+		s.r, s.err = s.open(s.body, []byte(respStreamMediaType), streamOpts()...)
+		if s.err == nil && s.r == nil {
+			// The body ended before the response header; say why.
+			if _, err := s.body.Read(nil); err != nil && err != io.EOF {
+				s.err = err
+			} else {
+				s.err = errors.New("open response stream")
+			}
+		}
+	})
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.r.Read(b)
+}
+
+func (s *streamResponse) Close() error {
+	return s.body.Close()
+}
+
+var (
+	// errStreamBacklog aborts a stream whose sender sent more than its
+	// credit.
+	errStreamBacklog = errors.New("more stream data than credited: stream aborted")
+	// errStreamClosed stops sending a stream that ended on our side.
+	errStreamClosed = errors.New("stream closed")
+)
+
+// streamBody is the receiving end of one direction of a stream. Its
+// frames wait in data until feed writes them to the reader, which grants
+// the sender credit for more as it goes; the session loop never waits
+// for the reader.
+type streamBody struct {
+	id     uint64
+	pw     *io.PipeWriter
+	credit func(StreamCredit) error
+
+	mu   sync.Mutex
+	data chan []byte
+	done bool      // data is closed
+	end  StreamEnd // how the sender ended it; set before data is closed
+}
+
+func newStreamBody(id uint64, pw *io.PipeWriter, credit func(StreamCredit) error) *streamBody {
+	return &streamBody{id: id, pw: pw, credit: credit, data: make(chan []byte, streamBacklog)}
+}
+
+// feed hands the frames of b to its reader, granting credit every half
+// backlog, then ends the reader's body as the STREAM_END said. Frames
+// arriving once the reader is gone are dropped, but still credited so the
+// sender can finish.
+func (b *streamBody) feed() {
+	var read uint32
+	for d := range b.data {
+		_, _ = b.pw.Write(d)
+		if read++; read == streamBacklog/2 {
+			_ = b.credit(StreamCredit{RequestID: b.id, Frames: read})
+			read = 0
+		}
+	}
+	closeStream(b.pw, b.end)
+}
+
+// push queues a frame for the reader. It reports false if the sender
+// went past its credit.
+func (b *streamBody) push(d []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return true
+	}
+	select {
+	case b.data <- d:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish ends b as the sender did, once the frames queued are read.
+func (b *streamBody) finish(end StreamEnd) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return
+	}
+	b.end = end
+	b.done = true
+	close(b.data)
+}
+
+// abort ends the reader's body with err at once.
+func (b *streamBody) abort(err error) {
+	b.pw.CloseWithError(err)
+	b.finish(StreamEnd{})
+}
+
+// streamWindow is the credit left to the sending end of one direction of
+// a stream.
+type streamWindow struct {
+	credit chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newStreamWindow() *streamWindow {
+	w := &streamWindow{credit: make(chan struct{}, streamBacklog), done: make(chan struct{})}
+	w.grant(streamBacklog)
+	return w
+}
+
+// grant adds credit for n frames, up to streamBacklog.
+func (w *streamWindow) grant(n uint32) {
+	for range n {
+		select {
+		case w.credit <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// wait takes the credit for one frame, waiting for the receiver to grant
+// it unless the stream is closed first.
+func (w *streamWindow) wait() error {
+	select {
+	case <-w.done:
+		return errStreamClosed
+	default:
+	}
+	select {
+	case <-w.credit:
+		return nil
+	case <-w.done:
+		return errStreamClosed
+	}
+}
+
+func (w *streamWindow) close() {
+	w.once.Do(func() { close(w.done) })
+}
+
+// inboundStreams are the streamed requests being received on one inbound
+// stream, and the credit left to their responses.
+type inboundStreams struct {
+	slots chan struct{} // one per request being served
+
+	mu      sync.Mutex
+	pending map[uint64]*streamBody
+	windows map[uint64]*streamWindow
+}
+
+func newInboundStreams() *inboundStreams {
+	return &inboundStreams{
+		slots:   make(chan struct{}, maxInboundStreams),
+		pending: make(map[uint64]*streamBody),
+		windows: make(map[uint64]*streamWindow),
+	}
+}
+
+// streamFrame handles a STREAM_OPEN, STREAM_DATA, STREAM_END or
+// STREAM_CREDIT from a peer. Each request is served by its own goroutine,
+// up to maxInboundStreams at once.
+func (p *connPool) streamFrame(from PeerID, typ byte, payload []byte, in *inboundStreams, receiver *twoway.MultiRequestReceiver, out *responder) error {
+	switch typ {
+	case msgStreamOpen:
+		open, err := decodeStreamOpen(payload)
+		if err != nil {
+			return fmt.Errorf("decode stream open: %w", err)
+		}
+		in.mu.Lock()
+		_, dup := in.pending[open.RequestID]
+		in.mu.Unlock()
+		if dup {
+			return fmt.Errorf("stream %d opened twice", open.RequestID)
+		}
+		select {
+		case in.slots <- struct{}{}:
+		default:
+			p.console.Printf("[%s] stream from %s: more than %d at once, refused\n", p.nickname, from, maxInboundStreams)
+			return out.write(msgStreamEnd, encodeStreamEnd(StreamEnd{RequestID: open.RequestID, Error: "too many streams"}))
+		}
+		pr, pw := io.Pipe()
+		body := newStreamBody(open.RequestID, pw, func(c StreamCredit) error {
+			return out.write(msgStreamCred, encodeStreamCredit(c))
+		})
+		window := newStreamWindow()
+		in.mu.Lock()
+		in.pending[open.RequestID] = body
+		in.windows[open.RequestID] = window
+		in.mu.Unlock()
+		go body.feed()
+		go func() {
+			defer func() { <-in.slots }()
+			p.serveStream(from, open, pr, receiver, out, window)
+			in.mu.Lock()
+			delete(in.windows, open.RequestID)
+			in.mu.Unlock()
+		}()
+	case msgStreamData:
+		d, err := decodeStreamData(payload)
+		if err != nil {
+			return fmt.Errorf("decode stream data: %w", err)
+		}
+		in.mu.Lock()
+		body := in.pending[d.RequestID]
+		in.mu.Unlock()
+		if body != nil && !body.push(d.Data) {
+			p.console.Printf("[%s] stream from %s: %v\n", p.nickname, from, errStreamBacklog)
+			in.mu.Lock()
+			delete(in.pending, d.RequestID)
+			in.mu.Unlock()
+			body.abort(errStreamBacklog)
+		}
+	case msgStreamEnd:
+		end, err := decodeStreamEnd(payload)
+		if err != nil {
+			return fmt.Errorf("decode stream end: %w", err)
+		}
+		in.mu.Lock()
+		body := in.pending[end.RequestID]
+		delete(in.pending, end.RequestID)
+		in.mu.Unlock()
+		if body != nil {
+			body.finish(end)
+		}
+	case msgStreamCred:
+		c, err := decodeStreamCredit(payload)
+		if err != nil {
+			return fmt.Errorf("decode stream credit: %w", err)
+		}
+		in.mu.Lock()
+		window := in.windows[c.RequestID]
+		in.mu.Unlock()
+		if window != nil {
+			window.grant(c.Frames)
+		}
+	}
+	return nil
+}
+
+// closeAll aborts the requests still being received, and stops sending
+// their responses, when the inbound stream ends.
+func (in *inboundStreams) closeAll() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for id, body := range in.pending {
+		delete(in.pending, id)
+		body.abort(io.ErrUnexpectedEOF)
+	}
+	for id, window := range in.windows {
+		delete(in.windows, id)
+		window.close()
+	}
+}
+
+// serveStream opens a streamed request, runs its handler and streams the
+// sealed response back.
+func (p *connPool) serveStream(from PeerID, open StreamOpen, body *io.PipeReader, receiver *twoway.MultiRequestReceiver, out *responder, window *streamWindow) {
+	defer func() { _ = body.Close() }()
+
+	fail := func(err error) {
+		p.console.Printf("[%s] stream from %s: %v\n", p.nickname, from, err)
+		_ = out.write(msgStreamEnd, encodeStreamEnd(StreamEnd{RequestID: open.RequestID, Error: "request refused"}))
+	}
+	if !p.keyID.Matches(open.RecipientKeyID) {
+		fail(fmt.Errorf("keyID=%x (expected %x)", open.RecipientKeyID, p.keyID))
+		return
+	}
+	opener, err := receiver.NewRequestOpener(open.EncapKey, body, open.MediaType, streamOpts()...)
+	if err != nil {
+		fail(fmt.Errorf("NewRequestOpener: %w", err))
+		return
+	}
+	respBody, respW := io.Pipe()
+	sealer, err := opener.NewResponseSealer(respBody, []byte(respStreamMediaType), streamOpts()...)
+	if err != nil {
+		fail(fmt.Errorf("NewResponseSealer: %w", err))
+		return
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- pumpStream(open.RequestID, sealer, out.write, window)
+		_ = respBody.Close()
+	}()
+	err = p.streamHandler(string(open.MediaType))(from, opener, respW)
+	_ = body.Close() // drop what the handler left unread
+	if err != nil {
+		respW.CloseWithError(err)
+	} else {
+		_ = respW.Close()
+	}
+	if err := <-sent; err != nil {
+		p.console.Printf("[%s] stream to %s: %v\n", p.nickname, from, err)
+	}
+}
+
+// pumpStream sends what src yields as STREAM_DATA frames, as window
+// allows, then a STREAM_END. A read error is sent in the STREAM_END and
+// returned.
+func pumpStream(id uint64, src io.Reader, write func(typ byte, payload []byte) error, window *streamWindow) error {
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if werr := window.wait(); werr != nil {
+				_ = write(msgStreamEnd, encodeStreamEnd(StreamEnd{RequestID: id, Error: werr.Error()}))
+				return werr
+			}
+			if werr := write(msgStreamData, encodeStreamData(StreamData{RequestID: id, Data: buf[:n]})); werr != nil {
+				return werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return write(msgStreamEnd, encodeStreamEnd(StreamEnd{RequestID: id}))
+		}
+		if err != nil {
+			_ = write(msgStreamEnd, encodeStreamEnd(StreamEnd{RequestID: id, Error: err.Error()}))
+			return err
+		}
+	}
+}
+
+// closeStream ends the ciphertext of a stream as STREAM_END says.
+func closeStream(pw *io.PipeWriter, end StreamEnd) {
+	if end.Error != "" {
+		pw.CloseWithError(fmt.Errorf("stream aborted by peer: %s", end.Error))
+		return
+	}
+	_ = pw.Close()
+}
+
+// ctxReader stops reading once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
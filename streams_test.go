@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// streamPeers starts alice and bob on one node and returns bob as alice
+// sees him.
+func streamPeers(t *testing.T) (*simNetwork, PeerInfo) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("needs loopback networking")
+	}
+	n := newSimNetwork(t)
+	n.tokens["alice"] = "token-alice"
+	n.tokens["bob"] = "token-bob"
+	n.startNode("n1")
+	n.startPeer("alice", []string{"n1"})
+	n.startPeer("bob", []string{"n1"})
+	if !n.peer("alice").console.WaitFor("peer joined: bob", defaultExpectTimeout) {
+		t.Fatal("alice never saw bob")
+	}
+	to, _ := n.peer("alice").pool.peerTable.Get("bob")
+	return n, to
+}
+
+// patternReader yields n bytes without holding them.
+type patternReader struct{ left int64 }
+
+func (r *patternReader) Read(b []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > r.left {
+		b = b[:r.left]
+	}
+	for i := range b {
+		b[i] = byte(r.left - int64(i))
+	}
+	r.left -= int64(len(b))
+	return len(b), nil
+}
+
+func TestSendStreamLargePayload(t *testing.T) {
+	n, to := streamPeers(t)
+	const mediaType = "application/octet-stream; purpose=digest"
+	n.peer("bob").pool.onStream(mediaType, func(from PeerID, body io.Reader, resp io.Writer) error {
+		h := sha256.New()
+		if _, err := io.Copy(h, body); err != nil {
+			return err
+		}
+		_, err := io.WriteString(resp, hex.EncodeToString(h.Sum(nil)))
+		return err
+	})
+
+	// Larger than any single message may be.
+	size := int64(maxMessageSize + 3*streamChunkSize + 5)
+	want := sha256.New()
+	_, _ = io.Copy(want, &patternReader{left: size})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 4*defaultExpectTimeout)
+	defer cancel()
+	resp, err := n.peer("alice").pool.SendStream(ctx, to, &patternReader{left: size}, mediaType)
+	if err != nil {
+		t.Fatalf("SendStream: %v", err)
+	}
+	defer func() { _ = resp.Close() }()
+	got, err := io.ReadAll(resp)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if string(got) != hex.EncodeToString(want.Sum(nil)) {
+		t.Fatalf("bob hashed %s", got)
+	}
+}
+
+func TestSendStreamDefaultAndAbort(t *testing.T) {
+	n, to := streamPeers(t)
+	alice, bob := n.peer("alice"), n.peer("bob")
+	ctx := context.Background()
+
+	// Unregistered media types are drained and acknowledged.
+	resp, err := alice.pool.SendStream(ctx, to, strings.NewReader("some bytes"), "application/x-unknown")
+	if err != nil {
+		t.Fatalf("SendStream: %v", err)
+	}
+	got, err := io.ReadAll(resp)
+	_ = resp.Close()
+	if err != nil || string(got) != ackReply {
+		t.Fatalf("response = %q, %v", got, err)
+	}
+	if !bob.console.WaitFor("[stream from alice] 10 bytes", defaultExpectTimeout) {
+		t.Fatal("bob never logged the stream")
+	}
+
+	// A handler error aborts the response.
+	bob.pool.onStream("text/plain", func(from PeerID, body io.Reader, resp io.Writer) error {
+		_, _ = io.WriteString(resp, "partial")
+		return errors.New("out of space")
+	})
+	resp, err = alice.pool.SendStream(ctx, to, strings.NewReader("hello"), "text/plain")
+	if err != nil {
+		t.Fatalf("SendStream: %v", err)
+	}
+	_, err = io.ReadAll(resp)
+	_ = resp.Close()
+	if err == nil || !strings.Contains(err.Error(), "out of space") {
+		t.Fatalf("aborted response: %v", err)
+	}
+
+	// The session still carries ordinary requests.
+	if reply, err := alice.pool.SendRequest(to, "still there?"); err != nil || reply != ackReply {
+		t.Fatalf("SendRequest after streams = %q, %v", reply, err)
+	}
+}
+
+// TestSendStreamLimits checks that a handler not reading its request, a
+// response nobody reads, or more streams than a session serves at once do
+// not hold up the session.
+func TestSendStreamLimits(t *testing.T) {
+	n, to := streamPeers(t)
+	alice, bob := n.peer("alice"), n.peer("bob")
+	ctx := context.Background()
+	const size = (streamBacklog + 8) * streamChunkSize
+
+	release := make(chan struct{})
+	bob.pool.onStream("application/x-stuck", func(from PeerID, body io.Reader, resp io.Writer) error {
+		<-release
+		n, err := io.Copy(io.Discard, body)
+		_, _ = fmt.Fprintf(resp, "%d", n)
+		return err
+	})
+	resp, err := alice.pool.SendStream(ctx, to, &patternReader{left: size}, "application/x-stuck")
+	if err != nil {
+		t.Fatalf("SendStream: %v", err)
+	}
+	if reply, err := alice.pool.SendRequest(to, "still there?"); err != nil || reply != ackReply {
+		t.Fatalf("SendRequest past a stuck handler = %q, %v", reply, err)
+	}
+	close(release)
+	got, err := io.ReadAll(resp)
+	_ = resp.Close()
+	if err != nil || string(got) != fmt.Sprint(size) {
+		t.Fatalf("response of the stuck stream = %q, %v", got, err)
+	}
+
+	bob.pool.onStream("application/x-big", func(from PeerID, body io.Reader, resp io.Writer) error {
+		_, err := io.Copy(resp, &patternReader{left: size})
+		return err
+	})
+	resp, err = alice.pool.SendStream(ctx, to, strings.NewReader("x"), "application/x-big")
+	if err != nil {
+		t.Fatalf("SendStream: %v", err)
+	}
+	if reply, err := alice.pool.SendRequest(to, "still there?"); err != nil || reply != ackReply {
+		t.Fatalf("SendRequest past an unread response = %q, %v", reply, err)
+	}
+	n64, err := io.Copy(io.Discard, resp)
+	_ = resp.Close()
+	if err != nil || n64 != size {
+		t.Fatalf("unread response = %d bytes, %v", n64, err)
+	}
+
+	hold := make(chan struct{})
+	defer close(hold)
+	bob.pool.onStream("application/x-hold", func(from PeerID, body io.Reader, resp io.Writer) error {
+		<-hold
+		return nil
+	})
+	for range maxInboundStreams {
+		resp, err := alice.pool.SendStream(ctx, to, strings.NewReader("x"), "application/x-hold")
+		if err != nil {
+			t.Fatalf("SendStream: %v", err)
+		}
+		defer func() { _ = resp.Close() }()
+	}
+	resp, err = alice.pool.SendStream(ctx, to, strings.NewReader("x"), "application/x-hold")
+	if err != nil {
+		t.Fatalf("SendStream: %v", err)
+	}
+	_, err = io.ReadAll(resp)
+	_ = resp.Close()
+	if err == nil || !strings.Contains(err.Error(), "too many streams") {
+		t.Fatalf("stream past the limit: %v", err)
+	}
+	if reply, err := alice.pool.SendRequest(to, "still there?"); err != nil || reply != ackReply {
+		t.Fatalf("SendRequest past the stream limit = %q, %v", reply, err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// The HPKE suite sealing requests, their responses and notifies on a
+// session is negotiated in the handshake. The listener appends the suites
+// it supports to its CHALLENGE, strongest first; the dialer takes the first
+// of its own suites that the listener supports, and lists its suites in
+// its HELLO. The HELLO signature covers both lists, so a listener sees if
+// either was changed on the way, and a listener that offered suites
+// refuses a HELLO without them: a dialer only leaves them out for a
+// listener that offered none. Keys are X25519, so suites differ in their
+// KDF and AEAD only.
+//
+// Sessions with listeners predating suites, mail held by the nodes, file
+// transfers, streams, typing notices and channels use the pool's default
+// suite (p.suite).
+//
+// With --addressbook, /suite requires one suite with a peer, e.g. the
+// strongest with one correspondent and the default with the others; the
+// book keeps it. Sessions we dial to the peer then list only that suite,
+// and fail if the peer does not offer it. Sessions the peer dials that
+// negotiate another suite are refused, since both sides pick the same one
+// from the lists: requests to the peer then go over a session we dial.
+// Mail to the peer is refused unless its suite is the default one.
+
+// supportedSuites are the suites we offer, strongest first; the last is
+// the default.
+var supportedSuites = []hpke.Suite{
+	hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA512, hpke.AEAD_AES256GCM),
+	hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_ChaCha20Poly1305),
+	hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM),
+}
+
+// suiteNames names the supported suites for /suite, in the same order.
+var suiteNames = []string{
+	"x25519-sha512-aes256gcm",
+	"x25519-sha256-chacha20poly1305",
+	"x25519-sha256-aes128gcm",
+}
+
+// suiteName returns the name of a supported suite.
+func suiteName(s hpke.Suite) string {
+	if i := slices.Index(supportedSuites, s); i >= 0 {
+		return suiteNames[i]
+	}
+	return "unknown suite"
+}
+
+// parseSuite returns the supported suite named name.
+func parseSuite(name string) (hpke.Suite, error) {
+	i := slices.Index(suiteNames, name)
+	if i < 0 {
+		return hpke.Suite{}, fmt.Errorf("unknown HPKE suite %q (known: %s)", name, strings.Join(suiteNames, ", "))
+	}
+	return supportedSuites[i], nil
+}
+
+// pickSuite returns the first suite of offer that supported has.
+func pickSuite(offer, supported []hpke.Suite) (hpke.Suite, bool) {
+	for _, s := range offer {
+		for _, t := range supported {
+			if s == t {
+				return s, true
+			}
+		}
+	}
+	return hpke.Suite{}, false
+}
+
+// dialerSuite returns the suite of a session we dial to to, given the
+// suites the listener offered in its CHALLENGE, and the suites to list in
+// our HELLO.
+func (p *connPool) dialerSuite(to PeerID, offered []hpke.Suite) (hpke.Suite, []hpke.Suite, error) {
+	only, ok, err := p.peerSuite(to)
+	switch {
+	case err != nil:
+		return hpke.Suite{}, nil, err
+	case ok && (len(offered) == 0 || len(p.suites) == 0) && only != p.suite:
+		return hpke.Suite{}, nil, fmt.Errorf("%s predates suite negotiation: %s unavailable", to, suiteName(only))
+	case ok && len(offered) > 0 && len(p.suites) > 0:
+		if !slices.Contains(offered, only) {
+			return hpke.Suite{}, nil, fmt.Errorf("%s does not offer HPKE suite %s", to, suiteName(only))
+		}
+		return only, []hpke.Suite{only}, nil
+	}
+	if len(offered) == 0 || len(p.suites) == 0 {
+		return p.suite, nil, nil
+	}
+	s, ok := pickSuite(p.suites, offered)
+	if !ok {
+		return hpke.Suite{}, nil, errors.New("no HPKE suite in common")
+	}
+	return s, p.suites, nil
+}
+
+// listenerSuite returns the suite of a session we accept, from the suites
+// a verified HELLO lists.
+func (p *connPool) listenerSuite(hello Hello) (hpke.Suite, error) {
+	if len(p.suites) == 0 {
+		return p.suite, nil
+	}
+	if len(hello.Suites) == 0 {
+		if p.legacyHellos {
+			return p.suite, nil
+		}
+		return hpke.Suite{}, errHelloNoSuites
+	}
+	offer, err := decodeSuites(hello.Suites)
+	if err != nil {
+		return hpke.Suite{}, err
+	}
+	s, ok := pickSuite(offer, p.suites)
+	if !ok {
+		return hpke.Suite{}, errors.New("no HPKE suite in common")
+	}
+	return s, nil
+}
+
+// errHelloNoSuites refuses a HELLO without suites when we offered some.
+var errHelloNoSuites = errors.New("HELLO lists no HPKE suites: suites offered were dropped (see --legacy-hellos)")
+
+// errHelloUnbound refuses a HELLO without the binding we offered.
+var errHelloUnbound = errors.New("HELLO is not bound to the connection: the binding offered was dropped (see --legacy-hellos)")
+
+// setLegacyHellos accepts the HELLOs of dialers predating suites or
+// bindings, when we offered them: over the bare challenge, or unbound.
+func (p *connPool) setLegacyHellos(on bool) {
+	p.legacyHellos = on
+}
+
+// helloTranscript returns what the HELLO of a session we accept must have
+// signed: the CHALLENGE payload, with the suites we offered, when it lists
+// suites, bound to the connection when it sets featureBinding (see
+// binding.go). A HELLO without suites signs the bare challenge. When we
+// offered suites, and so the binding, a HELLO without suites or without
+// the binding is refused as a downgrade, unless legacy HELLOs are
+// accepted; a HELLO whose binding cannot be computed is refused.
+func (p *connPool) helloTranscript(stream network.Stream, chal, chalPayload []byte, hello Hello) ([]byte, error) {
+	offered := len(p.suites) > 0
+	switch {
+	case len(hello.Suites) == 0:
+		if offered && !p.legacyHellos {
+			return nil, errHelloNoSuites
+		}
+		return chal, nil
+	case hello.Features&featureBinding == 0:
+		if offered && !p.legacyHellos {
+			return nil, errHelloUnbound
+		}
+		return chalPayload, nil
+	}
+	// Bound to the suite the HELLO picks: another suite breaks it.
+	suite, err := p.listenerSuite(hello)
+	if err != nil {
+		return nil, fmt.Errorf("cannot bind HELLO: %w", err)
+	}
+	return append(slices.Clip(chalPayload), channelBinding(stream.Conn().RemotePeer(), p.host.ID(), stream.Protocol(), suite)...), nil
+}
+
+// peerSuite returns the suite required with peer, if any.
+func (p *connPool) peerSuite(peer PeerID) (hpke.Suite, bool, error) {
+	if p.book == nil {
+		return hpke.Suite{}, false, nil
+	}
+	e, ok := p.book.Get(string(peer))
+	if !ok || e.Suite == "" {
+		return hpke.Suite{}, false, nil
+	}
+	s, err := parseSuite(e.Suite)
+	if err != nil {
+		return hpke.Suite{}, false, fmt.Errorf("address book: %s: %w", peer, err)
+	}
+	return s, true, nil
+}
+
+// checkPeerSuite refuses to use suite with peer when another one is
+// required with it: for sessions peer dialed, and for mail.
+func (p *connPool) checkPeerSuite(peer PeerID, suite hpke.Suite) error {
+	only, ok, err := p.peerSuite(peer)
+	switch {
+	case err != nil:
+		return err
+	case ok && suite != only:
+		return fmt.Errorf("HPKE suite %s required with %s, not %s (see /suite)", suiteName(only), peer, suiteName(suite))
+	}
+	return nil
+}
+
+// runSuite handles "/suite [peer [name|default]]": the suites, the suite
+// required with a peer, or setting it.
+func runSuite(c Console, pool *connPool, args string) {
+	name, suite, _ := strings.Cut(args, " ")
+	suite = strings.TrimSpace(suite)
+	if name == "" {
+		for i, n := range suiteNames {
+			mark := ""
+			if supportedSuites[i] == pool.suite {
+				mark = " (default)"
+			}
+			c.Printf("[suite] %s%s", n, mark)
+		}
+		return
+	}
+	if pool.book == nil {
+		c.Errorf("no address book (see --addressbook)")
+		return
+	}
+	if suite == "" {
+		only, ok, err := pool.peerSuite(PeerID(name))
+		switch {
+		case err != nil:
+			c.Errorf("suite: %v", err)
+		case ok:
+			c.Printf("[suite] %s: %s", name, suiteName(only))
+		default:
+			c.Printf("[suite] %s: negotiated", name)
+		}
+		return
+	}
+	if suite == "default" {
+		suite = ""
+	} else if _, err := parseSuite(suite); err != nil {
+		c.Errorf("suite: %v", err)
+		return
+	}
+	if err := pool.book.SetSuite(name, suite); err != nil {
+		c.Errorf("suite: %v", err)
+		return
+	}
+	// The next session negotiates again.
+	if _, ok := pool.GetSession(PeerInfo{Nickname: PeerID(name)}); ok {
+		pool.RemoveSession(PeerID(name))
+	}
+	if suite == "" {
+		c.Printf("[suite] %s: negotiated", name)
+		return
+	}
+	c.Printf("[suite] %s: %s", name, suite)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudflare/circl/hpke"
+
+	"github.com/pivaldi/tmd/internal/addrbook"
+	"github.com/pivaldi/tmd/internal/conformance"
+)
+
+func TestSuiteNegotiation(t *testing.T) {
+	strongest, chacha, fallback := supportedSuites[0], supportedSuites[1], supportedSuites[2]
+	p := newTestPool("alice")
+
+	if s, offer, err := p.dialerSuite("bob", supportedSuites); err != nil || s != strongest || len(offer) != len(supportedSuites) {
+		t.Fatalf("dialerSuite(all) = %v %v %v", s, offer, err)
+	}
+	if s, _, err := p.dialerSuite("bob", []hpke.Suite{fallback, chacha}); err != nil || s != chacha {
+		t.Fatalf("dialerSuite picked %v, %v; want ours first", s, err)
+	}
+	// A listener predating suites: the default, and nothing to list.
+	if s, offer, err := p.dialerSuite("bob", nil); err != nil || s != p.suite || offer != nil {
+		t.Fatalf("dialerSuite(nil) = %v %v %v", s, offer, err)
+	}
+
+	hello := Hello{Suites: encodeSuites([]hpke.Suite{chacha, fallback})}
+	if s, err := p.listenerSuite(hello); err != nil || s != chacha {
+		t.Fatalf("listenerSuite = %v, %v", s, err)
+	}
+	if _, err := p.listenerSuite(Hello{}); err == nil {
+		t.Fatal("a HELLO without suites was accepted after offering some")
+	}
+	chal := []byte("challenge")
+	if _, err := p.helloTranscript(nil, chal, nil, Hello{}); err == nil {
+		t.Fatal("a HELLO without suites was verified after offering some")
+	}
+	p.setLegacyHellos(true)
+	if signed, err := p.helloTranscript(nil, chal, nil, Hello{}); err != nil || string(signed) != string(chal) {
+		t.Fatalf("legacy HELLO transcript = %q, %v", signed, err)
+	}
+	if s, err := p.listenerSuite(Hello{}); err != nil || s != p.suite {
+		t.Fatalf("legacy listenerSuite = %v, %v", s, err)
+	}
+	p.setLegacyHellos(false)
+	p.suites = []hpke.Suite{strongest}
+	if _, err := p.listenerSuite(hello); err == nil {
+		t.Fatal("a suite in common was found where there is none")
+	}
+}
+
+// TestPeerSuite checks that a suite required with a peer is the only one
+// dialed sessions offer it, and that other suites are refused.
+func TestPeerSuite(t *testing.T) {
+	strongest, chacha := supportedSuites[0], supportedSuites[1]
+	book, err := addrbook.Open(filepath.Join(t.TempDir(), "book"), conformance.Hex(aliceSeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := book.Put(addrbook.Entry{Nickname: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	c := newHeadlessConsole()
+	p := newTestPool("alice")
+	p.setConsole(c)
+	p.setAddressBook(book)
+
+	runSuite(c, p, "bob rot13")
+	if _, ok, _ := p.peerSuite("bob"); ok {
+		t.Fatal("an unknown suite was required")
+	}
+	runSuite(c, p, "bob x25519-sha256-chacha20poly1305")
+	if s, offer, err := p.dialerSuite("bob", supportedSuites); err != nil || s != chacha || len(offer) != 1 || offer[0] != chacha {
+		t.Fatalf("dialerSuite(bob) = %v %v %v", s, offer, err)
+	}
+	if _, _, err := p.dialerSuite("bob", []hpke.Suite{strongest}); err == nil {
+		t.Fatal("dialed bob without the suite required")
+	}
+	if _, _, err := p.dialerSuite("bob", nil); err == nil {
+		t.Fatal("dialed bob with the default suite")
+	}
+	if s, _, err := p.dialerSuite("carol", supportedSuites); err != nil || s != strongest {
+		t.Fatalf("dialerSuite(carol) = %v, %v", s, err)
+	}
+	if err := p.checkPeerSuite("bob", strongest); err == nil {
+		t.Fatal("a session bob dialed with another suite was accepted")
+	}
+	if err := p.checkPeerSuite("bob", chacha); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := book.Get("bob"); e.Suite != "x25519-sha256-chacha20poly1305" {
+		t.Fatalf("book entry suite = %q", e.Suite)
+	}
+
+	runSuite(c, p, "bob default")
+	if _, ok, _ := p.peerSuite("bob"); ok {
+		t.Fatal("/suite bob default kept the suite")
+	}
+}
+
+func TestDecodeSuitesSkipsUnknown(t *testing.T) {
+	b := encodeSuites(supportedSuites[:1])
+	b = append(b, 0x00, 0x20, 0x00, 0x01, 0x99, 0x99) // an AEAD we do not know
+	suites, err := decodeSuites(b)
+	if err != nil || len(suites) != 1 || suites[0] != supportedSuites[0] {
+		t.Fatalf("decodeSuites = %v, %v", suites, err)
+	}
+	if _, err := decodeSuites(b[:5]); err == nil {
+		t.Fatal("a truncated suite was accepted")
+	}
+	if _, _, _, _, err := decodeChallenge(append(make([]byte, 36), 1)); err == nil {
+		t.Fatal("a challenge with a truncated suite list was accepted")
+	}
+}
+
+// TestSuiteDowngradeDetected checks that the HELLO signature covers the
+// suites both sides offered.
+func TestSuiteDowngradeDetected(t *testing.T) {
+	chal := make([]byte, 32)
+	_, _ = rand.Read(chal)
+	sent := encodeChallenge(chal, defaultMaxFrame, supportedSuites, 0)
+	// On the way, the strong suites are dropped from the listener's offer.
+	received := encodeChallenge(chal, defaultMaxFrame, supportedSuites[2:], 0)
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	h := Hello{SenderID: "alice", SenderKeyID: make([]byte, KeyIDSize), SenderEdPub: pub, SenderHPKEPub: make([]byte, 32),
+		MaxFrame: defaultMaxFrame, Suites: encodeSuites(supportedSuites)}
+	h.Signature = ed25519.Sign(priv, helloSignInput(received, h))
+	dec, err := decodeHello(encodeHello(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySignedHello(nil, received, dec); err != nil {
+		t.Fatalf("untouched HELLO rejected: %v", err)
+	}
+	if err := verifySignedHello(nil, sent, dec); err == nil {
+		t.Fatal("a HELLO answering a changed suite offer verified")
+	}
+
+	// Or dropped from the dialer's list.
+	dec.Suites = encodeSuites(supportedSuites[2:])
+	if err := verifySignedHello(nil, received, dec); err == nil {
+		t.Fatal("a HELLO with a changed suite list verified")
+	}
+}
@@ -0,0 +1,90 @@
+// Package testvectors publishes the tmd conformance vectors for other
+// implementations and for fuzzers.
+//
+// Each suite covers one protocol: "wire" for /tmd/msg/1.0.0 between peers,
+// "node" for /tmd/node/1.0.0 between a peer and a node. A suite lists
+// vectors (inputs and the framed message tmd encodes from them, which an
+// implementation must encode and decode alike), handshake transcripts,
+// the Hello signatures with the exact bytes they cover, and framed
+// messages decoders must refuse. Binary fields and frames are hex; frames
+// are u32(len(type+payload)) || type || payload.
+//
+// The vectors are the ones tmd's own tests check its encoders against,
+// so they change only with the formats.
+package testvectors
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pivaldi/tmd/internal/conformance"
+)
+
+type (
+	// Suite is the set of vectors of one protocol.
+	Suite = conformance.Suite
+	// Vector is a message encoded from its inputs.
+	Vector = conformance.Vector
+	// Transcript is a dialer/listener exchange replayable from its
+	// inputs with deterministic randomness.
+	Transcript = conformance.Transcript
+	// Step is one framed message of a transcript.
+	Step = conformance.Step
+	// Signature is a signature in a vector with the bytes it covers.
+	Signature = conformance.Signature
+	// Reject is a framed message decoders must refuse.
+	Reject = conformance.Reject
+)
+
+// Names returns the names of the suites.
+func Names() []string {
+	return conformance.Names()
+}
+
+// Load returns the suite with the given name.
+func Load(name string) (*Suite, error) {
+	return conformance.Load(name)
+}
+
+// Emit writes the suite with the given name to w as indented JSON.
+func Emit(w io.Writer, name string) error {
+	s, err := Load(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// Corpus returns every frame of the suite with the given name, vectors,
+// transcript steps and rejects, as a seed corpus for fuzzers.
+func Corpus(name string) ([][]byte, error) {
+	s, err := Load(name)
+	if err != nil {
+		return nil, err
+	}
+	var frames []string
+	for _, v := range s.Vectors {
+		frames = append(frames, v.Frame)
+	}
+	for _, tr := range s.Transcripts {
+		for _, st := range tr.Steps {
+			frames = append(frames, st.Frame)
+		}
+	}
+	for _, r := range s.Rejects {
+		frames = append(frames, r.Frame)
+	}
+	corpus := make([][]byte, 0, len(frames))
+	for _, f := range frames {
+		b, err := hex.DecodeString(f)
+		if err != nil {
+			return nil, fmt.Errorf("suite %s: %w", name, err)
+		}
+		corpus = append(corpus, b)
+	}
+	return corpus, nil
+}
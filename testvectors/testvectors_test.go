@@ -0,0 +1,59 @@
+package testvectors
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+// TestSignatures checks the signature vectors the way a third party
+// would: with crypto/ed25519 alone.
+func TestSignatures(t *testing.T) {
+	s, err := Load("wire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Signatures) == 0 {
+		t.Fatal("no signature vectors")
+	}
+	for _, sig := range s.Signatures {
+		input, err1 := hex.DecodeString(sig.Input)
+		pub, err2 := hex.DecodeString(sig.PublicKey)
+		signature, err3 := hex.DecodeString(sig.Signature)
+		if err1 != nil || err2 != nil || err3 != nil || len(pub) != ed25519.PublicKeySize {
+			t.Fatalf("%s %s: bad hex", sig.Vector, sig.Field)
+		}
+		if !ed25519.Verify(pub, input, signature) {
+			t.Fatalf("%s %s: signature does not verify", sig.Vector, sig.Field)
+		}
+	}
+}
+
+func TestCorpusAndEmit(t *testing.T) {
+	for _, name := range Names() {
+		corpus, err := Corpus(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(corpus) == 0 {
+			t.Fatalf("%s: empty corpus", name)
+		}
+		for _, f := range corpus {
+			if len(f) < 5 || int(binary.BigEndian.Uint32(f)) != len(f)-4 {
+				t.Fatalf("%s: bad frame %x", name, f)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := Emit(&buf, name); err != nil {
+			t.Fatal(err)
+		}
+		var s Suite
+		if err := json.Unmarshal(buf.Bytes(), &s); err != nil || len(s.Vectors) == 0 {
+			t.Fatalf("%s: emitted %d vectors, %v", name, len(s.Vectors), err)
+		}
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"maps"
+	mrand "math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Topics (--gossip) are named channels carried by libp2p gossipsub: a
+// message is published once and the mesh of subscribers passes it on, so
+// the sender does not open a session per receiver. Like room messages,
+// topic messages are encrypted once under a sender key of the publisher's
+// for that topic, with the topic, the publisher's nickname and the key
+// generation as additional data. Gossipsub signs each message with the
+// publisher's libp2p key; the receiver maps that peer ID to a nickname in
+// its peer table and drops messages from peers it does not know or
+// blocked. Sender keys are not pushed: a subscriber that gets a message
+// under a key it lacks holds it and asks the publisher for the key in a
+// sealed notify, and the publisher answers, sealed to that peer, if it is
+// subscribed. Any peer of the group may thus read a topic it subscribes
+// to; peers outside it, and the other libp2p peers relaying the topic,
+// only see ciphertext.
+//
+// With --gossip every peer also subscribes to broadcastTopic, and
+// Broadcast to gossipBroadcastMin peers or more publishes there once
+// instead of sending a request to each peer. Gossiped broadcasts are not
+// acknowledged or retried.
+
+const (
+	// topicKeyMediaType marks notifies carrying a topic sender key, and
+	// topicKeyRequestMediaType notifies asking for one.
+	topicKeyMediaType        = "application/x-tmd-topic-key"
+	topicKeyRequestMediaType = "application/x-tmd-topic-key-request"
+
+	// topicPrefix prefixes topic names on gossipsub.
+	topicPrefix = "tmd/topic/"
+	// broadcastTopic carries broadcasts; it is not a valid topic name.
+	broadcastTopic = "*"
+
+	// gossipBroadcastMin is the default number of peers from which
+	// broadcasts go on broadcastTopic (see --gossip-min).
+	gossipBroadcastMin = 8
+	// gossipDegree is the number of subscribers of a topic we try to be
+	// connected to; fillMesh dials peers of the table until then, every
+	// gossipMeshInterval.
+	gossipDegree       = 6
+	gossipMeshInterval = 5 * time.Second
+
+	// maxHeldTopicMessages bounds the messages held per publisher while
+	// its key is asked for; the oldest go first.
+	maxHeldTopicMessages = 32
+	maxTopicNameLen      = 64
+)
+
+type topic struct {
+	t      *pubsub.Topic
+	sub    *pubsub.Subscription
+	cancel context.CancelFunc
+
+	own    senderKey
+	sealed rekeyCount // under own (see rekey.go)
+
+	// Keys of the publishers: the latest generation asked for and the
+	// one before, for messages sent just before a change.
+	keys  map[PeerID][]senderKey
+	asked map[PeerID]uint32        // the generation last asked for
+	held  map[PeerID][]RoomMessage // waiting for their publisher's key
+}
+
+// topicState holds the topics subscribed with /sub.
+type topicState struct {
+	mu           sync.Mutex
+	ps           *pubsub.PubSub // nil unless --gossip
+	ctx          context.Context
+	topics       map[string]*topic
+	broadcastMin int
+}
+
+// setGossipBroadcastMin sets the number of peers from which broadcasts go
+// on gossipsub.
+func (p *connPool) setGossipBroadcastMin(n int) {
+	p.topics.mu.Lock()
+	defer p.topics.mu.Unlock()
+	p.topics.broadcastMin = n
+}
+
+// startGossip runs gossipsub on the host and subscribes to broadcastTopic
+// until the returned func is called. Our own messages go to every
+// subscriber we are connected to, not only to those of the mesh, which
+// takes up new subscribers at its next heartbeat.
+func (p *connPool) startGossip() (func(), error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ps, err := pubsub.NewGossipSub(ctx, p.host, pubsub.WithMessageSignaturePolicy(pubsub.StrictSign), pubsub.WithFloodPublish(true))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("gossipsub: %w", err)
+	}
+	p.topics.mu.Lock()
+	p.topics.ps, p.topics.ctx = ps, ctx
+	if p.topics.broadcastMin == 0 {
+		p.topics.broadcastMin = gossipBroadcastMin
+	}
+	p.topics.mu.Unlock()
+	if err := p.Subscribe(broadcastTopic); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go func() {
+		t := time.NewTicker(gossipMeshInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				p.fillMesh(ctx)
+			}
+		}
+	}()
+	return cancel, nil
+}
+
+// validTopic reports whether name is a topic name: letters, digits, '-',
+// '_' and '.', up to maxTopicNameLen.
+func validTopic(name string) bool {
+	if name == "" || len(name) > maxTopicNameLen {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscribe subscribes to the topic name.
+func (p *connPool) Subscribe(name string) error {
+	p.topics.mu.Lock()
+	defer p.topics.mu.Unlock()
+	if p.topics.ps == nil {
+		return errors.New("topics need --gossip")
+	}
+	if _, ok := p.topics.topics[name]; ok {
+		return nil
+	}
+	t, err := p.topics.ps.Join(topicPrefix + name)
+	if err != nil {
+		return err
+	}
+	sub, err := t.Subscribe()
+	if err != nil {
+		_ = t.Close()
+		return err
+	}
+	if p.topics.topics == nil {
+		p.topics.topics = make(map[string]*topic)
+	}
+	ctx, cancel := context.WithCancel(p.topics.ctx)
+	p.topics.topics[name] = &topic{
+		t: t, sub: sub, cancel: cancel,
+		own:   newSenderKey(1),
+		keys:  make(map[PeerID][]senderKey),
+		asked: make(map[PeerID]uint32),
+		held:  make(map[PeerID][]RoomMessage),
+	}
+
+	go p.readTopic(ctx, name, sub)
+	go p.fillMesh(ctx)
+	return nil
+}
+
+// Unsubscribe leaves the topic name and forgets its keys.
+func (p *connPool) Unsubscribe(name string) error {
+	p.topics.mu.Lock()
+	defer p.topics.mu.Unlock()
+	tp, ok := p.topics.topics[name]
+	if !ok || name == broadcastTopic {
+		return fmt.Errorf("not subscribed to %s", name)
+	}
+	delete(p.topics.topics, name)
+	tp.cancel()
+	tp.sub.Cancel()
+	return tp.t.Close()
+}
+
+// Topics lists the subscribed topics, without broadcastTopic, and the
+// peers of the group each is known to have among our connections.
+func (p *connPool) Topics() map[string][]PeerID {
+	p.topics.mu.Lock()
+	defer p.topics.mu.Unlock()
+	out := make(map[string][]PeerID)
+	for name, tp := range p.topics.topics {
+		if name == broadcastTopic {
+			continue
+		}
+		var subs []PeerID
+		for _, id := range tp.t.ListPeers() {
+			if info, ok := p.peerTable.ByPeerID(id); ok {
+				subs = append(subs, info.Nickname)
+			}
+		}
+		out[name] = subs
+	}
+	return out
+}
+
+// Publish encrypts msg once under our sender key for name and publishes
+// it on the topic.
+func (p *connPool) Publish(name, msg string) error {
+	p.topics.mu.Lock()
+	tp, ok := p.topics.topics[name]
+	if !ok {
+		p.topics.mu.Unlock()
+		return fmt.Errorf("not subscribed to %s (use /sub %s)", name, name)
+	}
+	if p.rekey.due(tp.sealed, len(msg)) {
+		tp.own = newSenderKey(tp.own.gen + 1)
+		tp.sealed = rekeyCount{}
+	}
+	tp.sealed.add(len(msg))
+	key, ctx := tp.own, p.topics.ctx
+	p.topics.mu.Unlock()
+
+	aead, err := chacha20poly1305.NewX(key.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	m := RoomMessage{Room: name, Gen: key.gen, Nonce: nonce}
+	m.Ciphertext = aead.Seal(nil, nonce, []byte(msg), topicAD(name, p.nickname, key.gen))
+	return tp.t.Publish(ctx, encodeRoomMessage(m))
+}
+
+// broadcastViaTopic publishes msg on broadcastTopic. It reports false,
+// publishing nothing, without --gossip or to fewer peers than the
+// broadcast minimum.
+func (p *connPool) broadcastViaTopic(msg string, peers []PeerInfo) ([]BroadcastResult, bool) {
+	p.topics.mu.Lock()
+	_, ok := p.topics.topics[broadcastTopic]
+	min := p.topics.broadcastMin
+	p.topics.mu.Unlock()
+	if !ok || len(peers) < min {
+		return nil, false
+	}
+	if err := p.Publish(broadcastTopic, msg); err != nil {
+		p.console.Errorf("[gossip] %v; sending to each peer", err)
+		return nil, false
+	}
+	results := make([]BroadcastResult, len(peers))
+	for i, to := range peers {
+		results[i] = BroadcastResult{Peer: to.Nickname, Gossiped: true}
+	}
+	return results, true
+}
+
+// readTopic passes the messages of a subscription to handleTopicMessage
+// until ctx is done.
+func (p *connPool) readTopic(ctx context.Context, name string, sub *pubsub.Subscription) {
+	for {
+		m, err := sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		if m.GetFrom() == p.host.ID() {
+			continue
+		}
+		if err := p.handleTopicMessage(name, m.GetFrom(), m.Data); err != nil {
+			p.console.Errorf("[gossip] %s: %v", name, err)
+		}
+	}
+}
+
+// handleTopicMessage opens a message published on name by the libp2p peer
+// id and shows it, or holds it and asks for the publisher's key.
+func (p *connPool) handleTopicMessage(name string, id peer.ID, data []byte) error {
+	from, ok := p.peerTable.ByPeerID(id)
+	if !ok || p.checkBlocked(from) != nil {
+		return nil // not of the group, or blocked
+	}
+	m, err := decodeRoomMessage(data)
+	if err != nil {
+		return fmt.Errorf("decode message from %s: %w", from.Nickname, err)
+	}
+	if m.Room != name {
+		return fmt.Errorf("message from %s for topic %q", from.Nickname, m.Room)
+	}
+
+	p.topics.mu.Lock()
+	tp, ok := p.topics.topics[name]
+	if !ok {
+		p.topics.mu.Unlock()
+		return nil // unsubscribed meanwhile
+	}
+	key := topicKey(tp.keys[from.Nickname], m.Gen)
+	ask := false
+	if key == nil {
+		held := append(tp.held[from.Nickname], m)
+		if len(held) > maxHeldTopicMessages {
+			held = held[len(held)-maxHeldTopicMessages:]
+		}
+		tp.held[from.Nickname] = held
+		if tp.asked[from.Nickname] != m.Gen {
+			tp.asked[from.Nickname] = m.Gen
+			ask = true
+		}
+	}
+	p.topics.mu.Unlock()
+
+	if key != nil {
+		return p.openTopicMessage(from.Nickname, key, m)
+	}
+	if ask {
+		go func() {
+			if err := p.sendNotify(from, name, topicKeyRequestMediaType); err != nil {
+				p.console.Errorf("[gossip] %s: ask %s for its key: %v", name, from.Nickname, err)
+				p.topics.mu.Lock()
+				delete(tp.asked, from.Nickname) // ask again with the next message
+				p.topics.mu.Unlock()
+			}
+		}()
+	}
+	return nil
+}
+
+// topicKey returns the key of generation gen among keys, or nil.
+func topicKey(keys []senderKey, gen uint32) []byte {
+	for _, k := range keys {
+		if k.gen == gen {
+			return k.key
+		}
+	}
+	return nil
+}
+
+// openTopicMessage opens a topic message from a publisher and shows it,
+// as a broadcast for broadcastTopic. Like room messages, topic messages
+// are not passed to onReceive subscribers; gossiped broadcasts are.
+func (p *connPool) openTopicMessage(from PeerID, key []byte, m RoomMessage) error {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	if len(m.Nonce) != aead.NonceSize() {
+		return fmt.Errorf("message from %s: bad nonce", from)
+	}
+	plain, err := aead.Open(nil, m.Nonce, m.Ciphertext, topicAD(m.Room, from, m.Gen))
+	if err != nil {
+		return fmt.Errorf("cannot decrypt message from %s", from)
+	}
+	if m.Room == broadcastTopic {
+		p.showBroadcastFrom(from, string(plain))
+		p.notifyReceived(receivedMessage{Kind: "broadcast", From: from, Text: string(plain)})
+		return nil
+	}
+	if !p.Muted(from) {
+		p.console.AddHistory(fmt.Sprintf("[topic %s] %s: %s", m.Room, from, plain))
+	}
+	return nil
+}
+
+// sendTopicKey answers a peer asking for our key for a topic we are
+// subscribed to.
+func (p *connPool) sendTopicKey(from PeerID, name []byte) error {
+	p.topics.mu.Lock()
+	tp, ok := p.topics.topics[string(name)]
+	var key senderKey
+	if ok {
+		key = tp.own
+	}
+	p.topics.mu.Unlock()
+	to, known := p.peerTable.Get(from)
+	if !ok || !known {
+		return nil
+	}
+	go func() {
+		if err := p.sendNotify(to, string(encodeSenderKey(string(name), key)), topicKeyMediaType); err != nil {
+			p.console.Errorf("[gossip] %s: key for %s: %v", name, from, err)
+		}
+	}()
+	return nil
+}
+
+// acceptTopicKey stores a topic key received from a publisher and opens
+// the messages held for it.
+func (p *connPool) acceptTopicKey(from PeerID, payload []byte) error {
+	name, key, err := decodeSenderKey(payload)
+	if err != nil {
+		return err
+	}
+	p.topics.mu.Lock()
+	tp, ok := p.topics.topics[name]
+	if !ok {
+		p.topics.mu.Unlock()
+		return nil // unsubscribed meanwhile
+	}
+	keys := append(tp.keys[from], key)
+	if len(keys) > 2 {
+		keys = keys[len(keys)-2:]
+	}
+	tp.keys[from] = keys
+	var ready []RoomMessage
+	tp.held[from] = slices.DeleteFunc(tp.held[from], func(m RoomMessage) bool {
+		if m.Gen == key.gen {
+			ready = append(ready, m)
+			return true
+		}
+		return false
+	})
+	p.topics.mu.Unlock()
+
+	var errs []error
+	for _, m := range ready {
+		errs = append(errs, p.openTopicMessage(from, key.key, m))
+	}
+	return errors.Join(errs...)
+}
+
+// fillMesh dials up to gossipDegree peers of the table we are not
+// connected to when a topic has fewer subscribers among our connections,
+// so that gossipsub finds them.
+func (p *connPool) fillMesh(ctx context.Context) {
+	p.topics.mu.Lock()
+	short := false
+	for _, tp := range p.topics.topics {
+		short = short || len(tp.t.ListPeers()) < gossipDegree
+	}
+	p.topics.mu.Unlock()
+	if !short {
+		return
+	}
+
+	var candidates []PeerInfo
+	for _, info := range p.peerTable.All() {
+		if info.Nickname != p.nickname && p.host.Network().Connectedness(info.PeerID) != network.Connected && p.checkBlocked(info) == nil {
+			candidates = append(candidates, info)
+		}
+	}
+	mrand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	var wg sync.WaitGroup
+	for _, info := range candidates[:min(len(candidates), gossipDegree)] {
+		wg.Go(func() {
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			_ = p.host.Connect(ctx, peer.AddrInfo{ID: info.PeerID, Addrs: info.Addrs})
+		})
+	}
+	wg.Wait()
+}
+
+// fillMeshSoon runs fillMesh in the background, with --gossip; it is
+// called when a peer joins.
+func (p *connPool) fillMeshSoon() {
+	p.topics.mu.Lock()
+	ctx := p.topics.ctx
+	p.topics.mu.Unlock()
+	if ctx != nil {
+		go p.fillMesh(ctx)
+	}
+}
+
+// topicAD binds a topic message to its topic, publisher and key
+// generation; it differs from roomAD so that neither kind of message
+// passes for the other.
+func topicAD(name string, from PeerID, gen uint32) []byte {
+	var b bytes.Buffer
+	_ = writeBlob(&b, []byte("tmd topic v1"))
+	b.Write(roomAD(name, from, gen))
+	return b.Bytes()
+}
+
+// runTopicCommand handles /sub, /unsub, /topics and /pub.
+func runTopicCommand(c Console, pool *connPool, cmd, args string) {
+	args = strings.TrimSpace(args)
+	switch cmd {
+	case "/sub":
+		if !validTopic(args) {
+			c.Errorf("usage: /sub topic (letters, digits, - _ .)")
+			return
+		}
+		if err := pool.Subscribe(args); err != nil {
+			c.Errorf("%v", err)
+			return
+		}
+		c.Printf("[topic %s] subscribed", args)
+	case "/unsub":
+		if err := pool.Unsubscribe(args); err != nil {
+			c.Errorf("%v", err)
+			return
+		}
+		c.Printf("[topic %s] unsubscribed", args)
+	case "/topics":
+		topics := pool.Topics()
+		if len(topics) == 0 {
+			c.Printf("No topics subscribed")
+			return
+		}
+		for _, name := range slices.Sorted(maps.Keys(topics)) {
+			c.Printf("%s: %d peers connected (%s)", name, len(topics[name]), strings.Join(peerNames(topics[name]), ", "))
+		}
+	case "/pub":
+		name, msg, ok := splitFirstWord(args)
+		if !ok || !validTopic(name) {
+			c.Errorf("usage: /pub topic <message>")
+			return
+		}
+		if err := pool.Publish(name, msg); err != nil {
+			c.Errorf("%v", err)
+			return
+		}
+		c.Printf("[topic %s] %s: %s", name, pool.nickname, msg)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/pivaldi/tmd/internal/identity"
+	"github.com/pivaldi/tmd/internal/p2p"
+)
+
+// gossiping starts gossipsub on a simulated peer.
+func gossiping(n *simNetwork, p *connPool) error {
+	stop, err := p.startGossip()
+	if err != nil {
+		return err
+	}
+	n.t.Cleanup(stop)
+	return nil
+}
+
+// waitTopicPeers waits until a and b see each other among the
+// subscribers of name. A publisher sends a message to the subscribers it
+// knows of, on the stream it announced its own subscriptions on, so
+// either may then publish to the other.
+func waitTopicPeers(t *testing.T, name string, a, b *simPeer) {
+	t.Helper()
+	sees := func(p, other *simPeer) bool {
+		p.pool.topics.mu.Lock()
+		defer p.pool.topics.mu.Unlock()
+		tp, ok := p.pool.topics.topics[name]
+		return ok && slices.Contains(tp.t.ListPeers(), other.host.ID())
+	}
+	deadline := time.Now().Add(defaultExpectTimeout)
+	for time.Now().Before(deadline) {
+		if sees(a, b) && sees(b, a) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("%s and %s do not see each other on %s", a.nickname, b.nickname, name)
+}
+
+// TestTopics checks that a message published once on a topic reaches the
+// other subscribers, who ask for the publisher's key, and that a libp2p
+// peer outside the group relaying the topic sees only ciphertext.
+func TestTopics(t *testing.T) {
+	if testing.Short() {
+		t.Skip("needs loopback networking")
+	}
+	n := newSimNetwork(t)
+	n.startNode("n1")
+	for _, nick := range []string{"alice", "bob", "carol"} {
+		n.tokens[nick] = "token-" + nick
+		n.setups[nick] = append(n.setups[nick], gossiping)
+		n.startPeer(nick, []string{"n1"})
+	}
+	alice := n.peer("alice")
+	for _, nick := range []string{"bob", "carol"} {
+		if !alice.console.WaitFor("peer joined: "+nick, defaultExpectTimeout) {
+			t.Fatalf("no join of %s; alice: %q", nick, alice.console.History())
+		}
+		if err := n.peer(nick).pool.Subscribe("news"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alice.pool.Subscribe("news"); err != nil {
+		t.Fatal(err)
+	}
+
+	// eve runs gossipsub on the topic, but is no peer of the group.
+	seed, _ := identity.GenerateSeed()
+	keys, _ := identity.DeriveKeys(seed)
+	eh, err := p2p.NewHost(keys.Libp2pPriv, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = eh.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	eps, err := pubsub.NewGossipSub(ctx, eh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	et, _ := eps.Join(topicPrefix + "news")
+	esub, err := et.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := eh.Connect(ctx, peer.AddrInfo{ID: alice.host.ID(), Addrs: alice.host.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, nick := range []string{"bob", "carol"} {
+		waitTopicPeers(t, "news", alice, n.peer(nick))
+	}
+	eve := &simPeer{nickname: "eve", host: eh, pool: &connPool{}}
+	eve.pool.topics.topics = map[string]*topic{"news": {t: et}}
+	waitTopicPeers(t, "news", alice, eve)
+	if err := alice.pool.Publish("news", "hello subscribers"); err != nil {
+		t.Fatal(err)
+	}
+	for _, nick := range []string{"bob", "carol"} {
+		if !n.peer(nick).console.WaitFor("[topic news] alice: hello subscribers", defaultExpectTimeout) {
+			t.Fatalf("%s: %q", nick, n.peer(nick).console.History())
+		}
+	}
+	got, err := esub.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(got.Data, []byte("hello subscribers")) {
+		t.Fatal("the topic carried the plaintext")
+	}
+	if err := et.Publish(ctx, got.Data); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.peer("bob").pool.Publish("news", "second"); err != nil {
+		t.Fatal(err)
+	}
+	if !alice.console.WaitFor("[topic news] bob: second", defaultExpectTimeout) {
+		t.Fatalf("alice: %q", alice.console.History())
+	}
+	for _, line := range alice.console.History() {
+		if strings.Contains(line, "[error]") {
+			t.Fatalf("alice: %q", alice.console.History())
+		}
+	}
+}
+
+// TestBroadcastGossiped checks that a broadcast to at least the broadcast
+// minimum of peers is published once on gossipsub.
+func TestBroadcastGossiped(t *testing.T) {
+	if testing.Short() {
+		t.Skip("needs loopback networking")
+	}
+	n := newSimNetwork(t)
+	n.startNode("n1")
+	for _, nick := range []string{"alice", "bob", "carol"} {
+		n.tokens[nick] = "token-" + nick
+		n.setups[nick] = append(n.setups[nick], gossiping)
+		n.startPeer(nick, []string{"n1"})
+	}
+	alice := n.peer("alice")
+	for _, nick := range []string{"bob", "carol"} {
+		if !alice.console.WaitFor("peer joined: "+nick, defaultExpectTimeout) {
+			t.Fatalf("no join of %s; alice: %q", nick, alice.console.History())
+		}
+	}
+	for _, nick := range []string{"bob", "carol"} {
+		waitTopicPeers(t, broadcastTopic, alice, n.peer(nick))
+	}
+
+	if results := alice.pool.Broadcast("below the minimum"); len(results) != 2 || results[0].Gossiped {
+		t.Fatalf("results = %+v", results)
+	}
+	alice.pool.setGossipBroadcastMin(2)
+	results := alice.pool.Broadcast("over gossip")
+	if len(results) != 2 || !results[0].Gossiped || !results[1].Gossiped || broadcastErr(results) != nil {
+		t.Fatalf("results = %+v", results)
+	}
+	for _, nick := range []string{"bob", "carol"} {
+		if !n.peer(nick).console.WaitFor("[broadcast from alice] over gossip", defaultExpectTimeout) {
+			t.Fatalf("%s: %q", nick, n.peer(nick).console.History())
+		}
+	}
+	// Now that they hold alice's key, the next one opens at once.
+	alice.pool.Broadcast("again")
+	for _, nick := range []string{"bob", "carol"} {
+		if !n.peer(nick).console.WaitFor("[broadcast from alice] again", defaultExpectTimeout) {
+			t.Fatalf("%s: %q", nick, n.peer(nick).console.History())
+		}
+	}
+}
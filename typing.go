@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openpcc/twoway"
+)
+
+// Typing signals tell a peer that a message to it is being composed. Each
+// is an empty notify sealed like any other, so it reveals nothing but its
+// timing, and goes in its own TYPING frame, which older peers ignore.
+const (
+	typingMediaType = "text/plain; purpose=typing"
+	// typingInterval is the least time between two signals to a peer.
+	typingInterval = 3 * time.Second
+	// typingTimeout is how long a signal is shown.
+	typingTimeout = 6 * time.Second
+)
+
+// typingState throttles the signals we send and expires the ones shown.
+type typingState struct {
+	mu    sync.Mutex
+	sent  map[PeerID]time.Time
+	shown map[PeerID]*time.Timer
+}
+
+// composingTo returns the peer a partly typed input line is addressed to:
+// "@peer text" or "/reply peer text", once some text follows the name.
+func composingTo(line string) (PeerID, bool) {
+	if rest, ok := strings.CutPrefix(line, "/reply "); ok {
+		line = rest
+	} else if rest, ok := strings.CutPrefix(line, "@"); ok {
+		line = rest
+	} else {
+		return "", false
+	}
+	peer, text, ok := strings.Cut(line, " ")
+	peer, _, _ = strings.Cut(peer, "#")
+	if !ok || peer == "" || strings.TrimSpace(text) == "" {
+		return "", false
+	}
+	return PeerID(peer), true
+}
+
+// sendTyping signals a peer that we are typing to it, at most once every
+// typingInterval. Unknown peers are ignored.
+func (p *connPool) sendTyping(to PeerID) {
+	info, ok := p.peerTable.Get(to)
+	if !ok || to == p.nickname {
+		return
+	}
+	p.typing.mu.Lock()
+	if time.Since(p.typing.sent[to]) < typingInterval {
+		p.typing.mu.Unlock()
+		return
+	}
+	if p.typing.sent == nil {
+		p.typing.sent = make(map[PeerID]time.Time)
+	}
+	p.typing.sent[to] = time.Now()
+	p.typing.mu.Unlock()
+
+	n, err := p.sealNotify(info, "", typingMediaType)
+	if err != nil {
+		return
+	}
+	_ = p.sendOneWay(info, msgTyping, encodeNotify(n))
+}
+
+// handleTyping shows a peer's typing signal in the status area, unless
+// the peer is muted.
+func (p *connPool) handleTyping(from PeerID, payload []byte, receiver *twoway.MultiRequestReceiver) error {
+	n, err := decodeNotify(payload)
+	if err != nil {
+		return fmt.Errorf("decode typing: %w", err)
+	}
+	if _, err := p.openNotify(n, receiver); err != nil {
+		return err
+	}
+	if baseMediaType(n.MediaType) != typingMediaType || p.Muted(from) {
+		return nil
+	}
+
+	p.typing.mu.Lock()
+	defer p.typing.mu.Unlock()
+	if p.typing.shown == nil {
+		p.typing.shown = make(map[PeerID]*time.Timer)
+	}
+	if t, ok := p.typing.shown[from]; ok {
+		t.Stop()
+	}
+	p.typing.shown[from] = time.AfterFunc(typingTimeout, func() { p.clearTyping(from) })
+	p.setStatus(typingKey(from), fmt.Sprintf("%s is typing", from))
+	return nil
+}
+
+// clearTyping removes a peer's typing signal, when it expires or when the
+// peer's message arrives.
+func (p *connPool) clearTyping(from PeerID) {
+	p.typing.mu.Lock()
+	t, ok := p.typing.shown[from]
+	delete(p.typing.shown, from)
+	p.typing.mu.Unlock()
+	if ok {
+		t.Stop()
+		p.setStatus(typingKey(from), "")
+	}
+}
+
+func typingKey(from PeerID) string {
+	return "typing " + string(from)
+}
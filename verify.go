@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/pins"
+)
+
+// With --pins, each peer is in one of four states: verified (its pinned
+// keys were checked by the user, with /fingerprint then /verify), vouched
+// (enough verified peers vouched for its pinned keys, see vouches.go),
+// tofu (pinned on first contact, not checked) or unknown (not pinned, or
+// presenting keys other than its pin). With --requests, a tofu peer the
+// user did not accept yet is untrusted instead (see requests.go). Consoles show them next to the
+// peer's name; with --confirm-unverified, a direct message to a peer that
+// is neither verified nor vouched is only sent once typed twice.
+const (
+	peerVerified = "verified"
+	peerVouched  = "vouched"
+	peerTOFU     = "tofu"
+	peerUnknown  = "unknown"
+)
+
+// verifyConsole is implemented by consoles that show next to a peer's
+// name whether its keys are verified.
+type verifyConsole interface {
+	// SetPeerTrust shows trust (peerVerified, peerVouched, peerTOFU,
+	// peerUntrusted or peerUnknown) next to peer; empty clears it.
+	SetPeerTrust(peer PeerID, trust string)
+}
+
+// trustBadge is what consoles show after a peer's name for trust.
+func trustBadge(trust string) string {
+	switch trust {
+	case peerVerified:
+		return "✓"
+	case peerVouched:
+		return "≈"
+	case peerTOFU:
+		return "~"
+	case peerUntrusted:
+		return "…"
+	case peerUnknown:
+		return "?"
+	}
+	return ""
+}
+
+// withTrustBadge adds the badge of the peer a history line is from or to
+// after its name in the line's label, e.g. "[from bob ✓] hi".
+func withTrustBadge(text string, trust func(PeerID) string) string {
+	end := strings.Index(text, "] ")
+	if !strings.HasPrefix(text, "[") || end < 0 {
+		return text
+	}
+	label := text[1:end]
+	var peer string
+	switch {
+	case strings.HasPrefix(label, "from "):
+		peer = strings.TrimPrefix(label, "from ")
+	case strings.HasPrefix(label, "broadcast from "):
+		peer = strings.TrimPrefix(label, "broadcast from ")
+	case strings.Contains(label, " to "):
+		peer = label[strings.LastIndex(label, " to ")+len(" to "):]
+	default:
+		return text
+	}
+	badge := trustBadge(trust(PeerID(peer)))
+	if badge == "" {
+		return text
+	}
+	return text[:end] + " " + badge + text[end:]
+}
+
+// verifyState holds direct messages to unverified peers awaiting
+// confirmation (--confirm-unverified).
+type verifyState struct {
+	mu      sync.Mutex
+	confirm bool
+	held    map[PeerID]string // peer -> message typed once
+}
+
+// setConfirmUnverified makes direct messages to peers that are not
+// verified wait until typed again.
+func (p *connPool) setConfirmUnverified(on bool) {
+	p.verify.mu.Lock()
+	p.verify.confirm = on
+	p.verify.mu.Unlock()
+}
+
+// trustOf is the state of a peer whose keys checked as status against pin.
+func (p *connPool) trustOf(status pins.Status, pin pins.Pin) string {
+	switch {
+	case status != pins.Match:
+		return peerUnknown
+	case !pin.Verified.IsZero():
+		return peerVerified
+	case p.pinned.Vouches(pin) >= p.vouchThreshold:
+		return peerVouched
+	case pin.Accepted.IsZero() && p.requestsOn():
+		return peerUntrusted
+	}
+	return peerTOFU
+}
+
+// peerTrust returns the state of a peer, or "" without --pins.
+func (p *connPool) peerTrust(info PeerInfo) string {
+	if p.pinned == nil {
+		return ""
+	}
+	key, err := identityKey(info)
+	if err != nil {
+		return peerUnknown
+	}
+	return p.trustOf(p.pinned.Check(string(info.Nickname), key, info.HPKEPub))
+}
+
+// showPeerTrust passes the state of a peer to the console.
+func (p *connPool) showPeerTrust(peer PeerID, trust string) {
+	p.rememberTrust(peer, trust)
+	if trust != "" && trust != peerUntrusted && trust != peerUnknown {
+		p.releaseRequests(peer)
+	}
+	if c, ok := p.console.(verifyConsole); ok {
+		c.SetPeerTrust(peer, trust)
+	}
+}
+
+// holdUnverified reports whether a direct message to a peer neither
+// verified nor vouched must wait for confirmation. The same message to the same peer
+// again is the confirmation.
+func (p *connPool) holdUnverified(to PeerInfo, msg string) bool {
+	p.verify.mu.Lock()
+	defer p.verify.mu.Unlock()
+	if trust := p.peerTrust(to); !p.verify.confirm || p.pinned == nil || trust == peerVerified || trust == peerVouched {
+		return false
+	}
+	if p.verify.held[to.Nickname] == msg {
+		delete(p.verify.held, to.Nickname)
+		return false
+	}
+	if p.verify.held == nil {
+		p.verify.held = make(map[PeerID]string)
+	}
+	p.verify.held[to.Nickname] = msg
+	return true
+}
+
+// verifyPeer marks the pin of a peer as verified by the user. An online
+// peer must present its pinned keys.
+func (p *connPool) verifyPeer(nickname PeerID) (pins.Pin, error) {
+	if p.pinned == nil {
+		return pins.Pin{}, errors.New("no pin store (see --pins)")
+	}
+	if info, online := p.peerTable.Get(nickname); online && p.pinStatus(info) == pins.Changed {
+		return pins.Pin{}, fmt.Errorf("%s presents keys other than its pinned ones (see /repin)", nickname)
+	}
+	pin, ok, err := p.pinned.Verify(string(nickname))
+	if err != nil {
+		return pins.Pin{}, err
+	}
+	if !ok {
+		return pins.Pin{}, fmt.Errorf("%s has no pinned keys yet", nickname)
+	}
+	p.showPeerTrust(nickname, peerVerified)
+	return pin, nil
+}
+
+// runVerify handles "/verify peer".
+func runVerify(c Console, pool *connPool, args string) {
+	nickname := PeerID(strings.TrimPrefix(strings.TrimSpace(args), "@"))
+	if nickname == "" {
+		c.Errorf("usage: /verify <peer>")
+		return
+	}
+	pin, err := pool.verifyPeer(nickname)
+	if err != nil {
+		c.Errorf("verify: %v", err)
+		return
+	}
+	c.Printf("[verify] %s is verified: keys pinned on %s", nickname, pin.Pinned.Local().Format(time.DateOnly))
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestWithTrustBadge(t *testing.T) {
+	trust := func(peer PeerID) string {
+		return map[PeerID]string{"bob": peerVerified, "carol": peerTOFU, "dave": peerUnknown, "erin": peerVouched}[peer]
+	}
+	for in, want := range map[string]string{
+		"[from bob] hi":              "[from bob ✓] hi",
+		"[broadcast from carol] hey": "[broadcast from carol ~] hey",
+		"[alice to dave] who?":       "[alice to dave ?] who?",
+		"[from erin] hi":             "[from erin ≈] hi",
+		"[from frank] hi":            "[from frank] hi",
+		"[node] peer joined: bob":    "[node] peer joined: bob",
+		"plain line":                 "plain line",
+	} {
+		if got := withTrustBadge(in, trust); got != want {
+			t.Errorf("withTrustBadge(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/audit"
+	"github.com/pivaldi/tmd/internal/pins"
+)
+
+// A vouch tells a peer the keys we verified for another: /vouch sends it,
+// signed with our identity key, as a sealed notify. With --pins, a vouch
+// counts only from a peer we verified ourselves. Once vouchThreshold
+// verified peers vouched for the same keys of a peer not pinned yet, they
+// are pinned, so they no longer come from the discovery node alone, and
+// that peer is vouched (see verify.go); so is a pinned peer once as many
+// vouched for its pinned keys. A vouch for keys other than the pinned
+// ones is reported, never applied.
+const (
+	vouchMediaType        = "application/x-tmd-vouch"
+	vouchSignContext      = "tmd vouch v1"
+	defaultVouchThreshold = 2
+)
+
+// vouch is an opened vouch statement.
+type vouch struct {
+	Subject PeerID
+	EdPub   ed25519.PublicKey
+	HPKEPub []byte
+	At      time.Time
+}
+
+// Signed vouch layout: blob(subject nickname) || blob(Ed25519 key) ||
+// blob(HPKE key) || blob(u64 unix seconds) || blob(signature). The
+// signature covers "tmd vouch v1" || 0 || voucher nickname || 0 || the
+// four field blobs.
+func vouchFields(v vouch) []byte {
+	var b bytes.Buffer
+	_ = writeBlob(&b, []byte(v.Subject))
+	_ = writeBlob(&b, v.EdPub)
+	_ = writeBlob(&b, v.HPKEPub)
+	_ = writeBlob(&b, binary.BigEndian.AppendUint64(nil, uint64(v.At.Unix())))
+	return b.Bytes()
+}
+
+func vouchSignInput(voucher PeerID, fields []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(vouchSignContext)
+	b.WriteByte(0)
+	b.WriteString(string(voucher))
+	b.WriteByte(0)
+	b.Write(fields)
+	return b.Bytes()
+}
+
+// signVouch encodes v, vouched by voucher and signed with priv.
+func signVouch(voucher PeerID, priv crypto.Signer, v vouch) ([]byte, error) {
+	fields := vouchFields(v)
+	sig, err := priv.Sign(nil, vouchSignInput(voucher, fields), crypto.Hash(0))
+	if err != nil {
+		return nil, fmt.Errorf("sign vouch: %w", err)
+	}
+	var b bytes.Buffer
+	b.Write(fields)
+	_ = writeBlob(&b, sig)
+	return b.Bytes(), nil
+}
+
+// openVouch decodes a statement vouched by voucher and checks its
+// signature with voucher's key edPub.
+func openVouch(statement []byte, voucher PeerID, edPub ed25519.PublicKey) (vouch, error) {
+	r := bytes.NewReader(statement)
+	var blobs [5][]byte
+	for i := range blobs {
+		b, err := readBlob(r)
+		if err != nil {
+			return vouch{}, fmt.Errorf("decode vouch: %w", err)
+		}
+		blobs[i] = b
+	}
+	switch {
+	case r.Len() != 0:
+		return vouch{}, errors.New("decode vouch: trailing bytes")
+	case len(blobs[0]) == 0 || len(blobs[1]) != ed25519.PublicKeySize || len(blobs[2]) == 0 || len(blobs[3]) != 8:
+		return vouch{}, errors.New("decode vouch: bad field size")
+	}
+	fields := statement[:len(statement)-4-len(blobs[4])]
+	if len(edPub) != ed25519.PublicKeySize || !ed25519.Verify(edPub, vouchSignInput(voucher, fields), blobs[4]) {
+		return vouch{}, errors.New("vouch: bad signature")
+	}
+	return vouch{
+		Subject: PeerID(blobs[0]),
+		EdPub:   blobs[1],
+		HPKEPub: blobs[2],
+		At:      time.Unix(int64(binary.BigEndian.Uint64(blobs[3])), 0),
+	}, nil
+}
+
+// setVouchThreshold sets how many verified peers must vouch for a peer's
+// keys for it to be vouched.
+func (p *connPool) setVouchThreshold(n int) {
+	p.vouchThreshold = n
+}
+
+// Vouch sends the keys we verified for subject to each peer of to, and
+// returns the peers it reached.
+func (p *connPool) Vouch(subject PeerID, to []PeerInfo) ([]PeerID, error) {
+	if p.pinned == nil {
+		return nil, errors.New("no pin store (see --pins)")
+	}
+	pin, ok := p.pinned.Get(string(subject))
+	if !ok || pin.Verified.IsZero() {
+		return nil, fmt.Errorf("%s is not verified: vouch only for keys you checked (/fingerprint %s, then /verify %s)", subject, subject, subject)
+	}
+	statement, err := signVouch(p.nickname, p.selfSigner, vouch{Subject: subject, EdPub: pin.EdPub, HPKEPub: pin.HPKEPub, At: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	var sent []PeerID
+	var errs []error
+	for _, info := range to {
+		if err := p.sendNotify(info, string(statement), vouchMediaType); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sent = append(sent, info.Nickname)
+	}
+	return sent, errors.Join(errs...)
+}
+
+// handleVouch applies a vouch from a peer we verified.
+func (p *connPool) handleVouch(from PeerID, statement []byte) error {
+	if p.pinned == nil {
+		return nil
+	}
+	voucher, ok := p.pinned.Get(string(from))
+	if !ok || voucher.Verified.IsZero() {
+		p.console.AddHistory(fmt.Sprintf("[vouch] ignored a vouch from %s: it is not verified (see /verify)", from))
+		return nil
+	}
+	v, err := openVouch(statement, from, voucher.EdPub)
+	if err != nil {
+		p.auditf(audit.ForgedSig, from, "vouch: %v", err)
+		return fmt.Errorf("vouch from %s: %w", from, err)
+	}
+	if v.Subject == p.nickname || v.Subject == from {
+		return nil
+	}
+	status, pin, err := p.pinned.Vouch(string(v.Subject), v.EdPub, v.HPKEPub, string(from), p.vouchThreshold)
+	if err != nil {
+		p.console.Errorf("pins: %v", err)
+	}
+	switch status {
+	case pins.Pending:
+		p.console.AddHistory(fmt.Sprintf("[vouch] %s vouches for keys of %s (%d of %d verified vouchers): not pinned yet",
+			from, v.Subject, p.pinned.Vouches(pin), p.vouchThreshold))
+		return nil
+	case pins.Changed:
+		p.console.Errorf("WARNING: %s vouches for keys of %s other than the ones pinned on %s. Someone may be impersonating %s, or %s has new keys: check with both",
+			from, v.Subject, pin.Pinned.Local().Format(time.DateOnly), v.Subject, v.Subject)
+		p.auditf(audit.KeyMismatch, v.Subject, "vouched by %s with keys other than those pinned on %s", from, pin.Pinned.Format(time.DateOnly))
+		return nil
+	}
+	trust := p.trustOf(pins.Match, pin)
+	p.console.AddHistory(fmt.Sprintf("[vouch] %s vouches for the keys of %s (%d of %d verified vouchers): %s",
+		from, v.Subject, p.pinned.Vouches(pin), p.vouchThreshold, trust))
+	p.showPeerTrust(v.Subject, trust)
+	return nil
+}
+
+// runVouch handles "/vouch peer [to]": it sends the keys we verified for
+// peer to to, or to every other peer online.
+func runVouch(c Console, pool *connPool, args string) {
+	fields := strings.Fields(args)
+	if len(fields) < 1 || len(fields) > 2 {
+		c.Errorf("usage: /vouch <peer> [to]")
+		return
+	}
+	subject := PeerID(strings.TrimPrefix(fields[0], "@"))
+	var to []PeerInfo
+	if len(fields) == 2 {
+		info, ok := pool.peerTable.Get(PeerID(strings.TrimPrefix(fields[1], "@")))
+		if !ok {
+			c.Errorf("unknown peer: %s", fields[1])
+			return
+		}
+		to = append(to, info)
+	} else {
+		for _, info := range pool.peerTable.All() {
+			if info.Nickname != subject && info.Nickname != pool.nickname {
+				to = append(to, info)
+			}
+		}
+	}
+	sent, err := pool.Vouch(subject, to)
+	if err != nil {
+		c.Errorf("vouch: %v", err)
+	}
+	for _, nick := range sent {
+		c.Printf("[vouch] sent the keys of %s to %s", subject, nick)
+	}
+	if len(sent) == 0 && err == nil {
+		c.Printf("[vouch] no peer online to vouch to")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pivaldi/tmd/internal/identity"
+)
+
+func TestVouchStatement(t *testing.T) {
+	alice, err := identity.DeriveKeys(bytes.Repeat([]byte{1}, identity.SeedSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol, err := identity.DeriveKeys(bytes.Repeat([]byte{2}, identity.SeedSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := vouch{Subject: "carol", EdPub: carol.Ed25519Pub, HPKEPub: carol.HPKEPubBytes, At: time.Unix(1_700_000_000, 0)}
+	statement, err := signVouch("alice", alice.Ed25519Priv, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := openVouch(statement, "alice", alice.Ed25519Pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Subject != "carol" || !bytes.Equal(v.EdPub, carol.Ed25519Pub) || !bytes.Equal(v.HPKEPub, carol.HPKEPubBytes) || !v.At.Equal(in.At) {
+		t.Fatalf("opened %+v", v)
+	}
+
+	// Sent by another nickname or key, or altered on the way.
+	if _, err := openVouch(statement, "mallory", alice.Ed25519Pub); err == nil {
+		t.Fatal("opened under another nickname")
+	}
+	if _, err := openVouch(statement, "alice", carol.Ed25519Pub); err == nil {
+		t.Fatal("opened with another key")
+	}
+	for i := range statement {
+		bad := bytes.Clone(statement)
+		bad[i] ^= 1
+		if _, err := openVouch(bad, "alice", alice.Ed25519Pub); err == nil {
+			t.Fatalf("opened with byte %d flipped", i)
+		}
+	}
+}
@@ -5,36 +5,91 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"time"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/pivaldi/tmd/internal/keyid"
+	"github.com/pivaldi/tmd/internal/node"
+	"github.com/pivaldi/tmd/internal/ratchet"
 )
 
 // Wire format
 const (
-	msgChallenge byte = 1
-	msgHello     byte = 2
-	msgRequest   byte = 3
-	msgResponse  byte = 4
-	msgGoodbye   byte = 5
+	msgChallenge  byte = 1
+	msgHello      byte = 2
+	msgRequest    byte = 3
+	msgResponse   byte = 4
+	msgGoodbye    byte = 5
+	msgFragment   byte = 6
+	msgNotify     byte = 7
+	msgRoom       byte = 8 // 9 and 10 are unassigned
+	msgFileOffer  byte = 11
+	msgFileChunk  byte = 12
+	msgFileResume byte = 13
+	msgStreamOpen byte = 14
+	msgStreamData byte = 15
+	msgStreamEnd  byte = 16
+	msgStreamCred byte = 25
+	msgReceipt    byte = 17
+	msgTyping     byte = 18
+	msgChanOpen   byte = 19
+	msgChanData   byte = 20
+	msgChanClose  byte = 21
+	msgRatchet    byte = 22
+	msgChanRekey  byte = 23
+	msgRespHello  byte = 24
+)
+
+// Frame-size limits. Each side advertises the largest frame it accepts in
+// the handshake: the listener after the 32-byte challenge, the dialer in
+// its HELLO. Messages that do not fit the peer's limit are split into
+// FRAGMENT frames, provided the peer advertised a limit (and so knows how
+// to reassemble them); peers that advertise nothing are assumed to accept
+// defaultMaxFrame and oversized messages to them are refused.
+const (
+	// defaultMaxFrame is the limit this peer advertises, and the one
+	// assumed for peers that do not advertise any.
+	defaultMaxFrame = 1 << 20
+	// minMaxFrame is the smallest limit a peer may advertise; it leaves
+	// room for the handshake messages.
+	minMaxFrame = 1 << 10
+	// maxMessageSize bounds a reassembled fragmented message.
+	maxMessageSize = 64 << 20
 )
 
+// frameTooLargeError reports a message that cannot be sent to a peer.
+type frameTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *frameTooLargeError) Error() string {
+	return fmt.Sprintf("message of %d bytes exceeds the %d-byte limit", e.Size, e.Limit)
+}
+
 // KeyIDSize is the size of key fingerprints in bytes.
-const KeyIDSize = 8
+const KeyIDSize = keyid.Size
 
 // Message format: u32(len(type+payload)) || type(1) || payload
+// The frame is emitted with a single Write so stream wrappers (see
+// internal/chaos) see exactly one call per protocol message.
 func writeMsg(w io.Writer, typ byte, payload []byte) error {
-	total := uint32(1 + len(payload))
-	var hdr [4]byte
-	binary.BigEndian.PutUint32(hdr[:], total)
-	if _, err := w.Write(hdr[:]); err != nil {
-		return err
-	}
-	if _, err := w.Write([]byte{typ}); err != nil {
-		return err
-	}
-	_, err := w.Write(payload)
+	frame := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(1+len(payload)))
+	frame[4] = typ
+	copy(frame[5:], payload)
+	_, err := w.Write(frame)
 	return err
 }
 
+// readMsg reads one frame of at most defaultMaxFrame bytes.
 func readMsg(r io.Reader) (byte, []byte, error) {
+	return readMsgLimit(r, defaultMaxFrame)
+}
+
+// readMsgLimit reads one frame, refusing frames over limit bytes (type
+// and payload) before allocating them.
+func readMsgLimit(r io.Reader, limit uint32) (byte, []byte, error) {
 	var hdr [4]byte
 	if _, err := io.ReadFull(r, hdr[:]); err != nil {
 		return 0, nil, err
@@ -43,6 +98,9 @@ func readMsg(r io.Reader) (byte, []byte, error) {
 	if n < 1 {
 		return 0, nil, fmt.Errorf("bad msg length")
 	}
+	if n > limit {
+		return 0, nil, fmt.Errorf("frame of %d bytes: %w", n, &frameTooLargeError{Size: int(n), Limit: int(limit)})
+	}
 	var typ [1]byte
 	if _, err := io.ReadFull(r, typ[:]); err != nil {
 		return 0, nil, err
@@ -54,6 +112,161 @@ func readMsg(r io.Reader) (byte, []byte, error) {
 	return typ[0], payload, nil
 }
 
+// writeMsgLimit writes a message to a peer accepting frames of at most
+// limit bytes. Larger messages are fragmented when the peer supports it
+// and refused otherwise.
+//
+// Fragment payload: more(1) || chunk. Concatenating the chunks up to the
+// fragment with more=0 yields type(1) || payload of the original message.
+// Callers must serialize writes so the fragments of one message are not
+// interleaved with other frames.
+func writeMsgLimit(w io.Writer, typ byte, payload []byte, limit uint32, fragment bool) error {
+	size := 1 + len(payload)
+	if size <= int(limit) {
+		return writeMsg(w, typ, payload)
+	}
+	if !fragment {
+		return &frameTooLargeError{Size: size, Limit: int(limit)}
+	}
+	if size > maxMessageSize {
+		return &frameTooLargeError{Size: size, Limit: maxMessageSize}
+	}
+
+	msg := make([]byte, 0, size)
+	msg = append(msg, typ)
+	msg = append(msg, payload...)
+	chunk := int(limit) - 2 // fragment type + more flag
+	for len(msg) > 0 {
+		n := min(chunk, len(msg))
+		more := byte(0)
+		if n < len(msg) {
+			more = 1
+		}
+		frag := make([]byte, 0, 1+n)
+		frag = append(frag, more)
+		frag = append(frag, msg[:n]...)
+		if err := writeMsg(w, msgFragment, frag); err != nil {
+			return err
+		}
+		msg = msg[n:]
+	}
+	return nil
+}
+
+// readMessage reads the next message, reassembling fragments. Every frame
+// must fit limit; the reassembled message must fit maxMessageSize.
+func readMessage(r io.Reader, limit uint32) (byte, []byte, error) {
+	var buf []byte
+	for {
+		typ, payload, err := readMsgLimit(r, limit)
+		if err != nil {
+			return 0, nil, err
+		}
+		if typ != msgFragment {
+			if buf != nil {
+				return 0, nil, fmt.Errorf("message type %d inside a fragmented message", typ)
+			}
+			return typ, payload, nil
+		}
+		if len(payload) < 1 {
+			return 0, nil, fmt.Errorf("empty fragment")
+		}
+		if len(buf)+len(payload)-1 > maxMessageSize {
+			return 0, nil, &frameTooLargeError{Size: len(buf) + len(payload) - 1, Limit: maxMessageSize}
+		}
+		buf = append(buf, payload[1:]...)
+		if payload[0] == 0 {
+			if len(buf) < 1 || buf[0] == msgFragment {
+				return 0, nil, fmt.Errorf("bad fragmented message")
+			}
+			return buf[0], buf[1:], nil
+		}
+	}
+}
+
+// encodeChallenge returns the CHALLENGE payload: challenge ||
+// u32(maxFrame) || the suites we offer (see suites.go) [|| the features
+// field, if any features (see features.go)].
+func encodeChallenge(chal []byte, maxFrame uint32, suites []hpke.Suite, features uint32) []byte {
+	b := make([]byte, len(chal)+4)
+	copy(b, chal)
+	binary.BigEndian.PutUint32(b[len(chal):], maxFrame)
+	b = append(b, encodeSuites(suites)...)
+	if features != 0 {
+		b = appendFeatures(b, features)
+	}
+	return b
+}
+
+// decodeChallenge splits a CHALLENGE payload. Listeners predating frame
+// negotiation send the bare 32-byte challenge; maxFrame is then 0.
+// Listeners predating suites offer none, and those predating features
+// none either.
+func decodeChallenge(p []byte) (chal []byte, maxFrame uint32, suites []hpke.Suite, features uint32, err error) {
+	switch {
+	case len(p) == 32:
+		return p, 0, nil, 0, nil
+	case len(p) >= 36:
+		rest, features := cutFeatures(p[36:])
+		if suites, err = decodeSuites(rest); err != nil {
+			return nil, 0, nil, 0, err
+		}
+		return p[:32], binary.BigEndian.Uint32(p[32:36]), suites, features, nil
+	default:
+		return nil, 0, nil, 0, fmt.Errorf("bad challenge length: %d", len(p))
+	}
+}
+
+// suiteSize is the size of an encoded suite: u16(KEM) || u16(KDF) ||
+// u16(AEAD).
+const suiteSize = 6
+
+// maxSuites bounds the suites a peer may offer.
+const maxSuites = 16
+
+func encodeSuites(suites []hpke.Suite) []byte {
+	b := make([]byte, 0, len(suites)*suiteSize)
+	for _, s := range suites {
+		kem, kdf, aead := s.Params()
+		b = binary.BigEndian.AppendUint16(b, uint16(kem))
+		b = binary.BigEndian.AppendUint16(b, uint16(kdf))
+		b = binary.BigEndian.AppendUint16(b, uint16(aead))
+	}
+	return b
+}
+
+// decodeSuites reads a list of suites, leaving out those we do not know.
+func decodeSuites(b []byte) ([]hpke.Suite, error) {
+	if len(b)%suiteSize != 0 || len(b)/suiteSize > maxSuites {
+		return nil, fmt.Errorf("bad suite list length: %d", len(b))
+	}
+	var suites []hpke.Suite
+	for ; len(b) > 0; b = b[suiteSize:] {
+		kem := hpke.KEM(binary.BigEndian.Uint16(b))
+		kdf := hpke.KDF(binary.BigEndian.Uint16(b[2:]))
+		aead := hpke.AEAD(binary.BigEndian.Uint16(b[4:]))
+		if kem.IsValid() && kdf.IsValid() && aead.IsValid() {
+			suites = append(suites, hpke.NewSuite(kem, kdf, aead))
+		}
+	}
+	return suites, nil
+}
+
+// Field limits. Decoders check each length read off the wire against
+// its field's limit, and against what is left of the message, before
+// allocating it, and refuse bytes left over after the last field they
+// know. New optional trailers therefore go only to peers that offer a
+// feature for them (see features.go).
+const (
+	// maxNameField bounds sender IDs and room names.
+	maxNameField = node.MaxNicknameSize
+	// maxKeyField bounds keys, encapsulations, signatures, nonces and
+	// stream errors.
+	maxKeyField = 4 << 10
+	// maxMediaType bounds media types.
+	maxMediaType = 256
+)
+
 // Blob format: u32(len) || bytes
 func writeBlob(w io.Writer, b []byte) error {
 	var hdr [4]byte
@@ -65,12 +278,24 @@ func writeBlob(w io.Writer, b []byte) error {
 	return err
 }
 
-func readBlob(r io.Reader) ([]byte, error) {
+// readBlob reads a blob, which must fit in what is left of r.
+func readBlob(r *bytes.Reader) ([]byte, error) {
+	return readField(r, r.Len())
+}
+
+// readField reads a blob of at most max bytes.
+func readField(r *bytes.Reader, max int) ([]byte, error) {
 	var hdr [4]byte
 	if _, err := io.ReadFull(r, hdr[:]); err != nil {
 		return nil, err
 	}
 	n := binary.BigEndian.Uint32(hdr[:])
+	switch {
+	case uint64(n) > uint64(max):
+		return nil, fmt.Errorf("field of %d bytes exceeds %d", n, max)
+	case int64(n) > int64(r.Len()):
+		return nil, fmt.Errorf("field of %d bytes overruns the message", n)
+	}
 	b := make([]byte, n)
 	if _, err := io.ReadFull(r, b); err != nil {
 		return nil, err
@@ -78,6 +303,14 @@ func readBlob(r io.Reader) ([]byte, error) {
 	return b, nil
 }
 
+// expectEnd refuses bytes left in r after the last field.
+func expectEnd(r *bytes.Reader) error {
+	if r.Len() > 0 {
+		return fmt.Errorf("%d trailing bytes", r.Len())
+	}
+	return nil
+}
+
 func encodeHello(h Hello) []byte {
 	var b bytes.Buffer
 	_ = writeBlob(&b, []byte(h.SenderID))
@@ -85,42 +318,146 @@ func encodeHello(h Hello) []byte {
 	_ = writeBlob(&b, h.SenderEdPub)
 	_ = writeBlob(&b, h.SenderHPKEPub)
 	_ = writeBlob(&b, h.Signature)
+	// Optional trailers: the max frame size (possibly 0, when a profile
+	// follows), then the profile, the ratchet key and the suites (possibly
+	// empty, when what follows is not), then the key signature, the early
+	// request and the features.
+	more := len(h.Profile) > 0 || len(h.RatchetPub) > 0 || len(h.Suites) > 0 || len(h.KeySig) > 0 || len(h.Request) > 0 || h.Features != 0
+	if h.MaxFrame != 0 || more {
+		var mf [4]byte
+		binary.BigEndian.PutUint32(mf[:], h.MaxFrame)
+		_ = writeBlob(&b, mf[:])
+	}
+	if more {
+		_ = writeBlob(&b, h.Profile)
+	}
+	if len(h.RatchetPub) > 0 || len(h.Suites) > 0 || len(h.KeySig) > 0 || len(h.Request) > 0 || h.Features != 0 {
+		_ = writeBlob(&b, h.RatchetPub)
+	}
+	if len(h.Suites) > 0 || len(h.KeySig) > 0 || len(h.Request) > 0 || h.Features != 0 {
+		_ = writeBlob(&b, h.Suites)
+	}
+	if len(h.KeySig) > 0 || len(h.Request) > 0 || h.Features != 0 {
+		_ = writeBlob(&b, h.KeySig)
+	}
+	if len(h.Request) > 0 || h.Features != 0 {
+		_ = writeBlob(&b, h.Request)
+	}
+	if h.Features != 0 {
+		var f [4]byte
+		binary.BigEndian.PutUint32(f[:], h.Features)
+		_ = writeBlob(&b, f[:])
+	}
 	return b.Bytes()
 }
 
 func decodeHello(p []byte) (Hello, error) {
 	r := bytes.NewReader(p)
 
-	id, err := readBlob(r)
+	id, err := readField(r, maxNameField)
 	if err != nil {
 		return Hello{}, err
 	}
-	keyID, err := readBlob(r)
+	keyID, err := readField(r, KeyIDSize)
 	if err != nil {
 		return Hello{}, err
 	}
-	if len(keyID) != KeyIDSize {
+	if !keyid.ValidOrLegacy(keyID) {
 		return Hello{}, fmt.Errorf("bad keyID length: %d", len(keyID))
 	}
-	edPub, err := readBlob(r)
+	edPub, err := readField(r, maxKeyField)
 	if err != nil {
 		return Hello{}, err
 	}
-	hpkePub, err := readBlob(r)
+	hpkePub, err := readField(r, maxKeyField)
 	if err != nil {
 		return Hello{}, err
 	}
-	sig, err := readBlob(r)
+	sig, err := readField(r, maxKeyField)
 	if err != nil {
 		return Hello{}, err
 	}
+	// Optional trailing max frame size; absent from older dialers.
+	var maxFrame uint32
+	if r.Len() > 0 {
+		mf, err := readField(r, 4)
+		if err != nil {
+			return Hello{}, err
+		}
+		if len(mf) != 4 {
+			return Hello{}, fmt.Errorf("bad max frame length: %d", len(mf))
+		}
+		maxFrame = binary.BigEndian.Uint32(mf)
+	}
+	var profile []byte
+	if r.Len() > 0 {
+		if profile, err = readField(r, maxSignedProfile); err != nil {
+			return Hello{}, fmt.Errorf("profile: %w", err)
+		}
+	}
+	var ratchetPub []byte
+	if r.Len() > 0 {
+		if ratchetPub, err = readField(r, ratchet.KeySize); err != nil {
+			return Hello{}, err
+		}
+		if len(ratchetPub) != 0 && len(ratchetPub) != ratchet.KeySize {
+			return Hello{}, fmt.Errorf("bad ratchet key length: %d", len(ratchetPub))
+		}
+	}
+	var suites []byte
+	if r.Len() > 0 {
+		if suites, err = readField(r, maxKeyField); err != nil {
+			return Hello{}, err
+		}
+		if _, err := decodeSuites(suites); err != nil {
+			return Hello{}, err
+		}
+	}
+	var keySig []byte
+	if r.Len() > 0 {
+		if keySig, err = readField(r, node.MaxKeySigSize); err != nil {
+			return Hello{}, fmt.Errorf("key signature: %w", err)
+		}
+	}
+	var request []byte
+	if r.Len() > 0 {
+		if request, err = readBlob(r); err != nil {
+			return Hello{}, err
+		}
+		if len(request) > 0 {
+			if _, err := decodeRequest(request); err != nil {
+				return Hello{}, fmt.Errorf("early request: %w", err)
+			}
+		}
+	}
+	var features uint32
+	if r.Len() > 0 {
+		f, err := readField(r, 4)
+		if err != nil {
+			return Hello{}, err
+		}
+		if len(f) != 4 {
+			return Hello{}, fmt.Errorf("bad features length: %d", len(f))
+		}
+		features = binary.BigEndian.Uint32(f)
+	}
 
+	if err := expectEnd(r); err != nil {
+		return Hello{}, err
+	}
 	return Hello{
 		SenderID:      PeerID(id),
 		SenderKeyID:   keyID,
 		SenderEdPub:   edPub,
 		SenderHPKEPub: hpkePub,
 		Signature:     sig,
+		MaxFrame:      maxFrame,
+		Profile:       profile,
+		RatchetPub:    ratchetPub,
+		Suites:        suites,
+		KeySig:        keySig,
+		Request:       request,
+		Features:      features,
 	}, nil
 }
 
@@ -130,6 +467,13 @@ type Request struct {
 	EncapKey       []byte
 	MediaType      []byte
 	Ciphertext     []byte
+	MessageID      []byte // optional trailing blob, 16 random bytes kept across resends
+	// Priority follows MessageID, as a 1-byte blob, when it is not
+	// priorityNormal (see sendqueue.go) or Timeout follows.
+	Priority byte
+	// Timeout follows Priority, in milliseconds as a 4-byte blob, when it
+	// is not zero (see deadlines.go).
+	Timeout time.Duration
 }
 
 func encodeRequest(req Request) []byte {
@@ -141,12 +485,22 @@ func encodeRequest(req Request) []byte {
 	_ = writeBlob(&b, req.EncapKey)
 	_ = writeBlob(&b, req.MediaType)
 	_ = writeBlob(&b, req.Ciphertext)
+	if len(req.MessageID) > 0 {
+		_ = writeBlob(&b, req.MessageID)
+		if req.Priority != priorityNormal || req.Timeout > 0 {
+			_ = writeBlob(&b, []byte{req.Priority})
+		}
+		if req.Timeout > 0 {
+			ms := min(req.Timeout, maxRequestTimeout).Milliseconds()
+			_ = writeBlob(&b, binary.BigEndian.AppendUint32(nil, uint32(max(ms, 1))))
+		}
+	}
 	return b.Bytes()
 }
 
 func decodeRequest(p []byte) (Request, error) {
 	r := bytes.NewReader(p)
-	idb, err := readBlob(r)
+	idb, err := readField(r, 8)
 	if err != nil {
 		return Request{}, err
 	}
@@ -155,18 +509,18 @@ func decodeRequest(p []byte) (Request, error) {
 	}
 	id := binary.BigEndian.Uint64(idb)
 
-	keyID, err := readBlob(r)
+	keyID, err := readField(r, KeyIDSize)
 	if err != nil {
 		return Request{}, err
 	}
-	if len(keyID) != KeyIDSize {
+	if !keyid.ValidOrLegacy(keyID) {
 		return Request{}, fmt.Errorf("bad recipient keyID length: %d", len(keyID))
 	}
-	encap, err := readBlob(r)
+	encap, err := readField(r, maxKeyField)
 	if err != nil {
 		return Request{}, err
 	}
-	mt, err := readBlob(r)
+	mt, err := readField(r, maxMediaType)
 	if err != nil {
 		return Request{}, err
 	}
@@ -174,8 +528,259 @@ func decodeRequest(p []byte) (Request, error) {
 	if err != nil {
 		return Request{}, err
 	}
+	req := Request{RequestID: id, RecipientKeyID: keyID, EncapKey: encap, MediaType: mt, Ciphertext: ct}
+
+	// Senders that predate message IDs stop here.
+	if r.Len() > 0 {
+		if req.MessageID, err = readField(r, messageIDSize); err != nil {
+			return Request{}, err
+		}
+		if len(req.MessageID) != messageIDSize {
+			return Request{}, fmt.Errorf("bad message ID length: %d", len(req.MessageID))
+		}
+	}
+	// Senders that predate priorities stop here.
+	if r.Len() > 0 {
+		prio, err := readField(r, 1)
+		if err != nil {
+			return Request{}, err
+		}
+		if len(prio) != 1 {
+			return Request{}, fmt.Errorf("bad priority length: %d", len(prio))
+		}
+		req.Priority = prio[0]
+	}
+	// Senders that predate timeouts stop here.
+	if r.Len() > 0 {
+		ms, err := readField(r, 4)
+		if err != nil {
+			return Request{}, err
+		}
+		if len(ms) != 4 {
+			return Request{}, fmt.Errorf("bad timeout length: %d", len(ms))
+		}
+		req.Timeout = time.Duration(binary.BigEndian.Uint32(ms)) * time.Millisecond
+	}
+	if err := expectEnd(r); err != nil {
+		return Request{}, err
+	}
+	return req, nil
+}
+
+// Notify is a one-way request: sealed like a Request but never answered,
+// so it carries no request ID. Peers that predate it ignore the frame.
+type Notify struct {
+	RecipientKeyID []byte // 8-byte key fingerprint
+	EncapKey       []byte
+	MediaType      []byte
+	Ciphertext     []byte
+}
+
+func encodeNotify(n Notify) []byte {
+	var b bytes.Buffer
+	_ = writeBlob(&b, n.RecipientKeyID)
+	_ = writeBlob(&b, n.EncapKey)
+	_ = writeBlob(&b, n.MediaType)
+	_ = writeBlob(&b, n.Ciphertext)
+	return b.Bytes()
+}
+
+func decodeNotify(p []byte) (Notify, error) {
+	r := bytes.NewReader(p)
+	keyID, err := readField(r, KeyIDSize)
+	if err != nil {
+		return Notify{}, err
+	}
+	if !keyid.ValidOrLegacy(keyID) {
+		return Notify{}, fmt.Errorf("bad recipient keyID length: %d", len(keyID))
+	}
+	encap, err := readField(r, maxKeyField)
+	if err != nil {
+		return Notify{}, err
+	}
+	mt, err := readField(r, maxMediaType)
+	if err != nil {
+		return Notify{}, err
+	}
+	ct, err := readBlob(r)
+	if err != nil {
+		return Notify{}, err
+	}
+	if err := expectEnd(r); err != nil {
+		return Notify{}, err
+	}
+	return Notify{RecipientKeyID: keyID, EncapKey: encap, MediaType: mt, Ciphertext: ct}, nil
+}
+
+// RoomMessage is a message to a room, encrypted once under the sender's
+// key for the room (see rooms.go). The sender is the session's peer.
+type RoomMessage struct {
+	Room       string
+	Gen        uint32 // generation of the sender key
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+func encodeRoomMessage(m RoomMessage) []byte {
+	var b bytes.Buffer
+	var gen [4]byte
+	binary.BigEndian.PutUint32(gen[:], m.Gen)
+	_ = writeBlob(&b, []byte(m.Room))
+	_ = writeBlob(&b, gen[:])
+	_ = writeBlob(&b, m.Nonce)
+	_ = writeBlob(&b, m.Ciphertext)
+	return b.Bytes()
+}
+
+func decodeRoomMessage(p []byte) (RoomMessage, error) {
+	r := bytes.NewReader(p)
+	room, err := readField(r, maxNameField)
+	if err != nil {
+		return RoomMessage{}, err
+	}
+	gen, err := readField(r, 4)
+	if err != nil {
+		return RoomMessage{}, err
+	}
+	if len(gen) != 4 {
+		return RoomMessage{}, fmt.Errorf("bad sender key generation")
+	}
+	nonce, err := readField(r, maxKeyField)
+	if err != nil {
+		return RoomMessage{}, err
+	}
+	ct, err := readBlob(r)
+	if err != nil {
+		return RoomMessage{}, err
+	}
+	if err := expectEnd(r); err != nil {
+		return RoomMessage{}, err
+	}
+	return RoomMessage{Room: string(room), Gen: binary.BigEndian.Uint32(gen), Nonce: nonce, Ciphertext: ct}, nil
+}
+
+// FileOffer starts a file transfer. The name, size and digest of the file
+// are in the sealed part (see files.go); only the transfer ID and the
+// number of chunks that follow are in the clear.
+type FileOffer struct {
+	TransferID []byte // 16 random bytes
+	Chunks     uint32
+	Sealed     Notify
+}
+
+// FileChunk is one piece of a file, sealed on its own to the receiver.
+type FileChunk struct {
+	TransferID []byte
+	Index      uint32
+	Sealed     Notify
+}
+
+func encodeFileOffer(o FileOffer) []byte {
+	return encodeFileFrame(o.TransferID, o.Chunks, o.Sealed)
+}
+
+func decodeFileOffer(p []byte) (FileOffer, error) {
+	id, n, sealed, err := decodeFileFrame(p)
+	if err != nil {
+		return FileOffer{}, err
+	}
+	return FileOffer{TransferID: id, Chunks: n, Sealed: sealed}, nil
+}
 
-	return Request{RequestID: id, RecipientKeyID: keyID, EncapKey: encap, MediaType: mt, Ciphertext: ct}, nil
+func encodeFileChunk(c FileChunk) []byte {
+	return encodeFileFrame(c.TransferID, c.Index, c.Sealed)
+}
+
+func decodeFileChunk(p []byte) (FileChunk, error) {
+	id, n, sealed, err := decodeFileFrame(p)
+	if err != nil {
+		return FileChunk{}, err
+	}
+	return FileChunk{TransferID: id, Index: n, Sealed: sealed}, nil
+}
+
+// FileResume is sent by a receiver to the sender of a file: it asks for
+// the chunks listed in Missing, as [start, end) index ranges, or reports
+// the file complete when Missing is empty.
+type FileResume struct {
+	TransferID []byte
+	Missing    [][2]uint32
+}
+
+func encodeFileResume(r FileResume) []byte {
+	var b bytes.Buffer
+	ranges := make([]byte, 0, 8*len(r.Missing))
+	for _, m := range r.Missing {
+		ranges = binary.BigEndian.AppendUint32(ranges, m[0])
+		ranges = binary.BigEndian.AppendUint32(ranges, m[1])
+	}
+	_ = writeBlob(&b, r.TransferID)
+	_ = writeBlob(&b, ranges)
+	return b.Bytes()
+}
+
+func decodeFileResume(p []byte) (FileResume, error) {
+	r := bytes.NewReader(p)
+	id, err := readField(r, fileIDSize)
+	if err != nil {
+		return FileResume{}, err
+	}
+	if len(id) != fileIDSize {
+		return FileResume{}, fmt.Errorf("bad transfer ID length: %d", len(id))
+	}
+	ranges, err := readBlob(r)
+	if err != nil {
+		return FileResume{}, err
+	}
+	if len(ranges)%8 != 0 {
+		return FileResume{}, fmt.Errorf("bad chunk ranges")
+	}
+	if err := expectEnd(r); err != nil {
+		return FileResume{}, err
+	}
+	res := FileResume{TransferID: id}
+	for i := 0; i < len(ranges); i += 8 {
+		start, end := binary.BigEndian.Uint32(ranges[i:]), binary.BigEndian.Uint32(ranges[i+4:])
+		if start >= end {
+			return FileResume{}, fmt.Errorf("bad chunk range %d-%d", start, end)
+		}
+		res.Missing = append(res.Missing, [2]uint32{start, end})
+	}
+	return res, nil
+}
+
+// File frames: blob(transfer ID) || blob(u32) || sealed notify fields
+func encodeFileFrame(id []byte, n uint32, sealed Notify) []byte {
+	var b bytes.Buffer
+	var nb [4]byte
+	binary.BigEndian.PutUint32(nb[:], n)
+	_ = writeBlob(&b, id)
+	_ = writeBlob(&b, nb[:])
+	b.Write(encodeNotify(sealed))
+	return b.Bytes()
+}
+
+func decodeFileFrame(p []byte) ([]byte, uint32, Notify, error) {
+	r := bytes.NewReader(p)
+	id, err := readField(r, fileIDSize)
+	if err != nil {
+		return nil, 0, Notify{}, err
+	}
+	if len(id) != fileIDSize {
+		return nil, 0, Notify{}, fmt.Errorf("bad transfer ID length: %d", len(id))
+	}
+	nb, err := readField(r, 4)
+	if err != nil {
+		return nil, 0, Notify{}, err
+	}
+	if len(nb) != 4 {
+		return nil, 0, Notify{}, fmt.Errorf("bad chunk number")
+	}
+	sealed, err := decodeNotify(p[len(p)-r.Len():])
+	if err != nil {
+		return nil, 0, Notify{}, err
+	}
+	return id, binary.BigEndian.Uint32(nb), sealed, nil
 }
 
 func encodeResponse(resp Response) []byte {
@@ -190,7 +795,7 @@ func encodeResponse(resp Response) []byte {
 
 func decodeResponse(p []byte) (Response, error) {
 	r := bytes.NewReader(p)
-	idb, err := readBlob(r)
+	idb, err := readField(r, 8)
 	if err != nil {
 		return Response{}, err
 	}
@@ -199,7 +804,7 @@ func decodeResponse(p []byte) (Response, error) {
 	}
 	id := binary.BigEndian.Uint64(idb)
 
-	mt, err := readBlob(r)
+	mt, err := readField(r, maxMediaType)
 	if err != nil {
 		return Response{}, err
 	}
@@ -207,9 +812,347 @@ func decodeResponse(p []byte) (Response, error) {
 	if err != nil {
 		return Response{}, err
 	}
+	if err := expectEnd(r); err != nil {
+		return Response{}, err
+	}
 	return Response{RequestID: id, MediaType: mt, Ciphertext: ct}, nil
 }
 
+// StreamOpen starts a streamed request: the fields of a Request but the
+// ciphertext, which follows in STREAM_DATA frames with the same request
+// ID and ends with a STREAM_END. The response comes back the same way.
+type StreamOpen struct {
+	RequestID      uint64
+	RecipientKeyID []byte // 8-byte key fingerprint
+	EncapKey       []byte
+	MediaType      []byte
+}
+
+// StreamData is a piece of a streamed ciphertext. Frame boundaries carry
+// no meaning: the receiver reads the pieces back to back.
+type StreamData struct {
+	RequestID uint64
+	Data      []byte
+}
+
+// StreamEnd closes one direction of a stream. A non-empty Error aborts
+// it; the ciphertext received so far is then discarded.
+type StreamEnd struct {
+	RequestID uint64
+	Error     string
+}
+
+// StreamCredit lets the sender of one direction of a stream send Frames
+// more STREAM_DATA frames (see streams.go).
+type StreamCredit struct {
+	RequestID uint64
+	Frames    uint32
+}
+
+func encodeStreamOpen(o StreamOpen) []byte {
+	var b bytes.Buffer
+	writeRequestID(&b, o.RequestID)
+	_ = writeBlob(&b, o.RecipientKeyID)
+	_ = writeBlob(&b, o.EncapKey)
+	_ = writeBlob(&b, o.MediaType)
+	return b.Bytes()
+}
+
+func decodeStreamOpen(p []byte) (StreamOpen, error) {
+	r := bytes.NewReader(p)
+	id, err := readRequestID(r)
+	if err != nil {
+		return StreamOpen{}, err
+	}
+	keyID, err := readField(r, KeyIDSize)
+	if err != nil {
+		return StreamOpen{}, err
+	}
+	if !keyid.Valid(keyID) {
+		return StreamOpen{}, fmt.Errorf("bad recipient keyID length: %d", len(keyID))
+	}
+	encap, err := readField(r, maxKeyField)
+	if err != nil {
+		return StreamOpen{}, err
+	}
+	mt, err := readField(r, maxMediaType)
+	if err != nil {
+		return StreamOpen{}, err
+	}
+	if err := expectEnd(r); err != nil {
+		return StreamOpen{}, err
+	}
+	return StreamOpen{RequestID: id, RecipientKeyID: keyID, EncapKey: encap, MediaType: mt}, nil
+}
+
+func encodeStreamData(d StreamData) []byte {
+	var b bytes.Buffer
+	writeRequestID(&b, d.RequestID)
+	_ = writeBlob(&b, d.Data)
+	return b.Bytes()
+}
+
+func decodeStreamData(p []byte) (StreamData, error) {
+	r := bytes.NewReader(p)
+	id, err := readRequestID(r)
+	if err != nil {
+		return StreamData{}, err
+	}
+	data, err := readBlob(r)
+	if err != nil {
+		return StreamData{}, err
+	}
+	if err := expectEnd(r); err != nil {
+		return StreamData{}, err
+	}
+	return StreamData{RequestID: id, Data: data}, nil
+}
+
+func encodeStreamEnd(e StreamEnd) []byte {
+	var b bytes.Buffer
+	writeRequestID(&b, e.RequestID)
+	_ = writeBlob(&b, []byte(e.Error))
+	return b.Bytes()
+}
+
+func decodeStreamEnd(p []byte) (StreamEnd, error) {
+	r := bytes.NewReader(p)
+	id, err := readRequestID(r)
+	if err != nil {
+		return StreamEnd{}, err
+	}
+	msg, err := readField(r, maxKeyField)
+	if err != nil {
+		return StreamEnd{}, err
+	}
+	if err := expectEnd(r); err != nil {
+		return StreamEnd{}, err
+	}
+	return StreamEnd{RequestID: id, Error: string(msg)}, nil
+}
+
+func encodeStreamCredit(c StreamCredit) []byte {
+	var b bytes.Buffer
+	writeRequestID(&b, c.RequestID)
+	_ = writeBlob(&b, binary.BigEndian.AppendUint32(nil, c.Frames))
+	return b.Bytes()
+}
+
+func decodeStreamCredit(p []byte) (StreamCredit, error) {
+	r := bytes.NewReader(p)
+	id, err := readRequestID(r)
+	if err != nil {
+		return StreamCredit{}, err
+	}
+	frames, err := readField(r, 4)
+	if err != nil {
+		return StreamCredit{}, err
+	}
+	if len(frames) != 4 {
+		return StreamCredit{}, fmt.Errorf("bad stream credit")
+	}
+	if err := expectEnd(r); err != nil {
+		return StreamCredit{}, err
+	}
+	return StreamCredit{RequestID: id, Frames: binary.BigEndian.Uint32(frames)}, nil
+}
+
+// Receipt tells the sender of an interactive request how far it got:
+// delivered once received, read once the user has seen it. It goes back
+// on the stream the request came on, which RequestID refers to.
+type Receipt struct {
+	RequestID uint64
+	Kind      byte
+}
+
+func encodeReceipt(r Receipt) []byte {
+	var b bytes.Buffer
+	writeRequestID(&b, r.RequestID)
+	_ = writeBlob(&b, []byte{r.Kind})
+	return b.Bytes()
+}
+
+func decodeReceipt(p []byte) (Receipt, error) {
+	r := bytes.NewReader(p)
+	id, err := readRequestID(r)
+	if err != nil {
+		return Receipt{}, err
+	}
+	kind, err := readField(r, 1)
+	if err != nil {
+		return Receipt{}, err
+	}
+	if len(kind) != 1 {
+		return Receipt{}, fmt.Errorf("bad receipt kind")
+	}
+	if err := expectEnd(r); err != nil {
+		return Receipt{}, err
+	}
+	return Receipt{RequestID: id, Kind: kind[0]}, nil
+}
+
+// ChanOpen opens a duplex channel (see channels.go) on the dialer's
+// session stream: EncapKey is an HPKE encapsulation to the listener's
+// key, whose exporter secret keys both directions.
+type ChanOpen struct {
+	ChannelID      uint64
+	RecipientKeyID []byte // 8-byte key fingerprint
+	EncapKey       []byte
+}
+
+// ChanData is one sealed frame of a channel. Seq counts the frames sent
+// in its direction from 0; receivers take them in order only.
+type ChanData struct {
+	ChannelID  uint64
+	Seq        uint64
+	Ciphertext []byte
+}
+
+// ChanClose closes a channel in both directions.
+type ChanClose struct {
+	ChannelID uint64
+}
+
+// ChanRekey replaces the key of one direction of a channel (see rekey.go):
+// EncapKey is a new HPKE encapsulation from the sender to the receiver's
+// key, whose exporter secret keys the frames from number Seq on.
+type ChanRekey struct {
+	ChannelID      uint64
+	Seq            uint64
+	RecipientKeyID []byte // 8-byte key fingerprint
+	EncapKey       []byte
+}
+
+func encodeChanOpen(o ChanOpen) []byte {
+	var b bytes.Buffer
+	writeRequestID(&b, o.ChannelID)
+	_ = writeBlob(&b, o.RecipientKeyID)
+	_ = writeBlob(&b, o.EncapKey)
+	return b.Bytes()
+}
+
+func decodeChanOpen(p []byte) (ChanOpen, error) {
+	r := bytes.NewReader(p)
+	id, err := readRequestID(r)
+	if err != nil {
+		return ChanOpen{}, err
+	}
+	keyID, err := readField(r, KeyIDSize)
+	if err != nil {
+		return ChanOpen{}, err
+	}
+	if !keyid.Valid(keyID) {
+		return ChanOpen{}, fmt.Errorf("bad recipient keyID length: %d", len(keyID))
+	}
+	encap, err := readField(r, maxKeyField)
+	if err != nil {
+		return ChanOpen{}, err
+	}
+	if err := expectEnd(r); err != nil {
+		return ChanOpen{}, err
+	}
+	return ChanOpen{ChannelID: id, RecipientKeyID: keyID, EncapKey: encap}, nil
+}
+
+func encodeChanData(d ChanData) []byte {
+	var b bytes.Buffer
+	writeRequestID(&b, d.ChannelID)
+	writeRequestID(&b, d.Seq)
+	_ = writeBlob(&b, d.Ciphertext)
+	return b.Bytes()
+}
+
+func decodeChanData(p []byte) (ChanData, error) {
+	r := bytes.NewReader(p)
+	id, err := readRequestID(r)
+	if err != nil {
+		return ChanData{}, err
+	}
+	seq, err := readRequestID(r)
+	if err != nil {
+		return ChanData{}, err
+	}
+	ct, err := readBlob(r)
+	if err != nil {
+		return ChanData{}, err
+	}
+	if err := expectEnd(r); err != nil {
+		return ChanData{}, err
+	}
+	return ChanData{ChannelID: id, Seq: seq, Ciphertext: ct}, nil
+}
+
+func encodeChanClose(c ChanClose) []byte {
+	var b bytes.Buffer
+	writeRequestID(&b, c.ChannelID)
+	return b.Bytes()
+}
+
+func decodeChanClose(p []byte) (ChanClose, error) {
+	r := bytes.NewReader(p)
+	id, err := readRequestID(r)
+	if err != nil {
+		return ChanClose{}, err
+	}
+	if err := expectEnd(r); err != nil {
+		return ChanClose{}, err
+	}
+	return ChanClose{ChannelID: id}, nil
+}
+
+func encodeChanRekey(k ChanRekey) []byte {
+	var b bytes.Buffer
+	writeRequestID(&b, k.ChannelID)
+	writeRequestID(&b, k.Seq)
+	_ = writeBlob(&b, k.RecipientKeyID)
+	_ = writeBlob(&b, k.EncapKey)
+	return b.Bytes()
+}
+
+func decodeChanRekey(p []byte) (ChanRekey, error) {
+	r := bytes.NewReader(p)
+	id, err := readRequestID(r)
+	if err != nil {
+		return ChanRekey{}, err
+	}
+	seq, err := readRequestID(r)
+	if err != nil {
+		return ChanRekey{}, err
+	}
+	keyID, err := readField(r, KeyIDSize)
+	if err != nil {
+		return ChanRekey{}, err
+	}
+	if !keyid.Valid(keyID) {
+		return ChanRekey{}, fmt.Errorf("bad recipient keyID length: %d", len(keyID))
+	}
+	encap, err := readField(r, maxKeyField)
+	if err != nil {
+		return ChanRekey{}, err
+	}
+	if err := expectEnd(r); err != nil {
+		return ChanRekey{}, err
+	}
+	return ChanRekey{ChannelID: id, Seq: seq, RecipientKeyID: keyID, EncapKey: encap}, nil
+}
+
+func writeRequestID(b *bytes.Buffer, id uint64) {
+	var idb [8]byte
+	binary.BigEndian.PutUint64(idb[:], id)
+	_ = writeBlob(b, idb[:])
+}
+
+func readRequestID(r *bytes.Reader) (uint64, error) {
+	idb, err := readField(r, 8)
+	if err != nil {
+		return 0, err
+	}
+	if len(idb) != 8 {
+		return 0, fmt.Errorf("bad request id")
+	}
+	return binary.BigEndian.Uint64(idb), nil
+}
+
 // Goodbye message: just the sender ID
 type Goodbye struct {
 	SenderID PeerID
@@ -223,9 +1166,12 @@ func encodeGoodbye(g Goodbye) []byte {
 
 func decodeGoodbye(p []byte) (Goodbye, error) {
 	r := bytes.NewReader(p)
-	id, err := readBlob(r)
+	id, err := readField(r, maxNameField)
 	if err != nil {
 		return Goodbye{}, err
 	}
+	if err := expectEnd(r); err != nil {
+		return Goodbye{}, err
+	}
 	return Goodbye{SenderID: PeerID(id)}, nil
 }
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	libp2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/pivaldi/tmd/internal/keyid"
+)
+
+func TestWriteMsgLimitFragments(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 3*minMaxFrame+17)
+
+	var buf bytes.Buffer
+	if err := writeMsgLimit(&buf, msgRequest, payload, minMaxFrame, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every frame on the wire honours the limit.
+	frames := bytes.NewReader(buf.Bytes())
+	count := 0
+	for frames.Len() > 0 {
+		typ, p, err := readMsgLimit(frames, minMaxFrame)
+		if err != nil {
+			t.Fatalf("frame %d: %v", count, err)
+		}
+		if typ != msgFragment {
+			t.Fatalf("frame %d: type %d, want FRAGMENT", count, typ)
+		}
+		if more := p[0] == 1; more != (frames.Len() > 0) {
+			t.Fatalf("frame %d: more=%v with %d bytes left", count, more, frames.Len())
+		}
+		count++
+	}
+	if count != 4 {
+		t.Fatalf("got %d fragments, want 4", count)
+	}
+
+	typ, got, err := readMessage(bytes.NewReader(buf.Bytes()), minMaxFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != msgRequest || !bytes.Equal(got, payload) {
+		t.Fatalf("reassembled type %d, %d bytes; want %d, %d bytes", typ, len(got), msgRequest, len(payload))
+	}
+}
+
+func TestWriteMsgLimitRefusesWithoutFragments(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeMsgLimit(&buf, msgRequest, make([]byte, minMaxFrame), minMaxFrame, false)
+	var tooLarge *frameTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Limit != minMaxFrame || tooLarge.Size != minMaxFrame+1 {
+		t.Fatalf("err = %v, want frameTooLargeError", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes written for a refused message", buf.Len())
+	}
+
+	// Small messages go out as a single plain frame either way.
+	if err := writeMsgLimit(&buf, msgGoodbye, []byte("hi"), minMaxFrame, true); err != nil {
+		t.Fatal(err)
+	}
+	if typ, p, err := readMsg(&buf); err != nil || typ != msgGoodbye || string(p) != "hi" {
+		t.Fatalf("readMsg = %d %q %v", typ, p, err)
+	}
+}
+
+func TestReadMsgLimitRejectsOversizedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeMsg(&buf, msgRequest, make([]byte, minMaxFrame)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := readMsgLimit(&buf, minMaxFrame)
+	var tooLarge *frameTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("err = %v, want frameTooLargeError", err)
+	}
+}
+
+func TestReadMessageRejectsInterleavedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	_ = writeMsg(&buf, msgFragment, []byte{1, msgRequest, 'a'})
+	_ = writeMsg(&buf, msgGoodbye, nil)
+	if _, _, err := readMessage(&buf, defaultMaxFrame); err == nil {
+		t.Fatal("interleaved frame accepted")
+	}
+}
+
+func TestChallengeAndHelloLimits(t *testing.T) {
+	chal := make([]byte, 32)
+	_, _ = rand.Read(chal)
+
+	got, maxFrame, _, _, err := decodeChallenge(encodeChallenge(chal, 4096, nil, 0))
+	if err != nil || !bytes.Equal(got, chal) || maxFrame != 4096 {
+		t.Fatalf("decodeChallenge = %x %d %v", got, maxFrame, err)
+	}
+	if _, maxFrame, _, _, err := decodeChallenge(chal); err != nil || maxFrame != 0 {
+		t.Fatalf("legacy challenge: %d %v", maxFrame, err)
+	}
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	for _, mf := range []uint32{0, 4096} {
+		h := Hello{SenderID: "alice", SenderKeyID: make([]byte, KeyIDSize), SenderEdPub: pub, SenderHPKEPub: make([]byte, 32), MaxFrame: mf}
+		h.Signature = ed25519.Sign(priv, helloSignInput(chal, h))
+		dec, err := decodeHello(encodeHello(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dec.MaxFrame != mf {
+			t.Fatalf("MaxFrame = %d, want %d", dec.MaxFrame, mf)
+		}
+		if err := verifySignedHello(nil, chal, dec); err != nil {
+			t.Fatalf("max frame %d: %v", mf, err)
+		}
+
+		// The advertised limit is covered by the signature.
+		dec.MaxFrame++
+		if err := verifySignedHello(nil, chal, dec); err == nil {
+			t.Fatalf("max frame %d: tampered limit verified", mf)
+		}
+	}
+
+	if _, _, err := negotiateFrameLimit(minMaxFrame - 1); err == nil {
+		t.Fatal("limit below minimum accepted")
+	}
+	if limit, frag, _ := negotiateFrameLimit(0); limit != defaultMaxFrame || frag {
+		t.Fatalf("legacy peer: limit %d fragments %v", limit, frag)
+	}
+}
+
+// TestStrictDecoding checks that decoders refuse fields over their limit
+// or past the end of the message, and bytes after the last field.
+func TestStrictDecoding(t *testing.T) {
+	req := encodeRequest(Request{RequestID: 7, RecipientKeyID: make([]byte, KeyIDSize), EncapKey: []byte{1}, MediaType: []byte(reqMediaType), Ciphertext: []byte("ct")})
+	if _, err := decodeRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeRequest(append(req, 0)); err == nil {
+		t.Fatal("trailing byte accepted")
+	}
+	if _, err := decodeRequest(req[:len(req)-1]); err == nil {
+		t.Fatal("truncated ciphertext accepted")
+	}
+
+	// A length claiming more than the message holds is refused before
+	// anything is allocated.
+	var b bytes.Buffer
+	writeRequestID(&b, 7)
+	b.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := decodeStreamData(b.Bytes()); err == nil {
+		t.Fatal("overrunning blob accepted")
+	}
+
+	long := Request{RequestID: 7, RecipientKeyID: make([]byte, KeyIDSize), EncapKey: []byte{1}, MediaType: make([]byte, maxMediaType+1)}
+	if _, err := decodeRequest(encodeRequest(long)); err == nil {
+		t.Fatal("oversized media type accepted")
+	}
+	if _, err := decodeGoodbye(encodeGoodbye(Goodbye{SenderID: PeerID(make([]byte, maxNameField+1))})); err == nil {
+		t.Fatal("oversized sender ID accepted")
+	}
+	if _, err := decodeChanClose(append(encodeChanClose(ChanClose{ChannelID: 1}), 0)); err == nil {
+		t.Fatal("trailing byte after a channel ID accepted")
+	}
+}
+
+func TestNotifyRoundTrip(t *testing.T) {
+	n := Notify{RecipientKeyID: make([]byte, KeyIDSize), EncapKey: []byte{1, 2}, MediaType: []byte(notifyMediaType), Ciphertext: []byte("ct")}
+	got, err := decodeNotify(encodeNotify(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.EncapKey, n.EncapKey) || string(got.MediaType) != notifyMediaType || string(got.Ciphertext) != "ct" {
+		t.Fatalf("decodeNotify = %+v", got)
+	}
+
+	n.RecipientKeyID = n.RecipientKeyID[:4]
+	if _, err := decodeNotify(encodeNotify(n)); err == nil {
+		t.Fatal("short recipient keyID accepted")
+	}
+}
+
+func TestRoomMessageRoundTrip(t *testing.T) {
+	m := RoomMessage{Room: "#dev", Gen: 3, Nonce: make([]byte, 24), Ciphertext: []byte("ct")}
+	got, err := decodeRoomMessage(encodeRoomMessage(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Room != "#dev" || got.Gen != 3 || len(got.Nonce) != 24 || string(got.Ciphertext) != "ct" {
+		t.Fatalf("decodeRoomMessage = %+v", got)
+	}
+
+	name, key, err := decodeSenderKey(encodeSenderKey("#dev", newSenderKey(7)))
+	if err != nil || name != "#dev" || key.gen != 7 || len(key.key) != 32 {
+		t.Fatalf("decodeSenderKey = %q %+v %v", name, key, err)
+	}
+	if _, _, err := decodeSenderKey(encodeSenderKey("#dev", senderKey{gen: 1, key: []byte("short")})); err == nil {
+		t.Fatal("short sender key accepted")
+	}
+}
+
+func TestFileFramesRoundTrip(t *testing.T) {
+	sealed := Notify{RecipientKeyID: make([]byte, KeyIDSize), EncapKey: []byte("ek"), MediaType: []byte(fileChunkMediaType), Ciphertext: []byte("ct")}
+	id := bytes.Repeat([]byte{7}, fileIDSize)
+
+	o, err := decodeFileOffer(encodeFileOffer(FileOffer{TransferID: id, Chunks: 3, Sealed: sealed}))
+	if err != nil || !bytes.Equal(o.TransferID, id) || o.Chunks != 3 || string(o.Sealed.Ciphertext) != "ct" {
+		t.Fatalf("decodeFileOffer = %+v %v", o, err)
+	}
+	c, err := decodeFileChunk(encodeFileChunk(FileChunk{TransferID: id, Index: 2, Sealed: sealed}))
+	if err != nil || c.Index != 2 || string(c.Sealed.MediaType) != fileChunkMediaType {
+		t.Fatalf("decodeFileChunk = %+v %v", c, err)
+	}
+	if _, err := decodeFileChunk(encodeFileChunk(FileChunk{TransferID: id[:4], Sealed: sealed})); err == nil {
+		t.Fatal("short transfer ID accepted")
+	}
+
+	r, err := decodeFileResume(encodeFileResume(FileResume{TransferID: id, Missing: [][2]uint32{{1, 3}, {7, 8}}}))
+	if err != nil || len(r.Missing) != 2 || r.Missing[0] != [2]uint32{1, 3} || r.Missing[1] != [2]uint32{7, 8} {
+		t.Fatalf("decodeFileResume = %+v %v", r, err)
+	}
+	if _, err := decodeFileResume(encodeFileResume(FileResume{TransferID: id, Missing: [][2]uint32{{3, 3}}})); err == nil {
+		t.Fatal("empty chunk range accepted")
+	}
+
+	gotID, index, data, err := decodeFileChunkPlain(fileChunkPlain(id, 5, []byte("data")))
+	if err != nil || !bytes.Equal(gotID, id) || index != 5 || string(data) != "data" {
+		t.Fatalf("decodeFileChunkPlain = %x %d %q %v", gotID, index, data, err)
+	}
+}
+
+func TestStreamFramesRoundTrip(t *testing.T) {
+	o, err := decodeStreamOpen(encodeStreamOpen(StreamOpen{RequestID: 9, RecipientKeyID: make([]byte, KeyIDSize), EncapKey: []byte("ek"), MediaType: []byte("mt")}))
+	if err != nil || o.RequestID != 9 || string(o.EncapKey) != "ek" || string(o.MediaType) != "mt" {
+		t.Fatalf("decodeStreamOpen = %+v %v", o, err)
+	}
+	if _, err := decodeStreamOpen(encodeStreamOpen(StreamOpen{RequestID: 9, RecipientKeyID: []byte{1}})); err == nil {
+		t.Fatal("short keyID accepted")
+	}
+	d, err := decodeStreamData(encodeStreamData(StreamData{RequestID: 9, Data: []byte("ct")}))
+	if err != nil || d.RequestID != 9 || string(d.Data) != "ct" {
+		t.Fatalf("decodeStreamData = %+v %v", d, err)
+	}
+	e, err := decodeStreamEnd(encodeStreamEnd(StreamEnd{RequestID: 9, Error: "aborted"}))
+	if err != nil || e.RequestID != 9 || e.Error != "aborted" {
+		t.Fatalf("decodeStreamEnd = %+v %v", e, err)
+	}
+}
+
+func TestRequestMessageID(t *testing.T) {
+	req := Request{RequestID: 3, RecipientKeyID: make([]byte, KeyIDSize), Ciphertext: []byte("ct")}
+	got, err := decodeRequest(encodeRequest(req))
+	if err != nil || got.MessageID != nil {
+		t.Fatalf("request without ID = %+v %v", got, err)
+	}
+	req.MessageID = bytes.Repeat([]byte{9}, messageIDSize)
+	got, err = decodeRequest(encodeRequest(req))
+	if err != nil || !bytes.Equal(got.MessageID, req.MessageID) || string(got.Ciphertext) != "ct" {
+		t.Fatalf("request with ID = %+v %v", got, err)
+	}
+	req.MessageID = []byte{1, 2}
+	if _, err := decodeRequest(encodeRequest(req)); err == nil {
+		t.Fatal("short message ID accepted")
+	}
+}
+
+func TestRequestPriority(t *testing.T) {
+	req := Request{RequestID: 3, RecipientKeyID: make([]byte, KeyIDSize), Ciphertext: []byte("ct"),
+		MessageID: bytes.Repeat([]byte{9}, messageIDSize), Priority: priorityInteractive}
+	got, err := decodeRequest(encodeRequest(req))
+	if err != nil || got.Priority != priorityInteractive || !bytes.Equal(got.MessageID, req.MessageID) {
+		t.Fatalf("request with priority = %+v %v", got, err)
+	}
+	req.Priority = priorityNormal
+	if enc := encodeRequest(req); len(enc) != len(encodeRequest(Request{RequestID: 3, RecipientKeyID: req.RecipientKeyID, Ciphertext: req.Ciphertext, MessageID: req.MessageID})) {
+		t.Fatal("normal priority written on the wire")
+	}
+	bad := append(encodeRequest(req), 0, 0, 0, 2, 1, 1)
+	if _, err := decodeRequest(bad); err == nil {
+		t.Fatal("2-byte priority accepted")
+	}
+
+	req.Timeout = 1500 * time.Millisecond
+	got, err = decodeRequest(encodeRequest(req))
+	if err != nil || got.Timeout != req.Timeout || got.Priority != priorityNormal {
+		t.Fatalf("request with timeout = %+v %v", got, err)
+	}
+	req.Timeout, req.Priority = 0, priorityInteractive
+	short := append(encodeRequest(req), 0, 0, 0, 2, 0, 1)
+	if _, err := decodeRequest(short); err == nil {
+		t.Fatal("2-byte timeout accepted")
+	}
+}
+
+func TestReceiptRoundTrip(t *testing.T) {
+	r, err := decodeReceipt(encodeReceipt(Receipt{RequestID: 7, Kind: receiptRead}))
+	if err != nil || r.RequestID != 7 || r.Kind != receiptRead {
+		t.Fatalf("decodeReceipt = %+v %v", r, err)
+	}
+	if _, err := decodeReceipt(encodeStreamEnd(StreamEnd{RequestID: 7, Error: "xy"})); err == nil {
+		t.Fatal("two-byte kind accepted")
+	}
+}
+
+func TestSafeFileName(t *testing.T) {
+	for in, want := range map[string]string{
+		"report.pdf":         "report.pdf",
+		"../../etc/passwd":   "passwd",
+		`..\..\boot.ini`:     "boot.ini",
+		"/":                  "file",
+		"..":                 "file",
+		"dir/sub/notes.txt/": "notes.txt",
+	} {
+		if got := safeFileName(in); got != want {
+			t.Errorf("safeFileName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestLegacyKeyIDs checks that the single-byte key IDs of peers predating
+// full KeyIDs still decode, verify and match ours.
+func TestLegacyKeyIDs(t *testing.T) {
+	hpkePub := bytes.Repeat([]byte{7}, 32)
+	full := keyid.Of(hpkePub)
+	legacy := full[:keyid.LegacySize]
+
+	chal := make([]byte, 32)
+	_, _ = rand.Read(chal)
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	h := Hello{SenderID: "alice", SenderKeyID: legacy, SenderEdPub: pub, SenderHPKEPub: hpkePub}
+	h.Signature = ed25519.Sign(priv, helloSignInput(chal, h))
+	dec, err := decodeHello(encodeHello(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lpub, err := libp2pcrypto.UnmarshalEd25519PublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(lpub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := NewPeerTable()
+	table.Add(PeerInfo{Nickname: "alice", PeerID: id, HPKEPub: hpkePub, KeyID: full})
+	if err := verifySignedHello(nil, chal, dec); err != nil {
+		t.Fatalf("legacy HELLO rejected: %v", err)
+	}
+	if err := checkHelloPeer(dec, id, table); err != nil {
+		t.Fatalf("legacy HELLO rejected: %v", err)
+	}
+	if widened, err := keyid.Resolve(dec.SenderKeyID, dec.SenderHPKEPub); err != nil || !bytes.Equal(widened, full) {
+		t.Fatalf("widened keyID = %x, %v; want %x", widened, err, full)
+	}
+
+	req, err := decodeRequest(encodeRequest(Request{RequestID: 1, RecipientKeyID: legacy, Ciphertext: []byte("ct")}))
+	if err != nil || !full.Matches(req.RecipientKeyID) {
+		t.Fatalf("legacy request: %x, %v", req.RecipientKeyID, err)
+	}
+	// Newer frames carry full KeyIDs only.
+	if _, err := decodeStreamOpen(encodeStreamOpen(StreamOpen{RequestID: 1, RecipientKeyID: legacy})); err == nil {
+		t.Fatal("a stream opened with a legacy keyID was accepted")
+	}
+}